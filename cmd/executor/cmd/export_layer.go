@@ -0,0 +1,102 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/chainguard-dev/kaniko/pkg/executor"
+	"github.com/chainguard-dev/kaniko/pkg/logging"
+	units "github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var exportLayerOpts struct {
+	image       string
+	layer       int
+	instruction string
+	outputDir   string
+	outputTar   string
+}
+
+func init() {
+	exportLayerCmd.Flags().StringVarP(&exportLayerOpts.image, "image", "", "", "Image to export a layer of: an OCI image layout as oci:<path>, a tarball, or a reference to an image in a registry, like a cached layer.")
+	exportLayerCmd.Flags().IntVarP(&exportLayerOpts.layer, "layer", "", 0, "Index of the layer to export, counted from the last one if negative.")
+	exportLayerCmd.Flags().StringVarP(&exportLayerOpts.instruction, "instruction", "", "", "Export the last layer created by an instruction containing this text instead.")
+	exportLayerCmd.Flags().StringVarP(&exportLayerOpts.outputDir, "output-dir", "", "", "Directory to extract the files of the layer into.")
+	exportLayerCmd.Flags().StringVarP(&exportLayerOpts.outputTar, "output-tar", "", "", "Path to write the uncompressed tar of the layer to.")
+	RootCmd.AddCommand(exportLayerCmd)
+}
+
+var exportLayerCmd = &cobra.Command{
+	Use:   "export-layer",
+	Short: "Export a layer of a built or cached image to inspect the changes of its instruction",
+	Long: `Export a layer of a built or cached image to inspect the changes of its instruction.
+
+The layers of the image are listed unless --output-dir or --output-tar is set.
+The files of a layer are extracted as they are in the layer, so the files its
+instruction deleted are the empty .wh.<name> files of the whiteouts.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := logging.Configure(logLevel, logFormat, logTimestamp); err != nil {
+			return err
+		}
+		if exportLayerOpts.image == "" {
+			return errors.New("set the image to export a layer of with --image")
+		}
+		if exportLayerOpts.outputDir != "" && exportLayerOpts.outputTar != "" {
+			return errors.New("--output-dir cannot be used with --output-tar")
+		}
+		validateFlags()
+
+		image, err := executor.LoadImage(exportLayerOpts.image, opts.RegistryOptions, opts.CustomPlatform)
+		if err != nil {
+			return errors.Wrapf(err, "loading image %s", exportLayerOpts.image)
+		}
+		layers, err := executor.ImageLayers(image)
+		if err != nil {
+			return errors.Wrapf(err, "reading the layers of %s", exportLayerOpts.image)
+		}
+		if exportLayerOpts.outputDir == "" && exportLayerOpts.outputTar == "" {
+			return printLayers(cmd.OutOrStdout(), layers)
+		}
+
+		layer, err := executor.SelectLayer(layers, exportLayerOpts.layer, exportLayerOpts.instruction)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Exporting layer %d %s created by %q", layer.Index, layer.Digest, layer.CreatedBy)
+		if exportLayerOpts.outputTar != "" {
+			return executor.ExportLayerTar(layer, exportLayerOpts.outputTar)
+		}
+		return executor.ExportLayerDir(layer, exportLayerOpts.outputDir)
+	},
+}
+
+// printLayers prints the index, digest, size and instruction of layers to w
+func printLayers(w io.Writer, layers []executor.ExportedLayer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "INDEX\tDIGEST\tSIZE\tCREATED BY")
+	for _, l := range layers {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", l.Index, l.Digest, units.HumanSize(float64(l.Size)), l.CreatedBy)
+	}
+	return tw.Flush()
+}
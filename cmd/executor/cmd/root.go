@@ -17,7 +17,9 @@ limitations under the License.
 package cmd
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"os/exec"
@@ -27,23 +29,38 @@ import (
 	"strings"
 	"time"
 
+	"github.com/chainguard-dev/kaniko/pkg/audit"
 	"github.com/chainguard-dev/kaniko/pkg/buildcontext"
+	"github.com/chainguard-dev/kaniko/pkg/cache"
+	"github.com/chainguard-dev/kaniko/pkg/commands"
 	"github.com/chainguard-dev/kaniko/pkg/config"
 	"github.com/chainguard-dev/kaniko/pkg/constants"
+	"github.com/chainguard-dev/kaniko/pkg/creds"
+	"github.com/chainguard-dev/kaniko/pkg/dockerfile"
 	"github.com/chainguard-dev/kaniko/pkg/executor"
+	"github.com/chainguard-dev/kaniko/pkg/hermetic"
+	"github.com/chainguard-dev/kaniko/pkg/isolation"
 	"github.com/chainguard-dev/kaniko/pkg/logging"
+	"github.com/chainguard-dev/kaniko/pkg/profiling"
+	"github.com/chainguard-dev/kaniko/pkg/progress"
 	"github.com/chainguard-dev/kaniko/pkg/timing"
 	"github.com/chainguard-dev/kaniko/pkg/util"
 	"github.com/chainguard-dev/kaniko/pkg/util/proc"
 	"github.com/containerd/containerd/platforms"
-	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
+	"golang.org/x/sys/unix"
 )
 
+// stdinDockerfile is the --dockerfile value used to read the Dockerfile from standard input
+const stdinDockerfile = "-"
+
+// sourceDateEpochEnv is the environment variable defaulting --source-date-epoch
+const sourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
 var (
 	opts         = &config.KanikoOptions{}
 	ctxSubPath   string
@@ -51,6 +68,7 @@ var (
 	logLevel     string
 	logFormat    string
 	logTimestamp bool
+	profiler     *profiling.Profiler
 )
 
 func init() {
@@ -68,33 +86,12 @@ func init() {
 func validateFlags() {
 	checkNoDeprecatedFlags()
 
-	// Allow setting --registry-mirror using an environment variable.
-	if val, ok := os.LookupEnv("KANIKO_REGISTRY_MIRROR"); ok {
-		opts.RegistryMirrors.Set(val)
-	}
-
-	// Allow setting --no-push using an environment variable.
-	if val, ok := os.LookupEnv("KANIKO_NO_PUSH"); ok {
-		valBoolean, err := strconv.ParseBool(val)
-		if err != nil {
-			errors.New("invalid value (true/false) for KANIKO_NO_PUSH environment variable")
-		}
-		opts.NoPush = valBoolean
-	}
-
-	// Allow setting --registry-maps using an environment variable.
-	if val, ok := os.LookupEnv("KANIKO_REGISTRY_MAP"); ok {
-		opts.RegistryMaps.Set(val)
-	}
-
-	for _, target := range opts.RegistryMirrors {
-		opts.RegistryMaps.Set(fmt.Sprintf("%s=%s", name.DefaultRegistry, target))
-	}
+	opts.ResolveRegistryMaps()
 
-	if len(opts.RegistryMaps) > 0 {
-		for src, dsts := range opts.RegistryMaps {
-			logrus.Debugf("registry-map remaps %s to %s.", src, strings.Join(dsts, ", "))
-		}
+	// The cached layers are written to the first cache repo unless another
+	// one is designated
+	if opts.CacheRepo == "" && len(opts.CacheRepos) > 0 {
+		opts.CacheRepo = opts.CacheRepos[0]
 	}
 
 	// Default the custom platform flag to our current platform, and validate it.
@@ -111,6 +108,9 @@ var RootCmd = &cobra.Command{
 	Use: "executor",
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 		if cmd.Use == "executor" {
+			if err := config.SetFlagsFromEnv(cmd.Flags()); err != nil {
+				return err
+			}
 
 			if err := logging.Configure(logLevel, logFormat, logTimestamp); err != nil {
 				return err
@@ -124,23 +124,119 @@ var RootCmd = &cobra.Command{
 				dir = opts.KanikoDir
 			}
 
-			if err := checkKanikoDir(dir); err != nil {
+			nested, err := relocateNestedKanikoDir(dir)
+			if err != nil {
 				return err
 			}
+			if !nested {
+				if err := checkKanikoDir(dir); err != nil {
+					return err
+				}
+				if err := lockKanikoDir(dir); err != nil {
+					return err
+				}
+			}
+
+			config.SetWorkDirs(opts.StagingDir, opts.ScratchDir, opts.BuildContextDir)
+			for _, d := range config.WorkDirs() {
+				if err := os.MkdirAll(d, 0o755); err != nil {
+					return errors.Wrapf(err, "creating working directory %s", d)
+				}
+				util.AddToDefaultIgnoreList(util.IgnoreListEntry{Path: d})
+			}
+			commands.SetCacheMountDir(opts.CacheMountDir)
+			if opts.CacheMountDir != "" {
+				util.AddToDefaultIgnoreList(util.IgnoreListEntry{Path: opts.CacheMountDir})
+			}
 
 			resolveEnvironmentBuildArgs(opts.BuildArgs, os.Getenv)
 
 			if !opts.NoPush && len(opts.Destinations) == 0 {
 				return errors.New("you must provide --destination, or use --no-push")
 			}
+			if opts.HashJobs < 1 || opts.UploadJobs < 1 || opts.CacheProbeJobs < 1 || opts.CacheRestoreJobs < 1 || opts.CompressionJobs < 0 {
+				return errors.New("--hash-jobs, --upload-jobs, --cache-probe-jobs and --cache-restore-jobs must be at least 1, and --compression-jobs must not be negative")
+			}
+			if opts.Compression == config.ZStd && opts.MediaTypes == config.MediaTypesDocker {
+				return errors.New("--compression=zstd requires OCI media types, Docker images do not support zstd compressed layers")
+			}
+			if opts.PushStages && opts.CacheRepo == "" && len(opts.Destinations) == 0 {
+				return errors.New("if pushing stages with --no-push, specify cache repo with --cache-repo")
+			}
+			if opts.SnapshotSampleRate < 0 || opts.SnapshotSampleRate > 1 {
+				return errors.New("--snapshot-sample-rate must be between 0 and 1")
+			}
 			if err := cacheFlagsValid(); err != nil {
 				return errors.Wrap(err, "cache flags invalid")
 			}
-			if err := resolveSourceContext(); err != nil {
-				return errors.Wrap(err, "error resolving source context")
+			if opts.AuditLog != "" {
+				if err := audit.Open(opts.AuditLog); err != nil {
+					return err
+				}
+			}
+			creds.SetDockerConfigDirs(opts.DockerConfigs)
+			creds.SetAuthDebug(opts.AuthDebug)
+			if err := creds.SetImagePullSecrets(opts.ImagePullSecrets); err != nil {
+				return err
+			}
+			if opts.OAuth2Config != "" {
+				if err := creds.LoadOAuth2Config(opts.OAuth2Config); err != nil {
+					return err
+				}
+			}
+			if err := creds.LoadHarborRobotAccounts(opts.HarborRobotAccounts); err != nil {
+				return err
+			}
+			// Labels and annotations set on the command line override those
+			// read from files
+			labels, err := readKeyValueFiles("--label-file", opts.LabelFiles)
+			if err != nil {
+				return err
+			}
+			opts.Labels = append(labels, opts.Labels...)
+			annotations, err := readKeyValueFiles("--annotation-file", opts.AnnotationFiles)
+			if err != nil {
+				return err
+			}
+			opts.Annotations = append(annotations, opts.Annotations...)
+			overrides, err := readKeyValueFiles("--from-image-override-file", opts.FromImageOverrideFiles)
+			if err != nil {
+				return err
+			}
+			for _, o := range overrides {
+				k, v, _ := strings.Cut(o, "=")
+				if _, ok := opts.FromImageOverrides[k]; !ok {
+					opts.FromImageOverrides[k] = v
+				}
+			}
+			if opts.SourceDateEpoch == "" {
+				opts.SourceDateEpoch = os.Getenv(sourceDateEpochEnv)
+			}
+			if _, err := opts.SourceDateEpochTime(); err != nil {
+				return err
+			}
+			if opts.DockerfilePath == stdinDockerfile && opts.SrcContext == buildcontext.TarBuildContextPrefix+"stdin" {
+				return errors.New("--dockerfile=- cannot be used with --context=tar://stdin, both would read from standard input")
+			}
+			if opts.Rebase != "" && opts.RebaseNewBase == "" {
+				return errors.New("--rebase requires the base image to rebase onto with --rebase-new-base")
 			}
-			if err := resolveDockerfilePath(); err != nil {
-				return errors.Wrap(err, "error resolving dockerfile path")
+			if opts.Rebase != "" && opts.Transcode != "" {
+				return errors.New("--rebase cannot be used with --transcode")
+			}
+			// The remote contexts and Dockerfiles are fetched with the
+			// certificates of their hosts
+			if err := util.SetHTTPCertificates(opts.HTTPCertificates, opts.HTTPClientCertificates); err != nil {
+				return err
+			}
+			// Transcoding or rebasing an image requires no build context nor Dockerfile
+			if opts.Transcode == "" && opts.Rebase == "" {
+				if err := resolveSourceContext(); err != nil {
+					return errors.Wrap(err, "error resolving source context")
+				}
+				if err := resolveDockerfilePath(); err != nil {
+					return errors.Wrap(err, "error resolving dockerfile path")
+				}
 			}
 			if len(opts.Destinations) == 0 && opts.ImageNameDigestFile != "" {
 				return errors.New("you must provide --destination if setting ImageNameDigestFile")
@@ -160,12 +256,90 @@ var RootCmd = &cobra.Command{
 					PrefixMatchOnly: false,
 				})
 			}
-			for _, p := range opts.IgnorePaths {
+			if opts.BaseImageStore != "" {
+				util.AddToDefaultIgnoreList(util.IgnoreListEntry{
+					Path:            opts.BaseImageStore,
+					PrefixMatchOnly: false,
+				})
+			}
+			if opts.ProfileDir != "" {
+				util.AddToDefaultIgnoreList(util.IgnoreListEntry{
+					Path:            opts.ProfileDir,
+					PrefixMatchOnly: false,
+				})
+			}
+			// The audit log is written all along the build, and the summary
+			// appended to at its end, like $GITHUB_STEP_SUMMARY, so both are
+			// kept apart from the filesystem of the image
+			for _, f := range []string{opts.AuditLog, opts.SummaryFile} {
+				if f == "" {
+					continue
+				}
+				path, err := filepath.Abs(f)
+				if err != nil {
+					return err
+				}
 				util.AddToDefaultIgnoreList(util.IgnoreListEntry{
-					Path:            p,
+					Path:            path,
 					PrefixMatchOnly: false,
 				})
 			}
+			for _, p := range opts.IgnorePaths {
+				entry, err := util.NewIgnoreListEntry(p)
+				if err != nil {
+					return errors.Wrap(err, "error parsing --ignore-path")
+				}
+				if filepath.IsAbs(entry.Path) || entry.Regexp != nil {
+					if !entry.MatchesUnder(config.RootDir) {
+						return errors.Errorf("--ignore-path %s matches no path of the filesystem, check that it is not mistyped", p)
+					}
+				}
+				util.AddToDefaultIgnoreList(entry)
+			}
+			for _, p := range opts.CleanupPreservePaths {
+				entry, err := util.NewIgnoreListEntry(p)
+				if err != nil {
+					return errors.Wrap(err, "error parsing --cleanup-preserve-path")
+				}
+				util.AddToCleanupPreserveList(entry)
+			}
+			if opts.Unprivileged {
+				util.EnableOwnershipFallback()
+			}
+			if err := isolation.SetMode(opts.RunIsolation); err != nil {
+				return err
+			}
+			if err := isolation.SetDefaultNetwork(opts.DefaultRunNetwork); err != nil {
+				return err
+			}
+			if err := hermetic.SetMode(opts.HermeticCheck, opts.HermeticAllow); err != nil {
+				return err
+			}
+			if err := executor.ValidateRunRecording(opts); err != nil {
+				return err
+			}
+			if opts.RecordRuns != "" || opts.ReplayRuns != "" {
+				logrus.Warn("Recording and replaying RUN instructions is experimental")
+				hermetic.Record()
+			}
+			if err := commands.SetSecrets(opts.Secrets); err != nil {
+				return err
+			}
+			if err := commands.SetSSH(opts.SSH); err != nil {
+				return err
+			}
+			if err := util.SetRegistryLimits(opts.RegistryOptions); err != nil {
+				return err
+			}
+			if err := util.ValidateRegistryIPFamilies(opts.RegistryIPFamilies); err != nil {
+				return err
+			}
+			if err := executor.ValidateSummaryFormat(opts); err != nil {
+				return err
+			}
+			if err := startProfiling(); err != nil {
+				return err
+			}
 		}
 		return nil
 	},
@@ -187,12 +361,30 @@ var RootCmd = &cobra.Command{
 		if err := os.Chdir("/"); err != nil {
 			exit(errors.Wrap(err, "error changing to root dir"))
 		}
-		image, err := executor.DoBuild(opts)
-		if err != nil {
-			exit(errors.Wrap(err, "error building image"))
+		if opts.SummaryFile != "" {
+			executor.StartSummary()
+		}
+		stopHeartbeat := progress.Start(opts.HeartbeatInterval)
+		var image v1.Image
+		var err error
+		if opts.Transcode != "" {
+			if image, err = executor.DoTranscode(opts); err != nil {
+				exit(summarize(nil, errors.Wrap(err, "error transcoding image")))
+			}
+		} else if opts.Rebase != "" {
+			if image, err = executor.DoRebase(opts); err != nil {
+				exit(summarize(nil, errors.Wrap(err, "error rebasing image")))
+			}
+		} else if image, err = executor.DoBuild(opts); err != nil {
+			exit(summarize(nil, errors.Wrap(err, "error building image")))
 		}
 		if err := executor.DoPush(image, opts); err != nil {
-			exit(errors.Wrap(err, "error pushing image"))
+			exit(summarize(image, errors.Wrap(err, "error pushing image")))
+		}
+		summarize(image, nil)
+		stopHeartbeat()
+		if err := profiler.Stop(); err != nil {
+			logrus.Warnf("Unable to write profiles: %v", err)
 		}
 
 		benchmarkFile := os.Getenv("BENCHMARK_FILE")
@@ -225,13 +417,26 @@ var RootCmd = &cobra.Command{
 
 // addKanikoOptionsFlags configures opts
 func addKanikoOptionsFlags() {
-	RootCmd.PersistentFlags().StringVarP(&opts.DockerfilePath, "dockerfile", "f", "Dockerfile", "Path to the dockerfile to be built.")
+	RootCmd.PersistentFlags().StringVarP(&opts.DockerfilePath, "dockerfile", "f", "Dockerfile", "Path or http(s) URL to the dockerfile to be built. Use '-' to read the dockerfile from standard input.")
+	opts.DockerfileHeaders = make(map[string]string)
+	RootCmd.PersistentFlags().VarP(&opts.DockerfileHeaders, "dockerfile-header", "", "HTTP header to send when fetching the dockerfile from a URL. Expected format is 'Header-Name=value'. Set it repeatedly for multiple headers.")
+	opts.HTTPCertificates = make(map[string]string)
+	RootCmd.PersistentFlags().VarP(&opts.HTTPCertificates, "http-certificate", "", "Use the provided CA certificate to verify the given host when fetching remote files, dockerfiles and build contexts from it. Expected format is 'files.example.com=/path/to/ca/cert'.")
+	opts.HTTPClientCertificates = make(map[string]string)
+	RootCmd.PersistentFlags().VarP(&opts.HTTPClientCertificates, "http-client-cert", "", "Use the provided client certificate for mutual TLS (mTLS) communication with the given host when fetching remote files, dockerfiles and build contexts from it. Expected format is 'files.example.com=/path/to/client/cert,/path/to/client/key'.")
+	opts.FromImageOverrides = make(map[string]string)
+	RootCmd.PersistentFlags().VarP(&opts.FromImageOverrides, "from-image-override", "", "Replace an image of the dockerfile, the base image of a stage by its name or the image of a FROM or COPY --from, like with one pinned to a digest as alpine=alpine@sha256:... Set it repeatedly for multiple images.")
+	RootCmd.PersistentFlags().VarP(&opts.FromImageOverrideFiles, "from-image-override-file", "", "Read --from-image-override replacements from a lockfile of IMAGE=REPLACEMENT lines. Set it repeatedly for multiple files.")
+	RootCmd.PersistentFlags().VarP(&opts.DockerfileFragments, "dockerfile-fragment", "", "Path or http(s) URL of a dockerfile fragment to append to the dockerfile. Relative paths are resolved against the build context. Set it repeatedly for multiple fragments.")
 	RootCmd.PersistentFlags().StringVarP(&opts.SrcContext, "context", "c", "/workspace/", "Path to the dockerfile build context.")
 	RootCmd.PersistentFlags().StringVarP(&ctxSubPath, "context-sub-path", "", "", "Sub path within the given context.")
 	RootCmd.PersistentFlags().StringVarP(&opts.Bucket, "bucket", "b", "", "Name of the GCS bucket from which to access build context as tarball.")
 	RootCmd.PersistentFlags().VarP(&opts.Destinations, "destination", "d", "Registry the final image should be pushed to. Set it repeatedly for multiple destinations.")
 	RootCmd.PersistentFlags().StringVarP(&opts.SnapshotMode, "snapshot-mode", "", "full", "Change the file attributes inspected during snapshotting")
+	RootCmd.PersistentFlags().Float64VarP(&opts.SnapshotSampleRate, "snapshot-sample-rate", "", 0.01, "Fraction of the files whose contents are verified when snapshotting with --snapshot-mode=sampled, between 0 and 1")
 	RootCmd.PersistentFlags().StringVarP(&opts.CustomPlatform, "custom-platform", "", "", "Specify the build platform if different from the current host")
+	RootCmd.PersistentFlags().StringVarP(&opts.OSVersion, "os-version", "", "", "Set the os.version of the image config, like the Windows build the image requires")
+	RootCmd.PersistentFlags().VarP(&opts.OSFeatures, "os-features", "", "Set an entry of the os.features of the image config. Set it repeatedly for multiple features.")
 	RootCmd.PersistentFlags().VarP(&opts.BuildArgs, "build-arg", "", "This flag allows you to pass in ARG values at build time. Set it repeatedly for multiple values.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.Insecure, "insecure", "", false, "Push to insecure registry using plain HTTP")
 	RootCmd.PersistentFlags().BoolVarP(&opts.SkipTLSVerify, "skip-tls-verify", "", false, "Push to insecure registry ignoring TLS verify")
@@ -241,24 +446,65 @@ func addKanikoOptionsFlags() {
 	RootCmd.PersistentFlags().BoolVar(&opts.PushIgnoreImmutableTagErrors, "push-ignore-immutable-tag-errors", false, "If true, known tag immutability errors are ignored and the push finishes with success.")
 	RootCmd.PersistentFlags().IntVar(&opts.ImageFSExtractRetry, "image-fs-extract-retry", 0, "Number of retries for image FS extraction")
 	RootCmd.PersistentFlags().IntVar(&opts.ImageDownloadRetry, "image-download-retry", 0, "Number of retries for downloading the remote image")
+	RootCmd.PersistentFlags().IntVarP(&opts.HashJobs, "hash-jobs", "", 1, "Number of files hashed concurrently when snapshotting the filesystem")
+	RootCmd.PersistentFlags().BoolVarP(&opts.SnapshotDirDigests, "snapshot-dir-digests", "", false, "Keep the metadata of the files between the snapshots of a stage, and watch the directories with inotify, to not hash again the files which did not change nor walk again the directories in which nothing changed.")
+	RootCmd.PersistentFlags().IntVarP(&opts.CompressionJobs, "compression-jobs", "", 0, "Maximum number of layers compressed concurrently while pushing or saving the image. Unlimited when set to 0.")
+	RootCmd.PersistentFlags().IntVarP(&opts.CacheProbeJobs, "cache-probe-jobs", "", 8, "Number of cached layers of a stage looked up concurrently. With 1, they are looked up one at a time until one is missing.")
+	RootCmd.PersistentFlags().IntVarP(&opts.CacheRestoreJobs, "cache-restore-jobs", "", 4, "Number of layers fetched concurrently when restoring the filesystem of a stage whose commands are all cached.")
+	RootCmd.PersistentFlags().IntVarP(&opts.UploadJobs, "upload-jobs", "", 4, "Number of layers uploaded concurrently when pushing an image")
 	RootCmd.PersistentFlags().StringVarP(&opts.KanikoDir, "kaniko-dir", "", constants.DefaultKanikoPath, "Path to the kaniko directory, this takes precedence over the KANIKO_DIR environment variable.")
-	RootCmd.PersistentFlags().StringVarP(&opts.TarPath, "tar-path", "", "", "Path to save the image in as a tarball instead of pushing")
+	RootCmd.PersistentFlags().StringVarP(&opts.StagingDir, "staging-dir", "", "", "Directory the files and images copied from by later stages are extracted into. Defaults to the kaniko directory.")
+	RootCmd.PersistentFlags().StringVarP(&opts.CacheMountDir, "cache-mount-dir", "", "", "Directory holding the persistent directories of RUN --mount=type=cache, reused across builds when it is a volume. Defaults to a directory in the kaniko directory.")
+	RootCmd.PersistentFlags().StringVarP(&opts.ScratchDir, "scratch-dir", "", "", "Directory the layer tarballs and intermediate stages are written to. Defaults to the kaniko directory.")
+	RootCmd.PersistentFlags().StringVarP(&opts.BuildContextDir, "build-context-dir", "", "", "Directory remote build contexts are downloaded and unpacked into. Defaults to the buildcontext directory of the kaniko directory.")
+	RootCmd.PersistentFlags().StringVarP(&opts.ContextCacheDir, "context-cache-dir", "", "", "Directory keeping the files of manifest+https:// build contexts across builds, so that only the files changed since the previous build are fetched.")
+	RootCmd.PersistentFlags().StringVarP(&opts.TarPath, "tar-path", "", "", "Path to save the image in as a tarball. The image is also pushed to the destinations unless --no-push is set.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.SingleSnapshot, "single-snapshot", "", false, "Take a single snapshot at the end of the build.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.Reproducible, "reproducible", "", false, "Strip timestamps out of the image to make it reproducible")
+	RootCmd.PersistentFlags().BoolVarP(&opts.NormalizeLayers, "normalize-layers", "", false, "Sort the entries of the layers built and normalize their timestamps and metadata, keeping the creation time of the image, so that their digests don't depend on the builder.")
+	RootCmd.PersistentFlags().StringVarP(&opts.SourceDateEpoch, "source-date-epoch", "", "", "Unix timestamp to use as the creation time of the image in reproducible mode. Defaults to the SOURCE_DATE_EPOCH environment variable, or to the commit time of git build contexts.")
+	RootCmd.PersistentFlags().StringVarP(&opts.Transcode, "transcode", "", "", "Instead of building a Dockerfile, push this image with its layers compressed again according to --compression and --compression-level.")
+	RootCmd.PersistentFlags().StringVarP(&opts.Rebase, "rebase", "", "", "Instead of building a Dockerfile, push this image with the layers of its base image replaced by the ones of --rebase-new-base.")
+	RootCmd.PersistentFlags().StringVarP(&opts.RebaseOldBase, "rebase-old-base", "", "", "Base image of the image rebased with --rebase. Defaults to the base image recorded in its annotations.")
+	RootCmd.PersistentFlags().StringVarP(&opts.RebaseNewBase, "rebase-new-base", "", "", "Base image the image of --rebase is rebased onto.")
 	RootCmd.PersistentFlags().StringVarP(&opts.Target, "target", "", "", "Set the target build stage to build")
 	RootCmd.PersistentFlags().BoolVarP(&opts.NoPush, "no-push", "", false, "Do not push the image to the registry")
 	RootCmd.PersistentFlags().BoolVarP(&opts.NoPushCache, "no-push-cache", "", false, "Do not push the cache layers to the registry")
-	RootCmd.PersistentFlags().StringVarP(&opts.CacheRepo, "cache-repo", "", "", "Specify a repository to use as a cache, otherwise one will be inferred from the destination provided; when prefixed with 'oci:' the repository will be written in OCI image layout format at the path provided")
+	RootCmd.PersistentFlags().BoolVarP(&opts.PushStages, "push-stages", "", false, "Push the image of every named intermediate stage to the cache repo, tagged with the stage name")
+	RootCmd.PersistentFlags().VarP(&opts.PrePushHooks, "pre-push-hook", "", "Executable, or hook registered by a program embedding kaniko, run with the path of an OCI image layout holding the image before it is pushed; the last image of the layout is pushed. Set it repeatedly to run several hooks in order.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.PushBuildReport, "push-build-report", "", false, "Push the report of the build as an OCI artifact referring to the image")
+	RootCmd.PersistentFlags().StringVarP(&opts.BuildLogsURL, "build-logs-url", "", "", "URL of the logs of the build, recorded in the build report")
+	RootCmd.PersistentFlags().StringVarP(&opts.SummaryFile, "summary-file", "", "", "Write a summary of the build to this file, e.g. $GITHUB_STEP_SUMMARY or a JUnit report for GitLab CI")
+	RootCmd.PersistentFlags().StringVarP(&opts.SummaryFormat, "summary-format", "", "", "Format of the build summary: markdown or junit. Inferred from the extension of --summary-file when unset")
+	RootCmd.PersistentFlags().BoolVarP(&opts.Unprivileged, "unprivileged", "", false, "Record the file ownership that cannot be applied without the CAP_CHOWN capability, and write it into the layers anyway")
+	RootCmd.PersistentFlags().VarP(&opts.CacheRepos, "cache-repo", "", "Specify a repository to use as a cache, otherwise one will be inferred from the destination provided; when prefixed with 'oci:' the repository will be written in OCI image layout format at the path provided. Set it to s3://bucket/prefix, gs://bucket/prefix or azblob://account/container/prefix to store the cache in an S3 or GCS bucket or an Azure Blob Storage container. Set it repeatedly to look the cached layers up in several repositories, in order.")
+	RootCmd.PersistentFlags().StringVarP(&opts.CacheRepo, "cache-write-repo", "", "", "Repository the cached layers are written to, by default the first --cache-repo. It is looked up first if it is not one of the --cache-repo repositories.")
+	RootCmd.PersistentFlags().StringVarP(&opts.CacheS3KMSKeyID, "cache-s3-kms-key-id", "", "", "KMS key the objects of the cache repos stored in S3, as s3://bucket/prefix, are encrypted with using SSE-KMS.")
+	RootCmd.PersistentFlags().StringVarP(&opts.CacheExport, "cache-export", "", "", "Tarball to export the cached layers of the build to with --cache, both the ones found in the cache and the ones built, for --cache-import to use them elsewhere.")
+	RootCmd.PersistentFlags().StringVarP(&opts.CacheImport, "cache-import", "", "", "Tarball exported with --cache-export to look the cached layers up in with --cache, before the cache repos.")
 	RootCmd.PersistentFlags().StringVarP(&opts.CacheDir, "cache-dir", "", "/cache", "Specify a local directory to use as a cache.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.CacheDirWrite, "cache-dir-write", "", false, "Write the base images pulled and the layers cached with --cache to --cache-dir, for the next builds to use them.")
+	RootCmd.PersistentFlags().StringVarP(&opts.CacheDirMaxSize, "cache-dir-max-size", "", "", "Size budget of --cache-dir written with --cache-dir-write, like 20GiB. The least recently used base images and layers are evicted after the build once the cache exceeds it. Unlimited by default.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.CacheFileHashes, "cache-file-hashes", "", false, "Keep the hashes of the base image files in --cache-dir, for later builds from the same base image not to hash its unchanged files again.")
+	RootCmd.PersistentFlags().StringVarP(&opts.BaseImageStore, "base-image-store", "", "", "Directory in which to keep base images extracted across builds. Base images are extracted once, and restored from this directory by later builds.")
+	RootCmd.PersistentFlags().StringVarP(&opts.LayerIndex, "layer-index", "", "", "File indexing the layers pushed by the builds, for later builds making the same layers not to compress and upload them again.")
 	RootCmd.PersistentFlags().StringVarP(&opts.DigestFile, "digest-file", "", "", "Specify a file to save the digest of the built image to.")
 	RootCmd.PersistentFlags().StringVarP(&opts.ImageNameDigestFile, "image-name-with-digest-file", "", "", "Specify a file to save the image name w/ digest of the built image to.")
 	RootCmd.PersistentFlags().StringVarP(&opts.ImageNameTagDigestFile, "image-name-tag-with-digest-file", "", "", "Specify a file to save the image name w/ image tag w/ digest of the built image to.")
+	RootCmd.PersistentFlags().StringVarP(&opts.ImageIDFile, "iidfile", "", "", "Specify a file to save the ID of the built image to, the digest of its config like docker build --iidfile.")
 	RootCmd.PersistentFlags().StringVarP(&opts.OCILayoutPath, "oci-layout-path", "", "", "Path to save the OCI image layout of the built image.")
-	RootCmd.PersistentFlags().VarP(&opts.Compression, "compression", "", "Compression algorithm (gzip, zstd)")
-	RootCmd.PersistentFlags().IntVarP(&opts.CompressionLevel, "compression-level", "", -1, "Compression level")
+	RootCmd.PersistentFlags().StringVarP(&opts.ProfileDir, "profile-dir", "", "", "Directory to write the CPU and heap profiles and the execution trace of the build to.")
+	RootCmd.PersistentFlags().StringVarP(&opts.PprofAddress, "pprof-address", "", "", "Address to serve the pprof endpoints on during the build, like localhost:6060.")
+	RootCmd.PersistentFlags().StringVarP(&opts.ComposefsPath, "composefs-path", "", "", "Experimental: path to save the composefs metadata and objects of the built image. Requires mkcomposefs.")
+	RootCmd.PersistentFlags().VarP(&opts.Compression, "compression", "", "Compression algorithm of the pushed and cached layers (gzip, zstd). zstd builds OCI images")
+	opts.MediaTypes = config.MediaTypesAuto
+	RootCmd.PersistentFlags().VarP(&opts.MediaTypes, "media-types", "", "Media types of the manifest, config and layers of the image: auto to keep those of the base image, oci or docker")
+	RootCmd.PersistentFlags().IntVarP(&opts.CompressionLevel, "compression-level", "", -1, "Compression level of the pushed and cached layers, the default of the algorithm when not set")
 	RootCmd.PersistentFlags().BoolVarP(&opts.Cache, "cache", "", false, "Use cache when building image")
 	RootCmd.PersistentFlags().BoolVarP(&opts.CompressedCaching, "compressed-caching", "", true, "Compress the cached layers. Decreases build time, but increases memory usage.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.Cleanup, "cleanup", "", false, "Clean the filesystem at the end")
+	RootCmd.PersistentFlags().VarP(&opts.CleanupPreservePaths, "cleanup-preserve-path", "", "Keep these paths when cleaning the filesystem at the end with --cleanup, for the next builds run in the same container. Paths follow the syntax of --ignore-path. Set it repeatedly for multiple paths.")
+	RootCmd.PersistentFlags().DurationVarP(&opts.HeartbeatInterval, "heartbeat-interval", "", 0, "Interval of the heartbeats logged with the current phase, instruction, elapsed time and bytes processed, for long phases not to look stalled. Disabled by default.")
 	RootCmd.PersistentFlags().DurationVarP(&opts.CacheTTL, "cache-ttl", "", time.Hour*336, "Cache timeout, requires value and unit of duration -> ex: 6h. Defaults to two weeks.")
 	RootCmd.PersistentFlags().VarP(&opts.InsecureRegistries, "insecure-registry", "", "Insecure registry using plain HTTP to push and pull. Set it repeatedly for multiple registries.")
 	RootCmd.PersistentFlags().VarP(&opts.SkipTLSVerifyRegistries, "skip-tls-verify-registry", "", "Insecure registry ignoring TLS verify to push and pull. Set it repeatedly for multiple registries.")
@@ -266,18 +512,49 @@ func addKanikoOptionsFlags() {
 	RootCmd.PersistentFlags().VarP(&opts.RegistriesCertificates, "registry-certificate", "", "Use the provided certificate for TLS communication with the given registry. Expected format is 'my.registry.url=/path/to/the/server/certificate'.")
 	opts.RegistriesClientCertificates = make(map[string]string)
 	RootCmd.PersistentFlags().VarP(&opts.RegistriesClientCertificates, "registry-client-cert", "", "Use the provided client certificate for mutual TLS (mTLS) communication with the given registry. Expected format is 'my.registry.url=/path/to/client/cert,/path/to/client/key'.")
+	RootCmd.PersistentFlags().VarP(&opts.DockerConfigs, "docker-config", "", "Directory of a Docker config.json file to read the registry credentials from, instead of those of DOCKER_CONFIG. Set it repeatedly to merge several files, the first ones taking precedence.")
+	RootCmd.PersistentFlags().StringVarP(&opts.AuditLog, "audit-log", "", "", "Path of a file to record every registry request in, one JSON object per line.")
+	RootCmd.PersistentFlags().VarP(&opts.ImagePullSecrets, "image-pull-secret", "", "Path to a mounted Kubernetes image pull secret, the .dockerconfigjson or .dockercfg file or the directory it is mounted in, to read registry credentials from. Set it repeatedly for multiple secrets.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.AuthDebug, "auth-debug", "", false, "Log, once per repository, which credential source was selected and why the others were skipped, with the secrets redacted.")
+	RootCmd.PersistentFlags().StringVarP(&opts.OAuth2Config, "oauth2-config", "", "", "Path to a JSON file configuring OAuth2 client credentials or device flows against identity providers, and the registries their tokens are used for.")
+	RootCmd.PersistentFlags().VarP(&opts.HarborRobotAccounts, "harbor-robot-account", "", "Harbor robot account to pull and push with, as registry=path, path being the JSON file of the account exported by Harbor. The accounts of a project are only used for its repositories. Set it repeatedly for multiple accounts.")
 	opts.RegistryMaps = make(map[string][]string)
 	RootCmd.PersistentFlags().VarP(&opts.RegistryMaps, "registry-map", "", "Registry map of mirror to use as pull-through cache instead. Expected format is 'orignal.registry=new.registry;other-original.registry=other-remap.registry'")
+	opts.RegistryPushMaps = make(map[string]string)
+	RootCmd.PersistentFlags().VarP(&opts.RegistryPushMaps, "registry-push-map", "", "Push the images and cached layers of a repository to another one, like the writable upstream of a read-only virtual repository, as source.registry/repo=target.registry/repo. The repositories under source are mapped to the same path under target. Set it repeatedly for multiple repositories.")
 	RootCmd.PersistentFlags().VarP(&opts.RegistryMirrors, "registry-mirror", "", "Registry mirror to use as pull-through cache instead of docker.io. Set it repeatedly for multiple mirrors.")
+	RootCmd.PersistentFlags().VarP(&opts.RegistryUploadLimits, "registry-upload-limit", "", "Cap the bandwidth of the uploads to the registries, like 10MB per second, shared by the registries without a limit of their own, or for a registry as registry=10MB. Set it repeatedly for multiple registries.")
+	RootCmd.PersistentFlags().VarP(&opts.RegistryDownloadLimits, "registry-download-limit", "", "Cap the bandwidth of the downloads from the registries, like 10MB per second, shared by the registries without a limit of their own, or for a registry as registry=10MB. Set it repeatedly for multiple registries.")
+	RootCmd.PersistentFlags().VarP(&opts.RegistryMaxConnections, "registry-max-connections", "", "Cap the number of concurrent requests to the registries, shared by the registries without a limit of their own, or for a registry as registry=4. Set it repeatedly for multiple registries.")
+	RootCmd.PersistentFlags().VarP(&opts.RegistryIPFamilies, "registry-ip-family", "", "IP family the registries are dialed with: dual-stack, ipv4, ipv6, or prefer-ipv4 and prefer-ipv6 to fall back to the other family, for all registries or for a registry as registry=ipv4. Set it repeatedly for multiple registries.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.SkipDefaultRegistryFallback, "skip-default-registry-fallback", "", false, "If an image is not found on any mirrors (defined with registry-mirror) do not fallback to the default registry. If registry-mirror is not defined, this flag is ignored.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.PreserveResolvConf, "preserve-resolv-conf", "", false, "Preserve the changes made to /etc/resolv.conf by RUN commands in the image layers. By default they are reverted after every RUN command.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.PreserveHosts, "preserve-hosts", "", false, "Preserve the changes made to /etc/hosts by RUN commands in the image layers. By default they are reverted after every RUN command.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.IgnoreVarRun, "ignore-var-run", "", true, "Ignore /var/run directory when taking image snapshot. Set it to false to preserve /var/run/ in destination image.")
 	RootCmd.PersistentFlags().VarP(&opts.Labels, "label", "", "Set metadata for an image. Set it repeatedly for multiple labels.")
+	RootCmd.PersistentFlags().VarP(&opts.LabelFiles, "label-file", "", "Read labels from a file of KEY=VALUE lines, where quoted values may span multiple lines. Set it repeatedly for multiple files.")
+	RootCmd.PersistentFlags().VarP(&opts.Annotations, "annotation", "", "Set an annotation on the manifest of the image, in the form key=value. Set it repeatedly for multiple annotations.")
+	RootCmd.PersistentFlags().VarP(&opts.AnnotationFiles, "annotation-file", "", "Read annotations from a file of KEY=VALUE lines, where quoted values may span multiple lines. Set it repeatedly for multiple files.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.SkipUnusedStages, "skip-unused-stages", "", false, "Build only used stages if defined to true. Otherwise it builds by default all stages, even the unnecessaries ones until it reaches the target stage / end of Dockerfile")
+	RootCmd.PersistentFlags().VarP(&opts.StageMaxDurations, "stage-max-duration", "", "Fail the build when a stage takes longer than this duration, like 10m, or for a stage as stage=10m with its name or index. Set it repeatedly for multiple stages.")
+	RootCmd.PersistentFlags().VarP(&opts.StageMaxSnapshotSizes, "stage-max-snapshot-size", "", "Fail the build when the snapshots of a stage add up to more than this size, like 2GB, or for a stage as stage=2GB with its name or index. Set it repeatedly for multiple stages.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.Modernize, "modernize", "", false, "Convert deprecated Dockerfile instructions into their modern equivalents, like MAINTAINER into a label of the image authors, and log the rewrites.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.RunV2, "use-new-run", "", false, "Use the experimental run implementation for detecting changes without requiring file system snapshots.")
+	RootCmd.PersistentFlags().StringVarP(&opts.RunIsolation, "run-isolation", "", isolation.None, "Isolation of the commands run by RUN: none, or pivot-root to run them in a mount namespace hiding the kaniko directory, when permitted.")
+	RootCmd.PersistentFlags().StringVarP(&opts.DefaultRunNetwork, "default-run-network", "", isolation.NetworkHost, "Network of the commands run by RUN instructions without --network, or with --network=default: host, or none to run them without network access.")
+	RootCmd.PersistentFlags().StringVarP(&opts.HermeticCheck, "hermetic-check", "", hermetic.None, "Record the network destinations the commands run by RUN connect to: none, or report to log the ones outside of --hermetic-allow.")
+	RootCmd.PersistentFlags().VarP(&opts.HermeticAllow, "hermetic-allow", "", "IP address, CIDR network or host name, optionally followed by :port, the commands run by RUN may connect to with --hermetic-check. Set it repeatedly for multiple destinations.")
+	RootCmd.PersistentFlags().StringVarP(&opts.RecordRuns, "record-runs", "", "", "Experimental: file to record the network destinations and the files of the layer of every RUN instruction to.")
+	RootCmd.PersistentFlags().StringVarP(&opts.ReplayRuns, "replay-runs", "", "", "Experimental: file recorded with --record-runs, failing the build if a RUN instruction connects to other network destinations or changes other files.")
+	RootCmd.PersistentFlags().VarP(&opts.Secrets, "secret", "", "Secret mounted by RUN --mount=type=secret, as id=<id>,src=<path> or id=<id>,env=<variable>. Secrets are never snapshotted. Set it repeatedly for multiple secrets.")
+	RootCmd.PersistentFlags().VarP(&opts.SSH, "ssh", "", "SSH agent socket forwarded by RUN --mount=type=ssh, as <id>=<socket>, or as <id> alone, like default, for the socket of SSH_AUTH_SOCK. Set it repeatedly for multiple agents.")
 	RootCmd.PersistentFlags().Var(&opts.Git, "git", "Branch to clone if build context is a git repository")
-	RootCmd.PersistentFlags().BoolVarP(&opts.CacheCopyLayers, "cache-copy-layers", "", false, "Caches copy layers")
+	RootCmd.PersistentFlags().BoolVarP(&opts.CacheCopyLayers, "cache-copy-layers", "", true, "Caches copy layers")
 	RootCmd.PersistentFlags().BoolVarP(&opts.CacheRunLayers, "cache-run-layers", "", true, "Caches run layers")
-	RootCmd.PersistentFlags().VarP(&opts.IgnorePaths, "ignore-path", "", "Ignore these paths when taking a snapshot. Set it repeatedly for multiple paths.")
+	RootCmd.PersistentFlags().VarP(&opts.CacheKeys, "cache-key", "", "Value added to the cache keys of all the commands, like a policy epoch, to invalidate the cached layers without changing the Dockerfile. Set it repeatedly for multiple values.")
+	RootCmd.PersistentFlags().VarP(&opts.NoCacheFilter, "no-cache-filter", "", "Comma separated names of the stages whose commands are run instead of using the cached layers, like docker build --no-cache-filter. Set it repeatedly for multiple stages.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.NormalizeRunCacheKeys, "normalize-run-cache-keys", "", false, "Key the cached layers of RUN commands on their normalized form, without comments and with collapsed whitespace, to share them across reformatted Dockerfiles.")
+	RootCmd.PersistentFlags().VarP(&opts.IgnorePaths, "ignore-path", "", "Ignore these paths when taking a snapshot. Paths should be absolute, relative ones being deprecated, and may contain glob patterns, or be a regular expression matching the whole path when prefixed with 'regex:'. Set it repeatedly for multiple paths.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.ForceBuildMetadata, "force-build-metadata", "", false, "Force add metadata layers to build image")
 	RootCmd.PersistentFlags().BoolVarP(&opts.SkipPushPermissionCheck, "skip-push-permission-check", "", false, "Skip check of the push permission")
 
@@ -295,6 +572,23 @@ func addHiddenFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().MarkHidden("bucket")
 }
 
+// startProfiling starts recording profiles into --profile-dir, and serving
+// pprof on --pprof-address, when set
+func startProfiling() error {
+	if opts.PprofAddress != "" {
+		if _, err := profiling.Serve(opts.PprofAddress); err != nil {
+			return errors.Wrap(err, "serving pprof")
+		}
+	}
+	if opts.ProfileDir != "" {
+		var err error
+		if profiler, err = profiling.Start(opts.ProfileDir); err != nil {
+			return errors.Wrap(err, "starting profiling")
+		}
+	}
+	return nil
+}
+
 // checkKanikoDir will check whether the executor is operating in the default '/kaniko' directory,
 // conducting the relevant operations if it is not
 func checkKanikoDir(dir string) error {
@@ -316,6 +610,89 @@ func checkKanikoDir(dir string) error {
 	return nil
 }
 
+// kanikoDirLock is the kaniko directory locked by lockKanikoDir, kept open
+// until the executor exits
+var kanikoDirLock *os.File
+
+// lockKanikoDir locks the kaniko directory until the executor exits, for the
+// kaniko builds run by the RUN commands to detect they are nested. The lock
+// is not inherited by the commands, as files are opened close-on-exec.
+func lockKanikoDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return errors.Wrapf(err, "creating %s", dir)
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s", dir)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "locking %s", dir)
+	}
+	kanikoDirLock = f
+	return nil
+}
+
+// kanikoDirInUse returns true if dir is locked by another kaniko build
+func kanikoDirInUse(dir string) (bool, error) {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrapf(err, "opening %s", dir)
+	}
+	defer f.Close()
+	err = unix.Flock(int(f.Fd()), unix.LOCK_SH|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return true, nil
+	} else if err != nil {
+		return false, errors.Wrapf(err, "locking %s", dir)
+	}
+	return false, unix.Flock(int(f.Fd()), unix.LOCK_UN)
+}
+
+// relocateNestedKanikoDir moves the working directories of the executor into
+// a new directory when it runs inside another kaniko build, or when the kaniko
+// directory is read-only, and returns true if it did. The kaniko directory of
+// the outer build, dir or the default one, is left untouched and ignored, so
+// the executor does not clobber the files the outer build keeps there.
+func relocateNestedKanikoDir(dir string) (bool, error) {
+	parent := ""
+	for _, d := range []string{dir, constants.DefaultKanikoPath} {
+		inUse, err := kanikoDirInUse(d)
+		if err != nil {
+			return false, err
+		}
+		if inUse {
+			parent = d
+			break
+		}
+	}
+	base := filepath.Join(parent, "nested")
+	if parent == "" {
+		err := unix.Access(dir, unix.W_OK)
+		if !errors.Is(err, unix.EROFS) && !errors.Is(err, unix.EACCES) {
+			return false, nil
+		}
+		logrus.Infof("Kaniko directory %s is read-only", dir)
+		base = os.TempDir()
+	} else {
+		logrus.Infof("Running inside the kaniko build of %s", parent)
+		util.AddToDefaultIgnoreList(util.IgnoreListEntry{Path: parent})
+	}
+	if err := os.MkdirAll(base, 0o755); err != nil {
+		return false, errors.Wrapf(err, "creating %s", base)
+	}
+	nestedDir, err := os.MkdirTemp(base, "kaniko-")
+	if err != nil {
+		return false, errors.Wrap(err, "creating nested kaniko directory")
+	}
+	logrus.Infof("Using %s as kaniko directory", nestedDir)
+	config.SetKanikoDir(nestedDir)
+	util.AddToDefaultIgnoreList(util.IgnoreListEntry{Path: nestedDir})
+	return true, lockKanikoDir(nestedDir)
+}
+
 func checkContained() bool {
 	return proc.GetContainerRuntime(0, 0) != proc.RuntimeNotFound
 }
@@ -345,17 +722,43 @@ func cacheFlagsValid() error {
 		return nil
 	}
 	// If --cache=true and --no-push=true, then cache repo must be provided
-	// since cache can't be inferred from destination
-	if opts.CacheRepo == "" && opts.NoPush {
-		return errors.New("if using cache with --no-push, specify cache repo with --cache-repo")
+	// since cache can't be inferred from destination, unless the cache is only
+	// imported and exported as a tarball
+	if opts.CacheRepo == "" && opts.NoPush && opts.CacheImport == "" && opts.CacheExport == "" {
+		return errors.New("if using cache with --no-push, specify cache repo with --cache-repo, --cache-import or --cache-export")
+	}
+	for _, repo := range append([]string{opts.CacheRepo}, opts.CacheRepos...) {
+		if _, err := cache.GetBackend(opts, repo); err != nil {
+			return err
+		}
+	}
+	if _, err := opts.CacheDirMaxSizeBytes(); err != nil {
+		return err
 	}
 	return nil
 }
 
+// readKeyValueFiles returns the key=value pairs of the files set with flag
+func readKeyValueFiles(flag string, files []string) ([]string, error) {
+	var pairs []string
+	for _, file := range files {
+		p, err := config.ReadKeyValueFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading %s", flag)
+		}
+		pairs = append(pairs, p...)
+	}
+	return pairs, nil
+}
+
 // resolveDockerfilePath resolves the Dockerfile path to an absolute path
 func resolveDockerfilePath() error {
+	if opts.DockerfilePath == stdinDockerfile {
+		logrus.Info("Reading Dockerfile from standard input")
+		return copyDockerfileFromReader(os.Stdin)
+	}
 	if isURL(opts.DockerfilePath) {
-		return nil
+		return fetchDockerfile()
 	}
 	if util.FilepathExists(opts.DockerfilePath) {
 		abs, err := filepath.Abs(opts.DockerfilePath)
@@ -394,16 +797,72 @@ func copyDockerfile() error {
 	if _, err := util.CopyFile(opts.DockerfilePath, config.DockerfilePath, util.FileContext{}, util.DoNotChangeUID, util.DoNotChangeGID, fs.FileMode(0o600), true); err != nil {
 		return errors.Wrap(err, "copying dockerfile")
 	}
-	dockerignorePath := opts.DockerfilePath + ".dockerignore"
-	if util.FilepathExists(dockerignorePath) {
-		if _, err := util.CopyFile(dockerignorePath, config.DockerfilePath+".dockerignore", util.FileContext{}, util.DoNotChangeUID, util.DoNotChangeGID, fs.FileMode(0o600), true); err != nil {
-			return errors.Wrap(err, "copying Dockerfile.dockerignore")
+	if err := copyDockerignore(opts.DockerfilePath); err != nil {
+		return err
+	}
+	opts.DockerfilePath = config.DockerfilePath
+	return nil
+}
+
+// copyDockerignore copies the .dockerignore file of the Dockerfile at
+// dockerfilePath, like Dockerfile.api.dockerignore for Dockerfile.api, next to
+// /kaniko/Dockerfile, where it is used instead of the .dockerignore file of the
+// build context. The one of a previous build is removed if the Dockerfile has
+// none, or if dockerfilePath is empty.
+func copyDockerignore(dockerfilePath string) error {
+	dst := config.DockerfilePath + constants.Dockerignore
+	dockerignorePath := dockerfilePath + constants.Dockerignore
+	if dockerfilePath == "" || !util.FilepathExists(dockerignorePath) {
+		if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "removing %s", dst)
 		}
+		return nil
+	}
+	logrus.Infof("Using %s for %s", filepath.Base(dockerignorePath), filepath.Base(dockerfilePath))
+	if _, err := util.CopyFile(dockerignorePath, dst, util.FileContext{}, util.DoNotChangeUID, util.DoNotChangeGID, fs.FileMode(0o600), true); err != nil {
+		return errors.Wrapf(err, "copying %s", filepath.Base(dockerignorePath))
+	}
+	return nil
+}
+
+// copyDockerfileFromReader writes the Dockerfile read from r to /kaniko/Dockerfile,
+// this is used when the Dockerfile is passed on standard input with --dockerfile=-
+// or fetched from a URL
+func copyDockerfileFromReader(r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(config.DockerfilePath), 0750); err != nil {
+		return errors.Wrap(err, "creating dockerfile directory")
+	}
+	f, err := os.OpenFile(config.DockerfilePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return errors.Wrap(err, "creating dockerfile")
+	}
+	defer f.Close()
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return errors.Wrap(err, "reading dockerfile")
+	}
+	if n == 0 {
+		return errors.New("dockerfile is empty")
+	}
+	if err := copyDockerignore(""); err != nil {
+		return err
 	}
 	opts.DockerfilePath = config.DockerfilePath
 	return nil
 }
 
+// fetchDockerfile downloads the Dockerfile from the URL given with --dockerfile
+// to /kaniko/Dockerfile, independently of where the build context comes from
+func fetchDockerfile() error {
+	logrus.Infof("Fetching Dockerfile from %s", opts.DockerfilePath)
+	d, err := dockerfile.ReadDockerfile(opts.DockerfilePath, opts.DockerfileHeaders)
+	if err != nil {
+		return errors.Wrapf(err, "fetching dockerfile from %s", opts.DockerfilePath)
+	}
+	opts.DockerfileURL = opts.DockerfilePath
+	return copyDockerfileFromReader(bytes.NewReader(d))
+}
+
 // resolveSourceContext unpacks the source context if it is a tar in a bucket or in kaniko container
 // it resets srcContext to be the path to the unpacked build context within the image
 func resolveSourceContext() error {
@@ -426,6 +885,7 @@ func resolveSourceContext() error {
 		GitSingleBranch:      opts.Git.SingleBranch,
 		GitRecurseSubmodules: opts.Git.RecurseSubmodules,
 		InsecureSkipTLS:      opts.Git.InsecureSkipTLS,
+		ContextCacheDir:      opts.ContextCacheDir,
 	})
 	if err != nil {
 		return err
@@ -435,6 +895,16 @@ func resolveSourceContext() error {
 	if err != nil {
 		return err
 	}
+	if d, ok := contextExecutor.(buildcontext.ContentDigester); ok {
+		opts.ContextDigests = d.ContentDigests()
+	}
+	if c, ok := contextExecutor.(buildcontext.CommitTimer); ok {
+		opts.ContextCommit = c.Commit()
+	}
+	if c, ok := contextExecutor.(buildcontext.CommitTimer); ok && (opts.Reproducible || opts.NormalizeLayers) && opts.SourceDateEpoch == "" && !c.CommitTime().IsZero() {
+		opts.SourceDateEpoch = strconv.FormatInt(c.CommitTime().Unix(), 10)
+		logrus.Infof("Using the build context commit time as SOURCE_DATE_EPOCH: %s", opts.SourceDateEpoch)
+	}
 	if ctxSubPath != "" {
 		opts.SrcContext = filepath.Join(opts.SrcContext, ctxSubPath)
 		if _, err := os.Stat(opts.SrcContext); os.IsNotExist(err) {
@@ -454,6 +924,11 @@ func resolveRelativePaths() error {
 		&opts.DigestFile,
 		&opts.ImageNameDigestFile,
 		&opts.ImageNameTagDigestFile,
+		&opts.ImageIDFile,
+		&opts.RecordRuns,
+		&opts.ReplayRuns,
+		&opts.CacheExport,
+		&opts.CacheImport,
 	}
 
 	for _, p := range optsPaths {
@@ -473,6 +948,15 @@ func resolveRelativePaths() error {
 	return nil
 }
 
+// summarize writes the summary of the build of image, failed with err when not
+// nil, and returns err
+func summarize(image v1.Image, err error) error {
+	if serr := executor.WriteSummary(image, opts, err); serr != nil {
+		logrus.Warnf("Unable to write build summary: %v", serr)
+	}
+	return err
+}
+
 func exit(err error) {
 	var execErr *exec.ExitError
 	if errors.As(err, &execErr) {
@@ -485,6 +969,10 @@ func exit(err error) {
 
 // exits with the given error and exit code
 func exitWithCode(err error, exitCode int) {
+	// Keep the profiles of failed builds, os.Exit skips deferred calls
+	if perr := profiler.Stop(); perr != nil {
+		logrus.Warnf("Unable to write profiles: %v", perr)
+	}
 	fmt.Fprintln(os.Stderr, err)
 	os.Exit(exitCode)
 }
@@ -17,8 +17,12 @@ limitations under the License.
 package cmd
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/chainguard-dev/kaniko/pkg/config"
 	"github.com/chainguard-dev/kaniko/testutil"
 )
 
@@ -149,3 +153,79 @@ func TestResolveEnvironmentBuildArgs(t *testing.T) {
 		})
 	}
 }
+
+func TestCopyDockerfileFromReader(t *testing.T) {
+	dir := t.TempDir()
+	original := config.DockerfilePath
+	originalOpt := opts.DockerfilePath
+	defer func() {
+		config.DockerfilePath = original
+		opts.DockerfilePath = originalOpt
+	}()
+	config.DockerfilePath = filepath.Join(dir, "kaniko", "Dockerfile")
+	opts.DockerfilePath = stdinDockerfile
+
+	content := "FROM scratch\nCOPY foo /foo\n"
+	err := copyDockerfileFromReader(strings.NewReader(content))
+	testutil.CheckError(t, false, err)
+	testutil.CheckDeepEqual(t, config.DockerfilePath, opts.DockerfilePath)
+
+	b, err := os.ReadFile(config.DockerfilePath)
+	testutil.CheckError(t, false, err)
+	testutil.CheckDeepEqual(t, content, string(b))
+
+	err = copyDockerfileFromReader(strings.NewReader(""))
+	testutil.CheckError(t, true, err)
+}
+
+func TestCopyDockerignore(t *testing.T) {
+	dir := t.TempDir()
+	original := config.DockerfilePath
+	defer func() { config.DockerfilePath = original }()
+	config.DockerfilePath = filepath.Join(dir, "kaniko", "Dockerfile")
+	testutil.CheckNoError(t, os.MkdirAll(filepath.Dir(config.DockerfilePath), 0o755))
+
+	dockerfile := filepath.Join(dir, "Dockerfile.api")
+	testutil.CheckNoError(t, os.WriteFile(dockerfile+".dockerignore", []byte("vendor\n"), 0o644))
+	testutil.CheckNoError(t, copyDockerignore(dockerfile))
+	b, err := os.ReadFile(config.DockerfilePath + ".dockerignore")
+	testutil.CheckErrorAndDeepEqual(t, false, err, "vendor\n", string(b))
+
+	// The one of the previous build is removed
+	testutil.CheckNoError(t, copyDockerignore(filepath.Join(dir, "Dockerfile")))
+	_, err = os.Stat(config.DockerfilePath + ".dockerignore")
+	testutil.CheckDeepEqual(t, true, os.IsNotExist(err))
+}
+
+func TestRelocateNestedKanikoDir(t *testing.T) {
+	original := config.KanikoDir
+	defer config.SetKanikoDir(original)
+
+	defer func() {
+		if kanikoDirLock != nil {
+			kanikoDirLock.Close()
+			kanikoDirLock = nil
+		}
+	}()
+
+	dir := t.TempDir()
+	nested, err := relocateNestedKanikoDir(dir)
+	testutil.CheckErrorAndDeepEqual(t, false, err, false, nested)
+	testutil.CheckDeepEqual(t, original, config.KanikoDir)
+
+	// The kaniko directory is locked by the outer build
+	parent := t.TempDir()
+	testutil.CheckNoError(t, lockKanikoDir(parent))
+	outer := kanikoDirLock
+	defer outer.Close()
+	nested, err = relocateNestedKanikoDir(parent)
+	testutil.CheckErrorAndDeepEqual(t, false, err, true, nested)
+	testutil.CheckDeepEqual(t, filepath.Join(parent, "nested"), filepath.Dir(config.KanikoDir))
+	testutil.CheckDeepEqual(t, filepath.Join(config.KanikoDir, "Dockerfile"), config.DockerfilePath)
+	if _, err := os.Stat(config.KanikoDir); err != nil {
+		t.Errorf("expected nested kaniko directory to be created: %v", err)
+	}
+	// for builds nested in the nested one
+	inUse, err := kanikoDirInUse(config.KanikoDir)
+	testutil.CheckErrorAndDeepEqual(t, false, err, true, inUse)
+}
@@ -20,11 +20,14 @@ import (
 	"os"
 
 	"github.com/chainguard-dev/kaniko/cmd/executor/cmd"
+	"github.com/chainguard-dev/kaniko/pkg/isolation"
 
 	"github.com/google/slowjam/pkg/stacklog"
 )
 
 func main() {
+	isolation.Init()
+
 	s := stacklog.MustStartFromEnv("STACKLOG_PATH")
 	defer s.Stop()
 
@@ -21,15 +21,15 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
-	"strings"
 	"time"
 
+	"github.com/chainguard-dev/kaniko/pkg/audit"
 	"github.com/chainguard-dev/kaniko/pkg/cache"
 	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/creds"
 	"github.com/chainguard-dev/kaniko/pkg/logging"
 	"github.com/chainguard-dev/kaniko/pkg/util"
 	"github.com/containerd/containerd/platforms"
-	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -50,31 +50,18 @@ func init() {
 
 	addKanikoOptionsFlags()
 	addHiddenFlags()
+	RootCmd.AddCommand(pruneCmd)
 }
 
 var RootCmd = &cobra.Command{
 	Use: "cache warmer",
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-		if err := logging.Configure(logLevel, logFormat, logTimestamp); err != nil {
+		if err := configure(cmd); err != nil {
 			return err
 		}
 
-		// Allow setting --registry-maps using an environment variable.
-		// some users use warmer with --regisry-mirror before v1.21.0
-		// TODO may need all executors validation in here
-
-		if val, ok := os.LookupEnv("KANIKO_REGISTRY_MAP"); ok {
-			opts.RegistryMaps.Set(val)
-		}
-
-		for _, target := range opts.RegistryMirrors {
-			opts.RegistryMaps.Set(fmt.Sprintf("%s=%s", name.DefaultRegistry, target))
-		}
-
-		if len(opts.RegistryMaps) > 0 {
-			for src, dsts := range opts.RegistryMaps {
-				logrus.Debugf("registry-map remaps %s to %s.", src, strings.Join(dsts, ", "))
-			}
+		if _, err := opts.CacheMaxSizeBytes(); err != nil {
+			return err
 		}
 
 		if len(opts.Images) == 0 && opts.DockerfilePath == "" {
@@ -103,26 +90,104 @@ var RootCmd = &cobra.Command{
 	},
 }
 
+// pruneCmd deletes the expired base images and layers of the cache dir and of
+// the cache repos
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete the base images and layers of the cache which expired with --cache-ttl",
+	Args:  cobra.NoArgs,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return configure(cmd)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if _, err := os.Stat(opts.CacheDir); err == nil {
+			pruned, err := cache.PruneExpired(&opts.CacheOptions)
+			if err != nil {
+				exit(errors.Wrapf(err, "Failed pruning cache %s", opts.CacheDir))
+			}
+			logrus.Infof("Pruned %d expired base images and layers from %s", pruned, opts.CacheDir)
+		}
+		repoOpts := &config.KanikoOptions{RegistryOptions: opts.RegistryOptions, CacheOptions: opts.CacheOptions}
+		for _, repo := range opts.CacheRepos {
+			pruned, err := cache.PruneExpiredRepo(repoOpts, repo)
+			if err != nil {
+				exit(errors.Wrapf(err, "Failed pruning cache repo %s", repo))
+			}
+			logrus.Infof("Pruned %d expired layers from %s", pruned, repo)
+		}
+	},
+}
+
+// configure applies the flags shared by the commands of the warmer
+func configure(cmd *cobra.Command) error {
+	if err := config.SetFlagsFromEnv(cmd.Flags()); err != nil {
+		return err
+	}
+	if err := logging.Configure(logLevel, logFormat, logTimestamp); err != nil {
+		return err
+	}
+
+	// Resolve the registries to pull from like the executor does, for
+	// base images to be cached with the same mirrors and credentials.
+	opts.ResolveRegistryMaps()
+	if opts.AuditLog != "" {
+		if err := audit.Open(opts.AuditLog); err != nil {
+			return err
+		}
+	}
+	creds.SetDockerConfigDirs(opts.DockerConfigs)
+	creds.SetAuthDebug(opts.AuthDebug)
+	if err := creds.SetImagePullSecrets(opts.ImagePullSecrets); err != nil {
+		return err
+	}
+	if opts.OAuth2Config != "" {
+		if err := creds.LoadOAuth2Config(opts.OAuth2Config); err != nil {
+			return err
+		}
+	}
+	if err := creds.LoadHarborRobotAccounts(opts.HarborRobotAccounts); err != nil {
+		return err
+	}
+
+	return util.SetHTTPCertificates(opts.HTTPCertificates, opts.HTTPClientCertificates)
+}
+
 // addKanikoOptionsFlags configures opts
 func addKanikoOptionsFlags() {
 	RootCmd.PersistentFlags().VarP(&opts.Images, "image", "i", "Image to cache. Set it repeatedly for multiple images.")
 	RootCmd.PersistentFlags().StringVarP(&opts.CacheDir, "cache-dir", "c", "/cache", "Directory of the cache.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.Force, "force", "f", false, "Force cache overwriting.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.Unpack, "unpack", "", false, "Also extract the cached images, for the executor to restore their filesystem without extracting them.")
+	RootCmd.PersistentFlags().StringVarP(&opts.CacheMaxSize, "cache-max-size", "", "", "Size budget of the cache directory, like 20GiB. The least recently used images are evicted once the cache exceeds it. Unlimited by default.")
 	RootCmd.PersistentFlags().DurationVarP(&opts.CacheTTL, "cache-ttl", "", time.Hour*336, "Cache timeout in hours. Defaults to two weeks.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.InsecurePull, "insecure-pull", "", false, "Pull from insecure registry using plain HTTP")
 	RootCmd.PersistentFlags().BoolVarP(&opts.SkipTLSVerifyPull, "skip-tls-verify-pull", "", false, "Pull from insecure registry ignoring TLS verify")
+	RootCmd.PersistentFlags().IntVar(&opts.ImageDownloadRetry, "image-download-retry", 0, "Number of retries for downloading the remote image")
 	RootCmd.PersistentFlags().VarP(&opts.InsecureRegistries, "insecure-registry", "", "Insecure registry using plain HTTP to pull. Set it repeatedly for multiple registries.")
 	RootCmd.PersistentFlags().VarP(&opts.SkipTLSVerifyRegistries, "skip-tls-verify-registry", "", "Insecure registry ignoring TLS verify to pull. Set it repeatedly for multiple registries.")
 	opts.RegistriesCertificates = make(map[string]string)
 	RootCmd.PersistentFlags().VarP(&opts.RegistriesCertificates, "registry-certificate", "", "Use the provided certificate for TLS communication with the given registry. Expected format is 'my.registry.url=/path/to/the/server/certificate'.")
 	opts.RegistriesClientCertificates = make(map[string]string)
 	RootCmd.PersistentFlags().VarP(&opts.RegistriesClientCertificates, "registry-client-cert", "", "Use the provided client certificate for mutual TLS (mTLS) communication with the given registry. Expected format is 'my.registry.url=/path/to/client/cert,/path/to/client/key'.")
+	RootCmd.PersistentFlags().VarP(&opts.DockerConfigs, "docker-config", "", "Directory of a Docker config.json file to read the registry credentials from, instead of those of DOCKER_CONFIG. Set it repeatedly to merge several files, the first ones taking precedence.")
+	RootCmd.PersistentFlags().StringVarP(&opts.AuditLog, "audit-log", "", "", "Path of a file to record every registry request in, one JSON object per line.")
+	RootCmd.PersistentFlags().VarP(&opts.ImagePullSecrets, "image-pull-secret", "", "Path to a mounted Kubernetes image pull secret, the .dockerconfigjson or .dockercfg file or the directory it is mounted in, to read registry credentials from. Set it repeatedly for multiple secrets.")
+	RootCmd.PersistentFlags().BoolVarP(&opts.AuthDebug, "auth-debug", "", false, "Log, once per repository, which credential source was selected and why the others were skipped, with the secrets redacted.")
+	RootCmd.PersistentFlags().StringVarP(&opts.OAuth2Config, "oauth2-config", "", "", "Path to a JSON file configuring OAuth2 client credentials or device flows against identity providers, and the registries their tokens are used for.")
+	RootCmd.PersistentFlags().VarP(&opts.HarborRobotAccounts, "harbor-robot-account", "", "Harbor robot account to pull and push with, as registry=path, path being the JSON file of the account exported by Harbor. The accounts of a project are only used for its repositories. Set it repeatedly for multiple accounts.")
 	opts.RegistryMaps = make(map[string][]string)
 	RootCmd.PersistentFlags().VarP(&opts.RegistryMaps, "registry-map", "", "Registry map of mirror to use as pull-through cache instead. Expected format is 'orignal.registry=new.registry;other-original.registry=other-remap.registry'")
 	RootCmd.PersistentFlags().VarP(&opts.RegistryMirrors, "registry-mirror", "", "Registry mirror to use as pull-through cache instead of docker.io. Set it repeatedly for multiple mirrors.")
 	RootCmd.PersistentFlags().BoolVarP(&opts.SkipDefaultRegistryFallback, "skip-default-registry-fallback", "", false, "If an image is not found on any mirrors (defined with registry-mirror) do not fallback to the default registry. If registry-mirror is not defined, this flag is ignored.")
 	RootCmd.PersistentFlags().StringVarP(&opts.CustomPlatform, "customPlatform", "", "", "Specify the build platform if different from the current host")
 	RootCmd.PersistentFlags().StringVarP(&opts.DockerfilePath, "dockerfile", "d", "", "Path to the dockerfile to be cached. The kaniko warmer will parse and write out each stage's base image layers to the cache-dir. Using the same dockerfile path as what you plan to build in the kaniko executor is the expected usage.")
+	opts.DockerfileHeaders = make(map[string]string)
+	RootCmd.PersistentFlags().VarP(&opts.DockerfileHeaders, "dockerfile-header", "", "HTTP header to send when fetching the dockerfile from a URL. Expected format is 'Header-Name=value'. Set it repeatedly for multiple headers.")
+	opts.HTTPCertificates = make(map[string]string)
+	RootCmd.PersistentFlags().VarP(&opts.HTTPCertificates, "http-certificate", "", "Use the provided CA certificate to verify the given host when fetching remote files, dockerfiles and build contexts from it. Expected format is 'files.example.com=/path/to/ca/cert'.")
+	opts.HTTPClientCertificates = make(map[string]string)
+	RootCmd.PersistentFlags().VarP(&opts.HTTPClientCertificates, "http-client-cert", "", "Use the provided client certificate for mutual TLS (mTLS) communication with the given host when fetching remote files, dockerfiles and build contexts from it. Expected format is 'files.example.com=/path/to/client/cert,/path/to/client/key'.")
+	pruneCmd.Flags().VarP(&opts.CacheRepos, "cache-repo", "", "Cache repo to delete the expired layers from, a registry repository or the location of a cache backend like s3://bucket/prefix. Set it repeatedly for multiple repos.")
 	RootCmd.PersistentFlags().VarP(&opts.BuildArgs, "build-arg", "", "This flag should be used in conjunction with the dockerfile flag for scenarios where dynamic replacement of the base image is required.")
 
 	// Default the custom platform flag to our current platform, and validate it.
@@ -0,0 +1,156 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package audit records the requests made to the registries in an audit log,
+// one JSON object per line.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Record is the entry of the audit log of a registry request
+type Record struct {
+	Time          time.Time `json:"time"`
+	Method        string    `json:"method"`
+	Host          string    `json:"host"`
+	URL           string    `json:"url"`
+	Digest        string    `json:"digest,omitempty"`
+	Status        int       `json:"status,omitempty"`
+	RequestBytes  int64     `json:"requestBytes"`
+	ResponseBytes int64     `json:"responseBytes"`
+	DurationMS    int64     `json:"durationMs"`
+	Error         string    `json:"error,omitempty"`
+}
+
+var (
+	mu  sync.Mutex
+	out io.Writer
+
+	digestRegexp = regexp.MustCompile(`[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-fA-F0-9]{32,}`)
+)
+
+// Open starts recording the registry requests to the audit log at path.
+func Open(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return errors.Wrap(err, "opening audit log")
+	}
+	SetOutput(f)
+	return nil
+}
+
+// SetOutput starts recording the registry requests to w, or stops recording
+// them if w is nil.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+func enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return out != nil
+}
+
+func write(r *Record) {
+	mu.Lock()
+	defer mu.Unlock()
+	if out == nil {
+		return
+	}
+	if err := json.NewEncoder(out).Encode(r); err != nil {
+		logrus.Warnf("Unable to write to audit log: %v", err)
+	}
+}
+
+// Transport returns a transport recording the requests made with tr in the
+// audit log, if it is enabled.
+func Transport(tr http.RoundTripper) http.RoundTripper {
+	if !enabled() {
+		return tr
+	}
+	return &transport{inner: tr}
+}
+
+type transport struct {
+	inner http.RoundTripper
+}
+
+// RoundTrip records the request once its response body is closed, for the
+// record to hold the size and duration of the whole transfer.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The query strings may hold credentials, like presigned URLs
+	u := *req.URL
+	u.RawQuery = ""
+	r := &Record{
+		Time:   time.Now().UTC(),
+		Method: req.Method,
+		Host:   req.URL.Host,
+		URL:    u.String(),
+		Digest: digestRegexp.FindString(req.URL.Path),
+	}
+	if req.ContentLength > 0 {
+		r.RequestBytes = req.ContentLength
+	}
+
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil {
+		r.Error = err.Error()
+		r.DurationMS = time.Since(r.Time).Milliseconds()
+		write(r)
+		return nil, err
+	}
+	r.Status = resp.StatusCode
+	if d := resp.Header.Get("Docker-Content-Digest"); d != "" {
+		r.Digest = d
+	}
+	resp.Body = &body{ReadCloser: resp.Body, record: r}
+	return resp, nil
+}
+
+// body counts the bytes read from a response body, and writes the record of
+// the request when closed.
+type body struct {
+	io.ReadCloser
+	record *Record
+	once   sync.Once
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.record.ResponseBytes += int64(n)
+	return n, err
+}
+
+func (b *body) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.record.DurationMS = time.Since(b.record.Time).Milliseconds()
+		write(b.record)
+	})
+	return err
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestTransport(t *testing.T) {
+	const digest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/manifests/") {
+			w.Header().Set("Docker-Content-Digest", digest)
+		}
+		io.WriteString(w, "content")
+	}))
+	defer registry.Close()
+
+	if tr := Transport(http.DefaultTransport); tr != http.DefaultTransport {
+		t.Error("requests are recorded without an audit log")
+	}
+	var log bytes.Buffer
+	SetOutput(&log)
+	defer SetOutput(nil)
+	client := &http.Client{Transport: Transport(http.DefaultTransport)}
+
+	for _, path := range []string{"/v2/app/blobs/" + digest + "?X-Amz-Signature=secret", "/v2/app/manifests/latest"} {
+		resp, err := client.Get(registry.URL + path)
+		testutil.CheckNoError(t, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	_, err := client.Post("http://127.0.0.1:0/v2/app/blobs/uploads/", "text/plain", strings.NewReader("layer"))
+	testutil.CheckError(t, true, err)
+
+	var records []Record
+	dec := json.NewDecoder(&log)
+	for dec.More() {
+		var r Record
+		testutil.CheckNoError(t, dec.Decode(&r))
+		// Only check that failed requests record their error
+		r.Time, r.DurationMS, r.Error = r.Time.UTC(), 0, strconv.FormatBool(r.Error != "")
+		records = append(records, r)
+	}
+	host := strings.TrimPrefix(registry.URL, "http://")
+	testutil.CheckDeepEqual(t, []Record{
+		{Time: records[0].Time, Method: "GET", Host: host, URL: registry.URL + "/v2/app/blobs/" + digest, Digest: digest, Status: 200, ResponseBytes: 7, Error: "false"},
+		{Time: records[1].Time, Method: "GET", Host: host, URL: registry.URL + "/v2/app/manifests/latest", Digest: digest, Status: 200, ResponseBytes: 7, Error: "false"},
+		{Time: records[2].Time, Method: "POST", Host: "127.0.0.1:0", URL: "http://127.0.0.1:0/v2/app/blobs/uploads/", RequestBytes: 5, Error: "true"},
+	}, records)
+}
@@ -19,6 +19,7 @@ package buildcontext
 import (
 	"errors"
 	"strings"
+	"time"
 
 	"github.com/chainguard-dev/kaniko/pkg/constants"
 	"github.com/chainguard-dev/kaniko/pkg/util"
@@ -33,6 +34,9 @@ type BuildOptions struct {
 	GitSingleBranch      bool
 	GitRecurseSubmodules bool
 	InsecureSkipTLS      bool
+	// ContextCacheDir keeps the files of the manifest+https:// build contexts
+	// across builds
+	ContextCacheDir string
 }
 
 // BuildContext unifies calls to download and unpack the build context.
@@ -41,6 +45,14 @@ type BuildContext interface {
 	UnpackTarFromBuildContext() (string, error)
 }
 
+// CommitTimer is implemented by the build contexts checking out a commit
+type CommitTimer interface {
+	// CommitTime returns the committer time of the commit checked out
+	CommitTime() time.Time
+	// Commit returns the hash of the commit checked out
+	Commit() string
+}
+
 // GetBuildContext parses srcContext for the prefix and returns related buildcontext
 // parser
 func GetBuildContext(srcContext string, opts BuildOptions) (BuildContext, error) {
@@ -65,7 +77,24 @@ func GetBuildContext(srcContext string, opts BuildOptions) (BuildContext, error)
 			return &HTTPSTar{context: srcContext}, nil
 		case TarBuildContextPrefix:
 			return &Tar{context: context}, nil
+		case ManifestBuildContextPrefix:
+			return &Manifest{context: context, cacheDir: opts.ContextCacheDir}, nil
+		}
+		if f, ok := getFetcher(prefix); ok {
+			return &Fetched{fetcher: f, context: strings.TrimPrefix(srcContext, prefix)}, nil
 		}
 	}
-	return nil, errors.New("unknown build context prefix provided, please use one of the following: gs://, dir://, tar://, s3://, git://, https://")
+	prefixes := append([]string{"gs://", "dir://", "tar://", "s3://", "git://", "https://", "manifest+https://"}, registeredPrefixes()...)
+	return nil, errors.New("unknown build context prefix provided, please use one of the following: " + strings.Join(prefixes, ", "))
+}
+
+// isBuiltinPrefix returns true if the build contexts prefixed with prefix are
+// handled by kaniko itself
+func isBuiltinPrefix(prefix string) bool {
+	switch prefix {
+	case constants.GCSBuildContextPrefix, constants.S3BuildContextPrefix, constants.LocalDirBuildContextPrefix,
+		constants.GitBuildContextPrefix, constants.HTTPSBuildContextPrefix, TarBuildContextPrefix, ManifestBuildContextPrefix:
+		return true
+	}
+	return false
 }
@@ -0,0 +1,92 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildcontext
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// ContentDigester is implemented by the build contexts which know the digest
+// of the files they fetched from the context source, e.g. git tree hashes or
+// object ETags. Unlike hashes of the extracted files, these digests don't
+// depend on the filesystem the context was extracted to.
+type ContentDigester interface {
+	// ContentDigests returns the digests of the fetched files, keyed by path
+	ContentDigests() map[string]string
+}
+
+// objectDigests returns digests for the files extracted into directory from an
+// object with the given ETag. Weak ETags don't identify the object content,
+// in which case nil is returned.
+func objectDigests(directory, etag string) (map[string]string, error) {
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		return nil, nil
+	}
+	etag = strings.Trim(etag, `"`)
+	digests := map[string]string{}
+	err := filepath.WalkDir(directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+		// The object content determines the content of all the files
+		digests[path] = "etag:" + etag + ":" + rel
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
+
+// headCommit returns the commit checked out in the repository
+func headCommit(r *git.Repository) (*object.Commit, error) {
+	head, err := r.Head()
+	if err != nil {
+		return nil, err
+	}
+	return r.CommitObject(head.Hash())
+}
+
+// gitDigests returns the mode and blob hash of the files of the commit checked
+// out into directory. Files of submodules are not included.
+func gitDigests(commit *object.Commit, directory string) (map[string]string, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	digests := map[string]string{}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		digests[filepath.Join(directory, f.Name)] = "git:" + f.Mode.String() + ":" + f.Hash.String()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildcontext
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func TestObjectDigests(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub/file"), []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	digests, err := objectDigests(dir, `"0123abcd"`)
+	testutil.CheckErrorAndDeepEqual(t, false, err, map[string]string{
+		filepath.Join(dir, "sub/file"): "etag:0123abcd:sub/file",
+	}, digests)
+
+	digests, err = objectDigests(dir, `W/"0123abcd"`)
+	testutil.CheckErrorAndDeepEqual(t, false, err, map[string]string(nil), digests)
+}
+
+func TestGitDigests(t *testing.T) {
+	dir := t.TempDir()
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("content\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Add("file"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Commit("initial", &git.CommitOptions{
+		Author: &object.Signature{Name: "kaniko", Email: "kaniko@example.com", When: time.Unix(0, 0)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit, err := headCommit(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digests, err := gitDigests(commit, dir)
+	// git hash-object of "content\n"
+	testutil.CheckErrorAndDeepEqual(t, false, err, map[string]string{
+		filepath.Join(dir, "file"): "git:0100644:d95f3ad14dee633a758d2e331151e950dd13e4ed",
+	}, digests)
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildcontext
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	kConfig "github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/pkg/errors"
+)
+
+// Fetcher fetches the build contexts of a custom --context scheme
+type Fetcher interface {
+	// Fetch fetches the build context at location, the --context without its
+	// scheme, into the existing directory dir
+	Fetch(location, dir string) error
+}
+
+var (
+	fetchersMu sync.RWMutex
+	fetchers   = map[string]Fetcher{}
+)
+
+// RegisterFetcher registers the fetcher of the build contexts prefixed with
+// scheme://, e.g. --context=scheme://location. It is meant to be called by the
+// init functions of the packages implementing fetchers, and panics if scheme
+// is already handled.
+func RegisterFetcher(scheme string, f Fetcher) {
+	fetchersMu.Lock()
+	defer fetchersMu.Unlock()
+	if _, ok := fetchers[scheme]; ok || isBuiltinPrefix(scheme+"://") {
+		panic(fmt.Sprintf("build context scheme %q registered twice", scheme))
+	}
+	fetchers[scheme] = f
+}
+
+// getFetcher returns the fetcher registered for prefix, e.g. p4://
+func getFetcher(prefix string) (Fetcher, bool) {
+	fetchersMu.RLock()
+	defer fetchersMu.RUnlock()
+	f, ok := fetchers[prefix[:len(prefix)-len("://")]]
+	return f, ok
+}
+
+// registeredPrefixes returns the prefixes of the registered fetchers
+func registeredPrefixes() []string {
+	fetchersMu.RLock()
+	defer fetchersMu.RUnlock()
+	var prefixes []string
+	for scheme := range fetchers {
+		prefixes = append(prefixes, scheme+"://")
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// Fetched is the build context fetched by a registered Fetcher
+type Fetched struct {
+	fetcher Fetcher
+	context string
+}
+
+// UnpackTarFromBuildContext fetches the build context into the build context
+// directory and returns it
+func (f *Fetched) UnpackTarFromBuildContext() (string, error) {
+	directory := kConfig.BuildContextDir
+	if err := os.MkdirAll(directory, 0750); err != nil {
+		return directory, err
+	}
+	if err := f.fetcher.Fetch(f.context, directory); err != nil {
+		return directory, errors.Wrapf(err, "fetching build context %s", f.context)
+	}
+	return directory, nil
+}
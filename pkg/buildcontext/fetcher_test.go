@@ -0,0 +1,57 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildcontext
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	kConfig "github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+type fileFetcher struct{}
+
+func (fileFetcher) Fetch(location, dir string) error {
+	return os.WriteFile(filepath.Join(dir, "location"), []byte(location), 0o644)
+}
+
+func TestRegisterFetcher(t *testing.T) {
+	RegisterFetcher("vcs", fileFetcher{})
+
+	dir := t.TempDir() + "/"
+	original := kConfig.BuildContextDir
+	kConfig.BuildContextDir = dir
+	defer func() { kConfig.BuildContextDir = original }()
+
+	bc, err := GetBuildContext("vcs://server/depot/app://main", BuildOptions{})
+	testutil.CheckNoError(t, err)
+	got, err := bc.UnpackTarFromBuildContext()
+	testutil.CheckErrorAndDeepEqual(t, false, err, dir, got)
+	b, err := os.ReadFile(filepath.Join(dir, "location"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, "server/depot/app://main", string(b))
+
+	_, err = GetBuildContext("unknown://context", BuildOptions{})
+	testutil.CheckDeepEqual(t, true, err != nil && strings.Contains(err.Error(), "vcs://"))
+
+	defer func() {
+		testutil.CheckDeepEqual(t, true, recover() != nil)
+	}()
+	RegisterFetcher("git", fileFetcher{})
+}
@@ -20,7 +20,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	kConfig "github.com/chainguard-dev/kaniko/pkg/config"
 	"github.com/go-git/go-billy/v5/osfs"
@@ -31,6 +33,7 @@ import (
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/memory"
 	"github.com/sirupsen/logrus"
 )
 
@@ -50,8 +53,26 @@ var (
 
 // Git unifies calls to download and unpack the build context.
 type Git struct {
-	context string
-	opts    BuildOptions
+	context    string
+	opts       BuildOptions
+	digests    map[string]string
+	commit     string
+	commitTime time.Time
+}
+
+// CommitTime returns the committer time of the commit checked out
+func (g *Git) CommitTime() time.Time {
+	return g.commitTime
+}
+
+// Commit returns the hash of the commit checked out
+func (g *Git) Commit() string {
+	return g.commit
+}
+
+// ContentDigests returns the mode and blob hash of the files checked out
+func (g *Git) ContentDigests() map[string]string {
+	return g.digests
 }
 
 // UnpackTarFromBuildContext will provide the directory where Git Repository is Cloned
@@ -88,7 +109,7 @@ func (g *Git) UnpackTarFromBuildContext() (string, error) {
 	}
 
 	if branch := g.opts.GitBranch; branch != "" {
-		ref, err := getGitReferenceName(directory, url, branch)
+		ref, err := getGitReferenceName(directory, url, branch, getGitAuth())
 		if err != nil {
 			return directory, err
 		}
@@ -135,10 +156,129 @@ func (g *Git) UnpackTarFromBuildContext() (string, error) {
 			return directory, err
 		}
 	}
+
+	commit, err := headCommit(r)
+	if err != nil {
+		logrus.Warnf("Unable to get the commit checked out in the build context: %v", err)
+		return directory, nil
+	}
+	g.commit = commit.Hash.String()
+	g.commitTime = commit.Committer.When
+	if g.digests, err = gitDigests(commit, directory); err != nil {
+		logrus.Warnf("Unable to get the git tree hashes of the build context, cache keys will be computed from the checked out files: %v", err)
+	}
 	return directory, nil
 }
 
-func getGitReferenceName(directory string, url string, branch string) (plumbing.ReferenceName, error) {
+// CloneGitSource clones the git repository of an ADD source into dir, and
+// returns the directory to add. Like with BuildKit, src is the repository URL
+// optionally followed by #<ref>[:<subdir>], where ref is a branch, a tag or a
+// commit. The commit checked out is commit when set, as resolved by
+// ResolveGitSource, even if ref moved since. The .git directory is removed
+// unless keepGitDir is set.
+func CloneGitSource(src, commit, dir string, keepGitDir bool) (string, error) {
+	remote, fragment, _ := strings.Cut(src, "#")
+	ref, subdir, _ := strings.Cut(fragment, ":")
+	options := git.CloneOptions{
+		URL:               remote,
+		Auth:              gitSourceAuth(remote),
+		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+	}
+
+	checkoutRef := commit
+	switch {
+	case ref == "":
+	case plumbing.IsHash(ref):
+		if checkoutRef == "" {
+			checkoutRef = ref
+		}
+	case strings.HasPrefix(ref, "refs/"):
+		options.ReferenceName = plumbing.ReferenceName(ref)
+		options.SingleBranch = true
+	default:
+		name, err := getGitReferenceName(dir, remote, ref, options.Auth)
+		if err != nil {
+			return "", err
+		}
+		options.ReferenceName = name
+		options.SingleBranch = true
+	}
+
+	logrus.Infof("Cloning %s", src)
+	r, err := git.PlainClone(dir, false, &options)
+	if err != nil {
+		return "", fmt.Errorf("cloning %s: %w", remote, err)
+	}
+	if checkoutRef != "" {
+		w, err := r.Worktree()
+		if err != nil {
+			return "", err
+		}
+		if err := w.Checkout(&git.CheckoutOptions{Hash: plumbing.NewHash(checkoutRef)}); err != nil {
+			return "", fmt.Errorf("checking out %s: %w", checkoutRef, err)
+		}
+	}
+	if !keepGitDir {
+		if err := os.RemoveAll(filepath.Join(dir, ".git")); err != nil {
+			return "", err
+		}
+	}
+	// Keep the subdirectory within the repository
+	return filepath.Join(dir, filepath.Clean("/"+subdir)), nil
+}
+
+// ResolveGitSource returns the commit the reference of the git repository of
+// an ADD source points to, for the cache keys to change along with the
+// repository. A reference which already is a commit is returned as is.
+func ResolveGitSource(src string) (string, error) {
+	remote, fragment, _ := strings.Cut(src, "#")
+	ref, _, _ := strings.Cut(fragment, ":")
+	if plumbing.IsHash(ref) {
+		return ref, nil
+	}
+	r := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: "origin", URLs: []string{remote}})
+	refs, err := r.List(&git.ListOptions{Auth: gitSourceAuth(remote)})
+	if err != nil {
+		return "", fmt.Errorf("listing the references of %s: %w", remote, err)
+	}
+	names := []plumbing.ReferenceName{plumbing.HEAD}
+	switch {
+	case strings.HasPrefix(ref, "refs/"):
+		names = []plumbing.ReferenceName{plumbing.ReferenceName(ref)}
+	case ref != "":
+		names = []plumbing.ReferenceName{plumbing.NewBranchReferenceName(ref), plumbing.NewTagReferenceName(ref)}
+	}
+	for _, name := range names {
+		for _, r := range refs {
+			if r.Name() != name {
+				continue
+			}
+			if r.Type() == plumbing.SymbolicReference {
+				// The default branch the HEAD of the repository points to
+				name = r.Target()
+				for _, target := range refs {
+					if target.Name() == name && target.Type() == plumbing.HashReference {
+						return target.Hash().String(), nil
+					}
+				}
+				continue
+			}
+			return r.Hash().String(), nil
+		}
+	}
+	return "", fmt.Errorf("invalid reference %q of %s", ref, remote)
+}
+
+// gitSourceAuth returns the credentials of the environment for the https git
+// repositories, ssh ones using the ssh agent instead
+func gitSourceAuth(remote string) transport.AuthMethod {
+	if strings.HasPrefix(remote, "http://") || strings.HasPrefix(remote, "https://") {
+		return getGitAuth()
+	}
+	return nil
+}
+
+func getGitReferenceName(directory string, url string, branch string, auth transport.AuthMethod) (plumbing.ReferenceName, error) {
 	var remote = git.NewRemote(
 		filesystem.NewStorage(
 			osfs.New(directory),
@@ -150,7 +290,7 @@ func getGitReferenceName(directory string, url string, branch string) (plumbing.
 	)
 
 	refs, err := remote.List(&git.ListOptions{
-		Auth: getGitAuth(),
+		Auth: auth,
 	})
 	if err != nil {
 		return plumbing.HEAD, err
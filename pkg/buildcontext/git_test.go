@@ -18,9 +18,14 @@ package buildcontext
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 )
@@ -189,3 +194,113 @@ func clearTestAuthEnv() {
 	_ = os.Unsetenv(gitAuthUsernameEnvKey)
 	_ = os.Unsetenv(gitAuthPasswordEnvKey)
 }
+
+func TestCloneGitSource(t *testing.T) {
+	remote := t.TempDir()
+	r, err := git.PlainInit(remote, false)
+	testutil.CheckNoError(t, err)
+	if err := os.MkdirAll(filepath.Join(remote, "docs"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(remote, "docs", "README"), []byte("docs"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	testutil.CheckNoError(t, err)
+	_, err = w.Add("docs/README")
+	testutil.CheckNoError(t, err)
+	commit, err := w.Commit("docs", &git.CommitOptions{
+		Author: &object.Signature{Name: "kaniko", When: time.Unix(0, 0)},
+	})
+	testutil.CheckNoError(t, err)
+	head, err := r.Head()
+	testutil.CheckNoError(t, err)
+	branch := head.Name().Short()
+	// The branch moves after its commit is resolved
+	if err := os.WriteFile(filepath.Join(remote, "docs", "README"), []byte("updated"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Add("docs/README")
+	testutil.CheckNoError(t, err)
+	_, err = w.Commit("update", &git.CommitOptions{
+		Author: &object.Signature{Name: "kaniko", When: time.Unix(1, 0)},
+	})
+	testutil.CheckNoError(t, err)
+
+	tests := []struct {
+		name        string
+		fragment    string
+		commit      string
+		keepGitDir  bool
+		wantFile    string
+		wantContent string
+		wantGitDir  bool
+	}{
+		{name: "default", wantFile: "docs/README", wantContent: "updated"},
+		{name: "keep git dir", keepGitDir: true, wantFile: "docs/README", wantGitDir: true},
+		{name: "commit and subdir", fragment: "#" + commit.String() + ":docs", wantFile: "README", wantContent: "docs"},
+		{name: "resolved commit of branch", fragment: "#" + branch, commit: commit.String(), wantFile: "docs/README", wantContent: "docs"},
+		{name: "resolved commit of default branch", commit: commit.String(), wantFile: "docs/README", wantContent: "docs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src, err := CloneGitSource(remote+tt.fragment, tt.commit, dir, tt.keepGitDir)
+			testutil.CheckNoError(t, err)
+			b, err := os.ReadFile(filepath.Join(src, tt.wantFile))
+			if err != nil {
+				t.Errorf("expected %s to be cloned: %v", tt.wantFile, err)
+			} else if tt.wantContent != "" {
+				testutil.CheckDeepEqual(t, tt.wantContent, string(b))
+			}
+			_, err = os.Stat(filepath.Join(dir, ".git"))
+			testutil.CheckDeepEqual(t, tt.wantGitDir, err == nil)
+		})
+	}
+}
+
+func TestResolveGitSource(t *testing.T) {
+	remote := t.TempDir()
+	r, err := git.PlainInit(remote, false)
+	testutil.CheckNoError(t, err)
+	w, err := r.Worktree()
+	testutil.CheckNoError(t, err)
+	commit := func(content string) plumbing.Hash {
+		if err := os.WriteFile(filepath.Join(remote, "README"), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Add("README")
+		testutil.CheckNoError(t, err)
+		hash, err := w.Commit(content, &git.CommitOptions{
+			Author: &object.Signature{Name: "kaniko", When: time.Unix(0, 0)},
+		})
+		testutil.CheckNoError(t, err)
+		return hash
+	}
+	first := commit("first")
+	_, err = r.CreateTag("v1", first, nil)
+	testutil.CheckNoError(t, err)
+	second := commit("second")
+	head, err := r.Head()
+	testutil.CheckNoError(t, err)
+
+	tests := []struct {
+		name     string
+		fragment string
+		want     string
+		wantErr  bool
+	}{
+		{name: "default branch", want: second.String()},
+		{name: "branch", fragment: "#" + head.Name().Short(), want: second.String()},
+		{name: "tag and subdir", fragment: "#v1:docs", want: first.String()},
+		{name: "full reference", fragment: "#refs/tags/v1", want: first.String()},
+		{name: "commit", fragment: "#" + first.String(), want: first.String()},
+		{name: "missing", fragment: "#missing", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveGitSource(remote + tt.fragment)
+			testutil.CheckErrorAndDeepEqual(t, tt.wantErr, err, tt.want, got)
+		})
+	}
+}
@@ -32,6 +32,13 @@ import (
 // HTTPSTar struct for https tar.gz files processing
 type HTTPSTar struct {
 	context string
+	digests map[string]string
+}
+
+// ContentDigests returns digests of the extracted files derived from the
+// ETag of the tar file
+func (h *HTTPSTar) ContentDigests() map[string]string {
+	return h.digests
 }
 
 // UnpackTarFromBuildContext downloads context file from https server
@@ -46,10 +53,18 @@ func (h *HTTPSTar) UnpackTarFromBuildContext() (directory string, err error) {
 	if err != nil {
 		return
 	}
+	// Remove the tar so it doesn't interfere with subsequent commands, even
+	// when the build context could not be extracted from it
+	defer func() {
+		file.Close()
+		if removeErr := os.Remove(tarPath); err == nil && removeErr != nil {
+			err = removeErr
+		}
+	}()
 
 	// Download tar file from remote https server
 	// and save it into the target tar file
-	resp, err := http.Get(h.context) //nolint:noctx
+	resp, err := util.HTTPClient().Get(h.context) //nolint:noctx
 	if err != nil {
 		return
 	}
@@ -75,6 +90,6 @@ func (h *HTTPSTar) UnpackTarFromBuildContext() (directory string, err error) {
 
 	logrus.Info("Extracted https tar file")
 
-	// Remove the tar so it doesn't interfere with subsequent commands
-	return directory, os.Remove(tarPath)
+	h.digests, err = objectDigests(directory, resp.Header.Get("ETag"))
+	return
 }
@@ -19,7 +19,12 @@ package buildcontext
 import (
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+
+	kConfig "github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/constants"
 )
 
 func TestBuildWithHttpsTar(t *testing.T) {
@@ -50,8 +55,11 @@ func TestBuildWithHttpsTar(t *testing.T) {
 		},
 	}
 
+	original := kConfig.BuildContextDir
+	defer func() { kConfig.BuildContextDir = original }()
 	for _, tcase := range tests {
 		t.Run(tcase.name, func(t *testing.T) {
+			kConfig.BuildContextDir = t.TempDir()
 			server := httptest.NewServer(tcase.serverHandler)
 			defer server.Close()
 
@@ -63,6 +71,10 @@ func TestBuildWithHttpsTar(t *testing.T) {
 			if err == nil {
 				t.Fatalf("Error expected but not returned: %s", err)
 			}
+			// The downloaded tar is removed
+			if _, err := os.Stat(filepath.Join(kConfig.BuildContextDir, constants.ContextTar)); !os.IsNotExist(err) {
+				t.Errorf("Expected the downloaded tar to be removed, got %v", err)
+			}
 		})
 	}
 }
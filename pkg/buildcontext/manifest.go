@@ -0,0 +1,453 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildcontext
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	kConfig "github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ManifestBuildContextPrefix is the prefix of the build contexts described
+	// by a manifest of their files, fetched from the blobs next to it
+	ManifestBuildContextPrefix = "manifest+https://"
+
+	// ManifestFile is the name of the manifest of a build context layout
+	ManifestFile = "manifest.json"
+
+	// manifestFetchJobs is the number of blobs fetched concurrently
+	manifestFetchJobs = 8
+
+	// manifestCacheLock is the file of the cache directory locked by the
+	// builds using it
+	manifestCacheLock = ".lock"
+)
+
+// The types of the entries of a build context manifest
+const (
+	ManifestEntryFile    = "file"
+	ManifestEntryDir     = "dir"
+	ManifestEntrySymlink = "symlink"
+)
+
+// for testing
+var manifestClient = util.HTTPClient()
+
+// ContextManifest lists the files of a build context along with the digests
+// of their contents, stored as blobs/sha256/<hex> next to the manifest.
+type ContextManifest struct {
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// ManifestEntry is a file, directory or symlink of a build context
+type ManifestEntry struct {
+	Path     string      `json:"path"`
+	Type     string      `json:"type"`
+	Mode     fs.FileMode `json:"mode,omitempty"`
+	Digest   string      `json:"digest,omitempty"`
+	Linkname string      `json:"linkname,omitempty"`
+}
+
+// Manifest is the build context described by a manifest. The blobs of its
+// files are kept in the cache directory, if any, so that the next builds only
+// fetch the files changed since.
+type Manifest struct {
+	context  string
+	cacheDir string
+	digests  map[string]string
+}
+
+// ContentDigests returns the digests of the files listed in the manifest
+func (m *Manifest) ContentDigests() map[string]string {
+	return m.digests
+}
+
+// UnpackTarFromBuildContext fetches the manifest, the blobs of the files
+// missing from the cache directory, and writes the files to the build context
+// directory.
+func (m *Manifest) UnpackTarFromBuildContext() (string, error) {
+	directory := kConfig.BuildContextDir
+	manifestURL, err := url.Parse("https://" + m.context)
+	if err != nil {
+		return directory, errors.Wrap(err, "parsing build context manifest url")
+	}
+	b, err := manifestGet(manifestURL.String())
+	if err != nil {
+		return directory, errors.Wrap(err, "fetching build context manifest")
+	}
+	var manifest ContextManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return directory, errors.Wrap(err, "parsing build context manifest")
+	}
+	if err := manifest.validate(); err != nil {
+		return directory, err
+	}
+
+	cacheDir := m.cacheDir
+	if cacheDir == "" {
+		if cacheDir, err = os.MkdirTemp(kConfig.ScratchDir(), "context-"); err != nil {
+			return directory, err
+		}
+		defer os.RemoveAll(cacheDir)
+	}
+	blobs := filepath.Join(cacheDir, "blobs", "sha256")
+	if err := os.MkdirAll(blobs, 0o755); err != nil {
+		return directory, err
+	}
+	lock, err := lockManifestCache(cacheDir)
+	if err != nil {
+		return directory, err
+	}
+	defer lock.Close()
+
+	unchanged, total := 0, 0
+	missing := map[string]bool{}
+	for _, e := range manifest.Entries {
+		if e.Type != ManifestEntryFile {
+			continue
+		}
+		total++
+		if _, err := os.Stat(filepath.Join(blobs, e.Digest)); err == nil {
+			unchanged++
+			continue
+		}
+		missing[e.Digest] = true
+	}
+	logrus.Infof("Fetching %d blobs of the build context, %d of its %d files are unchanged since the previous build", len(missing), unchanged, total)
+	g := errgroup.Group{}
+	g.SetLimit(manifestFetchJobs)
+	for digest := range missing {
+		blobURL := manifestURL.ResolveReference(&url.URL{Path: "blobs/sha256/" + digest})
+		g.Go(func() error {
+			return fetchBlob(blobURL.String(), blobs, digest)
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return directory, err
+	}
+
+	if m.digests, err = manifest.write(directory, blobs); err != nil {
+		return directory, err
+	}
+	if m.cacheDir != "" {
+		if err := recordManifest(m.cacheDir, manifestURL.String(), b, lock); err != nil {
+			logrus.Warnf("Unable to record the build context manifest, the next build will fetch all its files: %v", err)
+		}
+	}
+	return directory, nil
+}
+
+// validate checks that the entries of the manifest stay in the build context
+// and that the digests of their files are sha256 digests
+func (c *ContextManifest) validate() error {
+	for _, e := range c.Entries {
+		if !filepath.IsLocal(e.Path) {
+			return fmt.Errorf("build context manifest entry %q is outside of the build context", e.Path)
+		}
+		switch e.Type {
+		case ManifestEntryFile:
+			if len(e.Digest) != sha256.Size*2 || strings.Trim(e.Digest, "0123456789abcdef") != "" {
+				return fmt.Errorf("invalid digest %q of build context file %s", e.Digest, e.Path)
+			}
+		case ManifestEntryDir, ManifestEntrySymlink:
+		default:
+			return fmt.Errorf("unknown type %q of build context manifest entry %s", e.Type, e.Path)
+		}
+	}
+	return nil
+}
+
+// write writes the entries of the manifest to directory, copying the contents
+// of its files from blobs, and returns the digests of the files keyed by path
+func (c *ContextManifest) write(directory, blobs string) (map[string]string, error) {
+	digests := map[string]string{}
+	symlinks := map[string]bool{}
+	for _, e := range c.Entries {
+		// The entries are never written through the symlinks of the manifest
+		for dir := filepath.Dir(filepath.Clean(e.Path)); dir != "."; dir = filepath.Dir(dir) {
+			if symlinks[dir] {
+				return nil, fmt.Errorf("build context manifest entry %q is under the symlink %s", e.Path, dir)
+			}
+		}
+		path := filepath.Join(directory, e.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+		switch e.Type {
+		case ManifestEntryDir:
+			mode := e.Mode.Perm()
+			if mode == 0 {
+				mode = 0o755
+			}
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				return nil, err
+			}
+			if err := os.Chmod(path, mode); err != nil {
+				return nil, err
+			}
+		case ManifestEntrySymlink:
+			symlinks[filepath.Clean(e.Path)] = true
+			if err := os.RemoveAll(path); err != nil {
+				return nil, err
+			}
+			if err := os.Symlink(e.Linkname, path); err != nil {
+				return nil, err
+			}
+		case ManifestEntryFile:
+			mode := e.Mode.Perm()
+			if mode == 0 {
+				mode = 0o644
+			}
+			if err := copyBlob(filepath.Join(blobs, e.Digest), path, mode); err != nil {
+				return nil, errors.Wrapf(err, "writing build context file %s", e.Path)
+			}
+			digests[path] = "sha256:" + e.Digest
+		}
+	}
+	return digests, nil
+}
+
+// copyBlob copies the blob at src to the file dest, which gets mode
+func copyBlob(src, dest string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Chmod(mode); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// manifestGet returns the body of the response to a GET request to u
+func manifestGet(u string) ([]byte, error) {
+	resp, err := manifestClient.Get(u) //nolint:noctx
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status from server for %s: %s", u, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// fetchBlob fetches the blob with the sha256 digest at u into blobs, checking
+// its content against the digest
+func fetchBlob(u, blobs, digest string) error {
+	resp, err := manifestClient.Get(u) //nolint:noctx
+	if err != nil {
+		return errors.Wrapf(err, "fetching build context blob %s", digest)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status from server for %s: %s", u, resp.Status)
+	}
+	f, err := os.CreateTemp(blobs, "fetch-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), resp.Body); err != nil {
+		return errors.Wrapf(err, "fetching build context blob %s", digest)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != digest {
+		return fmt.Errorf("build context blob %s has digest %s", digest, got)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(blobs, digest))
+}
+
+// lockManifestCache takes a shared lock on cacheDir for the build using its
+// blobs, for the concurrent builds not to delete them
+func lockManifestCache(cacheDir string) (*os.File, error) {
+	path := filepath.Join(cacheDir, manifestCacheLock)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0o644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening build context cache lock %s", path)
+	}
+	for {
+		err = unix.Flock(int(f.Fd()), unix.LOCK_SH)
+		if !errors.Is(err, unix.EINTR) {
+			break
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "locking build context cache %s", cacheDir)
+	}
+	return f, nil
+}
+
+// recordManifest stores the manifest fetched from u in cacheDir, and deletes
+// the blobs none of the stored manifests lists anymore. The blobs are only
+// deleted when lock, the lock of the build on cacheDir, can be made
+// exclusive, as the other builds using cacheDir may be about to use them.
+func recordManifest(cacheDir, u string, manifest []byte, lock *os.File) error {
+	manifests := filepath.Join(cacheDir, "manifests")
+	if err := os.MkdirAll(manifests, 0o755); err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(u))
+	if err := os.WriteFile(filepath.Join(manifests, hex.EncodeToString(sum[:])+".json"), manifest, 0o644); err != nil {
+		return err
+	}
+
+	used := map[string]bool{}
+	files, err := os.ReadDir(manifests)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(filepath.Join(manifests, f.Name()))
+		if err != nil {
+			return err
+		}
+		var m ContextManifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			logrus.Debugf("Ignoring the invalid build context manifest %s: %v", f.Name(), err)
+			continue
+		}
+		for _, e := range m.Entries {
+			used[e.Digest] = true
+		}
+	}
+	if err := unix.Flock(int(lock.Fd()), unix.LOCK_EX|unix.LOCK_NB); errors.Is(err, unix.EWOULDBLOCK) {
+		logrus.Debugf("Build context cache %s is used by other builds, keeping its unused blobs", cacheDir)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	blobs := filepath.Join(cacheDir, "blobs", "sha256")
+	stored, err := os.ReadDir(blobs)
+	if err != nil {
+		return err
+	}
+	for _, blob := range stored {
+		if !used[blob.Name()] {
+			if err := os.Remove(filepath.Join(blobs, blob.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WriteManifestLayout writes the manifest of the build context in src to
+// dest, along with the blobs of its files not in dest already. Publishing dest
+// to a https server, e.g. by syncing it to a bucket, then only uploads the
+// files changed since the previous layout.
+func WriteManifestLayout(src, dest string) error {
+	blobs := filepath.Join(dest, "blobs", "sha256")
+	if err := os.MkdirAll(blobs, 0o755); err != nil {
+		return err
+	}
+	var manifest ContextManifest
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == src {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		e := ManifestEntry{Path: filepath.ToSlash(rel), Mode: fi.Mode().Perm()}
+		switch {
+		case d.IsDir():
+			e.Type = ManifestEntryDir
+		case d.Type()&fs.ModeSymlink != 0:
+			e.Type, e.Mode = ManifestEntrySymlink, 0
+			if e.Linkname, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case d.Type().IsRegular():
+			e.Type = ManifestEntryFile
+			if e.Digest, err = writeBlob(path, blobs); err != nil {
+				return err
+			}
+		default:
+			logrus.Warnf("Skipping %s, which is neither a file, a directory nor a symlink", path)
+			return nil
+		}
+		manifest.Entries = append(manifest.Entries, e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dest, ManifestFile), b, 0o644)
+}
+
+// writeBlob stores the content of the file at path in blobs if it isn't there
+// already, and returns its sha256 digest
+func writeBlob(path, blobs string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	blob := filepath.Join(blobs, digest)
+	if _, err := os.Stat(blob); err == nil {
+		return digest, nil
+	}
+	return digest, copyBlob(path, blob, 0o644)
+}
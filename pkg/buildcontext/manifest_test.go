@@ -0,0 +1,154 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package buildcontext
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	kConfig "github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestManifest_UnpackTarFromBuildContext(t *testing.T) {
+	original := kConfig.BuildContextDir
+	defer func() { kConfig.BuildContextDir = original }()
+
+	src, layout, cacheDir := t.TempDir(), t.TempDir(), t.TempDir()
+	testutil.CheckNoError(t, os.MkdirAll(filepath.Join(src, "cmd"), 0o755))
+	testutil.CheckNoError(t, os.WriteFile(filepath.Join(src, "Dockerfile"), []byte("FROM scratch"), 0o644))
+	testutil.CheckNoError(t, os.WriteFile(filepath.Join(src, "cmd", "main.go"), []byte("package main"), 0o644))
+	testutil.CheckNoError(t, os.WriteFile(filepath.Join(src, "run.sh"), []byte("#!/bin/sh"), 0o755))
+	testutil.CheckNoError(t, os.Symlink("cmd/main.go", filepath.Join(src, "main.go")))
+
+	var mu sync.Mutex
+	var fetched []string
+	files := http.FileServer(http.Dir(layout))
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/") {
+			mu.Lock()
+			fetched = append(fetched, filepath.Base(r.URL.Path))
+			mu.Unlock()
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	originalClient := manifestClient
+	defer func() { manifestClient = originalClient }()
+	manifestClient = server.Client()
+
+	build := func() (string, map[string]string) {
+		kConfig.BuildContextDir = t.TempDir()
+		fetched = nil
+		testutil.CheckNoError(t, WriteManifestLayout(src, layout))
+		bc, err := GetBuildContext(ManifestBuildContextPrefix+strings.TrimPrefix(server.URL, "https://")+"/"+ManifestFile, BuildOptions{ContextCacheDir: cacheDir})
+		testutil.CheckNoError(t, err)
+		dir, err := bc.UnpackTarFromBuildContext()
+		testutil.CheckNoError(t, err)
+		return dir, bc.(ContentDigester).ContentDigests()
+	}
+
+	dir, digests := build()
+	testutil.CheckDeepEqual(t, 3, len(fetched))
+	testutil.CheckDeepEqual(t, 3, len(digests))
+	b, err := os.ReadFile(filepath.Join(dir, "main.go"))
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, "package main", string(b))
+	fi, err := os.Stat(filepath.Join(dir, "run.sh"))
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, os.FileMode(0o755), fi.Mode().Perm())
+
+	// Only the changed file is fetched by the next build
+	testutil.CheckNoError(t, os.WriteFile(filepath.Join(src, "Dockerfile"), []byte("FROM busybox"), 0o644))
+	dir, _ = build()
+	testutil.CheckDeepEqual(t, 1, len(fetched))
+	b, err = os.ReadFile(filepath.Join(dir, "Dockerfile"))
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, "FROM busybox", string(b))
+	for _, f := range []string{"Dockerfile", "cmd/main.go", "run.sh"} {
+		_, err := os.Stat(filepath.Join(dir, f))
+		testutil.CheckNoError(t, err)
+	}
+
+	// The blob of the previous Dockerfile is deleted from the cache
+	blobs, err := os.ReadDir(filepath.Join(cacheDir, "blobs", "sha256"))
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 3, len(blobs))
+}
+
+func Test_recordManifest_concurrentBuilds(t *testing.T) {
+	cacheDir := t.TempDir()
+	blobs := filepath.Join(cacheDir, "blobs", "sha256")
+	testutil.CheckNoError(t, os.MkdirAll(blobs, 0o755))
+	// A blob fetched by another build, not recorded yet
+	testutil.CheckNoError(t, os.WriteFile(filepath.Join(blobs, "fetched"), nil, 0o644))
+	manifest := []byte(`{"entries":[]}`)
+
+	other, err := lockManifestCache(cacheDir)
+	testutil.CheckNoError(t, err)
+	lock, err := lockManifestCache(cacheDir)
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, recordManifest(cacheDir, "https://example.com/manifest.json", manifest, lock))
+	_, err = os.Stat(filepath.Join(blobs, "fetched"))
+	testutil.CheckNoError(t, err)
+	lock.Close()
+
+	// The blobs are deleted once no other build uses the cache
+	testutil.CheckNoError(t, other.Close())
+	lock, err = lockManifestCache(cacheDir)
+	testutil.CheckNoError(t, err)
+	defer lock.Close()
+	testutil.CheckNoError(t, recordManifest(cacheDir, "https://example.com/manifest.json", manifest, lock))
+	_, err = os.Stat(filepath.Join(blobs, "fetched"))
+	testutil.CheckDeepEqual(t, true, os.IsNotExist(err))
+}
+
+func TestContextManifest_validate(t *testing.T) {
+	digest := strings.Repeat("a", 64)
+	tests := []struct {
+		name    string
+		entry   ManifestEntry
+		wantErr bool
+	}{
+		{name: "file", entry: ManifestEntry{Path: "a/b", Type: ManifestEntryFile, Digest: digest}},
+		{name: "outside of the context", entry: ManifestEntry{Path: "../b", Type: ManifestEntryFile, Digest: digest}, wantErr: true},
+		{name: "absolute", entry: ManifestEntry{Path: "/etc/passwd", Type: ManifestEntryFile, Digest: digest}, wantErr: true},
+		{name: "invalid digest", entry: ManifestEntry{Path: "a", Type: ManifestEntryFile, Digest: "../../x"}, wantErr: true},
+		{name: "unknown type", entry: ManifestEntry{Path: "a", Type: "fifo"}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := ContextManifest{Entries: []ManifestEntry{test.entry}}
+			testutil.CheckError(t, test.wantErr, m.validate())
+		})
+	}
+}
+
+func TestContextManifest_write_symlinks(t *testing.T) {
+	// A file under a symlink of the manifest would be written outside of it
+	m := ContextManifest{Entries: []ManifestEntry{
+		{Path: "etc", Type: ManifestEntrySymlink, Linkname: "/etc"},
+		{Path: "etc/passwd", Type: ManifestEntryFile, Digest: strings.Repeat("a", 64)},
+	}}
+	_, err := m.write(t.TempDir(), t.TempDir())
+	testutil.CheckError(t, true, err)
+}
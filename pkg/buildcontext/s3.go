@@ -21,54 +21,40 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	s3manager "github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	kConfig "github.com/chainguard-dev/kaniko/pkg/config"
 	"github.com/chainguard-dev/kaniko/pkg/constants"
 	"github.com/chainguard-dev/kaniko/pkg/util"
 	"github.com/chainguard-dev/kaniko/pkg/util/bucket"
+	"github.com/sirupsen/logrus"
 )
 
 // S3 unifies calls to download and unpack the build context.
 type S3 struct {
 	context string
+	digests map[string]string
+}
+
+// ContentDigests returns digests of the extracted files derived from the
+// ETag of the context object
+func (s *S3) ContentDigests() map[string]string {
+	return s.digests
 }
 
 // UnpackTarFromBuildContext download and untar a file from s3
 func (s *S3) UnpackTarFromBuildContext() (string, error) {
-	bucket, item, err := bucket.GetNameAndFilepathFromURI(s.context)
+	bucketName, item, err := bucket.GetNameAndFilepathFromURI(s.context)
 	if err != nil {
 		return "", fmt.Errorf("getting bucketname and filepath from context: %w", err)
 	}
 
-	endpoint := os.Getenv(constants.S3EndpointEnv)
-	forcePath := false
-	if strings.ToLower(os.Getenv(constants.S3ForcePathStyle)) == "true" {
-		forcePath = true
-	}
-
-	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-		if endpoint != "" {
-			return aws.Endpoint{
-				URL: endpoint,
-			}, nil
-		}
-		return aws.Endpoint{}, &aws.EndpointNotFoundError{}
-	})
-
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithEndpointResolverWithOptions(customResolver))
+	client, err := bucket.NewS3Client(context.TODO())
 	if err != nil {
-		return bucket, err
+		return bucketName, err
 	}
-	client := s3.NewFromConfig(cfg, func(options *s3.Options) {
-		if endpoint != "" {
-			options.UsePathStyle = forcePath
-		}
-	})
 	downloader := s3manager.NewDownloader(client)
 	directory := kConfig.BuildContextDir
 	tarPath := filepath.Join(directory, constants.ContextTar)
@@ -81,12 +67,25 @@ func (s *S3) UnpackTarFromBuildContext() (string, error) {
 	}
 	_, err = downloader.Download(context.TODO(), file,
 		&s3.GetObjectInput{
-			Bucket: aws.String(bucket),
+			Bucket: aws.String(bucketName),
 			Key:    aws.String(item),
 		})
 	if err != nil {
 		return directory, err
 	}
 
-	return directory, util.UnpackCompressedTar(tarPath, directory)
+	if err := util.UnpackCompressedTar(tarPath, directory); err != nil {
+		return directory, err
+	}
+
+	head, err := client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(item),
+	})
+	if err != nil {
+		logrus.Warnf("Unable to get the ETag of the build context, cache keys will be computed from the extracted files: %v", err)
+		return directory, nil
+	}
+	s.digests, err = objectDigests(directory, aws.ToString(head.ETag))
+	return directory, err
 }
@@ -0,0 +1,282 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// metadataSuffix is the suffix of the files holding the metadata of the
+// objects of an archive
+const metadataSuffix = ".metadata.json"
+
+// Archive is a directory of cached layers, laid out like the buckets of the
+// object backends, which is exported to a tarball with --cache-export and
+// imported from one with --cache-import. It carries the cache of a build
+// between air-gapped environments, or as a CI artifact.
+type Archive struct {
+	*objectBackend
+	dir string
+}
+
+// NewArchive returns the archive of cached layers in dir, created if missing
+func NewArchive(dir string) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Archive{objectBackend: newObjectBackend(&dirStore{root: dir}, dir, ""), dir: dir}, nil
+}
+
+// ImportArchive extracts the tarball of cached layers at tarPath, exported by
+// Export, to dir and returns its archive
+func ImportArchive(tarPath, dir string) (*Archive, error) {
+	a, err := NewArchive(dir)
+	if err != nil {
+		return nil, err
+	}
+	a.location = tarPath
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening cache archive")
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading cache archive %s", tarPath)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := filepath.Clean(hdr.Name)
+		if !filepath.IsLocal(name) {
+			return nil, fmt.Errorf("invalid path %s in cache archive %s", hdr.Name, tarPath)
+		}
+		if err := a.store.(*dirStore).write(name, tr); err != nil {
+			return nil, err
+		}
+		n++
+	}
+	logrus.Infof("Imported %d files of cached layers from %s", n, tarPath)
+	return a, nil
+}
+
+// Export writes the cached layers of the archive to a tarball at tarPath
+func (a *Archive) Export(tarPath string) error {
+	if err := os.MkdirAll(filepath.Dir(tarPath), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(tarPath)
+	if err != nil {
+		return errors.Wrap(err, "creating cache archive")
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	// The files are walked in lexical order, for the tarball to only depend
+	// on the cached layers
+	err = filepath.WalkDir(a.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(a.dir, p)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     filepath.ToSlash(rel),
+			Typeflag: tar.TypeReg,
+			Mode:     0o644,
+			Size:     fi.Size(),
+		}); err != nil {
+			return err
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return errors.Wrapf(err, "writing cache archive %s", tarPath)
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// localLayersDir is the directory of the cache dir holding the cached layers
+const localLayersDir = "layers"
+
+// LocalLayersDir returns the directory of the cached layers of the local cache
+func LocalLayersDir(opts *config.CacheOptions) string {
+	return filepath.Join(opts.CacheDir, localLayersDir)
+}
+
+// LocalLayers returns the backend of the cached layers of the local cache,
+// stored in LocalLayersDir like in the buckets of the object backends
+func LocalLayers(opts *config.CacheOptions) Backend {
+	dir := LocalLayersDir(opts)
+	return newObjectBackend(&dirStore{root: dir}, dir, "")
+}
+
+// dirStore stores the objects of an archive as files under root, with their
+// metadata next to them
+type dirStore struct {
+	root string
+}
+
+func (d *dirStore) Metadata(key string) (map[string]string, error) {
+	if _, err := os.Stat(filepath.Join(d.root, key)); os.IsNotExist(err) {
+		return nil, errObjectNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(d.root, key+metadataSuffix))
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	md := map[string]string{}
+	if err := json.Unmarshal(b, &md); err != nil {
+		return nil, errors.Wrapf(err, "parsing metadata of %s", key)
+	}
+	return md, nil
+}
+
+func (d *dirStore) Open(key string) (io.ReadCloser, error) {
+	p := filepath.Join(d.root, key)
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	// Record the use of the object for the least recently used layers of the
+	// local cache to be evicted first. Its modification time is used, since
+	// its access time changes when it is only listed, and it is never
+	// modified once written.
+	now := time.Now()
+	if err := os.Chtimes(p, now, now); err != nil {
+		logrus.Debugf("Unable to update modification time of %s: %v", p, err)
+	}
+	return f, nil
+}
+
+func (d *dirStore) Put(key string, r io.Reader, _ int64, _ string, metadata map[string]string) error {
+	if len(metadata) > 0 {
+		b, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		if err := d.write(key+metadataSuffix, bytes.NewReader(b)); err != nil {
+			return err
+		}
+	}
+	return d.write(key, r)
+}
+
+// List returns the objects under prefix, leaving out their metadata and the
+// files being written
+func (d *dirStore) List(prefix string) (map[string]time.Time, error) {
+	objects := map[string]time.Time{}
+	err := filepath.WalkDir(filepath.Join(d.root, prefix), func(p string, e fs.DirEntry, err error) error {
+		if err != nil || !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") || strings.HasSuffix(e.Name(), metadataSuffix) {
+			return err
+		}
+		rel, err := filepath.Rel(d.root, p)
+		if err != nil {
+			return err
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return err
+		}
+		objects[filepath.ToSlash(rel)] = fi.ModTime()
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return objects, nil
+	}
+	return objects, err
+}
+
+func (d *dirStore) Touch(key string) error {
+	now := time.Now()
+	err := os.Chtimes(filepath.Join(d.root, key), now, now)
+	if os.IsNotExist(err) {
+		return errObjectNotFound
+	}
+	return err
+}
+
+// Delete removes the object at key along with its metadata
+func (d *dirStore) Delete(key string) error {
+	p := filepath.Join(d.root, key)
+	for _, f := range []string{p, p + metadataSuffix} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// write writes r to the file at key, renamed into place once complete for
+// the layers cached concurrently to never see it partially written
+func (d *dirStore) write(key string, r io.Reader) error {
+	p := filepath.Join(d.root, key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), "."+filepath.Base(p))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func TestArchive(t *testing.T) {
+	a, err := NewArchive(filepath.Join(t.TempDir(), "export"))
+	testutil.CheckNoError(t, err)
+	img, err := random.Image(1024, 2)
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, a.Put("key", img))
+
+	tarPath := filepath.Join(t.TempDir(), "cache.tar")
+	testutil.CheckNoError(t, a.Export(tarPath))
+
+	imported, err := ImportArchive(tarPath, filepath.Join(t.TempDir(), "import"))
+	testutil.CheckNoError(t, err)
+	digest, err := imported.Probe("key")
+	testutil.CheckNoError(t, err)
+	want, err := img.Digest()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, want, digest)
+	got, err := imported.Get("key", digest)
+	testutil.CheckNoError(t, err)
+	layers, err := got.Layers()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 2, len(layers))
+	if _, err := layers[1].Compressed(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = imported.Probe("missing")
+	if _, ok := err.(NotFoundErr); !ok {
+		t.Fatalf("expected a NotFoundErr, got %v", err)
+	}
+}
+
+func TestImportArchiveInvalidPath(t *testing.T) {
+	tarPath := filepath.Join(t.TempDir(), "cache.tar")
+	f, err := os.Create(tarPath)
+	testutil.CheckNoError(t, err)
+	tw := tar.NewWriter(f)
+	testutil.CheckNoError(t, tw.WriteHeader(&tar.Header{Name: "../escaped", Typeflag: tar.TypeReg, Mode: 0o644}))
+	testutil.CheckNoError(t, tw.Close())
+	testutil.CheckNoError(t, f.Close())
+
+	_, err = ImportArchive(tarPath, filepath.Join(t.TempDir(), "import"))
+	testutil.CheckError(t, true, err)
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// azureBlobHost is the domain of the storage accounts set by name
+	azureBlobHost = ".blob.core.windows.net"
+	// azureBlockSize is the size of the blocks the blobs are uploaded in
+	azureBlockSize = 8 << 20
+	// azureBlockJobs is the number of blocks uploaded concurrently
+	azureBlockJobs = 4
+)
+
+func init() {
+	RegisterBackend("azblob", newAzureBackend)
+}
+
+// azureStore stores the cache in an Azure Blob Storage container, set as
+// --cache-repo=azblob://account/container/prefix. The blobs are uploaded in
+// blocks in parallel.
+type azureStore struct {
+	client *container.Client
+}
+
+func newAzureBackend(_ *config.KanikoOptions, location string) (Backend, error) {
+	containerURL, account, prefix, err := parseAzureLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newAzureContainerClient(containerURL, account)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating Azure Blob Storage client")
+	}
+	return newObjectBackend(&azureStore{client: client}, "azblob://"+location, prefix), nil
+}
+
+// parseAzureLocation returns the URL of the container of an azblob:// cache
+// repo, the name of its storage account and the prefix of the cache in it.
+// The storage account is set either by name or by the host of its blob
+// service, for the clouds other than the public one.
+func parseAzureLocation(location string) (string, string, string, error) {
+	host, rest, _ := strings.Cut(location, "/")
+	containerName, prefix, _ := strings.Cut(rest, "/")
+	if host == "" || containerName == "" {
+		return "", "", "", fmt.Errorf("no storage account or container in cache repo azblob://%s", location)
+	}
+	if !strings.Contains(host, ".") {
+		host += azureBlobHost
+	}
+	account, _, _ := strings.Cut(host, ".")
+	return fmt.Sprintf("https://%s/%s", host, containerName), account, prefix, nil
+}
+
+// newAzureContainerClient returns a client of the container, authenticated
+// with the SAS token in AZURE_STORAGE_SAS_TOKEN, or the access key of the
+// storage account in AZURE_STORAGE_ACCESS_KEY, or else the workload identity
+// or the managed identity of the host.
+func newAzureContainerClient(containerURL, account string) (*container.Client, error) {
+	if sas := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); sas != "" {
+		logrus.Debugf("Authenticating to %s with a SAS token", containerURL)
+		return container.NewClientWithNoCredential(containerURL+"?"+strings.TrimPrefix(sas, "?"), nil)
+	}
+	if key := os.Getenv("AZURE_STORAGE_ACCESS_KEY"); key != "" {
+		logrus.Debugf("Authenticating to %s with the access key of %s", containerURL, account)
+		cred, err := container.NewSharedKeyCredential(account, key)
+		if err != nil {
+			return nil, err
+		}
+		return container.NewClientWithSharedKeyCredential(containerURL, cred, nil)
+	}
+	logrus.Debugf("Authenticating to %s with the workload or managed identity", containerURL)
+	cred, err := azureIdentityCredential()
+	if err != nil {
+		return nil, err
+	}
+	return container.NewClient(containerURL, cred, nil)
+}
+
+// azureIdentityCredential returns the credential of the AKS workload identity
+// if its federated token file is set in AZURE_FEDERATED_TOKEN_FILE, falling
+// back to the managed identity of the host, the user-assigned one in
+// AZURE_CLIENT_ID if set
+func azureIdentityCredential() (azcore.TokenCredential, error) {
+	var creds []azcore.TokenCredential
+	if os.Getenv("AZURE_FEDERATED_TOKEN_FILE") != "" {
+		wi, err := azidentity.NewWorkloadIdentityCredential(nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "getting workload identity credential")
+		}
+		creds = append(creds, wi)
+	}
+	miOpts := &azidentity.ManagedIdentityCredentialOptions{}
+	if id := os.Getenv("AZURE_CLIENT_ID"); id != "" {
+		miOpts.ID = azidentity.ClientID(id)
+	}
+	mi, err := azidentity.NewManagedIdentityCredential(miOpts)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting managed identity credential")
+	}
+	creds = append(creds, mi)
+	return azidentity.NewChainedTokenCredential(creds, nil)
+}
+
+// Metadata returns the metadata of the blob, whose keys Azure may return
+// capitalized
+func (a *azureStore) Metadata(key string) (map[string]string, error) {
+	props, err := a.client.NewBlobClient(key).GetProperties(context.Background(), nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	md := map[string]string{}
+	for k, v := range props.Metadata {
+		if v != nil {
+			md[strings.ToLower(k)] = *v
+		}
+	}
+	return md, nil
+}
+
+func (a *azureStore) Open(key string) (io.ReadCloser, error) {
+	resp, err := a.client.NewBlobClient(key).DownloadStream(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (a *azureStore) Put(key string, r io.Reader, _ int64, contentType string, metadata map[string]string) error {
+	md := make(map[string]*string, len(metadata))
+	for k, v := range metadata {
+		md[k] = &v
+	}
+	_, err := a.client.NewBlockBlobClient(key).UploadStream(context.Background(), r, &blockblob.UploadStreamOptions{
+		BlockSize:   azureBlockSize,
+		Concurrency: azureBlockJobs,
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: &contentType},
+		Metadata:    md,
+	})
+	return err
+}
+
+func (a *azureStore) List(prefix string) (map[string]time.Time, error) {
+	objects := map[string]time.Time{}
+	pages := a.client.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &prefix})
+	for pages.More() {
+		page, err := pages.NextPage(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range page.Segment.BlobItems {
+			if item.Name == nil || item.Properties == nil || item.Properties.LastModified == nil {
+				continue
+			}
+			objects[*item.Name] = *item.Properties.LastModified
+		}
+	}
+	return objects, nil
+}
+
+func (a *azureStore) Delete(key string) error {
+	_, err := a.client.NewBlobClient(key).Delete(context.Background(), nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return nil
+	}
+	return err
+}
+
+// Touch sets the metadata of the blob again, which updates the time it was
+// last modified
+func (a *azureStore) Touch(key string) error {
+	client := a.client.NewBlobClient(key)
+	props, err := client.GetProperties(context.Background(), nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return errObjectNotFound
+	}
+	if err != nil {
+		return err
+	}
+	_, err = client.SetMetadata(context.Background(), props.Metadata, nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return errObjectNotFound
+	}
+	return err
+}
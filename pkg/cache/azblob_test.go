@@ -0,0 +1,84 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestParseAzureLocation(t *testing.T) {
+	tests := []struct {
+		location     string
+		containerURL string
+		account      string
+		prefix       string
+		shouldErr    bool
+	}{
+		{
+			location:     "myaccount/cache/kaniko",
+			containerURL: "https://myaccount.blob.core.windows.net/cache",
+			account:      "myaccount",
+			prefix:       "kaniko",
+		},
+		{
+			location:     "myaccount.blob.core.chinacloudapi.cn/cache",
+			containerURL: "https://myaccount.blob.core.chinacloudapi.cn/cache",
+			account:      "myaccount",
+		},
+		{location: "myaccount", shouldErr: true},
+		{location: "", shouldErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.location, func(t *testing.T) {
+			containerURL, account, prefix, err := parseAzureLocation(tt.location)
+			testutil.CheckError(t, tt.shouldErr, err)
+			testutil.CheckDeepEqual(t, tt.containerURL, containerURL)
+			testutil.CheckDeepEqual(t, tt.account, account)
+			testutil.CheckDeepEqual(t, tt.prefix, prefix)
+		})
+	}
+}
+
+func TestGetAzureBackend(t *testing.T) {
+	t.Setenv("AZURE_STORAGE_SAS_TOKEN", "?sv=2022-11-02&sig=signature")
+	b, err := GetBackend(nil, "azblob://myaccount/cache/kaniko")
+	testutil.CheckNoError(t, err)
+	ob, ok := b.(*objectBackend)
+	if !ok {
+		t.Fatalf("expected an object backend, got %T", b)
+	}
+	testutil.CheckDeepEqual(t, "kaniko", ob.prefix)
+	testutil.CheckDeepEqual(t, "https://myaccount.blob.core.windows.net/cache?sv=2022-11-02&sig=signature", ob.store.(*azureStore).client.URL())
+}
+
+func TestAzureIdentityCredential(t *testing.T) {
+	t.Setenv("AZURE_CLIENT_ID", "00000000-0000-0000-0000-000000000000")
+	t.Setenv("AZURE_TENANT_ID", "")
+	_, err := azureIdentityCredential()
+	testutil.CheckNoError(t, err)
+
+	// The workload identity needs the tenant along with the token file
+	t.Setenv("AZURE_FEDERATED_TOKEN_FILE", filepath.Join(t.TempDir(), "token"))
+	_, err = azureIdentityCredential()
+	testutil.CheckError(t, true, err)
+	t.Setenv("AZURE_TENANT_ID", "11111111-1111-1111-1111-111111111111")
+	_, err = azureIdentityCredential()
+	testutil.CheckNoError(t, err)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Backend stores the cached layers, as single layer images keyed by their
+// cache keys, anywhere else than in a registry or an OCI image layout.
+type Backend interface {
+	// Probe returns the digest of the image cached for key, or a NotFoundErr
+	Probe(key string) (v1.Hash, error)
+	// Get returns the image cached for key with the digest returned by Probe
+	Get(key string, digest v1.Hash) (v1.Image, error)
+	// Put caches image for key
+	Put(key string, image v1.Image) error
+}
+
+// BackendFactory returns the backend storing the cache at location, the
+// cache repo without the scheme of the backend.
+type BackendFactory func(opts *config.KanikoOptions, location string) (Backend, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]BackendFactory{}
+)
+
+// RegisterBackend registers the backend used for the cache repos prefixed with
+// scheme://, e.g. --cache-repo=scheme://location. It is meant to be called by
+// the init functions of the packages implementing backends.
+func RegisterBackend(scheme string, f BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if _, ok := backends[scheme]; ok {
+		panic(fmt.Sprintf("cache backend %q registered twice", scheme))
+	}
+	backends[scheme] = f
+}
+
+// GetBackend returns the backend registered for the scheme of repo, or nil if
+// repo is a registry repository or an OCI image layout.
+func GetBackend(opts *config.KanikoOptions, repo string) (Backend, error) {
+	scheme, location, ok := strings.Cut(repo, "://")
+	if !ok {
+		return nil, nil
+	}
+	backendsMu.RLock()
+	f, ok := backends[scheme]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no cache backend registered for %s://", scheme)
+	}
+	return f(opts, location)
+}
+
+// BackendCache is the cache stored in a Backend
+type BackendCache struct {
+	Opts    *config.KanikoOptions
+	Backend Backend
+}
+
+// RetrieveLayer retrieves a layer from the backend given the cache key ck.
+func (bc *BackendCache) RetrieveLayer(ck string) (v1.Image, error) {
+	logrus.Infof("Checking for cached layer %s in %s...", ck, bc.Opts.CacheRepo)
+	digest, err := bc.Backend.Probe(ck)
+	if err != nil {
+		return nil, err
+	}
+	img, err := bc.Backend.Get(ck, digest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting cached layer %s", ck)
+	}
+	if err = verifyImage(img, bc.Opts.CacheTTL, ck); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+type memoryBackend map[string]v1.Image
+
+func (m memoryBackend) Probe(key string) (v1.Hash, error) {
+	img, ok := m[key]
+	if !ok {
+		return v1.Hash{}, NotFoundErr{msg: key + " not found"}
+	}
+	return img.Digest()
+}
+
+func (m memoryBackend) Get(key string, _ v1.Hash) (v1.Image, error) {
+	return m[key], nil
+}
+
+func (m memoryBackend) Put(key string, image v1.Image) error {
+	m[key] = image
+	return nil
+}
+
+func TestBackendCache(t *testing.T) {
+	backend := memoryBackend{}
+	RegisterBackend("memory", func(_ *config.KanikoOptions, location string) (Backend, error) {
+		testutil.CheckDeepEqual(t, "store/cache", location)
+		return backend, nil
+	})
+	opts := &config.KanikoOptions{CacheRepo: "memory://store/cache", CacheOptions: config.CacheOptions{CacheTTL: time.Hour}}
+
+	b, err := GetBackend(opts, opts.CacheRepo)
+	testutil.CheckNoError(t, err)
+	lc := &BackendCache{Opts: opts, Backend: b}
+
+	_, err = lc.RetrieveLayer("key")
+	testutil.CheckDeepEqual(t, true, IsNotFound(err))
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err = mutate.CreatedAt(img, v1.Time{Time: time.Now()})
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, b.Put("key", img))
+	got, err := lc.RetrieveLayer("key")
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, true, got == img)
+}
+
+func TestGetBackend(t *testing.T) {
+	b, err := GetBackend(&config.KanikoOptions{}, "gcr.io/project/cache")
+	testutil.CheckErrorAndDeepEqual(t, false, err, nil, b)
+
+	_, err = GetBackend(&config.KanikoOptions{}, "unknown://bucket")
+	testutil.CheckError(t, true, err)
+}
+
+func TestMultiCache(t *testing.T) {
+	opts := &config.KanikoOptions{CacheOptions: config.CacheOptions{CacheTTL: time.Hour}}
+	project, org := memoryBackend{}, memoryBackend{}
+	mc := MultiCache{&BackendCache{Opts: opts, Backend: project}, &BackendCache{Opts: opts, Backend: org}}
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err = mutate.CreatedAt(img, v1.Time{Time: time.Now()})
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, org.Put("key", img))
+
+	got, err := mc.RetrieveLayer("key")
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, true, got == img)
+	_, err = mc.RetrieveLayer("missing")
+	testutil.CheckDeepEqual(t, true, IsNotFound(err))
+}
@@ -41,6 +41,22 @@ type LayerCache interface {
 	RetrieveLayer(string) (v1.Image, error)
 }
 
+// MultiCache is made of the caches of several cache repos, in which the
+// layers are looked up in order
+type MultiCache []LayerCache
+
+// RetrieveLayer retrieves a layer from the first cache holding the cache key ck.
+func (mc MultiCache) RetrieveLayer(ck string) (v1.Image, error) {
+	var err error
+	for _, c := range mc {
+		var img v1.Image
+		if img, err = c.RetrieveLayer(ck); err == nil {
+			return img, nil
+		}
+	}
+	return nil, err
+}
+
 // RegistryCache is the registry cache
 type RegistryCache struct {
 	Opts *config.KanikoOptions
@@ -73,7 +89,7 @@ func (rc *RegistryCache) RetrieveLayer(ck string) (v1.Image, error) {
 		return nil, errors.Wrapf(err, "making transport for registry %q", registryName)
 	}
 
-	img, err := remote.Image(cacheRef, remote.WithTransport(tr), remote.WithAuthFromKeychain(creds.GetKeychain()))
+	img, err := remote.Image(cacheRef, remote.WithTransport(tr), remote.WithAuthFromKeychain(creds.Keychain(&rc.Opts.RegistryOptions)))
 	if err != nil {
 		return nil, err
 	}
@@ -94,7 +110,7 @@ func verifyImage(img v1.Image, cacheTTL time.Duration, cache string) error {
 	// Layer is stale, rebuild it.
 	if expiry.Before(time.Now()) {
 		logrus.Infof("Cache entry expired: %s", cache)
-		return fmt.Errorf("Cache entry expired: %s", cache)
+		return ExpiredErr{msg: fmt.Sprintf("Cache entry expired: %s", cache)}
 	}
 
 	// Force the manifest to be populated
@@ -117,7 +133,7 @@ func (lc *LayoutCache) RetrieveLayer(ck string) (v1.Image, error) {
 	logrus.Infof("Checking for cached layer %s...", cache)
 
 	var img v1.Image
-	if img, err = locateImage(strings.TrimPrefix(cache, "oci:")); err != nil {
+	if img, err = LocateImage(strings.TrimPrefix(cache, "oci:")); err != nil {
 		return nil, errors.Wrap(err, "locating cache image")
 	}
 
@@ -127,7 +143,8 @@ func (lc *LayoutCache) RetrieveLayer(ck string) (v1.Image, error) {
 	return img, nil
 }
 
-func locateImage(path string) (v1.Image, error) {
+// LocateImage returns the last image of the OCI image layout at path
+func LocateImage(path string) (v1.Image, error) {
 	var img v1.Image
 	layoutPath, err := layout.FromPath(path)
 	if err != nil {
@@ -194,9 +211,19 @@ func LocalSource(opts *config.CacheOptions, cacheKey string) (v1.Image, error) {
 	}
 
 	logrus.Infof("Found %s in local cache", cacheKey)
+	touchCachedImage(path, fi)
 	return cachedImageFromPath(path)
 }
 
+// touchCachedImage records the use of the cached image at path in its access
+// time, for the least recently used images to be evicted first. The
+// modification time is left as is, as it's the time the image was cached at.
+func touchCachedImage(path string, fi os.FileInfo) {
+	if err := os.Chtimes(path, time.Now(), fi.ModTime()); err != nil {
+		logrus.Debugf("Unable to update access time of %s: %v", path, err)
+	}
+}
+
 // cachedImage represents a v1.Tarball that is cached locally in a CAS.
 // Computing the digest for a v1.Tarball is very expensive. If the tarball
 // is named with the digest we can store this and return it directly rather
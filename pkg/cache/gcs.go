@@ -0,0 +1,282 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/util/bucket"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// gcsPartSize is the size of the parts of the large objects, uploaded in
+	// parallel and composed into the objects
+	gcsPartSize = 64 << 20
+	// gcsPartJobs is the number of parts uploaded concurrently
+	gcsPartJobs = 4
+	// gcsMaxComposeSources is the number of objects GCS composes at most at
+	// once
+	gcsMaxComposeSources = 32
+)
+
+func init() {
+	RegisterBackend("gs", newGCSBackend)
+}
+
+// gcsStore stores the cache in a GCS bucket, set as
+// --cache-repo=gs://bucket/prefix. The objects are written with resumable
+// uploads, and the large ones are uploaded in parallel parts composed into
+// them.
+type gcsStore struct {
+	bucket   *storage.BucketHandle
+	partSize int64
+}
+
+func newGCSBackend(_ *config.KanikoOptions, location string) (Backend, error) {
+	bucketName, prefix, _ := strings.Cut(location, "/")
+	if bucketName == "" {
+		return nil, fmt.Errorf("no bucket in cache repo gs://%s", location)
+	}
+	client, err := bucket.NewClient(context.Background())
+	if err != nil {
+		return nil, errors.Wrap(err, "creating GCS client")
+	}
+	store := &gcsStore{bucket: client.Bucket(bucketName), partSize: gcsPartSize}
+	return newObjectBackend(store, "gs://"+location, prefix), nil
+}
+
+func (g *gcsStore) Metadata(key string) (map[string]string, error) {
+	attrs, err := g.bucket.Object(key).Attrs(context.Background())
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return attrs.Metadata, nil
+}
+
+func (g *gcsStore) Open(key string) (io.ReadCloser, error) {
+	return g.bucket.Object(key).NewReader(context.Background())
+}
+
+func (g *gcsStore) Put(key string, r io.Reader, size int64, contentType string, metadata map[string]string) error {
+	if size <= g.partSize {
+		return g.upload(context.Background(), key, r, contentType, metadata)
+	}
+	return g.compositeUpload(key, r, contentType, metadata)
+}
+
+func (g *gcsStore) List(prefix string) (map[string]time.Time, error) {
+	objects := map[string]time.Time{}
+	it := g.bucket.Objects(context.Background(), &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects[attrs.Name] = attrs.Updated
+	}
+}
+
+func (g *gcsStore) Delete(key string) error {
+	err := g.bucket.Object(key).Delete(context.Background())
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Touch updates the custom time of the object, which updates the time it was
+// last written
+func (g *gcsStore) Touch(key string) error {
+	_, err := g.bucket.Object(key).Update(context.Background(), storage.ObjectAttrsToUpdate{CustomTime: time.Now()})
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return errObjectNotFound
+	}
+	return err
+}
+
+// upload writes r to the object at key with a resumable upload
+func (g *gcsStore) upload(ctx context.Context, key string, r io.Reader, contentType string, metadata map[string]string) error {
+	// The upload is aborted by canceling its context
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := g.bucket.Object(key).NewWriter(ctx)
+	w.ContentType = contentType
+	w.Metadata = metadata
+	if _, err := io.Copy(w, r); err != nil {
+		cancel()
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// compositeUpload uploads the parts of r in parallel as temporary objects,
+// composed into the object at key once all uploaded
+func (g *gcsStore) compositeUpload(key string, r io.Reader, contentType string, metadata map[string]string) error {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return err
+	}
+	// The parts of concurrent uploads of the same object must not collide
+	tmp := fmt.Sprintf("%s.parts-%s/", key, hex.EncodeToString(suffix))
+	var created []string
+	defer func() { g.deleteObjects(created) }()
+
+	eg, ctx := errgroup.WithContext(context.Background())
+	eg.SetLimit(gcsPartJobs)
+	// The buffers of the parts uploaded are reused for the next parts
+	bufs := newPartBuffers(g.partSize, gcsPartJobs)
+	var parts []string
+	for i := 0; ; i++ {
+		buf, err := bufs.get(ctx)
+		if err != nil {
+			// An upload failed
+			break
+		}
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			part := fmt.Sprintf("%s%05d", tmp, i)
+			parts = append(parts, part)
+			created = append(created, part)
+			eg.Go(func() error {
+				defer bufs.put(buf)
+				return g.upload(ctx, part, bytes.NewReader(buf[:n]), "", nil)
+			})
+		} else {
+			bufs.put(buf)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			_ = eg.Wait()
+			return err
+		}
+	}
+	if err := eg.Wait(); err != nil {
+		return errors.Wrap(err, "uploading part")
+	}
+	logrus.Debugf("Composing %d parts into %s", len(parts), key)
+
+	// Composing more objects than GCS composes at once takes intermediate
+	// objects
+	for level := 1; len(parts) > gcsMaxComposeSources; level++ {
+		var next []string
+		for i, group := range composeGroups(parts) {
+			intermediate := fmt.Sprintf("%s%d-%05d", tmp, level, i)
+			created = append(created, intermediate)
+			if err := g.compose(intermediate, group, "", nil); err != nil {
+				return err
+			}
+			next = append(next, intermediate)
+		}
+		parts = next
+	}
+	return g.compose(key, parts, contentType, metadata)
+}
+
+// partBuffers are the buffers of the parts of a composite upload, of which at
+// most jobs are allocated
+type partBuffers struct {
+	size int64
+	jobs int
+	// allocated is only read and written by the goroutine calling get
+	allocated int
+	free      chan []byte
+}
+
+func newPartBuffers(size int64, jobs int) *partBuffers {
+	return &partBuffers{size: size, jobs: jobs, free: make(chan []byte, jobs)}
+}
+
+// get returns a free buffer, allocated if less than jobs are, or waits for one
+// to be put back until ctx is done
+func (p *partBuffers) get(ctx context.Context) ([]byte, error) {
+	select {
+	case buf := <-p.free:
+		return buf, nil
+	default:
+	}
+	if p.allocated < p.jobs {
+		p.allocated++
+		return make([]byte, p.size), nil
+	}
+	select {
+	case buf := <-p.free:
+		return buf, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// put gives back a buffer returned by get
+func (p *partBuffers) put(buf []byte) {
+	p.free <- buf
+}
+
+// compose composes the objects srcs into the object at key
+func (g *gcsStore) compose(key string, srcs []string, contentType string, metadata map[string]string) error {
+	objects := make([]*storage.ObjectHandle, len(srcs))
+	for i, src := range srcs {
+		objects[i] = g.bucket.Object(src)
+	}
+	c := g.bucket.Object(key).ComposerFrom(objects...)
+	c.ContentType = contentType
+	c.Metadata = metadata
+	if _, err := c.Run(context.Background()); err != nil {
+		return errors.Wrapf(err, "composing %s", key)
+	}
+	return nil
+}
+
+// deleteObjects deletes the temporary objects of an upload
+func (g *gcsStore) deleteObjects(keys []string) {
+	for _, key := range keys {
+		if err := g.bucket.Object(key).Delete(context.Background()); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			logrus.Warnf("Unable to delete temporary object %s: %v", key, err)
+		}
+	}
+}
+
+// composeGroups splits srcs into the groups of objects composed at once
+func composeGroups(srcs []string) [][]string {
+	var groups [][]string
+	for len(srcs) > gcsMaxComposeSources {
+		groups = append(groups, srcs[:gcsMaxComposeSources])
+		srcs = srcs[gcsMaxComposeSources:]
+	}
+	return append(groups, srcs)
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestComposeGroups(t *testing.T) {
+	parts := func(n int) []string {
+		var p []string
+		for i := 0; i < n; i++ {
+			p = append(p, fmt.Sprint(i))
+		}
+		return p
+	}
+	var sizes []int
+	for _, g := range composeGroups(parts(70)) {
+		sizes = append(sizes, len(g))
+	}
+	testutil.CheckDeepEqual(t, []int{32, 32, 6}, sizes)
+	testutil.CheckDeepEqual(t, [][]string{parts(32)}, composeGroups(parts(32)))
+	testutil.CheckDeepEqual(t, "64", composeGroups(parts(70))[2][0])
+}
+
+func TestPartBuffers(t *testing.T) {
+	bufs := newPartBuffers(16, 2)
+	ctx := context.Background()
+	first, err := bufs.get(ctx)
+	testutil.CheckNoError(t, err)
+	_, err = bufs.get(ctx)
+	testutil.CheckNoError(t, err)
+
+	// No more than jobs buffers are allocated
+	canceled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = bufs.get(canceled)
+	testutil.CheckDeepEqual(t, context.DeadlineExceeded, err)
+
+	first[0] = 1
+	bufs.put(first)
+	reused, err := bufs.get(ctx)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, byte(1), reused[0])
+	testutil.CheckDeepEqual(t, 2, bufs.allocated)
+}
+
+func TestGetGCSBackend(t *testing.T) {
+	_, err := GetBackend(nil, "gs://")
+	testutil.CheckError(t, true, err)
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/chainguard-dev/kaniko/pkg/version"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+)
+
+// LayerIndex is a local index of the compressed layers pushed to registries,
+// keyed by the digests of their uncompressed contents, for the builds making
+// the same layers again to know their digests without compressing them.
+type LayerIndex struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]*LayerIndexEntry
+	// built are the keys of the layers built by this process, by diff id
+	built map[v1.Hash]string
+}
+
+// LayerIndexEntry is a compressed layer of the index
+type LayerIndexEntry struct {
+	Digest v1.Hash `json:"digest"`
+	Size   int64   `json:"size"`
+	// Repositories are the repositories the layer was pushed to
+	Repositories []string `json:"repositories"`
+}
+
+// LayerIndexKey returns the key of the layer with the uncompressed contents
+// diffID, of media type mt, compressed with compression by this version of
+// kaniko, as other versions may compress differently.
+func LayerIndexKey(diffID v1.Hash, mt types.MediaType, compression string) string {
+	return strings.Join([]string{diffID.String(), string(mt), compression, version.Version()}, "|")
+}
+
+// OpenLayerIndex loads the layer index at path, which is empty if missing
+func OpenLayerIndex(path string) (*LayerIndex, error) {
+	i := &LayerIndex{path: path, built: map[v1.Hash]string{}}
+	entries, err := readLayerIndex(path)
+	if err != nil {
+		return nil, err
+	}
+	i.entries = entries
+	return i, nil
+}
+
+func readLayerIndex(path string) (map[string]*LayerIndexEntry, error) {
+	entries := map[string]*LayerIndexEntry{}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "reading layer index")
+	}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, errors.Wrapf(err, "parsing layer index %s", path)
+	}
+	return entries, nil
+}
+
+// Lookup returns the compressed layer of key pushed to all repositories
+func (i *LayerIndex) Lookup(key string, repositories []string) (*LayerIndexEntry, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	e, ok := i.entries[key]
+	if !ok {
+		return nil, false
+	}
+	for _, repo := range repositories {
+		if !slices.Contains(e.Repositories, repo) {
+			return nil, false
+		}
+	}
+	return e, true
+}
+
+// Built records that this process built the layer with the uncompressed
+// contents diffID, with the given key, to record it once pushed.
+func (i *LayerIndex) Built(diffID v1.Hash, key string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.built[diffID] = key
+}
+
+// Pushed records that the layer with the uncompressed contents diffID, if it
+// was built by this process, was pushed to repository as digest.
+func (i *LayerIndex) Pushed(diffID, digest v1.Hash, size int64, repository string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	key, ok := i.built[diffID]
+	if !ok {
+		return
+	}
+	e, ok := i.entries[key]
+	if !ok || e.Digest != digest {
+		e = &LayerIndexEntry{Digest: digest, Size: size}
+		i.entries[key] = e
+	}
+	if !slices.Contains(e.Repositories, repository) {
+		e.Repositories = append(e.Repositories, repository)
+	}
+}
+
+// Save writes the index, merged with the entries written by other builds
+// since it was loaded.
+func (i *LayerIndex) Save() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	entries, err := readLayerIndex(i.path)
+	if err != nil {
+		return err
+	}
+	for key, e := range i.entries {
+		current, ok := entries[key]
+		if !ok || current.Digest != e.Digest {
+			entries[key] = e
+			continue
+		}
+		for _, repo := range e.Repositories {
+			if !slices.Contains(current.Repositories, repo) {
+				current.Repositories = append(current.Repositories, repo)
+			}
+		}
+	}
+	i.entries = entries
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(i.path), 0o755); err != nil {
+		return errors.Wrap(err, "creating layer index directory")
+	}
+	f, err := os.CreateTemp(filepath.Dir(i.path), filepath.Base(i.path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return errors.Wrap(os.Rename(f.Name(), i.path), "writing layer index")
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestLayerIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index", "layers.json")
+	diffID := v1.Hash{Algorithm: "sha256", Hex: "1111111111111111111111111111111111111111111111111111111111111111"}
+	digest := v1.Hash{Algorithm: "sha256", Hex: "2222222222222222222222222222222222222222222222222222222222222222"}
+	key := LayerIndexKey(diffID, types.OCILayer, "gzip--1")
+
+	i, err := OpenLayerIndex(path)
+	testutil.CheckNoError(t, err)
+	i.Built(diffID, key)
+	// Only the layers built by this process are recorded
+	i.Pushed(digest, digest, 10, "gcr.io/foo/other")
+	i.Pushed(diffID, digest, 10, "gcr.io/foo/bar")
+	testutil.CheckNoError(t, i.Save())
+
+	// Another build pushes the layer to another repository meanwhile
+	other, err := OpenLayerIndex(path)
+	testutil.CheckNoError(t, err)
+	other.Built(diffID, key)
+	other.Pushed(diffID, digest, 10, "gcr.io/foo/baz")
+	testutil.CheckNoError(t, other.Save())
+	testutil.CheckNoError(t, i.Save())
+
+	i, err = OpenLayerIndex(path)
+	testutil.CheckNoError(t, err)
+	e, ok := i.Lookup(key, []string{"gcr.io/foo/bar", "gcr.io/foo/baz"})
+	testutil.CheckDeepEqual(t, true, ok)
+	testutil.CheckDeepEqual(t, &LayerIndexEntry{Digest: digest, Size: 10, Repositories: []string{"gcr.io/foo/bar", "gcr.io/foo/baz"}}, e)
+
+	_, ok = i.Lookup(key, []string{"gcr.io/foo/bar", "gcr.io/foo/other"})
+	testutil.CheckDeepEqual(t, false, ok)
+	_, ok = i.Lookup(LayerIndexKey(diffID, types.OCILayerZStd, "zstd--1"), []string{"gcr.io/foo/bar"})
+	testutil.CheckDeepEqual(t, false, ok)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// lockFile is the file of the local cache locked by the builds using it and
+// by its pruning
+const lockFile = ".lock"
+
+// Lock is a lock on the local cache. The builds using the cache share it, for
+// the base images and layers they are about to use not to be evicted, while
+// pruning the cache takes it exclusively.
+type Lock struct {
+	f *os.File
+}
+
+// LockShared takes a shared lock on the local cache in dir, waiting for its
+// pruning if any. The lock is not taken, and nil is returned, if the cache
+// cannot be written to or is missing, as it cannot be pruned either.
+func LockShared(dir string) (*Lock, error) {
+	f, err := openLock(dir)
+	if os.IsNotExist(err) || os.IsPermission(err) || errors.Is(err, unix.EROFS) {
+		logrus.Debugf("Not locking cache %s: %v", dir, err)
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "opening lock of cache %s", dir)
+	}
+	if err := flock(f, unix.LOCK_SH); err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "locking cache %s", dir)
+	}
+	return &Lock{f: f}, nil
+}
+
+// lockExclusive takes an exclusive lock on the local cache in dir, returning
+// nil if it is used by builds or pruned already
+func lockExclusive(dir string) (*Lock, error) {
+	f, err := openLock(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening lock of cache %s", dir)
+	}
+	if err := flock(f, unix.LOCK_EX|unix.LOCK_NB); errors.Is(err, unix.EWOULDBLOCK) {
+		f.Close()
+		logrus.Infof("Cache %s is used by other builds, leaving it to them to prune it", dir)
+		return nil, nil
+	} else if err != nil {
+		f.Close()
+		return nil, errors.Wrapf(err, "locking cache %s", dir)
+	}
+	return &Lock{f: f}, nil
+}
+
+// openLock opens the lock file of the local cache in dir, creating it if
+// missing
+func openLock(dir string) (*os.File, error) {
+	return os.OpenFile(filepath.Join(dir, lockFile), os.O_CREATE|os.O_RDONLY, 0o644)
+}
+
+func flock(f *os.File, how int) error {
+	for {
+		err := unix.Flock(int(f.Fd()), how)
+		if !errors.Is(err, unix.EINTR) {
+			return err
+		}
+	}
+}
+
+// Close releases the lock
+func (l *Lock) Close() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
@@ -0,0 +1,357 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// digestMetadata is the metadata of the manifests stored in buckets holding
+// their digest, for the cached layers to be probed without downloading them
+const digestMetadata = "digest"
+
+// errObjectNotFound is returned by the object stores for missing objects
+var errObjectNotFound = errors.New("object not found")
+
+// objectStore is the bucket an objectBackend stores the cache in
+type objectStore interface {
+	// Metadata returns the metadata of the object at key, or
+	// errObjectNotFound
+	Metadata(key string) (map[string]string, error)
+	// Open opens the object at key
+	Open(key string) (io.ReadCloser, error)
+	// Put writes the size bytes read from r to the object at key
+	Put(key string, r io.Reader, size int64, contentType string, metadata map[string]string) error
+	// List returns the keys of the objects under prefix, with the time they
+	// were last written
+	List(prefix string) (map[string]time.Time, error)
+	// Delete deletes the object at key, if it exists
+	Delete(key string) error
+	// Touch updates the time the object at key was last written, or returns
+	// errObjectNotFound
+	Touch(key string) error
+}
+
+// objectBackend stores the cache in a bucket, set as
+// --cache-repo=scheme://bucket/prefix. The blobs of the cached images are
+// stored once under prefix/blobs/sha256/, and their manifests under
+// prefix/manifests/<cache key>.
+type objectBackend struct {
+	store objectStore
+	// location is the cache repo, for the messages
+	location string
+	prefix   string
+}
+
+func newObjectBackend(store objectStore, location, prefix string) *objectBackend {
+	return &objectBackend{store: store, location: location, prefix: strings.Trim(prefix, "/")}
+}
+
+// Probe returns the digest of the manifest cached for key, from its metadata
+func (b *objectBackend) Probe(key string) (v1.Hash, error) {
+	md, err := b.store.Metadata(b.manifestKey(key))
+	if errors.Is(err, errObjectNotFound) {
+		return v1.Hash{}, NotFoundErr{msg: fmt.Sprintf("no cached layer %s in %s", key, b.location)}
+	}
+	if err != nil {
+		return v1.Hash{}, errors.Wrapf(err, "looking up cached layer %s", key)
+	}
+	digest, ok := md[digestMetadata]
+	if !ok {
+		return v1.Hash{}, fmt.Errorf("cached layer %s has no %s metadata", key, digestMetadata)
+	}
+	return v1.NewHash(digest)
+}
+
+// Get returns the image whose manifest is cached for key. Its blobs are
+// downloaded when read.
+func (b *objectBackend) Get(key string, digest v1.Hash) (v1.Image, error) {
+	manifest, err := b.read(b.manifestKey(key))
+	if err != nil {
+		return nil, err
+	}
+	got, _, err := v1.SHA256(bytes.NewReader(manifest))
+	if err != nil {
+		return nil, err
+	}
+	if got != digest {
+		return nil, fmt.Errorf("cached layer %s changed since it was probed, its digest is %s instead of %s", key, got, digest)
+	}
+	m, err := v1.ParseManifest(bytes.NewReader(manifest))
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing manifest of cached layer %s", key)
+	}
+	return partial.CompressedToImage(&objectImage{backend: b, rawManifest: manifest, manifest: m})
+}
+
+// Put stores the blobs of image missing from the bucket, then its manifest
+func (b *objectBackend) Put(key string, image v1.Image) error {
+	layers, err := image.Layers()
+	if err != nil {
+		return err
+	}
+	for _, l := range layers {
+		digest, err := l.Digest()
+		if err != nil {
+			return err
+		}
+		size, err := l.Size()
+		if err != nil {
+			return err
+		}
+		mt, err := l.MediaType()
+		if err != nil {
+			return err
+		}
+		if err := b.putBlob(digest, size, mt, l.Compressed); err != nil {
+			return err
+		}
+	}
+	m, err := image.Manifest()
+	if err != nil {
+		return err
+	}
+	if err := b.putBlob(m.Config.Digest, m.Config.Size, m.Config.MediaType, func() (io.ReadCloser, error) {
+		cfg, err := image.RawConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(cfg)), nil
+	}); err != nil {
+		return err
+	}
+
+	manifest, err := image.RawManifest()
+	if err != nil {
+		return err
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		return err
+	}
+	mt, err := image.MediaType()
+	if err != nil {
+		return err
+	}
+	md := map[string]string{digestMetadata: digest.String()}
+	if err := b.store.Put(b.manifestKey(key), bytes.NewReader(manifest), int64(len(manifest)), string(mt), md); err != nil {
+		return errors.Wrapf(err, "storing manifest of cached layer %s", key)
+	}
+	return nil
+}
+
+// putBlob stores the blob with digest, opened with open, unless it is already
+// in the bucket. A blob already there is touched instead, for a concurrent
+// PruneExpired not to delete it once the manifest referencing it is stored.
+func (b *objectBackend) putBlob(digest v1.Hash, size int64, mt types.MediaType, open func() (io.ReadCloser, error)) error {
+	key := b.blobKey(digest)
+	err := b.store.Touch(key)
+	if err == nil {
+		logrus.Debugf("Blob %s is already in %s", digest, b.location)
+		return nil
+	}
+	if !errors.Is(err, errObjectNotFound) {
+		return errors.Wrapf(err, "touching blob %s", digest)
+	}
+	rc, err := open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := b.store.Put(key, rc, size, string(mt), nil); err != nil {
+		return errors.Wrapf(err, "storing blob %s", digest)
+	}
+	return nil
+}
+
+// PruneExpired deletes the cached layers older than ttl, which are treated as
+// misses, then the blobs referenced by none of the remaining layers and
+// written before the layers expire. The time a blob was written is checked
+// again right before deleting it, since the layers cached meanwhile touch the
+// blobs they reuse. It returns the number of layers deleted.
+func (b *objectBackend) PruneExpired(ttl time.Duration) (int, error) {
+	cutoff := time.Now().Add(-ttl)
+	manifests, err := b.store.List(path.Join(b.prefix, "manifests") + "/")
+	if err != nil {
+		return 0, errors.Wrapf(err, "listing cached layers of %s", b.location)
+	}
+	keys := make([]string, 0, len(manifests))
+	for key := range manifests {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	used := map[string]bool{}
+	pruned := 0
+	for _, key := range keys {
+		blobs, created, err := b.manifestBlobs(key)
+		switch {
+		case err != nil:
+			// The blobs are stored before the manifest, which is unusable
+			logrus.Warnf("Deleting unreadable cached layer %s from %s: %v", path.Base(key), b.location, err)
+		case !isCacheKey(path.Base(key)) || !created.Before(cutoff):
+			// The stages pushed to the cache are kept, as they are created
+			// when their base image was
+			for _, blob := range blobs {
+				used[blob] = true
+			}
+			continue
+		default:
+			logrus.Infof("Deleting cached layer %s from %s, created %s", path.Base(key), b.location, created.Format(time.RFC3339))
+		}
+		if err := b.store.Delete(key); err != nil {
+			return pruned, errors.Wrapf(err, "deleting cached layer %s", path.Base(key))
+		}
+		pruned++
+	}
+	blobs, err := b.store.List(path.Join(b.prefix, "blobs") + "/")
+	if err != nil {
+		return pruned, errors.Wrapf(err, "listing blobs of %s", b.location)
+	}
+	for key, written := range blobs {
+		if used[key] || !written.Before(cutoff) {
+			continue
+		}
+		current, err := b.store.List(key)
+		if err != nil {
+			return pruned, errors.Wrapf(err, "listing blob %s", key)
+		}
+		if written, ok := current[key]; !ok || !written.Before(cutoff) {
+			logrus.Debugf("Keeping blob %s of %s, reused since it was listed", key, b.location)
+			continue
+		}
+		logrus.Debugf("Deleting unused blob %s from %s", key, b.location)
+		if err := b.store.Delete(key); err != nil {
+			return pruned, errors.Wrapf(err, "deleting blob %s", key)
+		}
+	}
+	return pruned, nil
+}
+
+// manifestBlobs returns the keys of the blobs of the cached layer whose
+// manifest is at key, and the time it was created at
+func (b *objectBackend) manifestBlobs(key string) ([]string, time.Time, error) {
+	raw, err := b.read(key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	m, err := v1.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "parsing manifest")
+	}
+	rawConfig, err := b.read(b.blobKey(m.Config.Digest))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	cf, err := v1.ParseConfigFile(bytes.NewReader(rawConfig))
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "parsing config")
+	}
+	blobs := []string{b.blobKey(m.Config.Digest)}
+	for _, l := range m.Layers {
+		blobs = append(blobs, b.blobKey(l.Digest))
+	}
+	return blobs, cf.Created.Time, nil
+}
+
+func (b *objectBackend) read(key string) ([]byte, error) {
+	rc, err := b.store.Open(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s from %s", key, b.location)
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func (b *objectBackend) manifestKey(key string) string {
+	return path.Join(b.prefix, "manifests", key)
+}
+
+func (b *objectBackend) blobKey(digest v1.Hash) string {
+	return path.Join(b.prefix, "blobs", digest.Algorithm, digest.Hex)
+}
+
+// objectImage is an image cached in a bucket
+type objectImage struct {
+	backend     *objectBackend
+	rawManifest []byte
+	manifest    *v1.Manifest
+
+	configOnce sync.Once
+	config     []byte
+	configErr  error
+}
+
+var _ partial.CompressedImageCore = (*objectImage)(nil)
+
+func (i *objectImage) RawManifest() ([]byte, error) {
+	return i.rawManifest, nil
+}
+
+func (i *objectImage) MediaType() (types.MediaType, error) {
+	return i.manifest.MediaType, nil
+}
+
+func (i *objectImage) RawConfigFile() ([]byte, error) {
+	i.configOnce.Do(func() {
+		i.config, i.configErr = i.backend.read(i.backend.blobKey(i.manifest.Config.Digest))
+	})
+	return i.config, i.configErr
+}
+
+func (i *objectImage) LayerByDigest(digest v1.Hash) (partial.CompressedLayer, error) {
+	for _, desc := range i.manifest.Layers {
+		if desc.Digest == digest {
+			return &objectLayer{backend: i.backend, desc: desc}, nil
+		}
+	}
+	return nil, fmt.Errorf("no layer %s in the cached image", digest)
+}
+
+// objectLayer is a layer of an image cached in a bucket, downloaded when read
+type objectLayer struct {
+	backend *objectBackend
+	desc    v1.Descriptor
+}
+
+func (l *objectLayer) Digest() (v1.Hash, error) {
+	return l.desc.Digest, nil
+}
+
+func (l *objectLayer) Compressed() (io.ReadCloser, error) {
+	return l.backend.store.Open(l.backend.blobKey(l.desc.Digest))
+}
+
+func (l *objectLayer) Size() (int64, error) {
+	return l.desc.Size, nil
+}
+
+func (l *objectLayer) MediaType() (types.MediaType, error) {
+	return l.desc.MediaType, nil
+}
@@ -0,0 +1,326 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	units "github.com/docker/go-units"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// cacheEntry is a base image of the local cache, along with the files and
+// directories storing it
+type cacheEntry struct {
+	digest   string
+	paths    []string
+	size     int64
+	lastUsed time.Time
+}
+
+// Prune evicts the least recently used base images and layers from the local
+// cache until it takes at most maxSize bytes. Images used since usedSince are
+// kept even if the cache stays over budget, so that the images just warmed
+// are not evicted. The cache is not pruned while builds use it, as they may
+// be about to use the images and layers it would evict; the last of them
+// prunes it.
+func Prune(opts *config.CacheOptions, maxSize int64, usedSince time.Time) error {
+	lock, err := lockExclusive(opts.CacheDir)
+	if err != nil || lock == nil {
+		return err
+	}
+	defer lock.Close()
+	entries, err := cacheEntries(opts)
+	if err != nil {
+		return errors.Wrapf(err, "listing cache %s", opts.CacheDir)
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.size
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUsed.Before(entries[j].lastUsed)
+	})
+	evicted := false
+	for _, e := range entries {
+		if total <= maxSize || !e.lastUsed.Before(usedSince) {
+			break
+		}
+		logrus.Infof("Evicting %s from cache, last used %s", e.digest, e.lastUsed.Format(time.RFC3339))
+		for _, p := range e.paths {
+			if err := os.RemoveAll(p); err != nil {
+				return errors.Wrapf(err, "evicting %s", e.digest)
+			}
+		}
+		total -= e.size
+		evicted = true
+	}
+	if evicted {
+		if err := sweepLayerBlobs(opts, usedSince); err != nil {
+			return errors.Wrap(err, "removing unused blobs")
+		}
+	}
+	if total > maxSize {
+		logrus.Warnf("Cache %s takes %s, over the budget of %s", opts.CacheDir, units.BytesSize(float64(total)), units.BytesSize(float64(maxSize)))
+	}
+	return nil
+}
+
+// PruneExpired removes the base images and the layers of the local cache
+// which expired with opts.CacheTTL, as the builds treat them as misses. It
+// returns the number of images and layers removed, none while builds use the
+// cache.
+func PruneExpired(opts *config.CacheOptions) (int, error) {
+	lock, err := lockExclusive(opts.CacheDir)
+	if err != nil || lock == nil {
+		return 0, err
+	}
+	defer lock.Close()
+	entries, err := baseImageEntries(opts)
+	if err != nil {
+		return 0, errors.Wrapf(err, "listing cache %s", opts.CacheDir)
+	}
+	cutoff := time.Now().Add(-opts.CacheTTL)
+	pruned := 0
+	for _, e := range entries {
+		// The base images expire with the time they were cached at, like in
+		// LocalSource
+		fi, err := os.Stat(filepath.Join(opts.CacheDir, e.digest))
+		if err != nil || !fi.ModTime().Before(cutoff) {
+			continue
+		}
+		logrus.Infof("Removing %s from cache, cached %s", e.digest, fi.ModTime().Format(time.RFC3339))
+		for _, p := range e.paths {
+			if err := os.RemoveAll(p); err != nil {
+				return pruned, errors.Wrapf(err, "removing %s", e.digest)
+			}
+		}
+		pruned++
+	}
+	dir := LocalLayersDir(opts)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return pruned, nil
+	}
+	layers, err := newObjectBackend(&dirStore{root: dir}, dir, "").PruneExpired(opts.CacheTTL)
+	return pruned + layers, err
+}
+
+// cacheEntries lists the base images and the cached layers of the cache
+func cacheEntries(opts *config.CacheOptions) ([]*cacheEntry, error) {
+	entries, err := baseImageEntries(opts)
+	if err != nil {
+		return nil, err
+	}
+	layers, err := layerEntries(opts)
+	if err != nil {
+		return nil, err
+	}
+	return append(entries, layers...), nil
+}
+
+// baseImageEntries lists the base images of the cache, with their tarball and
+// manifest, their extracted filesystem in the unpacked cache and the hashes of
+// their files.
+func baseImageEntries(opts *config.CacheOptions) ([]*cacheEntry, error) {
+	byDigest := map[string]*cacheEntry{}
+	add := func(digest, path string) error {
+		size, lastUsed, err := usage(path)
+		if err != nil {
+			return err
+		}
+		e, ok := byDigest[digest]
+		if !ok {
+			e = &cacheEntry{digest: digest}
+			byDigest[digest] = e
+		}
+		e.paths = append(e.paths, path)
+		e.size += size
+		if lastUsed.After(e.lastUsed) {
+			e.lastUsed = lastUsed
+		}
+		return nil
+	}
+
+	files, err := os.ReadDir(opts.CacheDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		digest := strings.TrimSuffix(f.Name(), ".json")
+		if _, err := v1.NewHash(digest); err != nil || f.IsDir() {
+			continue
+		}
+		if err := add(digest, filepath.Join(opts.CacheDir, f.Name())); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, dir := range []string{UnpackedCache(opts).Dir, filepath.Join(opts.CacheDir, fileHashesCacheDir)} {
+		dirs, err := os.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, d := range dirs {
+			if _, err := v1.NewHash(d.Name()); err != nil || !d.IsDir() {
+				continue
+			}
+			if err := add(d.Name(), filepath.Join(dir, d.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	entries := make([]*cacheEntry, 0, len(byDigest))
+	for _, e := range byDigest {
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// layerEntries lists the cached layers of the cache, with their manifest. Their
+// size includes the blobs they reference, counted for each of the layers
+// sharing them, and their last use is recorded in the modification time of
+// their manifest.
+func layerEntries(opts *config.CacheOptions) ([]*cacheEntry, error) {
+	dir := LocalLayersDir(opts)
+	manifests, err := os.ReadDir(filepath.Join(dir, "manifests"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []*cacheEntry
+	for _, m := range manifests {
+		if !m.Type().IsRegular() || strings.HasPrefix(m.Name(), ".") || strings.HasSuffix(m.Name(), metadataSuffix) {
+			continue
+		}
+		p := filepath.Join(dir, "manifests", m.Name())
+		fi, err := m.Info()
+		if err != nil {
+			return nil, err
+		}
+		e := &cacheEntry{digest: "layer " + m.Name(), paths: []string{p, p + metadataSuffix}, size: fi.Size(), lastUsed: fi.ModTime()}
+		blobs, err := manifestBlobs(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range blobs {
+			if fi, err := os.Stat(filepath.Join(dir, b)); err == nil {
+				e.size += fi.Size()
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// manifestBlobs returns the blobs of the cached layer whose manifest is at p,
+// relative to the layers directory of the cache
+func manifestBlobs(p string) ([]string, error) {
+	m, err := mfstFromPath(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", p)
+	}
+	var blobs []string
+	for _, d := range append([]v1.Descriptor{m.Config}, m.Layers...) {
+		blobs = append(blobs, filepath.Join("blobs", d.Digest.Algorithm, d.Digest.Hex))
+	}
+	return blobs, nil
+}
+
+// sweepLayerBlobs removes the blobs of the cached layers referenced by none of
+// them anymore. The blobs used since usedSince are kept, as they may belong
+// to layers being cached.
+func sweepLayerBlobs(opts *config.CacheOptions, usedSince time.Time) error {
+	dir := LocalLayersDir(opts)
+	entries, err := layerEntries(opts)
+	if err != nil {
+		return err
+	}
+	used := map[string]bool{}
+	for _, e := range entries {
+		blobs, err := manifestBlobs(e.paths[0])
+		if err != nil {
+			return err
+		}
+		for _, b := range blobs {
+			used[b] = true
+		}
+	}
+	err = filepath.WalkDir(filepath.Join(dir, "blobs"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || used[rel] {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil || !fi.ModTime().Before(usedSince) {
+			return err
+		}
+		logrus.Debugf("Removing unused blob %s from cache", rel)
+		return os.Remove(p)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// usage returns the disk usage of path and the last time it was used,
+// recorded in its access time.
+func usage(path string) (int64, time.Time, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	lastUsed := fi.ModTime()
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if atime := time.Unix(stat.Atim.Unix()); atime.After(lastUsed) {
+			lastUsed = atime
+		}
+	}
+	if !fi.IsDir() {
+		return fi.Size(), lastUsed, nil
+	}
+	var size int64
+	err = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, lastUsed, err
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/creds"
+	"github.com/chainguard-dev/kaniko/pkg/util"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// expiringBackend is implemented by the backends the expired cached layers
+// can be pruned from
+type expiringBackend interface {
+	PruneExpired(ttl time.Duration) (int, error)
+}
+
+// PruneExpiredRepo deletes the cached layers of the cache repo which expired
+// with opts.CacheTTL, as the builds treat them as misses. The repo is a
+// registry repository or the location of a cache backend. It returns the
+// number of layers deleted.
+func PruneExpiredRepo(opts *config.KanikoOptions, repo string) (int, error) {
+	if strings.HasPrefix(repo, "oci:") {
+		return 0, fmt.Errorf("pruning the OCI image layout %s is not supported", repo)
+	}
+	backend, err := GetBackend(opts, repo)
+	if err != nil {
+		return 0, err
+	}
+	if backend != nil {
+		b, ok := backend.(expiringBackend)
+		if !ok {
+			return 0, fmt.Errorf("pruning the cache backend of %s is not supported", repo)
+		}
+		return b.PruneExpired(opts.CacheTTL)
+	}
+	return pruneExpiredRegistry(opts, repo)
+}
+
+// pruneExpiredRegistry deletes the manifests of the cached layers of the
+// registry repository repo which expired, the registry garbage collecting
+// their blobs
+func pruneExpiredRegistry(opts *config.KanikoOptions, repo string) (int, error) {
+	ref, err := name.NewRepository(repo, name.WeakValidation)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parsing cache repo %s", repo)
+	}
+	registryName := ref.Registry.Name()
+	if opts.Insecure || opts.InsecureRegistries.Contains(registryName) {
+		newReg, err := name.NewRegistry(registryName, name.WeakValidation, name.Insecure)
+		if err != nil {
+			return 0, err
+		}
+		ref.Registry = newReg
+	}
+	tr, err := util.MakeTransport(opts.RegistryOptions, registryName)
+	if err != nil {
+		return 0, errors.Wrapf(err, "making transport for registry %q", registryName)
+	}
+	remoteOpts := []remote.Option{remote.WithTransport(tr), remote.WithAuthFromKeychain(creds.Keychain(&opts.RegistryOptions))}
+	tags, err := remote.List(ref, remoteOpts...)
+	if err != nil {
+		return 0, errors.Wrapf(err, "listing cached layers of %s", repo)
+	}
+	cutoff := time.Now().Add(-opts.CacheTTL)
+	pruned := 0
+	for _, tag := range tags {
+		// The stages pushed to the cache are kept, as they are created when
+		// their base image was
+		if !isCacheKey(tag) {
+			continue
+		}
+		img, err := remote.Image(ref.Tag(tag), remoteOpts...)
+		if err != nil {
+			logrus.Warnf("Unable to get cached layer %s of %s: %v", tag, repo, err)
+			continue
+		}
+		cf, err := img.ConfigFile()
+		if err != nil {
+			logrus.Warnf("Unable to get config of cached layer %s of %s: %v", tag, repo, err)
+			continue
+		}
+		if !cf.Created.Before(cutoff) {
+			continue
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			return pruned, err
+		}
+		logrus.Infof("Deleting cached layer %s from %s, created %s", tag, repo, cf.Created.Format(time.RFC3339))
+		if err := remote.Delete(ref.Digest(digest.String()), remoteOpts...); err != nil {
+			return pruned, errors.Wrapf(err, "deleting cached layer %s", tag)
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// isCacheKey returns true if key is the cache key of a layer, rather than
+// the name of a stage pushed to the cache
+func isCacheKey(key string) bool {
+	_, err := v1.NewHash("sha256:" + key)
+	return err == nil
+}
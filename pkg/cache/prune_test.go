@@ -0,0 +1,213 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+)
+
+func TestPrune(t *testing.T) {
+	digest := func(c string) string {
+		return "sha256:" + strings.Repeat(c, 64)
+	}
+	now := time.Now()
+	// image digest -> last use
+	images := map[string]time.Time{
+		digest("a"): now.Add(-3 * time.Hour),
+		digest("b"): now.Add(-2 * time.Hour),
+		digest("c"): now.Add(-1 * time.Hour),
+		digest("d"): now.Add(time.Minute),
+	}
+
+	tests := []struct {
+		name      string
+		maxSize   int64
+		usedSince time.Time
+		want      []string
+	}{
+		{
+			name:      "within budget",
+			maxSize:   400,
+			usedSince: now,
+			want:      []string{digest("a"), digest("b"), digest("c"), digest("d")},
+		},
+		{
+			name:      "evicts least recently used",
+			maxSize:   250,
+			usedSince: now,
+			want:      []string{digest("c"), digest("d")},
+		},
+		{
+			name:      "keeps images used since",
+			maxSize:   50,
+			usedSince: now,
+			want:      []string{digest("d")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &config.CacheOptions{CacheDir: t.TempDir()}
+			for d, lastUsed := range images {
+				tarball := filepath.Join(opts.CacheDir, d)
+				if err := os.WriteFile(tarball, make([]byte, 90), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(tarball+".json", make([]byte, 10), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				for _, p := range []string{tarball, tarball + ".json"} {
+					if err := os.Chtimes(p, lastUsed, now.Add(-4*time.Hour)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			hashes := FileHashesPath(opts, v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}, "full")
+			if err := os.MkdirAll(filepath.Dir(hashes), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(hashes, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range []string{hashes, filepath.Dir(hashes)} {
+				if err := os.Chtimes(p, images[digest("a")], now.Add(-4*time.Hour)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Temporary files of the warmer are not evicted
+			if err := os.WriteFile(filepath.Join(opts.CacheDir, "warmingImage.123"), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			testutil.CheckNoError(t, Prune(opts, tt.maxSize, tt.usedSince))
+
+			entries, err := cacheEntries(opts)
+			testutil.CheckNoError(t, err)
+			got := map[string]bool{}
+			for _, e := range entries {
+				got[e.digest] = true
+				testutil.CheckDeepEqual(t, int64(100), e.size)
+			}
+			want := map[string]bool{}
+			for _, d := range tt.want {
+				want[d] = true
+			}
+			testutil.CheckDeepEqual(t, want, got)
+			_, err = os.Stat(hashes)
+			testutil.CheckDeepEqual(t, want[digest("a")], err == nil)
+			if _, err := os.Stat(filepath.Join(opts.CacheDir, "warmingImage.123")); err != nil {
+				t.Errorf("expected temporary file to be kept: %v", err)
+			}
+		})
+	}
+}
+
+func TestPruneLayers(t *testing.T) {
+	opts := &config.CacheOptions{CacheDir: t.TempDir()}
+	layers := LocalLayers(opts)
+	now := time.Now()
+	for key, lastUsed := range map[string]time.Time{
+		"old": now.Add(-2 * time.Hour),
+		"new": now.Add(-1 * time.Hour),
+	} {
+		img, err := random.Image(1000, 1)
+		testutil.CheckNoError(t, err)
+		testutil.CheckNoError(t, layers.Put(key, img))
+		manifest := filepath.Join(LocalLayersDir(opts), "manifests", key)
+		testutil.CheckNoError(t, os.Chtimes(manifest, lastUsed, lastUsed))
+		blobs, err := manifestBlobs(manifest)
+		testutil.CheckNoError(t, err)
+		for _, b := range blobs {
+			testutil.CheckNoError(t, os.Chtimes(filepath.Join(LocalLayersDir(opts), b), lastUsed, lastUsed))
+		}
+	}
+	entries, err := cacheEntries(opts)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 2, len(entries))
+
+	// Evicting the least recently used layer removes its blobs too
+	testutil.CheckNoError(t, Prune(opts, entries[0].size+10, now))
+	_, err = layers.Probe("old")
+	if !IsNotFound(err) {
+		t.Fatalf("expected old layer to be evicted, got %v", err)
+	}
+	digest, err := layers.Probe("new")
+	testutil.CheckNoError(t, err)
+	img, err := layers.Get("new", digest)
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, validate.Image(img))
+	var blobs int
+	filepath.WalkDir(filepath.Join(LocalLayersDir(opts), "blobs"), func(_ string, d fs.DirEntry, _ error) error {
+		if d.Type().IsRegular() {
+			blobs++
+		}
+		return nil
+	})
+	testutil.CheckDeepEqual(t, 2, blobs)
+}
+
+func TestPruneExpired(t *testing.T) {
+	opts := &config.CacheOptions{CacheDir: t.TempDir(), CacheTTL: time.Hour}
+	now := time.Now()
+	expired, fresh := "sha256:"+strings.Repeat("a", 64), "sha256:"+strings.Repeat("b", 64)
+	for d, cached := range map[string]time.Time{expired: now.Add(-2 * time.Hour), fresh: now} {
+		tarball := filepath.Join(opts.CacheDir, d)
+		testutil.CheckNoError(t, os.WriteFile(tarball, make([]byte, 90), 0o644))
+		testutil.CheckNoError(t, os.WriteFile(tarball+".json", make([]byte, 10), 0o644))
+		testutil.CheckNoError(t, os.Chtimes(tarball, now, cached))
+	}
+	layer, err := random.Image(1000, 1)
+	testutil.CheckNoError(t, err)
+	layer, err = mutate.CreatedAt(layer, v1.Time{Time: now.Add(-2 * time.Hour)})
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, LocalLayers(opts).Put(strings.Repeat("c", 64), layer))
+
+	// Nothing is removed while a build uses the cache
+	lock, err := LockShared(opts.CacheDir)
+	testutil.CheckNoError(t, err)
+	pruned, err := PruneExpired(opts)
+	testutil.CheckErrorAndDeepEqual(t, false, err, 0, pruned)
+	testutil.CheckNoError(t, Prune(opts, 0, now))
+	_, err = os.Stat(filepath.Join(opts.CacheDir, expired))
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, lock.Close())
+
+	pruned, err = PruneExpired(opts)
+	testutil.CheckErrorAndDeepEqual(t, false, err, 2, pruned)
+	for p, exists := range map[string]bool{
+		expired:           false,
+		expired + ".json": false,
+		fresh:             true,
+		fresh + ".json":   true,
+	} {
+		_, err := os.Stat(filepath.Join(opts.CacheDir, p))
+		testutil.CheckDeepEqual(t, exists, err == nil)
+	}
+	_, err = LocalLayers(opts).Probe(strings.Repeat("c", 64))
+	testutil.CheckDeepEqual(t, true, IsNotFound(err))
+}
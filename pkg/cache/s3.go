@@ -0,0 +1,269 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/util/bucket"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	RegisterBackend("s3", newS3Backend)
+}
+
+// s3API is the part of the S3 client used by the S3 backend
+type s3API interface {
+	manager.UploadAPIClient
+	HeadObject(context.Context, *s3.HeadObjectInput, ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	GetObject(context.Context, *s3.GetObjectInput, ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	DeleteObject(context.Context, *s3.DeleteObjectInput, ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	CopyObject(context.Context, *s3.CopyObjectInput, ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	UploadPartCopy(context.Context, *s3.UploadPartCopyInput, ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error)
+	s3.ListObjectsV2APIClient
+}
+
+const (
+	// s3CopyMaxSize is the size of the largest object copied with a single
+	// CopyObject request, the larger ones being copied in several parts
+	s3CopyMaxSize = 5 << 30
+	// s3CopyPartSize is the size of the parts the large objects are copied in,
+	// larger for the objects which would take more than s3MaxParts parts
+	s3CopyPartSize = 512 << 20
+	s3MaxParts     = 10000
+)
+
+// s3Store stores the cache in an S3 bucket, set as
+// --cache-repo=s3://bucket/prefix. The objects are looked up with HEAD
+// requests, and the large ones are uploaded in several parts.
+type s3Store struct {
+	client   s3API
+	uploader *manager.Uploader
+	bucket   string
+	// kmsKeyID is the KMS key the objects are encrypted with, if set
+	kmsKeyID string
+}
+
+func newS3Backend(opts *config.KanikoOptions, location string) (Backend, error) {
+	bucketName, prefix, _ := strings.Cut(location, "/")
+	if bucketName == "" {
+		return nil, fmt.Errorf("no bucket in cache repo s3://%s", location)
+	}
+	client, err := bucket.NewS3Client(context.TODO())
+	if err != nil {
+		return nil, errors.Wrap(err, "creating S3 client")
+	}
+	return newObjectBackend(newS3Store(client, bucketName, opts.CacheS3KMSKeyID), "s3://"+location, prefix), nil
+}
+
+func newS3Store(client s3API, bucketName, kmsKeyID string) *s3Store {
+	return &s3Store{
+		client:   client,
+		uploader: manager.NewUploader(client),
+		bucket:   bucketName,
+		kmsKeyID: kmsKeyID,
+	}
+}
+
+func (s *s3Store) Metadata(key string) (map[string]string, error) {
+	head, err := s.client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if isS3NotFound(err) {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return head.Metadata, nil
+}
+
+func (s *s3Store) Open(key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// Put uploads the object, in several parts if it is large, encrypted with
+// SSE-KMS if a KMS key is set
+func (s *s3Store) Put(key string, r io.Reader, _ int64, contentType string, metadata map[string]string) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        r,
+		ContentType: aws.String(contentType),
+		Metadata:    metadata,
+	}
+	if s.kmsKeyID != "" {
+		input.ServerSideEncryption = s3types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(s.kmsKeyID)
+	}
+	_, err := s.uploader.Upload(context.TODO(), input)
+	return err
+}
+
+func (s *s3Store) List(prefix string) (map[string]time.Time, error) {
+	objects := map[string]time.Time{}
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(context.TODO())
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range page.Contents {
+			objects[aws.ToString(o.Key)] = aws.ToTime(o.LastModified)
+		}
+	}
+	return objects, nil
+}
+
+func (s *s3Store) Delete(key string) error {
+	_, err := s.client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+// Touch copies the object onto itself, with its content type and metadata,
+// which updates the time it was last modified. The objects over 5GB, the
+// limit of CopyObject, are copied in several parts.
+func (s *s3Store) Touch(key string) error {
+	head, err := s.client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if isS3NotFound(err) {
+		return errObjectNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if size := aws.ToInt64(head.ContentLength); size > s3CopyMaxSize {
+		err := s.copyParts(key, size, head)
+		if isS3NotFound(err) {
+			return errObjectNotFound
+		}
+		return err
+	}
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(s.bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(url.PathEscape(s.bucket + "/" + key)),
+		ContentType:       head.ContentType,
+		Metadata:          head.Metadata,
+		MetadataDirective: s3types.MetadataDirectiveReplace,
+	}
+	if s.kmsKeyID != "" {
+		input.ServerSideEncryption = s3types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(s.kmsKeyID)
+	}
+	_, err = s.client.CopyObject(context.TODO(), input)
+	if isS3NotFound(err) {
+		return errObjectNotFound
+	}
+	return err
+}
+
+// copyParts copies the object of size bytes onto itself with a multipart
+// upload of parts copied from it, keeping the content type and metadata of
+// head
+func (s *s3Store) copyParts(key string, size int64, head *s3.HeadObjectOutput) error {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		ContentType: head.ContentType,
+		Metadata:    head.Metadata,
+	}
+	if s.kmsKeyID != "" {
+		input.ServerSideEncryption = s3types.ServerSideEncryptionAwsKms
+		input.SSEKMSKeyId = aws.String(s.kmsKeyID)
+	}
+	upload, err := s.client.CreateMultipartUpload(context.TODO(), input)
+	if err != nil {
+		return err
+	}
+	abort := func(err error) error {
+		if _, abortErr := s.client.AbortMultipartUpload(context.TODO(), &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			UploadId: upload.UploadId,
+		}); abortErr != nil {
+			return errors.Wrapf(err, "aborting the copy of %s: %v", key, abortErr)
+		}
+		return err
+	}
+
+	partSize := max(int64(s3CopyPartSize), (size+s3MaxParts-1)/s3MaxParts)
+	var parts []s3types.CompletedPart
+	for start := int64(0); start < size; start += partSize {
+		end := min(start+partSize, size) - 1
+		number := aws.Int32(int32(len(parts) + 1))
+		out, err := s.client.UploadPartCopy(context.TODO(), &s3.UploadPartCopyInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(key),
+			UploadId:        upload.UploadId,
+			PartNumber:      number,
+			CopySource:      aws.String(url.PathEscape(s.bucket + "/" + key)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+		})
+		if err != nil {
+			return abort(err)
+		}
+		part := s3types.CompletedPart{PartNumber: number}
+		if out.CopyPartResult != nil {
+			part.ETag = out.CopyPartResult.ETag
+		}
+		parts = append(parts, part)
+	}
+	_, err = s.client.CompleteMultipartUpload(context.TODO(), &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return abort(err)
+	}
+	return nil
+}
+
+func isS3NotFound(err error) bool {
+	var notFound *s3types.NotFound
+	var noSuchKey *s3types.NoSuchKey
+	return errors.As(err, &notFound) || errors.As(err, &noSuchKey)
+}
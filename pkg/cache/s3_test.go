@@ -0,0 +1,342 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/pkg/errors"
+)
+
+type fakeS3Object struct {
+	body     []byte
+	metadata map[string]string
+	sse      s3types.ServerSideEncryption
+	modified time.Time
+	// size is the size of the object when larger than its body
+	size int64
+}
+
+// fakeS3 is an S3 bucket in memory, which only supports the multipart uploads
+// copying an object onto itself
+type fakeS3 struct {
+	objects map[string]fakeS3Object
+	puts    int
+	// uploads are the multipart uploads in progress, by id
+	uploads map[string]*s3.CreateMultipartUploadInput
+	// copiedRanges are the ranges copied by the multipart uploads
+	copiedRanges []string
+}
+
+func (f *fakeS3) PutObject(_ context.Context, in *s3.PutObjectInput, _ ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	body, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[aws.ToString(in.Key)] = fakeS3Object{body: body, metadata: in.Metadata, sse: in.ServerSideEncryption, modified: time.Now()}
+	f.puts++
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) HeadObject(_ context.Context, in *s3.HeadObjectInput, _ ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	o, ok := f.objects[aws.ToString(in.Key)]
+	if !ok {
+		return nil, &s3types.NotFound{}
+	}
+	size := o.size
+	if size == 0 {
+		size = int64(len(o.body))
+	}
+	return &s3.HeadObjectOutput{Metadata: o.metadata, ContentLength: aws.Int64(size)}, nil
+}
+
+func (f *fakeS3) GetObject(_ context.Context, in *s3.GetObjectInput, _ ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	o, ok := f.objects[aws.ToString(in.Key)]
+	if !ok {
+		return nil, &s3types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(o.body))}, nil
+}
+
+func (f *fakeS3) DeleteObject(_ context.Context, in *s3.DeleteObjectInput, _ ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	delete(f.objects, aws.ToString(in.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// CopyObject only copies objects onto themselves, updating the time they were
+// modified
+func (f *fakeS3) CopyObject(_ context.Context, in *s3.CopyObjectInput, _ ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	o, ok := f.objects[aws.ToString(in.Key)]
+	if !ok {
+		return nil, &s3types.NoSuchKey{}
+	}
+	o.metadata = in.Metadata
+	o.modified = time.Now()
+	f.objects[aws.ToString(in.Key)] = o
+	return &s3.CopyObjectOutput{}, nil
+}
+
+// ListObjectsV2 lists all the objects under the prefix in a single page
+func (f *fakeS3) ListObjectsV2(_ context.Context, in *s3.ListObjectsV2Input, _ ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+	for key, o := range f.objects {
+		if strings.HasPrefix(key, aws.ToString(in.Prefix)) {
+			out.Contents = append(out.Contents, s3types.Object{Key: aws.String(key), LastModified: aws.Time(o.modified)})
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeS3) UploadPart(context.Context, *s3.UploadPartInput, ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	return nil, errors.New("multipart uploads are not supported")
+}
+
+func (f *fakeS3) CreateMultipartUpload(_ context.Context, in *s3.CreateMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	if f.uploads == nil {
+		f.uploads = map[string]*s3.CreateMultipartUploadInput{}
+	}
+	id := fmt.Sprintf("upload-%d", len(f.uploads))
+	f.uploads[id] = in
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+// UploadPartCopy records the range copied, from the object uploaded only
+func (f *fakeS3) UploadPartCopy(_ context.Context, in *s3.UploadPartCopyInput, _ ...func(*s3.Options)) (*s3.UploadPartCopyOutput, error) {
+	upload, ok := f.uploads[aws.ToString(in.UploadId)]
+	if !ok || aws.ToString(in.CopySource) != url.PathEscape(aws.ToString(upload.Bucket)+"/"+aws.ToString(upload.Key)) {
+		return nil, errors.New("only copies of an object onto itself are supported")
+	}
+	f.copiedRanges = append(f.copiedRanges, aws.ToString(in.CopySourceRange))
+	return &s3.UploadPartCopyOutput{CopyPartResult: &s3types.CopyPartResult{ETag: aws.String(fmt.Sprint(aws.ToInt32(in.PartNumber)))}}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(_ context.Context, in *s3.CompleteMultipartUploadInput, _ ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	upload, ok := f.uploads[aws.ToString(in.UploadId)]
+	if !ok {
+		return nil, &s3types.NoSuchUpload{}
+	}
+	delete(f.uploads, aws.ToString(in.UploadId))
+	o := f.objects[aws.ToString(in.Key)]
+	o.metadata = upload.Metadata
+	o.modified = time.Now()
+	f.objects[aws.ToString(in.Key)] = o
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(_ context.Context, in *s3.AbortMultipartUploadInput, _ ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	delete(f.uploads, aws.ToString(in.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func TestS3Backend(t *testing.T) {
+	client := &fakeS3{objects: map[string]fakeS3Object{}}
+	b := newObjectBackend(newS3Store(client, "bucket", "alias/cache"), "s3://bucket/kaniko/cache/", "/kaniko/cache/")
+
+	_, err := b.Probe("key")
+	testutil.CheckDeepEqual(t, true, IsNotFound(err))
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckNoError(t, b.Put("key", img))
+	// The two layers, the config and the manifest
+	testutil.CheckDeepEqual(t, 4, client.puts)
+	m, err := img.Manifest()
+	testutil.CheckNoError(t, err)
+	config := client.objects["kaniko/cache/blobs/sha256/"+m.Config.Digest.Hex]
+	testutil.CheckDeepEqual(t, s3types.ServerSideEncryptionAwsKms, config.sse)
+
+	// The blobs already in the bucket are not uploaded again
+	testutil.CheckNoError(t, b.Put("other", img))
+	testutil.CheckDeepEqual(t, 5, client.puts)
+
+	digest, err := b.Probe("key")
+	testutil.CheckNoError(t, err)
+	want, err := img.Digest()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, want, digest)
+
+	got, err := b.Get("key", digest)
+	testutil.CheckNoError(t, err)
+	gotDigest, err := got.Digest()
+	testutil.CheckErrorAndDeepEqual(t, false, err, want, gotDigest)
+	wantCfg, err := img.RawConfigFile()
+	testutil.CheckNoError(t, err)
+	gotCfg, err := got.RawConfigFile()
+	testutil.CheckErrorAndDeepEqual(t, false, err, wantCfg, gotCfg)
+	layers, err := got.Layers()
+	testutil.CheckNoError(t, err)
+	rc, err := layers[1].Compressed()
+	testutil.CheckNoError(t, err)
+	gotLayer, err := io.ReadAll(rc)
+	testutil.CheckNoError(t, err)
+	wantLayers, err := img.Layers()
+	testutil.CheckNoError(t, err)
+	rc, err = wantLayers[1].Compressed()
+	testutil.CheckNoError(t, err)
+	wantLayer, err := io.ReadAll(rc)
+	testutil.CheckErrorAndDeepEqual(t, false, err, wantLayer, gotLayer)
+
+	// The layer cached for key changed since it was probed
+	other, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckNoError(t, b.Put("key", other))
+	_, err = b.Get("key", digest)
+	testutil.CheckError(t, true, err)
+}
+
+func TestS3Touch_large(t *testing.T) {
+	client := &fakeS3{objects: map[string]fakeS3Object{}}
+	store := newS3Store(client, "bucket", "")
+	modified := time.Now().Add(-time.Hour)
+	client.objects["blob"] = fakeS3Object{metadata: map[string]string{"k": "v"}, modified: modified, size: 6 << 30}
+
+	// Objects over 5GB cannot be copied with CopyObject, they are copied in parts
+	testutil.CheckNoError(t, store.Touch("blob"))
+	testutil.CheckDeepEqual(t, []string{"bytes=0-536870911"}, client.copiedRanges[:1])
+	testutil.CheckDeepEqual(t, 12, len(client.copiedRanges))
+	testutil.CheckDeepEqual(t, "bytes=5905580032-6442450943", client.copiedRanges[11])
+	testutil.CheckDeepEqual(t, 0, len(client.uploads))
+	o := client.objects["blob"]
+	testutil.CheckDeepEqual(t, map[string]string{"k": "v"}, o.metadata)
+	if !o.modified.After(modified) {
+		t.Error("expected the object to be touched")
+	}
+
+	if err := store.Touch("missing"); err != errObjectNotFound {
+		t.Errorf("expected %v, got %v", errObjectNotFound, err)
+	}
+}
+
+func TestS3PruneExpired(t *testing.T) {
+	client := &fakeS3{objects: map[string]fakeS3Object{}}
+	b := newObjectBackend(newS3Store(client, "bucket", ""), "s3://bucket/cache", "cache")
+	expiredKey, freshKey := strings.Repeat("a", 64), strings.Repeat("b", 64)
+
+	expired, err := random.Image(1024, 1)
+	testutil.CheckNoError(t, err)
+	expired, err = mutate.CreatedAt(expired, v1.Time{Time: time.Now().Add(-2 * time.Hour)})
+	testutil.CheckNoError(t, err)
+	fresh, err := random.Image(1024, 1)
+	testutil.CheckNoError(t, err)
+	fresh, err = mutate.CreatedAt(fresh, v1.Time{Time: time.Now()})
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, b.Put(expiredKey, expired))
+	testutil.CheckNoError(t, b.Put(freshKey, fresh))
+	// The stages pushed to the cache are kept
+	testutil.CheckNoError(t, b.Put("builder", expired))
+	// The blobs were written when the layers were cached
+	for key, o := range client.objects {
+		o.modified = time.Now().Add(-2 * time.Hour)
+		client.objects[key] = o
+	}
+
+	// The expired layers are misses until they are pruned
+	bc := &BackendCache{Opts: &config.KanikoOptions{CacheOptions: config.CacheOptions{CacheTTL: time.Hour}}, Backend: b}
+	_, err = bc.RetrieveLayer(expiredKey)
+	testutil.CheckDeepEqual(t, true, IsExpired(err))
+	_, err = bc.RetrieveLayer(freshKey)
+	testutil.CheckNoError(t, err)
+
+	pruned, err := b.PruneExpired(time.Hour)
+	testutil.CheckErrorAndDeepEqual(t, false, err, 1, pruned)
+	_, err = b.Probe(expiredKey)
+	testutil.CheckDeepEqual(t, true, IsNotFound(err))
+	digest, err := b.Probe(freshKey)
+	testutil.CheckNoError(t, err)
+	_, err = b.Get(freshKey, digest)
+	testutil.CheckNoError(t, err)
+	_, err = b.Probe("builder")
+	testutil.CheckNoError(t, err)
+	// Only the fresh layer and the stage are left, with their blobs
+	testutil.CheckDeepEqual(t, 6, len(client.objects))
+}
+
+// racingStore runs race once the blobs are listed, as a layer cached
+// concurrently with PruneExpired
+type racingStore struct {
+	objectStore
+	race func()
+}
+
+func (s *racingStore) List(prefix string) (map[string]time.Time, error) {
+	objects, err := s.objectStore.List(prefix)
+	if race := s.race; race != nil && strings.HasSuffix(prefix, "/blobs/") {
+		s.race = nil
+		race()
+	}
+	return objects, err
+}
+
+func TestS3PruneExpired_concurrentPut(t *testing.T) {
+	client := &fakeS3{objects: map[string]fakeS3Object{}}
+	store := &racingStore{objectStore: newS3Store(client, "bucket", "")}
+	b := newObjectBackend(store, "s3://bucket/cache", "cache")
+
+	expired, err := random.Image(1024, 1)
+	testutil.CheckNoError(t, err)
+	expired, err = mutate.CreatedAt(expired, v1.Time{Time: time.Now().Add(-2 * time.Hour)})
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, b.Put(strings.Repeat("a", 64), expired))
+	for key, o := range client.objects {
+		o.modified = time.Now().Add(-2 * time.Hour)
+		client.objects[key] = o
+	}
+
+	// A layer reusing the blob of the expired one is cached once the blobs
+	// are listed, skipping its upload
+	reused, err := mutate.CreatedAt(expired, v1.Time{Time: time.Now()})
+	testutil.CheckNoError(t, err)
+	reusedKey := strings.Repeat("b", 64)
+	store.race = func() {
+		puts := client.puts
+		testutil.CheckNoError(t, b.Put(reusedKey, reused))
+		// The config and the manifest
+		testutil.CheckDeepEqual(t, puts+2, client.puts)
+	}
+
+	pruned, err := b.PruneExpired(time.Hour)
+	testutil.CheckErrorAndDeepEqual(t, false, err, 1, pruned)
+	digest, err := b.Probe(reusedKey)
+	testutil.CheckNoError(t, err)
+	img, err := b.Get(reusedKey, digest)
+	testutil.CheckNoError(t, err)
+	layers, err := img.Layers()
+	testutil.CheckNoError(t, err)
+	rc, err := layers[0].Compressed()
+	testutil.CheckNoError(t, err)
+	_, err = io.ReadAll(rc)
+	testutil.CheckNoError(t, err)
+}
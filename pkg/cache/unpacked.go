@@ -0,0 +1,131 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/util"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	unpackedRootfs   = "rootfs"
+	unpackedComplete = "complete"
+)
+
+// unpackedCacheDir is the directory of the cache dir holding the extracted
+// filesystems of the cached base images
+const unpackedCacheDir = "unpacked"
+
+// fileHashesCacheDir is the directory of the cache dir holding the hashes of
+// the files of the cached base images
+const fileHashesCacheDir = "hashes"
+
+// FileHashesPath returns the path of the cached hashes of the files of the
+// image with the given digest, computed with the hasher of snapshotMode
+func FileHashesPath(opts *config.CacheOptions, digest v1.Hash, snapshotMode string) string {
+	return filepath.Join(opts.CacheDir, fileHashesCacheDir, digest.String(), snapshotMode+".json")
+}
+
+// UnpackedCache returns the store of extracted base images of the local cache
+func UnpackedCache(opts *config.CacheOptions) *UnpackedStore {
+	return &UnpackedStore{Dir: filepath.Join(opts.CacheDir, unpackedCacheDir)}
+}
+
+// UnpackedStore keeps the extracted filesystems of base images in a directory,
+// keyed by image digest, so that successive builds can restore them without
+// downloading and extracting their layers again.
+type UnpackedStore struct {
+	Dir string
+}
+
+// Path returns the directory holding the extracted filesystem of the image
+// with the given digest.
+func (s *UnpackedStore) Path(digest v1.Hash) string {
+	return filepath.Join(s.Dir, digest.String(), unpackedRootfs)
+}
+
+// Contains returns true if the store holds the complete extracted filesystem
+// of the image with the given digest.
+func (s *UnpackedStore) Contains(digest v1.Hash) bool {
+	_, err := os.Stat(filepath.Join(s.Dir, digest.String(), unpackedComplete))
+	return err == nil
+}
+
+// Add extracts the filesystem of img into the store, unless it is already
+// there, and returns the image digest.
+func (s *UnpackedStore) Add(img v1.Image) (v1.Hash, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return v1.Hash{}, errors.Wrap(err, "getting image digest")
+	}
+	if s.Contains(digest) {
+		return digest, nil
+	}
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return v1.Hash{}, errors.Wrapf(err, "creating base image store %s", s.Dir)
+	}
+
+	// Extract into a temporary directory first so concurrent builds sharing
+	// the store never see a partially extracted image.
+	tmp, err := os.MkdirTemp(s.Dir, ".unpack-")
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	defer os.RemoveAll(tmp)
+
+	logrus.Infof("Extracting base image %s into %s", digest, s.Dir)
+	rootfs := filepath.Join(tmp, unpackedRootfs)
+	if err := os.Mkdir(rootfs, 0o755); err != nil {
+		return v1.Hash{}, err
+	}
+	if _, err := util.GetFSFromImage(rootfs, img, util.ExtractFile); err != nil {
+		return v1.Hash{}, errors.Wrapf(err, "extracting %s", digest)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, unpackedComplete), nil, 0o644); err != nil {
+		return v1.Hash{}, err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.Dir, digest.String())); err != nil && !s.Contains(digest) {
+		return v1.Hash{}, errors.Wrapf(err, "storing %s", digest)
+	}
+	return digest, nil
+}
+
+// Restore copies the extracted filesystem of img into root, adding it to the
+// store first if needed. Paths in the ignore list are not restored.
+func (s *UnpackedStore) Restore(img v1.Image, root string) error {
+	digest, err := s.Add(img)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Restoring base image %s from %s", digest, s.Dir)
+	// Record the last use of the image, for the store to be pruned
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(s.Dir, digest.String()), now, now); err != nil {
+		logrus.Debugf("Unable to update access time of %s: %v", digest, err)
+	}
+	if err := util.InitIgnoreList(); err != nil {
+		return errors.Wrap(err, "initializing filesystem ignore list")
+	}
+	return util.CopyTree(s.Path(digest), root, util.CheckIgnoreList)
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestUnpackedStore(t *testing.T) {
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &UnpackedStore{Dir: t.TempDir()}
+	testutil.CheckDeepEqual(t, false, store.Contains(digest))
+
+	root := t.TempDir()
+	if err := store.Restore(img, root); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckDeepEqual(t, true, store.Contains(digest))
+
+	stored, err := os.ReadDir(store.Path(digest))
+	testutil.CheckNoError(t, err)
+	restored, err := os.ReadDir(root)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, len(stored), len(restored))
+
+	// Restoring again reuses the extracted filesystem
+	if err := os.WriteFile(filepath.Join(store.Path(digest), "marker"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Restore(img, root); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "marker")); err != nil {
+		t.Errorf("expected the stored filesystem to be reused: %v", err)
+	}
+}
+
+func Test_unpackCachedImage(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &config.WarmerOptions{CacheOptions: config.CacheOptions{CacheDir: t.TempDir(), CacheTTL: time.Hour}}
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tarball.WriteToFile(filepath.Join(opts.CacheDir, digest.String()), ref, img); err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.CheckNoError(t, unpackCachedImage(digest, opts))
+	testutil.CheckDeepEqual(t, false, UnpackedCache(&opts.CacheOptions).Contains(digest))
+
+	opts.Unpack = true
+	testutil.CheckNoError(t, unpackCachedImage(digest, opts))
+	testutil.CheckDeepEqual(t, true, UnpackedCache(&opts.CacheOptions).Contains(digest))
+}
@@ -19,51 +19,73 @@ package cache
 import (
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"path"
-	"regexp"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/chainguard-dev/kaniko/pkg/config"
 	"github.com/chainguard-dev/kaniko/pkg/dockerfile"
 	"github.com/chainguard-dev/kaniko/pkg/image/remote"
-	"github.com/chainguard-dev/kaniko/pkg/util"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
 // WarmCache populates the cache
 func WarmCache(opts *config.WarmerOptions) error {
-	var dockerfileImages []string
 	cacheDir := opts.CacheDir
-	images := opts.Images
+	var images []warmedImage
+	for _, img := range opts.Images {
+		images = append(images, warmedImage{name: img, platform: opts.CustomPlatform})
+	}
 
 	// if opts.image is empty,we need to parse dockerfilepath to get images list
 	if opts.DockerfilePath != "" {
-		var err error
-		if dockerfileImages, err = ParseDockerfile(opts); err != nil {
+		stages, err := parseDockerfileStages(opts)
+		if err != nil {
 			return errors.Wrap(err, "failed to parse Dockerfile")
 		}
+		// TODO: Implement deduplication logic later.
+		for _, s := range stages {
+			platform := opts.CustomPlatform
+			if s.Platform != "" {
+				platform = s.Platform
+			}
+			images = append(images, warmedImage{name: s.BaseName, platform: platform})
+		}
 	}
 
-	// TODO: Implement deduplication logic later.
-	images = append(images, dockerfileImages...)
-
 	logrus.Debugf("%s\n", cacheDir)
 	logrus.Debugf("%s\n", images)
 
+	start := time.Now()
 	errs := 0
 	for _, img := range images {
-		err := warmToFile(cacheDir, img, opts)
+		// The base images of FROM --platform are warmed for their platform
+		imageOpts := *opts
+		imageOpts.CustomPlatform = img.platform
+		_, err := warmToFile(cacheDir, img.name, &imageOpts)
 		if err != nil {
-			logrus.Warnf("Error while trying to warm image: %v %v", img, err)
+			logrus.Warnf("Error while trying to warm image: %v %v", img.name, err)
 			errs++
 		}
 	}
 
+	maxSize, err := opts.CacheMaxSizeBytes()
+	if err != nil {
+		return err
+	}
+	if maxSize > 0 {
+		if err := Prune(&opts.CacheOptions, maxSize, start); err != nil {
+			return errors.Wrap(err, "pruning cache")
+		}
+	}
+
 	if len(images) == errs {
 		return errors.New("Failed to warm any of the given images")
 	}
@@ -71,11 +93,24 @@ func WarmCache(opts *config.WarmerOptions) error {
 	return nil
 }
 
+// WarmImage writes image to the local cache, for the executor to populate it
+// with the base images it pulls, and returns it from the cache
+func WarmImage(opts *config.WarmerOptions, image string) (v1.Image, error) {
+	if err := os.MkdirAll(opts.CacheDir, 0o755); err != nil {
+		return nil, err
+	}
+	digest, err := warmToFile(opts.CacheDir, image, opts)
+	if err != nil {
+		return nil, err
+	}
+	return LocalSource(&opts.CacheOptions, digest.String())
+}
+
 // Download image in temporary files then move files to final destination
-func warmToFile(cacheDir, img string, opts *config.WarmerOptions) error {
+func warmToFile(cacheDir, img string, opts *config.WarmerOptions) (v1.Hash, error) {
 	f, err := os.CreateTemp(cacheDir, "warmingImage.*")
 	if err != nil {
-		return err
+		return v1.Hash{}, err
 	}
 	// defer called in reverse order
 	defer os.Remove(f.Name())
@@ -83,7 +118,7 @@ func warmToFile(cacheDir, img string, opts *config.WarmerOptions) error {
 
 	mtfsFile, err := os.CreateTemp(cacheDir, "warmingManifest.*")
 	if err != nil {
-		return err
+		return v1.Hash{}, err
 	}
 	defer os.Remove(mtfsFile.Name())
 	defer mtfsFile.Close()
@@ -99,10 +134,10 @@ func warmToFile(cacheDir, img string, opts *config.WarmerOptions) error {
 	if err != nil {
 		if IsAlreadyCached(err) {
 			logrus.Infof("Image already in cache: %v", img)
-			return nil
+			return digest, unpackCachedImage(digest, opts)
 		}
 		logrus.Warnf("Error while trying to warm image: %v %v", img, err)
-		return err
+		return v1.Hash{}, err
 	}
 
 	finalCachePath := path.Join(cacheDir, digest.String())
@@ -110,15 +145,32 @@ func warmToFile(cacheDir, img string, opts *config.WarmerOptions) error {
 
 	err = os.Rename(f.Name(), finalCachePath)
 	if err != nil {
-		return err
+		return v1.Hash{}, err
 	}
 
 	err = os.Rename(mtfsFile.Name(), finalMfstPath)
 	if err != nil {
-		return errors.Wrap(err, "Failed to rename manifest file")
+		return v1.Hash{}, errors.Wrap(err, "Failed to rename manifest file")
 	}
 
 	logrus.Debugf("Wrote %s to cache", img)
+	return digest, unpackCachedImage(digest, opts)
+}
+
+// unpackCachedImage extracts the cached image with the given digest into the
+// unpacked cache, if requested
+func unpackCachedImage(digest v1.Hash, opts *config.WarmerOptions) error {
+	if !opts.Unpack {
+		return nil
+	}
+	img, err := LocalSource(&opts.CacheOptions, digest.String())
+	if err != nil {
+		logrus.Warnf("Not unpacking %s: %v", digest, err)
+		return nil
+	}
+	if _, err := UnpackedCache(&opts.CacheOptions).Add(img); err != nil {
+		return errors.Wrapf(err, "unpacking %s", digest)
+	}
 	return nil
 }
 
@@ -160,8 +212,16 @@ func (w *Warmer) Warm(image string, opts *config.WarmerOptions) (v1.Hash, error)
 
 	if !opts.Force {
 		_, err := w.Local(&opts.CacheOptions, digest.String())
+		if IsExpired(err) {
+			// The expired image is in use too, while LocalSource only
+			// records the use of the images it returns
+			cachePath := path.Join(opts.CacheDir, digest.String())
+			if fi, err := os.Stat(cachePath); err == nil {
+				touchCachedImage(cachePath, fi)
+			}
+		}
 		if err == nil || IsExpired(err) {
-			return v1.Hash{}, AlreadyCachedErr{}
+			return digest, AlreadyCachedErr{}
 		}
 	}
 
@@ -182,40 +242,54 @@ func (w *Warmer) Warm(image string, opts *config.WarmerOptions) (v1.Hash, error)
 	return digest, nil
 }
 
+// warmedImage is an image to warm for platform
+type warmedImage struct {
+	name     string
+	platform string
+}
+
+// ParseDockerfile returns the base images of the stages of the Dockerfile of opts
 func ParseDockerfile(opts *config.WarmerOptions) ([]string, error) {
-	var err error
-	var d []uint8
+	stages, err := parseDockerfileStages(opts)
+	if err != nil {
+		return nil, err
+	}
 	var baseNames []string
-	match, _ := regexp.MatchString("^https?://", opts.DockerfilePath)
-	if match {
-		response, e := http.Get(opts.DockerfilePath) //nolint:noctx
-		if e != nil {
-			return nil, e
-		}
-		d, err = io.ReadAll(response.Body)
-	} else {
-		d, err = os.ReadFile(opts.DockerfilePath)
+	for _, s := range stages {
+		baseNames = append(baseNames, s.BaseName)
 	}
+	return baseNames, nil
+}
 
+// parseDockerfileStages returns the stages of the Dockerfile of opts, with
+// the base images and platforms of their FROM instructions resolved
+func parseDockerfileStages(opts *config.WarmerOptions) ([]instructions.Stage, error) {
+	d, err := dockerfile.ReadDockerfile(opts.DockerfilePath, opts.DockerfileHeaders)
 	if err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("reading dockerfile at path %s", opts.DockerfilePath))
 	}
 
-	stages, _, err := dockerfile.Parse(d)
+	// The base images named in the fragments are warmed too. Without a build
+	// context, the relative paths are resolved against the directory of the
+	// Dockerfile.
+	var context, dockerfileURL string
+	if strings.HasPrefix(opts.DockerfilePath, "http://") || strings.HasPrefix(opts.DockerfilePath, "https://") {
+		dockerfileURL = opts.DockerfilePath
+	} else {
+		context = filepath.Dir(opts.DockerfilePath)
+	}
+	d, _, err = dockerfile.ResolveFragments(d, context, dockerfileURL, opts.DockerfileHeaders, nil)
 	if err != nil {
-		return nil, errors.Wrap(err, "parsing dockerfile")
+		return nil, errors.Wrap(err, "resolving dockerfile fragments")
 	}
 
-	for i, s := range stages {
-		resolvedBaseName, err := util.ResolveEnvironmentReplacement(s.BaseName, opts.BuildArgs, false)
-		if err != nil {
-			return nil, errors.Wrap(err, fmt.Sprintf("resolving base name %s", s.BaseName))
-		}
-		if s.BaseName != resolvedBaseName {
-			stages[i].BaseName = resolvedBaseName
-		}
-		baseNames = append(baseNames, resolvedBaseName)
+	stages, metaArgs, err := dockerfile.Parse(d)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing dockerfile")
 	}
-	return baseNames, nil
 
+	if err := dockerfile.ResolveStages(stages, metaArgs, opts.BuildArgs, opts.CustomPlatform); err != nil {
+		return nil, errors.Wrap(err, "resolving args")
+	}
+	return stages, nil
 }
@@ -19,10 +19,14 @@ package cache
 import (
 	"bytes"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/chainguard-dev/kaniko/pkg/config"
 	"github.com/chainguard-dev/kaniko/pkg/fakes"
+	"github.com/chainguard-dev/kaniko/testutil"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 )
 
@@ -92,7 +96,7 @@ func Test_Warmer_Warm_in_cache_expired(t *testing.T) {
 
 	cw := &Warmer{
 		Remote: func(_ string, _ config.RegistryOptions, _ string) (v1.Image, error) {
-			return fakes.FakeImage{}, nil
+			return fakes.FakeImage{Hash: v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("a", 64)}}, nil
 		},
 		Local: func(_ *config.CacheOptions, _ string) (v1.Image, error) {
 			return fakes.FakeImage{}, ExpiredErr{}
@@ -101,7 +105,11 @@ func Test_Warmer_Warm_in_cache_expired(t *testing.T) {
 		ManifestWriter: manifestBuf,
 	}
 
-	opts := &config.WarmerOptions{}
+	opts := &config.WarmerOptions{CacheOptions: config.CacheOptions{CacheDir: t.TempDir()}}
+	cached := filepath.Join(opts.CacheDir, "sha256:"+strings.Repeat("a", 64))
+	testutil.CheckNoError(t, os.WriteFile(cached, nil, 0o644))
+	old := time.Now().Add(-48 * time.Hour)
+	testutil.CheckNoError(t, os.Chtimes(cached, old, old))
 
 	_, err := cw.Warm(image, opts)
 	if !IsAlreadyCached(err) {
@@ -112,6 +120,16 @@ func Test_Warmer_Warm_in_cache_expired(t *testing.T) {
 	if len(tarBuf.Bytes()) != 0 {
 		t.Errorf("expected nothing to be written")
 	}
+
+	// The use of the skipped image is recorded, for it not to be evicted
+	_, lastUsed, err := usage(cached)
+	testutil.CheckNoError(t, err)
+	if !lastUsed.After(old) {
+		t.Errorf("expected the use of %s to be recorded", cached)
+	}
+	fi, err := os.Stat(cached)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, old.Unix(), fi.ModTime().Unix())
 }
 
 func TestParseDockerfile_SingleStageDockerfile(t *testing.T) {
@@ -211,6 +229,26 @@ FROM golang:${version}
 	}
 }
 
+func TestParseDockerfile_IncludedFragments(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "builder.Dockerfile"), []byte("FROM golang:1.20 AS builder\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dockerfile := filepath.Join(dir, "Dockerfile")
+	if err := os.WriteFile(dockerfile, []byte("# include builder.Dockerfile\nFROM alpine:latest\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &config.WarmerOptions{DockerfilePath: dockerfile}
+	baseNames, err := ParseDockerfile(opts)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(baseNames) != 2 || baseNames[0] != "golang:1.20" || baseNames[1] != "alpine:latest" {
+		t.Fatalf("expected the base images of the fragments to be warmed, got %v", baseNames)
+	}
+}
+
 func TestParseDockerfile_MissingsDockerfile(t *testing.T) {
 	opts := &config.WarmerOptions{DockerfilePath: "dummy-nowhere"}
 	baseNames, err := ParseDockerfile(opts)
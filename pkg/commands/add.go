@@ -18,12 +18,15 @@ package commands
 
 import (
 	"io/fs"
+	"os"
 	"path/filepath"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
 	"github.com/pkg/errors"
 
+	"github.com/chainguard-dev/kaniko/pkg/buildcontext"
+	kConfig "github.com/chainguard-dev/kaniko/pkg/config"
 	"github.com/chainguard-dev/kaniko/pkg/dockerfile"
 
 	"github.com/chainguard-dev/kaniko/pkg/util"
@@ -35,6 +38,8 @@ type AddCommand struct {
 	cmd           *instructions.AddCommand
 	fileContext   util.FileContext
 	snapshotFiles []string
+	// gitCommits are the commits of the git sources, resolved once
+	gitCommits map[string]string
 }
 
 // ExecuteCommand executes the ADD command
@@ -45,6 +50,8 @@ type AddCommand struct {
 //     - If dest doesn't end with a slash, the filepath is inferred to be <dest>/<filename>
 //  2. If <src> is a local tar archive:
 //     - it is unpacked at the dest, as 'tar -x' would
+//  3. If <src> is a git repository URL:
+//     - it is cloned into the dest directory, without its .git directory unless --keep-git-dir is set
 func (a *AddCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
 	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
 
@@ -52,8 +59,9 @@ func (a *AddCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.Bui
 	if err != nil {
 		return errors.Wrap(err, "getting permissions from chmod")
 	}
+	urlChmod := chmod
 	if useDefaultChmod {
-		chmod = fs.FileMode(0o600)
+		urlChmod = fs.FileMode(0o600)
 	}
 
 	uid, gid, err := util.GetUserGroup(a.cmd.Chown, replacementEnvs)
@@ -69,18 +77,31 @@ func (a *AddCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.Bui
 	var unresolvedSrcs []string
 	// If any of the sources are local tar archives:
 	// 	1. Unpack them to the specified destination
+	// If any of the sources is a git repository URL:
+	//	1. Clone it into the specified dest
 	// If any of the sources is a remote file URL:
 	//	1. Download and copy it to the specified dest
 	// Else, add to the list of unresolved sources
 	for _, src := range srcs {
 		fullPath := filepath.Join(a.fileContext.Root, src)
-		if util.IsSrcRemoteFileURL(src) {
+		if util.IsSrcGitURL(src) {
+			gitDest := dest
+			if !filepath.IsAbs(gitDest) {
+				gitDest = filepath.Join(config.WorkingDir, gitDest)
+			}
+			logrus.Infof("Adding git repository %s to %s", src, gitDest)
+			copiedFiles, err := a.addGitSource(src, gitDest, uid, gid, chmod, useDefaultChmod)
+			if err != nil {
+				return errors.Wrap(err, "adding git source")
+			}
+			a.snapshotFiles = append(a.snapshotFiles, copiedFiles...)
+		} else if util.IsSrcRemoteFileURL(src) {
 			urlDest, err := util.URLDestinationFilepath(src, dest, config.WorkingDir, replacementEnvs)
 			if err != nil {
 				return err
 			}
 			logrus.Infof("Adding remote URL %s to %s", src, urlDest)
-			if err := util.DownloadFileToDest(src, urlDest, uid, gid, chmod); err != nil {
+			if err := util.DownloadFileToDest(src, urlDest, uid, gid, urlChmod); err != nil {
 				return errors.Wrap(err, "downloading remote source file")
 			}
 			a.snapshotFiles = append(a.snapshotFiles, urlDest)
@@ -121,6 +142,28 @@ func (a *AddCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.Bui
 	return nil
 }
 
+// addGitSource clones the git repository src and copies it into dest
+func (a *AddCommand) addGitSource(src, dest string, uid, gid int64, chmod fs.FileMode, useDefaultChmod bool) ([]string, error) {
+	dir, err := os.MkdirTemp(kConfig.KanikoDir, "git-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	// Clone the commit of the cache key, even if the reference moved since
+	commit, err := a.gitCommit(src)
+	if err != nil {
+		return nil, err
+	}
+	srcDir, err := buildcontext.CloneGitSource(src, commit, dir, a.cmd.KeepGitDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := util.MkdirAllWithPermissions(dest, 0o755, uid, gid); err != nil {
+		return nil, err
+	}
+	return util.CopyDir(srcDir, dest, util.FileContext{Root: dir}, uid, gid, chmod, useDefaultChmod)
+}
+
 // FilesToSnapshot should return an empty array if still nil; no files were changed
 func (a *AddCommand) FilesToSnapshot() []string {
 	return a.snapshotFiles
@@ -141,7 +184,7 @@ func (a *AddCommand) FilesUsedFromContext(config *v1.Config, buildArgs *dockerfi
 
 	files := []string{}
 	for _, src := range srcs {
-		if util.IsSrcRemoteFileURL(src) {
+		if util.IsSrcRemoteFileURL(src) || util.IsSrcGitURL(src) {
 			continue
 		}
 		if util.IsFileLocalTarArchive(src) {
@@ -155,6 +198,45 @@ func (a *AddCommand) FilesUsedFromContext(config *v1.Config, buildArgs *dockerfi
 	return files, nil
 }
 
+// RemoteSourceKeys returns the commits the references of the git sources point
+// to, so that the commands after the ADD aren't cached across their changes
+func (a *AddCommand) RemoteSourceKeys(config *v1.Config, buildArgs *dockerfile.BuildArgs) ([]string, error) {
+	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
+	srcs, _, err := util.ResolveEnvAndWildcards(a.cmd.SourcesAndDest, a.fileContext, replacementEnvs)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, src := range srcs {
+		if !util.IsSrcGitURL(src) {
+			continue
+		}
+		commit, err := a.gitCommit(src)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, src+"@"+commit)
+	}
+	return keys, nil
+}
+
+// gitCommit returns the commit the reference of the git source src points to,
+// resolved once for both the cache key and the clone
+func (a *AddCommand) gitCommit(src string) (string, error) {
+	if commit, ok := a.gitCommits[src]; ok {
+		return commit, nil
+	}
+	commit, err := buildcontext.ResolveGitSource(src)
+	if err != nil {
+		return "", errors.Wrapf(err, "resolving git source %s", src)
+	}
+	if a.gitCommits == nil {
+		a.gitCommits = map[string]string{}
+	}
+	a.gitCommits[src] = commit
+	return commit, nil
+}
+
 func (a *AddCommand) MetadataOnly() bool {
 	return false
 }
@@ -16,10 +16,17 @@ limitations under the License.
 
 package commands
 
-import v1 "github.com/google/go-containerregistry/pkg/v1"
+import (
+	"fmt"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
 
 type Cached interface {
 	Layer() v1.Layer
+	// LoadLayer loads the cached layer of the command without extracting it
+	LoadLayer() error
 }
 
 type caching struct {
@@ -29,3 +36,19 @@ type caching struct {
 func (c caching) Layer() v1.Layer {
 	return c.layer
 }
+
+// load loads the layer of the image cached for command, which has one layer
+func (c *caching) load(img v1.Image, command string) error {
+	if img == nil {
+		return fmt.Errorf("cached command image is nil %v", command)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		return errors.Wrap(err, "retrieving image layers")
+	}
+	if len(layers) != 1 {
+		return fmt.Errorf("expected %d layers but got %d", 1, len(layers))
+	}
+	c.layer = layers[0]
+	return nil
+}
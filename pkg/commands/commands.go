@@ -17,6 +17,9 @@ limitations under the License.
 package commands
 
 import (
+	"context"
+	"time"
+
 	"github.com/chainguard-dev/kaniko/pkg/dockerfile"
 	"github.com/chainguard-dev/kaniko/pkg/util"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
@@ -64,13 +67,74 @@ type DockerCommand interface {
 	IsArgsEnvsRequiredInCache() bool
 }
 
+// RemoteSourcer is implemented by the commands whose remote sources may change
+// while the instruction doesn't, like the branches of the git repositories
+// added by ADD.
+type RemoteSourcer interface {
+	// RemoteSourceKeys returns keys identifying the current content of the
+	// remote sources, to be part of the cache key of the command
+	RemoteSourceKeys(*v1.Config, *dockerfile.BuildArgs) ([]string, error)
+}
+
+// MountSourcer is implemented by the commands reading files they mount rather
+// than copy, like RUN with bind mounts.
+type MountSourcer interface {
+	// MountSources returns the paths of the files mounted by the command, the
+	// content of which is part of the cache key of the command
+	MountSources(*v1.Config, *dockerfile.BuildArgs) ([]string, error)
+}
+
+// ContentAddressed is implemented by the commands whose cache keys are made of
+// the files they produce rather than of the files they read, like COPY.
+type ContentAddressed interface {
+	// CacheKeys returns a key for each file the command copies, made of its
+	// destination and of the digest of its content and metadata computed with
+	// hash, followed by the resolved destination, ownership and permissions
+	CacheKeys(config *v1.Config, buildArgs *dockerfile.BuildArgs, hash func(path string) (string, error)) ([]string, error)
+}
+
+// Linked is implemented by the commands making their layers themselves,
+// independently of the files of the previous layers, like COPY --link.
+type Linked interface {
+	// IsLinked returns true if the layer of the command is independent of
+	// the previous layers
+	IsLinked() bool
+	// LinkedLayer returns the path of the uncompressed layer made by the
+	// command once executed
+	LinkedLayer() string
+}
+
+// HealthChecker is implemented by the commands setting the healthcheck of the
+// image, like HEALTHCHECK.
+type HealthChecker interface {
+	// HealthcheckStartInterval returns the start interval of the healthcheck,
+	// which the config of go-containerregistry cannot hold
+	HealthcheckStartInterval() time.Duration
+}
+
+// NetworkRecorder is implemented by the commands recording the network
+// destinations they connected to, like RUN.
+type NetworkRecorder interface {
+	// NetworkDestinations returns the destinations the command connected to,
+	// if recorded
+	NetworkDestinations() []string
+}
+
+// Interruptible is implemented by the commands running processes, like RUN,
+// which are killed once the context of the build is done.
+type Interruptible interface {
+	// ExecuteCommandContext executes the command like ExecuteCommand, killing
+	// its processes and returning the cause of ctx once ctx is done
+	ExecuteCommandContext(ctx context.Context, config *v1.Config, buildArgs *dockerfile.BuildArgs) error
+}
+
 func GetCommand(cmd instructions.Command, fileContext util.FileContext, useNewRun bool, cacheCopy bool, cacheRun bool) (DockerCommand, error) {
 	switch c := cmd.(type) {
 	case *instructions.RunCommand:
 		if useNewRun {
-			return &RunMarkerCommand{cmd: c, shdCache: cacheRun}, nil
+			return &RunMarkerCommand{cmd: c, fileContext: fileContext, shdCache: cacheRun}, nil
 		}
-		return &RunCommand{cmd: c, shdCache: cacheRun}, nil
+		return &RunCommand{cmd: c, fileContext: fileContext, shdCache: cacheRun}, nil
 	case *instructions.CopyCommand:
 		return &CopyCommand{cmd: c, fileContext: fileContext, shdCache: cacheCopy}, nil
 	case *instructions.ExposeCommand:
@@ -102,7 +166,7 @@ func GetCommand(cmd instructions.Command, fileContext util.FileContext, useNewRu
 	case *instructions.HealthCheckCommand:
 		return &HealthCheckCommand{cmd: c}, nil
 	case *instructions.MaintainerCommand:
-		logrus.Warnf("%s is deprecated, skipping", cmd.Name())
+		logrus.Warnf("%s is deprecated, skipping, use --modernize to convert it into a label", cmd.Name())
 		return nil, nil
 	}
 	return nil, errors.Errorf("%s is not a supported command", cmd.Name())
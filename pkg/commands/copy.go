@@ -18,18 +18,21 @@ package commands
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
 
 	kConfig "github.com/chainguard-dev/kaniko/pkg/config"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/patternmatcher"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
 	"github.com/chainguard-dev/kaniko/pkg/dockerfile"
 	"github.com/chainguard-dev/kaniko/pkg/util"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
 )
 
 // for testing
@@ -43,69 +46,261 @@ type CopyCommand struct {
 	fileContext   util.FileContext
 	snapshotFiles []string
 	shdCache      bool
+	// linkRoot is the directory the sources are copied to with --link
+	linkRoot string
+	// linkedLayer is the path of the layer made with --link
+	linkedLayer string
 }
 
 func (c *CopyCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
-	// Resolve from
-	if c.cmd.From != "" {
-		c.fileContext = util.FileContext{Root: filepath.Join(kConfig.KanikoDir, c.cmd.From)}
+	if c.cmd.Link {
+		return c.executeLinked(config, buildArgs)
 	}
+	return c.copy(config, buildArgs)
+}
 
-	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
-	uid, gid, err := getUserGroup(c.cmd.Chown, replacementEnvs)
-	logrus.Debugf("found uid %v and gid %v for chown string %v", uid, gid, c.cmd.Chown)
+// executeLinked copies the sources to an empty directory, makes the layer of
+// the command of it, and extracts the layer to the filesystem, for the layer
+// not to depend on the files of the previous ones.
+func (c *CopyCommand) executeLinked(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
+	dir, err := os.MkdirTemp(kConfig.ScratchDir(), "link-")
 	if err != nil {
-		return errors.Wrap(err, "getting user group from chown")
+		return errors.Wrap(err, "creating link directory")
+	}
+	defer os.RemoveAll(dir)
+	c.linkRoot = dir
+	defer func() {
+		c.linkRoot = ""
+	}()
+	if err := c.copy(config, buildArgs); err != nil {
+		return err
 	}
 
-	// sources from the Copy command are resolved with wildcards {*?[}
-	srcs, dest, err := util.ResolveEnvAndWildcards(c.cmd.SourcesAndDest, c.fileContext, replacementEnvs)
+	f, err := os.CreateTemp(kConfig.ScratchDir(), "link-*.tar")
 	if err != nil {
-		return errors.Wrap(err, "resolving src")
+		return errors.Wrap(err, "creating linked layer")
+	}
+	defer f.Close()
+	if err := util.CreateLayerOfDirectory(dir, f); err != nil {
+		return errors.Wrap(err, "writing linked layer")
 	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	c.linkedLayer = f.Name()
+	layer, err := tarball.LayerFromFile(c.linkedLayer)
+	if err != nil {
+		return err
+	}
+	c.snapshotFiles, err = util.GetFSFromLayers(kConfig.RootDir, []v1.Layer{layer}, util.ExtractFunc(util.ExtractFile), util.IncludeWhiteout())
+	if err != nil {
+		return errors.Wrap(err, "extracting linked layer")
+	}
+	return nil
+}
 
-	chmod, useDefaultChmod, err := util.GetChmod(c.cmd.Chmod, replacementEnvs)
+// LinkedLayer returns the path of the uncompressed layer made by the command
+// with --link
+func (c *CopyCommand) LinkedLayer() string {
+	return c.linkedLayer
+}
+
+// IsLinked returns true for the COPY --link commands
+func (c *CopyCommand) IsLinked() bool {
+	return c.cmd.Link
+}
+
+// linkPath returns the path of the absolute path under the directory the
+// sources are copied to with --link
+func (c *CopyCommand) linkPath(path string) string {
+	return linkedPath(c.linkRoot, path)
+}
+
+func linkedPath(linkRoot, path string) string {
+	if linkRoot == "" || !filepath.IsAbs(path) {
+		return path
+	}
+	linked := filepath.Join(linkRoot, path)
+	if strings.HasSuffix(path, "/") {
+		linked += "/"
+	}
+	return linked
+}
+
+// workingDir returns the directory the relative destinations are resolved in
+func (c *CopyCommand) workingDir(config *v1.Config) string {
+	return copyWorkingDir(config, c.linkRoot)
+}
+
+func copyWorkingDir(config *v1.Config, linkRoot string) string {
+	cwd := config.WorkingDir
+	if cwd == "" {
+		cwd = kConfig.RootDir
+	}
+	return linkedPath(linkRoot, cwd)
+}
+
+// resolveDestination resolves the symlinks of destPath, which the
+// destinations of COPY --link are copied through.
+func (c *CopyCommand) resolveDestination(destPath string) (string, error) {
+	if c.linkRoot != "" {
+		return destPath, nil
+	}
+	// If the destination dir is a symlink we need to resolve the path and use
+	// that instead of the symlink path
+	destPath, err := resolveIfSymlink(destPath)
 	if err != nil {
-		return errors.Wrap(err, "getting permissions from chmod")
+		return "", errors.Wrap(err, "resolving dest symlink")
 	}
+	return destPath, nil
+}
 
-	// For each source, iterate through and copy it over
+// sourceContext returns the context the sources of cmd are copied from
+func sourceContext(cmd *instructions.CopyCommand, fileContext util.FileContext) util.FileContext {
+	if cmd.From != "" {
+		return util.FileContext{Root: filepath.Join(kConfig.StagingDir(), cmd.From)}
+	}
+	return fileContext
+}
+
+// copySource is a source of a COPY instruction along with the path it is
+// copied to
+type copySource struct {
+	path     string
+	destPath string
+	fi       os.FileInfo
+	// fileContext excludes the files of the source not to copy
+	fileContext util.FileContext
+}
+
+// copySources resolves the sources of cmd in fileContext, skipping the
+// excluded ones, along with the paths they are copied to under the directory
+// linkRoot, if any, and returns them with the resolved destination.
+func copySources(cmd *instructions.CopyCommand, fileContext util.FileContext, config *v1.Config, envs []string, linkRoot string) ([]copySource, string, error) {
+	// sources from the Copy command are resolved with wildcards {*?[}
+	var srcs []string
+	var dest string
+	// The paths of the sources under dest with --parents, keyed by source
+	var parents map[string]string
+	var err error
+	switch {
+	case len(cmd.SourcePaths) > 0 && cmd.Parents:
+		srcs, dest, parents, err = resolveParents(cmd.SourcesAndDest, fileContext, envs)
+	case len(cmd.SourcePaths) > 0:
+		srcs, dest, err = util.ResolveEnvAndWildcards(cmd.SourcesAndDest, fileContext, envs)
+	default:
+		dest, err = util.ResolveEnvironmentReplacement(cmd.DestPath, envs, true)
+	}
+	if err != nil {
+		return nil, "", errors.Wrap(err, "resolving src")
+	}
+	dest = linkedPath(linkRoot, dest)
+	if len(cmd.SourcePaths)+len(cmd.SourceContents) > 1 && !util.IsDestDir(dest) {
+		return nil, "", errors.New("when specifying multiple sources in a COPY command, destination must be a directory and end in '/'")
+	}
+
+	var excludes *patternmatcher.PatternMatcher
+	if len(cmd.ExcludePatterns) > 0 {
+		if excludes, err = patternmatcher.New(cmd.ExcludePatterns); err != nil {
+			return nil, "", errors.Wrap(err, "parsing exclude patterns")
+		}
+	}
+
+	var sources []copySource
 	for _, src := range srcs {
-		fullPath := filepath.Join(c.fileContext.Root, src)
+		fullPath := filepath.Join(fileContext.Root, src)
+		srcContext := fileContext
+		if excludes != nil {
+			// The patterns apply to the sources matched by the wildcards, by their
+			// path relative to the context or their name, and to the content of
+			// the directories
+			excluded, err := isExcluded(excludes, fileContext.Root, fullPath)
+			if err != nil {
+				return nil, "", errors.Wrap(err, "matching exclude patterns")
+			}
+			if excluded && filepath.Clean(src) != "." {
+				continue
+			}
+			srcContext.CopyExcludes = cmd.ExcludePatterns
+			srcContext.CopyExcludesRoot = fullPath
+		}
 
 		fi, err := os.Lstat(fullPath)
 		if err != nil {
-			return errors.Wrap(err, "could not copy source")
+			return nil, "", errors.Wrap(err, "could not copy source")
 		}
 		if fi.IsDir() && !strings.HasSuffix(fullPath, string(os.PathSeparator)) {
 			fullPath += "/"
 		}
-		cwd := config.WorkingDir
-		if cwd == "" {
-			cwd = kConfig.RootDir
-		}
+		cwd := copyWorkingDir(config, linkRoot)
 
 		destPath, err := util.DestinationFilepath(fullPath, dest, cwd)
+		if rel, ok := parents[src]; ok && err == nil {
+			destPath, err = util.DestinationFilepath("", dest, cwd)
+			destPath = filepath.Join(destPath, rel)
+			if fi.IsDir() {
+				destPath += "/"
+			}
+		}
 		if err != nil {
-			return errors.Wrap(err, "find destination path")
+			return nil, "", errors.Wrap(err, "find destination path")
 		}
+		sources = append(sources, copySource{path: fullPath, destPath: destPath, fi: fi, fileContext: srcContext})
+	}
+	return sources, dest, nil
+}
+
+// isExcluded returns true if the source path, or its name, matches the
+// exclude patterns, the path being relative to the context root
+func isExcluded(excludes *patternmatcher.PatternMatcher, root, path string) (bool, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false, err
+	}
+	excluded, err := excludes.MatchesOrParentMatches(rel)
+	if err != nil || excluded {
+		return excluded, err
+	}
+	return excludes.MatchesOrParentMatches(filepath.Base(path))
+}
+
+func (c *CopyCommand) copy(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
+	// Resolve from
+	c.fileContext = sourceContext(c.cmd, c.fileContext)
+
+	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
+	uid, gid, err := getUserGroup(c.cmd.Chown, replacementEnvs)
+	logrus.Debugf("found uid %v and gid %v for chown string %v", uid, gid, c.cmd.Chown)
+	if err != nil {
+		return errors.Wrap(err, "getting user group from chown")
+	}
 
-		// If the destination dir is a symlink we need to resolve the path and use
-		// that instead of the symlink path
-		destPath, err = resolveIfSymlink(destPath)
+	sources, dest, err := copySources(c.cmd, c.fileContext, config, replacementEnvs, c.linkRoot)
+	if err != nil {
+		return err
+	}
+
+	chmod, useDefaultChmod, err := util.GetChmod(c.cmd.Chmod, replacementEnvs)
+	if err != nil {
+		return errors.Wrap(err, "getting permissions from chmod")
+	}
+
+	// For each source, iterate through and copy it over
+	for _, src := range sources {
+		destPath, err := c.resolveDestination(src.destPath)
 		if err != nil {
-			return errors.Wrap(err, "resolving dest symlink")
+			return err
 		}
 
-		if fi.IsDir() {
-			copiedFiles, err := util.CopyDir(fullPath, destPath, c.fileContext, uid, gid, chmod, useDefaultChmod)
+		if src.fi.IsDir() {
+			copiedFiles, err := util.CopyDir(src.path, destPath, src.fileContext, uid, gid, chmod, useDefaultChmod)
 			if err != nil {
 				return errors.Wrap(err, "copying dir")
 			}
 			c.snapshotFiles = append(c.snapshotFiles, copiedFiles...)
-		} else if util.IsSymlink(fi) {
+		} else if util.IsSymlink(src.fi) {
 			// If file is a symlink, we want to copy the target file to destPath
-			exclude, err := util.CopySymlink(fullPath, destPath, c.fileContext)
+			exclude, err := util.CopySymlink(src.path, destPath, c.fileContext)
 			if err != nil {
 				return errors.Wrap(err, "copying symlink")
 			}
@@ -115,7 +310,7 @@ func (c *CopyCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.Bu
 			c.snapshotFiles = append(c.snapshotFiles, destPath)
 		} else {
 			// ... Else, we want to copy over a file
-			exclude, err := util.CopyFile(fullPath, destPath, c.fileContext, uid, gid, chmod, useDefaultChmod)
+			exclude, err := util.CopyFile(src.path, destPath, c.fileContext, uid, gid, chmod, useDefaultChmod)
 			if err != nil {
 				return errors.Wrap(err, "copying file")
 			}
@@ -125,6 +320,91 @@ func (c *CopyCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.Bu
 			c.snapshotFiles = append(c.snapshotFiles, destPath)
 		}
 	}
+	return c.copyHeredocs(config, dest, uid, gid, chmod, useDefaultChmod, replacementEnvs)
+}
+
+// resolveParents resolves the sources of a COPY --parents instruction like
+// util.ResolveEnvAndWildcards, and returns their paths under dest along with
+// them: the path of each source in the context, or its path under the part of
+// the source pattern before /./ if any, as with BuildKit. The destination is
+// always a directory.
+func resolveParents(sd instructions.SourcesAndDest, fileContext util.FileContext, envs []string) ([]string, string, map[string]string, error) {
+	dest, err := util.ResolveEnvironmentReplacement(sd.DestPath, envs, true)
+	if err != nil {
+		return nil, "", nil, errors.Wrap(err, "failed to resolve environment for dest path")
+	}
+	if !strings.HasSuffix(dest, "/") {
+		dest += "/"
+	}
+	var srcs []string
+	parents := map[string]string{}
+	for _, src := range sd.SourcePaths {
+		// The pivot is lost once the path is cleaned
+		src, err := util.ResolveEnvironmentReplacement(src, envs, false)
+		if err != nil {
+			return nil, "", nil, errors.Wrap(err, "failed to resolve environment")
+		}
+		pivot := ""
+		if before, _, ok := strings.Cut(src, "/./"); ok {
+			if strings.Count(src, "/./") > 1 {
+				return nil, "", nil, fmt.Errorf("invalid source %s of COPY --parents, it has several /./", src)
+			}
+			pivot = filepath.Clean(before)
+		}
+		resolved, err := util.ResolveSources([]string{filepath.Clean(src)}, fileContext.Root)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		for _, r := range resolved {
+			rel := filepath.Clean(r)
+			if pivot != "" {
+				if rel, err = filepath.Rel(pivot, rel); err != nil || strings.HasPrefix(rel, "..") {
+					return nil, "", nil, fmt.Errorf("source %s is not under %s", r, pivot)
+				}
+			}
+			// Absolute sources, from stages, keep their path under /
+			parents[r] = strings.TrimPrefix(rel, "/")
+			srcs = append(srcs, r)
+		}
+	}
+	return srcs, dest, parents, nil
+}
+
+// copyHeredocs writes the heredocs of the command to dest, as files named
+// after them, owned by root and with the mode 0644 unless set otherwise.
+func (c *CopyCommand) copyHeredocs(config *v1.Config, dest string, uid, gid int64, chmod fs.FileMode, useDefaultChmod bool, envs []string) error {
+	if uid == util.DoNotChangeUID {
+		uid = 0
+	}
+	if gid == util.DoNotChangeGID {
+		gid = 0
+	}
+	if useDefaultChmod {
+		chmod = 0o644
+	}
+	cwd := c.workingDir(config)
+	for _, content := range c.cmd.SourceContents {
+		data := content.Data
+		if content.Expand {
+			var err error
+			if data, err = expandHeredoc(data, envs); err != nil {
+				return errors.Wrapf(err, "expanding heredoc %s", content.Path)
+			}
+		}
+		destPath, err := util.DestinationFilepath(content.Path, dest, cwd)
+		if err != nil {
+			return errors.Wrap(err, "find destination path")
+		}
+		destPath, err = c.resolveDestination(destPath)
+		if err != nil {
+			return err
+		}
+		logrus.Debugf("Writing heredoc %s to %s", content.Path, destPath)
+		if err := util.CreateFile(destPath, strings.NewReader(data), chmod, uint32(uid), uint32(gid)); err != nil {
+			return errors.Wrapf(err, "writing heredoc %s", content.Path)
+		}
+		c.snapshotFiles = append(c.snapshotFiles, destPath)
+	}
 	return nil
 }
 
@@ -135,13 +415,18 @@ func (c *CopyCommand) FilesToSnapshot() []string {
 
 // String returns some information about the command for the image config
 func (c *CopyCommand) String() string {
-	return c.cmd.String()
+	return copyCommandString(c.cmd)
 }
 
 func (c *CopyCommand) FilesUsedFromContext(config *v1.Config, buildArgs *dockerfile.BuildArgs) ([]string, error) {
 	return copyCmdFilesUsedFromContext(config, buildArgs, c.cmd, c.fileContext)
 }
 
+// CacheKeys returns the keys of the files copied by the command
+func (c *CopyCommand) CacheKeys(config *v1.Config, buildArgs *dockerfile.BuildArgs, hash func(string) (string, error)) ([]string, error) {
+	return copyCacheKeys(config, buildArgs, c.cmd, c.fileContext, hash)
+}
+
 func (c *CopyCommand) MetadataOnly() bool {
 	return false
 }
@@ -180,23 +465,12 @@ type CachingCopyCommand struct {
 
 func (cr *CachingCopyCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
 	logrus.Infof("Found cached layer, extracting to filesystem")
-	var err error
-
-	if cr.img == nil {
-		return errors.New(fmt.Sprintf("cached command image is nil %v", cr.String()))
+	if err := cr.LoadLayer(); err != nil {
+		return err
 	}
 
-	layers, err := cr.img.Layers()
-	if err != nil {
-		return errors.Wrapf(err, "retrieve image layers")
-	}
-
-	if len(layers) != 1 {
-		return errors.New(fmt.Sprintf("expected %d layers but got %d", 1, len(layers)))
-	}
-
-	cr.layer = layers[0]
-	cr.extractedFiles, err = util.GetFSFromLayers(kConfig.RootDir, layers, util.ExtractFunc(cr.extractFn), util.IncludeWhiteout())
+	var err error
+	cr.extractedFiles, err = util.GetFSFromLayers(kConfig.RootDir, []v1.Layer{cr.layer}, util.ExtractFunc(cr.extractFn), util.IncludeWhiteout())
 
 	logrus.Debugf("ExtractedFiles: %s", cr.extractedFiles)
 	if err != nil {
@@ -206,10 +480,19 @@ func (cr *CachingCopyCommand) ExecuteCommand(config *v1.Config, buildArgs *docke
 	return nil
 }
 
+func (cr *CachingCopyCommand) LoadLayer() error {
+	return cr.load(cr.img, cr.String())
+}
+
 func (cr *CachingCopyCommand) FilesUsedFromContext(config *v1.Config, buildArgs *dockerfile.BuildArgs) ([]string, error) {
 	return copyCmdFilesUsedFromContext(config, buildArgs, cr.cmd, cr.fileContext)
 }
 
+// CacheKeys returns the keys of the files copied by the command
+func (cr *CachingCopyCommand) CacheKeys(config *v1.Config, buildArgs *dockerfile.BuildArgs, hash func(string) (string, error)) ([]string, error) {
+	return copyCacheKeys(config, buildArgs, cr.cmd, cr.fileContext, hash)
+}
+
 func (cr *CachingCopyCommand) FilesToSnapshot() []string {
 	f := cr.extractedFiles
 	logrus.Debugf("%d files extracted by caching copy command", len(f))
@@ -226,7 +509,7 @@ func (cr *CachingCopyCommand) String() string {
 	if cr.cmd == nil {
 		return "nil command"
 	}
-	return cr.cmd.String()
+	return copyCommandString(cr.cmd)
 }
 
 func (cr *CachingCopyCommand) From() string {
@@ -276,15 +559,24 @@ func copyCmdFilesUsedFromContext(
 	config *v1.Config, buildArgs *dockerfile.BuildArgs, cmd *instructions.CopyCommand,
 	fileContext util.FileContext,
 ) ([]string, error) {
-	if cmd.From != "" {
-		fileContext = util.FileContext{Root: filepath.Join(kConfig.KanikoDir, cmd.From)}
+	fileContext = sourceContext(cmd, fileContext)
+
+	// Heredocs are not part of the context
+	if len(cmd.SourcePaths) == 0 {
+		return []string{}, nil
 	}
 
 	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
 
-	srcs, _, err := util.ResolveEnvAndWildcards(
-		cmd.SourcesAndDest, fileContext, replacementEnvs,
-	)
+	var srcs []string
+	var err error
+	if cmd.Parents {
+		srcs, _, _, err = resolveParents(cmd.SourcesAndDest, fileContext, replacementEnvs)
+	} else {
+		srcs, _, err = util.ResolveEnvAndWildcards(
+			cmd.SourcesAndDest, fileContext, replacementEnvs,
+		)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -300,6 +592,70 @@ func copyCmdFilesUsedFromContext(
 	return files, nil
 }
 
+// copyCacheKeys returns a key for each file cmd copies, made of the path it is
+// copied to and of its digest, for the cache key of the layer to only depend
+// on the files it is made of: renaming or moving a source changes the key,
+// while the sources excluded or copied elsewhere don't. The sources are
+// resolved like when copying them, without following the symlinks of the
+// destination.
+func copyCacheKeys(
+	config *v1.Config, buildArgs *dockerfile.BuildArgs, cmd *instructions.CopyCommand,
+	fileContext util.FileContext, hash func(string) (string, error),
+) ([]string, error) {
+	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
+	fileContext = sourceContext(cmd, fileContext)
+	sources, dest, err := copySources(cmd, fileContext, config, replacementEnvs, "")
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	addKey := func(path, destPath string) error {
+		d, err := hash(path)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, destPath+"="+d)
+		return nil
+	}
+	for _, src := range sources {
+		if !src.fi.IsDir() {
+			if fileContext.ExcludesFile(src.path) {
+				continue
+			}
+			if err := addKey(src.path, src.destPath); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		files, err := util.RelativeFiles("", src.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			path := filepath.Join(src.path, f)
+			if src.fileContext.ExcludesFile(path) {
+				continue
+			}
+			if err := addKey(path, filepath.Join(src.destPath, f)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The heredocs are part of the command, but not where they are written to
+	chown, err := util.ResolveEnvironmentReplacement(cmd.Chown, replacementEnvs, false)
+	if err != nil {
+		return nil, err
+	}
+	chmod, err := util.ResolveEnvironmentReplacement(cmd.Chmod, replacementEnvs, false)
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, fmt.Sprintf("dest=%s workdir=%s chown=%s chmod=%s", dest, config.WorkingDir, chown, chmod))
+	return keys, nil
+}
+
 // AbstractCopyCommand can either be a CopyCommand or a CachingCopyCommand.
 type AbstractCopyCommand interface {
 	From() string
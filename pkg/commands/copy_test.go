@@ -23,10 +23,12 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"syscall"
 	"testing"
 
+	kConfig "github.com/chainguard-dev/kaniko/pkg/config"
 	"github.com/chainguard-dev/kaniko/pkg/dockerfile"
 	"github.com/chainguard-dev/kaniko/pkg/util"
 	"github.com/chainguard-dev/kaniko/testutil"
@@ -1148,3 +1150,279 @@ func TestCopyCommand_ExecuteCommand_Extended(t *testing.T) {
 		testutil.CheckDeepEqual(t, "../bam.txt", linkName)
 	})
 }
+
+func TestCopyCommand_ExecuteCommand_Parents(t *testing.T) {
+	setupDirs := func(t *testing.T) string {
+		testDir := t.TempDir()
+		for _, f := range []string{"src/app/go.mod", "src/app/main.go", "src/lib/go.mod", "go.mod"} {
+			path := filepath.Join(testDir, "context", f)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(f), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return testDir
+	}
+
+	tests := []struct {
+		name     string
+		srcs     []string
+		expected []string
+	}{
+		{
+			name:     "glob keeps the parent directories",
+			srcs:     []string{"**/go.mod"},
+			expected: []string{"go.mod", "src/app/go.mod", "src/lib/go.mod"},
+		},
+		{
+			name:     "parent directories under the pivot",
+			srcs:     []string{"src/./app/*.go"},
+			expected: []string{"app/main.go"},
+		},
+		{
+			name:     "directory",
+			srcs:     []string{"src/lib"},
+			expected: []string{"src/lib/go.mod"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testDir := setupDirs(t)
+			cmd := CopyCommand{
+				cmd: &instructions.CopyCommand{
+					SourcesAndDest: instructions.SourcesAndDest{SourcePaths: test.srcs, DestPath: "dest"},
+					Parents:        true,
+				},
+				fileContext: util.FileContext{Root: filepath.Join(testDir, "context")},
+			}
+			cfg := &v1.Config{WorkingDir: testDir}
+			testutil.CheckNoError(t, cmd.ExecuteCommand(cfg, dockerfile.NewBuildArgs([]string{})))
+
+			var actual []string
+			dest := filepath.Join(testDir, "dest")
+			err := filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(dest, path)
+				actual = append(actual, rel)
+				return err
+			})
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, test.expected, actual)
+		})
+	}
+
+	t.Run("several pivots", func(t *testing.T) {
+		testDir := setupDirs(t)
+		cmd := CopyCommand{
+			cmd: &instructions.CopyCommand{
+				SourcesAndDest: instructions.SourcesAndDest{SourcePaths: []string{"src/./app/./go.mod"}, DestPath: "dest"},
+				Parents:        true,
+			},
+			fileContext: util.FileContext{Root: filepath.Join(testDir, "context")},
+		}
+		cfg := &v1.Config{WorkingDir: testDir}
+		err := cmd.ExecuteCommand(cfg, dockerfile.NewBuildArgs([]string{}))
+		testutil.CheckError(t, true, err)
+	})
+}
+
+func TestCopyCommand_ExecuteCommand_Excludes(t *testing.T) {
+	setupDirs := func(t *testing.T) string {
+		testDir := t.TempDir()
+		for _, f := range []string{"app/main.go", "app/README.md", "app/vendor/lib.go", "app/docs/guide.md", "home.txt", "home.go"} {
+			path := filepath.Join(testDir, "context", f)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(f), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return testDir
+	}
+
+	tests := []struct {
+		name     string
+		srcs     []string
+		excludes []string
+		expected []string
+	}{
+		{
+			name:     "directory",
+			srcs:     []string{"app"},
+			excludes: []string{"vendor", "*.md"},
+			expected: []string{"docs/guide.md", "main.go"},
+		},
+		{
+			name:     "directory with nested patterns",
+			srcs:     []string{"app"},
+			excludes: []string{"**/*.md", "!README.md"},
+			expected: []string{"README.md", "main.go", "vendor/lib.go"},
+		},
+		{
+			name:     "wildcard",
+			srcs:     []string{"hom*"},
+			excludes: []string{"*.txt"},
+			expected: []string{"home.go"},
+		},
+		{
+			name:     "wildcard with patterns relative to the context",
+			srcs:     []string{"app/*"},
+			excludes: []string{"app/*.md", "app/vendor"},
+			expected: []string{"guide.md", "main.go"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testDir := setupDirs(t)
+			cmd := CopyCommand{
+				cmd: &instructions.CopyCommand{
+					SourcesAndDest:  instructions.SourcesAndDest{SourcePaths: test.srcs, DestPath: "dest/"},
+					ExcludePatterns: test.excludes,
+				},
+				fileContext: util.FileContext{Root: filepath.Join(testDir, "context")},
+			}
+			cfg := &v1.Config{WorkingDir: testDir}
+			testutil.CheckNoError(t, cmd.ExecuteCommand(cfg, dockerfile.NewBuildArgs([]string{})))
+
+			var actual []string
+			dest := filepath.Join(testDir, "dest")
+			err := filepath.Walk(dest, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(dest, path)
+				actual = append(actual, rel)
+				return err
+			})
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, test.expected, actual)
+		})
+	}
+}
+
+func TestCopyCommand_ExecuteCommand_Link(t *testing.T) {
+	originalRoot, originalKanikoDir := kConfig.RootDir, kConfig.KanikoDir
+	defer func() { kConfig.RootDir, kConfig.KanikoDir = originalRoot, originalKanikoDir }()
+	kConfig.RootDir, kConfig.KanikoDir = t.TempDir(), t.TempDir()
+
+	context := t.TempDir()
+	if err := os.WriteFile(filepath.Join(context, "main.go"), []byte("package main"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A file of the previous layers
+	if err := os.MkdirAll(filepath.Join(kConfig.RootDir, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(kConfig.RootDir, "app", "old.go"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := CopyCommand{
+		cmd: &instructions.CopyCommand{
+			SourcesAndDest: instructions.SourcesAndDest{SourcePaths: []string{"main.go"}, DestPath: "./"},
+			Link:           true,
+		},
+		fileContext: util.FileContext{Root: context},
+	}
+	cfg := &v1.Config{WorkingDir: "/app"}
+	testutil.CheckNoError(t, cmd.ExecuteCommand(cfg, dockerfile.NewBuildArgs([]string{})))
+
+	// The layer only holds the copied files
+	f, err := os.Open(cmd.LinkedLayer())
+	testutil.CheckNoError(t, err)
+	defer f.Close()
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		testutil.CheckNoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	testutil.CheckDeepEqual(t, []string{"app/", "app/main.go"}, names)
+
+	// and is extracted over the previous layers
+	for _, name := range []string{"main.go", "old.go"} {
+		if _, err := os.Stat(filepath.Join(kConfig.RootDir, "app", name)); err != nil {
+			t.Error(err)
+		}
+	}
+	testutil.CheckDeepEqual(t, true, len(cmd.FilesToSnapshot()) > 0)
+}
+
+func TestCopyCommand_CacheKeys(t *testing.T) {
+	contextDir := t.TempDir()
+	for _, f := range []string{"app/main.go", "app/README.md", "lib/util.go"} {
+		path := filepath.Join(contextDir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash := func(p string) (string, error) {
+		return util.CacheHasher()(p)
+	}
+	cacheKeys := func(t *testing.T, cmd *instructions.CopyCommand, cfg *v1.Config) []string {
+		c := CopyCommand{cmd: cmd, fileContext: util.FileContext{Root: contextDir}}
+		keys, err := c.CacheKeys(cfg, dockerfile.NewBuildArgs([]string{}), hash)
+		testutil.CheckNoError(t, err)
+		return keys
+	}
+	copyCmd := func(dest string, srcs ...string) *instructions.CopyCommand {
+		return &instructions.CopyCommand{SourcesAndDest: instructions.SourcesAndDest{SourcePaths: srcs, DestPath: dest}}
+	}
+	cfg := &v1.Config{WorkingDir: "/src"}
+
+	keys := cacheKeys(t, copyCmd("dest/", "app"), cfg)
+	testutil.CheckDeepEqual(t, 4, len(keys))
+	testutil.CheckDeepEqual(t, "dest=dest/ workdir=/src chown= chmod=", keys[3])
+
+	// The relative destinations depend on the working directory
+	other := cacheKeys(t, copyCmd("dest/", "app"), &v1.Config{WorkingDir: "/other"})
+	testutil.CheckDeepEqual(t, false, reflect.DeepEqual(keys, other))
+
+	// The excluded files are not part of the keys
+	excluded := copyCmd("dest/", "app")
+	excluded.ExcludePatterns = []string{"*.md"}
+	withoutReadme := cacheKeys(t, excluded, cfg)
+	if err := os.WriteFile(filepath.Join(contextDir, "app/README.md"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckDeepEqual(t, withoutReadme, cacheKeys(t, excluded, cfg))
+	testutil.CheckDeepEqual(t, false, reflect.DeepEqual(keys, cacheKeys(t, copyCmd("dest/", "app"), cfg)))
+
+	// Renaming a file of a directory changes the keys, even with the same
+	// contents
+	before := cacheKeys(t, copyCmd("dest/", "lib"), cfg)
+	if err := os.Rename(filepath.Join(contextDir, "lib/util.go"), filepath.Join(contextDir, "lib/helpers.go")); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckDeepEqual(t, false, reflect.DeepEqual(before, cacheKeys(t, copyCmd("dest/", "lib"), cfg)))
+
+	// The files of COPY --parents are keyed by their path in the context
+	parents := copyCmd("/dest/", "**/*.go")
+	parents.Parents = true
+	testutil.CheckDeepEqual(t, []string{
+		"/dest/app/main.go=" + mustHash(t, hash, filepath.Join(contextDir, "app/main.go")),
+		"/dest/lib/helpers.go=" + mustHash(t, hash, filepath.Join(contextDir, "lib/helpers.go")),
+		"dest=/dest/ workdir=/src chown= chmod=",
+	}, cacheKeys(t, parents, cfg))
+}
+
+func mustHash(t *testing.T, hash func(string) (string, error), p string) string {
+	t.Helper()
+	h, err := hash(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
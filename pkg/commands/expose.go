@@ -23,8 +23,10 @@ import (
 	"github.com/chainguard-dev/kaniko/pkg/dockerfile"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 
-	"github.com/chainguard-dev/kaniko/pkg/util"
+	"github.com/docker/go-connections/nat"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/dockerfile/shell"
 	"github.com/sirupsen/logrus"
 )
 
@@ -41,30 +43,41 @@ func (r *ExposeCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.
 		existingPorts = make(map[string]struct{})
 	}
 	replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
-	// Add any new ones in
+	shlex := shell.NewLex(parser.DefaultEscapeToken)
+	var specs []string
 	for _, p := range r.cmd.Ports {
-		// Resolve any environment variables
-		p, err := util.ResolveEnvironmentReplacement(p, replacementEnvs, false)
+		// Resolve any environment variables, which may hold several ports
+		words, err := shlex.ProcessWords(p, shell.EnvsFromSlice(replacementEnvs))
 		if err != nil {
 			return err
 		}
-		// Add the default protocol if one isn't specified
-		if !strings.Contains(p, "/") {
-			p = p + "/tcp"
-		}
-		protocol := strings.Split(p, "/")[1]
-		if !validProtocol(protocol) {
-			return fmt.Errorf("invalid protocol: %s", protocol)
+		for _, w := range words {
+			// Add the default protocol if one isn't specified
+			if !strings.Contains(w, "/") {
+				w = w + "/tcp"
+			}
+			protocol := strings.Split(w, "/")[1]
+			if !validProtocol(protocol) {
+				return fmt.Errorf("invalid protocol: %s", protocol)
+			}
+			specs = append(specs, w)
 		}
+	}
+	// Expand port ranges like docker build does
+	ports, _, err := nat.ParsePortSpecs(specs)
+	if err != nil {
+		return err
+	}
+	for p := range ports {
 		logrus.Infof("Adding exposed port: %s", p)
-		existingPorts[p] = struct{}{}
+		existingPorts[string(p)] = struct{}{}
 	}
 	config.ExposedPorts = existingPorts
 	return nil
 }
 
 func validProtocol(protocol string) bool {
-	validProtocols := [2]string{"tcp", "udp"}
+	validProtocols := [3]string{"tcp", "udp", "sctp"}
 	for _, p := range validProtocols {
 		if protocol == p {
 			return true
@@ -85,3 +85,27 @@ func TestInvalidProtocol(t *testing.T) {
 	err := exposeCmd.ExecuteCommand(cfg, buildArgs)
 	testutil.CheckErrorAndDeepEqual(t, true, err, nil, nil)
 }
+
+func TestExposePortRangesAndLists(t *testing.T) {
+	cfg := &v1.Config{
+		Env: []string{
+			"PORTS=80 443/tcp",
+			"RANGE=9000-9002",
+		},
+	}
+	exposeCmd := &ExposeCommand{
+		cmd: &instructions.ExposeCommand{
+			Ports: []string{"$PORTS", "${RANGE}/udp", "5000/sctp"},
+		},
+	}
+	expectedPorts := map[string]struct{}{
+		"80/tcp":    {},
+		"443/tcp":   {},
+		"9000/udp":  {},
+		"9001/udp":  {},
+		"9002/udp":  {},
+		"5000/sctp": {},
+	}
+	err := exposeCmd.ExecuteCommand(cfg, dockerfile.NewBuildArgs([]string{}))
+	testutil.CheckErrorAndDeepEqual(t, false, err, expectedPorts, cfg.ExposedPorts)
+}
@@ -17,6 +17,8 @@ limitations under the License.
 package commands
 
 import (
+	"time"
+
 	"github.com/chainguard-dev/kaniko/pkg/dockerfile"
 	"github.com/docker/docker/api/types/container"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
@@ -39,6 +41,8 @@ type HealthCheckCommand struct {
 }
 
 // ExecuteCommand handles command processing similar to CMD and RUN,
+// The command is not expanded, like docker build does, since the shell form is
+// expanded by the shell when the container runs the check.
 func (h *HealthCheckCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
 	check := convertDockerHealthConfigToContainerRegistryFormat(*h.cmd.Health)
 	config.Healthcheck = &check
@@ -46,6 +50,12 @@ func (h *HealthCheckCommand) ExecuteCommand(config *v1.Config, buildArgs *docker
 	return nil
 }
 
+// HealthcheckStartInterval returns the interval between the checks during the
+// start period, set with --start-interval
+func (h *HealthCheckCommand) HealthcheckStartInterval() time.Duration {
+	return h.cmd.Health.StartInterval
+}
+
 // String returns some information about the command for the image config history
 func (h *HealthCheckCommand) String() string {
 	return h.cmd.String()
@@ -0,0 +1,108 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/dockerfile/shell"
+)
+
+// heredocScriptDir is the directory the heredoc scripts starting with a
+// shebang are run from, as with buildkit
+const heredocScriptDir = "/dev/pipes"
+
+// escapeToken is the escape character of the Dockerfile
+var escapeToken rune = parser.DefaultEscapeToken
+
+// SetEscapeToken sets the escape character of the Dockerfile, set with its
+// escape parser directive, for the heredocs to be expanded with it. The
+// default backslash is used when token is zero.
+func SetEscapeToken(token rune) {
+	if token == 0 {
+		token = parser.DefaultEscapeToken
+	}
+	escapeToken = token
+}
+
+// heredocCmdLine returns the command line of cmdRun with its heredocs, run as
+// buildkit runs them. A RUN instruction made of a single heredoc runs it with
+// the shell, or as an executable written in heredocScriptDir, returned as
+// well, when it starts with a shebang. The other heredocs are handed to the
+// shell along with the command, like RUN <<EOF python3.
+func heredocCmdLine(cmdRun *instructions.RunCommand) ([]string, *instructions.ShellInlineFile, error) {
+	if len(cmdRun.Files) == 0 {
+		return append([]string{}, cmdRun.CmdLine...), nil, nil
+	}
+	if len(cmdRun.CmdLine) != 1 || !cmdRun.PrependShell {
+		return nil, nil, fmt.Errorf("invalid heredoc command line %v", cmdRun.CmdLine)
+	}
+	if heredoc := parser.MustParseHeredoc(cmdRun.CmdLine[0]); heredoc != nil {
+		file := cmdRun.Files[0]
+		if file.Chomp {
+			file.Data = parser.ChompHeredocContent(file.Data)
+		}
+		if strings.HasPrefix(file.Data, "#!") {
+			return []string{path.Join(heredocScriptDir, file.Name)}, &file, nil
+		}
+		return []string{file.Data}, nil, nil
+	}
+	cmdLine := cmdRun.CmdLine[0]
+	for _, file := range cmdRun.Files {
+		data := file.Data
+		if file.Chomp {
+			data = parser.ChompHeredocContent(data)
+		}
+		cmdLine += "\n" + data + file.Name
+	}
+	return []string{cmdLine}, nil, nil
+}
+
+// runCommandString returns the source of cmdRun followed by its heredocs, for
+// their contents to be part of its cache key.
+func runCommandString(cmdRun *instructions.RunCommand) string {
+	s := cmdRun.String()
+	for _, file := range cmdRun.Files {
+		s += "\n" + file.Data + file.Name
+	}
+	return s
+}
+
+// copyCommandString returns the source of cmd followed by its heredocs, for
+// their contents to be part of its cache key.
+func copyCommandString(cmd *instructions.CopyCommand) string {
+	s := cmd.String()
+	for _, content := range cmd.SourceContents {
+		s += "\n" + content.Data + content.Path
+	}
+	return s
+}
+
+// expandHeredoc replaces the variables of the content of an unquoted heredoc
+// with their values in envs, as buildkit does: the escaped \$ are kept, and
+// the quotes are left as they are. The escape character is the one of the
+// Dockerfile.
+func expandHeredoc(data string, envs []string) (string, error) {
+	shlex := shell.NewLex(escapeToken)
+	shlex.SkipProcessQuotes = true
+	data, _, err := shlex.ProcessWord(data, shell.EnvsFromSlice(envs))
+	return data, err
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/dockerfile"
+	"github.com/chainguard-dev/kaniko/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+func parseInstruction(t *testing.T, source string) interface{} {
+	t.Helper()
+	res, err := parser.Parse(strings.NewReader(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := instructions.ParseInstruction(res.AST.Children[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func Test_heredocCmdLine(t *testing.T) {
+	tests := []struct {
+		name       string
+		source     string
+		cmdLine    []string
+		scriptName string
+	}{
+		{
+			name:    "no heredoc",
+			source:  "RUN echo hi",
+			cmdLine: []string{"echo hi"},
+		},
+		{
+			name:    "script",
+			source:  "RUN <<EOF\napt-get update\napt-get install -y curl\nEOF\n",
+			cmdLine: []string{"apt-get update\napt-get install -y curl\n"},
+		},
+		{
+			name:    "chomped script",
+			source:  "RUN <<-EOF\n\techo hi\nEOF\n",
+			cmdLine: []string{"echo hi\n"},
+		},
+		{
+			name:       "shebang",
+			source:     "RUN <<EOF\n#!/usr/bin/env python3\nprint('hi')\nEOF\n",
+			cmdLine:    []string{"/dev/pipes/EOF"},
+			scriptName: "EOF",
+		},
+		{
+			name:    "interpreter",
+			source:  "RUN <<EOF python3\nprint('hi')\nEOF\n",
+			cmdLine: []string{"<<EOF python3\nprint('hi')\nEOF"},
+		},
+		{
+			name:    "several heredocs",
+			source:  "RUN cat <<A && cat <<B\na\nA\nb\nB\n",
+			cmdLine: []string{"cat <<A && cat <<B\na\nA\nb\nB"},
+		},
+		{
+			name:    "several chomped heredocs",
+			source:  "RUN cat <<-A && cat <<-B\n\ta\n\tA\n\t\tb\nB\n",
+			cmdLine: []string{"cat <<-A && cat <<-B\na\nA\nb\nB"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmdLine, script, err := heredocCmdLine(parseInstruction(t, test.source).(*instructions.RunCommand))
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, test.cmdLine, cmdLine)
+			name := ""
+			if script != nil {
+				name = script.Name
+			}
+			testutil.CheckDeepEqual(t, test.scriptName, name)
+		})
+	}
+}
+
+func TestRunCommand_String_heredoc(t *testing.T) {
+	// The heredocs are part of the cache key
+	first := &RunCommand{cmd: parseInstruction(t, "RUN <<EOF\necho one\nEOF\n").(*instructions.RunCommand)}
+	second := &RunCommand{cmd: parseInstruction(t, "RUN <<EOF\necho two\nEOF\n").(*instructions.RunCommand)}
+	if first.String() == second.String() {
+		t.Errorf("expected the heredocs to be part of %q", first.String())
+	}
+}
+
+func Test_expandHeredoc(t *testing.T) {
+	envs := []string{"NAME=app", "EMPTY="}
+	for _, tt := range []struct {
+		data string
+		want string
+	}{
+		{data: "name=$NAME\n", want: "name=app\n"},
+		{data: "name=${NAME}-${MISSING:-default}\n", want: "name=app-default\n"},
+		{data: "echo \\$HOME $NAME\n", want: "echo $HOME app\n"},
+		{data: "echo \"$NAME\" '$NAME' ${EMPTY}\n", want: "echo \"app\" 'app' \n"},
+	} {
+		got, err := expandHeredoc(tt.data, envs)
+		testutil.CheckNoError(t, err)
+		testutil.CheckDeepEqual(t, tt.want, got)
+	}
+
+	// The escape character set with the escape directive is honored
+	SetEscapeToken('`')
+	defer SetEscapeToken(0)
+	got, err := expandHeredoc("copy C:\\app `$HOME $NAME\n", envs)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, "copy C:\\app $HOME app\n", got)
+}
+
+func TestCopyCommand_heredoc(t *testing.T) {
+	root := t.TempDir()
+	cmd := &CopyCommand{
+		cmd: parseInstruction(t, "COPY --chmod=0755 <<run.sh <<'config' app/\necho $GREETING\nrun.sh\nname=$NAME\nconfig\n").(*instructions.CopyCommand),
+	}
+	cfg := &v1.Config{WorkingDir: root, Env: []string{"GREETING=hello", "NAME=app"}}
+	testutil.CheckNoError(t, cmd.ExecuteCommand(cfg, dockerfile.NewBuildArgs(nil)))
+
+	testutil.CheckDeepEqual(t, []string{filepath.Join(root, "app", "run.sh"), filepath.Join(root, "app", "config")}, cmd.FilesToSnapshot())
+	for file, want := range map[string]string{"run.sh": "echo hello\n", "config": "name=$NAME\n"} {
+		b, err := os.ReadFile(filepath.Join(root, "app", file))
+		testutil.CheckNoError(t, err)
+		testutil.CheckDeepEqual(t, want, string(b))
+	}
+	fi, err := os.Stat(filepath.Join(root, "app", "run.sh"))
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, os.FileMode(0o755), fi.Mode().Perm())
+
+	files, err := cmd.FilesUsedFromContext(cfg, dockerfile.NewBuildArgs(nil))
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 0, len(files))
+
+	// The heredocs of several sources are copied to a directory
+	cmd = &CopyCommand{cmd: parseInstruction(t, "COPY <<a <<b /file\na\na\nb\nb\n").(*instructions.CopyCommand)}
+	testutil.CheckError(t, true, cmd.ExecuteCommand(cfg, dockerfile.NewBuildArgs(nil)))
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"strings"
+)
+
+// NormalizedCacheKey returns the form of a RUN command its cached layer is
+// keyed on with --normalize-run-cache-keys: the instruction in upper case,
+// the shell comments removed and the whitespace outside of quotes collapsed,
+// so that reformatted Dockerfiles share the cached layers. The other commands,
+// and the RUN commands with here-documents whose whitespace is significant,
+// are returned as is.
+func NormalizedCacheKey(cmd DockerCommand) string {
+	s := cmd.String()
+	switch cmd.(type) {
+	case *RunCommand, *RunMarkerCommand:
+	default:
+		return s
+	}
+	if strings.Contains(s, "<<") {
+		return s
+	}
+	instruction, rest, _ := strings.Cut(strings.TrimSpace(s), " ")
+	return strings.ToUpper(instruction) + " " + normalizeShell(rest)
+}
+
+// normalizeShell removes the comments of the shell command s and collapses its
+// whitespace outside of quotes.
+func normalizeShell(s string) string {
+	var b strings.Builder
+	var quote rune
+	space, escaped, comment := false, false, false
+	for _, r := range s {
+		switch {
+		case comment:
+			if r == '\n' {
+				comment = false
+				space = true
+			}
+			continue
+		case escaped:
+			escaped = false
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else if r == '\\' && quote == '"' {
+				escaped = true
+			}
+		case r == '\\':
+			escaped = true
+		case r == '\'' || r == '"':
+			quote = r
+		case r == ' ' || r == '\t' || r == '\n':
+			space = true
+			continue
+		case r == '#' && (space || b.Len() == 0):
+			comment = true
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
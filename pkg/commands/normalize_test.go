@@ -0,0 +1,68 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/dockerfile"
+	"github.com/chainguard-dev/kaniko/pkg/util"
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestNormalizedCacheKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		dockerfile string
+		want       string
+	}{
+		{
+			name:       "whitespace",
+			dockerfile: "run   apt-get update \\\n    &&  apt-get install -y curl",
+			want:       "RUN apt-get update && apt-get install -y curl",
+		},
+		{
+			name:       "comment lines and trailing comments",
+			dockerfile: "RUN make \\\n# build the binaries\n  install # and install them",
+			want:       "RUN make install",
+		},
+		{
+			name:       "quotes",
+			dockerfile: `RUN echo "a   #b"  'c   d' e\  f g#h`,
+			want:       `RUN echo "a   #b" 'c   d' e\  f g#h`,
+		},
+		{
+			name:       "here-documents",
+			dockerfile: "RUN  <<EOF\n  indented\nEOF",
+			want:       "RUN  <<EOF\n  indented\nEOF",
+		},
+		{
+			name:       "other commands",
+			dockerfile: "LABEL  a=b",
+			want:       "LABEL  a=b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmds, err := dockerfile.ParseCommands([]string{tt.dockerfile})
+			testutil.CheckNoError(t, err)
+			cmd, err := GetCommand(cmds[0], util.FileContext{}, false, false, true)
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, tt.want, NormalizedCacheKey(cmd))
+		})
+	}
+}
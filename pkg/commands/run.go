@@ -17,15 +17,19 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"syscall"
 
 	kConfig "github.com/chainguard-dev/kaniko/pkg/config"
 	"github.com/chainguard-dev/kaniko/pkg/constants"
 	"github.com/chainguard-dev/kaniko/pkg/dockerfile"
+	"github.com/chainguard-dev/kaniko/pkg/hermetic"
+	"github.com/chainguard-dev/kaniko/pkg/isolation"
 	"github.com/chainguard-dev/kaniko/pkg/util"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
@@ -35,8 +39,11 @@ import (
 
 type RunCommand struct {
 	BaseCommand
-	cmd      *instructions.RunCommand
-	shdCache bool
+	cmd         *instructions.RunCommand
+	fileContext util.FileContext
+	shdCache    bool
+	// destinations are the network destinations the command connected to
+	destinations []string
 }
 
 // for testing
@@ -44,15 +51,56 @@ var (
 	userLookup = util.LookupUser
 )
 
+// killWhenDone kills the process group pgid once ctx is done, like when the
+// build is canceled or the duration budget of the stage has run out. The
+// returned function stops it, and reports whether the group was killed.
+func killWhenDone(ctx context.Context, pgid int) func() bool {
+	killed := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		logrus.Warnf("Killing the running command: %v", context.Cause(ctx))
+		syscall.Kill(-pgid, syscall.SIGKILL)
+		close(killed)
+	})
+	return func() bool {
+		if stop() {
+			return false
+		}
+		<-killed
+		return true
+	}
+}
+
 func (r *RunCommand) IsArgsEnvsRequiredInCache() bool {
 	return true
 }
 
 func (r *RunCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
-	return runCommandInExec(config, buildArgs, r.cmd)
+	return r.ExecuteCommandContext(context.Background(), config, buildArgs)
+}
+
+// ExecuteCommandContext runs the command, killing it once ctx is done
+func (r *RunCommand) ExecuteCommandContext(ctx context.Context, config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
+	return runCommandInExec(ctx, config, buildArgs, r.cmd, r.fileContext.Root, &r.destinations)
+}
+
+// NetworkDestinations returns the network destinations the command connected
+// to, when they are recorded
+func (r *RunCommand) NetworkDestinations() []string {
+	return r.destinations
+}
+
+// MountSources returns the sources of the bind mounts of the command
+func (r *RunCommand) MountSources(config *v1.Config, buildArgs *dockerfile.BuildArgs) ([]string, error) {
+	return bindSources(r.cmd, buildArgs.ReplacementEnvs(config.Env), r.fileContext.Root)
 }
 
-func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun *instructions.RunCommand) error {
+// runCommandInExec runs cmdRun until ctx is done, and sets destinations to the
+// network destinations it connected to, when they are recorded
+func runCommandInExec(ctx context.Context, config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun *instructions.RunCommand, buildContext string, destinations *[]string) (err error) {
+	cmdLine, script, err := heredocCmdLine(cmdRun)
+	if err != nil {
+		return err
+	}
 	var newCommand []string
 	if cmdRun.PrependShell {
 		// This is the default shell on Linux
@@ -63,9 +111,9 @@ func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun
 			shell = append(shell, "/bin/sh", "-c")
 		}
 
-		newCommand = append(shell, strings.Join(cmdRun.CmdLine, " "))
+		newCommand = append(shell, strings.Join(cmdLine, " "))
 	} else {
-		newCommand = cmdRun.CmdLine
+		newCommand = cmdLine
 		// Find and set absolute path of executable by setting PATH temporary
 		replacementEnvs := buildArgs.ReplacementEnvs(config.Env)
 		for _, v := range replacementEnvs {
@@ -113,10 +161,30 @@ func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun
 	if err != nil {
 		return errors.Wrap(err, "adding default HOME variable")
 	}
-
 	cmd.Env = env
 
+	// The mounts are removed before the filesystem is snapshotted, so that
+	// the secrets never end up in a layer
+	mounts, mountEnv, err := setupRunMounts(cmdRun, replacementEnvs, buildContext)
+	defer func() {
+		if cerr := mounts.cleanup(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	if err != nil {
+		return errors.Wrap(err, "setting up mounts")
+	}
+	cmd.Env = append(cmd.Env, mountEnv...)
+	if script != nil {
+		if err := mounts.writeFile(filepath.Join(kConfig.RootDir, heredocScriptDir, script.Name), []byte(script.Data), 0o755, 0, 0); err != nil {
+			return errors.Wrap(err, "writing heredoc script")
+		}
+	}
+
 	logrus.Infof("Running: %s", cmd.Args)
+	if cmd, err = isolation.Command(cmd, dockerfile.RunNetwork(cmdRun)); err != nil {
+		return err
+	}
 	if err := cmd.Start(); err != nil {
 		return errors.Wrap(err, "starting command")
 	}
@@ -125,9 +193,20 @@ func runCommandInExec(config *v1.Config, buildArgs *dockerfile.BuildArgs, cmdRun
 	if err != nil {
 		return errors.Wrap(err, "getting group id for process")
 	}
-	if err := cmd.Wait(); err != nil {
+	monitor := hermetic.Watch(pgid)
+	stop := killWhenDone(ctx, pgid)
+	err = cmd.Wait()
+	if stop() {
+		return errors.Wrapf(context.Cause(ctx), "killed %s", cmdRun.String())
+	}
+	if err != nil {
+		monitor.Check(cmdRun.String())
 		return errors.Wrap(err, "waiting for process to exit")
 	}
+	if err := monitor.Check(cmdRun.String()); err != nil {
+		return err
+	}
+	*destinations = monitor.Destinations()
 
 	//it's not an error if there are no grandchildren
 	if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil && err.Error() != "no such process" {
@@ -162,7 +241,7 @@ func addDefaultHOME(u string, envs []string) ([]string, error) {
 
 // String returns some information about the command for the image config
 func (r *RunCommand) String() string {
-	return r.cmd.String()
+	return runCommandString(r.cmd)
 }
 
 func (r *RunCommand) FilesToSnapshot() []string {
@@ -177,9 +256,10 @@ func (r *RunCommand) ProvidesFilesToSnapshot() bool {
 func (r *RunCommand) CacheCommand(img v1.Image) DockerCommand {
 
 	return &CachingRunCommand{
-		img:       img,
-		cmd:       r.cmd,
-		extractFn: util.ExtractFile,
+		img:         img,
+		cmd:         r.cmd,
+		fileContext: r.fileContext,
+		extractFn:   util.ExtractFile,
 	}
 }
 
@@ -201,6 +281,7 @@ type CachingRunCommand struct {
 	img            v1.Image
 	extractedFiles []string
 	cmd            *instructions.RunCommand
+	fileContext    util.FileContext
 	extractFn      util.ExtractFunction
 }
 
@@ -210,26 +291,14 @@ func (cr *CachingRunCommand) IsArgsEnvsRequiredInCache() bool {
 
 func (cr *CachingRunCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
 	logrus.Infof("Found cached layer, extracting to filesystem")
-	var err error
-
-	if cr.img == nil {
-		return errors.New(fmt.Sprintf("command image is nil %v", cr.String()))
-	}
-
-	layers, err := cr.img.Layers()
-	if err != nil {
-		return errors.Wrap(err, "retrieving image layers")
-	}
-
-	if len(layers) != 1 {
-		return errors.New(fmt.Sprintf("expected %d layers but got %d", 1, len(layers)))
+	if err := cr.LoadLayer(); err != nil {
+		return err
 	}
 
-	cr.layer = layers[0]
-
+	var err error
 	cr.extractedFiles, err = util.GetFSFromLayers(
 		kConfig.RootDir,
-		layers,
+		[]v1.Layer{cr.layer},
 		util.ExtractFunc(cr.extractFn),
 		util.IncludeWhiteout(),
 	)
@@ -240,6 +309,16 @@ func (cr *CachingRunCommand) ExecuteCommand(config *v1.Config, buildArgs *docker
 	return nil
 }
 
+// MountSources returns the sources of the bind mounts of the command, for its
+// cache key to match the one of the command it was cached from
+func (cr *CachingRunCommand) MountSources(config *v1.Config, buildArgs *dockerfile.BuildArgs) ([]string, error) {
+	return bindSources(cr.cmd, buildArgs.ReplacementEnvs(config.Env), cr.fileContext.Root)
+}
+
+func (cr *CachingRunCommand) LoadLayer() error {
+	return cr.load(cr.img, cr.String())
+}
+
 func (cr *CachingRunCommand) FilesToSnapshot() []string {
 	f := cr.extractedFiles
 	logrus.Debugf("%d files extracted by caching run command", len(f))
@@ -252,7 +331,7 @@ func (cr *CachingRunCommand) String() string {
 	if cr.cmd == nil {
 		return "nil command"
 	}
-	return cr.cmd.String()
+	return runCommandString(cr.cmd)
 }
 
 func (cr *CachingRunCommand) MetadataOnly() bool {
@@ -17,6 +17,7 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"os"
 
 	"github.com/chainguard-dev/kaniko/pkg/dockerfile"
@@ -28,16 +29,24 @@ import (
 
 type RunMarkerCommand struct {
 	BaseCommand
-	cmd      *instructions.RunCommand
-	Files    []string
-	shdCache bool
+	cmd         *instructions.RunCommand
+	fileContext util.FileContext
+	Files       []string
+	shdCache    bool
+	// destinations are the network destinations the command connected to
+	destinations []string
 }
 
 func (r *RunMarkerCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
+	return r.ExecuteCommandContext(context.Background(), config, buildArgs)
+}
+
+// ExecuteCommandContext runs the command, killing it once ctx is done
+func (r *RunMarkerCommand) ExecuteCommandContext(ctx context.Context, config *v1.Config, buildArgs *dockerfile.BuildArgs) error {
 	// run command `touch filemarker`
 	logrus.Debugf("Using new RunMarker command")
 	prevFilesMap, _ := util.GetFSInfoMap("/", map[string]os.FileInfo{})
-	if err := runCommandInExec(config, buildArgs, r.cmd); err != nil {
+	if err := runCommandInExec(ctx, config, buildArgs, r.cmd, r.fileContext.Root, &r.destinations); err != nil {
 		return err
 	}
 	_, r.Files = util.GetFSInfoMap("/", prevFilesMap)
@@ -46,9 +55,20 @@ func (r *RunMarkerCommand) ExecuteCommand(config *v1.Config, buildArgs *dockerfi
 	return nil
 }
 
+// NetworkDestinations returns the network destinations the command connected
+// to, when they are recorded
+func (r *RunMarkerCommand) NetworkDestinations() []string {
+	return r.destinations
+}
+
+// MountSources returns the sources of the bind mounts of the command
+func (r *RunMarkerCommand) MountSources(config *v1.Config, buildArgs *dockerfile.BuildArgs) ([]string, error) {
+	return bindSources(r.cmd, buildArgs.ReplacementEnvs(config.Env), r.fileContext.Root)
+}
+
 // String returns some information about the command for the image config
 func (r *RunMarkerCommand) String() string {
-	return r.cmd.String()
+	return runCommandString(r.cmd)
 }
 
 func (r *RunMarkerCommand) FilesToSnapshot() []string {
@@ -67,9 +87,10 @@ func (r *RunMarkerCommand) IsArgsEnvsRequiredInCache() bool {
 func (r *RunMarkerCommand) CacheCommand(img v1.Image) DockerCommand {
 
 	return &CachingRunCommand{
-		img:       img,
-		cmd:       r.cmd,
-		extractFn: util.ExtractFile,
+		img:         img,
+		cmd:         r.cmd,
+		fileContext: r.fileContext,
+		extractFn:   util.ExtractFile,
 	}
 }
 
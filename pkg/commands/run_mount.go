@@ -0,0 +1,800 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	kConfig "github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/dockerfile"
+	"github.com/chainguard-dev/kaniko/pkg/util"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// secretsDir is the directory the secrets are mounted in by default
+const secretsDir = "/run/secrets"
+
+// cacheMountDir is the directory holding the persistent directories of the
+// cache mounts, by id
+var cacheMountDir string
+
+// SetCacheMountDir sets the directory holding the persistent directories of
+// RUN --mount=type=cache, by default in the kaniko directory.
+func SetCacheMountDir(dir string) {
+	cacheMountDir = dir
+}
+
+func cacheMountRoot() string {
+	if cacheMountDir != "" {
+		return cacheMountDir
+	}
+	return filepath.Join(kConfig.KanikoDir, "cache-mounts")
+}
+
+// secretSource is where the value of a secret is read from, a file or an
+// environment variable of the executor
+type secretSource struct {
+	path string
+	env  string
+}
+
+// secrets are the secrets set with --secret, by id
+var secrets = map[string]secretSource{}
+
+// SetSecrets sets the secrets RUN --mount=type=secret mounts, each given as
+// id=<id>,src=<path> or id=<id>,env=<variable>. A secret given with its id
+// alone is read from the environment variable of that name.
+func SetSecrets(specs []string) error {
+	parsed := map[string]secretSource{}
+	for _, spec := range specs {
+		var id string
+		var s secretSource
+		for _, field := range strings.Split(spec, ",") {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				return fmt.Errorf("invalid secret %q, expected id=<id>,src=<path> or id=<id>,env=<variable>", spec)
+			}
+			switch strings.ToLower(key) {
+			case "id":
+				id = value
+			case "src", "source":
+				s.path = value
+			case "env":
+				s.env = value
+			case "type":
+				if value != "file" && value != "env" {
+					return fmt.Errorf("invalid type %q of secret %q, must be file or env", value, spec)
+				}
+			default:
+				return fmt.Errorf("unknown field %q of secret %q", key, spec)
+			}
+		}
+		if id == "" {
+			return fmt.Errorf("secret %q has no id", spec)
+		}
+		if s.path == "" && s.env == "" {
+			s.env = id
+		}
+		parsed[id] = s
+	}
+	secrets = parsed
+	return nil
+}
+
+// secretValue returns the value of the secret id, and false if it is not set
+func secretValue(id string) ([]byte, bool, error) {
+	s, ok := secrets[id]
+	if !ok {
+		return nil, false, nil
+	}
+	if s.path != "" {
+		b, err := os.ReadFile(s.path)
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "reading secret %s", id)
+		}
+		return b, true, nil
+	}
+	v, ok := os.LookupEnv(s.env)
+	return []byte(v), ok, nil
+}
+
+// sshAgents are the SSH agent sockets set with --ssh, by id
+var sshAgents = map[string]string{}
+
+// SetSSH sets the SSH agent sockets RUN --mount=type=ssh forwards, each given
+// as <id>=<socket>, or as <id> alone for the socket of SSH_AUTH_SOCK. The
+// sockets are masked from the snapshots.
+func SetSSH(specs []string) error {
+	parsed := map[string]string{}
+	for _, spec := range specs {
+		id, socket, ok := strings.Cut(spec, "=")
+		if !ok {
+			socket = os.Getenv("SSH_AUTH_SOCK")
+			if socket == "" {
+				return fmt.Errorf("ssh agent %s has no socket and SSH_AUTH_SOCK is not set", id)
+			}
+		}
+		fi, err := os.Stat(socket)
+		if err != nil {
+			return errors.Wrapf(err, "ssh agent %s", id)
+		}
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("ssh agent %s: %s is not a socket, only agent sockets are supported", id, socket)
+		}
+		parsed[id] = socket
+		util.AddToDefaultIgnoreList(util.IgnoreListEntry{Path: socket})
+	}
+	sshAgents = parsed
+	return nil
+}
+
+// runMounts are the files and directories mounted for a RUN command, removed
+// once it exits and before the filesystem is snapshotted
+type runMounts struct {
+	// files are the files written, and dirs the directories created, in order
+	files []string
+	dirs  []string
+	// backups are the files moved aside by the mounts, by path
+	backups map[string]string
+	// caches are the persistent directories of the cache mounts, by target
+	caches []cacheMount
+	// listeners are the sockets forwarding to the SSH agents
+	listeners []net.Listener
+	// binds are the targets of the bind mounts, and copies the ones copied
+	binds  []string
+	copies []string
+}
+
+// cacheMount is a persistent directory moved, or linked, to its target
+type cacheMount struct {
+	dir    string
+	target string
+	linked bool
+	// lock is the lock held on the directory while it is mounted
+	lock *os.File
+	// temporary is true for a directory created for this command only, the
+	// persistent one being used by another build
+	temporary bool
+}
+
+// stageIndexes are the indexes of the stages of the build, by name
+var stageIndexes = map[string]string{}
+
+// SetStageIndexes sets the indexes of the stages of the build by name, for
+// RUN --mount=type=bind,from=<stage> to find the files saved from them.
+func SetStageIndexes(indexes map[string]string) {
+	stageIndexes = indexes
+}
+
+// setupRunMounts sets up the mounts of cmdRun, whose options are expanded
+// with envs, the bind mounts without from being from the build context, and
+// returns the environment variables they set.
+func setupRunMounts(cmdRun *instructions.RunCommand, envs []string, buildContext string) (*runMounts, []string, error) {
+	m := &runMounts{backups: map[string]string{}}
+	mounts, err := dockerfile.RunMounts(cmdRun, envs)
+	if err != nil {
+		return m, nil, err
+	}
+	var env []string
+	for _, mount := range mounts {
+		switch mount.Type {
+		case instructions.MountTypeBind:
+			if err := m.mountBind(mount, buildContext); err != nil {
+				return m, nil, err
+			}
+		case instructions.MountTypeSecret:
+			e, err := m.mountSecret(mount)
+			if err != nil {
+				return m, nil, err
+			}
+			env = append(env, e...)
+		case instructions.MountTypeCache:
+			if err := m.mountCache(mount); err != nil {
+				return m, nil, err
+			}
+		case instructions.MountTypeTmpfs:
+			if err := m.mountTmpfs(mount); err != nil {
+				return m, nil, err
+			}
+		case instructions.MountTypeSSH:
+			e, err := m.mountSSH(mount)
+			if err != nil {
+				return m, nil, err
+			}
+			env = append(env, e...)
+		}
+	}
+	return m, env, nil
+}
+
+// mountSecret writes the secret of mount at its target, by default
+// /run/secrets/<id>, and returns the environment variable it sets if any.
+func (m *runMounts) mountSecret(mount *instructions.Mount) ([]string, error) {
+	id := mount.CacheID
+	if id == "" {
+		id = mount.Source
+	}
+	if id == "" {
+		id = filepath.Base(mount.Target)
+	}
+	value, ok, err := secretValue(id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if mount.Required {
+			return nil, fmt.Errorf("secret %s is required but not set with --secret", id)
+		}
+		logrus.Debugf("Skipping secret %s, it is not set with --secret", id)
+		return nil, nil
+	}
+
+	var env []string
+	if mount.Env != nil {
+		name := *mount.Env
+		if name == "" {
+			name = id
+		}
+		env = append(env, name+"="+string(value))
+		if mount.Target == "" {
+			return env, nil
+		}
+	}
+	target := mount.Target
+	if target == "" {
+		target = filepath.Join(secretsDir, id)
+	}
+	mode := os.FileMode(0o400)
+	if mount.Mode != nil {
+		mode = os.FileMode(*mount.Mode)
+	}
+	uid, gid := 0, 0
+	if mount.UID != nil {
+		uid = int(*mount.UID)
+	}
+	if mount.GID != nil {
+		gid = int(*mount.GID)
+	}
+	return env, m.writeFile(filepath.Join(kConfig.RootDir, target), value, mode, uid, gid)
+}
+
+// mountCache backs the target of mount with the persistent directory of its
+// id, by default its target, moving the directory to the target or, across
+// filesystems, linking the target to it. The directory is locked while it is
+// mounted, for concurrent builds sharing it not to move it at the same time:
+// with sharing=locked the command waits for the other builds to release it,
+// otherwise it runs with an empty directory of its own.
+func (m *runMounts) mountCache(mount *instructions.Mount) error {
+	if mount.From != "" {
+		return fmt.Errorf("cache mounts from %s are not supported", mount.From)
+	}
+	id := mount.CacheID
+	if id == "" {
+		id = mount.Target
+	}
+	root := cacheMountRoot()
+	c := cacheMount{dir: filepath.Join(root, url.PathEscape(id))}
+	lock, locked, err := lockCacheDir(root, id, mount.CacheSharing == instructions.MountSharingLocked)
+	if err != nil {
+		return err
+	}
+	c.lock = lock
+	mounted := false
+	defer func() {
+		if !mounted {
+			lock.Close()
+		}
+	}()
+	if !locked {
+		logrus.Infof("Cache %s is in use by another build, using an empty directory", id)
+		tmp, err := os.MkdirTemp(filepath.Join(root, cacheLocksDir), "private-")
+		if err != nil {
+			return errors.Wrapf(err, "creating private cache directory for %s", id)
+		}
+		c.dir, c.temporary = tmp, true
+	}
+	if err := createCacheDir(c.dir, mount, c.temporary); err != nil {
+		return err
+	}
+
+	c.target = filepath.Join(kConfig.RootDir, mount.Target)
+	if err := m.mkdirAll(filepath.Dir(c.target)); err != nil {
+		return err
+	}
+	if err := m.moveAside(c.target); err != nil {
+		return err
+	}
+	if err := os.Rename(c.dir, c.target); err != nil {
+		if !errors.Is(err, syscall.EXDEV) {
+			return errors.Wrapf(err, "mounting cache %s", id)
+		}
+		if err := os.Symlink(c.dir, c.target); err != nil {
+			return errors.Wrapf(err, "mounting cache %s", id)
+		}
+		c.linked = true
+	}
+	m.caches = append(m.caches, c)
+	mounted = true
+	return nil
+}
+
+// cacheLocksDir is the directory of the cache mount root holding the locks of
+// the caches and their private directories
+const cacheLocksDir = ".locks"
+
+// lockCacheDir takes an exclusive lock on the cache directory of id, waiting
+// for it if wait is true, and returns the lock file and whether it was taken.
+func lockCacheDir(root, id string, wait bool) (*os.File, bool, error) {
+	dir := filepath.Join(root, cacheLocksDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, false, errors.Wrapf(err, "creating cache lock directory %s", dir)
+	}
+	path := filepath.Join(dir, url.PathEscape(id)+".lock")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "opening cache lock %s", path)
+	}
+	how := unix.LOCK_EX
+	if !wait {
+		how |= unix.LOCK_NB
+	} else {
+		logrus.Debugf("Waiting for the lock of cache %s", id)
+	}
+	for {
+		err = unix.Flock(int(f.Fd()), how)
+		if !errors.Is(err, unix.EINTR) {
+			break
+		}
+	}
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return f, false, nil
+	} else if err != nil {
+		f.Close()
+		return nil, false, errors.Wrapf(err, "locking cache %s", id)
+	}
+	return f, true, nil
+}
+
+// createCacheDir creates the cache directory dir, with the mode and owner of
+// mount, unless it exists and is not new
+func createCacheDir(dir string, mount *instructions.Mount, created bool) error {
+	if _, err := os.Lstat(dir); !created && !os.IsNotExist(err) {
+		return nil
+	}
+	mode := os.FileMode(0o755)
+	if mount.Mode != nil {
+		mode = os.FileMode(*mount.Mode)
+	}
+	if err := os.MkdirAll(dir, mode); err != nil {
+		return errors.Wrapf(err, "creating cache directory %s", dir)
+	}
+	if err := os.Chmod(dir, mode); err != nil {
+		return err
+	}
+	uid, gid := 0, 0
+	if mount.UID != nil {
+		uid = int(*mount.UID)
+	}
+	if mount.GID != nil {
+		gid = int(*mount.GID)
+	}
+	if err := os.Chown(dir, uid, gid); err != nil && os.Geteuid() == 0 {
+		return err
+	}
+	return nil
+}
+
+// bindSource returns the path of the source of the bind mount, in the build
+// context or in the files saved from a stage or an image, the whole filesystem
+// of which is mounted when the source is not set
+func bindSource(mount *instructions.Mount, buildContext string) string {
+	root := buildContext
+	if mount.From != "" {
+		from := mount.From
+		if i, ok := stageIndexes[strings.ToLower(from)]; ok {
+			from = i
+		}
+		root = filepath.Join(kConfig.StagingDir(), from)
+	}
+	return filepath.Join(root, filepath.Clean("/"+mount.Source))
+}
+
+// bindSources returns the paths of the sources of the bind mounts of cmdRun,
+// whose options are expanded with envs
+func bindSources(cmdRun *instructions.RunCommand, envs []string, buildContext string) ([]string, error) {
+	mounts, err := dockerfile.RunMounts(cmdRun, envs)
+	if err != nil {
+		return nil, err
+	}
+	var sources []string
+	for _, mount := range mounts {
+		if mount.Type == instructions.MountTypeBind {
+			sources = append(sources, bindSource(mount, buildContext))
+		}
+	}
+	return sources, nil
+}
+
+// mountBind makes the files at the source of mount, in the build context or
+// in the files saved from a stage or an image, visible at its target with a
+// read-only bind mount when permitted, or with a copy otherwise, so that they
+// are never snapshotted.
+func (m *runMounts) mountBind(mount *instructions.Mount, buildContext string) error {
+	src := bindSource(mount, buildContext)
+	fi, err := os.Stat(src)
+	if err != nil {
+		return errors.Wrapf(err, "bind mount source %s", mount.Source)
+	}
+
+	target := filepath.Join(kConfig.RootDir, mount.Target)
+	_, err = os.Lstat(target)
+	missing := os.IsNotExist(err)
+	if err := m.mkdirAll(filepath.Dir(target)); err != nil {
+		return err
+	}
+	// Writes to the mount are discarded, so only read-only mounts are bound,
+	// when permitted, and the others are copied and removed along with their
+	// changes once the command exits
+	if mount.ReadOnly {
+		if missing {
+			if fi.IsDir() {
+				err = m.mkdirAll(target)
+			} else {
+				err = m.writeFile(target, nil, 0o644, 0, 0)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		flags := uintptr(unix.MS_BIND | unix.MS_REC)
+		err := unix.Mount(src, target, "", flags, "")
+		if err == nil {
+			m.binds = append(m.binds, target)
+			return unix.Mount("", target, "", flags|unix.MS_REMOUNT|unix.MS_RDONLY, "")
+		}
+		if !errors.Is(err, unix.EPERM) {
+			return errors.Wrapf(err, "bind mounting %s", mount.Source)
+		}
+		logrus.Debugf("Unable to bind mount %s, copying it", mount.Source)
+		if missing {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+	}
+	if err := m.moveAside(target); err != nil {
+		return err
+	}
+	m.copies = append(m.copies, target)
+	return copyTree(src, target)
+}
+
+// mountTmpfs mounts an empty tmpfs at the target of mount, hiding the files
+// there while the command runs, so that the scratch files written to it are
+// never snapshotted. Without the permission to mount, the target is an empty
+// directory instead, removed once the command exits.
+func (m *runMounts) mountTmpfs(mount *instructions.Mount) error {
+	target := filepath.Join(kConfig.RootDir, mount.Target)
+	if err := m.mkdirAll(target); err != nil {
+		return err
+	}
+	data := "mode=1777"
+	if mount.SizeLimit > 0 {
+		data += fmt.Sprintf(",size=%d", mount.SizeLimit)
+	}
+	err := unix.Mount("tmpfs", target, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, data)
+	if err == nil {
+		m.binds = append(m.binds, target)
+		return nil
+	}
+	if !errors.Is(err, unix.EPERM) {
+		return errors.Wrapf(err, "mounting tmpfs at %s", mount.Target)
+	}
+	logrus.Debugf("Unable to mount a tmpfs at %s, using an empty directory", mount.Target)
+	if err := m.moveAside(target); err != nil {
+		return err
+	}
+	m.copies = append(m.copies, target)
+	if err := os.Mkdir(target, 0o777); err != nil {
+		return err
+	}
+	return os.Chmod(target, 0o777|os.ModeSticky)
+}
+
+// copyTree copies the file or directory src to dst, with the modes, owners and
+// symbolic links of its files.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		to := filepath.Join(dst, rel)
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.IsDir():
+			err = os.Mkdir(to, fi.Mode().Perm())
+		case fi.Mode()&os.ModeSymlink != 0:
+			var link string
+			if link, err = os.Readlink(path); err == nil {
+				err = os.Symlink(link, to)
+			}
+		default:
+			err = copyFile(path, to, fi.Mode().Perm())
+		}
+		if err != nil {
+			return err
+		}
+		// The modes are set past the umask
+		if fi.Mode()&os.ModeSymlink == 0 {
+			if err := os.Chmod(to, fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+				return err
+			}
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			if err := os.Lchown(to, int(st.Uid), int(st.Gid)); err != nil && os.Geteuid() == 0 {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// mountSSH forwards a socket at the target of mount, by default
+// /run/buildkit/ssh_agent.<n>, to the SSH agent of its id, and returns the
+// SSH_AUTH_SOCK variable pointing to it.
+func (m *runMounts) mountSSH(mount *instructions.Mount) ([]string, error) {
+	id := mount.CacheID
+	if id == "" {
+		id = "default"
+	}
+	agent, ok := sshAgents[id]
+	if !ok {
+		if mount.Required {
+			return nil, fmt.Errorf("ssh agent %s is required but not set with --ssh", id)
+		}
+		logrus.Debugf("Skipping ssh agent %s, it is not set with --ssh", id)
+		return nil, nil
+	}
+	target := mount.Target
+	if target == "" {
+		target = fmt.Sprintf("/run/buildkit/ssh_agent.%d", len(m.listeners))
+	}
+	path := filepath.Join(kConfig.RootDir, target)
+	if err := m.mkdirAll(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	if err := m.moveAside(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "forwarding ssh agent %s", id)
+	}
+	m.listeners = append(m.listeners, l)
+	m.files = append(m.files, path)
+
+	mode := os.FileMode(0o600)
+	if mount.Mode != nil {
+		mode = os.FileMode(*mount.Mode)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return nil, err
+	}
+	uid, gid := 0, 0
+	if mount.UID != nil {
+		uid = int(*mount.UID)
+	}
+	if mount.GID != nil {
+		gid = int(*mount.GID)
+	}
+	if err := os.Chown(path, uid, gid); err != nil && os.Geteuid() == 0 {
+		return nil, err
+	}
+	go forwardSSHAgent(l, agent)
+	return []string{"SSH_AUTH_SOCK=" + target}, nil
+}
+
+// forwardSSHAgent forwards the connections accepted by l to the agent socket
+// until l is closed.
+func forwardSSHAgent(l net.Listener, agent string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			upstream, err := net.Dial("unix", agent)
+			if err != nil {
+				logrus.Warnf("Unable to connect to ssh agent %s: %v", agent, err)
+				return
+			}
+			defer upstream.Close()
+			go io.Copy(upstream, conn)
+			io.Copy(conn, upstream)
+		}()
+	}
+}
+
+// moveAside moves the file at path aside, to restore it on cleanup
+func (m *runMounts) moveAside(path string) error {
+	if _, err := os.Lstat(path); err != nil {
+		return nil
+	}
+	backup := path + ".kaniko-mount-backup"
+	if err := os.Rename(path, backup); err != nil {
+		return errors.Wrapf(err, "moving %s aside", path)
+	}
+	m.backups[path] = backup
+	return nil
+}
+
+// restore restores the file moved aside from path
+func (m *runMounts) restore(path string) error {
+	backup, ok := m.backups[path]
+	if !ok {
+		return nil
+	}
+	if err := os.Rename(backup, path); err != nil {
+		return errors.Wrapf(err, "restoring %s", path)
+	}
+	return nil
+}
+
+// writeFile writes a mounted file at path, creating its missing parent
+// directories and moving aside the file it replaces.
+func (m *runMounts) writeFile(path string, content []byte, mode os.FileMode, uid, gid int) error {
+	if err := m.mkdirAll(filepath.Dir(path)); err != nil {
+		return err
+	}
+	if err := m.moveAside(path); err != nil {
+		return err
+	}
+	m.files = append(m.files, path)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(content); err != nil {
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+	if err := f.Chown(uid, gid); err != nil {
+		// Unprivileged builds own the files they write
+		if os.Geteuid() == 0 {
+			return err
+		}
+		logrus.Debugf("Unable to change the owner of %s: %v", path, err)
+	}
+	return nil
+}
+
+// mkdirAll creates dir and its missing parents, recording them to remove them
+func (m *runMounts) mkdirAll(dir string) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Lstat(d); err == nil || d == filepath.Dir(d) {
+			break
+		}
+		missing = append(missing, d)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], 0o755); err != nil {
+			return err
+		}
+		m.dirs = append(m.dirs, missing[i])
+	}
+	return nil
+}
+
+// cleanup unmounts the bind mounts, moves the cache directories back, removes
+// the copied and mounted files and sockets, restores the files they replaced
+// and removes the directories created for them.
+func (m *runMounts) cleanup() error {
+	for _, l := range m.listeners {
+		l.Close()
+	}
+	for i := len(m.binds) - 1; i >= 0; i-- {
+		if err := unix.Unmount(m.binds[i], unix.MNT_DETACH); err != nil {
+			return errors.Wrapf(err, "unmounting %s", m.binds[i])
+		}
+	}
+	for i := len(m.copies) - 1; i >= 0; i-- {
+		if err := os.RemoveAll(m.copies[i]); err != nil {
+			return errors.Wrapf(err, "removing copy %s", m.copies[i])
+		}
+		if err := m.restore(m.copies[i]); err != nil {
+			return err
+		}
+	}
+	for i := len(m.caches) - 1; i >= 0; i-- {
+		c := m.caches[i]
+		var err error
+		if c.linked {
+			err = os.Remove(c.target)
+		} else {
+			err = os.Rename(c.target, c.dir)
+		}
+		// The command may have removed the cache, which starts over next time
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "unmounting cache %s", c.target)
+		}
+		if c.temporary {
+			if err := os.RemoveAll(c.dir); err != nil {
+				return errors.Wrapf(err, "removing private cache directory %s", c.dir)
+			}
+		}
+		// Releasing the lock only once the directory is back
+		c.lock.Close()
+		if err := m.restore(c.target); err != nil {
+			return err
+		}
+	}
+	for i := len(m.files) - 1; i >= 0; i-- {
+		path := m.files[i]
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "removing mounted file %s", path)
+		}
+		if err := m.restore(path); err != nil {
+			return err
+		}
+	}
+	for i := len(m.dirs) - 1; i >= 0; i-- {
+		if err := os.RemoveAll(m.dirs[i]); err != nil {
+			return errors.Wrapf(err, "removing mount directory %s", m.dirs[i])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,347 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kConfig "github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+func parseRun(t *testing.T, line string) *instructions.RunCommand {
+	t.Helper()
+	res, err := parser.Parse(strings.NewReader(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := instructions.ParseInstruction(res.AST.Children[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmd.(*instructions.RunCommand)
+}
+
+func TestSetSecrets(t *testing.T) {
+	defer SetSecrets(nil)
+	testutil.CheckError(t, true, SetSecrets([]string{"src=/tmp/token"}))
+	testutil.CheckError(t, true, SetSecrets([]string{"id=token,type=ssh"}))
+	testutil.CheckError(t, true, SetSecrets([]string{"id=token,unknown=value"}))
+	testutil.CheckNoError(t, SetSecrets([]string{"id=token,src=/tmp/token", "id=key,env=API_KEY", "id=GITHUB_TOKEN"}))
+	testutil.CheckDeepEqual(t, 3, len(secrets))
+	testutil.CheckDeepEqual(t, "/tmp/token", secrets["token"].path)
+	testutil.CheckDeepEqual(t, "API_KEY", secrets["key"].env)
+	testutil.CheckDeepEqual(t, "GITHUB_TOKEN", secrets["GITHUB_TOKEN"].env)
+}
+
+func TestSetupRunMounts(t *testing.T) {
+	defer SetSecrets(nil)
+	original := kConfig.RootDir
+	defer func() { kConfig.RootDir = original }()
+	kConfig.RootDir = t.TempDir()
+
+	src := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(src, []byte("s3cr3t"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	existing := filepath.Join(kConfig.RootDir, "etc", "token")
+	if err := os.MkdirAll(filepath.Dir(existing), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(existing, []byte("original"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KANIKO_TEST_KEY", "key")
+	testutil.CheckNoError(t, SetSecrets([]string{"id=token,src=" + src, "id=key,env=KANIKO_TEST_KEY"}))
+
+	m, env, err := setupRunMounts(parseRun(t, "RUN --mount=type=secret,id=token --mount=type=secret,id=token,target=/etc/token --mount=type=secret,id=key,env=API_KEY --mount=type=secret,id=missing cat /run/secrets/token"), nil, "")
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, []string{"API_KEY=key"}, env)
+	for _, path := range []string{"run/secrets/token", "etc/token"} {
+		b, err := os.ReadFile(filepath.Join(kConfig.RootDir, path))
+		testutil.CheckNoError(t, err)
+		testutil.CheckDeepEqual(t, "s3cr3t", string(b))
+	}
+
+	testutil.CheckNoError(t, m.cleanup())
+	if _, err := os.Stat(filepath.Join(kConfig.RootDir, "run")); !os.IsNotExist(err) {
+		t.Errorf("expected the secrets directory to be removed, got %v", err)
+	}
+	b, err := os.ReadFile(existing)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, "original", string(b))
+
+	_, _, err = setupRunMounts(parseRun(t, "RUN --mount=type=secret,id=missing,required cat /run/secrets/missing"), nil, "")
+	testutil.CheckError(t, true, err)
+
+	m, env, err = setupRunMounts(&instructions.RunCommand{}, nil, "")
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 0, len(env)+len(m.files))
+}
+
+func TestSetupRunMounts_cache(t *testing.T) {
+	original := kConfig.RootDir
+	defer func() { kConfig.RootDir = original }()
+	kConfig.RootDir = t.TempDir()
+	SetCacheMountDir(t.TempDir())
+	defer SetCacheMountDir("")
+
+	existing := filepath.Join(kConfig.RootDir, "root", ".cache", "image-file")
+	if err := os.MkdirAll(filepath.Dir(existing), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(existing, []byte("image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := parseRun(t, "RUN --mount=type=cache,target=/root/.cache --mount=type=cache,id=gomod,target=/go/pkg/mod go build")
+	for i := 0; i < 2; i++ {
+		m, _, err := setupRunMounts(cmd, nil, "")
+		testutil.CheckNoError(t, err)
+		// The files written to the cache in the first build are there in the second
+		built := filepath.Join(kConfig.RootDir, "root", ".cache", "built")
+		_, err = os.Stat(built)
+		testutil.CheckDeepEqual(t, i == 1, err == nil)
+		if err := os.WriteFile(built, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err = os.Stat(existing)
+		testutil.CheckDeepEqual(t, true, os.IsNotExist(err))
+		testutil.CheckNoError(t, m.cleanup())
+
+		// The image files are restored and the cache is gone from the filesystem
+		b, err := os.ReadFile(existing)
+		testutil.CheckNoError(t, err)
+		testutil.CheckDeepEqual(t, "image", string(b))
+		_, err = os.Stat(built)
+		testutil.CheckDeepEqual(t, true, os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(kConfig.RootDir, "go"))
+		testutil.CheckDeepEqual(t, true, os.IsNotExist(err))
+	}
+	_, err := os.Stat(filepath.Join(cacheMountRoot(), "gomod"))
+	testutil.CheckNoError(t, err)
+}
+
+func TestSetupRunMounts_cacheSharing(t *testing.T) {
+	original := kConfig.RootDir
+	defer func() { kConfig.RootDir = original }()
+	kConfig.RootDir = t.TempDir()
+	SetCacheMountDir(t.TempDir())
+	defer SetCacheMountDir("")
+
+	// A first build holds the cache
+	first, _, err := setupRunMounts(parseRun(t, "RUN --mount=type=cache,id=shared,target=/first true"), nil, "")
+	testutil.CheckNoError(t, err)
+	if err := os.WriteFile(filepath.Join(kConfig.RootDir, "first", "built"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another build sharing it gets an empty directory of its own, removed afterwards
+	second, _, err := setupRunMounts(parseRun(t, "RUN --mount=type=cache,id=shared,target=/second true"), nil, "")
+	testutil.CheckNoError(t, err)
+	entries, err := os.ReadDir(filepath.Join(kConfig.RootDir, "second"))
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 0, len(entries))
+	testutil.CheckNoError(t, second.cleanup())
+	entries, err = os.ReadDir(filepath.Join(cacheMountRoot(), cacheLocksDir))
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 1, len(entries))
+
+	// A build locking it waits for the first one to release it
+	mounted := make(chan *runMounts)
+	go func() {
+		m, _, err := setupRunMounts(parseRun(t, "RUN --mount=type=cache,id=shared,target=/third,sharing=locked true"), nil, "")
+		if err != nil {
+			t.Error(err)
+		}
+		mounted <- m
+	}()
+	select {
+	case <-mounted:
+		t.Fatal("the locked cache was mounted while in use")
+	case <-time.After(100 * time.Millisecond):
+	}
+	testutil.CheckNoError(t, first.cleanup())
+	third := <-mounted
+	_, err = os.Stat(filepath.Join(kConfig.RootDir, "third", "built"))
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, third.cleanup())
+}
+
+func TestSetupRunMounts_ssh(t *testing.T) {
+	defer SetSSH(nil)
+	original := kConfig.RootDir
+	defer func() { kConfig.RootDir = original }()
+	kConfig.RootDir = t.TempDir()
+
+	// The agent echoes what it is sent
+	agent := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	testutil.CheckError(t, true, SetSSH([]string{"default=" + filepath.Join(t.TempDir(), "missing")}))
+	t.Setenv("SSH_AUTH_SOCK", agent)
+	testutil.CheckNoError(t, SetSSH([]string{"default"}))
+
+	m, env, err := setupRunMounts(parseRun(t, "RUN --mount=type=ssh git clone git@github.com:org/private.git"), nil, "")
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, []string{"SSH_AUTH_SOCK=/run/buildkit/ssh_agent.0"}, env)
+	socket := filepath.Join(kConfig.RootDir, "run", "buildkit", "ssh_agent.0")
+	conn, err := net.Dial("unix", socket)
+	testutil.CheckNoError(t, err)
+	_, err = conn.Write([]byte("ping"))
+	testutil.CheckNoError(t, err)
+	b := make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, "ping", string(b))
+	conn.Close()
+
+	testutil.CheckNoError(t, m.cleanup())
+	_, err = os.Stat(filepath.Join(kConfig.RootDir, "run"))
+	testutil.CheckDeepEqual(t, true, os.IsNotExist(err))
+
+	_, _, err = setupRunMounts(parseRun(t, "RUN --mount=type=ssh,id=deploy,required git fetch"), nil, "")
+	testutil.CheckError(t, true, err)
+}
+
+func TestSetupRunMounts_bind(t *testing.T) {
+	original, originalKanikoDir := kConfig.RootDir, kConfig.KanikoDir
+	defer func() { kConfig.RootDir, kConfig.KanikoDir = original, originalKanikoDir }()
+	kConfig.RootDir, kConfig.KanikoDir = t.TempDir(), t.TempDir()
+	SetStageIndexes(map[string]string{"deps": "0"})
+	defer SetStageIndexes(map[string]string{})
+
+	buildContext := t.TempDir()
+	if err := os.WriteFile(filepath.Join(buildContext, "go.mod"), []byte("module example.com/app"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	vendor := filepath.Join(kConfig.StagingDir(), "0", "src", "vendor")
+	if err := os.MkdirAll(vendor, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(vendor, "modules.txt"), []byte("# modules"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, _, err := setupRunMounts(parseRun(t, "RUN --mount=type=bind,target=/app/go.mod,source=go.mod --mount=type=bind,from=deps,source=/src/vendor,target=/app/vendor go build"), nil, buildContext)
+	testutil.CheckNoError(t, err)
+	for path, want := range map[string]string{"app/go.mod": "module example.com/app", "app/vendor/modules.txt": "# modules"} {
+		b, err := os.ReadFile(filepath.Join(kConfig.RootDir, path))
+		testutil.CheckNoError(t, err)
+		testutil.CheckDeepEqual(t, want, string(b))
+	}
+	testutil.CheckNoError(t, m.cleanup())
+	_, err = os.Stat(filepath.Join(kConfig.RootDir, "app"))
+	testutil.CheckDeepEqual(t, true, os.IsNotExist(err))
+	// The sources are left as is
+	_, err = os.Stat(filepath.Join(vendor, "modules.txt"))
+	testutil.CheckNoError(t, err)
+
+	// The writes to read-write mounts never reach their source
+	m, _, err = setupRunMounts(parseRun(t, "RUN --mount=type=bind,rw,target=/app/go.mod,source=go.mod go mod tidy"), nil, buildContext)
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, os.WriteFile(filepath.Join(kConfig.RootDir, "app", "go.mod"), []byte("tidied"), 0o644))
+	testutil.CheckNoError(t, m.cleanup())
+	b, err := os.ReadFile(filepath.Join(buildContext, "go.mod"))
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, "module example.com/app", string(b))
+
+	// Without source, the whole filesystem of the stage is mounted
+	m, _, err = setupRunMounts(parseRun(t, "RUN --mount=type=bind,from=deps,target=/deps ls"), nil, buildContext)
+	testutil.CheckNoError(t, err)
+	b, err = os.ReadFile(filepath.Join(kConfig.RootDir, "deps", "src", "vendor", "modules.txt"))
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, "# modules", string(b))
+	testutil.CheckNoError(t, m.cleanup())
+}
+
+func TestSetupRunMounts_tmpfs(t *testing.T) {
+	original := kConfig.RootDir
+	defer func() { kConfig.RootDir = original }()
+	kConfig.RootDir = t.TempDir()
+	existing := filepath.Join(kConfig.RootDir, "tmp", "image-file")
+	if err := os.MkdirAll(filepath.Dir(existing), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(existing, []byte("image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m, _, err := setupRunMounts(parseRun(t, "RUN --mount=type=tmpfs,target=/tmp --mount=type=tmpfs,target=/build/obj,size=64m make"), nil, "")
+	testutil.CheckNoError(t, err)
+	_, err = os.Stat(existing)
+	testutil.CheckDeepEqual(t, true, os.IsNotExist(err))
+	scratch := filepath.Join(kConfig.RootDir, "build", "obj", "main.o")
+	testutil.CheckNoError(t, os.WriteFile(scratch, nil, 0o644))
+
+	// The scratch files are gone and the image files are back
+	testutil.CheckNoError(t, m.cleanup())
+	_, err = os.Stat(filepath.Join(kConfig.RootDir, "build"))
+	testutil.CheckDeepEqual(t, true, os.IsNotExist(err))
+	b, err := os.ReadFile(existing)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, "image", string(b))
+}
+
+func Test_copyTree(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "dir"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "dir", "file"), []byte("content"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("dir/file", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "copy")
+	testutil.CheckNoError(t, copyTree(src, dst))
+
+	b, err := os.ReadFile(filepath.Join(dst, "link"))
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, "content", string(b))
+	fi, err := os.Stat(filepath.Join(dst, "dir"))
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, os.FileMode(0o700), fi.Mode().Perm())
+	fi, err = os.Stat(filepath.Join(dst, "dir", "file"))
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, os.FileMode(0o640), fi.Mode().Perm())
+}
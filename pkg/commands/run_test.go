@@ -19,16 +19,20 @@ package commands
 import (
 	"archive/tar"
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"log"
 	"os"
 	"os/user"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/chainguard-dev/kaniko/pkg/dockerfile"
 	"github.com/chainguard-dev/kaniko/testutil"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
 )
 
 func Test_addDefaultHOME(t *testing.T) {
@@ -315,3 +319,17 @@ func TestSetWorkDirIfExists(t *testing.T) {
 	testutil.CheckDeepEqual(t, testDir, setWorkDirIfExists(testDir))
 	testutil.CheckDeepEqual(t, "", setWorkDirIfExists("doesnot-exists"))
 }
+
+func TestRunCommand_ExecuteCommandContext(t *testing.T) {
+	cmd := &RunCommand{cmd: &instructions.RunCommand{
+		ShellDependantCmdLine: instructions.ShellDependantCmdLine{CmdLine: []string{"sleep 30"}, PrependShell: true},
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// The command is killed once the context is done
+	start := time.Now()
+	err := cmd.ExecuteCommandContext(ctx, &v1.Config{}, dockerfile.NewBuildArgs(nil))
+	testutil.CheckDeepEqual(t, true, errors.Is(err, context.DeadlineExceeded))
+	testutil.CheckDeepEqual(t, true, time.Since(start) < 10*time.Second)
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+// envPrefix prefixes the environment variables setting the flags
+const envPrefix = "KANIKO_"
+
+// envBoundElsewhere are the flags whose environment variables are read along
+// with the flags rather than instead of them, by ResolveRegistryMaps
+var envBoundElsewhere = map[string]bool{
+	"registry-mirror": true,
+	"registry-map":    true,
+}
+
+// FlagEnv returns the environment variable setting the flag name, like
+// KANIKO_NO_PUSH for --no-push
+func FlagEnv(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// SetFlagsFromEnv sets the flags not set on the command line from their
+// environment variables, named by FlagEnv, so that the flags take precedence
+// over the environment variables, which take precedence over the defaults. The
+// values of the flags that can be set repeatedly are separated by newlines.
+func SetFlagsFromEnv(flags *pflag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed || f.Deprecated != "" || envBoundElsewhere[f.Name] {
+			return
+		}
+		env := FlagEnv(f.Name)
+		val, ok := os.LookupEnv(env)
+		if !ok {
+			return
+		}
+		values := []string{val}
+		if isRepeatable(f.Value) {
+			values = strings.FieldsFunc(val, func(r rune) bool { return r == '\n' })
+		}
+		for _, v := range values {
+			if setErr := flags.Set(f.Name, strings.TrimSpace(v)); setErr != nil {
+				err = errors.Wrapf(setErr, "invalid value %q of %s for --%s", v, env, f.Name)
+				return
+			}
+		}
+	})
+	return err
+}
+
+// isRepeatable returns true if the flag of value can be set repeatedly, each
+// time adding a value
+func isRepeatable(value pflag.Value) bool {
+	if _, ok := value.(pflag.SliceValue); ok {
+		return true
+	}
+	switch value.(type) {
+	case *multiArg, *keyValueArg, *multiKeyMultiValueArg, *KanikoGitOptions:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/spf13/pflag"
+)
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	opts := &KanikoOptions{}
+	flags := pflag.NewFlagSet("executor", pflag.ContinueOnError)
+	flags.StringVar(&opts.DockerfilePath, "dockerfile", "Dockerfile", "")
+	flags.StringVar(&opts.Target, "target", "", "")
+	flags.BoolVar(&opts.NoPush, "no-push", false, "")
+	flags.Var(&opts.BuildArgs, "build-arg", "")
+	flags.Var(&opts.Destinations, "destination", "")
+	flags.Var(&opts.RegistryMirrors, "registry-mirror", "")
+
+	t.Setenv("KANIKO_DOCKERFILE", "build/Dockerfile")
+	t.Setenv("KANIKO_TARGET", "from-env")
+	t.Setenv("KANIKO_NO_PUSH", "true")
+	t.Setenv("KANIKO_BUILD_ARG", "A=1,2\nB=3\n")
+	t.Setenv("KANIKO_DESTINATION", "gcr.io/from/env")
+	t.Setenv("KANIKO_REGISTRY_MIRROR", "mirror.gcr.io")
+
+	testutil.CheckNoError(t, flags.Parse([]string{"--target=from-flag", "--destination=gcr.io/from/flag"}))
+	testutil.CheckNoError(t, SetFlagsFromEnv(flags))
+	testutil.CheckDeepEqual(t, "build/Dockerfile", opts.DockerfilePath)
+	testutil.CheckDeepEqual(t, true, opts.NoPush)
+	testutil.CheckDeepEqual(t, multiArg{"A=1,2", "B=3"}, opts.BuildArgs)
+	// The flags take precedence over the environment variables
+	testutil.CheckDeepEqual(t, "from-flag", opts.Target)
+	testutil.CheckDeepEqual(t, multiArg{"gcr.io/from/flag"}, opts.Destinations)
+	// The registry mirrors are added by ResolveRegistryMaps
+	testutil.CheckDeepEqual(t, multiArg(nil), opts.RegistryMirrors)
+
+	t.Setenv("KANIKO_NO_PUSH", "maybe")
+	flags = pflag.NewFlagSet("executor", pflag.ContinueOnError)
+	flags.BoolVar(&opts.NoPush, "no-push", false, "")
+	testutil.CheckError(t, true, SetFlagsFromEnv(flags))
+}
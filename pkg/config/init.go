@@ -19,6 +19,9 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/chainguard-dev/kaniko/pkg/constants"
 )
@@ -46,6 +49,61 @@ var KanikoIntermediateStagesDir = fmt.Sprintf("%s/stages/", KanikoDir)
 
 var MountInfoPath string
 
+// stagingDir and scratchDir are the working directories moved out of the
+// kaniko directory with SetWorkDirs
+var stagingDir, scratchDir string
+
+// StagingDir returns the directory the files of the stages, and the images,
+// copied from by later stages are extracted into
+func StagingDir() string {
+	if stagingDir != "" {
+		return stagingDir
+	}
+	return KanikoDir
+}
+
+// ScratchDir returns the directory the layer tarballs are written to while
+// building and pushing the image
+func ScratchDir() string {
+	if scratchDir != "" {
+		return scratchDir
+	}
+	return KanikoDir
+}
+
+// SetWorkDirs moves the working directories out of the kaniko directory, for
+// example onto faster disks. The directories left empty are kept in place.
+func SetWorkDirs(staging, scratch, buildContext string) {
+	stagingDir = staging
+	scratchDir = scratch
+	if scratch != "" {
+		KanikoIntermediateStagesDir = fmt.Sprintf("%s/stages/", filepath.Clean(scratch))
+	}
+	if buildContext != "" {
+		BuildContextDir = fmt.Sprintf("%s/", filepath.Clean(buildContext))
+	}
+}
+
+// WorkDirs returns the working directories moved out of the kaniko directory
+func WorkDirs() []string {
+	var dirs []string
+	for _, d := range []string{stagingDir, scratchDir, BuildContextDir} {
+		d = filepath.Clean(d)
+		if d != "." && !strings.HasPrefix(d+"/", filepath.Clean(KanikoDir)+"/") && !slices.Contains(dirs, d) {
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs
+}
+
+// SetKanikoDir moves the kaniko directory, along with the paths inside it
+func SetKanikoDir(dir string) {
+	KanikoDir = dir
+	DockerfilePath = fmt.Sprintf("%s/Dockerfile", KanikoDir)
+	BuildContextDir = fmt.Sprintf("%s/buildcontext/", KanikoDir)
+	KanikoIntermediateStagesDir = fmt.Sprintf("%s/stages/", KanikoDir)
+}
+
 func init() {
 	RootDir = constants.RootDir
 	MountInfoPath = constants.MountInfoPath
@@ -0,0 +1,45 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestSetWorkDirs(t *testing.T) {
+	originalKanikoDir := KanikoDir
+	defer SetKanikoDir(originalKanikoDir)
+	defer SetWorkDirs("", "", "")
+
+	SetKanikoDir("/kaniko")
+	testutil.CheckDeepEqual(t, "/kaniko", StagingDir())
+	testutil.CheckDeepEqual(t, "/kaniko", ScratchDir())
+	testutil.CheckDeepEqual(t, []string(nil), WorkDirs())
+
+	SetWorkDirs("/mnt/nvme/staging", "/mnt/nvme/scratch/", "/kaniko/context")
+	testutil.CheckDeepEqual(t, "/mnt/nvme/staging", StagingDir())
+	testutil.CheckDeepEqual(t, "/mnt/nvme/scratch/", ScratchDir())
+	testutil.CheckDeepEqual(t, "/mnt/nvme/scratch/stages/", KanikoIntermediateStagesDir)
+	testutil.CheckDeepEqual(t, "/kaniko/context/", BuildContextDir)
+	// The directories inside the kaniko directory are handled along with it
+	testutil.CheckDeepEqual(t, []string{"/mnt/nvme/staging", "/mnt/nvme/scratch"}, WorkDirs())
+
+	SetWorkDirs("/mnt/nvme", "/mnt/nvme", "/mnt/nvme")
+	testutil.CheckDeepEqual(t, []string{"/mnt/nvme"}, WorkDirs())
+}
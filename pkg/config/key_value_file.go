@@ -0,0 +1,117 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ReadKeyValueFile reads the KEY=VALUE pairs of the file at path, and returns
+// them in the key=value form of the --label and --annotation flags.
+//
+// Blank lines and lines starting with # are skipped. Unquoted values run to the
+// end of the line. Values in single quotes are taken literally and values in
+// double quotes support the \\, \", \n and \t escapes; both may span multiple
+// lines.
+func ReadKeyValueFile(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", path)
+	}
+	pairs, err := parseKeyValues(strings.ReplaceAll(string(b), "\r\n", "\n"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", path)
+	}
+	return pairs, nil
+}
+
+func parseKeyValues(s string) ([]string, error) {
+	var pairs []string
+	line := 1
+	for len(s) > 0 {
+		l, rest, more := strings.Cut(s, "\n")
+		s = rest
+		start := line
+		line++
+		trimmed := strings.TrimSpace(l)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimLeft(l, " \t"), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE, got %q", start, trimmed)
+		}
+		value = strings.TrimLeft(value, " \t")
+		if value == "" || (value[0] != '"' && value[0] != '\'') {
+			pairs = append(pairs, key+"="+strings.TrimSpace(value))
+			continue
+		}
+
+		// Quoted values may continue on the following lines
+		if more {
+			value += "\n" + s
+		}
+		unquoted, rest, err := unquoteValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: value of %s: %w", start, key, err)
+		}
+		consumed := value[:len(value)-len(rest)]
+		line += strings.Count(consumed, "\n")
+		var tail string
+		tail, s, _ = strings.Cut(rest, "\n")
+		if tail = strings.TrimSpace(tail); tail != "" && !strings.HasPrefix(tail, "#") {
+			return nil, fmt.Errorf("line %d: unexpected %q after the value of %s", start, tail, key)
+		}
+		pairs = append(pairs, key+"="+unquoted)
+	}
+	return pairs, nil
+}
+
+// unquoteValue returns the value quoted at the start of s and the rest of s
+// after the closing quote.
+func unquoteValue(s string) (string, string, error) {
+	quote := s[0]
+	var sb strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == quote:
+			return sb.String(), s[i+1:], nil
+		case c == '\\' && quote == '"' && i+1 < len(s):
+			i++
+			switch s[i] {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case '\\', '"':
+				sb.WriteByte(s[i])
+			default:
+				sb.WriteByte('\\')
+				sb.WriteByte(s[i])
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", "", fmt.Errorf("missing closing %c", quote)
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestReadKeyValueFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		want        []string
+		shouldError bool
+	}{
+		{
+			name: "unquoted values",
+			content: `# build metadata
+org.opencontainers.image.source = https://example.com/repo
+
+org.opencontainers.image.url=https://example.com/?a=b
+EMPTY=
+`,
+			want: []string{
+				"org.opencontainers.image.source=https://example.com/repo",
+				"org.opencontainers.image.url=https://example.com/?a=b",
+				"EMPTY=",
+			},
+		},
+		{
+			name:    "multi-line values",
+			content: "description=\"first line\nsecond \\\"line\\\"\\t\\\\\" # comment\r\njson='{\"a\": [1,\n 2]}'\nlast=1",
+			want: []string{
+				"description=first line\nsecond \"line\"\t\\",
+				"json={\"a\": [1,\n 2]}",
+				"last=1",
+			},
+		},
+		{
+			name:        "missing equal sign",
+			content:     "key\n",
+			shouldError: true,
+		},
+		{
+			name:        "missing closing quote",
+			content:     "key=\"value\nother=1\n",
+			shouldError: true,
+		},
+		{
+			name:        "text after closing quote",
+			content:     "key='value' extra\n",
+			shouldError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "labels")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadKeyValueFile(path)
+			testutil.CheckError(t, tt.shouldError, err)
+			if !tt.shouldError {
+				testutil.CheckDeepEqual(t, tt.want, got)
+			}
+		})
+	}
+}
@@ -19,9 +19,16 @@ package config
 import (
 	"errors"
 	"fmt"
+	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sirupsen/logrus"
 )
 
 // CacheOptions are base image cache options that are set by command line arguments
@@ -38,6 +45,16 @@ type RegistryOptions struct {
 	SkipTLSVerifyRegistries      multiArg
 	RegistriesCertificates       keyValueArg
 	RegistriesClientCertificates keyValueArg
+	OAuth2Config                 string
+	HarborRobotAccounts          multiArg
+	DockerConfigs                multiArg
+	ImagePullSecrets             multiArg
+	AuthDebug                    bool
+	RegistryUploadLimits         multiArg
+	RegistryDownloadLimits       multiArg
+	RegistryMaxConnections       multiArg
+	RegistryIPFamilies           multiArg
+	AuditLog                     string
 	SkipDefaultRegistryFallback  bool
 	Insecure                     bool
 	SkipTLSVerify                bool
@@ -46,6 +63,44 @@ type RegistryOptions struct {
 	PushIgnoreImmutableTagErrors bool
 	PushRetry                    int
 	ImageDownloadRetry           int
+	// Keychain replaces the default keychain when set by the programs
+	// embedding kaniko, for the credentials of a build not to be shared with
+	// the others
+	Keychain authn.Keychain
+}
+
+// ResolveRegistryMaps adds the registry mirror and map set with the
+// KANIKO_REGISTRY_MIRROR and KANIKO_REGISTRY_MAP environment variables, and
+// maps the default registry to the registry mirrors.
+func (r *RegistryOptions) ResolveRegistryMaps() {
+	// Allow setting --registry-mirror using an environment variable.
+	if val, ok := os.LookupEnv("KANIKO_REGISTRY_MIRROR"); ok {
+		r.RegistryMirrors.Set(val)
+	}
+
+	// Allow setting --registry-maps using an environment variable.
+	if val, ok := os.LookupEnv("KANIKO_REGISTRY_MAP"); ok {
+		r.RegistryMaps.Set(val)
+	}
+
+	// The images are looked up by the canonical name of their registry, like
+	// index.docker.io rather than docker.io
+	for src, dsts := range r.RegistryMaps {
+		reg, err := name.NewRegistry(src, name.WeakValidation)
+		if err != nil || reg.RegistryStr() == src {
+			continue
+		}
+		r.RegistryMaps[reg.RegistryStr()] = append(r.RegistryMaps[reg.RegistryStr()], dsts...)
+		delete(r.RegistryMaps, src)
+	}
+
+	for _, target := range r.RegistryMirrors {
+		r.RegistryMaps.Set(fmt.Sprintf("%s=%s", name.DefaultRegistry, target))
+	}
+
+	for src, dsts := range r.RegistryMaps {
+		logrus.Debugf("registry-map remaps %s to %s.", src, strings.Join(dsts, ", "))
+	}
 }
 
 // KanikoOptions are options that are set by command line arguments
@@ -55,42 +110,190 @@ type KanikoOptions struct {
 	Destinations             multiArg
 	BuildArgs                multiArg
 	Labels                   multiArg
+	LabelFiles               multiArg
+	Annotations              multiArg
+	AnnotationFiles          multiArg
+	DockerfileHeaders        keyValueArg
+	HTTPCertificates         keyValueArg
+	HTTPClientCertificates   keyValueArg
+	DockerfileFragments      multiArg
+	FromImageOverrides       keyValueArg
+	RegistryPushMaps         keyValueArg
+	FromImageOverrideFiles   multiArg
 	Git                      KanikoGitOptions
 	IgnorePaths              multiArg
+	HermeticAllow            multiArg
+	Secrets                  multiArg
+	SSH                      multiArg
+	CacheRepos               multiArg
+	PrePushHooks             multiArg
+	CleanupPreservePaths     multiArg
 	DockerfilePath           string
 	SrcContext               string
 	SnapshotMode             string
 	SnapshotModeDeprecated   string
 	CustomPlatform           string
 	CustomPlatformDeprecated string
+	OSVersion                string
+	OSFeatures               multiArg
+	SourceDateEpoch          string
 	Bucket                   string
+	BaseImageStore           string
+	LayerIndex               string
 	TarPath                  string
 	TarPathDeprecated        string
 	KanikoDir                string
+	StagingDir               string
+	ScratchDir               string
+	CacheMountDir            string
+	BuildContextDir          string
+	ContextCacheDir          string
 	Target                   string
+	BuildLogsURL             string
+	SummaryFile              string
+	SummaryFormat            string
+	Transcode                string
+	Rebase                   string
+	RebaseOldBase            string
+	RebaseNewBase            string
 	CacheRepo                string
+	CacheS3KMSKeyID          string
+	CacheExport              string
+	CacheImport              string
+	CacheDirMaxSize          string
 	DigestFile               string
 	ImageNameDigestFile      string
 	ImageNameTagDigestFile   string
+	ImageIDFile              string
 	OCILayoutPath            string
+	ComposefsPath            string
+	ProfileDir               string
+	PprofAddress             string
+	RunIsolation             string
+	DefaultRunNetwork        string
+	HermeticCheck            string
+	RecordRuns               string
+	ReplayRuns               string
 	Compression              Compression
+	MediaTypes               MediaTypes
 	CompressionLevel         int
 	ImageFSExtractRetry      int
+	HashJobs                 int
+	SnapshotDirDigests       bool
+	CacheProbeJobs           int
+	CacheRestoreJobs         int
+	SnapshotSampleRate       float64
+	CompressionJobs          int
+	UploadJobs               int
+	HeartbeatInterval        time.Duration
 	SingleSnapshot           bool
 	Reproducible             bool
+	NormalizeLayers          bool
 	NoPush                   bool
 	NoPushCache              bool
+	PushStages               bool
+	PushBuildReport          bool
 	Cache                    bool
 	Cleanup                  bool
 	CompressedCaching        bool
 	IgnoreVarRun             bool
 	SkipUnusedStages         bool
 	RunV2                    bool
+	Modernize                bool
 	CacheCopyLayers          bool
 	CacheRunLayers           bool
+	NormalizeRunCacheKeys    bool
+	CacheKeys                multiArg
+	NoCacheFilter            multiArg
+	StageMaxDurations        multiArg
+	StageMaxSnapshotSizes    multiArg
+	CacheFileHashes          bool
+	CacheDirWrite            bool
 	ForceBuildMetadata       bool
 	InitialFSUnpacked        bool
 	SkipPushPermissionCheck  bool
+	PreserveResolvConf       bool
+	PreserveHosts            bool
+	Unprivileged             bool
+
+	// ResolvedDockerfileFragments is populated while parsing the Dockerfile with
+	// the fragments that were included, in the form source@sha256:<digest>
+	ResolvedDockerfileFragments []string
+	// StageBudgetComments is populated while parsing the Dockerfile with the
+	// budgets declared in the comments of the stages, keyed by the line of
+	// their FROM instruction
+	StageBudgetComments map[int]string
+	// NoCacheLines is populated while parsing the Dockerfile with the lines of
+	// the instructions whose layers are never cached
+	NoCacheLines map[int]bool
+	// EscapeToken is populated while parsing the Dockerfile with its escape
+	// character, set with the escape parser directive
+	EscapeToken rune
+	// ContextDigests are the digests of the build context files recorded while
+	// fetching the build context, keyed by path
+	ContextDigests map[string]string
+	// ContextCommit is the commit checked out in the build context, when it is
+	// a git repository
+	ContextCommit string
+	// DockerfileURL is the URL the Dockerfile was fetched from when
+	// --dockerfile is a URL, the Dockerfile then being read from its copy
+	DockerfileURL string
+	// RootDir is the directory the images are unpacked into, set by the
+	// programs embedding kaniko. RootDir of the package is used when empty.
+	RootDir string
+}
+
+// Root returns the directory the images of the build are unpacked into
+func (k *KanikoOptions) Root() string {
+	if k.RootDir != "" {
+		return k.RootDir
+	}
+	return RootDir
+}
+
+// SourceDateEpochTime returns the time SourceDateEpoch is set to, or the zero
+// time if it is not set
+func (k *KanikoOptions) SourceDateEpochTime() (time.Time, error) {
+	if k.SourceDateEpoch == "" {
+		return time.Time{}, nil
+	}
+	epoch, err := strconv.ParseInt(k.SourceDateEpoch, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid source date epoch %q, it must be a unix timestamp in seconds", k.SourceDateEpoch)
+	}
+	return time.Unix(epoch, 0).UTC(), nil
+}
+
+// CacheReadRepos returns the cache repos the cached layers are looked up in,
+// in order: the one they are written to, CacheRepo, unless it is one of
+// CacheRepos, followed by CacheRepos.
+func (k *KanikoOptions) CacheReadRepos() []string {
+	if k.CacheRepo == "" || slices.Contains(k.CacheRepos, k.CacheRepo) {
+		return k.CacheRepos
+	}
+	return append([]string{k.CacheRepo}, k.CacheRepos...)
+}
+
+// NoCacheFiltered returns true if the cached layers are not used for the
+// stage name, as set with --no-cache-filter
+func (k *KanikoOptions) NoCacheFiltered(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, f := range k.NoCacheFilter {
+		for _, stage := range strings.Split(f, ",") {
+			if strings.EqualFold(strings.TrimSpace(stage), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CacheDirMaxSizeBytes returns the size budget of the local cache, or 0 if
+// unlimited
+func (k *KanikoOptions) CacheDirMaxSizeBytes() (int64, error) {
+	return parseSizeBudget("--cache-dir-max-size", k.CacheDirMaxSize)
 }
 
 type KanikoGitOptions struct {
@@ -167,13 +370,71 @@ func (c *Compression) Type() string {
 	return "compression"
 }
 
+// MediaTypes is an enumeration of the families of media types of the images
+type MediaTypes string
+
+const (
+	// MediaTypesAuto keeps the media types of the base image
+	MediaTypesAuto MediaTypes = "auto"
+	// MediaTypesOCI uses the media types of the OCI image spec
+	MediaTypesOCI MediaTypes = "oci"
+	// MediaTypesDocker uses the media types of the Docker image manifest v2
+	// schema 2
+	MediaTypesDocker MediaTypes = "docker"
+)
+
+func (m *MediaTypes) String() string {
+	return string(*m)
+}
+
+func (m *MediaTypes) Set(v string) error {
+	switch MediaTypes(v) {
+	case MediaTypesAuto, MediaTypesOCI, MediaTypesDocker:
+		*m = MediaTypes(v)
+		return nil
+	default:
+		return errors.New(`must be either "auto", "oci" or "docker"`)
+	}
+}
+
+func (m *MediaTypes) Type() string {
+	return "media-types"
+}
+
 // WarmerOptions are options that are set by command line arguments to the cache warmer.
 type WarmerOptions struct {
 	CacheOptions
 	RegistryOptions
-	CustomPlatform string
-	Images         multiArg
-	Force          bool
-	DockerfilePath string
-	BuildArgs      multiArg
+	CustomPlatform         string
+	Images                 multiArg
+	Force                  bool
+	DockerfilePath         string
+	DockerfileHeaders      keyValueArg
+	HTTPCertificates       keyValueArg
+	HTTPClientCertificates keyValueArg
+	BuildArgs              multiArg
+	Unpack                 bool
+	CacheMaxSize           string
+	CacheRepos             multiArg
+}
+
+// CacheMaxSizeBytes returns the size budget of the cache, or 0 if unlimited
+func (w *WarmerOptions) CacheMaxSizeBytes() (int64, error) {
+	return parseSizeBudget("--cache-max-size", w.CacheMaxSize)
+}
+
+// parseSizeBudget parses the size budget s set with flag, like 20GiB, or
+// returns 0 if unset
+func parseSizeBudget(flag, s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	size, err := units.RAMInBytes(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", flag, s, err)
+	}
+	if size <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be positive", flag, s)
+	}
+	return size, nil
 }
@@ -18,6 +18,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/chainguard-dev/kaniko/testutil"
 )
@@ -53,3 +54,77 @@ func TestKanikoGitOptions(t *testing.T) {
 		}, g)
 	})
 }
+
+func TestSourceDateEpochTime(t *testing.T) {
+	tests := []struct {
+		epoch     string
+		expected  time.Time
+		shouldErr bool
+	}{
+		{epoch: "", expected: time.Time{}},
+		{epoch: "0", expected: time.Unix(0, 0).UTC()},
+		{epoch: "1700000000", expected: time.Unix(1700000000, 0).UTC()},
+		{epoch: "2023-11-14", shouldErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.epoch, func(t *testing.T) {
+			opts := &KanikoOptions{SourceDateEpoch: test.epoch}
+			actual, err := opts.SourceDateEpochTime()
+			testutil.CheckErrorAndDeepEqual(t, test.shouldErr, err, test.expected, actual)
+		})
+	}
+}
+
+func TestResolveRegistryMaps(t *testing.T) {
+	t.Setenv("KANIKO_REGISTRY_MIRROR", "mirror.gcr.io")
+	t.Setenv("KANIKO_REGISTRY_MAP", "gcr.io=my.registry")
+	opts := RegistryOptions{RegistryMaps: map[string][]string{}}
+	opts.ResolveRegistryMaps()
+	testutil.CheckDeepEqual(t, multiArg{"mirror.gcr.io"}, opts.RegistryMirrors)
+	testutil.CheckDeepEqual(t, multiKeyMultiValueArg{
+		"index.docker.io": {"mirror.gcr.io"},
+		"gcr.io":          {"my.registry"},
+	}, opts.RegistryMaps)
+}
+
+func TestResolveRegistryMapsAliases(t *testing.T) {
+	opts := RegistryOptions{RegistryMaps: map[string][]string{}}
+	opts.RegistryMaps.Set("docker.io=harbor.example.com/dockerhub-proxy")
+	opts.ResolveRegistryMaps()
+	testutil.CheckDeepEqual(t, multiKeyMultiValueArg{
+		"index.docker.io": {"harbor.example.com/dockerhub-proxy"},
+	}, opts.RegistryMaps)
+}
+
+func TestCacheReadRepos(t *testing.T) {
+	tests := []struct {
+		name      string
+		writeRepo string
+		repos     []string
+		expected  []string
+	}{
+		{name: "none"},
+		{name: "write repo only", writeRepo: "gcr.io/project/cache", expected: []string{"gcr.io/project/cache"}},
+		{name: "write repo first", writeRepo: "gcr.io/project/cache", repos: []string{"gcr.io/project/cache", "gcr.io/org/cache"}, expected: []string{"gcr.io/project/cache", "gcr.io/org/cache"}},
+		{name: "write repo read first", writeRepo: "gcr.io/project/cache", repos: []string{"gcr.io/org/cache"}, expected: []string{"gcr.io/project/cache", "gcr.io/org/cache"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := &KanikoOptions{CacheRepo: test.writeRepo, CacheRepos: test.repos}
+			testutil.CheckDeepEqual(t, test.expected, opts.CacheReadRepos())
+		})
+	}
+}
+
+func TestNoCacheFiltered(t *testing.T) {
+	opts := &KanikoOptions{NoCacheFilter: []string{"deps, test", "Lint"}}
+	for stage, expected := range map[string]bool{
+		"deps":  true,
+		"test":  true,
+		"lint":  true,
+		"build": false,
+		"":      false,
+	} {
+		testutil.CheckDeepEqual(t, expected, opts.NoCacheFiltered(stage))
+	}
+}
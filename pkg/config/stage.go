@@ -17,6 +17,8 @@ limitations under the License.
 package config
 
 import (
+	"time"
+
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
 )
 
@@ -29,4 +31,14 @@ type KanikoStage struct {
 	SaveStage              bool
 	MetaArgs               []instructions.ArgCommand
 	Index                  int
+	Budget                 StageBudget
+}
+
+// StageBudget limits the resources a stage may use, no limit being set when
+// a field is zero
+type StageBudget struct {
+	// MaxDuration is how long the commands of the stage may take to build
+	MaxDuration time.Duration
+	// MaxSnapshotSize is the total size in bytes of the snapshots of the stage
+	MaxSnapshotSize int64
 }
@@ -30,9 +30,10 @@ const (
 	ContextTar = "context.tar.gz"
 
 	// Various snapshot modes:
-	SnapshotModeTime = "time"
-	SnapshotModeFull = "full"
-	SnapshotModeRedo = "redo"
+	SnapshotModeTime    = "time"
+	SnapshotModeFull    = "full"
+	SnapshotModeRedo    = "redo"
+	SnapshotModeSampled = "sampled"
 
 	// NoBaseImage is the scratch image
 	NoBaseImage = "scratch"
@@ -52,6 +53,9 @@ const (
 	Cmd        = "CMD"
 	Entrypoint = "ENTRYPOINT"
 
+	// DockerfileFragmentsLabel records the Dockerfile fragments included in the build
+	DockerfileFragmentsLabel = "dev.kaniko.dockerfile.fragments"
+
 	// Name of the .dockerignore file
 	Dockerignore = ".dockerignore"
 
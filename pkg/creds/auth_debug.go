@@ -0,0 +1,118 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package creds
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	authDebugMu sync.Mutex
+	authDebug   bool
+	// authDebugLogged are the resources the resolution of which was logged
+	authDebugLogged = map[string]bool{}
+)
+
+// SetAuthDebug enables logging, once per repository, which credential source
+// the keychain returned by GetKeychain selected and why it skipped the others.
+func SetAuthDebug(enabled bool) {
+	authDebugMu.Lock()
+	defer authDebugMu.Unlock()
+	authDebug = enabled
+	authDebugLogged = map[string]bool{}
+}
+
+func authDebugEnabled() bool {
+	authDebugMu.Lock()
+	defer authDebugMu.Unlock()
+	return authDebug
+}
+
+// namedKeychain is a credential source, named in the logs
+type namedKeychain struct {
+	name     string
+	keychain authn.Keychain
+}
+
+// debugKeychain resolves the credentials of the first of its sources having
+// some, like authn.NewMultiKeychain, and logs the resolution.
+type debugKeychain []namedKeychain
+
+func (k debugKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	var lines []string
+	logResolution := func() {
+		authDebugMu.Lock()
+		defer authDebugMu.Unlock()
+		if authDebugLogged[target.String()] {
+			return
+		}
+		authDebugLogged[target.String()] = true
+		for _, line := range lines {
+			logrus.Infof("Credentials of %s: %s", target, line)
+		}
+	}
+	for _, source := range k {
+		auth, err := source.keychain.Resolve(target)
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("%s: failed: %v", source.name, err))
+			logResolution()
+			return nil, err
+		}
+		if auth == authn.Anonymous {
+			lines = append(lines, fmt.Sprintf("%s: skipped, no credentials", source.name))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s: selected, %s", source.name, describeAuthenticator(auth)))
+		logResolution()
+		return auth, nil
+	}
+	lines = append(lines, "anonymous: selected, no source has credentials")
+	logResolution()
+	return authn.Anonymous, nil
+}
+
+// describeAuthenticator describes the credentials of auth with their secrets
+// redacted.
+func describeAuthenticator(auth authn.Authenticator) string {
+	cfg, err := auth.Authorization()
+	if err != nil {
+		return fmt.Sprintf("failing to provide credentials: %v", err)
+	}
+	var parts []string
+	if cfg.Username != "" {
+		parts = append(parts, "username "+cfg.Username)
+	}
+	for _, secret := range []struct{ name, value string }{
+		{"password", cfg.Password},
+		{"auth", cfg.Auth},
+		{"identity token", cfg.IdentityToken},
+		{"registry token", cfg.RegistryToken},
+	} {
+		if secret.value != "" {
+			parts = append(parts, secret.name+" <redacted>")
+		}
+	}
+	if len(parts) == 0 {
+		return "empty credentials"
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package creds
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sirupsen/logrus"
+)
+
+type staticKeychain map[string]authn.Authenticator
+
+func (k staticKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	if auth, ok := k[target.RegistryStr()]; ok {
+		return auth, nil
+	}
+	return authn.Anonymous, nil
+}
+
+func TestDebugKeychain(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	defer logrus.SetOutput(os.Stderr)
+	SetAuthDebug(true)
+	defer SetAuthDebug(false)
+
+	k := debugKeychain{
+		{"pull secrets", staticKeychain{}},
+		{"Docker config", staticKeychain{"gcr.io": authn.FromConfig(authn.AuthConfig{Username: "ci", Password: "hunter2"})}},
+	}
+	repo, err := name.NewRepository("gcr.io/project/app")
+	testutil.CheckNoError(t, err)
+	auth, err := k.Resolve(repo)
+	testutil.CheckNoError(t, err)
+	cfg, err := auth.Authorization()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, "hunter2", cfg.Password)
+	out := buf.String()
+	for _, want := range []string{"pull secrets: skipped, no credentials", "Docker config: selected, username ci, password <redacted>"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in the logs, got %s", want, out)
+		}
+	}
+	if strings.Contains(out, "hunter2") {
+		t.Errorf("expected the password to be redacted, got %s", out)
+	}
+
+	// The resolutions are logged once per repository
+	buf.Reset()
+	_, err = k.Resolve(repo)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, "", buf.String())
+
+	other, err := name.NewRepository("quay.io/org/app")
+	testutil.CheckNoError(t, err)
+	auth, err = k.Resolve(other)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, authn.Anonymous, auth)
+	if !strings.Contains(buf.String(), "anonymous: selected") {
+		t.Errorf("expected the anonymous access to be logged, got %s", buf.String())
+	}
+}
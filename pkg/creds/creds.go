@@ -20,19 +20,44 @@ import (
 	"io"
 
 	ecr "github.com/awslabs/amazon-ecr-credential-helper/ecr-login"
+	"github.com/chainguard-dev/kaniko/pkg/config"
 	"github.com/chrismellard/docker-credential-acr-env/pkg/credhelper"
 	gitlab "github.com/ePirat/docker-credential-gitlabci/pkg/credhelper"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/v1/google"
 )
 
+// Keychain returns the keychain of the build with the registry options opts:
+// the one set in opts by the programs embedding kaniko, or else the keychain
+// returned by GetKeychain.
+func Keychain(opts *config.RegistryOptions) authn.Keychain {
+	if opts == nil || opts.Keychain == nil {
+		return GetKeychain()
+	}
+	if authDebugEnabled() {
+		return debugKeychain{{"custom keychain", opts.Keychain}}
+	}
+	return opts.Keychain
+}
+
 // GetKeychain returns a keychain for accessing container registries.
 func GetKeychain() authn.Keychain {
-	return authn.NewMultiKeychain(
-		authn.DefaultKeychain,
-		google.Keychain,
-		authn.NewKeychainFromHelper(ecr.NewECRHelper(ecr.WithLogger(io.Discard))),
-		authn.NewKeychainFromHelper(credhelper.NewACRCredentialsHelper()),
-		authn.NewKeychainFromHelper(gitlab.NewGitLabCredentialsHelper()),
-	)
+	sources := []namedKeychain{
+		{"OAuth2 config", getOAuth2Keychain()},
+		{"Harbor robot accounts", getHarborKeychain()},
+		{"image pull secrets", getPullSecretKeychain()},
+		{"Docker config " + describeDockerConfigs(), getDockerConfigKeychain()},
+		{"Google credentials", google.Keychain},
+		{"ECR credential helper", authn.NewKeychainFromHelper(ecr.NewECRHelper(ecr.WithLogger(io.Discard)))},
+		{"ACR credential helper", authn.NewKeychainFromHelper(credhelper.NewACRCredentialsHelper())},
+		{"GitLab CI credential helper", authn.NewKeychainFromHelper(gitlab.NewGitLabCredentialsHelper())},
+	}
+	if authDebugEnabled() {
+		return debugKeychain(sources)
+	}
+	keychains := make([]authn.Keychain, len(sources))
+	for i, source := range sources {
+		keychains[i] = source.keychain
+	}
+	return authn.NewMultiKeychain(keychains...)
 }
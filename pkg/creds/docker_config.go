@@ -0,0 +1,259 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package creds
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/cli/cli/config/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+)
+
+const (
+	// dockerConfigJSONKey is the key of the Docker config.json in the secrets
+	// of type kubernetes.io/dockerconfigjson
+	dockerConfigJSONKey = ".dockerconfigjson"
+	// dockerCfgKey is the key of the legacy Docker config in the secrets of
+	// type kubernetes.io/dockercfg, which only holds the auths
+	dockerCfgKey = ".dockercfg"
+)
+
+var (
+	dockerConfigMu   sync.Mutex
+	dockerConfigDirs []string
+	pullSecretFiles  []string
+)
+
+// SetDockerConfigDirs sets the directories of the Docker config.json files to
+// read the registry credentials from, instead of those of DOCKER_CONFIG.
+func SetDockerConfigDirs(dirs []string) {
+	dockerConfigMu.Lock()
+	defer dockerConfigMu.Unlock()
+	dockerConfigDirs = dirs
+}
+
+// SetImagePullSecrets sets the Kubernetes image pull secrets to read registry
+// credentials from, which take precedence over those of the Docker config
+// files. Each path is a secret file, or the directory a secret is mounted in.
+func SetImagePullSecrets(paths []string) error {
+	var files []string
+	for _, p := range paths {
+		fi, err := os.Stat(p)
+		if err != nil {
+			return errors.Wrap(err, "reading image pull secret")
+		}
+		if !fi.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		found := false
+		for _, key := range []string{dockerConfigJSONKey, dockerCfgKey} {
+			if _, err := os.Stat(filepath.Join(p, key)); err == nil {
+				files = append(files, filepath.Join(p, key))
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("no %s or %s in image pull secret %s", dockerConfigJSONKey, dockerCfgKey, p)
+		}
+	}
+	dockerConfigMu.Lock()
+	defer dockerConfigMu.Unlock()
+	pullSecretFiles = files
+	return nil
+}
+
+// getPullSecretKeychain returns the keychain of the image pull secrets.
+func getPullSecretKeychain() authn.Keychain {
+	dockerConfigMu.Lock()
+	defer dockerConfigMu.Unlock()
+	return &dockerConfigs{files: pullSecretFiles}
+}
+
+// getDockerConfigDirs returns the directories set with SetDockerConfigDirs, or
+// else those of DOCKER_CONFIG, which may list several directories separated
+// like PATH.
+func getDockerConfigDirs() []string {
+	dockerConfigMu.Lock()
+	defer dockerConfigMu.Unlock()
+	if len(dockerConfigDirs) > 0 {
+		return dockerConfigDirs
+	}
+	var dirs []string
+	for _, dir := range filepath.SplitList(os.Getenv("DOCKER_CONFIG")) {
+		if dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// getDockerConfigKeychain returns the keychain of the Docker config files. A
+// single directory is handled by the default keychain, which also falls back
+// to the Podman auth files.
+func getDockerConfigKeychain() authn.Keychain {
+	dirs := getDockerConfigDirs()
+	if len(dirs) == 0 || (len(dirs) == 1 && dirs[0] == os.Getenv("DOCKER_CONFIG")) {
+		return authn.DefaultKeychain
+	}
+	k := &dockerConfigs{}
+	for _, dir := range dirs {
+		k.files = append(k.files, filepath.Join(dir, config.ConfigFileName))
+	}
+	return k
+}
+
+// describeDockerConfigs describes the Docker config files credentials are
+// read from.
+func describeDockerConfigs() string {
+	dirs := getDockerConfigDirs()
+	if len(dirs) == 0 {
+		return "(default locations)"
+	}
+	files := make([]string, len(dirs))
+	for i, dir := range dirs {
+		files[i] = filepath.Join(dir, config.ConfigFileName)
+	}
+	return "(" + strings.Join(files, ", ") + ")"
+}
+
+// dockerConfigs is the keychain merging the credentials of several Docker
+// config files. The credentials of the first files take precedence.
+type dockerConfigs struct {
+	files []string
+}
+
+// loadDockerConfig loads the Docker config file at path, which may be in the
+// legacy format of the kubernetes.io/dockercfg secrets.
+func loadDockerConfig(path string) (*configfile.ConfigFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Base(path) == dockerCfgKey {
+		b = append(append([]byte(`{"auths":`), b...), '}')
+	}
+	return config.LoadFromReader(bytes.NewReader(b))
+}
+
+// Resolve returns the credentials of the registry of target of the first
+// config file having some, including from its credential helpers.
+func (k *dockerConfigs) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	for _, file := range k.files {
+		cf, err := loadDockerConfig(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "loading Docker config %s", file)
+		}
+		auth, err := resolveDockerConfig(cf, target)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolving credentials from %s", file)
+		}
+		if auth != nil {
+			return auth, nil
+		}
+	}
+	return authn.Anonymous, nil
+}
+
+// resolveDockerConfig returns the credentials of target in cf, those of its
+// repository or of the closest parent having some, like an Artifact Registry
+// repository, before those of its registry, or nil if it has none.
+func resolveDockerConfig(cf *configfile.ConfigFile, target authn.Resource) (authn.Authenticator, error) {
+	// The same keys as the default keychain, see
+	// https://github.com/google/go-containerregistry/issues/1510
+	var empty types.AuthConfig
+	for _, key := range authKeys(target) {
+		if key == name.DefaultRegistry {
+			key = authn.DefaultAuthKey
+		}
+		cfg, err := cf.GetAuthConfig(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting credentials of %s", key)
+		}
+		cfg.ServerAddress = ""
+		if cfg == empty {
+			continue
+		}
+		return authn.FromConfig(authn.AuthConfig{
+			Username:      cfg.Username,
+			Password:      cfg.Password,
+			Auth:          cfg.Auth,
+			IdentityToken: cfg.IdentityToken,
+			RegistryToken: cfg.RegistryToken,
+		}), nil
+	}
+	return nil, nil
+}
+
+// authKeys returns the keys of the credentials of target in the Docker
+// configs, from the most specific one to the registry
+func authKeys(target authn.Resource) []string {
+	keys := []string{target.String()}
+	for key := target.String(); ; {
+		i := strings.LastIndex(key, "/")
+		if i < 0 {
+			break
+		}
+		key = key[:i]
+		keys = append(keys, key)
+	}
+	if keys[len(keys)-1] != target.RegistryStr() {
+		keys = append(keys, target.RegistryStr())
+	}
+	return keys
+}
+
+// dockerConfigKeychain is the keychain of a Docker config held in memory
+type dockerConfigKeychain struct {
+	cf *configfile.ConfigFile
+}
+
+// NewDockerConfigKeychain returns the keychain of the credentials of the
+// Docker config.json document b, like one supplied along with a build request.
+// The credentials stay in memory, and the credential helpers are refused as
+// they would run with the credentials of the process.
+func NewDockerConfigKeychain(b []byte) (authn.Keychain, error) {
+	cf, err := config.LoadFromReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing Docker config")
+	}
+	if cf.CredentialsStore != "" || len(cf.CredentialHelpers) > 0 {
+		return nil, errors.New("credential helpers are not supported in Docker configs held in memory")
+	}
+	return &dockerConfigKeychain{cf: cf}, nil
+}
+
+// Resolve returns the credentials of the registry of target
+func (k *dockerConfigKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	auth, err := resolveDockerConfig(k.cf, target)
+	if err != nil || auth != nil {
+		return auth, err
+	}
+	return authn.Anonymous, nil
+}
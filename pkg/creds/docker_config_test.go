@@ -0,0 +1,177 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package creds
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func writeDockerConfig(t *testing.T, auths map[string]string) string {
+	dir := t.TempDir()
+	var entries []string
+	for registry, user := range auths {
+		auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + user + "-password"))
+		entries = append(entries, fmt.Sprintf("%q: {\"auth\": %q}", registry, auth))
+	}
+	content := fmt.Sprintf(`{"auths": {%s}}`, strings.Join(entries, ","))
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestDockerConfigs(t *testing.T) {
+	ci := writeDockerConfig(t, map[string]string{"registry.example.com": "ci"})
+	org := writeDockerConfig(t, map[string]string{
+		"registry.example.com":        "org",
+		"https://index.docker.io/v1/": "hub",
+	})
+	t.Setenv("DOCKER_CONFIG", strings.Join([]string{ci, filepath.Join(t.TempDir(), "missing"), org}, string(filepath.ListSeparator)))
+	SetDockerConfigDirs(nil)
+
+	tests := []struct {
+		registry string
+		want     *authn.AuthConfig
+	}{
+		{
+			registry: "registry.example.com",
+			want:     &authn.AuthConfig{Username: "ci", Password: "ci-password"},
+		},
+		{
+			registry: name.DefaultRegistry,
+			want:     &authn.AuthConfig{Username: "hub", Password: "hub-password"},
+		},
+		{
+			registry: "other.example.com",
+			want:     &authn.AuthConfig{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.registry, func(t *testing.T) {
+			reg, err := name.NewRegistry(tt.registry)
+			testutil.CheckNoError(t, err)
+			auth, err := getDockerConfigKeychain().Resolve(reg)
+			testutil.CheckNoError(t, err)
+			got, err := auth.Authorization()
+			testutil.CheckErrorAndDeepEqual(t, false, err, tt.want, got)
+		})
+	}
+
+	// The directories set with --docker-config replace those of DOCKER_CONFIG
+	SetDockerConfigDirs([]string{org})
+	defer SetDockerConfigDirs(nil)
+	reg, _ := name.NewRegistry("registry.example.com")
+	auth, err := getDockerConfigKeychain().Resolve(reg)
+	testutil.CheckNoError(t, err)
+	got, err := auth.Authorization()
+	testutil.CheckErrorAndDeepEqual(t, false, err, &authn.AuthConfig{Username: "org", Password: "org-password"}, got)
+}
+
+func TestImagePullSecrets(t *testing.T) {
+	// A kubernetes.io/dockerconfigjson secret mounted as a directory
+	mounted := writeDockerConfig(t, map[string]string{"registry.example.com": "secret"})
+	if err := os.Rename(filepath.Join(mounted, "config.json"), filepath.Join(mounted, dockerConfigJSONKey)); err != nil {
+		t.Fatal(err)
+	}
+	// A legacy kubernetes.io/dockercfg secret file
+	legacy := filepath.Join(t.TempDir(), dockerCfgKey)
+	auth := base64.StdEncoding.EncodeToString([]byte("legacy:legacy-password"))
+	if err := os.WriteFile(legacy, []byte(fmt.Sprintf(`{"registry.example.com": {"auth": %q}, "other.example.com": {"auth": %q}}`, auth, auth)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	testutil.CheckError(t, true, SetImagePullSecrets([]string{t.TempDir()}))
+	testutil.CheckNoError(t, SetImagePullSecrets([]string{mounted, legacy}))
+	defer SetImagePullSecrets(nil)
+
+	for registry, want := range map[string]*authn.AuthConfig{
+		"registry.example.com": {Username: "secret", Password: "secret-password"},
+		"other.example.com":    {Username: "legacy", Password: "legacy-password"},
+		"third.example.com":    {},
+	} {
+		reg, err := name.NewRegistry(registry)
+		testutil.CheckNoError(t, err)
+		auth, err := getPullSecretKeychain().Resolve(reg)
+		testutil.CheckNoError(t, err)
+		got, err := auth.Authorization()
+		testutil.CheckErrorAndDeepEqual(t, false, err, want, got)
+	}
+}
+
+func TestNewDockerConfigKeychain(t *testing.T) {
+	dir := writeDockerConfig(t, map[string]string{"registry.example.com": "tenant"})
+	b, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	testutil.CheckNoError(t, err)
+	k, err := NewDockerConfigKeychain(b)
+	testutil.CheckNoError(t, err)
+
+	for registry, want := range map[string]*authn.AuthConfig{
+		"registry.example.com": {Username: "tenant", Password: "tenant-password"},
+		"other.example.com":    {},
+	} {
+		reg, err := name.NewRegistry(registry)
+		testutil.CheckNoError(t, err)
+		auth, err := k.Resolve(reg)
+		testutil.CheckNoError(t, err)
+		got, err := auth.Authorization()
+		testutil.CheckErrorAndDeepEqual(t, false, err, want, got)
+	}
+
+	// The credential helpers would run with the credentials of the process
+	_, err = NewDockerConfigKeychain([]byte(`{"credsStore": "desktop"}`))
+	testutil.CheckError(t, true, err)
+	_, err = NewDockerConfigKeychain([]byte(`{"credHelpers": {"gcr.io": "gcloud"}}`))
+	testutil.CheckError(t, true, err)
+	_, err = NewDockerConfigKeychain([]byte(`{`))
+	testutil.CheckError(t, true, err)
+}
+
+func TestRepositoryScopedCredentials(t *testing.T) {
+	dir := writeDockerConfig(t, map[string]string{
+		"us-docker.pkg.dev":              "registry",
+		"us-docker.pkg.dev/prj/virtual":  "virtual",
+		"us-docker.pkg.dev/prj/standard": "standard",
+	})
+	b, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	testutil.CheckNoError(t, err)
+	k, err := NewDockerConfigKeychain(b)
+	testutil.CheckNoError(t, err)
+
+	// The credentials of the closest repository are used before those of the
+	// registry
+	for repo, user := range map[string]string{
+		"us-docker.pkg.dev/prj/virtual/library/ubuntu": "virtual",
+		"us-docker.pkg.dev/prj/standard/app":           "standard",
+		"us-docker.pkg.dev/prj/other/app":              "registry",
+	} {
+		ref, err := name.NewRepository(repo)
+		testutil.CheckNoError(t, err)
+		auth, err := k.Resolve(ref)
+		testutil.CheckNoError(t, err)
+		got, err := auth.Authorization()
+		testutil.CheckErrorAndDeepEqual(t, false, err, &authn.AuthConfig{Username: user, Password: user + "-password"}, got)
+	}
+}
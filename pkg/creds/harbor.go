@@ -0,0 +1,152 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package creds
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// harborRobotFile is a Harbor robot account, as exported to a JSON file by
+// Harbor or returned by its API when the account is created
+type harborRobotFile struct {
+	Name   string `json:"name"`
+	Secret string `json:"secret"`
+	// ExpiresAt is the Unix time the account expires at, or -1 if it never
+	// does
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// harborRobot is a robot account used for the repositories under scope, a
+// registry or a project of it
+type harborRobot struct {
+	scope string
+	auth  authn.AuthConfig
+}
+
+// harborRobots is the keychain of the Harbor robot accounts
+type harborRobots struct {
+	robots []harborRobot
+}
+
+var (
+	harborMu       sync.Mutex
+	harborKeychain authn.Keychain = &harborRobots{}
+)
+
+// LoadHarborRobotAccounts reads the Harbor robot accounts set with
+// --harbor-robot-account as registry=path or registry/project=path, path being
+// the JSON file of the account exported by Harbor, and adds them to the
+// keychain returned by GetKeychain. The accounts of a project, named like
+// robot$project+name, are only used for the repositories of the project.
+func LoadHarborRobotAccounts(accounts []string) error {
+	k := &harborRobots{}
+	for _, account := range accounts {
+		scope, path, ok := strings.Cut(account, "=")
+		if !ok || scope == "" || path == "" {
+			return fmt.Errorf("invalid Harbor robot account %q, expected registry=path", account)
+		}
+		robot, err := loadHarborRobot(strings.TrimSuffix(scope, "/"), path)
+		if err != nil {
+			return errors.Wrapf(err, "loading Harbor robot account %s", path)
+		}
+		logrus.Debugf("Using Harbor robot account %s for %s", robot.auth.Username, robot.scope)
+		k.robots = append(k.robots, robot)
+	}
+	harborMu.Lock()
+	defer harborMu.Unlock()
+	harborKeychain = k
+	return nil
+}
+
+func loadHarborRobot(scope, path string) (harborRobot, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return harborRobot{}, err
+	}
+	var f harborRobotFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return harborRobot{}, errors.Wrap(err, "parsing robot account")
+	}
+	if f.Name == "" || f.Secret == "" {
+		return harborRobot{}, errors.New("robot account has no name or secret")
+	}
+	if f.ExpiresAt > 0 && time.Unix(f.ExpiresAt, 0).Before(time.Now()) {
+		return harborRobot{}, fmt.Errorf("robot account %s expired at %s", f.Name, time.Unix(f.ExpiresAt, 0).Format(time.RFC3339))
+	}
+	reg, project, _ := strings.Cut(scope, "/")
+	registry, err := name.NewRegistry(reg, name.WeakValidation)
+	if err != nil {
+		return harborRobot{}, err
+	}
+	if project == "" {
+		project = harborRobotProject(f.Name)
+	}
+	scope = registry.RegistryStr()
+	if project != "" {
+		scope += "/" + project
+	}
+	return harborRobot{scope: scope, auth: authn.AuthConfig{Username: f.Name, Password: f.Secret}}, nil
+}
+
+// harborRobotProject returns the project of a robot account named like
+// robot$project+name, or "" for the system robot accounts named like
+// robot$name
+func harborRobotProject(robot string) string {
+	_, rest, ok := strings.Cut(robot, "$")
+	if !ok {
+		return ""
+	}
+	project, _, ok := strings.Cut(rest, "+")
+	if !ok {
+		return ""
+	}
+	return project
+}
+
+func getHarborKeychain() authn.Keychain {
+	harborMu.Lock()
+	defer harborMu.Unlock()
+	return harborKeychain
+}
+
+// Resolve returns the credentials of the robot account with the narrowest
+// scope target is under, or anonymous credentials if there is none.
+func (k *harborRobots) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	var found *harborRobot
+	for i, r := range k.robots {
+		if target.String() != r.scope && !strings.HasPrefix(target.String(), r.scope+"/") {
+			continue
+		}
+		if found == nil || len(r.scope) > len(found.scope) {
+			found = &k.robots[i]
+		}
+	}
+	if found == nil {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(found.auth), nil
+}
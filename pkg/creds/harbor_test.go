@@ -0,0 +1,67 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package creds
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func writeHarborRobot(t *testing.T, content string) string {
+	p := filepath.Join(t.TempDir(), "robot.json")
+	if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestHarborRobotAccounts(t *testing.T) {
+	system := writeHarborRobot(t, `{"id": 1, "name": "robot$ci", "secret": "system-secret", "expires_at": -1}`)
+	project := writeHarborRobot(t, `{"id": 2, "name": "robot$team+ci", "secret": "team-secret", "expires_at": 4102444800}`)
+	custom := writeHarborRobot(t, `{"name": "bot_ci", "secret": "custom-secret"}`)
+	testutil.CheckNoError(t, LoadHarborRobotAccounts([]string{
+		"harbor.example.com=" + system,
+		"harbor.example.com=" + project,
+		"harbor.example.com/other=" + custom,
+	}))
+	defer LoadHarborRobotAccounts(nil)
+
+	// The accounts of a project are used for its repositories only
+	for repo, want := range map[string]*authn.AuthConfig{
+		"harbor.example.com/team/app":       {Username: "robot$team+ci", Password: "team-secret"},
+		"harbor.example.com/team-b/app":     {Username: "robot$ci", Password: "system-secret"},
+		"harbor.example.com/other/app":      {Username: "bot_ci", Password: "custom-secret"},
+		"registry.example.com/team/app":     {},
+		"harbor.example.com/team/proxy/app": {Username: "robot$team+ci", Password: "team-secret"},
+	} {
+		ref, err := name.NewRepository(repo)
+		testutil.CheckNoError(t, err)
+		auth, err := getHarborKeychain().Resolve(ref)
+		testutil.CheckNoError(t, err)
+		got, err := auth.Authorization()
+		testutil.CheckErrorAndDeepEqual(t, false, err, want, got)
+	}
+
+	expired := writeHarborRobot(t, `{"name": "robot$team+old", "secret": "secret", "expires_at": 1}`)
+	testutil.CheckError(t, true, LoadHarborRobotAccounts([]string{"harbor.example.com=" + expired}))
+	testutil.CheckError(t, true, LoadHarborRobotAccounts([]string{system}))
+}
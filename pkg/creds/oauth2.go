@@ -0,0 +1,262 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package creds
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const (
+	// GrantClientCredentials gets tokens with the OAuth2 client credentials flow
+	GrantClientCredentials = "client_credentials"
+	// GrantDeviceCode gets tokens with the OAuth2 device authorization flow,
+	// for a user to authorize on another device
+	GrantDeviceCode = "device_code"
+
+	// defaultOAuth2Username is the username sent along the tokens to the
+	// registries by default
+	defaultOAuth2Username = "oauth2"
+)
+
+// OAuth2Config is the configuration of the OAuth2 credential sources, read from
+// the file set with --oauth2-config.
+type OAuth2Config struct {
+	Sources []OAuth2Source `json:"sources"`
+}
+
+// OAuth2Source gets tokens from an identity provider for the registries it
+// maps them to.
+type OAuth2Source struct {
+	// Registries are the hosts of the registries the tokens are used for. A
+	// host starting with *. matches its subdomains.
+	Registries []string `json:"registries"`
+	// Grant is client_credentials, the default, or device_code.
+	Grant            string   `json:"grant"`
+	TokenURL         string   `json:"tokenURL"`
+	DeviceAuthURL    string   `json:"deviceAuthURL"`
+	ClientID         string   `json:"clientID"`
+	ClientSecret     string   `json:"clientSecret"`
+	ClientSecretFile string   `json:"clientSecretFile"`
+	Scopes           []string `json:"scopes"`
+	Audience         string   `json:"audience"`
+	// Token is the token sent to the registries: access_token, the default,
+	// or the OIDC id_token.
+	Token string `json:"token"`
+	// Username is sent to the registries along the token, as password.
+	Username string `json:"username"`
+	// Bearer sends the token to the registries as a bearer token instead.
+	Bearer bool `json:"bearer"`
+}
+
+var (
+	oauth2Mu       sync.Mutex
+	oauth2Keychain authn.Keychain = &oauth2Sources{}
+)
+
+// LoadOAuth2Config reads the OAuth2 credential sources configured at path, and
+// adds them to the keychain returned by GetKeychain. They take precedence over
+// the other credentials of their registries.
+func LoadOAuth2Config(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "reading OAuth2 config %s", path)
+	}
+	var c OAuth2Config
+	if err := json.Unmarshal(b, &c); err != nil {
+		return errors.Wrapf(err, "parsing OAuth2 config %s", path)
+	}
+	k, err := newOAuth2Sources(c)
+	if err != nil {
+		return errors.Wrapf(err, "invalid OAuth2 config %s", path)
+	}
+	oauth2Mu.Lock()
+	defer oauth2Mu.Unlock()
+	oauth2Keychain = k
+	return nil
+}
+
+func getOAuth2Keychain() authn.Keychain {
+	oauth2Mu.Lock()
+	defer oauth2Mu.Unlock()
+	return oauth2Keychain
+}
+
+// oauth2Sources is the keychain of the OAuth2 credential sources
+type oauth2Sources struct {
+	sources []*oauth2Source
+}
+
+type oauth2Source struct {
+	OAuth2Source
+
+	mu     sync.Mutex
+	tokens oauth2.TokenSource
+	// newTokens returns the source of the tokens, once they are needed
+	newTokens func(ctx context.Context) (oauth2.TokenSource, error)
+}
+
+func newOAuth2Sources(c OAuth2Config) (*oauth2Sources, error) {
+	k := &oauth2Sources{}
+	for i, s := range c.Sources {
+		if len(s.Registries) == 0 {
+			return nil, fmt.Errorf("source %d: no registries", i)
+		}
+		if s.TokenURL == "" || s.ClientID == "" {
+			return nil, fmt.Errorf("source %d: tokenURL and clientID are required", i)
+		}
+		if s.ClientSecretFile != "" {
+			secret, err := os.ReadFile(s.ClientSecretFile)
+			if err != nil {
+				return nil, errors.Wrapf(err, "source %d: reading client secret", i)
+			}
+			s.ClientSecret = strings.TrimSpace(string(secret))
+		}
+		if s.Token != "" && s.Token != "access_token" && s.Token != "id_token" {
+			return nil, fmt.Errorf("source %d: invalid token %q, must be access_token or id_token", i, s.Token)
+		}
+		if s.Username == "" {
+			s.Username = defaultOAuth2Username
+		}
+
+		src := &oauth2Source{OAuth2Source: s}
+		var params url.Values
+		if s.Audience != "" {
+			params = url.Values{"audience": {s.Audience}}
+		}
+		switch s.Grant {
+		case "", GrantClientCredentials:
+			cfg := &clientcredentials.Config{
+				ClientID:       s.ClientID,
+				ClientSecret:   s.ClientSecret,
+				TokenURL:       s.TokenURL,
+				Scopes:         s.Scopes,
+				EndpointParams: params,
+			}
+			src.newTokens = func(ctx context.Context) (oauth2.TokenSource, error) {
+				return cfg.TokenSource(ctx), nil
+			}
+		case GrantDeviceCode:
+			if s.DeviceAuthURL == "" {
+				return nil, fmt.Errorf("source %d: deviceAuthURL is required by the %s grant", i, GrantDeviceCode)
+			}
+			src.newTokens = deviceTokens(s, params)
+		default:
+			return nil, fmt.Errorf("source %d: invalid grant %q, must be %s or %s", i, s.Grant, GrantClientCredentials, GrantDeviceCode)
+		}
+		k.sources = append(k.sources, src)
+	}
+	return k, nil
+}
+
+// deviceTokens returns the tokens of the user authorizing kaniko with the
+// device authorization flow, refreshed as long as the identity provider allows.
+func deviceTokens(s OAuth2Source, params url.Values) func(ctx context.Context) (oauth2.TokenSource, error) {
+	cfg := &oauth2.Config{
+		ClientID:     s.ClientID,
+		ClientSecret: s.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			TokenURL:      s.TokenURL,
+			DeviceAuthURL: s.DeviceAuthURL,
+		},
+		Scopes: s.Scopes,
+	}
+	var opts []oauth2.AuthCodeOption
+	for k := range params {
+		opts = append(opts, oauth2.SetAuthURLParam(k, params.Get(k)))
+	}
+	return func(ctx context.Context) (oauth2.TokenSource, error) {
+		auth, err := cfg.DeviceAuth(ctx, opts...)
+		if err != nil {
+			return nil, errors.Wrap(err, "starting device authorization")
+		}
+		if auth.VerificationURIComplete != "" {
+			logrus.Warnf("To authorize kaniko to access %s, visit %s", strings.Join(s.Registries, ", "), auth.VerificationURIComplete)
+		} else {
+			logrus.Warnf("To authorize kaniko to access %s, visit %s and enter the code %s", strings.Join(s.Registries, ", "), auth.VerificationURI, auth.UserCode)
+		}
+		tok, err := cfg.DeviceAccessToken(ctx, auth, opts...)
+		if err != nil {
+			return nil, errors.Wrap(err, "waiting for device authorization")
+		}
+		return cfg.TokenSource(ctx, tok), nil
+	}
+}
+
+// Resolve returns the credentials of the source of the registry of target, or
+// anonymous credentials if there is none.
+func (k *oauth2Sources) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	for _, s := range k.sources {
+		if s.matches(target.RegistryStr()) {
+			return s, nil
+		}
+	}
+	return authn.Anonymous, nil
+}
+
+func (s *oauth2Source) matches(registry string) bool {
+	for _, r := range s.Registries {
+		if r == registry {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(r, "*"); ok && strings.HasPrefix(suffix, ".") && strings.HasSuffix(registry, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorization returns the credentials of a token of the source, getting a
+// new one if it expired.
+func (s *oauth2Source) Authorization() (*authn.AuthConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tokens == nil {
+		tokens, err := s.newTokens(context.Background())
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting token from %s", s.TokenURL)
+		}
+		s.tokens = tokens
+	}
+	tok, err := s.tokens.Token()
+	if err != nil {
+		return nil, errors.Wrapf(err, "getting token from %s", s.TokenURL)
+	}
+	token := tok.AccessToken
+	if s.Token == "id_token" {
+		id, ok := tok.Extra("id_token").(string)
+		if !ok || id == "" {
+			return nil, fmt.Errorf("no id_token in the token from %s", s.TokenURL)
+		}
+		token = id
+	}
+	if s.Bearer {
+		return &authn.AuthConfig{RegistryToken: token}, nil
+	}
+	return &authn.AuthConfig{Username: s.Username, Password: token}, nil
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2022 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package creds
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func newIdP(t *testing.T) *httptest.Server {
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/device":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"device_code":      "device",
+				"user_code":        "ABCD-EFGH",
+				"verification_uri": "https://idp.example.com/activate",
+				"interval":         1,
+			})
+		case "/token":
+			token := r.Form.Get("grant_type") + ":" + r.Form.Get("audience")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": token,
+				"id_token":     "id:" + token,
+				"token_type":   "Bearer",
+				"expires_in":   3600,
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func TestOAuth2Sources(t *testing.T) {
+	idp := newIdP(t)
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := newOAuth2Sources(OAuth2Config{Sources: []OAuth2Source{
+		{
+			Registries:       []string{"registry.example.com"},
+			TokenURL:         idp.URL + "/token",
+			ClientID:         "kaniko",
+			ClientSecretFile: secret,
+			Audience:         "registry",
+		},
+		{
+			Registries: []string{"*.corp.example.com"},
+			TokenURL:   idp.URL + "/token",
+			ClientID:   "kaniko",
+			Token:      "id_token",
+			Bearer:     true,
+		},
+		{
+			Registries:    []string{"device.example.com:5000"},
+			Grant:         GrantDeviceCode,
+			TokenURL:      idp.URL + "/token",
+			DeviceAuthURL: idp.URL + "/device",
+			ClientID:      "kaniko",
+			Username:      "user",
+		},
+	}})
+	testutil.CheckNoError(t, err)
+
+	tests := []struct {
+		registry string
+		want     *authn.AuthConfig
+	}{
+		{
+			registry: "registry.example.com",
+			want:     &authn.AuthConfig{Username: "oauth2", Password: "client_credentials:registry"},
+		},
+		{
+			registry: "harbor.corp.example.com",
+			want:     &authn.AuthConfig{RegistryToken: "id:client_credentials:"},
+		},
+		{
+			registry: "device.example.com:5000",
+			want:     &authn.AuthConfig{Username: "user", Password: "urn:ietf:params:oauth:grant-type:device_code:"},
+		},
+		{
+			registry: "corp.example.com",
+			want:     &authn.AuthConfig{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.registry, func(t *testing.T) {
+			reg, err := name.NewRegistry(tt.registry)
+			testutil.CheckNoError(t, err)
+			auth, err := k.Resolve(reg)
+			testutil.CheckNoError(t, err)
+			got, err := auth.Authorization()
+			testutil.CheckErrorAndDeepEqual(t, false, err, tt.want, got)
+		})
+	}
+}
+
+func TestOAuth2SourcesInvalid(t *testing.T) {
+	for name, s := range map[string]OAuth2Source{
+		"no registries":  {TokenURL: "https://idp/token", ClientID: "kaniko"},
+		"no token url":   {Registries: []string{"r"}, ClientID: "kaniko"},
+		"invalid grant":  {Registries: []string{"r"}, TokenURL: "https://idp/token", ClientID: "kaniko", Grant: "password"},
+		"no device url":  {Registries: []string{"r"}, TokenURL: "https://idp/token", ClientID: "kaniko", Grant: GrantDeviceCode},
+		"invalid token":  {Registries: []string{"r"}, TokenURL: "https://idp/token", ClientID: "kaniko", Token: "refresh_token"},
+		"missing secret": {Registries: []string{"r"}, TokenURL: "https://idp/token", ClientID: "kaniko", ClientSecretFile: "/does/not/exist"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := newOAuth2Sources(OAuth2Config{Sources: []OAuth2Source{s}})
+			testutil.CheckError(t, true, err)
+		})
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	units "github.com/docker/go-units"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/pkg/errors"
+)
+
+// budgetDirective starts the comments declaring the budget of the stage of
+// the FROM instruction they precede, like
+//
+//	# kaniko-budget: duration=10m snapshot-size=2GB
+const budgetDirective = "kaniko-budget:"
+
+// budgetComments returns the budgets declared in the comments preceding the
+// FROM instructions of the Dockerfile d, keyed by the line of the FROM
+// instruction
+func budgetComments(d []byte) (map[int]string, error) {
+	p, err := parser.Parse(bytes.NewReader(d))
+	if err != nil {
+		return nil, err
+	}
+	comments := map[int]string{}
+	for _, node := range p.AST.Children {
+		if !strings.EqualFold(node.Value, "from") {
+			continue
+		}
+		for _, c := range node.PrevComment {
+			if budget, ok := strings.CutPrefix(c, budgetDirective); ok {
+				comments[node.StartLine] = strings.TrimSpace(budget)
+			}
+		}
+	}
+	return comments, nil
+}
+
+// parseBudget parses the budget declared as space separated duration=10m and
+// snapshot-size=2GB settings into budget
+func parseBudget(declared string, budget *config.StageBudget) error {
+	for _, setting := range strings.Fields(declared) {
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			return fmt.Errorf("invalid budget %q, must be duration=<duration> or snapshot-size=<size>", setting)
+		}
+		switch key {
+		case "duration":
+			d, err := parseBudgetDuration(value)
+			if err != nil {
+				return err
+			}
+			budget.MaxDuration = d
+		case "snapshot-size":
+			size, err := parseBudgetSize(value)
+			if err != nil {
+				return err
+			}
+			budget.MaxSnapshotSize = size
+		default:
+			return fmt.Errorf("unknown budget %q, must be duration or snapshot-size", key)
+		}
+	}
+	return nil
+}
+
+func parseBudgetDuration(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration budget %q, must be a positive duration like 10m", value)
+	}
+	return d, nil
+}
+
+func parseBudgetSize(value string) (int64, error) {
+	size, err := units.RAMInBytes(value)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid snapshot size budget %q, must be a positive size like 2GB", value)
+	}
+	return size, nil
+}
+
+// stageBudget returns the budget of the stage at index. The limits set for all
+// the stages by the flags are overridden by the ones declared in the comments
+// of the stage, themselves overridden by the ones set for the stage by the
+// flags, as stage=limit with the name or the index of the stage.
+func stageBudget(opts *config.KanikoOptions, stage instructions.Stage, index int) (config.StageBudget, error) {
+	var budget config.StageBudget
+	for _, l := range opts.StageMaxDurations {
+		if !strings.Contains(l, "=") {
+			d, err := parseBudgetDuration(l)
+			if err != nil {
+				return budget, err
+			}
+			budget.MaxDuration = d
+		}
+	}
+	for _, l := range opts.StageMaxSnapshotSizes {
+		if !strings.Contains(l, "=") {
+			size, err := parseBudgetSize(l)
+			if err != nil {
+				return budget, err
+			}
+			budget.MaxSnapshotSize = size
+		}
+	}
+
+	if len(stage.Location) > 0 {
+		if declared, ok := opts.StageBudgetComments[stage.Location[0].Start.Line]; ok {
+			if err := parseBudget(declared, &budget); err != nil {
+				return budget, errors.Wrapf(err, "parsing the budget of stage %s", stageRef(stage, index))
+			}
+		}
+	}
+
+	for _, l := range opts.StageMaxDurations {
+		if ref, value, ok := strings.Cut(l, "="); ok && matchesStage(ref, stage, index) {
+			d, err := parseBudgetDuration(value)
+			if err != nil {
+				return budget, err
+			}
+			budget.MaxDuration = d
+		}
+	}
+	for _, l := range opts.StageMaxSnapshotSizes {
+		if ref, value, ok := strings.Cut(l, "="); ok && matchesStage(ref, stage, index) {
+			size, err := parseBudgetSize(value)
+			if err != nil {
+				return budget, err
+			}
+			budget.MaxSnapshotSize = size
+		}
+	}
+	return budget, nil
+}
+
+// matchesStage returns true if ref is the name or the index of the stage at
+// index
+func matchesStage(ref string, stage instructions.Stage, index int) bool {
+	if stage.Name != "" && strings.EqualFold(ref, stage.Name) {
+		return true
+	}
+	return ref == strconv.Itoa(index)
+}
+
+// stageRef returns the name of the stage at index, or its index if unnamed
+func stageRef(stage instructions.Stage, index int) string {
+	if stage.Name != "" {
+		return stage.Name
+	}
+	return strconv.Itoa(index)
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestStageBudget(t *testing.T) {
+	d := []byte(`FROM scratch AS base
+
+# Builds the binaries
+# kaniko-budget: duration=10m snapshot-size=2GB
+FROM golang AS build
+RUN make
+
+# kaniko-budget: duration=1m
+FROM base
+`)
+	comments, err := budgetComments(d)
+	testutil.CheckErrorAndDeepEqual(t, false, err, map[int]string{
+		5: "duration=10m snapshot-size=2GB",
+		9: "duration=1m",
+	}, comments)
+	stages, _, err := Parse(d)
+	testutil.CheckNoError(t, err)
+
+	tests := []struct {
+		name      string
+		durations []string
+		sizes     []string
+		expected  []config.StageBudget
+	}{
+		{
+			name: "comments",
+			expected: []config.StageBudget{
+				{},
+				{MaxDuration: 10 * time.Minute, MaxSnapshotSize: 2 * 1024 * 1024 * 1024},
+				{MaxDuration: time.Minute},
+			},
+		},
+		{
+			name:      "flags",
+			durations: []string{"5m", "build=20m", "2=30s"},
+			sizes:     []string{"1GB", "base=1MB"},
+			expected: []config.StageBudget{
+				{MaxDuration: 5 * time.Minute, MaxSnapshotSize: 1024 * 1024},
+				{MaxDuration: 20 * time.Minute, MaxSnapshotSize: 2 * 1024 * 1024 * 1024},
+				{MaxDuration: 30 * time.Second, MaxSnapshotSize: 1024 * 1024 * 1024},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := &config.KanikoOptions{
+				StageMaxDurations:     test.durations,
+				StageMaxSnapshotSizes: test.sizes,
+				StageBudgetComments:   comments,
+			}
+			for i, stage := range stages {
+				budget, err := stageBudget(opts, stage, i)
+				testutil.CheckErrorAndDeepEqual(t, false, err, test.expected[i], budget)
+			}
+		})
+	}
+
+	for _, opts := range []*config.KanikoOptions{
+		{StageMaxDurations: []string{"-1m"}},
+		{StageMaxSnapshotSizes: []string{"build=lots"}},
+		{StageBudgetComments: map[int]string{5: "memory=1GB"}},
+	} {
+		_, err := stageBudget(opts, stages[1], 1)
+		testutil.CheckError(t, true, err)
+	}
+}
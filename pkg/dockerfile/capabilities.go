@@ -0,0 +1,305 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/sirupsen/logrus"
+)
+
+// Feature is a Dockerfile feature used at a given line of the Dockerfile
+type Feature struct {
+	Line        int
+	Instruction string
+	Name        string
+}
+
+func (f Feature) String() string {
+	return fmt.Sprintf("line %d: %s %s", f.Line, strings.ToUpper(f.Instruction), f.Name)
+}
+
+// CapabilityReport lists the Dockerfile features kaniko cannot honor
+type CapabilityReport struct {
+	// Syntax is the frontend declared with the `# syntax=` directive, if any
+	Syntax string
+	// Unsupported features make the build fail, kaniko cannot produce the
+	// image the Dockerfile describes
+	Unsupported []Feature
+	// Ignored features are skipped, the resulting image is the same but the
+	// build may behave differently than with BuildKit
+	Ignored []Feature
+}
+
+// Err returns an error describing every unsupported feature, or nil if the
+// Dockerfile can be built
+func (r *CapabilityReport) Err() error {
+	if len(r.Unsupported) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString("dockerfile uses features not supported by kaniko:")
+	for _, f := range r.Unsupported {
+		b.WriteString("\n  ")
+		b.WriteString(f.String())
+	}
+	return fmt.Errorf("%s", b.String())
+}
+
+// instruction flags kaniko is unable to honor, keyed by instruction
+var unsupportedFlags = map[string][]string{
+	"run": {"device"},
+	"add": {"exclude", "checksum", "unpack"},
+}
+
+// instruction flags kaniko skips, keyed by instruction
+var ignoredFlags = map[string][]string{
+	"run": {"security"},
+	"add": {"link"},
+}
+
+// instructions for which heredocs are not supported
+var unsupportedHeredocs = map[string]bool{
+	"add": true,
+}
+
+// dockerfileFrontends are the frontend images implementing the Dockerfile
+// syntax kaniko understands
+var dockerfileFrontends = []string{
+	"docker/dockerfile",
+	"docker/dockerfile-upstream",
+}
+
+// frontendFeature is a feature of the Dockerfile syntax added by a version of
+// the docker/dockerfile frontend
+type frontendFeature struct {
+	instruction string
+	// flag is the flag of the instruction, or empty for heredocs
+	flag string
+	// stable is the first stable version supporting the feature, if any
+	stable string
+	// labs is the first -labs version supporting the feature
+	labs string
+}
+
+// frontendFeatures are the features the Dockerfiles declaring an older syntax
+// cannot use, like BuildKit which does not parse them with older frontends
+var frontendFeatures = []frontendFeature{
+	{instruction: "run", flag: "mount", stable: "1.2", labs: "1.2"},
+	{instruction: "run", flag: "network", stable: "1.3", labs: "1.3"},
+	{instruction: "copy", flag: "link", stable: "1.4", labs: "1.4"},
+	{instruction: "add", flag: "link", stable: "1.4", labs: "1.4"},
+	{instruction: "run", stable: "1.4", labs: "1.3"},
+	{instruction: "copy", stable: "1.4", labs: "1.3"},
+	{instruction: "copy", flag: "parents", labs: "1.7"},
+	{instruction: "copy", flag: "exclude", labs: "1.7"},
+}
+
+// frontendVersionRegexp matches the tags of the frontend pinning a minor
+// version, like 1.4, 1.4.3 or 1.7-labs
+var frontendVersionRegexp = regexp.MustCompile(`^(\d+)\.(\d+)(?:\.\d+)?(-labs)?$`)
+
+// frontendVersion is a version of the docker/dockerfile frontend
+type frontendVersion struct {
+	major, minor int
+	labs         bool
+}
+
+// parseFrontendVersion returns the version of the docker/dockerfile frontend
+// syntax refers to, if it pins a minor version. The floating tags, like 1 or
+// latest, refer to the latest frontend, which supports every feature.
+func parseFrontendVersion(syntax string) (frontendVersion, bool) {
+	ref := syntax
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+	i := strings.LastIndex(ref, ":")
+	if i < 0 {
+		return frontendVersion{}, false
+	}
+	m := frontendVersionRegexp.FindStringSubmatch(ref[i+1:])
+	if m == nil {
+		return frontendVersion{}, false
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return frontendVersion{major: major, minor: minor, labs: m[3] != ""}, true
+}
+
+// atLeast returns true if v is version, as major.minor, or newer
+func (v frontendVersion) atLeast(version string) bool {
+	major, minor, _ := strings.Cut(version, ".")
+	ma, _ := strconv.Atoi(major)
+	mi, _ := strconv.Atoi(minor)
+	return v.major > ma || (v.major == ma && v.minor >= mi)
+}
+
+// supports returns true if the frontend version v supports f
+func (v frontendVersion) supports(f frontendFeature) bool {
+	if v.labs && v.atLeast(f.labs) {
+		return true
+	}
+	return f.stable != "" && v.atLeast(f.stable)
+}
+
+// requirement describes the versions of the frontend supporting f
+func (f frontendFeature) requirement() string {
+	if f.stable == "" {
+		return fmt.Sprintf("docker/dockerfile:%s-labs or later", f.labs)
+	}
+	return fmt.Sprintf("docker/dockerfile:%s or later", f.stable)
+}
+
+// CheckCapabilities reports the features used by the Dockerfile content d that
+// kaniko cannot honor, along with the line they are used at.
+func CheckCapabilities(d []byte) (*CapabilityReport, error) {
+	report := &CapabilityReport{}
+	var version frontendVersion
+	versioned := false
+	if syntax, _, loc, ok := parser.DetectSyntax(d); ok {
+		report.Syntax = syntax
+		if isDockerfileFrontend(syntax) {
+			version, versioned = parseFrontendVersion(syntax)
+		} else {
+			line := 1
+			if len(loc) > 0 {
+				line = loc[0].Start.Line
+			}
+			report.Unsupported = append(report.Unsupported, Feature{
+				Line:        line,
+				Instruction: "#",
+				Name:        fmt.Sprintf("syntax=%s (only the docker/dockerfile frontend is supported)", syntax),
+			})
+		}
+	}
+
+	p, err := parser.Parse(bytes.NewReader(d))
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range p.AST.Children {
+		instruction := strings.ToLower(node.Value)
+		for _, flag := range node.Flags {
+			flag = strings.TrimPrefix(flag, "--")
+			if strings.HasPrefix(flag, "mount=") && !strings.Contains(flag, "type=") {
+				// mounts are bind mounts unless specified otherwise
+				flag += ",type=bind"
+			}
+			f := Feature{Line: node.StartLine, Instruction: instruction, Name: "--" + flag}
+			if matchesFlag(flag, unsupportedFlags[instruction]) {
+				report.Unsupported = append(report.Unsupported, f)
+			} else if matchesFlag(flag, ignoredFlags[instruction]) {
+				report.Ignored = append(report.Ignored, f)
+			}
+		}
+		if len(node.Heredocs) > 0 && unsupportedHeredocs[instruction] {
+			report.Unsupported = append(report.Unsupported, Feature{
+				Line:        node.StartLine,
+				Instruction: instruction,
+				Name:        "<<" + node.Heredocs[0].Name + " (heredoc)",
+			})
+		}
+		if versioned {
+			report.Unsupported = append(report.Unsupported, unsupportedByFrontend(node, instruction, version, report.Syntax)...)
+		}
+	}
+	return report, nil
+}
+
+// unsupportedByFrontend returns the features of the instruction node the
+// frontend version declared with the syntax directive doesn't support
+func unsupportedByFrontend(node *parser.Node, instruction string, version frontendVersion, syntax string) []Feature {
+	var unsupported []Feature
+	for _, f := range frontendFeatures {
+		if f.instruction != instruction || version.supports(f) {
+			continue
+		}
+		name := ""
+		if f.flag == "" && len(node.Heredocs) > 0 {
+			name = "<<" + node.Heredocs[0].Name + " (heredoc)"
+		}
+		for _, flag := range node.Flags {
+			flag = strings.TrimPrefix(flag, "--")
+			if f.flag != "" && matchesFlag(flag, []string{f.flag}) {
+				name = "--" + flag
+			}
+		}
+		if name == "" {
+			continue
+		}
+		unsupported = append(unsupported, Feature{
+			Line:        node.StartLine,
+			Instruction: instruction,
+			Name:        fmt.Sprintf("%s (requires syntax %s, not %s)", name, f.requirement(), syntax),
+		})
+	}
+	return unsupported
+}
+
+// Log prints the features kaniko ignores as warnings
+func (r *CapabilityReport) Log() {
+	if r.Syntax != "" {
+		logrus.Infof("Dockerfile declares syntax %s, building with kaniko's built-in Dockerfile frontend", r.Syntax)
+	}
+	for _, f := range r.Ignored {
+		logrus.Warnf("Ignoring unsupported Dockerfile feature at %s", f)
+	}
+}
+
+// matchesFlag returns true if flag, without its leading dashes, matches one of
+// the patterns. A pattern matches a flag of the same name, or a flag whose
+// comma separated value contains the pattern's value (e.g. "mount=type=secret"
+// matches "mount=type=secret,id=foo").
+func matchesFlag(flag string, patterns []string) bool {
+	name, value, _ := strings.Cut(flag, "=")
+	for _, p := range patterns {
+		pName, pValue, hasValue := strings.Cut(p, "=")
+		if name != pName {
+			continue
+		}
+		if !hasValue {
+			return true
+		}
+		for _, field := range strings.Split(value, ",") {
+			if field == pValue {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isDockerfileFrontend(syntax string) bool {
+	ref := strings.TrimPrefix(strings.TrimPrefix(syntax, "docker.io/"), "index.docker.io/")
+	if i := strings.Index(ref, "@"); i >= 0 {
+		ref = ref[:i]
+	}
+	if i := strings.LastIndex(ref, ":"); i >= 0 {
+		ref = ref[:i]
+	}
+	for _, f := range dockerfileFrontends {
+		if ref == f {
+			return true
+		}
+	}
+	return false
+}
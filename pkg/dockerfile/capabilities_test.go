@@ -0,0 +1,123 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestCheckCapabilities(t *testing.T) {
+	tests := []struct {
+		name                string
+		dockerfile          string
+		expectedSyntax      string
+		expectedUnsupported []string
+		expectedIgnored     []string
+	}{
+		{
+			name:       "supported dockerfile",
+			dockerfile: "FROM alpine\nCOPY --chown=1000 foo /foo\nRUN echo hi\n",
+		},
+		{
+			name:           "dockerfile frontend",
+			dockerfile:     "# syntax=docker/dockerfile:1.7\nFROM alpine\n",
+			expectedSyntax: "docker/dockerfile:1.7",
+		},
+		{
+			name:                "custom frontend",
+			dockerfile:          "# syntax=example.com/custom/frontend:1\nFROM alpine\n",
+			expectedSyntax:      "example.com/custom/frontend:1",
+			expectedUnsupported: []string{"line 1: # syntax=example.com/custom/frontend:1 (only the docker/dockerfile frontend is supported)"},
+		},
+		{
+			name: "unsupported and ignored flags",
+			dockerfile: `FROM alpine
+RUN --mount=type=cache,target=/root/.cache echo cache
+RUN --mount=type=secret,id=token cat /run/secrets/token
+RUN --mount=target=/src make
+ADD --link foo /foo
+ADD --exclude=*.md a/b /c
+`,
+			expectedUnsupported: []string{
+				"line 6: ADD --exclude=*.md",
+			},
+			expectedIgnored: []string{
+				"line 5: ADD --link",
+			},
+		},
+		{
+			name: "features newer than the declared syntax",
+			dockerfile: `# syntax=docker/dockerfile:1.2
+FROM alpine
+RUN --mount=type=cache,target=/root/.cache --network=none echo hi
+COPY --link foo /foo
+RUN <<EOF
+echo hi
+EOF
+`,
+			expectedSyntax: "docker/dockerfile:1.2",
+			expectedUnsupported: []string{
+				"line 3: RUN --network=none (requires syntax docker/dockerfile:1.3 or later, not docker/dockerfile:1.2)",
+				"line 4: COPY --link (requires syntax docker/dockerfile:1.4 or later, not docker/dockerfile:1.2)",
+				"line 5: RUN <<EOF (heredoc) (requires syntax docker/dockerfile:1.4 or later, not docker/dockerfile:1.2)",
+			},
+		},
+		{
+			name:           "labs features",
+			dockerfile:     "# syntax=docker/dockerfile:1.7-labs\nFROM alpine\nCOPY --parents --exclude=*.md ./a/ /b/\nCOPY <<EOF /hi\nhi\nEOF\n",
+			expectedSyntax: "docker/dockerfile:1.7-labs",
+		},
+		{
+			name:           "labs features with a stable syntax",
+			dockerfile:     "# syntax=docker/dockerfile:1.7.1\nFROM alpine\nCOPY --parents ./a/ /b/\n",
+			expectedSyntax: "docker/dockerfile:1.7.1",
+			expectedUnsupported: []string{
+				"line 3: COPY --parents (requires syntax docker/dockerfile:1.7-labs or later, not docker/dockerfile:1.7.1)",
+			},
+		},
+		{
+			name:           "floating syntax",
+			dockerfile:     "# syntax=docker/dockerfile:1\nFROM alpine\nCOPY --parents ./a/ /b/\nRUN <<EOF\necho hi\nEOF\n",
+			expectedSyntax: "docker/dockerfile:1",
+		},
+		{
+			name:                "heredoc",
+			dockerfile:          "FROM alpine\nRUN <<EOF\necho hi\nEOF\nCOPY <<EOF /hi\nhi\nEOF\nADD <<EOF /hi\nhi\nEOF\n",
+			expectedUnsupported: []string{"line 8: ADD <<EOF (heredoc)"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			report, err := CheckCapabilities([]byte(test.dockerfile))
+			testutil.CheckError(t, false, err)
+			testutil.CheckDeepEqual(t, test.expectedSyntax, report.Syntax)
+			testutil.CheckDeepEqual(t, test.expectedUnsupported, featureStrings(report.Unsupported))
+			testutil.CheckDeepEqual(t, test.expectedIgnored, featureStrings(report.Ignored))
+			testutil.CheckDeepEqual(t, len(test.expectedUnsupported) > 0, report.Err() != nil)
+		})
+	}
+}
+
+func featureStrings(features []Feature) []string {
+	var s []string
+	for _, f := range features {
+		s = append(s, f.String())
+	}
+	return s
+}
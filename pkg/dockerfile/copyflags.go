@@ -0,0 +1,92 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+// copyFlags are the flags of a COPY instruction the parser only accepts when
+// built with the dfparents and dfexcludepatterns tags
+type copyFlags struct {
+	parents  bool
+	excludes []string
+}
+
+// stripCopyFlags removes the --parents and --exclude flags of the COPY
+// instructions of ast, and returns them keyed by the line of the instructions
+// they are set for.
+func stripCopyFlags(ast *parser.Node) (map[int]*copyFlags, error) {
+	lines := map[int]*copyFlags{}
+	for _, node := range ast.Children {
+		if !strings.EqualFold(node.Value, "copy") {
+			continue
+		}
+		var flags []string
+		f := &copyFlags{}
+		for _, flag := range node.Flags {
+			name, value, hasValue := strings.Cut(strings.TrimPrefix(flag, "--"), "=")
+			switch name {
+			case "parents":
+				switch {
+				case !hasValue || strings.EqualFold(value, "true"):
+					f.parents = true
+				case strings.EqualFold(value, "false"):
+				default:
+					return nil, fmt.Errorf("line %d: invalid value %q of --parents, expected true or false", node.StartLine, value)
+				}
+			case "exclude":
+				if value == "" {
+					return nil, fmt.Errorf("line %d: missing pattern of --exclude", node.StartLine)
+				}
+				f.excludes = append(f.excludes, value)
+			default:
+				flags = append(flags, flag)
+			}
+		}
+		node.Flags = flags
+		if f.parents || len(f.excludes) > 0 {
+			lines[node.StartLine] = f
+		}
+	}
+	return lines, nil
+}
+
+// setCopyFlags sets the flags returned by stripCopyFlags to the COPY commands
+// of cmds starting at their lines.
+func setCopyFlags(cmds []instructions.Command, lines map[int]*copyFlags) {
+	if len(lines) == 0 {
+		return
+	}
+	for _, cmd := range cmds {
+		c, ok := cmd.(*instructions.CopyCommand)
+		if !ok {
+			continue
+		}
+		loc := c.Location()
+		if len(loc) == 0 || lines[loc[0].Start.Line] == nil {
+			continue
+		}
+		f := lines[loc[0].Start.Line]
+		c.Parents = f.parents
+		c.ExcludePatterns = f.excludes
+	}
+}
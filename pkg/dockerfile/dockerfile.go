@@ -18,56 +18,140 @@ package dockerfile
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
-	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/sirupsen/logrus"
 
 	"github.com/chainguard-dev/kaniko/pkg/config"
 	"github.com/chainguard-dev/kaniko/pkg/util"
+	"github.com/containerd/containerd/platforms"
 	"github.com/moby/buildkit/frontend/dockerfile/instructions"
 	"github.com/moby/buildkit/frontend/dockerfile/linter"
 	"github.com/moby/buildkit/frontend/dockerfile/parser"
 	"github.com/pkg/errors"
 )
 
-func ParseStages(opts *config.KanikoOptions) ([]instructions.Stage, []instructions.ArgCommand, error) {
-	var err error
-	var d []uint8
-	match, _ := regexp.MatchString("^https?://", opts.DockerfilePath)
-	if match {
-		response, e := http.Get(opts.DockerfilePath) //nolint:noctx
-		if e != nil {
-			return nil, nil, e
-		}
-		d, err = io.ReadAll(response.Body)
-	} else {
-		d, err = os.ReadFile(opts.DockerfilePath)
+// dockerfileFetchTimeout is how long fetching a remote Dockerfile may take,
+// for a stalled server not to hang the build
+var dockerfileFetchTimeout = 2 * time.Minute
+
+// ReadDockerfile returns the content of the Dockerfile at path, which is either
+// a local file or a http(s) URL. The headers are added to the request made for
+// a URL, which allows fetching Dockerfiles from locations requiring authentication.
+func ReadDockerfile(path string, headers map[string]string) ([]byte, error) {
+	if !isURL(path) {
+		return os.ReadFile(path)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dockerfileFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	response, err := util.HTTPClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status from server: %s", response.Status)
 	}
+	return io.ReadAll(response.Body)
+}
 
+func ParseStages(opts *config.KanikoOptions) ([]instructions.Stage, []instructions.ArgCommand, error) {
+	d, err := ReadDockerfile(opts.DockerfilePath, opts.DockerfileHeaders)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, fmt.Sprintf("reading dockerfile at path %s", opts.DockerfilePath))
 	}
 
+	d, opts.ResolvedDockerfileFragments, err = resolveFragments(d, opts)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "resolving dockerfile fragments")
+	}
+
+	report, err := CheckCapabilities(d)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parsing dockerfile")
+	}
+	report.Log()
+	if err := report.Err(); err != nil {
+		return nil, nil, err
+	}
+
 	stages, metaArgs, err := Parse(d)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "parsing dockerfile")
 	}
+	opts.StageBudgetComments, err = budgetComments(d)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parsing dockerfile")
+	}
+	opts.NoCacheLines, err = noCacheLines(d)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parsing dockerfile")
+	}
+	opts.EscapeToken, err = escapeToken(d)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "parsing dockerfile")
+	}
+	if opts.Modernize {
+		rewrites, err := modernize(d, stages)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "modernizing dockerfile")
+		}
+		for _, r := range rewrites {
+			logrus.Warnf("Modernized deprecated instruction at %s", r)
+		}
+	}
 
-	metaArgs, err = expandNestedArgs(metaArgs, opts.BuildArgs)
+	metaArgs, err = resolveMetaArgs(metaArgs, opts.BuildArgs, opts.CustomPlatform)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "expanding meta ARGs")
+		return nil, nil, err
 	}
 
 	return stages, metaArgs, nil
 }
 
+// resolveMetaArgs adds the automatic platform ARGs of targetPlatform to the
+// global ARGs metaArgs, and expands the ARGs referencing the previous ones
+func resolveMetaArgs(metaArgs []instructions.ArgCommand, buildArgs []string, targetPlatform string) ([]instructions.ArgCommand, error) {
+	platformArgs, err := PlatformArgs(targetPlatform)
+	if err != nil {
+		return nil, err
+	}
+	metaArgs = AddAutomaticArgs(metaArgs, platformArgs)
+
+	metaArgs, err = expandNestedArgs(metaArgs, buildArgs)
+	if err != nil {
+		return nil, errors.Wrap(err, "expanding meta ARGs")
+	}
+	return metaArgs, nil
+}
+
+// ResolveStages resolves the base images and platforms of the FROM
+// instructions of stages, like FROM --platform=$BUILDPLATFORM, with the global
+// ARGs metaArgs, the automatic platform ARGs of targetPlatform and buildArgs.
+func ResolveStages(stages []instructions.Stage, metaArgs []instructions.ArgCommand, buildArgs []string, targetPlatform string) error {
+	metaArgs, err := resolveMetaArgs(metaArgs, buildArgs, targetPlatform)
+	if err != nil {
+		return err
+	}
+	return resolveStagesArgs(stages, unifyArgs(metaArgs, buildArgs))
+}
+
 // baseImageIndex returns the index of the stage the current stage is built off
 // returns -1 if the current stage isn't built off a previous stage
 func baseImageIndex(currentStage int, stages []instructions.Stage) int {
@@ -91,10 +175,18 @@ func Parse(b []byte) ([]instructions.Stage, []instructions.ArgCommand, error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	parents, err := stripCopyFlags(p.AST)
+	if err != nil {
+		return nil, nil, err
+	}
+	stripNoCacheFlags(p.AST)
 	stages, metaArgs, err := instructions.Parse(p.AST, &linter.Linter{})
 	if err != nil {
 		return nil, nil, err
 	}
+	for _, stage := range stages {
+		setCopyFlags(stage.Commands, parents)
+	}
 
 	metaArgs, err = stripEnclosingQuotes(metaArgs)
 	if err != nil {
@@ -104,6 +196,16 @@ func Parse(b []byte) ([]instructions.Stage, []instructions.ArgCommand, error) {
 	return stages, metaArgs, nil
 }
 
+// escapeToken returns the escape character of the Dockerfile d, the backslash
+// unless set otherwise with the escape parser directive
+func escapeToken(d []byte) (rune, error) {
+	p, err := parser.Parse(bytes.NewReader(d))
+	if err != nil {
+		return 0, err
+	}
+	return p.EscapeToken, nil
+}
+
 // expandNestedArgs tries to resolve nested ARG value against the previously defined ARGs
 func expandNestedArgs(metaArgs []instructions.ArgCommand, buildArgs []string) ([]instructions.ArgCommand, error) {
 	var prevArgs []string
@@ -206,7 +308,8 @@ func targetStage(stages []instructions.Stage, target string) (int, error) {
 	return -1, fmt.Errorf("%s is not a valid target build stage", target)
 }
 
-// ParseCommands parses an array of commands into an array of instructions.Command; used for onbuild
+// ParseCommands parses an array of commands into an array of instructions.Command; used for onbuild.
+// The RUN commands declared with ONBUILD RUN --no-cache keep the flag in their FlagsUsed.
 func ParseCommands(cmdArray []string) ([]instructions.Command, error) {
 	var cmds []instructions.Command
 	cmdString := strings.Join(cmdArray, "\n")
@@ -214,13 +317,22 @@ func ParseCommands(cmdArray []string) ([]instructions.Command, error) {
 	if err != nil {
 		return nil, err
 	}
+	parents, err := stripCopyFlags(ast.AST)
+	if err != nil {
+		return nil, err
+	}
+	noCache := stripNoCacheFlags(ast.AST)
 	for _, child := range ast.AST.Children {
 		cmd, err := instructions.ParseCommand(child)
 		if err != nil {
 			return nil, err
 		}
+		if run, ok := cmd.(*instructions.RunCommand); ok && noCache[child.StartLine] {
+			run.FlagsUsed = append(run.FlagsUsed, noCacheFlag)
+		}
 		cmds = append(cmds, cmd)
 	}
+	setCopyFlags(cmds, parents)
 	return cmds, nil
 }
 
@@ -259,6 +371,30 @@ func ResolveCrossStageCommands(cmds []instructions.Command, stageNameToIdx map[s
 	}
 }
 
+// RunMounts returns the mounts of the RUN command cmd, whose options are
+// expanded with envs.
+func RunMounts(cmd *instructions.RunCommand, envs []string) ([]*instructions.Mount, error) {
+	if !slices.Contains(cmd.FlagsUsed, "mount") {
+		return nil, nil
+	}
+	// The parser defers the options of the mounts until they are expanded
+	if err := cmd.Expand(func(word string) (string, error) {
+		return util.ResolveEnvironmentReplacement(word, envs, false)
+	}); err != nil {
+		return nil, errors.Wrap(err, "parsing mounts")
+	}
+	return instructions.GetMounts(cmd), nil
+}
+
+// RunNetwork returns the network of the RUN instruction cmd, default unless
+// set with --network
+func RunNetwork(cmd *instructions.RunCommand) string {
+	if !slices.Contains(cmd.FlagsUsed, "network") {
+		return instructions.NetworkDefault
+	}
+	return instructions.GetNetwork(cmd)
+}
+
 // resolveStagesArgs resolves all the args from list of stages
 func resolveStagesArgs(stages []instructions.Stage, args []string) error {
 	for i, s := range stages {
@@ -269,6 +405,16 @@ func resolveStagesArgs(stages []instructions.Stage, args []string) error {
 		if s.BaseName != resolvedBaseName {
 			stages[i].BaseName = resolvedBaseName
 		}
+		resolvedPlatform, err := util.ResolveEnvironmentReplacement(s.Platform, args, false)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("resolving platform %s", s.Platform))
+		}
+		if resolvedPlatform != "" {
+			if _, err := platforms.Parse(resolvedPlatform); err != nil {
+				return errors.Wrapf(err, "parsing platform %s of FROM %s", s.Platform, s.BaseName)
+			}
+		}
+		stages[i].Platform = resolvedPlatform
 	}
 	return nil
 }
@@ -282,6 +428,7 @@ func MakeKanikoStages(opts *config.KanikoOptions, stages []instructions.Stage, m
 	if err := resolveStagesArgs(stages, args); err != nil {
 		return nil, errors.Wrap(err, "resolving args")
 	}
+	overrideImages(stages, opts.FromImageOverrides)
 	if opts.SkipUnusedStages {
 		stages = skipUnusedStages(stages, &targetStage, opts.Target)
 	}
@@ -291,6 +438,10 @@ func MakeKanikoStages(opts *config.KanikoOptions, stages []instructions.Stage, m
 			logrus.Infof("Resolved base name %s to %s", stage.BaseName, stage.Name)
 		}
 		baseImageIndex := baseImageIndex(index, stages)
+		budget, err := stageBudget(opts, stage, index)
+		if err != nil {
+			return nil, err
+		}
 		kanikoStages = append(kanikoStages, config.KanikoStage{
 			Stage:                  stage,
 			BaseImageIndex:         baseImageIndex,
@@ -299,6 +450,7 @@ func MakeKanikoStages(opts *config.KanikoOptions, stages []instructions.Stage, m
 			Final:                  index == targetStage,
 			MetaArgs:               metaArgs,
 			Index:                  index,
+			Budget:                 budget,
 		})
 		if index == targetStage {
 			break
@@ -18,9 +18,12 @@ package dockerfile
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/chainguard-dev/kaniko/pkg/config"
 	"github.com/chainguard-dev/kaniko/testutil"
@@ -67,9 +70,11 @@ func Test_ParseStages_ArgValueWithQuotes(t *testing.T) {
 		t.Fatal("length of stages expected to be greater than zero, but was zero")
 	}
 
-	if len(metaArgs) != 5 {
-		t.Fatalf("length of stage meta args expected to be 5, but was %d", len(metaArgs))
+	// the first meta args are the automatic platform args
+	if len(metaArgs) != 6 {
+		t.Fatalf("length of stage meta args expected to be 6, but was %d", len(metaArgs))
 	}
+	metaArgs = metaArgs[1:]
 
 	for i, expectedVal := range []string{"ubuntu:16.04", "bar", "Hello", "World", "Hello World"} {
 		if metaArgs[i].Args[0].ValueString() != expectedVal {
@@ -657,3 +662,103 @@ func Test_SkipingUnusedStages(t *testing.T) {
 		}
 	}
 }
+
+func TestReadDockerfile_URL(t *testing.T) {
+	content := "FROM scratch\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	d, err := ReadDockerfile(server.URL+"/Dockerfile", map[string]string{"Authorization": "Bearer token"})
+	testutil.CheckErrorAndDeepEqual(t, false, err, content, string(d))
+
+	_, err = ReadDockerfile(server.URL+"/Dockerfile", nil)
+	testutil.CheckError(t, true, err)
+}
+
+func TestReadDockerfile_URLTimeout(t *testing.T) {
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("FROM "))
+		w.(http.Flusher).Flush()
+		select {
+		case <-stalled:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(stalled)
+	original := dockerfileFetchTimeout
+	defer func() { dockerfileFetchTimeout = original }()
+	dockerfileFetchTimeout = 100 * time.Millisecond
+
+	_, err := ReadDockerfile(server.URL+"/Dockerfile", nil)
+	testutil.CheckError(t, true, err)
+}
+
+func Test_escapeToken(t *testing.T) {
+	token, err := escapeToken([]byte("FROM scratch\n"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, '\\', token)
+	token, err = escapeToken([]byte("# escape=`\nFROM scratch\n"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, '`', token)
+}
+
+func Test_Parse_CopyFlags(t *testing.T) {
+	dockerfile := `
+FROM scratch
+COPY --parents **/go.mod /src/
+COPY --parents=false a /b
+COPY --chown=1000 --parents=true a/./b /c/
+COPY a /d
+COPY --exclude=*.md --exclude=vendor --parents . /e/
+`
+	stages, _, err := Parse([]byte(dockerfile))
+	testutil.CheckNoError(t, err)
+	var parents []bool
+	var chown []string
+	var excludes [][]string
+	for _, cmd := range stages[0].Commands {
+		c := cmd.(*instructions.CopyCommand)
+		parents = append(parents, c.Parents)
+		chown = append(chown, c.Chown)
+		excludes = append(excludes, c.ExcludePatterns)
+	}
+	testutil.CheckDeepEqual(t, []bool{true, false, true, false, true}, parents)
+	testutil.CheckDeepEqual(t, []string{"", "", "1000", "", ""}, chown)
+	testutil.CheckDeepEqual(t, [][]string{nil, nil, nil, nil, {"*.md", "vendor"}}, excludes)
+
+	cmds, err := ParseCommands([]string{"COPY --parents a/b /c/", "COPY a /d"})
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, true, cmds[0].(*instructions.CopyCommand).Parents)
+	testutil.CheckDeepEqual(t, false, cmds[1].(*instructions.CopyCommand).Parents)
+
+	_, _, err = Parse([]byte("FROM scratch\nCOPY --parents=maybe a /b\n"))
+	testutil.CheckError(t, true, err)
+	_, _, err = Parse([]byte("FROM scratch\nCOPY --exclude a /b\n"))
+	testutil.CheckError(t, true, err)
+}
+
+func Test_RunNetwork(t *testing.T) {
+	dockerfile := `
+FROM scratch
+RUN make
+RUN --network=none make test
+RUN --network=host make fetch
+`
+	stages, _, err := Parse([]byte(dockerfile))
+	testutil.CheckNoError(t, err)
+	var networks []string
+	for _, cmd := range stages[0].Commands {
+		networks = append(networks, RunNetwork(cmd.(*instructions.RunCommand)))
+	}
+	testutil.CheckDeepEqual(t, []string{"default", "none", "host"}, networks)
+	testutil.CheckDeepEqual(t, "default", RunNetwork(&instructions.RunCommand{}))
+
+	_, _, err = Parse([]byte("FROM scratch\nRUN --network=bridge make\n"))
+	testutil.CheckError(t, true, err)
+}
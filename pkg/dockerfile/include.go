@@ -0,0 +1,173 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// maxIncludeDepth limits how deeply fragments can include other fragments
+const maxIncludeDepth = 10
+
+var includeDirective = regexp.MustCompile(`^\s*#\s*include\s+(\S+)\s*$`)
+
+// resolveFragments replaces every `# include <path|url>` line of the Dockerfile
+// content d with the content of the referenced fragment, and appends the
+// fragments passed with --dockerfile-fragment. It returns the resulting
+// Dockerfile along with the list of included fragments in the form
+// `source@sha256:<digest>`.
+func resolveFragments(d []byte, opts *config.KanikoOptions) ([]byte, []string, error) {
+	dockerfileURL := opts.DockerfileURL
+	if dockerfileURL == "" && isURL(opts.DockerfilePath) {
+		dockerfileURL = opts.DockerfilePath
+	}
+	return ResolveFragments(d, opts.SrcContext, dockerfileURL, opts.DockerfileHeaders, opts.DockerfileFragments)
+}
+
+// ResolveFragments replaces every `# include <path|url>` line of the
+// Dockerfile content d with the content of the referenced fragment, and
+// appends fragments. Relative paths are resolved against the directory
+// context, or against the URL of the fragment including them when it was
+// fetched from a URL. The headers are only sent to the origin of
+// dockerfileURL, the URL the Dockerfile was fetched from, if any. It returns
+// the resulting Dockerfile along with the list of included fragments in the
+// form `source@sha256:<digest>`.
+func ResolveFragments(d []byte, context, dockerfileURL string, headers map[string]string, fragments []string) ([]byte, []string, error) {
+	r := &fragmentResolver{context: context, headers: headers}
+	if dockerfileURL != "" {
+		u, err := url.Parse(dockerfileURL)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "parsing dockerfile url %s", dockerfileURL)
+		}
+		r.origin = origin(u)
+	}
+	out, err := r.resolve(d, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, f := range fragments {
+		content, err := r.include(f, nil, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		out = append(out, '\n')
+		out = append(out, content...)
+	}
+	return out, r.resolved, nil
+}
+
+type fragmentResolver struct {
+	context string
+	headers map[string]string
+	// origin is the origin of the URL the Dockerfile was fetched from, the
+	// only one the headers are sent to
+	origin   string
+	resolved []string
+}
+
+// resolve replaces the include lines of d, a fragment fetched from base if
+// not nil
+func (r *fragmentResolver) resolve(d []byte, base *url.URL, stack []string) ([]byte, error) {
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(d))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(d)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		m := includeDirective.FindStringSubmatch(line)
+		if m == nil {
+			out.WriteString(line)
+			out.WriteByte('\n')
+			continue
+		}
+		content, err := r.include(m[1], base, stack)
+		if err != nil {
+			return nil, err
+		}
+		out.Write(content)
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			out.WriteByte('\n')
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// include returns the content of the fragment source, with its include lines
+// replaced, included by a fragment fetched from base if not nil
+func (r *fragmentResolver) include(source string, base *url.URL, stack []string) ([]byte, error) {
+	if len(stack) >= maxIncludeDepth {
+		return nil, fmt.Errorf("dockerfile fragments nested more than %d levels deep at %s", maxIncludeDepth, source)
+	}
+	path := source
+	switch {
+	case base != nil && !isURL(path):
+		// The fragments fetched from a URL never read local files
+		ref, err := url.Parse(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing dockerfile fragment %s", source)
+		}
+		path = base.ResolveReference(ref).String()
+	case !isURL(path) && !filepath.IsAbs(path):
+		path = filepath.Join(r.context, path)
+	}
+	for _, s := range stack {
+		if s == path {
+			return nil, fmt.Errorf("dockerfile fragment %s includes itself", source)
+		}
+	}
+	logrus.Infof("Including dockerfile fragment %s", source)
+	var headers map[string]string
+	var fetched *url.URL
+	if isURL(path) {
+		u, err := url.Parse(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing dockerfile fragment %s", source)
+		}
+		if r.origin != "" && origin(u) == r.origin {
+			headers = r.headers
+		}
+		fetched = u
+	}
+	content, err := ReadDockerfile(path, headers)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading dockerfile fragment %s", source)
+	}
+	r.resolved = append(r.resolved, fmt.Sprintf("%s@sha256:%x", source, sha256.Sum256(content)))
+	return r.resolve(content, fetched, append(stack, path))
+}
+
+// origin returns the scheme and the host of u
+func origin(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+func isURL(path string) bool {
+	match, _ := regexp.MatchString("^https?://", path)
+	return match
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func Test_resolveFragments(t *testing.T) {
+	dir := t.TempDir()
+	labels := "LABEL org=example\n"
+	hardening := "# include labels.Dockerfile\nRUN rm -rf /tmp/*\n"
+	user := "USER nonroot\n"
+	for name, content := range map[string]string{
+		"labels.Dockerfile":    labels,
+		"hardening.Dockerfile": hardening,
+		"user.Dockerfile":      user,
+		"loop.Dockerfile":      "# include loop.Dockerfile\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	digest := func(s string) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(s)))
+	}
+
+	tests := []struct {
+		name             string
+		dockerfile       string
+		fragments        []string
+		expected         string
+		expectedResolved []string
+		shouldErr        bool
+	}{
+		{
+			name:       "no includes",
+			dockerfile: "FROM scratch\n# a comment\n",
+			expected:   "FROM scratch\n# a comment\n",
+		},
+		{
+			name:             "nested include",
+			dockerfile:       "FROM scratch\n# include hardening.Dockerfile\nCMD [\"/bin\"]\n",
+			expected:         "FROM scratch\nLABEL org=example\nRUN rm -rf /tmp/*\nCMD [\"/bin\"]\n",
+			expectedResolved: []string{"hardening.Dockerfile@" + digest(hardening), "labels.Dockerfile@" + digest(labels)},
+		},
+		{
+			name:             "fragment flag",
+			dockerfile:       "FROM scratch\n",
+			fragments:        []string{filepath.Join(dir, "user.Dockerfile")},
+			expected:         "FROM scratch\n\nUSER nonroot\n",
+			expectedResolved: []string{filepath.Join(dir, "user.Dockerfile") + "@" + digest(user)},
+		},
+		{
+			name:       "include cycle",
+			dockerfile: "FROM scratch\n# include loop.Dockerfile\n",
+			shouldErr:  true,
+		},
+		{
+			name:       "missing fragment",
+			dockerfile: "FROM scratch\n# include missing.Dockerfile\n",
+			shouldErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := &config.KanikoOptions{SrcContext: dir, DockerfileFragments: test.fragments}
+			d, resolved, err := resolveFragments([]byte(test.dockerfile), opts)
+			testutil.CheckError(t, test.shouldErr, err)
+			if test.shouldErr {
+				return
+			}
+			testutil.CheckDeepEqual(t, test.expected, string(d))
+			testutil.CheckDeepEqual(t, test.expectedResolved, resolved)
+		})
+	}
+}
+
+func Test_resolveFragments_url(t *testing.T) {
+	var headers []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.URL.Path+" "+r.Header.Get("Authorization"))
+		fmt.Fprint(w, "USER nonroot\n")
+	}))
+	defer other.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.URL.Path+" "+r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/fragments/hardening.Dockerfile":
+			fmt.Fprintf(w, "# include labels.Dockerfile\n# include %s/user.Dockerfile\n", other.URL)
+		case "/fragments/labels.Dockerfile":
+			fmt.Fprint(w, "LABEL org=example\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer origin.Close()
+
+	opts := &config.KanikoOptions{
+		SrcContext:          t.TempDir(),
+		DockerfilePath:      config.DockerfilePath,
+		DockerfileURL:       origin.URL + "/Dockerfile",
+		DockerfileHeaders:   map[string]string{"Authorization": "Bearer token"},
+		DockerfileFragments: []string{origin.URL + "/fragments/hardening.Dockerfile"},
+	}
+	d, _, err := resolveFragments([]byte("FROM scratch\n"), opts)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, "FROM scratch\n\nLABEL org=example\nUSER nonroot\n", string(d))
+	// The headers are only sent to the origin of the Dockerfile, and the
+	// relative includes of a fragment are resolved against its URL
+	testutil.CheckDeepEqual(t, []string{
+		"/fragments/hardening.Dockerfile Bearer token",
+		"/fragments/labels.Dockerfile Bearer token",
+		"/user.Dockerfile ",
+	}, headers)
+}
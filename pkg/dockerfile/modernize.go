@@ -0,0 +1,113 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+// AuthorsLabel is the label MAINTAINER instructions are converted into
+const AuthorsLabel = "org.opencontainers.image.authors"
+
+// legacyKeyValueLines returns the lines of the ENV and LABEL instructions of
+// the Dockerfile using the legacy whitespace separated "key value" format, in
+// which the parser leaves the separator of the key and value empty.
+func legacyKeyValueLines(b []byte) (map[int]bool, error) {
+	p, err := parser.Parse(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	lines := map[int]bool{}
+	for _, node := range p.AST.Children {
+		if cmd := strings.ToLower(node.Value); cmd != "env" && cmd != "label" {
+			continue
+		}
+		if kv := node.Next; kv != nil && kv.Next != nil && kv.Next.Next != nil && kv.Next.Next.Value == "" {
+			lines[node.StartLine] = true
+		}
+	}
+	return lines, nil
+}
+
+// modernize converts the deprecated instructions of stages, parsed from the
+// Dockerfile b, into their modern equivalents, and returns the rewrites made,
+// for them to be reported:
+//   - MAINTAINER becomes a LABEL of the image authors
+//   - ENV and LABEL in the legacy "key value" format are reported as their
+//     "key=value" equivalent, which they are parsed into already
+func modernize(b []byte, stages []instructions.Stage) ([]string, error) {
+	legacy, err := legacyKeyValueLines(b)
+	if err != nil {
+		return nil, err
+	}
+	var rewrites []string
+	for i := range stages {
+		for j, cmd := range stages[i].Commands {
+			line := 0
+			if l := cmd.Location(); len(l) > 0 {
+				line = l[0].Start.Line
+			}
+			switch c := cmd.(type) {
+			case *instructions.MaintainerCommand:
+				label := instructions.NewLabelCommand(AuthorsLabel, quoteWord(c.Maintainer), true)
+				stages[i].Commands[j] = label
+				rewrites = append(rewrites, rewrite(line, c.String(), label.String()))
+			case *instructions.EnvCommand:
+				if legacy[line] {
+					rewrites = append(rewrites, rewrite(line, c.String(), "ENV "+keyValues(c.Env)))
+				}
+			case *instructions.LabelCommand:
+				if legacy[line] {
+					rewrites = append(rewrites, rewrite(line, c.String(), "LABEL "+keyValues(c.Labels)))
+				}
+			}
+		}
+	}
+	return rewrites, nil
+}
+
+func rewrite(line int, from, to string) string {
+	return fmt.Sprintf("line %d: %s -> %s", line, from, to)
+}
+
+func keyValues(kvps instructions.KeyValuePairs) string {
+	var s []string
+	for _, kvp := range kvps {
+		s = append(s, kvp.Key+"="+quoteValue(kvp.Value))
+	}
+	return strings.Join(s, " ")
+}
+
+// quoteValue quotes a value of the legacy format, which may hold whitespace
+// and variables, in double quotes.
+func quoteValue(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\"'") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// quoteWord quotes s in single quotes, for it to be taken literally when the
+// variables of the instruction are expanded.
+func quoteWord(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/util"
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+)
+
+func TestModernize(t *testing.T) {
+	dockerfile := `FROM scratch
+MAINTAINER Jane O'Neil <jane@$HOST>
+ENV PATH /usr/local/bin:$PATH
+ENV LANG=C.UTF-8
+LABEL description an old image
+`
+	stages, _, err := Parse([]byte(dockerfile))
+	testutil.CheckNoError(t, err)
+
+	rewrites, err := modernize([]byte(dockerfile), stages)
+	testutil.CheckErrorAndDeepEqual(t, false, err, []string{
+		`line 2: MAINTAINER Jane O'Neil <jane@$HOST> -> LABEL org.opencontainers.image.authors='Jane O'\''Neil <jane@$HOST>'`,
+		`line 3: ENV PATH /usr/local/bin:$PATH -> ENV PATH=/usr/local/bin:$PATH`,
+		`line 5: LABEL description an old image -> LABEL description="an old image"`,
+	}, rewrites)
+
+	label, ok := stages[0].Commands[0].(*instructions.LabelCommand)
+	if !ok {
+		t.Fatalf("MAINTAINER was not converted into a LABEL: %T", stages[0].Commands[0])
+	}
+	// The maintainer is taken literally when the label is expanded
+	value, err := util.ResolveEnvironmentReplacement(label.Labels[0].Value, []string{"HOST=example.com"}, false)
+	testutil.CheckErrorAndDeepEqual(t, false, err, "Jane O'Neil <jane@$HOST>", value)
+}
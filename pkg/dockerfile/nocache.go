@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"bytes"
+	"slices"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+)
+
+// noCacheDirective is the comment preceding the instructions whose layers are
+// never cached, like the RUN instructions with the --no-cache flag
+const noCacheDirective = "kaniko: no-cache"
+
+// noCacheFlag is the flag of the RUN instructions whose layers are never
+// cached
+const noCacheFlag = "no-cache"
+
+// stripNoCacheFlags removes the --no-cache flags of the RUN instructions of
+// ast, which the parser does not accept, and returns the lines of the
+// instructions opting out of the cache with the flag or the comment.
+func stripNoCacheFlags(ast *parser.Node) map[int]bool {
+	lines := map[int]bool{}
+	for _, node := range ast.Children {
+		for _, c := range node.PrevComment {
+			if c == noCacheDirective {
+				lines[node.StartLine] = true
+			}
+		}
+		if !strings.EqualFold(node.Value, "run") {
+			continue
+		}
+		var flags []string
+		for _, flag := range node.Flags {
+			if flag == "--"+noCacheFlag {
+				lines[node.StartLine] = true
+				continue
+			}
+			flags = append(flags, flag)
+		}
+		node.Flags = flags
+	}
+	return lines
+}
+
+// noCacheLines returns the lines of the instructions of the Dockerfile d whose
+// layers are never cached
+func noCacheLines(d []byte) (map[int]bool, error) {
+	p, err := parser.Parse(bytes.NewReader(d))
+	if err != nil {
+		return nil, err
+	}
+	return stripNoCacheFlags(p.AST), nil
+}
+
+// NoCache returns true if the layer of cmd is never cached, as set in the
+// Dockerfile whose instructions opting out of the cache are at lines, or with
+// ONBUILD RUN --no-cache for the build triggers
+func NoCache(cmd instructions.Command, lines map[int]bool) bool {
+	if run, ok := cmd.(*instructions.RunCommand); ok && slices.Contains(run.FlagsUsed, noCacheFlag) {
+		return true
+	}
+	loc := cmd.Location()
+	return len(loc) > 0 && lines[loc[0].Start.Line]
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+)
+
+func TestNoCache(t *testing.T) {
+	d := []byte(`FROM scratch
+# kaniko: no-cache
+RUN apt-get update
+RUN --no-cache --network=host apt-get update
+# Install curl
+RUN apt-get install -y curl
+# kaniko: no-cache
+COPY . /src
+`)
+	lines, err := noCacheLines(d)
+	testutil.CheckErrorAndDeepEqual(t, false, err, map[int]bool{3: true, 4: true, 8: true}, lines)
+
+	stages, _, err := Parse(d)
+	testutil.CheckNoError(t, err)
+	var noCache []bool
+	for _, cmd := range stages[0].Commands {
+		noCache = append(noCache, NoCache(cmd, lines))
+	}
+	testutil.CheckDeepEqual(t, []bool{true, true, false, true}, noCache)
+	run := stages[0].Commands[1].(*instructions.RunCommand)
+	testutil.CheckDeepEqual(t, []string{"network"}, run.FlagsUsed)
+}
+
+func TestNoCache_onbuild(t *testing.T) {
+	stages, _, err := Parse([]byte(`FROM scratch
+ONBUILD RUN --no-cache --network=host apt-get update
+ONBUILD RUN apt-get install -y curl
+`))
+	testutil.CheckNoError(t, err)
+	var triggers []string
+	for _, cmd := range stages[0].Commands {
+		triggers = append(triggers, cmd.(*instructions.OnbuildCommand).Expression)
+	}
+
+	// The triggers run in the stages built from the image
+	cmds, err := ParseCommands(triggers)
+	testutil.CheckNoError(t, err)
+	var noCache []bool
+	for _, cmd := range cmds {
+		noCache = append(noCache, NoCache(cmd, nil))
+	}
+	testutil.CheckDeepEqual(t, []bool{true, false}, noCache)
+	testutil.CheckDeepEqual(t, "apt-get update", strings.Join(cmds[0].(*instructions.RunCommand).CmdLine, " "))
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/sirupsen/logrus"
+)
+
+// overrideImages replaces the images of stages set with --from-image-override:
+// the base image of a stage, by its name or by the image in its FROM, and the
+// images in COPY --from which are not stages. This pins the images of a
+// Dockerfile, like to the digests of a lockfile, without editing it.
+func overrideImages(stages []instructions.Stage, overrides map[string]string) {
+	if len(overrides) == 0 {
+		return
+	}
+	for k, v := range overrides {
+		if _, err := name.NewDigest(v); err != nil {
+			logrus.Warnf("--from-image-override of %s to %s is not pinned to a digest", k, v)
+		}
+	}
+
+	names := map[string]bool{}
+	for _, s := range stages {
+		if s.Name != "" {
+			names[s.Name] = true
+		}
+	}
+	for i, s := range stages {
+		var image string
+		ok := false
+		if s.Name != "" {
+			image, ok = overrides[s.Name]
+		}
+		// The base of stages built off a previous stage is overridden with it
+		if !ok && !isPreviousStage(s.BaseName, stages[:i]) {
+			image, ok = lookupOverride(overrides, s.BaseName)
+		}
+		if ok {
+			logrus.Infof("Overriding base image %s of stage %d with %s", s.BaseName, i, image)
+			stages[i].BaseName = image
+		}
+
+		for _, cmd := range s.Commands {
+			c, ok := cmd.(*instructions.CopyCommand)
+			if !ok || c.From == "" || names[strings.ToLower(c.From)] {
+				continue
+			}
+			if _, err := strconv.Atoi(c.From); err == nil {
+				continue
+			}
+			if image, ok := lookupOverride(overrides, c.From); ok {
+				logrus.Infof("Overriding image %s of COPY --from with %s", c.From, image)
+				c.From = image
+			}
+		}
+	}
+}
+
+// lookupOverride returns the override of image, set either as it is written
+// or as another reference to the same repository and tag, like alpine for
+// docker.io/library/alpine:latest
+func lookupOverride(overrides map[string]string, image string) (string, bool) {
+	if v, ok := overrides[image]; ok {
+		return v, true
+	}
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", false
+	}
+	for k, v := range overrides {
+		if kref, err := name.ParseReference(k); err == nil && kref.Name() == ref.Name() {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// isPreviousStage returns true if base is the name of one of stages
+func isPreviousStage(base string, stages []instructions.Stage) bool {
+	base = strings.ToLower(base)
+	for _, s := range stages {
+		if s.Name != "" && s.Name == base {
+			return true
+		}
+	}
+	return false
+}
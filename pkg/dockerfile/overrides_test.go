@@ -0,0 +1,56 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+)
+
+func TestOverrideImages(t *testing.T) {
+	const (
+		golang  = "golang@sha256:0000000000000000000000000000000000000000000000000000000000000001"
+		alpine  = "alpine@sha256:0000000000000000000000000000000000000000000000000000000000000002"
+		busybox = "busybox@sha256:0000000000000000000000000000000000000000000000000000000000000003"
+	)
+	stages, _, err := Parse([]byte(`FROM golang:1.22 AS build
+FROM build AS test
+FROM docker.io/library/alpine AS runtime
+COPY --from=build /app /app
+COPY --from=busybox:latest /bin/busybox /bin/busybox
+COPY --from=debian /etc/os-release /etc/os-release
+`))
+	testutil.CheckNoError(t, err)
+	overrideImages(stages, map[string]string{
+		"build":          golang,
+		"alpine:latest":  alpine,
+		"busybox:latest": busybox,
+	})
+
+	var bases []string
+	for _, s := range stages {
+		bases = append(bases, s.BaseName)
+	}
+	testutil.CheckDeepEqual(t, []string{golang, "build", alpine}, bases)
+	var froms []string
+	for _, cmd := range stages[2].Commands {
+		froms = append(froms, cmd.(*instructions.CopyCommand).From)
+	}
+	testutil.CheckDeepEqual(t, []string{"build", busybox, "debian"}, froms)
+}
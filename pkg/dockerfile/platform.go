@@ -0,0 +1,71 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"github.com/containerd/containerd/platforms"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/pkg/errors"
+)
+
+// PlatformArgs returns the platform ARGs BuildKit automatically defines in the
+// global scope of every Dockerfile. The TARGET* args describe the platform the
+// image is built for, defaulting to the host when targetPlatform is empty, and
+// the BUILD* args describe the host kaniko runs on.
+func PlatformArgs(targetPlatform string) ([]instructions.KeyValuePairOptional, error) {
+	build := platforms.Normalize(platforms.DefaultSpec())
+	target := build
+	if targetPlatform != "" {
+		p, err := platforms.Parse(targetPlatform)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing platform %s", targetPlatform)
+		}
+		target = platforms.Normalize(p)
+	}
+
+	args := []instructions.KeyValuePairOptional{}
+	add := func(k, v string) {
+		args = append(args, instructions.KeyValuePairOptional{Key: k, Value: &v})
+	}
+	add("TARGETPLATFORM", platforms.Format(target))
+	add("TARGETOS", target.OS)
+	add("TARGETARCH", target.Architecture)
+	add("TARGETVARIANT", target.Variant)
+	add("BUILDPLATFORM", platforms.Format(build))
+	add("BUILDOS", build.OS)
+	add("BUILDARCH", build.Architecture)
+	add("BUILDVARIANT", build.Variant)
+	return args, nil
+}
+
+// AddAutomaticArgs prepends the automatic ARGs, like the platform ARGs, to the
+// global ARGs of the Dockerfile, and sets them as the value of global ARGs
+// re-declaring them without a default.
+func AddAutomaticArgs(metaArgs []instructions.ArgCommand, automaticArgs []instructions.KeyValuePairOptional) []instructions.ArgCommand {
+	values := map[string]*string{}
+	for _, a := range automaticArgs {
+		values[a.Key] = a.Value
+	}
+	for i, marg := range metaArgs {
+		for j, arg := range marg.Args {
+			if v, ok := values[arg.Key]; ok && arg.Value == nil {
+				metaArgs[i].Args[j].Value = v
+			}
+		}
+	}
+	return append([]instructions.ArgCommand{{Args: automaticArgs}}, metaArgs...)
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dockerfile
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestPlatformArgs(t *testing.T) {
+	args, err := PlatformArgs("linux/arm/v7")
+	testutil.CheckError(t, false, err)
+	values := map[string]string{}
+	for _, a := range args {
+		values[a.Key] = a.ValueString()
+	}
+	testutil.CheckDeepEqual(t, "linux/arm/v7", values["TARGETPLATFORM"])
+	testutil.CheckDeepEqual(t, "linux", values["TARGETOS"])
+	testutil.CheckDeepEqual(t, "arm", values["TARGETARCH"])
+	testutil.CheckDeepEqual(t, "v7", values["TARGETVARIANT"])
+	testutil.CheckDeepEqual(t, runtime.GOARCH, values["BUILDARCH"])
+
+	_, err = PlatformArgs("not/a/valid/platform")
+	testutil.CheckError(t, true, err)
+}
+
+func TestParseStages_PlatformArgs(t *testing.T) {
+	dockerfile := `
+ARG TARGETARCH
+FROM busybox:${TARGETARCH}
+ARG TARGETOS
+RUN echo $TARGETOS
+`
+	path := filepath.Join(t.TempDir(), "Dockerfile")
+	if err := os.WriteFile(path, []byte(dockerfile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := &config.KanikoOptions{DockerfilePath: path, CustomPlatform: "linux/arm64"}
+	stages, metaArgs, err := ParseStages(opts)
+	testutil.CheckError(t, false, err)
+
+	kanikoStages, err := MakeKanikoStages(opts, stages, metaArgs)
+	testutil.CheckError(t, false, err)
+	testutil.CheckDeepEqual(t, "busybox:arm64", kanikoStages[0].BaseName)
+
+	args := NewBuildArgs(opts.BuildArgs)
+	args.AddMetaArgs(kanikoStages[0].MetaArgs)
+	testutil.CheckDeepEqual(t, "linux", args.GetAllMeta()["TARGETOS"])
+}
+
+func TestResolveStages_Platform(t *testing.T) {
+	dockerfile := `
+ARG BUILDER_PLATFORM=$BUILDPLATFORM
+FROM --platform=${BUILDER_PLATFORM} golang AS builder
+FROM --platform=$TARGETOS/$TARGETARCH alpine
+FROM --platform=${RUNTIME_PLATFORM} alpine
+FROM alpine
+`
+	stages, metaArgs, err := Parse([]byte(dockerfile))
+	testutil.CheckError(t, false, err)
+	err = ResolveStages(stages, metaArgs, []string{"RUNTIME_PLATFORM=linux/s390x"}, "linux/arm64")
+	testutil.CheckError(t, false, err)
+
+	args, err := PlatformArgs("")
+	testutil.CheckError(t, false, err)
+	testutil.CheckDeepEqual(t, "BUILDPLATFORM", args[4].Key)
+	testutil.CheckDeepEqual(t, args[4].ValueString(), stages[0].Platform)
+	testutil.CheckDeepEqual(t, "linux/arm64", stages[1].Platform)
+	testutil.CheckDeepEqual(t, "linux/s390x", stages[2].Platform)
+	testutil.CheckDeepEqual(t, "", stages[3].Platform)
+
+	stages, metaArgs, err = Parse([]byte("ARG PLATFORM=not/a/valid/platform\nFROM --platform=$PLATFORM alpine\n"))
+	testutil.CheckError(t, false, err)
+	testutil.CheckError(t, true, ResolveStages(stages, metaArgs, nil, ""))
+}
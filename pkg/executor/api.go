@@ -0,0 +1,191 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/creds"
+	"github.com/chainguard-dev/kaniko/pkg/isolation"
+	"github.com/google/go-containerregistry/pkg/authn"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// Option customizes the builds and pushes of Build and Push
+type Option func(*settings)
+
+type settings struct {
+	rootDir      string
+	keychain     authn.Keychain
+	dockerConfig []byte
+	noDefault    bool
+	reservation  Reservation
+}
+
+// WithRootDir builds the image in dir instead of the root of the filesystem.
+// Only the root directory of kaniko, config.RootDir, is supported for now: the
+// commands of the build, the cached layers and the mounts of RUN instructions
+// still use it, so Build and Push fail with ErrRootDirUnsupported for any
+// other directory.
+func WithRootDir(dir string) Option {
+	return func(s *settings) {
+		s.rootDir = dir
+	}
+}
+
+// WithKeychain authenticates to the registries with k instead of the default
+// keychain of kaniko
+func WithKeychain(k authn.Keychain) Option {
+	return func(s *settings) {
+		s.keychain = k
+	}
+}
+
+// WithDockerConfig authenticates to the registries with the credentials of the
+// Docker config.json document b, like one supplied along with a build request,
+// before those of the keychain given with WithKeychain. The credentials are
+// only used by this build, and are never written to the filesystem.
+func WithDockerConfig(b []byte) Option {
+	return func(s *settings) {
+		s.dockerConfig = b
+	}
+}
+
+// WithoutDefaultCredentials accesses the registries anonymously unless
+// credentials are given with WithKeychain or WithDockerConfig, instead of with
+// the default keychain of kaniko, which holds the credentials of the process.
+// Services building for several tenants set it for a build not to use the
+// credentials of another.
+func WithoutDefaultCredentials() Option {
+	return func(s *settings) {
+		s.noDefault = true
+	}
+}
+
+// ErrRootDirUnsupported is returned when WithRootDir sets a directory other
+// than the root directory of kaniko
+var ErrRootDirUnsupported = errors.New("building in a root directory other than the one of kaniko is not supported")
+
+// acquire queues the build or the push with the reservation of its options
+func acquire(ctx context.Context, options []Option) (release func(), err error) {
+	var s settings
+	for _, o := range options {
+		o(&s)
+	}
+	return apiQueue.acquire(ctx, s.reservation)
+}
+
+// apply returns the options of a build or a push, opts with the root
+// directory and the credentials set by options. opts is left untouched, and
+// nothing is set for the process, for the builds not to share their settings.
+func apply(opts *config.KanikoOptions, options []Option) (*config.KanikoOptions, error) {
+	var s settings
+	for _, o := range options {
+		o(&s)
+	}
+	keychain := s.keychain
+	if s.dockerConfig != nil {
+		k, err := creds.NewDockerConfigKeychain(s.dockerConfig)
+		if err != nil {
+			return nil, err
+		}
+		if keychain != nil {
+			k = authn.NewMultiKeychain(k, keychain)
+		}
+		keychain = k
+	}
+	if keychain == nil && s.noDefault {
+		// The empty keychain resolves to anonymous
+		keychain = authn.NewMultiKeychain()
+	}
+	o := *opts
+	if keychain != nil {
+		o.Keychain = keychain
+	}
+	if s.rootDir != "" {
+		if filepath.Clean(s.rootDir) != filepath.Clean(config.RootDir) {
+			return nil, ErrRootDirUnsupported
+		}
+		o.RootDir = s.rootDir
+	}
+	return &o, nil
+}
+
+// Build builds the image described by opts, or transcodes the image of
+// opts.Transcode or rebases the one of opts.Rebase, and returns it along with
+// the report of the build. It is the entry point of the programs embedding
+// kaniko, and must be given the options the executor command would resolve
+// from its flags. The builds and pushes are queued within the limits set with
+// SetQueueLimits and run one at a time. Once ctx is done, the build stops and
+// its running commands are killed.
+//
+// The commands of RUN instructions run with the pivot-root isolation, or
+// without network, re-execute the running program: the programs embedding
+// kaniko must call isolation.Init at the start of their main function for
+// them, or the builds fail.
+func Build(ctx context.Context, opts *config.KanikoOptions, options ...Option) (v1.Image, *BuildReport, error) {
+	if err := isolation.CheckInit(opts.RunIsolation, opts.DefaultRunNetwork); err != nil {
+		return nil, nil, err
+	}
+	opts, err := apply(opts, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	release, err := acquire(ctx, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	var image v1.Image
+	if opts.Transcode != "" {
+		image, err = DoTranscode(opts)
+	} else if opts.Rebase != "" {
+		image, err = DoRebase(opts)
+	} else {
+		image, err = doBuild(ctx, opts)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	report, err := newBuildReport(image, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return image, report, nil
+}
+
+// Push pushes image, built by Build, to the destinations of opts until ctx is
+// done
+func Push(ctx context.Context, image v1.Image, opts *config.KanikoOptions, options ...Option) error {
+	opts, err := apply(opts, options)
+	if err != nil {
+		return err
+	}
+	release, err := acquire(ctx, options)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return doPush(ctx, image, opts)
+}
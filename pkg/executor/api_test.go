@@ -0,0 +1,113 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/creds"
+	"github.com/chainguard-dev/kaniko/pkg/isolation"
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func Test_apply(t *testing.T) {
+	rootDir := config.RootDir
+	keychain := authn.NewMultiKeychain()
+
+	opts := &config.KanikoOptions{}
+	buildOpts, err := apply(opts, []Option{WithRootDir(rootDir), WithKeychain(keychain)})
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, rootDir, buildOpts.Root())
+	testutil.CheckDeepEqual(t, true, creds.Keychain(&buildOpts.RegistryOptions) == keychain)
+	// The settings are only set for the build, not in the options given nor
+	// for the process
+	testutil.CheckDeepEqual(t, true, opts.Keychain == nil)
+	testutil.CheckDeepEqual(t, rootDir, opts.Root())
+	testutil.CheckDeepEqual(t, rootDir, config.RootDir)
+
+	// The commands of the build still run in the root directory of kaniko
+	_, err = apply(opts, []Option{WithRootDir(filepath.Join(rootDir, "workspace", "root"))})
+	testutil.CheckDeepEqual(t, true, err == ErrRootDirUnsupported)
+}
+
+func Test_apply_credentials(t *testing.T) {
+	reg, err := name.NewRegistry("registry.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte("tenant:secret"))
+	dockerConfig := []byte(fmt.Sprintf(`{"auths": {"registry.example.com": {"auth": %q}}}`, auth))
+
+	tests := []struct {
+		name    string
+		options []Option
+		want    *authn.AuthConfig
+	}{
+		{
+			name:    "docker config",
+			options: []Option{WithDockerConfig(dockerConfig), WithoutDefaultCredentials()},
+			want:    &authn.AuthConfig{Username: "tenant", Password: "secret"},
+		},
+		{
+			name:    "without default credentials",
+			options: []Option{WithoutDefaultCredentials()},
+			want:    &authn.AuthConfig{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := apply(&config.KanikoOptions{}, tt.options)
+			testutil.CheckNoError(t, err)
+			a, err := creds.Keychain(&opts.RegistryOptions).Resolve(reg)
+			testutil.CheckNoError(t, err)
+			got, err := a.Authorization()
+			testutil.CheckErrorAndDeepEqual(t, false, err, tt.want, got)
+		})
+	}
+
+	_, err = apply(&config.KanikoOptions{}, []Option{WithDockerConfig([]byte(`{"credsStore": "desktop"}`))})
+	testutil.CheckError(t, true, err)
+}
+
+func TestBuild_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	image, report, err := Build(ctx, &config.KanikoOptions{})
+	testutil.CheckDeepEqual(t, true, err == context.Canceled)
+	testutil.CheckDeepEqual(t, true, image == nil && report == nil)
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckDeepEqual(t, true, Push(ctx, img, &config.KanikoOptions{}) == context.Canceled)
+}
+
+func TestBuild_isolationNotInitialized(t *testing.T) {
+	// The tests of the package do not call isolation.Init
+	_, _, err := Build(context.Background(), &config.KanikoOptions{RunIsolation: isolation.PivotRoot})
+	testutil.CheckDeepEqual(t, true, err == isolation.ErrNotInitialized)
+}
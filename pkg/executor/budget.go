@@ -0,0 +1,104 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// stageBudget tracks the resources used by a stage against its budget
+type stageBudget struct {
+	start        time.Time
+	snapshotSize int64
+}
+
+// startBudget starts tracking the budget of the stage, killing its RUN
+// commands once its duration budget has run out. The returned function stops
+// it.
+func (s *stageBuilder) startBudget() func() {
+	s.budget = stageBudget{start: time.Now()}
+	if s.stage.Budget.MaxDuration == 0 {
+		return func() {}
+	}
+	logrus.Infof("Stage %s has a duration budget of %s", s.stageRef(), s.stage.Budget.MaxDuration)
+	parent := s.ctx
+	ctx, cancel := context.WithDeadlineCause(s.runContext(), s.budget.start.Add(s.stage.Budget.MaxDuration),
+		errors.Errorf("the duration budget of stage %s has run out", s.stageRef()))
+	s.ctx = ctx
+	return func() {
+		cancel()
+		s.ctx = parent
+	}
+}
+
+// runContext returns the context the commands of the stage run in, done once
+// the build is canceled or the duration budget of the stage has run out
+func (s *stageBuilder) runContext() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// checkDurationBudget returns an error if the stage has taken longer than its
+// duration budget, after command
+func (s *stageBuilder) checkDurationBudget(command string) error {
+	limit := s.stage.Budget.MaxDuration
+	if limit == 0 {
+		return nil
+	}
+	if elapsed := time.Since(s.budget.start); elapsed > limit {
+		return errors.Errorf("stage %s exceeded its duration budget of %s: %s at %s",
+			s.stageRef(), limit, elapsed.Round(time.Second), command)
+	}
+	return nil
+}
+
+// checkSnapshotBudget adds the size of the snapshot at tarPath, taken after
+// command, to the size of the snapshots of the stage, and returns an error if
+// it exceeds the snapshot size budget
+func (s *stageBuilder) checkSnapshotBudget(command string, tarPath string) error {
+	limit := s.stage.Budget.MaxSnapshotSize
+	if limit == 0 || tarPath == "" {
+		return nil
+	}
+	fi, err := os.Stat(tarPath)
+	if err != nil {
+		return errors.Wrap(err, "tar file path does not exist")
+	}
+	s.budget.snapshotSize += fi.Size()
+	if s.budget.snapshotSize > limit {
+		return errors.Errorf("stage %s exceeded its snapshot size budget of %s: %s at %s",
+			s.stageRef(), units.BytesSize(float64(limit)), units.BytesSize(float64(s.budget.snapshotSize)), command)
+	}
+	return nil
+}
+
+// stageRef returns the name of the stage, or its index if unnamed
+func (s *stageBuilder) stageRef() string {
+	if s.stage.Name != "" {
+		return s.stage.Name
+	}
+	return strconv.Itoa(s.stage.Index)
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func Test_stageBuilder_checkBudget(t *testing.T) {
+	tarPath := filepath.Join(t.TempDir(), "layer.tar")
+	testutil.CheckNoError(t, os.WriteFile(tarPath, make([]byte, 600), 0o644))
+
+	s := &stageBuilder{stage: config.KanikoStage{Budget: config.StageBudget{
+		MaxDuration:     time.Hour,
+		MaxSnapshotSize: 1000,
+	}}}
+	defer s.startBudget()()
+	testutil.CheckNoError(t, s.checkDurationBudget("RUN make"))
+	testutil.CheckNoError(t, s.checkSnapshotBudget("RUN make", tarPath))
+	testutil.CheckError(t, true, s.checkSnapshotBudget("RUN make install", tarPath))
+
+	s.budget.start = time.Now().Add(-2 * time.Hour)
+	testutil.CheckError(t, true, s.checkDurationBudget("RUN make"))
+
+	// Without budget, nothing is checked
+	s = &stageBuilder{}
+	defer s.startBudget()()
+	testutil.CheckNoError(t, s.checkSnapshotBudget("RUN make", tarPath))
+	s.budget.start = time.Now().Add(-2 * time.Hour)
+	testutil.CheckNoError(t, s.checkDurationBudget("RUN make"))
+}
@@ -17,7 +17,9 @@ limitations under the License.
 package executor
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -44,6 +46,7 @@ import (
 	"github.com/chainguard-dev/kaniko/pkg/dockerfile"
 	image_util "github.com/chainguard-dev/kaniko/pkg/image"
 	"github.com/chainguard-dev/kaniko/pkg/image/remote"
+	"github.com/chainguard-dev/kaniko/pkg/progress"
 	"github.com/chainguard-dev/kaniko/pkg/snapshot"
 	"github.com/chainguard-dev/kaniko/pkg/timing"
 	"github.com/chainguard-dev/kaniko/pkg/util"
@@ -55,8 +58,9 @@ const emptyTarSize = 1024
 
 // for testing
 var (
-	initializeConfig = initConfig
-	getFSFromImage   = util.GetFSFromImage
+	initializeConfig       = initConfig
+	getFSFromImage         = util.GetFSFromImage
+	extractLayersFlattened = util.ExtractLayersFlattened
 )
 
 type cachePusher func(*config.KanikoOptions, string, string, string) error
@@ -64,10 +68,13 @@ type snapShotter interface {
 	Init() error
 	TakeSnapshotFS() (string, error)
 	TakeSnapshot([]string, bool, bool) (string, error)
+	RecordFiles([]string) error
 }
 
 // stageBuilder contains all fields necessary to build one stage of a Dockerfile
 type stageBuilder struct {
+	// ctx is done once the build is canceled
+	ctx              context.Context
 	stage            config.KanikoStage
 	image            v1.Image
 	cf               *v1.ConfigFile
@@ -83,6 +90,25 @@ type stageBuilder struct {
 	snapshotter      snapShotter
 	layerCache       cache.LayerCache
 	pushLayerToCache cachePusher
+	revertedFiles    []string
+	hashCache        *snapshot.HashCache
+	hashCachePath    string
+	// sharedLayers are the layers shared with the other stages, if any
+	sharedLayers sharedLayers
+	// layerIndex is the index of the layers already pushed, if any
+	layerIndex *cache.LayerIndex
+	// cacheKeyContributions are added to the cache keys of all the commands
+	cacheKeyContributions []string
+	// runs records or replays the effects of the RUN instructions, if set
+	runs *runRecorder
+	// cacheArchives are the archives of cached layers imported and exported,
+	// if any
+	cacheArchives *cacheArchives
+	// healthcheckStartInterval is the start interval of the healthcheck of
+	// the image, which its config cannot hold
+	healthcheckStartInterval time.Duration
+	// budget tracks the resources used by the stage against its budget
+	budget stageBudget
 }
 
 // newStageBuilder returns a new type stageBuilder which contains all the information required to build the stage
@@ -91,6 +117,13 @@ func newStageBuilder(args *dockerfile.BuildArgs, opts *config.KanikoOptions, sta
 	if err != nil {
 		return nil, err
 	}
+	startInterval, err := healthcheckStartInterval(sourceImage)
+	if err != nil {
+		return nil, err
+	}
+	if sourceImage, err = convertImageMediaTypes(sourceImage, imageMediaTypes(opts)); err != nil {
+		return nil, errors.Wrap(err, "converting media types of base image")
+	}
 
 	imageConfig, err := initializeConfig(sourceImage, opts)
 	if err != nil {
@@ -106,17 +139,38 @@ func newStageBuilder(args *dockerfile.BuildArgs, opts *config.KanikoOptions, sta
 		return nil, errors.Wrap(err, "failed to initialize ignore list")
 	}
 
-	hasher, err := getHasher(opts.SnapshotMode)
+	hasher, err := getHasher(opts.SnapshotMode, opts.SnapshotSampleRate)
 	if err != nil {
 		return nil, err
 	}
-	l := snapshot.NewLayeredMap(hasher)
-	snapshotter := snapshot.NewSnapshotter(l, config.RootDir)
-
 	digest, err := sourceImage.Digest()
 	if err != nil {
 		return nil, err
 	}
+	var hashCache *snapshot.HashCache
+	var hashCachePath string
+	if opts.CacheFileHashes && opts.CacheDir != "" && !stage.BaseImageStoredLocally {
+		hashCachePath = cache.FileHashesPath(&opts.CacheOptions, digest, opts.SnapshotMode)
+		hashCache = snapshot.LoadHashCache(hashCachePath)
+	}
+	l := snapshot.NewLayeredMap(hasher)
+	snapshotter := snapshot.NewSnapshotter(l, opts.Root())
+	if hashCache != nil {
+		snapshotter.SetInitHasher(hashCache.Hasher(hasher))
+	}
+	snapshotter.SetRoot(opts.Root())
+	snapshotter.SetHashJobs(opts.HashJobs)
+	snapshotter.SetDirDigests(opts.SnapshotDirDigests)
+
+	// The network files mounted by the container runtime are ignored, while
+	// the changes made to them are part of the layers when preserved
+	preserved, reverted := networkFiles(opts)
+	for _, f := range preserved {
+		if err := snapshotter.Track(f); err != nil {
+			return nil, errors.Wrapf(err, "tracking changes to %s", f)
+		}
+	}
+
 	s := &stageBuilder{
 		stage:            stage,
 		image:            sourceImage,
@@ -130,10 +184,19 @@ func newStageBuilder(args *dockerfile.BuildArgs, opts *config.KanikoOptions, sta
 		stageIdxToDigest: sid,
 		layerCache:       newLayerCache(opts),
 		pushLayerToCache: pushLayerToCache,
+		revertedFiles:    reverted,
+		hashCache:        hashCache,
+		hashCachePath:    hashCachePath,
+
+		healthcheckStartInterval: startInterval,
 	}
 
 	for _, cmd := range s.stage.Commands {
-		command, err := commands.GetCommand(cmd, fileContext, opts.RunV2, opts.CacheCopyLayers, opts.CacheRunLayers)
+		noCache := dockerfile.NoCache(cmd, opts.NoCacheLines)
+		if noCache {
+			logrus.Infof("Not caching the layer of %s at line %d, as set in the Dockerfile", strings.ToUpper(cmd.Name()), cmd.Location()[0].Start.Line)
+		}
+		command, err := commands.GetCommand(cmd, fileContext, opts.RunV2, opts.CacheCopyLayers && !noCache, opts.CacheRunLayers && !noCache)
 		if err != nil {
 			return nil, err
 		}
@@ -184,6 +247,47 @@ func initConfig(img partial.WithConfigFile, opts *config.KanikoOptions) (*v1.Con
 }
 
 func newLayerCache(opts *config.KanikoOptions) cache.LayerCache {
+	repos := newReposLayerCache(opts)
+	local := localLayers(opts)
+	if local == nil {
+		return repos
+	}
+	localOpts := *opts
+	localOpts.CacheRepo = opts.CacheDir
+	localCache := &cache.BackendCache{Opts: &localOpts, Backend: local}
+	if !opts.CacheDirWrite {
+		return cache.MultiCache{localCache, repos}
+	}
+	// The layers found in the cache repos are added to the local cache
+	return cache.MultiCache{localCache, &copyingCache{LayerCache: repos, backend: local}}
+}
+
+// newReposLayerCache returns the layer cache of the cache repos
+func newReposLayerCache(opts *config.KanikoOptions) cache.LayerCache {
+	repos := opts.CacheReadRepos()
+	if len(repos) <= 1 {
+		return newRepoLayerCache(opts)
+	}
+	var caches cache.MultiCache
+	for _, repo := range repos {
+		repoOpts := *opts
+		repoOpts.CacheRepo = repo
+		caches = append(caches, newRepoLayerCache(&repoOpts))
+	}
+	return caches
+}
+
+// newRepoLayerCache returns the layer cache of opts.CacheRepo
+func newRepoLayerCache(opts *config.KanikoOptions) cache.LayerCache {
+	backend, err := cache.GetBackend(opts, opts.CacheRepo)
+	if err != nil {
+		logrus.Warnf("Unable to use the cache backend of %s: %v", opts.CacheRepo, err)
+	} else if backend != nil {
+		return &cache.BackendCache{
+			Opts:    opts,
+			Backend: backend,
+		}
+	}
 	if isOCILayout(opts.CacheRepo) {
 		return &cache.LayoutCache{
 			Opts: opts,
@@ -198,9 +302,9 @@ func isOCILayout(path string) bool {
 	return strings.HasPrefix(path, "oci:")
 }
 
-func (s *stageBuilder) populateCompositeKey(command commands.DockerCommand, files []string, compositeKey CompositeCache, args *dockerfile.BuildArgs, env []string) (CompositeCache, error) {
+func (s *stageBuilder) populateCompositeKey(command commands.DockerCommand, files []string, compositeKey CompositeCache, args *dockerfile.BuildArgs, cfg *v1.Config) (CompositeCache, error) {
 	// First replace all the environment variables or args in the command
-	replacementEnvs := args.ReplacementEnvs(env)
+	replacementEnvs := args.ReplacementEnvs(cfg.Env)
 	// The sort order of `replacementEnvs` is basically undefined, sort it
 	// so we can ensure a stable cache key.
 	sort.Strings(replacementEnvs)
@@ -217,7 +321,48 @@ func (s *stageBuilder) populateCompositeKey(command commands.DockerCommand, file
 	}
 
 	// Add the next command to the cache key.
-	compositeKey.AddKey(command.String())
+	if s.opts != nil && s.opts.NormalizeRunCacheKeys {
+		compositeKey.AddKey(commands.NormalizedCacheKey(command))
+	} else {
+		compositeKey.AddKey(command.String())
+	}
+	if r, ok := command.(commands.RemoteSourcer); ok {
+		keys, err := r.RemoteSourceKeys(&v1.Config{Env: cfg.Env}, args)
+		if err != nil {
+			return compositeKey, err
+		}
+		compositeKey.AddKey(keys...)
+	}
+	// The files mounted are not copied, so their content is not part of the
+	// command
+	if m, ok := command.(commands.MountSourcer); ok {
+		paths, err := m.MountSources(&v1.Config{Env: cfg.Env}, args)
+		if err != nil {
+			return compositeKey, err
+		}
+		for _, p := range paths {
+			if err := compositeKey.AddPath(p, s.fileContext); err != nil {
+				return compositeKey, err
+			}
+		}
+	}
+
+	// The files copied are keyed by their destination and digest, rather
+	// than by the files of the context they come from
+	if c, ok := command.(commands.ContentAddressed); ok {
+		keys, err := c.CacheKeys(cfg, args, func(p string) (string, error) {
+			fi, err := os.Lstat(p)
+			if err != nil {
+				return "", err
+			}
+			return contentHash(p, fi, s.fileContext)
+		})
+		if err != nil {
+			return compositeKey, err
+		}
+		compositeKey.AddKey(keys...)
+		return compositeKey, nil
+	}
 
 	for _, f := range files {
 		if err := compositeKey.AddPath(f, s.fileContext); err != nil {
@@ -237,11 +382,11 @@ func (s *stageBuilder) optimize(compositeKey CompositeCache, cfg v1.Config) erro
 		s.args = buildArgs
 	}()
 
-	stopCache := false
 	// Possibly replace commands with their cached implementations.
 	// We walk through all the commands, running any commands that only operate on metadata.
 	// We throw the metadata away after, but we need it to properly track command dependencies
 	// for things like COPY ${FOO} or RUN commands that use environment variables.
+	var probes []*cacheProbe
 	for i, command := range s.cmds {
 		if command == nil {
 			continue
@@ -251,7 +396,7 @@ func (s *stageBuilder) optimize(compositeKey CompositeCache, cfg v1.Config) erro
 			return errors.Wrap(err, "failed to get files used from context")
 		}
 
-		compositeKey, err = s.populateCompositeKey(command, files, compositeKey, s.args, cfg.Env)
+		compositeKey, err = s.populateCompositeKey(command, files, compositeKey, s.args, &cfg)
 		if err != nil {
 			return err
 		}
@@ -265,21 +410,15 @@ func (s *stageBuilder) optimize(compositeKey CompositeCache, cfg v1.Config) erro
 		logrus.Debugf("Optimize: cache key for command %v %v", command.String(), ck)
 		s.finalCacheKey = ck
 
-		if command.ShouldCacheOutput() && !stopCache {
-			img, err := s.layerCache.RetrieveLayer(ck)
-
-			if err != nil {
-				logrus.Debugf("Failed to retrieve layer: %s", err)
-				logrus.Infof("No cached layer found for cmd %s", command.String())
-				logrus.Debugf("Key missing was: %s", compositeKey.Key())
-				stopCache = true
-				continue
-			}
-
-			if cacheCmd := command.CacheCommand(img); cacheCmd != nil {
-				logrus.Infof("Using caching version of cmd: %s", command.String())
-				s.cmds[i] = cacheCmd
+		if command.ShouldCacheOutput() {
+			p := &cacheProbe{index: i, key: ck, compositeKey: compositeKey.Key()}
+			if isLinked(command) {
+				if p.key, err = s.linkedCacheKey(command, files, &cfg); err != nil {
+					return err
+				}
+				p.linked = true
 			}
+			probes = append(probes, p)
 		}
 
 		// Mutate the config for any commands that require it.
@@ -289,10 +428,99 @@ func (s *stageBuilder) optimize(compositeKey CompositeCache, cfg v1.Config) erro
 			}
 		}
 	}
+
+	if s.opts.NoCacheFiltered(s.stage.Name) {
+		logrus.Infof("Not using the cached layers of stage %s, as set with --no-cache-filter", s.stage.Name)
+		return nil
+	}
+	s.probeCache(probes)
+	// The linked layers are still used after a miss, as they don't depend on
+	// the previous layers
+	missed := false
+	for _, p := range probes {
+		command := s.cmds[p.index]
+		if missed && !p.linked {
+			continue
+		}
+		if p.err != nil {
+			logrus.Debugf("Failed to retrieve layer: %s", p.err)
+			logrus.Infof("No cached layer found for cmd %s", command.String())
+			logrus.Debugf("Key missing was: %s", p.compositeKey)
+			buildStats.cacheMisses.Add(1)
+			missed = true
+			continue
+		}
+		if cacheCmd := command.CacheCommand(p.img); cacheCmd != nil {
+			logrus.Infof("Using caching version of cmd: %s", command.String())
+			s.cmds[p.index] = cacheCmd
+			buildStats.cacheHits.Add(1)
+		}
+	}
 	return nil
 }
 
-func (s *stageBuilder) build() error {
+// cacheProbe is the lookup of the cached layer of a command
+type cacheProbe struct {
+	index        int
+	key          string
+	compositeKey string
+	// linked is set for the commands whose layers don't depend on the
+	// previous ones
+	linked bool
+	img    v1.Image
+	err    error
+}
+
+// isLinked returns true if the layer of command doesn't depend on the
+// previous layers
+func isLinked(command commands.DockerCommand) bool {
+	l, ok := command.(commands.Linked)
+	return ok && l.IsLinked()
+}
+
+// linkedCacheKey returns the cache key of the layer of a linked command, made
+// of the command and the files it uses only, for the layer to be reused when
+// the previous ones change.
+func (s *stageBuilder) linkedCacheKey(command commands.DockerCommand, files []string, cfg *v1.Config) (string, error) {
+	compositeKey, err := s.populateCompositeKey(command, files, *NewCompositeCache(s.cacheKeyContributions...), s.args, cfg)
+	if err != nil {
+		return "", err
+	}
+	return compositeKey.Hash()
+}
+
+// probeCache looks the cached layers of the probes up. With more than one
+// --cache-probe-jobs, they are all looked up concurrently, to not wait for the
+// registry once per command. Otherwise they are looked up in order until one
+// is missing, since the commands after it are not cached, apart from the
+// linked ones.
+func (s *stageBuilder) probeCache(probes []*cacheProbe) {
+	if s.opts.CacheProbeJobs <= 1 {
+		missed := false
+		for _, p := range probes {
+			if missed && !p.linked {
+				continue
+			}
+			if p.img, p.err = s.layerCache.RetrieveLayer(p.key); p.err != nil {
+				missed = true
+			}
+		}
+		return
+	}
+	g := errgroup.Group{}
+	g.SetLimit(s.opts.CacheProbeJobs)
+	for _, p := range probes {
+		g.Go(func() error {
+			p.img, p.err = s.layerCache.RetrieveLayer(p.key)
+			return nil
+		})
+	}
+	g.Wait()
+}
+
+func (s *stageBuilder) build() (err error) {
+	defer s.startBudget()()
+
 	// Set the initial cache key to be the base image digest, the build args and the SrcContext.
 	var compositeKey *CompositeCache
 	if cacheKey, ok := s.digestToCacheKey[s.baseImageDigest]; ok {
@@ -300,12 +528,19 @@ func (s *stageBuilder) build() error {
 	} else {
 		compositeKey = NewCompositeCache(s.baseImageDigest)
 	}
+	compositeKey.AddKey(s.cacheKeyContributions...)
 
 	// Apply optimizations to the instructions.
 	if err := s.optimize(*compositeKey, s.cf.Config); err != nil {
 		return errors.Wrap(err, "failed to optimize instructions")
 	}
 
+	// A stage whose commands are all cached is restored in a single pass
+	cachedLayers, err := s.cachedStageLayers()
+	if err != nil {
+		return errors.Wrap(err, "failed to load cached layers")
+	}
+
 	// Unpack file system to root if we need to.
 	shouldUnpack := false
 	for _, cmd := range s.cmds {
@@ -318,17 +553,35 @@ func (s *stageBuilder) build() error {
 	if len(s.crossStageDeps[s.stage.Index]) > 0 {
 		shouldUnpack = true
 	}
+	restoreCachedLayers := cachedLayers != nil && shouldUnpack
+	extractCachedLayers := restoreCachedLayers
 	if s.stage.Index == 0 && s.opts.InitialFSUnpacked {
 		shouldUnpack = false
 	}
 
 	if shouldUnpack {
 		t := timing.Start("FS Unpacking")
+		progress.SetPhase(progress.PhaseUnpacking, "")
 
 		retryFunc := func() error {
-			_, err := getFSFromImage(config.RootDir, s.image, util.ExtractFile)
+			_, err := getFSFromImage(s.opts.Root(), s.image, util.ExtractFile)
 			return err
 		}
+		if store := s.baseImageStore(); store != nil {
+			retryFunc = func() error {
+				return store.Restore(s.image, s.opts.Root())
+			}
+		} else if restoreCachedLayers {
+			logrus.Info("All the commands of the stage are cached, extracting the image and the cached layers at once.")
+			retryFunc = func() error {
+				layers, err := s.image.Layers()
+				if err != nil {
+					return err
+				}
+				return extractLayersFlattened(s.opts.Root(), append(layers, cachedLayers...), s.opts.CacheRestoreJobs, util.ExtractFile)
+			}
+			extractCachedLayers = false
+		}
 
 		if err := util.Retry(retryFunc, s.opts.ImageFSExtractRetry, 1000); err != nil {
 			return errors.Wrap(err, "failed to get filesystem from image")
@@ -338,6 +591,14 @@ func (s *stageBuilder) build() error {
 	} else {
 		logrus.Info("Skipping unpacking as no commands require it.")
 	}
+	if extractCachedLayers {
+		logrus.Info("All the commands of the stage are cached, extracting the cached layers at once.")
+		t := timing.Start("Cached Layers Extraction")
+		if err := extractLayersFlattened(s.opts.Root(), cachedLayers, s.opts.CacheRestoreJobs, util.ExtractFile); err != nil {
+			return errors.Wrap(err, "failed to extract cached layers")
+		}
+		timing.DefaultRun.Stop(t)
+	}
 
 	initSnapshotTaken := false
 	if s.opts.SingleSnapshot {
@@ -347,6 +608,16 @@ func (s *stageBuilder) build() error {
 		initSnapshotTaken = true
 	}
 
+	// The command the build fails on is recorded in the summary too
+	var running commands.DockerCommand
+	var runningCached bool
+	var runningStart time.Time
+	defer func() {
+		if err != nil && running != nil {
+			recordFailedStep(&s.stage, running.String(), runningCached, time.Since(runningStart))
+		}
+	}()
+
 	cacheGroup := errgroup.Group{}
 	for index, command := range s.cmds {
 		if command == nil {
@@ -354,6 +625,8 @@ func (s *stageBuilder) build() error {
 		}
 
 		t := timing.Start("Command: " + command.String())
+		start := time.Now()
+		running, runningStart = command, start
 
 		// If the command uses files from the context, add them.
 		files, err := command.FilesUsedFromContext(&s.cf.Config, s.args)
@@ -362,7 +635,7 @@ func (s *stageBuilder) build() error {
 		}
 
 		if s.opts.Cache {
-			*compositeKey, err = s.populateCompositeKey(command, files, *compositeKey, s.args, s.cf.Config.Env)
+			*compositeKey, err = s.populateCompositeKey(command, files, *compositeKey, s.args, &s.cf.Config)
 			if err != nil && s.opts.Cache {
 				return err
 			}
@@ -378,6 +651,7 @@ func (s *stageBuilder) build() error {
 				return false
 			}
 		}()
+		runningCached = isCacheCommand
 		if !initSnapshotTaken && !isCacheCommand && !command.ProvidesFilesToSnapshot() {
 			// Take initial snapshot if command does not expect to return
 			// a list of files.
@@ -387,27 +661,77 @@ func (s *stageBuilder) build() error {
 			initSnapshotTaken = true
 		}
 
-		if err := command.ExecuteCommand(&s.cf.Config, s.args); err != nil {
-			return errors.Wrap(err, "failed to execute command")
+		progress.SetPhase(progress.PhaseExecuting, command.String())
+		if err := s.runContext().Err(); err != nil {
+			return context.Cause(s.runContext())
+		}
+		// The changes RUN makes to the network files are reverted, while COPY
+		// and ADD write them on purpose
+		var savedFiles []savedFile
+		if revertsNetworkFiles(command) {
+			if savedFiles, err = saveFiles(s.revertedFiles); err != nil {
+				return errors.Wrap(err, "failed to save network files")
+			}
+		}
+		// The layers of a fully cached stage are extracted already
+		if !restoreCachedLayers || !isCacheCommand {
+			if err := s.executeCommand(command); err != nil {
+				if berr := s.checkDurationBudget(command.String()); berr != nil {
+					return berr
+				}
+				return errors.Wrap(err, "failed to execute command")
+			}
+		}
+		if err := s.checkDurationBudget(command.String()); err != nil {
+			return err
+		}
+		if h, ok := command.(commands.HealthChecker); ok {
+			s.healthcheckStartInterval = h.HealthcheckStartInterval()
+		}
+		if err := restoreFiles(savedFiles); err != nil {
+			return errors.Wrap(err, "failed to revert network files")
 		}
 		files = command.FilesToSnapshot()
 		timing.DefaultRun.Stop(t)
 
 		if !s.shouldTakeSnapshot(index, command.MetadataOnly()) && !s.opts.ForceBuildMetadata {
 			logrus.Debugf("Build: skipping snapshot for [%v]", command.String())
+			recordStep(&s.stage, command.String(), isCacheCommand, time.Since(start))
+			running = nil
 			continue
 		}
 		if isCacheCommand {
+			// The cached linked layers may follow the initial snapshot, which
+			// must not see their files as changed
+			if initSnapshotTaken && !s.opts.SingleSnapshot {
+				if err := s.snapshotter.RecordFiles(files); err != nil {
+					return errors.Wrap(err, "failed to record cached files")
+				}
+			}
 			v := command.(commands.Cached)
 			layer := v.Layer()
 			if err := s.saveLayerToImage(layer, command.String()); err != nil {
 				return errors.Wrap(err, "failed to save layer")
 			}
 		} else {
-			tarPath, err := s.takeSnapshot(files, command.ShouldDetectDeletedFiles())
+			progress.SetPhase(progress.PhaseSnapshotting, command.String())
+			var tarPath string
+			if l, ok := command.(commands.Linked); ok && l.LinkedLayer() != "" && !s.opts.SingleSnapshot {
+				tarPath, err = s.recordLinkedLayer(files, l.LinkedLayer())
+			} else {
+				tarPath, err = s.takeSnapshot(files, command.ShouldDetectDeletedFiles())
+			}
 			if err != nil {
 				return errors.Wrap(err, "failed to take snapshot")
 			}
+			if err := s.checkSnapshotBudget(command.String(), tarPath); err != nil {
+				return err
+			}
+			if r, ok := command.(commands.NetworkRecorder); ok && s.runs != nil {
+				if err := s.runs.record(s.stage.Index, index, command.String(), r.NetworkDestinations(), tarPath); err != nil {
+					return err
+				}
+			}
 
 			if s.opts.Cache {
 				logrus.Debugf("Build: composite key for command %v %v", command.String(), compositeKey)
@@ -415,20 +739,32 @@ func (s *stageBuilder) build() error {
 				if err != nil {
 					return errors.Wrap(err, "failed to hash composite key")
 				}
+				if isLinked(command) {
+					if ck, err = s.linkedCacheKey(command, files, &s.cf.Config); err != nil {
+						return errors.Wrap(err, "failed to hash linked cache key")
+					}
+				}
 
 				logrus.Debugf("Build: cache key for command %v %v", command.String(), ck)
 
 				// Push layer to cache (in parallel) now along with new config file
-				if command.ShouldCacheOutput() && !s.opts.NoPushCache {
+				if command.ShouldCacheOutput() && !s.opts.NoPushCache && (s.cacheArchives == nil || !s.cacheArchives.repoless) {
 					cacheGroup.Go(func() error {
 						return s.pushLayerToCache(s.opts, ck, tarPath, command.String())
 					})
 				}
+				if command.ShouldCacheOutput() {
+					cacheGroup.Go(func() error {
+						return s.storeCachedLayer(ck, tarPath, command.String())
+					})
+				}
 			}
 			if err := s.saveSnapshotToImage(command.String(), tarPath); err != nil {
 				return errors.Wrap(err, "failed to save snapshot to image")
 			}
 		}
+		recordStep(&s.stage, command.String(), isCacheCommand, time.Since(start))
+		running = nil
 	}
 
 	if err := cacheGroup.Wait(); err != nil {
@@ -438,6 +774,62 @@ func (s *stageBuilder) build() error {
 	return nil
 }
 
+// executeCommand executes command, killing its processes once the context of
+// the stage is done when it runs any
+func (s *stageBuilder) executeCommand(command commands.DockerCommand) error {
+	if c, ok := command.(commands.Interruptible); ok {
+		return c.ExecuteCommandContext(s.runContext(), &s.cf.Config, s.args)
+	}
+	return command.ExecuteCommand(&s.cf.Config, s.args)
+}
+
+// cachedStageLayers loads and returns the cached layers of the stage when all
+// its commands writing files were replaced by their cached versions, or nil.
+func (s *stageBuilder) cachedStageLayers() ([]v1.Layer, error) {
+	var cached []commands.Cached
+	for _, command := range s.cmds {
+		if command == nil {
+			continue
+		}
+		if c, ok := command.(commands.Cached); ok {
+			cached = append(cached, c)
+		} else if !command.MetadataOnly() {
+			return nil, nil
+		}
+	}
+	if len(cached) == 0 {
+		return nil, nil
+	}
+	layers := make([]v1.Layer, len(cached))
+	for i, c := range cached {
+		if err := c.LoadLayer(); err != nil {
+			return nil, err
+		}
+		layers[i] = c.Layer()
+	}
+	return layers, nil
+}
+
+// baseImageStore returns the store to restore the extracted base image of the
+// stage from, or nil if it must be extracted.
+func (s *stageBuilder) baseImageStore() *cache.UnpackedStore {
+	if s.stage.BaseImageStoredLocally {
+		return nil
+	}
+	if s.opts.BaseImageStore != "" {
+		return &cache.UnpackedStore{Dir: s.opts.BaseImageStore}
+	}
+	// The local cache may be read-only, only use it when the warmer already
+	// extracted the base image there.
+	if s.opts.Cache && s.opts.CacheDir != "" {
+		store := cache.UnpackedCache(&s.opts.CacheOptions)
+		if digest, err := s.image.Digest(); err == nil && store.Contains(digest) {
+			return store
+		}
+	}
+	return nil
+}
+
 func (s *stageBuilder) takeSnapshot(files []string, shdDelete bool) (string, error) {
 	var snapshot string
 	var err error
@@ -450,10 +842,39 @@ func (s *stageBuilder) takeSnapshot(files []string, shdDelete bool) (string, err
 		files = append(files, util.Volumes()...)
 		snapshot, err = s.snapshotter.TakeSnapshot(files, shdDelete, s.opts.ForceBuildMetadata)
 	}
+	if err == nil && snapshot != "" && s.opts.NormalizeLayers {
+		epoch, epochErr := s.opts.SourceDateEpochTime()
+		if epochErr != nil {
+			return "", epochErr
+		}
+		if err = util.NormalizeTar(snapshot, epoch); err != nil {
+			err = errors.Wrap(err, "normalizing layer")
+		}
+	}
 	timing.DefaultRun.Stop(t)
 	return snapshot, err
 }
 
+// recordLinkedLayer records the files of the layer at tarPath made by a linked
+// command in the snapshotter, instead of snapshotting them, and returns it.
+func (s *stageBuilder) recordLinkedLayer(files []string, tarPath string) (string, error) {
+	t := timing.Start("Snapshotting FS")
+	defer timing.DefaultRun.Stop(t)
+	if err := s.snapshotter.RecordFiles(files); err != nil {
+		return "", err
+	}
+	if s.opts.NormalizeLayers {
+		epoch, err := s.opts.SourceDateEpochTime()
+		if err != nil {
+			return "", err
+		}
+		if err := util.NormalizeTar(tarPath, epoch); err != nil {
+			return "", errors.Wrap(err, "normalizing layer")
+		}
+	}
+	return tarPath, nil
+}
+
 func (s *stageBuilder) shouldTakeSnapshot(index int, isMetadatCmd bool) bool {
 	isLastCommand := index == len(s.cmds)-1
 
@@ -496,27 +917,44 @@ func (s *stageBuilder) saveSnapshotToLayer(tarPath string) (v1.Layer, error) {
 		logrus.Info("No files were changed, appending empty layer to config. No layer added to image.")
 		return nil, nil
 	}
+	if err := checkLayerLeaks(tarPath, internalPaths(s.opts)); err != nil {
+		return nil, errors.Wrap(err, "verifying snapshot")
+	}
 
 	layerOpts := s.getLayerOptionFromOpts()
 	imageMediaType, err := s.image.MediaType()
 	if err != nil {
 		return nil, err
 	}
+	layerMediaType, compression := types.DockerLayer, "gzip"
 	// Only appending MediaType for OCI images as the default is docker
 	if extractMediaTypeVendor(imageMediaType) == types.OCIVendorPrefix {
 		if s.opts.Compression == config.ZStd {
+			layerMediaType, compression = types.OCILayerZStd, "zstd"
 			layerOpts = append(layerOpts, tarball.WithCompression("zstd"), tarball.WithMediaType(types.OCILayerZStd))
 		} else {
+			layerMediaType = types.OCILayer
 			layerOpts = append(layerOpts, tarball.WithMediaType(types.OCILayer))
 		}
 	}
 
-	layer, err := tarball.LayerFromFile(tarPath, layerOpts...)
-	if err != nil {
-		return nil, err
+	newLayer := func() (v1.Layer, error) {
+		return tarball.LayerFromFile(tarPath, layerOpts...)
 	}
-
-	return layer, nil
+	if s.layerIndex != nil {
+		repos, err := destinationRepositories(s.opts)
+		if err != nil {
+			return nil, err
+		}
+		compressLayer := newLayer
+		newLayer = func() (v1.Layer, error) {
+			return indexLayer(s.layerIndex, tarPath, layerMediaType, fmt.Sprintf("%s-%d", compression, s.opts.CompressionLevel), repos, compressLayer)
+		}
+	}
+	if s.sharedLayers != nil {
+		return s.sharedLayers.get(tarPath, imageMediaType, newLayer)
+	}
+	return newLayer()
 }
 
 func (s *stageBuilder) getLayerOptionFromOpts() []tarball.LayerOption {
@@ -649,7 +1087,17 @@ func CalculateDependencies(stages []config.KanikoStage, opts *config.KanikoOptio
 		}
 
 		cmds, err := dockerfile.GetOnBuildInstructions(&cfg.Config, stageNameToIdx)
+		if err != nil {
+			return nil, err
+		}
 		cmds = append(cmds, s.Commands...)
+		// The triggers of the base image run in this stage only, while the ones
+		// it declares run in the stages built from it
+		cfg.Config.OnBuild = nil
+		image, err = mutate.Config(image, cfg.Config)
+		if err != nil {
+			return nil, err
+		}
 
 		for _, c := range cmds {
 			switch cmd := c.(type) {
@@ -665,6 +1113,27 @@ func CalculateDependencies(stages []config.KanikoStage, opts *config.KanikoOptio
 					}
 					depGraph[i] = append(depGraph[i], resolved...)
 				}
+			case *instructions.RunCommand:
+				mounts, err := dockerfile.RunMounts(cmd, ba.ReplacementEnvs(cfg.Config.Env))
+				if err != nil {
+					return nil, err
+				}
+				for _, m := range mounts {
+					if m.Type != instructions.MountTypeBind || m.From == "" {
+						continue
+					}
+					from := m.From
+					if idx, ok := stageNameToIdx[strings.ToLower(from)]; ok {
+						from = idx
+					}
+					i, err := strconv.Atoi(from)
+					if err != nil {
+						continue
+					}
+					// Without source, the whole filesystem of the stage is
+					// mounted
+					depGraph[i] = append(depGraph[i], filepath.Clean("/"+m.Source))
+				}
 			case *instructions.EnvCommand:
 				if err := util.UpdateConfigEnv(cmd.Env, &cfg.Config, ba.ReplacementEnvs(cfg.Config.Env)); err != nil {
 					return nil, err
@@ -681,6 +1150,12 @@ func CalculateDependencies(stages []config.KanikoStage, opts *config.KanikoOptio
 					}
 					ba.AddArg(k, v)
 				}
+			case *instructions.OnbuildCommand:
+				cfg.Config.OnBuild = append(cfg.Config.OnBuild, cmd.Expression)
+				image, err = mutate.Config(image, cfg.Config)
+				if err != nil {
+					return nil, err
+				}
 			}
 		}
 		images = append(images, image)
@@ -690,9 +1165,19 @@ func CalculateDependencies(stages []config.KanikoStage, opts *config.KanikoOptio
 
 // DoBuild executes building the Dockerfile
 func DoBuild(opts *config.KanikoOptions) (v1.Image, error) {
+	return doBuild(context.Background(), opts)
+}
+
+// doBuild builds the Dockerfile until ctx is done, killing the running
+// commands then
+func doBuild(ctx context.Context, opts *config.KanikoOptions) (v1.Image, error) {
 	t := timing.Start("Total Build Time")
+	start := time.Now()
+	cacheLock := lockCacheDir(opts)
+	defer cacheLock.Close()
 	digestToCacheKey := make(map[string]string)
 	stageIdxToDigest := make(map[string]string)
+	layers := sharedLayers{}
 
 	stages, metaArgs, err := dockerfile.ParseStages(opts)
 	if err != nil {
@@ -703,15 +1188,25 @@ func DoBuild(opts *config.KanikoOptions) (v1.Image, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := addBuildMetadataArgs(kanikoStages, opts); err != nil {
+		return nil, err
+	}
 	stageNameToIdx := ResolveCrossStageInstructions(kanikoStages)
+	commands.SetStageIndexes(stageNameToIdx)
+	commands.SetEscapeToken(opts.EscapeToken)
 
 	fileContext, err := util.NewFileContextFromDockerfile(opts.DockerfilePath, opts.SrcContext)
 	if err != nil {
 		return nil, err
 	}
+	fileContext.Digests = opts.ContextDigests
 
+	triggers, err := baseImageTriggers(kanikoStages, opts, stageNameToIdx)
+	if err != nil {
+		return nil, err
+	}
 	// Some stages may refer to other random images, not previous stages
-	if err := fetchExtraStages(kanikoStages, opts); err != nil {
+	if err := fetchExtraStages(kanikoStages, triggers, opts); err != nil {
 		return nil, err
 	}
 	crossStageDependencies, err := CalculateDependencies(kanikoStages, opts, stageNameToIdx)
@@ -720,9 +1215,25 @@ func DoBuild(opts *config.KanikoOptions) (v1.Image, error) {
 	}
 	logrus.Infof("Built cross stage deps: %v", crossStageDependencies)
 
+	cacheKeys, err := cacheKeyContributions(opts)
+	if err != nil {
+		return nil, err
+	}
+	runs, err := newRunRecorder(opts)
+	if err != nil {
+		return nil, err
+	}
+	archives, err := openCacheArchives(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	var args *dockerfile.BuildArgs
 
 	for index, stage := range kanikoStages {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		sb, err := newStageBuilder(
 			args, opts, stage,
 			crossStageDependencies,
@@ -737,12 +1248,40 @@ func DoBuild(opts *config.KanikoOptions) (v1.Image, error) {
 		if err != nil {
 			return nil, err
 		}
+		sb.ctx = ctx
 		args = sb.args
-		if err := sb.build(); err != nil {
+		if len(kanikoStages) > 1 {
+			sb.sharedLayers = layers
+		}
+		sb.cacheKeyContributions = cacheKeys
+		sb.runs = runs
+		if archives != nil {
+			sb.layerCache = archives.layerCache(opts, sb.layerCache)
+			sb.cacheArchives = archives
+		}
+		if sb.layerIndex, err = openLayerIndex(opts); err != nil {
+			return nil, errors.Wrap(err, "opening layer index")
+		}
+		err = sb.build()
+		// The snapshotter may watch the filesystem of the stage
+		if c, ok := sb.snapshotter.(io.Closer); ok {
+			c.Close()
+		}
+		if err != nil {
 			return nil, errors.Wrap(err, "error building stage")
 		}
 
 		reviewConfig(stage, &sb.cf.Config)
+		if stage.Final {
+			recordDockerfileFragments(opts, &sb.cf.Config)
+			if err := runs.save(); err != nil {
+				return nil, errors.Wrap(err, "saving the records of the RUN instructions")
+			}
+			if err := archives.export(opts.CacheExport); err != nil {
+				return nil, errors.Wrap(err, "exporting the cached layers")
+			}
+			pruneCacheDir(opts, start, cacheLock)
+		}
 
 		sourceImage, err := mutate.Config(sb.image, sb.cf.Config)
 		if err != nil {
@@ -753,17 +1292,16 @@ func DoBuild(opts *config.KanikoOptions) (v1.Image, error) {
 		if err != nil {
 			return nil, err
 		}
-		if opts.CustomPlatform == "" {
-			configFile.OS = runtime.GOOS
-			configFile.Architecture = runtime.GOARCH
-		} else {
-			configFile.OS = strings.Split(opts.CustomPlatform, "/")[0]
-			configFile.Architecture = strings.Split(opts.CustomPlatform, "/")[1]
+		if err := setPlatform(configFile, opts, stage.Platform); err != nil {
+			return nil, err
 		}
 		sourceImage, err = mutate.ConfigFile(sourceImage, configFile)
 		if err != nil {
 			return nil, err
 		}
+		if sourceImage, err = withHealthcheckStartInterval(sourceImage, sb.healthcheckStartInterval); err != nil {
+			return nil, err
+		}
 
 		d, err := sourceImage.Digest()
 		if err != nil {
@@ -785,9 +1323,24 @@ func DoBuild(opts *config.KanikoOptions) (v1.Image, error) {
 				if err != nil {
 					return nil, err
 				}
+				epoch, err := opts.SourceDateEpochTime()
+				if err != nil {
+					return nil, err
+				}
+				if !epoch.IsZero() {
+					if sourceImage, err = mutate.CreatedAt(sourceImage, v1.Time{Time: epoch}); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if sourceImage, err = annotate(sourceImage, opts.Annotations); err != nil {
+				return nil, err
+			}
+			if sourceImage, err = withHealthcheckStartInterval(sourceImage, sb.healthcheckStartInterval); err != nil {
+				return nil, err
 			}
 			if opts.Cleanup {
-				if err = util.DeleteFilesystem(); err != nil {
+				if err = util.CleanupFilesystem(opts.Root()); err != nil {
 					return nil, err
 				}
 			}
@@ -799,12 +1352,17 @@ func DoBuild(opts *config.KanikoOptions) (v1.Image, error) {
 				return nil, err
 			}
 		}
+		if opts.PushStages && stage.Name != "" {
+			if err := pushStageToCache(opts, stage.Name, sourceImage); err != nil {
+				return nil, errors.Wrapf(err, "pushing stage %s", stage.Name)
+			}
+		}
 
-		filesToSave, err := filesToSave(crossStageDependencies[index])
+		filesToSave, err := filesToSave(crossStageDependencies[index], opts.Root())
 		if err != nil {
 			return nil, err
 		}
-		dstDir := filepath.Join(config.KanikoDir, strconv.Itoa(index))
+		dstDir := filepath.Join(config.StagingDir(), strconv.Itoa(index))
 		if err := os.MkdirAll(dstDir, 0644); err != nil {
 			return nil, errors.Wrap(err,
 				fmt.Sprintf("to create workspace for stage %s",
@@ -813,13 +1371,13 @@ func DoBuild(opts *config.KanikoOptions) (v1.Image, error) {
 		}
 		for _, p := range filesToSave {
 			logrus.Infof("Saving file %s for later use", p)
-			if err := util.CopyFileOrSymlink(p, dstDir, config.RootDir); err != nil {
+			if err := util.CopyFileOrSymlink(p, dstDir, opts.Root()); err != nil {
 				return nil, errors.Wrap(err, "could not save file")
 			}
 		}
 
 		// Delete the filesystem
-		if err := util.DeleteFilesystem(); err != nil {
+		if err := util.DeleteFilesystem(opts.Root()); err != nil {
 			return nil, errors.Wrap(err, fmt.Sprintf("deleting file system after stage %d", index))
 		}
 	}
@@ -827,26 +1385,60 @@ func DoBuild(opts *config.KanikoOptions) (v1.Image, error) {
 	return nil, err
 }
 
-// filesToSave returns all the files matching the given pattern in deps.
+// setPlatform sets the platform of the image config to the platform of the
+// final stage set with FROM --platform, the custom platform, or the one of the
+// host, along with the OS version and features set by flags
+func setPlatform(configFile *v1.ConfigFile, opts *config.KanikoOptions, stagePlatform string) error {
+	customPlatform := opts.CustomPlatform
+	if stagePlatform != "" {
+		customPlatform = stagePlatform
+	}
+	if customPlatform == "" {
+		configFile.OS = runtime.GOOS
+		configFile.Architecture = runtime.GOARCH
+	} else {
+		platform, err := v1.ParsePlatform(customPlatform)
+		if err != nil {
+			return errors.Wrapf(err, "parsing platform %s", customPlatform)
+		}
+		configFile.OS = platform.OS
+		configFile.Architecture = platform.Architecture
+		if platform.Variant != "" {
+			configFile.Variant = platform.Variant
+		}
+		if platform.OSVersion != "" {
+			configFile.OSVersion = platform.OSVersion
+		}
+	}
+	if opts.OSVersion != "" {
+		configFile.OSVersion = opts.OSVersion
+	}
+	if len(opts.OSFeatures) > 0 {
+		configFile.OSFeatures = opts.OSFeatures
+	}
+	return nil
+}
+
+// filesToSave returns all the files under root matching the given pattern in deps.
 // If a file is a symlink, it also returns the target file.
-func filesToSave(deps []string) ([]string, error) {
+func filesToSave(deps []string, root string) ([]string, error) {
 	srcFiles := []string{}
 	for _, src := range deps {
-		srcs, err := filepath.Glob(filepath.Join(config.RootDir, src))
+		srcs, err := filepath.Glob(filepath.Join(root, src))
 		if err != nil {
 			return nil, err
 		}
 		for _, f := range srcs {
 			if link, err := util.EvalSymLink(f); err == nil {
-				link, err = filepath.Rel(config.RootDir, link)
+				link, err = filepath.Rel(root, link)
 				if err != nil {
-					return nil, errors.Wrap(err, fmt.Sprintf("could not find relative path to %s", config.RootDir))
+					return nil, errors.Wrap(err, fmt.Sprintf("could not find relative path to %s", root))
 				}
 				srcFiles = append(srcFiles, link)
 			}
-			f, err = filepath.Rel(config.RootDir, f)
+			f, err = filepath.Rel(root, f)
 			if err != nil {
-				return nil, errors.Wrap(err, fmt.Sprintf("could not find relative path to %s", config.RootDir))
+				return nil, errors.Wrap(err, fmt.Sprintf("could not find relative path to %s", root))
 			}
 			srcFiles = append(srcFiles, f)
 		}
@@ -899,42 +1491,121 @@ func deduplicatePaths(paths []string) []string {
 	return deduped
 }
 
-func fetchExtraStages(stages []config.KanikoStage, opts *config.KanikoOptions) error {
+// baseImageTriggers returns the ONBUILD triggers the stages run before their
+// instructions, by stage index: the triggers of their base image, or the ONBUILD
+// instructions of the stage they are built from. The triggers are checked for
+// the features kaniko cannot honor like the instructions of the Dockerfile.
+func baseImageTriggers(stages []config.KanikoStage, opts *config.KanikoOptions, stageNameToIdx map[string]string) (map[int][]instructions.Command, error) {
+	triggers := map[int][]instructions.Command{}
+	for i, s := range stages {
+		var onBuild []string
+		switch {
+		case s.BaseImageStoredLocally:
+			for _, c := range stages[s.BaseImageIndex].Commands {
+				if o, ok := c.(*instructions.OnbuildCommand); ok {
+					onBuild = append(onBuild, o.Expression)
+				}
+			}
+		case s.BaseName == constants.NoBaseImage:
+		default:
+			image, err := image_util.RetrieveSourceImage(s, opts)
+			if err != nil {
+				return nil, err
+			}
+			cf, err := image.ConfigFile()
+			if err != nil {
+				return nil, err
+			}
+			onBuild = cf.Config.OnBuild
+		}
+		if len(onBuild) == 0 {
+			continue
+		}
+
+		report, err := dockerfile.CheckCapabilities([]byte(strings.Join(onBuild, "\n")))
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing ONBUILD triggers of %s", s.BaseName)
+		}
+		report.Log()
+		if err := report.Err(); err != nil {
+			return nil, errors.Wrapf(err, "ONBUILD triggers of %s", s.BaseName)
+		}
+		cmds, err := dockerfile.GetOnBuildInstructions(&v1.Config{OnBuild: onBuild}, stageNameToIdx)
+		if err != nil {
+			return nil, err
+		}
+		triggers[i] = cmds
+	}
+	return triggers, nil
+}
+
+func fetchExtraStages(stages []config.KanikoStage, triggers map[int][]instructions.Command, opts *config.KanikoOptions) error {
 	t := timing.Start("Fetching Extra Stages")
 	defer timing.DefaultRun.Stop(t)
 
 	var names []string
+	fetched := map[string]bool{}
 
 	for stageIndex, s := range stages {
-		for _, cmd := range s.Commands {
-			c, ok := cmd.(*instructions.CopyCommand)
-			if !ok || c.From == "" {
-				continue
+		// The sources of the mounts may be set with the build args
+		ba := dockerfile.NewBuildArgs(opts.BuildArgs)
+		ba.AddMetaArgs(s.MetaArgs)
+		// The triggers run in the stage like its own instructions
+		cmds := append(append([]instructions.Command{}, triggers[stageIndex]...), s.Commands...)
+		for _, cmd := range cmds {
+			var froms []string
+			switch c := cmd.(type) {
+			case *instructions.ArgCommand:
+				for _, arg := range c.Args {
+					k, v, err := commands.ParseArg(arg.Key, arg.Value, nil, ba)
+					if err != nil {
+						return err
+					}
+					ba.AddArg(k, v)
+				}
+			case *instructions.CopyCommand:
+				froms = append(froms, c.From)
+			case *instructions.RunCommand:
+				mounts, err := dockerfile.RunMounts(c, ba.ReplacementEnvs(nil))
+				if err != nil {
+					return err
+				}
+				for _, m := range mounts {
+					if m.Type == instructions.MountTypeBind {
+						froms = append(froms, m.From)
+					}
+				}
 			}
+			for _, from := range froms {
+				if from == "" || fetched[from] {
+					continue
+				}
 
-			// FROMs at this point are guaranteed to be either an integer referring to a previous stage,
-			// the name of a previous stage, or a name of a remote image.
+				// FROMs at this point are guaranteed to be either an integer referring to a previous stage,
+				// the name of a previous stage, or a name of a remote image.
 
-			// If it is an integer stage index, validate that it is actually a previous index
-			if fromIndex, err := strconv.Atoi(c.From); err == nil && stageIndex > fromIndex && fromIndex >= 0 {
-				continue
-			}
-			// Check if the name is the alias of a previous stage
-			if fromPreviousStage(c, names) {
-				continue
-			}
+				// If it is an integer stage index, validate that it is actually a previous index
+				if fromIndex, err := strconv.Atoi(from); err == nil && stageIndex > fromIndex && fromIndex >= 0 {
+					continue
+				}
+				// Check if the name is the alias of a previous stage
+				if fromPreviousStage(from, names) {
+					continue
+				}
 
-			// This must be an image name, fetch it.
-			logrus.Debugf("Found extra base image stage %s", c.From)
-			sourceImage, err := remote.RetrieveRemoteImage(c.From, opts.RegistryOptions, opts.CustomPlatform)
-			if err != nil {
-				return err
-			}
-			if err := saveStageAsTarball(c.From, sourceImage); err != nil {
-				return err
-			}
-			if err := extractImageToDependencyDir(c.From, sourceImage); err != nil {
-				return err
+				// This must be an image name, fetch it.
+				logrus.Debugf("Found extra base image stage %s", from)
+				sourceImage, err := remote.RetrieveRemoteImage(from, opts.RegistryOptions, opts.CustomPlatform)
+				if err != nil {
+					return err
+				}
+				if err := saveStageAsTarball(from, sourceImage); err != nil {
+					return err
+				}
+				if err := extractImageToDependencyDir(from, sourceImage); err != nil {
+					return err
+				}
+				fetched[from] = true
 			}
 		}
 		// Store the name of the current stage in the list with names, if applicable.
@@ -945,9 +1616,9 @@ func fetchExtraStages(stages []config.KanikoStage, opts *config.KanikoOptions) e
 	return nil
 }
 
-func fromPreviousStage(copyCommand *instructions.CopyCommand, previousStageNames []string) bool {
+func fromPreviousStage(from string, previousStageNames []string) bool {
 	for _, previousStageName := range previousStageNames {
-		if previousStageName == copyCommand.From {
+		if strings.EqualFold(previousStageName, from) {
 			return true
 		}
 	}
@@ -957,7 +1628,7 @@ func fromPreviousStage(copyCommand *instructions.CopyCommand, previousStageNames
 func extractImageToDependencyDir(name string, image v1.Image) error {
 	t := timing.Start("Extracting Image to Dependency Dir")
 	defer timing.DefaultRun.Stop(t)
-	dependencyDir := filepath.Join(config.KanikoDir, name)
+	dependencyDir := filepath.Join(config.StagingDir(), name)
 	if err := os.MkdirAll(dependencyDir, 0755); err != nil {
 		return err
 	}
@@ -981,7 +1652,7 @@ func saveStageAsTarball(path string, image v1.Image) error {
 	return tarball.WriteToFile(tarPath, destRef, image)
 }
 
-func getHasher(snapshotMode string) (func(string) (string, error), error) {
+func getHasher(snapshotMode string, sampleRate float64) (func(string) (string, error), error) {
 	switch snapshotMode {
 	case constants.SnapshotModeTime:
 		logrus.Info("Only file modification time will be considered when snapshotting")
@@ -990,6 +1661,9 @@ func getHasher(snapshotMode string) (func(string) (string, error), error) {
 		return util.Hasher(), nil
 	case constants.SnapshotModeRedo:
 		return util.RedoHasher(), nil
+	case constants.SnapshotModeSampled:
+		logrus.Infof("Verifying the contents of %g%% of the files when snapshotting", sampleRate*100)
+		return util.SampledHasher(sampleRate), nil
 	default:
 		return nil, fmt.Errorf("%s is not a valid snapshot mode", snapshotMode)
 	}
@@ -1030,6 +1704,34 @@ func reviewConfig(stage config.KanikoStage, config *v1.Config) {
 	}
 }
 
+// annotate sets the key=value annotations on the manifest of image
+func annotate(image v1.Image, annotations []string) (v1.Image, error) {
+	if len(annotations) == 0 {
+		return image, nil
+	}
+	anns := make(map[string]string, len(annotations))
+	for _, a := range annotations {
+		parts := strings.SplitN(a, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("annotations must be of the form key=value, got %s", a)
+		}
+		anns[parts[0]] = parts[1]
+	}
+	return mutate.Annotations(image, anns).(v1.Image), nil
+}
+
+// recordDockerfileFragments labels the image with the Dockerfile fragments
+// included in the build, so it is possible to tell which ones were applied
+func recordDockerfileFragments(opts *config.KanikoOptions, config *v1.Config) {
+	if len(opts.ResolvedDockerfileFragments) == 0 {
+		return
+	}
+	if config.Labels == nil {
+		config.Labels = make(map[string]string)
+	}
+	config.Labels[constants.DockerfileFragmentsLabel] = strings.Join(opts.ResolvedDockerfileFragments, ",")
+}
+
 // iterates over a list of KanikoStage and resolves instructions referring to earlier stages
 // returns a mapping of stage name to stage id, f.e - ["first": "0", "second": "1", "target": "2"]
 func ResolveCrossStageInstructions(stages []config.KanikoStage) map[string]string {
@@ -1048,9 +1750,16 @@ func ResolveCrossStageInstructions(stages []config.KanikoStage) map[string]strin
 
 func (s stageBuilder) initSnapshotWithTimings() error {
 	t := timing.Start("Initial FS snapshot")
+	progress.SetPhase(progress.PhaseSnapshotting, "")
 	if err := s.snapshotter.Init(); err != nil {
 		return err
 	}
 	timing.DefaultRun.Stop(t)
+	if s.hashCache != nil {
+		// The cache dir may be read-only, later builds then hash the files again
+		if err := s.hashCache.Save(s.hashCachePath); err != nil {
+			logrus.Warnf("Unable to save file hashes to %s: %v", s.hashCachePath, err)
+		}
+	}
 	return nil
 }
@@ -19,12 +19,14 @@ package executor
 import (
 	"archive/tar"
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
+	"sync"
 	"testing"
 
 	"github.com/chainguard-dev/kaniko/pkg/cache"
@@ -399,6 +401,110 @@ COPY --from=second /bar /bat
 	}
 }
 
+func TestCalculateDependencies_onbuild(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "Dockerfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(f.Name(), []byte(`
+FROM scratch AS files
+COPY a /a
+FROM scratch AS builder
+ONBUILD COPY --from=files /a /b
+FROM builder
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := &config.KanikoOptions{DockerfilePath: f.Name()}
+	stages, metaArgs, err := dockerfile.ParseStages(opts)
+	testutil.CheckNoError(t, err)
+	kanikoStages, err := dockerfile.MakeKanikoStages(opts, stages, metaArgs)
+	testutil.CheckNoError(t, err)
+
+	got, err := CalculateDependencies(kanikoStages, opts, ResolveCrossStageInstructions(kanikoStages))
+	testutil.CheckErrorAndDeepEqual(t, false, err, map[int][]string{0: {"/a"}}, got)
+}
+
+func Test_baseImageTriggers(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "Dockerfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(f.Name(), []byte(`
+FROM scratch AS files
+COPY a /a
+FROM scratch AS builder
+ONBUILD COPY --from=files --chmod=755 --chown=1000 /a /b
+ONBUILD RUN --mount=type=bind,from=golang,target=/go --network=none go build
+FROM builder
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := &config.KanikoOptions{DockerfilePath: f.Name()}
+	stages, metaArgs, err := dockerfile.ParseStages(opts)
+	testutil.CheckNoError(t, err)
+	kanikoStages, err := dockerfile.MakeKanikoStages(opts, stages, metaArgs)
+	testutil.CheckNoError(t, err)
+
+	triggers, err := baseImageTriggers(kanikoStages, opts, ResolveCrossStageInstructions(kanikoStages))
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, []int{2}, func() []int {
+		var stages []int
+		for i := range triggers {
+			stages = append(stages, i)
+		}
+		return stages
+	}())
+	testutil.CheckDeepEqual(t, 2, len(triggers[2]))
+	copyCmd := triggers[2][0].(*instructions.CopyCommand)
+	testutil.CheckDeepEqual(t, "0", copyCmd.From)
+	testutil.CheckDeepEqual(t, "755", copyCmd.Chmod)
+	testutil.CheckDeepEqual(t, "1000", copyCmd.Chown)
+	runCmd := triggers[2][1].(*instructions.RunCommand)
+	mounts, err := dockerfile.RunMounts(runCmd, nil)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, "golang", mounts[0].From)
+	testutil.CheckDeepEqual(t, instructions.NetworkNone, dockerfile.RunNetwork(runCmd))
+
+	// The triggers are checked like the instructions of the Dockerfile
+	if err := os.WriteFile(f.Name(), []byte(`
+FROM scratch AS builder
+ONBUILD ADD --checksum=sha256:24454f830cdb571e2c4ad15481119c43b3cafd48dd869a9b2945d1036d1dc68d https://example.com/a /a
+FROM builder
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stages, metaArgs, err = dockerfile.ParseStages(opts)
+	testutil.CheckNoError(t, err)
+	kanikoStages, err = dockerfile.MakeKanikoStages(opts, stages, metaArgs)
+	testutil.CheckNoError(t, err)
+	_, err = baseImageTriggers(kanikoStages, opts, ResolveCrossStageInstructions(kanikoStages))
+	testutil.CheckError(t, true, err)
+}
+
+func TestCalculateDependencies_runMount(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "Dockerfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(f.Name(), []byte(`
+FROM scratch AS deps
+COPY vendor /src/vendor
+FROM scratch
+RUN --mount=type=bind,from=deps,source=/src/vendor,target=/vendor --mount=type=cache,target=/cache ls
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := &config.KanikoOptions{DockerfilePath: f.Name()}
+	stages, metaArgs, err := dockerfile.ParseStages(opts)
+	testutil.CheckNoError(t, err)
+	kanikoStages, err := dockerfile.MakeKanikoStages(opts, stages, metaArgs)
+	testutil.CheckNoError(t, err)
+
+	got, err := CalculateDependencies(kanikoStages, opts, ResolveCrossStageInstructions(kanikoStages))
+	testutil.CheckErrorAndDeepEqual(t, false, err, map[int][]string{0: {"/src/vendor"}}, got)
+}
+
 func Test_filesToSave(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -455,7 +561,7 @@ func Test_filesToSave(t *testing.T) {
 				fp.Close()
 			}
 
-			got, err := filesToSave(tt.args)
+			got, err := filesToSave(tt.args, tmpDir)
 			if err != nil {
 				t.Errorf("got err: %s", err)
 			}
@@ -639,6 +745,156 @@ func Test_stageBuilder_optimize(t *testing.T) {
 	}
 }
 
+// probeLayerCache is a layer cache safe for concurrent lookups, missing the
+// given keys
+type probeLayerCache struct {
+	mu      sync.Mutex
+	missing map[string]bool
+	probed  []string
+}
+
+func (c *probeLayerCache) RetrieveLayer(key string) (v1.Image, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.probed = append(c.probed, key)
+	if c.missing[key] {
+		return nil, errors.New("could not find layer")
+	}
+	return empty.Image, nil
+}
+
+func Test_stageBuilder_optimize_concurrentProbes(t *testing.T) {
+	newStageBuilder := func(opts *config.KanikoOptions, lc cache.LayerCache) *stageBuilder {
+		sb := &stageBuilder{opts: opts, cf: &v1.ConfigFile{}, snapshotter: &fakeSnapShotter{}, layerCache: lc,
+			args: dockerfile.NewBuildArgs([]string{})}
+		for _, c := range []string{"RUN one", "RUN two", "RUN three"} {
+			sb.cmds = append(sb.cmds, MockDockerCommand{command: c, cacheCommand: MockCachedDockerCommand{}})
+		}
+		return sb
+	}
+
+	// Sequential lookups stop at the first missing layer
+	lc := &probeLayerCache{}
+	sb := newStageBuilder(&config.KanikoOptions{Cache: true}, lc)
+	testutil.CheckNoError(t, sb.optimize(CompositeCache{}, sb.cf.Config))
+	keys := lc.probed
+	if len(keys) != 3 {
+		t.Fatalf("expected 3 lookups, got %v", keys)
+	}
+	lc = &probeLayerCache{missing: map[string]bool{keys[1]: true}}
+	sb = newStageBuilder(&config.KanikoOptions{Cache: true}, lc)
+	testutil.CheckNoError(t, sb.optimize(CompositeCache{}, sb.cf.Config))
+	testutil.CheckDeepEqual(t, keys[:2], lc.probed)
+
+	// Concurrent lookups probe every command, but only the commands before
+	// the first missing layer are cached
+	lc = &probeLayerCache{missing: map[string]bool{keys[1]: true}}
+	sb = newStageBuilder(&config.KanikoOptions{Cache: true, CacheProbeJobs: 2}, lc)
+	testutil.CheckNoError(t, sb.optimize(CompositeCache{}, sb.cf.Config))
+	sort.Strings(lc.probed)
+	sorted := append([]string{}, keys...)
+	sort.Strings(sorted)
+	testutil.CheckDeepEqual(t, sorted, lc.probed)
+	for i, cached := range []bool{true, false, false} {
+		if _, ok := sb.cmds[i].(MockCachedDockerCommand); ok != cached {
+			t.Errorf("command %d: expected cached to be %v, got %T", i, cached, sb.cmds[i])
+		}
+	}
+}
+
+// linkedMockCommand is a command whose layer doesn't depend on the previous
+// ones
+type linkedMockCommand struct {
+	MockDockerCommand
+}
+
+func (linkedMockCommand) IsLinked() bool {
+	return true
+}
+
+func (linkedMockCommand) LinkedLayer() string {
+	return ""
+}
+
+func Test_stageBuilder_optimize_linked(t *testing.T) {
+	newStageBuilder := func(first string, lc cache.LayerCache) *stageBuilder {
+		sb := &stageBuilder{opts: &config.KanikoOptions{Cache: true}, cf: &v1.ConfigFile{}, snapshotter: &fakeSnapShotter{}, layerCache: lc,
+			args: dockerfile.NewBuildArgs([]string{})}
+		sb.cmds = []commands.DockerCommand{
+			MockDockerCommand{command: first, cacheCommand: MockCachedDockerCommand{}},
+			linkedMockCommand{MockDockerCommand{command: "COPY --link foo /foo", cacheCommand: MockCachedDockerCommand{}}},
+			MockDockerCommand{command: "RUN three", cacheCommand: MockCachedDockerCommand{}},
+		}
+		return sb
+	}
+
+	lc := &probeLayerCache{}
+	sb := newStageBuilder("RUN one", lc)
+	testutil.CheckNoError(t, sb.optimize(CompositeCache{}, sb.cf.Config))
+	keys := lc.probed
+
+	// The key of the linked layer doesn't depend on the previous commands
+	lc = &probeLayerCache{}
+	sb = newStageBuilder("RUN other", lc)
+	testutil.CheckNoError(t, sb.optimize(CompositeCache{}, sb.cf.Config))
+	testutil.CheckDeepEqual(t, keys[1], lc.probed[1])
+	testutil.CheckDeepEqual(t, false, keys[0] == lc.probed[0])
+
+	// and the linked layer is used after a missing layer
+	lc = &probeLayerCache{missing: map[string]bool{keys[0]: true}}
+	sb = newStageBuilder("RUN one", lc)
+	testutil.CheckNoError(t, sb.optimize(CompositeCache{}, sb.cf.Config))
+	testutil.CheckDeepEqual(t, keys[:2], lc.probed)
+	for i, cached := range []bool{false, true, false} {
+		if _, ok := sb.cmds[i].(MockCachedDockerCommand); ok != cached {
+			t.Errorf("command %d: expected cached to be %v, got %T", i, cached, sb.cmds[i])
+		}
+	}
+}
+
+func Test_stageBuilder_cachedStageLayers(t *testing.T) {
+	dockerCommands := func(lines ...string) []commands.DockerCommand {
+		cmds, err := dockerfile.ParseCommands(lines)
+		testutil.CheckNoError(t, err)
+		var dockerCommands []commands.DockerCommand
+		for _, c := range cmds {
+			command, err := commands.GetCommand(c, util.FileContext{}, false, true, true)
+			testutil.CheckNoError(t, err)
+			dockerCommands = append(dockerCommands, command)
+		}
+		return dockerCommands
+	}
+	layer := fakeLayer{TarContent: []byte("cached")}
+	img := fakeImage{ImageLayers: []v1.Layer{layer}}
+
+	// The commands writing files are all cached
+	cmds := dockerCommands("ENV a=b", "RUN make", "COPY a b")
+	cmds[1] = cmds[1].CacheCommand(img)
+	cmds[2] = cmds[2].CacheCommand(img)
+	sb := &stageBuilder{cmds: append(cmds, nil)}
+	layers, err := sb.cachedStageLayers()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 2, len(layers))
+	for _, l := range layers {
+		testutil.CheckDeepEqual(t, layer.TarContent, l.(fakeLayer).TarContent)
+	}
+
+	// One of them is run
+	cmds = dockerCommands("RUN make", "COPY a b")
+	cmds[0] = cmds[0].CacheCommand(img)
+	sb = &stageBuilder{cmds: cmds}
+	layers, err = sb.cachedStageLayers()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 0, len(layers))
+
+	// A cached image has several layers
+	cmds = dockerCommands("RUN make")
+	cmds[0] = cmds[0].CacheCommand(fakeImage{ImageLayers: []v1.Layer{layer, layer}})
+	sb = &stageBuilder{cmds: cmds}
+	_, err = sb.cachedStageLayers()
+	testutil.CheckError(t, true, err)
+}
+
 type stageContext struct {
 	command fmt.Stringer
 	args    *dockerfile.BuildArgs
@@ -653,6 +909,65 @@ func newStageContext(command string, args map[string]string, env []string) stage
 	return stageContext{MockDockerCommand{command: command}, dockerArgs, env}
 }
 
+// remoteSourceCommand is a command with remote sources like ADD of git
+type remoteSourceCommand struct {
+	MockDockerCommand
+	keys []string
+}
+
+func (r remoteSourceCommand) RemoteSourceKeys(*v1.Config, *dockerfile.BuildArgs) ([]string, error) {
+	return r.keys, nil
+}
+
+func Test_stageBuilder_populateCompositeKey_remoteSources(t *testing.T) {
+	sb := &stageBuilder{fileContext: util.FileContext{Root: "workspace"}}
+	key := func(commit string) string {
+		cmd := remoteSourceCommand{MockDockerCommand{command: "ADD https://example.com/repo.git#main /src"}, []string{"https://example.com/repo.git#main@" + commit}}
+		ck, err := sb.populateCompositeKey(cmd, nil, *NewCompositeCache("base"), dockerfile.NewBuildArgs(nil), &v1.Config{})
+		testutil.CheckNoError(t, err)
+		hash, err := ck.Hash()
+		testutil.CheckNoError(t, err)
+		return hash
+	}
+	// The key changes along with the commit of the branch
+	if key("1111") == key("2222") {
+		t.Error("expected the commits of the remote sources to be part of the cache key")
+	}
+}
+
+func Test_stageBuilder_populateCompositeKey_bindMounts(t *testing.T) {
+	buildContext := t.TempDir()
+	sb := &stageBuilder{fileContext: util.FileContext{Root: buildContext}}
+	instrs, err := dockerfile.ParseCommands([]string{"RUN --mount=type=bind,source=go.mod,target=/app/go.mod go build"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := commands.GetCommand(instrs[0], sb.fileContext, false, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := func(content string) string {
+		if err := os.WriteFile(filepath.Join(buildContext, "go.mod"), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		ck, err := sb.populateCompositeKey(cmd, nil, *NewCompositeCache("base"), dockerfile.NewBuildArgs(nil), &v1.Config{})
+		testutil.CheckNoError(t, err)
+		hash, err := ck.Hash()
+		testutil.CheckNoError(t, err)
+		return hash
+	}
+	// The key changes along with the content of the files mounted
+	if key("module example.com/a") == key("module example.com/b") {
+		t.Error("expected the content of the bind mount sources to be part of the cache key")
+	}
+	// The cached command has the key of the command it was cached from
+	cached, err := sb.populateCompositeKey(cmd.CacheCommand(nil), nil, *NewCompositeCache("base"), dockerfile.NewBuildArgs(nil), &v1.Config{})
+	testutil.CheckNoError(t, err)
+	hash, err := cached.Hash()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, key("module example.com/b"), hash)
+}
+
 func Test_stageBuilder_populateCompositeKey(t *testing.T) {
 	type testcase struct {
 		description string
@@ -875,7 +1190,7 @@ func Test_stageBuilder_populateCompositeKey(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			fc1 := util.FileContext{Root: "workspace"}
+			fc1 := util.FileContext{Root: "/"}
 			dockerCommand1, err := commands.GetCommand(instructions1[0], fc1, false, true, true)
 			if err != nil {
 				t.Fatal(err)
@@ -886,17 +1201,17 @@ func Test_stageBuilder_populateCompositeKey(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			fc2 := util.FileContext{Root: "workspace"}
+			fc2 := util.FileContext{Root: "/"}
 			dockerCommand2, err := commands.GetCommand(instructions[0], fc2, false, true, true)
 			if err != nil {
 				t.Fatal(err)
 			}
 
-			ck1, err := sb.populateCompositeKey(dockerCommand1, []string{}, ck, tc.cmd1.args, tc.cmd1.env)
+			ck1, err := sb.populateCompositeKey(dockerCommand1, []string{}, ck, tc.cmd1.args, &v1.Config{Env: tc.cmd1.env})
 			if err != nil {
 				t.Errorf("Expected error to be nil but was %v", err)
 			}
-			ck2, err := sb.populateCompositeKey(dockerCommand2, []string{}, ck, tc.cmd2.args, tc.cmd2.env)
+			ck2, err := sb.populateCompositeKey(dockerCommand2, []string{}, ck, tc.cmd2.args, &v1.Config{Env: tc.cmd2.env})
 			if err != nil {
 				t.Errorf("Expected error to be nil but was %v", err)
 			}
@@ -1052,7 +1367,7 @@ func Test_stageBuilder_build(t *testing.T) {
 			tarContent := generateTar(t, dir, filename)
 
 			ch := NewCompositeCache("", fmt.Sprintf("COPY %s foo.txt", filename))
-			ch.AddPath(filepath, util.FileContext{})
+			addCopyKeys(t, ch, filepath, dir+"/foo.txt", "foo.txt", "")
 
 			hash, err := ch.Hash()
 			if err != nil {
@@ -1119,7 +1434,7 @@ func Test_stageBuilder_build(t *testing.T) {
 			destDir := t.TempDir()
 			filePath := filepath.Join(dir, filename)
 			ch := NewCompositeCache("", fmt.Sprintf("COPY %s foo.txt", filename))
-			ch.AddPath(filePath, util.FileContext{})
+			addCopyKeys(t, ch, filePath, filepath.Join(destDir, "foo.txt"), "foo.txt", destDir)
 
 			hash, err := ch.Hash()
 			if err != nil {
@@ -1185,7 +1500,7 @@ COPY %s foo.txt
 			}
 
 			ch.AddKey(fmt.Sprintf("COPY %s bar.txt", filename))
-			ch.AddPath(filePath, util.FileContext{})
+			addCopyKeys(t, ch, filePath, filepath.Join(destDir, "bar.txt"), "bar.txt", destDir)
 
 			hash2, err := ch.Hash()
 			if err != nil {
@@ -1193,7 +1508,7 @@ COPY %s foo.txt
 			}
 			ch = NewCompositeCache("", fmt.Sprintf("COPY %s foo.txt", filename))
 			ch.AddKey(fmt.Sprintf("COPY %s bar.txt", filename))
-			ch.AddPath(filePath, util.FileContext{})
+			addCopyKeys(t, ch, filePath, filepath.Join(destDir, "bar.txt"), "bar.txt", destDir)
 
 			image := fakeImage{
 				ImageLayers: []v1.Layer{
@@ -1253,7 +1568,7 @@ COPY %s bar.txt
 			filePath := filepath.Join(dir, filename)
 
 			ch := NewCompositeCache("", fmt.Sprintf("COPY %s bar.txt", filename))
-			ch.AddPath(filePath, util.FileContext{})
+			addCopyKeys(t, ch, filePath, filepath.Join(destDir, "bar.txt"), "bar.txt", destDir)
 
 			// copy hash
 			_, err := ch.Hash()
@@ -1582,6 +1897,17 @@ func tempDirAndFile(t *testing.T) (string, []string) {
 	return dir, filenames
 }
 
+// addCopyKeys adds the keys of a COPY of the file at src, copied to destPath,
+// to ck
+func addCopyKeys(t *testing.T, ck *CompositeCache, src, destPath, dest, workdir string) {
+	t.Helper()
+	digest, err := util.CacheHasher()(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ck.AddKey(destPath+"="+digest, fmt.Sprintf("dest=%s workdir=%s chown= chmod=", dest, workdir))
+}
+
 func generateTar(t *testing.T, dir string, fileNames ...string) []byte {
 	buf := bytes.NewBuffer([]byte{})
 	writer := tar.NewWriter(buf)
@@ -1628,6 +1954,22 @@ func hashCompositeKeys(t *testing.T, ck1 CompositeCache, ck2 CompositeCache) (st
 
 func Test_stageBuild_populateCompositeKeyForCopyCommand(t *testing.T) {
 	// See https://github.com/chainguard-dev/kaniko/issues/589
+	originalKanikoDir := config.KanikoDir
+	defer func() { config.KanikoDir = originalKanikoDir }()
+	config.KanikoDir = t.TempDir()
+	workspace := t.TempDir()
+	for _, dir := range []string{workspace, filepath.Join(config.StagingDir(), "0")} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "foo.txt"), []byte("foo"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	digest, err := util.CacheHasher()(filepath.Join(workspace, "foo.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	for _, tc := range []struct {
 		description      string
@@ -1638,12 +1980,12 @@ func Test_stageBuild_populateCompositeKeyForCopyCommand(t *testing.T) {
 			description: "multi-stage copy command",
 			// dont use digest from previoust stage for COPY
 			command:          "COPY --from=0 foo.txt bar.txt",
-			expectedCacheKey: "COPY --from=0 foo.txt bar.txt",
+			expectedCacheKey: "COPY --from=0 foo.txt bar.txt-/bar.txt=" + digest + "-dest=bar.txt workdir= chown= chmod=",
 		},
 		{
 			description:      "copy command",
 			command:          "COPY foo.txt bar.txt",
-			expectedCacheKey: "COPY foo.txt bar.txt",
+			expectedCacheKey: "COPY foo.txt bar.txt-/bar.txt=" + digest + "-dest=bar.txt workdir= chown= chmod=",
 		},
 	} {
 		t.Run(tc.description, func(t *testing.T) {
@@ -1652,7 +1994,7 @@ func Test_stageBuild_populateCompositeKeyForCopyCommand(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			fc := util.FileContext{Root: "workspace"}
+			fc := util.FileContext{Root: workspace}
 			copyCommand, err := commands.GetCommand(instructions[0], fc, false, true, true)
 			if err != nil {
 				t.Fatal(err)
@@ -1681,7 +2023,7 @@ func Test_stageBuild_populateCompositeKeyForCopyCommand(t *testing.T) {
 						[]string{},
 						ck,
 						dockerfile.NewBuildArgs([]string{}),
-						[]string{},
+						&v1.Config{},
 					)
 					if err != nil {
 						t.Fatal(err)
@@ -2022,3 +2364,62 @@ func Test_stageBuilder_convertLayerMediaType(t *testing.T) {
 		})
 	}
 }
+
+func Test_setPlatform(t *testing.T) {
+	tests := []struct {
+		name          string
+		opts          *config.KanikoOptions
+		stagePlatform string
+		base          v1.ConfigFile
+		want          v1.ConfigFile
+	}{
+		{
+			name: "custom platform with variant",
+			opts: &config.KanikoOptions{CustomPlatform: "linux/arm/v7"},
+			want: v1.ConfigFile{OS: "linux", Architecture: "arm", Variant: "v7"},
+		},
+		{
+			name: "os version and features",
+			opts: &config.KanikoOptions{
+				CustomPlatform: "windows/amd64",
+				OSVersion:      "10.0.17763.1234",
+				OSFeatures:     []string{"win32k"},
+			},
+			base: v1.ConfigFile{OSVersion: "10.0.17763.1"},
+			want: v1.ConfigFile{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1234", OSFeatures: []string{"win32k"}},
+		},
+		{
+			name: "os version of the base image is kept",
+			opts: &config.KanikoOptions{CustomPlatform: "windows/amd64"},
+			base: v1.ConfigFile{OSVersion: "10.0.17763.1"},
+			want: v1.ConfigFile{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1"},
+		},
+		{
+			name:          "platform of the final stage",
+			opts:          &config.KanikoOptions{CustomPlatform: "linux/amd64"},
+			stagePlatform: "linux/arm64",
+			want:          v1.ConfigFile{OS: "linux", Architecture: "arm64"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.base
+			err := setPlatform(&got, tt.opts, tt.stagePlatform)
+			testutil.CheckErrorAndDeepEqual(t, false, err, tt.want, got)
+		})
+	}
+}
+
+func Test_annotate(t *testing.T) {
+	image, err := annotate(empty.Image, []string{"org.opencontainers.image.description=multi\nline", "empty="})
+	testutil.CheckNoError(t, err)
+	manifest, err := image.Manifest()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, map[string]string{
+		"org.opencontainers.image.description": "multi\nline",
+		"empty":                                "",
+	}, manifest.Annotations)
+
+	_, err = annotate(empty.Image, []string{"invalid"})
+	testutil.CheckError(t, true, err)
+}
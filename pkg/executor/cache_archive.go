@@ -0,0 +1,121 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/chainguard-dev/kaniko/pkg/cache"
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// cacheArchives are the archives of cached layers imported with
+// --cache-import and exported with --cache-export
+type cacheArchives struct {
+	imported *cache.Archive
+	exported *cache.Archive
+	// repoless is set when the archives are the only cache, without a cache
+	// repo to look the layers up in and push them to
+	repoless bool
+}
+
+// openCacheArchives extracts the archive imported with --cache-import and
+// creates the one exported with --cache-export, or returns nil if there are
+// none
+func openCacheArchives(opts *config.KanikoOptions) (*cacheArchives, error) {
+	if !opts.Cache || (opts.CacheImport == "" && opts.CacheExport == "") {
+		return nil, nil
+	}
+	a := &cacheArchives{repoless: opts.CacheRepo == "" && opts.NoPush}
+	if opts.CacheImport != "" {
+		dir := filepath.Join(config.KanikoDir, "cache-import")
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, err
+		}
+		imported, err := cache.ImportArchive(opts.CacheImport, dir)
+		if err != nil {
+			return nil, errors.Wrap(err, "importing cache archive")
+		}
+		a.imported = imported
+	}
+	if opts.CacheExport != "" {
+		dir := filepath.Join(config.KanikoDir, "cache-export")
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, err
+		}
+		exported, err := cache.NewArchive(dir)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating cache archive")
+		}
+		a.exported = exported
+	}
+	return a, nil
+}
+
+// layerCache returns the cache looking the layers up in the imported archive
+// before repos, and adding the ones found to the exported archive
+func (a *cacheArchives) layerCache(opts *config.KanikoOptions, repos cache.LayerCache) cache.LayerCache {
+	var caches cache.MultiCache
+	if a.imported != nil {
+		importOpts := *opts
+		importOpts.CacheRepo = opts.CacheImport
+		caches = append(caches, &cache.BackendCache{Opts: &importOpts, Backend: a.imported})
+	}
+	if !a.repoless {
+		caches = append(caches, repos)
+	} else if a.exported != nil {
+		// The layers of the previous stages may be cached already
+		exportOpts := *opts
+		exportOpts.CacheRepo = opts.CacheExport
+		caches = append(caches, &cache.BackendCache{Opts: &exportOpts, Backend: a.exported})
+	}
+	if a.exported == nil {
+		return caches
+	}
+	return &copyingCache{LayerCache: caches, backend: a.exported}
+}
+
+// export writes the exported archive to the tarball set with --cache-export
+func (a *cacheArchives) export(path string) error {
+	if a == nil || a.exported == nil {
+		return nil
+	}
+	logrus.Infof("Exporting the cached layers of the build to %s", path)
+	return a.exported.Export(path)
+}
+
+// copyingCache adds the layers found in a cache to another backend, like the
+// exported archive or the local cache
+type copyingCache struct {
+	cache.LayerCache
+	backend cache.Backend
+}
+
+func (c *copyingCache) RetrieveLayer(ck string) (v1.Image, error) {
+	img, err := c.LayerCache.RetrieveLayer(ck)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.backend.Put(ck, img); err != nil {
+		logrus.Warnf("Unable to copy cached layer %s: %v", ck, err)
+	}
+	return img, nil
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/cache"
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestCacheArchives(t *testing.T) {
+	dir := t.TempDir()
+	opts := &config.KanikoOptions{CacheOptions: config.CacheOptions{CacheTTL: time.Hour}}
+	img, err := cachedLayerImage(opts, writeRunLayer(t, "cached"), "RUN make")
+	testutil.CheckNoError(t, err)
+
+	imported, err := cache.NewArchive(filepath.Join(dir, "import"))
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, imported.Put("imported", img))
+	exported, err := cache.NewArchive(filepath.Join(dir, "export"))
+	testutil.CheckNoError(t, err)
+	a := &cacheArchives{imported: imported, exported: exported}
+
+	repos := &fakeLayerCache{retrieve: true, img: img}
+	lc := a.layerCache(opts, repos)
+
+	// The layers are looked up in the imported archive first
+	_, err = lc.RetrieveLayer("imported")
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 0, len(repos.receivedKeys))
+	_, err = lc.RetrieveLayer("remote")
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, []string{"remote"}, repos.receivedKeys)
+
+	// The layers built are exported as well as the ones found
+	testutil.CheckNoError(t, (&stageBuilder{opts: opts, cacheArchives: a}).storeCachedLayer("built", writeRunLayer(t, "binary"), "RUN make"))
+	tarPath := filepath.Join(dir, "cache.tar")
+	testutil.CheckNoError(t, a.export(tarPath))
+	archive, err := cache.ImportArchive(tarPath, filepath.Join(dir, "reimport"))
+	testutil.CheckNoError(t, err)
+	for _, key := range []string{"imported", "remote", "built"} {
+		if _, err := archive.Probe(key); err != nil {
+			t.Errorf("expected %s to be exported: %v", key, err)
+		}
+	}
+
+	// Without a cache repo, the layers are only looked up in the archives
+	a.repoless = true
+	repos.receivedKeys = nil
+	_, err = a.layerCache(opts, repos).RetrieveLayer("built")
+	testutil.CheckNoError(t, err)
+	_, err = a.layerCache(opts, repos).RetrieveLayer("missing")
+	testutil.CheckError(t, true, err)
+	testutil.CheckDeepEqual(t, 0, len(repos.receivedKeys))
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"os"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/cache"
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// localLayers returns the cached layers of the local cache, written with
+// --cache-dir-write by this build or by previous ones, or nil if there are
+// none
+func localLayers(opts *config.KanikoOptions) cache.Backend {
+	if !opts.Cache || opts.CacheDir == "" {
+		return nil
+	}
+	if !opts.CacheDirWrite {
+		if _, err := os.Stat(cache.LocalLayersDir(&opts.CacheOptions)); err != nil {
+			return nil
+		}
+	}
+	return cache.LocalLayers(&opts.CacheOptions)
+}
+
+// storeCachedLayer adds the layer at tarPath, cached for cacheKey, to the
+// local cache with --cache-dir-write and to the archive exported with
+// --cache-export
+func (s *stageBuilder) storeCachedLayer(cacheKey, tarPath, createdBy string) error {
+	var backends []cache.Backend
+	if s.opts.CacheDirWrite && s.opts.CacheDir != "" {
+		backends = append(backends, cache.LocalLayers(&s.opts.CacheOptions))
+	}
+	if s.cacheArchives != nil && s.cacheArchives.exported != nil {
+		backends = append(backends, s.cacheArchives.exported)
+	}
+	if len(backends) == 0 {
+		return nil
+	}
+	img, err := cachedLayerImage(s.opts, tarPath, createdBy)
+	if err != nil {
+		return err
+	}
+	for _, b := range backends {
+		if err := b.Put(cacheKey, img); err != nil {
+			return errors.Wrapf(err, "storing cached layer %s", cacheKey)
+		}
+	}
+	return nil
+}
+
+// lockCacheDir takes a shared lock on the local cache for the build, for the
+// concurrent builds not to evict the base images and layers it is about to
+// use, or returns nil if there is no local cache
+func lockCacheDir(opts *config.KanikoOptions) *cache.Lock {
+	if !opts.Cache || opts.CacheDir == "" {
+		return nil
+	}
+	lock, err := cache.LockShared(opts.CacheDir)
+	if err != nil {
+		logrus.Warnf("Unable to lock cache %s, concurrent builds may evict the images and layers used by this one: %v", opts.CacheDir, err)
+	}
+	return lock
+}
+
+// pruneCacheDir evicts the least recently used base images and layers from
+// the local cache written with --cache-dir-write, once over the budget set
+// with --cache-dir-max-size. The ones used by the build started at start are
+// kept. The lock of the build on the cache is released first, the cache
+// being only pruned when no other build holds it.
+func pruneCacheDir(opts *config.KanikoOptions, start time.Time, lock *cache.Lock) {
+	lock.Close()
+	if !opts.Cache || !opts.CacheDirWrite || opts.CacheDir == "" {
+		return
+	}
+	maxSize, err := opts.CacheDirMaxSizeBytes()
+	if err != nil || maxSize == 0 {
+		return
+	}
+	if err := cache.Prune(&opts.CacheOptions, maxSize, start); err != nil {
+		logrus.Warnf("Unable to prune cache %s: %v", opts.CacheDir, err)
+	}
+}
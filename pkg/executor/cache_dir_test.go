@@ -0,0 +1,50 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestLocalLayers(t *testing.T) {
+	opts := &config.KanikoOptions{
+		Cache:        true,
+		CacheOptions: config.CacheOptions{CacheDir: t.TempDir(), CacheTTL: time.Hour},
+	}
+	if localLayers(opts) != nil {
+		t.Fatal("expected no local layers before any were written")
+	}
+
+	// The layers built are written to the local cache with --cache-dir-write
+	writeOpts := *opts
+	writeOpts.CacheDirWrite = true
+	testutil.CheckNoError(t, (&stageBuilder{opts: &writeOpts}).storeCachedLayer("built", writeRunLayer(t, "binary"), "RUN make"))
+
+	// and looked up by the following builds, whether they write or not
+	if localLayers(opts) == nil {
+		t.Fatal("expected the local layers written by the previous build")
+	}
+	img, err := newLayerCache(opts).RetrieveLayer("built")
+	testutil.CheckNoError(t, err)
+	layers, err := img.Layers()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 1, len(layers))
+}
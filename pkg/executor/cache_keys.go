@@ -0,0 +1,80 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// CacheKeyContributor returns values added to the cache keys of all the
+// commands of the build of opts, like the versions of the toolchains of the
+// builder or a policy epoch, for the cached layers to be invalidated when they
+// change without changing the Dockerfiles.
+type CacheKeyContributor func(opts *config.KanikoOptions) ([]string, error)
+
+var (
+	cacheKeyContributorsMu sync.RWMutex
+	cacheKeyContributors   = map[string]CacheKeyContributor{}
+)
+
+// RegisterCacheKeyContributor registers a contributor to the cache keys of
+// every build, for programs embedding kaniko. It panics if a contributor is
+// already registered with that name.
+func RegisterCacheKeyContributor(name string, c CacheKeyContributor) {
+	cacheKeyContributorsMu.Lock()
+	defer cacheKeyContributorsMu.Unlock()
+	if _, ok := cacheKeyContributors[name]; ok {
+		panic(fmt.Sprintf("cache key contributor %s registered twice", name))
+	}
+	cacheKeyContributors[name] = c
+}
+
+// cacheKeyContributions returns the values of --cache-key and of the
+// registered contributors, by name, added to the cache keys of the build.
+func cacheKeyContributions(opts *config.KanikoOptions) ([]string, error) {
+	keys := []string{}
+	for _, k := range opts.CacheKeys {
+		keys = append(keys, "cache-key="+k)
+	}
+
+	cacheKeyContributorsMu.RLock()
+	defer cacheKeyContributorsMu.RUnlock()
+	names := make([]string, 0, len(cacheKeyContributors))
+	for name := range cacheKeyContributors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values, err := cacheKeyContributors[name](opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "running cache key contributor %s", name)
+		}
+		for _, v := range values {
+			keys = append(keys, name+"="+v)
+		}
+	}
+	if len(keys) > 0 {
+		logrus.Debugf("Adding %v to the cache keys", keys)
+	}
+	return keys, nil
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func Test_cacheKeyContributions(t *testing.T) {
+	RegisterCacheKeyContributor("test-toolchain", func(opts *config.KanikoOptions) ([]string, error) {
+		return []string{"go1.24", "rustc-1.87"}, nil
+	})
+	RegisterCacheKeyContributor("test-epoch", func(opts *config.KanikoOptions) ([]string, error) {
+		return []string{"3"}, nil
+	})
+	defer func() {
+		delete(cacheKeyContributors, "test-toolchain")
+		delete(cacheKeyContributors, "test-epoch")
+	}()
+
+	keys, err := cacheKeyContributions(&config.KanikoOptions{CacheKeys: []string{"fleet-2"}})
+	testutil.CheckErrorAndDeepEqual(t, false, err, []string{
+		"cache-key=fleet-2",
+		"test-epoch=3",
+		"test-toolchain=go1.24",
+		"test-toolchain=rustc-1.87",
+	}, keys)
+
+	RegisterCacheKeyContributor("test-failing", func(opts *config.KanikoOptions) ([]string, error) {
+		return nil, errors.New("no toolchain")
+	})
+	defer delete(cacheKeyContributors, "test-failing")
+	_, err = cacheKeyContributions(&config.KanikoOptions{})
+	testutil.CheckError(t, true, err)
+}
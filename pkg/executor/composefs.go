@@ -0,0 +1,74 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/util"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	composefsImage   = "image.cfs"
+	composefsDigest  = "image.digest"
+	composefsObjects = "objects"
+)
+
+// for testing
+var mkcomposefs = "mkcomposefs"
+
+// writeComposefs writes the composefs metadata of the filesystem of image to
+// dir/image.cfs, with the file contents in the dir/objects store named by
+// their fs-verity digest. The fs-verity digest of the metadata image is
+// written to dir/image.digest. It relies on the mkcomposefs tool.
+func writeComposefs(image v1.Image, dir string) error {
+	bin, err := exec.LookPath(mkcomposefs)
+	if err != nil {
+		return errors.Wrap(err, "composefs output requires mkcomposefs")
+	}
+	objects := filepath.Join(dir, composefsObjects)
+	if err := os.MkdirAll(objects, 0o755); err != nil {
+		return err
+	}
+
+	// The staging directory is ignored, so the whole image is extracted there
+	rootfs, err := os.MkdirTemp(config.StagingDir(), "composefs-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(rootfs)
+	if _, err := util.GetFSFromImage(rootfs, image, util.ExtractFile); err != nil {
+		return errors.Wrap(err, "extracting image filesystem")
+	}
+
+	logrus.Infof("Writing composefs metadata to %s", dir)
+	var stdout bytes.Buffer
+	cmd := exec.Command(bin, "--print-digest", "--digest-store="+objects, rootfs, filepath.Join(dir, composefsImage))
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrap(err, "running mkcomposefs")
+	}
+	return os.WriteFile(filepath.Join(dir, composefsDigest), bytes.TrimSpace(stdout.Bytes()), 0o644)
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func Test_writeComposefs(t *testing.T) {
+	bin := t.TempDir()
+	dir := t.TempDir()
+	// fake mkcomposefs recording its arguments
+	script := "#!/bin/sh\necho \"$@\" > " + filepath.Join(dir, "args") + "\necho abcdef\n"
+	if err := os.WriteFile(filepath.Join(bin, "mkcomposefs"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	original, originalKanikoDir := mkcomposefs, config.KanikoDir
+	defer func() { mkcomposefs, config.KanikoDir = original, originalKanikoDir }()
+	mkcomposefs = filepath.Join(bin, "mkcomposefs")
+	config.KanikoDir = t.TempDir()
+
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckNoError(t, writeComposefs(image, dir))
+
+	digest, err := os.ReadFile(filepath.Join(dir, "image.digest"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, "abcdef", string(digest))
+	_, err = os.Stat(filepath.Join(dir, "objects"))
+	testutil.CheckNoError(t, err)
+	args, err := os.ReadFile(filepath.Join(dir, "args"))
+	testutil.CheckNoError(t, err)
+	if !strings.HasPrefix(string(args), "--print-digest --digest-store="+filepath.Join(dir, "objects")) ||
+		!strings.HasSuffix(string(args), filepath.Join(dir, "image.cfs")+"\n") {
+		t.Errorf("unexpected mkcomposefs arguments %s", args)
+	}
+}
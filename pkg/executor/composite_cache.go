@@ -79,7 +79,7 @@ func (s *CompositeCache) AddPath(p string, context util.FileContext) error {
 	if context.ExcludesFile(p) {
 		return nil
 	}
-	fh, err := util.CacheHasher()(p)
+	fh, err := contentHash(p, fi, context)
 	if err != nil {
 		return err
 	}
@@ -91,6 +91,20 @@ func (s *CompositeCache) AddPath(p string, context util.FileContext) error {
 	return nil
 }
 
+// contentHash returns the digest of p recorded when fetching the build context,
+// or hashes p if there is none. The digests recorded while fetching the build
+// context don't depend on the file metadata of the extracted context, which
+// may differ across runners.
+func contentHash(p string, fi os.FileInfo, context util.FileContext) (string, error) {
+	if d, ok := context.Digests[p]; ok {
+		return d, nil
+	}
+	if fi.IsDir() && len(context.Digests) > 0 {
+		return "dir", nil
+	}
+	return util.CacheHasher()(p)
+}
+
 // HashDir returns a hash of the directory.
 func hashDir(p string, context util.FileContext) (bool, string, error) {
 	sha := sha256.New()
@@ -104,7 +118,7 @@ func hashDir(p string, context util.FileContext) (bool, string, error) {
 			return nil
 		}
 
-		fileHash, err := util.CacheHasher()(path)
+		fileHash, err := contentHash(path, fi, context)
 		if err != nil {
 			return err
 		}
@@ -523,3 +523,41 @@ func Test_CompositeKey_AddPath_WithExtraDirIgnored_Works(t *testing.T) {
 		})
 	}
 }
+
+func Test_CompositeKey_AddPath_ContextDigests(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("meow"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	context := util.FileContext{Root: dir, Digests: map[string]string{file: "git:0100644:abc"}}
+
+	hash := func() string {
+		r := NewCompositeCache()
+		if err := r.AddPath(dir, context); err != nil {
+			t.Fatal(err)
+		}
+		h, err := r.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	before := hash()
+
+	// The recorded digests don't depend on the file metadata
+	if err := os.Chmod(file, 0o664); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0o775); err != nil {
+		t.Fatal(err)
+	}
+	if after := hash(); after != before {
+		t.Errorf("expected hash %s to not change when file modes change, got %s", before, after)
+	}
+
+	context.Digests[file] = "git:0100644:def"
+	if after := hash(); after == before {
+		t.Errorf("expected hash to change when the recorded digest changes")
+	}
+}
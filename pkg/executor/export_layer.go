@@ -0,0 +1,239 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chainguard-dev/kaniko/pkg/cache"
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/image/remote"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ExportedLayer describes a layer of an image, along with the instruction
+// that created it
+type ExportedLayer struct {
+	Index     int
+	Digest    v1.Hash
+	Size      int64
+	CreatedBy string
+	layer     v1.Layer
+}
+
+// LoadImage loads the image at ref, which is either the OCI image layout
+// written with --oci-layout-path, as oci:<path>, the tarball written with
+// --tar-path, or a reference to an image in a registry, like a cached layer.
+// The last image of a layout is loaded, as the images of the builds are
+// appended to it.
+func LoadImage(ref string, opts config.RegistryOptions, platform string) (v1.Image, error) {
+	if path, ok := strings.CutPrefix(ref, "oci:"); ok {
+		return cache.LocateImage(path)
+	}
+	if fi, err := os.Stat(ref); err == nil {
+		if fi.IsDir() {
+			return cache.LocateImage(ref)
+		}
+		return tarball.ImageFromPath(ref, nil)
+	}
+	return remote.RetrieveRemoteImage(ref, opts, platform)
+}
+
+// ImageLayers returns the layers of image, with the instructions that created
+// them, from the history of the image
+func ImageLayers(image v1.Image) ([]ExportedLayer, error) {
+	layers, err := image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	cf, err := image.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	var createdBy []string
+	for _, h := range cf.History {
+		if !h.EmptyLayer {
+			createdBy = append(createdBy, h.CreatedBy)
+		}
+	}
+
+	exported := make([]ExportedLayer, len(layers))
+	for i, l := range layers {
+		digest, err := l.Digest()
+		if err != nil {
+			return nil, err
+		}
+		size, err := l.Size()
+		if err != nil {
+			return nil, err
+		}
+		exported[i] = ExportedLayer{Index: i, Digest: digest, Size: size, layer: l}
+		// The history of images without one for each layer cannot be matched
+		if len(createdBy) == len(layers) {
+			exported[i].CreatedBy = createdBy[i]
+		}
+	}
+	return exported, nil
+}
+
+// SelectLayer returns the layer at index of layers, counted from the last one
+// if negative, or the last layer created by an instruction containing
+// instruction if set
+func SelectLayer(layers []ExportedLayer, index int, instruction string) (ExportedLayer, error) {
+	if instruction != "" {
+		for i := len(layers) - 1; i >= 0; i-- {
+			if strings.Contains(layers[i].CreatedBy, instruction) {
+				return layers[i], nil
+			}
+		}
+		return ExportedLayer{}, fmt.Errorf("no layer was created by an instruction containing %q", instruction)
+	}
+	if index < 0 {
+		index += len(layers)
+	}
+	if index < 0 || index >= len(layers) {
+		return ExportedLayer{}, fmt.Errorf("no layer %d, the image has %d layers", index, len(layers))
+	}
+	return layers[index], nil
+}
+
+// ExportLayerTar writes the uncompressed tar of layer to path
+func ExportLayerTar(layer ExportedLayer, path string) error {
+	rc, err := layer.layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		return errors.Wrapf(err, "writing layer %d to %s", layer.Index, path)
+	}
+	return f.Close()
+}
+
+// ExportLayerDir extracts the files of layer into dir as they are in the
+// layer, without applying its whiteouts, which are extracted as the empty
+// .wh.<name> files marking the files the layer deletes.
+func ExportLayerDir(layer ExportedLayer, dir string) error {
+	rc, err := layer.layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "reading layer %d", layer.Index)
+		}
+		if err := extractExportedFile(dir, hdr, tr); err != nil {
+			return errors.Wrapf(err, "extracting %s", hdr.Name)
+		}
+	}
+}
+
+// extractExportedFile extracts the file of hdr into dir. Unlike the files of
+// the images unpacked by the build, it is never ignored, it is only owned by
+// the owner in the layer when running as root, and its parent directories are
+// resolved within dir, for the symbolic links of the layer not to point the
+// files outside of it.
+func extractExportedFile(dir string, hdr *tar.Header, r io.Reader) error {
+	name := filepath.Clean("/" + hdr.Name)
+	if name == "/" {
+		return nil
+	}
+	parent, err := securejoin.SecureJoin(dir, filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(parent, filepath.Base(name))
+	if err := os.MkdirAll(parent, 0o755); err != nil {
+		return err
+	}
+	// The files in place are replaced rather than written through
+	if fi, err := os.Lstat(path); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		target, err := securejoin.SecureJoin(dir, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		return os.Link(target, path)
+	default:
+		logrus.Warnf("Skipping %s, exporting files of type %c is not supported", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	// The mode is set past the umask, and after the owner which clears setuid
+	mode := hdr.FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestExportLayer(t *testing.T) {
+	image, err := mutate.Append(empty.Image,
+		mutate.Addendum{
+			Layer:   tarLayer(t, map[string]string{"etc/app.conf": "a", "etc/old.conf": "b"}),
+			History: v1.History{CreatedBy: "COPY etc /etc"},
+		},
+		mutate.Addendum{History: v1.History{CreatedBy: "ENV A=b", EmptyLayer: true}},
+		mutate.Addendum{
+			Layer:   tarLayer(t, map[string]string{"etc/.wh.old.conf": "", "usr/bin/app": "app"}),
+			History: v1.History{CreatedBy: "RUN make install"},
+		},
+	)
+	testutil.CheckNoError(t, err)
+
+	// The images are loaded from the tarballs written with --tar-path
+	tarPath := filepath.Join(t.TempDir(), "image.tar")
+	testutil.CheckNoError(t, tarball.WriteToFile(tarPath, name.MustParseReference("app:latest"), image))
+	image, err = LoadImage(tarPath, config.RegistryOptions{}, "")
+	testutil.CheckNoError(t, err)
+
+	layers, err := ImageLayers(image)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 2, len(layers))
+	testutil.CheckDeepEqual(t, "COPY etc /etc", layers[0].CreatedBy)
+	testutil.CheckDeepEqual(t, "RUN make install", layers[1].CreatedBy)
+
+	for _, test := range []struct {
+		index       int
+		instruction string
+		expected    int
+	}{
+		{index: 0, expected: 0},
+		{index: -1, expected: 1},
+		{instruction: "make install", expected: 1},
+	} {
+		layer, err := SelectLayer(layers, test.index, test.instruction)
+		testutil.CheckErrorAndDeepEqual(t, false, err, test.expected, layer.Index)
+	}
+	_, err = SelectLayer(layers, 2, "")
+	testutil.CheckError(t, true, err)
+	_, err = SelectLayer(layers, 0, "apt-get")
+	testutil.CheckError(t, true, err)
+
+	// The whiteouts are kept, to show what the layer deletes
+	dir := t.TempDir()
+	testutil.CheckNoError(t, ExportLayerDir(layers[1], dir))
+	for file, content := range map[string]string{"etc/.wh.old.conf": "", "usr/bin/app": "app"} {
+		b, err := os.ReadFile(filepath.Join(dir, file))
+		testutil.CheckErrorAndDeepEqual(t, false, err, content, string(b))
+	}
+
+	layerTar := filepath.Join(t.TempDir(), "layer.tar")
+	testutil.CheckNoError(t, ExportLayerTar(layers[0], layerTar))
+	l, err := tarball.LayerFromFile(layerTar)
+	testutil.CheckNoError(t, err)
+	diffID, err := l.DiffID()
+	testutil.CheckNoError(t, err)
+	expected, err := layers[0].layer.DiffID()
+	testutil.CheckErrorAndDeepEqual(t, false, err, expected, diffID)
+}
+
+func TestExportLayerDir_symlinks(t *testing.T) {
+	outside := t.TempDir()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range []*tar.Header{
+		{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: outside},
+		{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "../../.."},
+		{Name: "escape/pwned", Typeflag: tar.TypeReg, Mode: 0o644, Size: 1},
+		{Name: "up/pwned", Typeflag: tar.TypeReg, Mode: 0o644, Size: 1},
+		// Kaniko ignores its own directory in the images it unpacks
+		{Name: "kaniko/file", Typeflag: tar.TypeReg, Mode: 0o644, Size: 1},
+	} {
+		testutil.CheckNoError(t, tw.WriteHeader(hdr))
+		if hdr.Size > 0 {
+			tw.Write([]byte("x"))
+		}
+	}
+	testutil.CheckNoError(t, tw.Close())
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	testutil.CheckNoError(t, err)
+
+	dir := t.TempDir()
+	testutil.CheckNoError(t, ExportLayerDir(ExportedLayer{layer: layer}, dir))
+	// The symbolic links of the layer are resolved within dir
+	_, err = os.Stat(filepath.Join(outside, "pwned"))
+	testutil.CheckDeepEqual(t, true, os.IsNotExist(err))
+	for _, file := range []string{outside + "/pwned", "pwned", "kaniko/file"} {
+		b, err := os.ReadFile(filepath.Join(dir, file))
+		testutil.CheckErrorAndDeepEqual(t, false, err, "x", string(b))
+	}
+	link, err := os.Readlink(filepath.Join(dir, "escape"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, outside, link)
+}
@@ -44,6 +44,9 @@ func (f *fakeSnapShotter) TakeSnapshotFS() (string, error) {
 func (f *fakeSnapShotter) TakeSnapshot(_ []string, _, _ bool) (string, error) {
 	return f.tarPath, nil
 }
+func (f *fakeSnapShotter) RecordFiles(_ []string) error {
+	return nil
+}
 
 type MockDockerCommand struct {
 	command             string
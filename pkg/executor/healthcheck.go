@@ -0,0 +1,160 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+// The StartInterval of HEALTHCHECK --start-interval is part of the image spec,
+// but not of the config of go-containerregistry, which drops it whenever the
+// config of an image is mutated. It is read from the raw config of the base
+// images, and written to the raw config of the built ones.
+
+// healthcheckStartInterval returns the start interval of the healthcheck in
+// the config of image
+func healthcheckStartInterval(image v1.Image) (time.Duration, error) {
+	raw, err := image.RawConfigFile()
+	if err != nil {
+		return 0, err
+	}
+	var cf struct {
+		Config struct {
+			Healthcheck *struct {
+				StartInterval time.Duration `json:",omitempty"`
+			} `json:",omitempty"`
+		} `json:"config"`
+	}
+	if err := json.Unmarshal(raw, &cf); err != nil {
+		return 0, errors.Wrap(err, "parsing image config")
+	}
+	if cf.Config.Healthcheck == nil {
+		return 0, nil
+	}
+	return cf.Config.Healthcheck.StartInterval, nil
+}
+
+// withHealthcheckStartInterval returns image with the start interval of its
+// healthcheck set to startInterval. It must be the last change to the image,
+// as mutating it again drops the start interval.
+func withHealthcheckStartInterval(image v1.Image, startInterval time.Duration) (v1.Image, error) {
+	if startInterval == 0 {
+		return image, nil
+	}
+	cf, err := image.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if cf.Config.Healthcheck == nil {
+		return image, nil
+	}
+
+	raw, err := image.RawConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if raw, err = setRawField(raw, startInterval, "config", "Healthcheck", "StartInterval"); err != nil {
+		return nil, errors.Wrap(err, "setting healthcheck start interval")
+	}
+	configName, size, err := v1.SHA256(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := image.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	manifest = manifest.DeepCopy()
+	manifest.Config.Digest = configName
+	manifest.Config.Size = size
+	rawManifest, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	digest, _, err := v1.SHA256(bytes.NewReader(rawManifest))
+	if err != nil {
+		return nil, err
+	}
+	return &rawConfigImage{
+		Image:       image,
+		rawConfig:   raw,
+		configName:  configName,
+		manifest:    manifest,
+		rawManifest: rawManifest,
+		digest:      digest,
+	}, nil
+}
+
+// setRawField sets the field at path of the JSON object raw to value, keeping
+// the other fields, unknown ones included.
+func setRawField(raw []byte, value interface{}, path ...string) ([]byte, error) {
+	if len(path) == 0 {
+		return json.Marshal(value)
+	}
+	fields := map[string]json.RawMessage{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, err
+		}
+	}
+	field, err := setRawField(fields[path[0]], value, path[1:]...)
+	if err != nil {
+		return nil, err
+	}
+	fields[path[0]] = field
+	return json.Marshal(fields)
+}
+
+// rawConfigImage is an image with a raw config go-containerregistry cannot
+// represent
+type rawConfigImage struct {
+	v1.Image
+	rawConfig   []byte
+	configName  v1.Hash
+	manifest    *v1.Manifest
+	rawManifest []byte
+	digest      v1.Hash
+}
+
+func (i *rawConfigImage) RawConfigFile() ([]byte, error) {
+	return i.rawConfig, nil
+}
+
+func (i *rawConfigImage) ConfigName() (v1.Hash, error) {
+	return i.configName, nil
+}
+
+func (i *rawConfigImage) Manifest() (*v1.Manifest, error) {
+	return i.manifest.DeepCopy(), nil
+}
+
+func (i *rawConfigImage) RawManifest() ([]byte, error) {
+	return i.rawManifest, nil
+}
+
+func (i *rawConfigImage) Digest() (v1.Hash, error) {
+	return i.digest, nil
+}
+
+func (i *rawConfigImage) Size() (int64, error) {
+	return int64(len(i.rawManifest)), nil
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/validate"
+)
+
+func Test_withHealthcheckStartInterval(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	testutil.CheckNoError(t, err)
+
+	// Without healthcheck, there is no start interval to set
+	unchanged, err := withHealthcheckStartInterval(img, time.Second)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, true, img == unchanged)
+
+	img, err = mutate.Config(img, v1.Config{
+		Healthcheck: &v1.HealthConfig{Test: []string{"CMD", "true"}, StartPeriod: time.Minute},
+	})
+	testutil.CheckNoError(t, err)
+	img, err = withHealthcheckStartInterval(img, 5*time.Second)
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, validate.Image(img))
+
+	startInterval, err := healthcheckStartInterval(img)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 5*time.Second, startInterval)
+	cf, err := img.ConfigFile()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, time.Minute, cf.Config.Healthcheck.StartPeriod)
+
+	// Mutating the image again drops it
+	img, err = mutate.Config(img, cf.Config)
+	testutil.CheckNoError(t, err)
+	startInterval, err = healthcheckStartInterval(img)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, time.Duration(0), startInterval)
+}
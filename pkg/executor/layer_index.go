@@ -0,0 +1,181 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/chainguard-dev/kaniko/pkg/cache"
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	layerIndexesMu sync.Mutex
+	// layerIndexes are the layer indexes opened by the builds of this
+	// process, by path, for the pushes to record the layers of the builds
+	layerIndexes = map[string]*cache.LayerIndex{}
+)
+
+// openLayerIndex returns the layer index of opts, if any
+func openLayerIndex(opts *config.KanikoOptions) (*cache.LayerIndex, error) {
+	if opts.LayerIndex == "" {
+		return nil, nil
+	}
+	layerIndexesMu.Lock()
+	defer layerIndexesMu.Unlock()
+	if i, ok := layerIndexes[opts.LayerIndex]; ok {
+		return i, nil
+	}
+	i, err := cache.OpenLayerIndex(opts.LayerIndex)
+	if err != nil {
+		return nil, err
+	}
+	layerIndexes[opts.LayerIndex] = i
+	return i, nil
+}
+
+// destinationRepositories returns the repositories the image is pushed to,
+// mapped with --registry-push-map like the ones the pushes record the layers
+// under
+func destinationRepositories(opts *config.KanikoOptions) ([]string, error) {
+	if opts.NoPush {
+		return nil, nil
+	}
+	var repos []string
+	for _, d := range opts.Destinations {
+		ref, err := name.NewTag(d, name.WeakValidation)
+		if err != nil {
+			return nil, err
+		}
+		if ref, err = mapPushTarget(opts, ref); err != nil {
+			return nil, err
+		}
+		repos = append(repos, ref.Context().String())
+	}
+	return repos, nil
+}
+
+// indexedLayer is a layer of the snapshot at tarPath, already pushed to the
+// destinations as the compressed layer of entry. It is only compressed if its
+// compressed contents are read, like when the layer is written to a tarball.
+type indexedLayer struct {
+	tarPath  string
+	diffID   v1.Hash
+	mt       types.MediaType
+	entry    *cache.LayerIndexEntry
+	newLayer func() (v1.Layer, error)
+
+	once  sync.Once
+	layer v1.Layer
+	err   error
+}
+
+func (l *indexedLayer) Digest() (v1.Hash, error) {
+	return l.entry.Digest, nil
+}
+
+func (l *indexedLayer) DiffID() (v1.Hash, error) {
+	return l.diffID, nil
+}
+
+func (l *indexedLayer) Size() (int64, error) {
+	return l.entry.Size, nil
+}
+
+func (l *indexedLayer) MediaType() (types.MediaType, error) {
+	return l.mt, nil
+}
+
+func (l *indexedLayer) Uncompressed() (io.ReadCloser, error) {
+	return os.Open(l.tarPath)
+}
+
+func (l *indexedLayer) Compressed() (io.ReadCloser, error) {
+	l.once.Do(func() {
+		l.layer, l.err = l.newLayer()
+		if l.err != nil {
+			return
+		}
+		digest, err := l.layer.Digest()
+		if err != nil {
+			l.err = err
+			return
+		}
+		if digest != l.entry.Digest {
+			l.err = fmt.Errorf("layer %s compressed to %s instead of %s recorded by the layer index", l.diffID, digest, l.entry.Digest)
+		}
+	})
+	if l.err != nil {
+		return nil, l.err
+	}
+	return l.layer.Compressed()
+}
+
+// indexLayer returns the layer of the snapshot at tarPath from the layer
+// index if it was already pushed to all the destinations, or builds it with
+// newLayer, and records it for the push to add it to the index.
+func indexLayer(index *cache.LayerIndex, tarPath string, mt types.MediaType, compression string, repos []string, newLayer func() (v1.Layer, error)) (v1.Layer, error) {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	diffID, _, err := v1.SHA256(f)
+	f.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "hashing snapshot")
+	}
+	key := cache.LayerIndexKey(diffID, mt, compression)
+	index.Built(diffID, key)
+	if e, ok := index.Lookup(key, repos); ok {
+		logrus.Infof("Layer %s was already pushed as %s, skipping its compression", diffID, e.Digest)
+		return &indexedLayer{tarPath: tarPath, diffID: diffID, mt: mt, entry: e, newLayer: newLayer}, nil
+	}
+	return newLayer()
+}
+
+// recordPushedLayers records the layers of image pushed to repository in the
+// layer index.
+func recordPushedLayers(index *cache.LayerIndex, image v1.Image, repository string) error {
+	layers, err := image.Layers()
+	if err != nil {
+		return err
+	}
+	for _, l := range layers {
+		diffID, err := l.DiffID()
+		if err != nil {
+			return err
+		}
+		digest, err := l.Digest()
+		if err != nil {
+			return err
+		}
+		size, err := l.Size()
+		if err != nil {
+			return err
+		}
+		index.Pushed(diffID, digest, size, repository)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/cache"
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func Test_indexLayer(t *testing.T) {
+	dir := t.TempDir()
+	tarPath := filepath.Join(dir, "snapshot")
+	f, err := os.Create(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(f)
+	if err := tw.WriteHeader(&tar.Header{Name: "app/main.go", Mode: 0o644, Size: 12}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte("package main")); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	f.Close()
+
+	index, err := cache.OpenLayerIndex(filepath.Join(dir, "layers.json"))
+	testutil.CheckNoError(t, err)
+	repos := []string{"gcr.io/foo/bar"}
+	compressed := 0
+	newLayer := func() (v1.Layer, error) {
+		compressed++
+		return tarball.LayerFromFile(tarPath)
+	}
+
+	// The first build compresses the layer and records it once pushed
+	layer, err := indexLayer(index, tarPath, types.DockerLayer, "gzip--1", repos, newLayer)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 1, compressed)
+	image, err := mutate.AppendLayers(empty.Image, layer)
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, recordPushedLayers(index, image, repos[0]))
+
+	// The next one knows its digest without compressing it
+	indexed, err := indexLayer(index, tarPath, types.DockerLayer, "gzip--1", repos, newLayer)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 1, compressed)
+	for _, f := range []func(v1.Layer) (any, error){
+		func(l v1.Layer) (any, error) { return l.Digest() },
+		func(l v1.Layer) (any, error) { return l.DiffID() },
+		func(l v1.Layer) (any, error) { return l.Size() },
+	} {
+		want, err := f(layer)
+		testutil.CheckNoError(t, err)
+		got, err := f(indexed)
+		testutil.CheckErrorAndDeepEqual(t, false, err, want, got)
+	}
+
+	// It is compressed, and checked, once its compressed contents are read
+	rc, err := indexed.Compressed()
+	testutil.CheckNoError(t, err)
+	rc.Close()
+	testutil.CheckDeepEqual(t, 2, compressed)
+
+	// It is not reused for the destinations it was not pushed to
+	_, err = indexLayer(index, tarPath, types.DockerLayer, "gzip--1", []string{"gcr.io/foo/baz"}, newLayer)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 3, compressed)
+}
+
+func Test_destinationRepositories(t *testing.T) {
+	opts := &config.KanikoOptions{}
+	opts.Destinations = []string{"us-docker.pkg.dev/prj/virtual/app:v1", "gcr.io/foo/bar"}
+	opts.RegistryPushMaps = map[string]string{
+		"us-docker.pkg.dev/prj/virtual": "us-docker.pkg.dev/prj/standard",
+	}
+	// The repositories are the ones the pushes record the layers under
+	repos, err := destinationRepositories(opts)
+	testutil.CheckErrorAndDeepEqual(t, false, err, []string{"us-docker.pkg.dev/prj/standard/app", "gcr.io/foo/bar"}, repos)
+}
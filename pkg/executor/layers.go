@@ -0,0 +1,228 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+)
+
+// wrappedImage is an image whose layers are wrapped to change how their
+// content is read.
+type wrappedImage struct {
+	v1.Image
+	layers []v1.Layer
+}
+
+// wrapLayers returns image with its layers replaced by wrap(layer). Layers of
+// remote images are kept as is, for them to still be mounted when pushed to
+// the registry they come from.
+func wrapLayers(image v1.Image, wrap func(v1.Layer) v1.Layer) (v1.Image, error) {
+	layers, err := image.Layers()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting image layers")
+	}
+	wrapped := make([]v1.Layer, len(layers))
+	for i, l := range layers {
+		if _, ok := l.(*remote.MountableLayer); ok {
+			wrapped[i] = l
+			continue
+		}
+		wrapped[i] = wrap(l)
+	}
+	return &wrappedImage{Image: image, layers: wrapped}, nil
+}
+
+// Layers returns the wrapped layers of the image
+func (i *wrappedImage) Layers() ([]v1.Layer, error) {
+	return i.layers, nil
+}
+
+// LayerByDigest returns the wrapped layer with the given digest
+func (i *wrappedImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	for _, l := range i.layers {
+		digest, err := l.Digest()
+		if err != nil {
+			return nil, err
+		}
+		if digest == h {
+			return l, nil
+		}
+	}
+	return i.Image.LayerByDigest(h)
+}
+
+// LayerByDiffID returns the wrapped layer with the given diff ID
+func (i *wrappedImage) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	for _, l := range i.layers {
+		diffID, err := l.DiffID()
+		if err != nil {
+			return nil, err
+		}
+		if diffID == h {
+			return l, nil
+		}
+	}
+	return i.Image.LayerByDiffID(h)
+}
+
+// spoolLayers returns image with the compressed content of its layers written
+// to dir on first read, and read from there by later reads, for the image to
+// be written to several outputs while compressing its layers once.
+func spoolLayers(image v1.Image, dir string) (v1.Image, error) {
+	return wrapLayers(image, func(l v1.Layer) v1.Layer {
+		return &spooledLayer{Layer: l, dir: dir}
+	})
+}
+
+type spooledLayer struct {
+	v1.Layer
+	dir string
+
+	once sync.Once
+	path string
+	err  error
+}
+
+// Compressed returns the compressed content of the layer, read from the
+// spooled file
+func (l *spooledLayer) Compressed() (io.ReadCloser, error) {
+	l.once.Do(func() {
+		l.path, l.err = l.spool()
+	})
+	if l.err != nil {
+		return nil, l.err
+	}
+	return os.Open(l.path)
+}
+
+// spool writes the compressed content of the layer to a file of its own, the
+// layers of an image sharing a digest being spooled concurrently
+func (l *spooledLayer) spool() (string, error) {
+	digest, err := l.Digest()
+	if err != nil {
+		return "", err
+	}
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	f, err := os.CreateTemp(l.dir, digest.Hex+"-")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, rc); err != nil {
+		return "", errors.Wrapf(err, "spooling layer %s", digest)
+	}
+	return f.Name(), f.Close()
+}
+
+// limitCompression returns image with at most jobs of its layers compressed at
+// the same time. The limit is the one of a single push, the pushes of the
+// other builds having their own.
+func limitCompression(image v1.Image, jobs int) (v1.Image, error) {
+	slots := make(chan struct{}, jobs)
+	return wrapLayers(image, func(l v1.Layer) v1.Layer {
+		return &limitedLayer{Layer: l, slots: slots}
+	})
+}
+
+// limitedLayer holds one of slots while its compressed content is read, or
+// its digest or size, which may compress it, are computed
+type limitedLayer struct {
+	v1.Layer
+	slots chan struct{}
+
+	mu sync.Mutex
+	// held is the number of readers and calls holding the slot of the layer
+	held int
+}
+
+// acquire takes a slot, unless the layer holds one already: the digest and
+// the size are asked while its compressed content is read.
+func (l *limitedLayer) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held == 0 {
+		l.slots <- struct{}{}
+	}
+	l.held++
+}
+
+// release frees the slot of the layer once nothing holds it
+func (l *limitedLayer) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.held--
+	if l.held == 0 {
+		<-l.slots
+	}
+}
+
+// Compressed returns the compressed content of the layer once a slot is
+// available. The slot is released when the content is read to its end, fails
+// to be read or is closed: writers like tarball.Write never close it.
+func (l *limitedLayer) Compressed() (io.ReadCloser, error) {
+	l.acquire()
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+	return &releasingReadCloser{ReadCloser: rc, release: l.release}, nil
+}
+
+// Digest returns the digest of the layer once a slot is available
+func (l *limitedLayer) Digest() (v1.Hash, error) {
+	l.acquire()
+	defer l.release()
+	return l.Layer.Digest()
+}
+
+// Size returns the compressed size of the layer once a slot is available
+func (l *limitedLayer) Size() (int64, error) {
+	l.acquire()
+	defer l.release()
+	return l.Layer.Size()
+}
+
+type releasingReadCloser struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releasingReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil {
+		r.once.Do(r.release)
+	}
+	return n, err
+}
+
+func (r *releasingReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// countingLayer counts the reads of its compressed content
+type countingLayer struct {
+	v1.Layer
+	reads int
+}
+
+func (l *countingLayer) Compressed() (io.ReadCloser, error) {
+	l.reads++
+	return l.Layer.Compressed()
+}
+
+func Test_spoolLayers(t *testing.T) {
+	rl, err := random.Layer(1024, types.DockerLayer)
+	testutil.CheckNoError(t, err)
+	layer := &countingLayer{Layer: rl}
+	image, err := mutate.AppendLayers(empty.Image, layer)
+	testutil.CheckNoError(t, err)
+	want, err := image.Digest()
+	testutil.CheckNoError(t, err)
+
+	dir := t.TempDir()
+	spooled, err := spoolLayers(image, t.TempDir())
+	testutil.CheckNoError(t, err)
+
+	ref, err := name.NewTag("image")
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, tarball.WriteToFile(filepath.Join(dir, "image.tar"), ref, spooled))
+	path, err := layout.Write(filepath.Join(dir, "layout"), empty.Index)
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, path.AppendImage(spooled))
+
+	got, err := spooled.Digest()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, want, got)
+	testutil.CheckDeepEqual(t, 1, layer.reads)
+}
+
+func Test_spoolLayers_sameDigest(t *testing.T) {
+	rl, err := random.Layer(1024, types.DockerLayer)
+	testutil.CheckNoError(t, err)
+	image, err := mutate.AppendLayers(empty.Image, rl, rl)
+	testutil.CheckNoError(t, err)
+	spooled, err := spoolLayers(image, t.TempDir())
+	testutil.CheckNoError(t, err)
+	layers, err := spooled.Layers()
+	testutil.CheckNoError(t, err)
+	rc, err := rl.Compressed()
+	testutil.CheckNoError(t, err)
+	want, err := io.ReadAll(rc)
+	testutil.CheckNoError(t, err)
+
+	// The layers sharing a digest are spooled to files of their own
+	var wg sync.WaitGroup
+	got := make([][]byte, len(layers))
+	for i, l := range layers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rc, err := l.Compressed()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer rc.Close()
+			got[i], err = io.ReadAll(rc)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	for i := range layers {
+		testutil.CheckDeepEqual(t, want, got[i])
+	}
+	if layers[0].(*spooledLayer).path == layers[1].(*spooledLayer).path {
+		t.Errorf("expected the layers to be spooled to different files, got %s", layers[0].(*spooledLayer).path)
+	}
+}
+
+func Test_limitCompression(t *testing.T) {
+	rl, err := random.Layer(1024, types.DockerLayer)
+	testutil.CheckNoError(t, err)
+	image, err := mutate.AppendLayers(empty.Image, rl, rl)
+	testutil.CheckNoError(t, err)
+	limited, err := limitCompression(image, 1)
+	testutil.CheckNoError(t, err)
+	layers, err := limited.Layers()
+	testutil.CheckNoError(t, err)
+
+	rc, err := layers[0].Compressed()
+	testutil.CheckNoError(t, err)
+	second := make(chan struct{})
+	go func() {
+		rc, err := layers[1].Compressed()
+		if err == nil {
+			rc.Close()
+		}
+		close(second)
+	}()
+	select {
+	case <-second:
+		t.Fatal("expected the second layer to wait for the first one to be closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	// The size of a layer being read is computed without waiting
+	_, err = layers[0].Size()
+	testutil.CheckNoError(t, err)
+	sized := make(chan struct{})
+	go func() {
+		layers[1].Size()
+		close(sized)
+	}()
+	select {
+	case <-sized:
+		t.Fatal("expected the size of the second layer to wait for the first one to be closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	testutil.CheckNoError(t, rc.Close())
+	for _, done := range []chan struct{}{second, sized} {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("expected the second layer to be compressed once the first one is closed")
+		}
+	}
+
+	// Another push has slots of its own
+	other, err := limitCompression(image, 1)
+	testutil.CheckNoError(t, err)
+	otherLayers, err := other.Layers()
+	testutil.CheckNoError(t, err)
+	rc, err = layers[0].Compressed()
+	testutil.CheckNoError(t, err)
+	defer rc.Close()
+	_, err = otherLayers[0].Digest()
+	testutil.CheckNoError(t, err)
+}
+
+func Test_limitCompression_tarball(t *testing.T) {
+	var layers []v1.Layer
+	for i := 0; i < 3; i++ {
+		l, err := random.Layer(1024, types.DockerLayer)
+		testutil.CheckNoError(t, err)
+		layers = append(layers, l)
+	}
+	image, err := mutate.AppendLayers(empty.Image, layers...)
+	testutil.CheckNoError(t, err)
+	limited, err := limitCompression(image, 1)
+	testutil.CheckNoError(t, err)
+	ref, err := name.NewTag("image")
+	testutil.CheckNoError(t, err)
+
+	// tarball.Write reads the layers to their end without closing them
+	written := make(chan error)
+	go func() {
+		written <- tarball.WriteToFile(filepath.Join(t.TempDir(), "image.tar"), ref, limited)
+	}()
+	select {
+	case err := <-written:
+		testutil.CheckNoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the tarball to be written with more layers than compression jobs")
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/sirupsen/logrus"
+)
+
+// internalPaths returns the paths of the files kaniko uses to build the image,
+// which must never be in its layers: the kaniko and working directories, and
+// the credentials.
+func internalPaths(opts *config.KanikoOptions) []string {
+	paths := append([]string{config.KanikoDir}, config.WorkDirs()...)
+	dockerConfigs := append([]string{}, opts.DockerConfigs...)
+	if d := os.Getenv("DOCKER_CONFIG"); d != "" {
+		dockerConfigs = append(dockerConfigs, d)
+	}
+	for _, d := range dockerConfigs {
+		paths = append(paths, filepath.Join(d, "config.json"))
+	}
+	paths = append(paths, opts.ImagePullSecrets...)
+	if opts.OAuth2Config != "" {
+		paths = append(paths, opts.OAuth2Config)
+	}
+	for i, p := range paths {
+		paths[i] = filepath.Clean(p)
+	}
+	return paths
+}
+
+// checkLayerLeaks returns an error if the layer tarball at tarPath contains
+// one of the internal paths of kaniko, or the metadata of the whiteouts of an
+// overlay filesystem, which would leak into the image. Only the headers are
+// read, since the tarball is seekable.
+func checkLayerLeaks(tarPath string, internal []string) error {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// Validating the tarball is not the purpose of the check
+			logrus.Debugf("Unable to check %s for leaks: %v", tarPath, err)
+			return nil
+		}
+		name := filepath.Clean("/" + hdr.Name)
+		base := filepath.Base(name)
+		if strings.HasPrefix(base, archive.WhiteoutMetaPrefix) && base != archive.WhiteoutOpaqueDir {
+			return fmt.Errorf("whiteout metadata %s leaked into layer", name)
+		}
+		for _, p := range internal {
+			if name == p || strings.HasPrefix(name, p+"/") {
+				return fmt.Errorf("kaniko internal path %s leaked into layer", name)
+			}
+		}
+	}
+}
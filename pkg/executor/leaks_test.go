@@ -0,0 +1,85 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func Test_checkLayerLeaks(t *testing.T) {
+	internal := internalPaths(&config.KanikoOptions{
+		RegistryOptions: config.RegistryOptions{
+			DockerConfigs:    []string{"/root/.docker"},
+			ImagePullSecrets: []string{"/var/run/secrets/pull.json"},
+		},
+	})
+	tests := []struct {
+		name    string
+		files   []string
+		wantErr bool
+	}{
+		{
+			name:  "image files",
+			files: []string{"etc/", "etc/passwd", "kaniko-app/main", "root/.docker/", "app/.wh.removed", "app/.wh..wh..opq"},
+		},
+		{
+			name:    "kaniko directory",
+			files:   []string{"etc/passwd", config.KanikoDir[1:] + "/Dockerfile"},
+			wantErr: true,
+		},
+		{
+			name:    "credentials",
+			files:   []string{"./root/.docker/config.json"},
+			wantErr: true,
+		},
+		{
+			name:    "image pull secrets",
+			files:   []string{"var/run/secrets/pull.json"},
+			wantErr: true,
+		},
+		{
+			name:    "whiteout metadata",
+			files:   []string{"app/.wh..wh.plnk/"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tarPath := filepath.Join(t.TempDir(), "layer.tar")
+			f, err := os.Create(tarPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tw := tar.NewWriter(f)
+			for _, name := range tt.files {
+				if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: 1}); err != nil {
+					t.Fatal(err)
+				}
+				tw.Write([]byte("a"))
+			}
+			tw.Close()
+			f.Close()
+			testutil.CheckError(t, tt.wantErr, checkLayerLeaks(tarPath, internal))
+		})
+	}
+}
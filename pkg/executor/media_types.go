@@ -0,0 +1,106 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"fmt"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// imageMediaTypes returns the family of media types of the built images. zstd
+// compressed layers are only part of the OCI image spec, so the images are
+// converted to OCI ones when compressed with zstd unless set otherwise.
+func imageMediaTypes(opts *config.KanikoOptions) config.MediaTypes {
+	if opts.Compression == config.ZStd && opts.MediaTypes == config.MediaTypesAuto {
+		return config.MediaTypesOCI
+	}
+	return opts.MediaTypes
+}
+
+// convertImageMediaTypes returns image with the media types of its manifest,
+// config and layers converted to the family set with --media-types. The
+// layers built on top of it then get media types of the same family. Gzip
+// compressed layers have the same contents in both families, so only zstd
+// compressed layers are compressed again, with gzip, for Docker images.
+func convertImageMediaTypes(image v1.Image, mediaTypes config.MediaTypes) (v1.Image, error) {
+	vendor := ""
+	switch mediaTypes {
+	case config.MediaTypesOCI:
+		vendor = types.OCIVendorPrefix
+	case config.MediaTypesDocker:
+		vendor = types.DockerVendorPrefix
+	default:
+		return image, nil
+	}
+	mt, err := image.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	if extractMediaTypeVendor(mt) == vendor {
+		return image, nil
+	}
+
+	manifest, err := image.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	cf, err := image.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := image.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	converted := mutate.MediaType(empty.Image, convertMediaType(mt))
+	converted = mutate.ConfigMediaType(converted, convertMediaType(manifest.Config.MediaType))
+	addenda := make([]mutate.Addendum, 0, len(layers))
+	for i, layer := range layers {
+		lmt := manifest.Layers[i].MediaType
+		target := convertMediaType(lmt)
+		if target == "" {
+			return nil, fmt.Errorf("layer %d with media type %s has no %s equivalent", i, lmt, mediaTypes)
+		}
+		// Docker images only support gzip compressed layers
+		if lmt == types.OCILayerZStd {
+			if layer, err = tarball.LayerFromOpener(layer.Uncompressed, tarball.WithMediaType(target)); err != nil {
+				return nil, err
+			}
+		}
+		addenda = append(addenda, mutate.Addendum{
+			Layer:       layer,
+			MediaType:   target,
+			URLs:        manifest.Layers[i].URLs,
+			Annotations: manifest.Layers[i].Annotations,
+		})
+	}
+	if converted, err = mutate.Append(converted, addenda...); err != nil {
+		return nil, err
+	}
+	if len(manifest.Annotations) > 0 {
+		converted = mutate.Annotations(converted, manifest.Annotations).(v1.Image)
+	}
+	// The layers are the same, so the config still applies
+	return mutate.ConfigFile(converted, cf)
+}
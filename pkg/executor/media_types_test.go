@@ -0,0 +1,119 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func Test_convertImageMediaTypes(t *testing.T) {
+	image, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := image.Manifest()
+	testutil.CheckNoError(t, err)
+	originalConfig, err := image.ConfigFile()
+	testutil.CheckNoError(t, err)
+
+	kept, err := convertImageMediaTypes(image, config.MediaTypesAuto)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, true, kept == image)
+
+	oci, err := convertImageMediaTypes(image, config.MediaTypesOCI)
+	testutil.CheckNoError(t, err)
+	m, err := oci.Manifest()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, types.OCIManifestSchema1, m.MediaType)
+	testutil.CheckDeepEqual(t, types.OCIConfigJSON, m.Config.MediaType)
+	for i, l := range m.Layers {
+		testutil.CheckDeepEqual(t, types.OCILayer, l.MediaType)
+		// The layers are not compressed again
+		testutil.CheckDeepEqual(t, original.Layers[i].Digest, l.Digest)
+	}
+	cf, err := oci.ConfigFile()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, originalConfig.RootFS.DiffIDs, cf.RootFS.DiffIDs)
+
+	docker, err := convertImageMediaTypes(oci, config.MediaTypesDocker)
+	testutil.CheckNoError(t, err)
+	m, err = docker.Manifest()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, types.DockerManifestSchema2, m.MediaType)
+	testutil.CheckDeepEqual(t, types.DockerConfigJSON, m.Config.MediaType)
+	testutil.CheckDeepEqual(t, types.DockerLayer, m.Layers[0].MediaType)
+}
+
+func Test_convertImageMediaTypes_zstd(t *testing.T) {
+	layer, err := random.Layer(1024, types.OCILayerZStd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), types.OCIConfigJSON)
+	if image, err = mutate.AppendLayers(image, layer); err != nil {
+		t.Fatal(err)
+	}
+
+	docker, err := convertImageMediaTypes(image, config.MediaTypesDocker)
+	testutil.CheckNoError(t, err)
+	m, err := docker.Manifest()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, types.DockerLayer, m.Layers[0].MediaType)
+	layers, err := docker.Layers()
+	testutil.CheckNoError(t, err)
+	diffID, err := layers[0].DiffID()
+	testutil.CheckNoError(t, err)
+	originalDiffID, err := layer.DiffID()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, originalDiffID, diffID)
+}
+
+func Test_imageMediaTypes(t *testing.T) {
+	tests := []struct {
+		compression config.Compression
+		mediaTypes  config.MediaTypes
+		want        config.MediaTypes
+	}{
+		{config.GZip, config.MediaTypesAuto, config.MediaTypesAuto},
+		{config.ZStd, config.MediaTypesAuto, config.MediaTypesOCI},
+		{config.ZStd, config.MediaTypesOCI, config.MediaTypesOCI},
+		{config.GZip, config.MediaTypesDocker, config.MediaTypesDocker},
+	}
+	for _, test := range tests {
+		opts := &config.KanikoOptions{Compression: test.compression, MediaTypes: test.mediaTypes}
+		testutil.CheckDeepEqual(t, test.want, imageMediaTypes(opts))
+	}
+}
+
+func Test_cachedLayerImageZStd(t *testing.T) {
+	opts := &config.KanikoOptions{Compression: config.ZStd, CompressionLevel: 3}
+	img, err := cachedLayerImage(opts, writeRunLayer(t, "cached"), "RUN make")
+	testutil.CheckNoError(t, err)
+	m, err := img.Manifest()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, types.OCIManifestSchema1, m.MediaType)
+	testutil.CheckDeepEqual(t, types.OCIConfigJSON, m.Config.MediaType)
+	testutil.CheckDeepEqual(t, 1, len(m.Layers))
+	testutil.CheckDeepEqual(t, types.OCILayerZStd, m.Layers[0].MediaType)
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"strings"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/constants"
+	"github.com/chainguard-dev/kaniko/pkg/dockerfile"
+	image_util "github.com/chainguard-dev/kaniko/pkg/image"
+	"github.com/moby/buildkit/frontend/dockerfile/instructions"
+	"github.com/pkg/errors"
+)
+
+// The build metadata ARGs kaniko automatically defines in the global scope of
+// every Dockerfile, for the images to embed their provenance in their labels
+// or environment
+const (
+	// buildDateArg is the date of the build, or the one of --source-date-epoch
+	buildDateArg = "KANIKO_BUILD_DATE"
+	// gitSHAArg is the commit checked out in the git build context, if any
+	gitSHAArg = "KANIKO_GIT_SHA"
+	// imageDigestsArg are the base images of the stages, as image@digest
+	imageDigestsArg = "KANIKO_IMAGE_DIGESTS"
+)
+
+// addBuildMetadataArgs adds the build metadata ARGs to the global ARGs of the
+// stages
+func addBuildMetadataArgs(stages []config.KanikoStage, opts *config.KanikoOptions) error {
+	if len(stages) == 0 {
+		return nil
+	}
+	args, err := buildMetadataArgs(stages, opts)
+	if err != nil {
+		return err
+	}
+	metaArgs := dockerfile.AddAutomaticArgs(stages[0].MetaArgs, args)
+	for i := range stages {
+		stages[i].MetaArgs = metaArgs
+	}
+	return nil
+}
+
+// buildMetadataArgs returns the build metadata ARGs of the build of stages
+func buildMetadataArgs(stages []config.KanikoStage, opts *config.KanikoOptions) ([]instructions.KeyValuePairOptional, error) {
+	date, err := opts.SourceDateEpochTime()
+	if err != nil {
+		return nil, err
+	}
+	if date.IsZero() {
+		date = time.Now().UTC()
+	}
+	// Retrieving the base images is only worth it if their digests are used
+	digests := ""
+	if declaresArg(stages, imageDigestsArg) {
+		if digests, err = baseImageDigests(stages, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	args := []instructions.KeyValuePairOptional{}
+	add := func(k, v string) {
+		args = append(args, instructions.KeyValuePairOptional{Key: k, Value: &v})
+	}
+	add(buildDateArg, date.Format(time.RFC3339))
+	add(gitSHAArg, opts.ContextCommit)
+	add(imageDigestsArg, digests)
+	return args, nil
+}
+
+// baseImageDigests returns the base images of stages which are not stages
+// themselves, as comma separated image@digest references
+func baseImageDigests(stages []config.KanikoStage, opts *config.KanikoOptions) (string, error) {
+	seen := map[string]bool{}
+	var digests []string
+	for _, s := range stages {
+		if s.BaseImageStoredLocally || s.BaseName == constants.NoBaseImage || seen[s.BaseName] {
+			continue
+		}
+		seen[s.BaseName] = true
+		image, err := image_util.RetrieveSourceImage(s, opts)
+		if err != nil {
+			return "", errors.Wrapf(err, "retrieving base image %s", s.BaseName)
+		}
+		digest, err := image.Digest()
+		if err != nil {
+			return "", err
+		}
+		name, _, _ := strings.Cut(s.BaseName, "@")
+		digests = append(digests, name+"@"+digest.String())
+	}
+	return strings.Join(digests, ","), nil
+}
+
+// declaresArg returns true if the global ARGs or the commands of stages
+// declare the ARG name
+func declaresArg(stages []config.KanikoStage, name string) bool {
+	for _, s := range stages {
+		for _, marg := range s.MetaArgs {
+			for _, arg := range marg.Args {
+				if arg.Key == name {
+					return true
+				}
+			}
+		}
+		for _, cmd := range s.Commands {
+			if a, ok := cmd.(*instructions.ArgCommand); ok {
+				for _, arg := range a.Args {
+					if arg.Key == name {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/dockerfile"
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func Test_addBuildMetadataArgs(t *testing.T) {
+	opts := &config.KanikoOptions{
+		DockerfilePath:  "Dockerfile",
+		SourceDateEpoch: "1700000000",
+		ContextCommit:   "0123456789abcdef0123456789abcdef01234567",
+	}
+	stages, metaArgs, err := dockerfile.Parse([]byte(`ARG KANIKO_GIT_SHA
+FROM scratch AS base
+ARG KANIKO_BUILD_DATE
+LABEL org.opencontainers.image.created=$KANIKO_BUILD_DATE
+FROM base
+ARG KANIKO_GIT_SHA
+ARG KANIKO_IMAGE_DIGESTS
+ENV GIT_SHA=$KANIKO_GIT_SHA
+`))
+	testutil.CheckNoError(t, err)
+	kanikoStages, err := dockerfile.MakeKanikoStages(opts, stages, metaArgs)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, true, declaresArg(kanikoStages, imageDigestsArg))
+	testutil.CheckDeepEqual(t, false, declaresArg(kanikoStages[:1], imageDigestsArg))
+
+	testutil.CheckNoError(t, addBuildMetadataArgs(kanikoStages, opts))
+	values := map[string]string{}
+	for _, stage := range kanikoStages {
+		args := dockerfile.NewBuildArgs(nil)
+		args.AddMetaArgs(stage.MetaArgs)
+		for _, k := range []string{buildDateArg, gitSHAArg, imageDigestsArg} {
+			args.AddArg(k, nil)
+		}
+		for k, v := range args.GetAllAllowed() {
+			values[k] = v
+		}
+	}
+	testutil.CheckDeepEqual(t, "2023-11-14T22:13:20Z", values[buildDateArg])
+	testutil.CheckDeepEqual(t, opts.ContextCommit, values[gitSHAArg])
+	// Neither scratch nor the stages have digests
+	testutil.CheckDeepEqual(t, "", values[imageDigestsArg])
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/commands"
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	resolvConfPath = "/etc/resolv.conf"
+	hostsPath      = "/etc/hosts"
+)
+
+// networkFiles returns the network configuration files whose changes are
+// preserved in the image layers, and the ones whose changes are reverted after
+// every RUN command, like docker build does.
+func networkFiles(opts *config.KanikoOptions) (preserved, reverted []string) {
+	add := func(path string, preserve bool) {
+		path = filepath.Join(opts.Root(), path)
+		if preserve {
+			preserved = append(preserved, path)
+		} else {
+			reverted = append(reverted, path)
+		}
+	}
+	add(resolvConfPath, opts.PreserveResolvConf)
+	add(hostsPath, opts.PreserveHosts)
+	return preserved, reverted
+}
+
+// revertsNetworkFiles returns true if the changes command makes to the network
+// files are reverted, the ones of RUN commands, which usually modify them for
+// the command only
+func revertsNetworkFiles(command commands.DockerCommand) bool {
+	switch command.(type) {
+	case *commands.RunCommand, *commands.RunMarkerCommand, *commands.CachingRunCommand:
+		return true
+	}
+	return false
+}
+
+// savedFile is the content of a file before the build modified it
+type savedFile struct {
+	path    string
+	content []byte
+	mode    os.FileMode
+	modTime time.Time
+	exists  bool
+}
+
+func saveFiles(paths []string) ([]savedFile, error) {
+	saved := []savedFile{}
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			saved = append(saved, savedFile{path: path})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "saving %s", path)
+		}
+		saved = append(saved, savedFile{path: path, content: content, mode: fi.Mode().Perm(), modTime: fi.ModTime(), exists: true})
+	}
+	return saved, nil
+}
+
+// restoreFiles reverts the changes made to the saved files
+func restoreFiles(saved []savedFile) error {
+	for _, f := range saved {
+		content, err := os.ReadFile(f.path)
+		switch {
+		case os.IsNotExist(err):
+			if !f.exists {
+				continue
+			}
+		case err != nil:
+			return err
+		case !f.exists:
+			logrus.Infof("Reverting creation of %s", f.path)
+			if err := os.Remove(f.path); err != nil {
+				return errors.Wrapf(err, "reverting %s", f.path)
+			}
+			continue
+		case bytes.Equal(content, f.content):
+			continue
+		}
+		logrus.Infof("Reverting changes to %s", f.path)
+		// Write in place rather than replacing the file, which is usually a
+		// bind mount of the container runtime.
+		if err := os.WriteFile(f.path, f.content, f.mode); err != nil {
+			return errors.Wrapf(err, "reverting %s", f.path)
+		}
+		// The reverted file is left out of the snapshot
+		if err := os.Chtimes(f.path, f.modTime, f.modTime); err != nil {
+			return errors.Wrapf(err, "reverting %s", f.path)
+		}
+	}
+	return nil
+}
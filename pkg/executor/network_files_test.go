@@ -0,0 +1,84 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/commands"
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/dockerfile"
+	"github.com/chainguard-dev/kaniko/pkg/util"
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func Test_networkFiles(t *testing.T) {
+	preserved, reverted := networkFiles(&config.KanikoOptions{PreserveHosts: true})
+	testutil.CheckDeepEqual(t, []string{"/etc/hosts"}, preserved)
+	testutil.CheckDeepEqual(t, []string{"/etc/resolv.conf"}, reverted)
+}
+
+func Test_restoreFiles(t *testing.T) {
+	dir := t.TempDir()
+	hosts := filepath.Join(dir, "hosts")
+	created := filepath.Join(dir, "resolv.conf")
+	if err := os.WriteFile(hosts, []byte("127.0.0.1 localhost\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Unix(1700000000, 0)
+	if err := os.Chtimes(hosts, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := saveFiles([]string{hosts, created})
+	testutil.CheckNoError(t, err)
+
+	if err := os.WriteFile(hosts, []byte("10.0.0.1 mirror\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(created, []byte("nameserver 10.0.0.1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckNoError(t, restoreFiles(saved))
+
+	content, err := os.ReadFile(hosts)
+	testutil.CheckErrorAndDeepEqual(t, false, err, "127.0.0.1 localhost\n", string(content))
+	// The reverted file is unchanged for the snapshotter
+	fi, err := os.Stat(hosts)
+	testutil.CheckErrorAndDeepEqual(t, false, err, true, fi.ModTime().Equal(modTime))
+	_, err = os.Stat(created)
+	testutil.CheckDeepEqual(t, true, os.IsNotExist(err))
+}
+
+func Test_revertsNetworkFiles(t *testing.T) {
+	for _, tc := range []struct {
+		instruction string
+		want        bool
+	}{
+		{"RUN echo 10.0.0.1 mirror >> /etc/hosts", true},
+		{"COPY hosts /etc/hosts", false},
+		{"ADD resolv.conf /etc/resolv.conf", false},
+	} {
+		instrs, err := dockerfile.ParseCommands([]string{tc.instruction})
+		testutil.CheckNoError(t, err)
+		command, err := commands.GetCommand(instrs[0], util.FileContext{Root: "/"}, false, true, true)
+		testutil.CheckNoError(t, err)
+		testutil.CheckDeepEqual(t, tc.want, revertsNetworkFiles(command))
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// PrePushHook inspects the image about to be pushed, written in the OCI image
+// layout at layoutPath, and may mutate it by appending another image to the
+// layout: the last image of its index is the one pushed.
+type PrePushHook func(layoutPath string) error
+
+var (
+	prePushHooksMu sync.RWMutex
+	prePushHooks   = map[string]PrePushHook{}
+)
+
+// RegisterPrePushHook registers a hook run by --pre-push-hook=name, for
+// programs embedding kaniko. It panics if a hook is already registered with
+// that name.
+func RegisterPrePushHook(name string, hook PrePushHook) {
+	prePushHooksMu.Lock()
+	defer prePushHooksMu.Unlock()
+	if _, ok := prePushHooks[name]; ok {
+		panic(fmt.Sprintf("pre-push hook %s registered twice", name))
+	}
+	prePushHooks[name] = hook
+}
+
+// Mutation is the record of an image mutated by a pre-push hook
+type Mutation struct {
+	Hook string `json:"hook"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// prePushMutations are the mutations of the image pushed, recorded in its
+// build report
+var prePushMutations []Mutation
+
+// runPrePushHooks runs the --pre-push-hook hooks in order, each given the image
+// returned by the previous one, and returns the image to push. The returned
+// function removes the layouts the image is read from once it is pushed.
+func runPrePushHooks(image v1.Image, opts *config.KanikoOptions) (v1.Image, func(), error) {
+	prePushMutations = nil
+	var dirs []string
+	cleanup := func() {
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}
+	for _, hook := range opts.PrePushHooks {
+		dir, err := os.MkdirTemp(config.ScratchDir(), "pre-push-")
+		if err != nil {
+			cleanup()
+			return nil, func() {}, errors.Wrap(err, "creating pre-push layout directory")
+		}
+		dirs = append(dirs, dir)
+		mutated, err := runPrePushHook(hook, image, dir)
+		if err != nil {
+			cleanup()
+			return nil, func() {}, errors.Wrapf(err, "running pre-push hook %s", hook)
+		}
+		from, err := image.Digest()
+		if err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		to, err := mutated.Digest()
+		if err != nil {
+			cleanup()
+			return nil, func() {}, err
+		}
+		if from != to {
+			logrus.Infof("Pre-push hook %s mutated the image from %s to %s", hook, from, to)
+			prePushMutations = append(prePushMutations, Mutation{Hook: hook, From: from.String(), To: to.String()})
+		}
+		image = mutated
+	}
+	return image, cleanup, nil
+}
+
+// runPrePushHook writes image in the OCI image layout dir, runs hook, either a
+// registered hook or an executable given the layout path, and returns the last
+// image of the layout.
+func runPrePushHook(hook string, image v1.Image, dir string) (v1.Image, error) {
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		return nil, errors.Wrap(err, "writing empty layout")
+	}
+	if err := p.AppendImage(image); err != nil {
+		return nil, errors.Wrap(err, "appending image")
+	}
+
+	prePushHooksMu.RLock()
+	run, ok := prePushHooks[hook]
+	prePushHooksMu.RUnlock()
+	if ok {
+		err = run(dir)
+	} else {
+		cmd := exec.Command(hook, dir)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := p.ImageIndex()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading layout index")
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading layout index")
+	}
+	if len(manifest.Manifests) == 0 {
+		return nil, errors.New("layout contains no images")
+	}
+	return p.Image(manifest.Manifests[len(manifest.Manifests)-1].Digest)
+}
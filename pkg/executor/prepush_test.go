@@ -0,0 +1,94 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+func Test_runPrePushHooks(t *testing.T) {
+	RegisterPrePushHook("test-harden", func(layoutPath string) error {
+		p, err := layout.FromPath(layoutPath)
+		if err != nil {
+			return err
+		}
+		index, err := p.ImageIndex()
+		if err != nil {
+			return err
+		}
+		m, err := index.IndexManifest()
+		if err != nil {
+			return err
+		}
+		img, err := p.Image(m.Manifests[0].Digest)
+		if err != nil {
+			return err
+		}
+		layer, err := random.Layer(512, "application/vnd.oci.image.layer.v1.tar")
+		if err != nil {
+			return err
+		}
+		hardened, err := mutate.AppendLayers(img, layer)
+		if err != nil {
+			return err
+		}
+		return p.AppendImage(hardened)
+	})
+	inspect := filepath.Join(t.TempDir(), "inspect.sh")
+	if err := os.WriteFile(inspect, []byte("#!/bin/sh\ntest -f \"$1/index.json\"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { prePushMutations = nil }()
+
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, err := image.Digest()
+	testutil.CheckNoError(t, err)
+	original := config.KanikoDir
+	defer func() { config.KanikoDir = original }()
+	config.KanikoDir = t.TempDir()
+	opts := &config.KanikoOptions{PrePushHooks: []string{inspect, "test-harden"}}
+
+	mutated, cleanup, err := runPrePushHooks(image, opts)
+	testutil.CheckNoError(t, err)
+	defer cleanup()
+	layers, err := mutated.Layers()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 2, len(layers))
+	to, err := mutated.Digest()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, []Mutation{{Hook: "test-harden", From: from.String(), To: to.String()}}, prePushMutations)
+
+	report, err := newBuildReport(mutated, opts)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, to.String(), report.Image)
+	testutil.CheckDeepEqual(t, prePushMutations, report.Mutations)
+
+	opts.PrePushHooks = []string{"/bin/false"}
+	_, _, err = runPrePushHooks(image, opts)
+	testutil.CheckError(t, true, err)
+}
@@ -18,6 +18,7 @@ package executor
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -30,6 +31,7 @@ import (
 	"github.com/chainguard-dev/kaniko/pkg/config"
 	"github.com/chainguard-dev/kaniko/pkg/constants"
 	"github.com/chainguard-dev/kaniko/pkg/creds"
+	"github.com/chainguard-dev/kaniko/pkg/progress"
 	"github.com/chainguard-dev/kaniko/pkg/timing"
 	"github.com/chainguard-dev/kaniko/pkg/util"
 	"github.com/chainguard-dev/kaniko/pkg/version"
@@ -101,6 +103,10 @@ func CheckPushPermissions(opts *config.KanikoOptions) error {
 		// instead of the destinations
 		if isOCILayout(opts.CacheRepo) {
 			targets = []string{} // no need to check push permissions if we're just writing to disk
+		} else if opts.CacheRepo == "" {
+			targets = []string{} // the cache is only exported with --cache-export
+		} else if strings.Contains(opts.CacheRepo, "://") {
+			targets = []string{} // cache backends check their own permissions
 		} else {
 			targets = []string{opts.CacheRepo}
 		}
@@ -112,6 +118,9 @@ func CheckPushPermissions(opts *config.KanikoOptions) error {
 		if err != nil {
 			return errors.Wrap(err, "getting tag for destination")
 		}
+		if destRef, err = pushTarget(opts, destRef); err != nil {
+			return err
+		}
 		if checked[destRef.Context().String()] {
 			continue
 		}
@@ -129,7 +138,7 @@ func CheckPushPermissions(opts *config.KanikoOptions) error {
 			return errors.Wrapf(err, "making transport for registry %q", registryName)
 		}
 		tr := newRetry(rt)
-		if err := checkRemotePushPermission(destRef, creds.GetKeychain(), tr); err != nil {
+		if err := checkRemotePushPermission(destRef, repositoryKeychain{repo: destRef.Context(), keychain: creds.Keychain(&opts.RegistryOptions)}, tr); err != nil {
 			return errors.Wrapf(err, "checking push permission for %q", destRef)
 		}
 		checked[destRef.Context().String()] = true
@@ -172,6 +181,11 @@ func writeDigestFile(path string, digestByteArray []byte) error {
 // A dummy destination would be set when --no-push is set to true and --tar-path
 // is not empty with empty --destinations.
 func DoPush(image v1.Image, opts *config.KanikoOptions) error {
+	return doPush(context.Background(), image, opts)
+}
+
+// doPush pushes image to the destinations until ctx is done
+func doPush(ctx context.Context, image v1.Image, opts *config.KanikoOptions) error {
 	t := timing.Start("Total Push Time")
 	var digestByteArray []byte
 	var builder strings.Builder
@@ -180,6 +194,13 @@ func DoPush(image v1.Image, opts *config.KanikoOptions) error {
 		return errors.New("must provide at least one destination to push")
 	}
 
+	// The hooks run first, for the digest files to record the image pushed
+	image, cleanup, err := runPrePushHooks(image, opts)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
 	if opts.DigestFile != "" || opts.ImageNameDigestFile != "" || opts.ImageNameTagDigestFile != "" {
 		var err error
 		digestByteArray, err = getDigest(image)
@@ -195,6 +216,36 @@ func DoPush(image v1.Image, opts *config.KanikoOptions) error {
 		}
 	}
 
+	if opts.ImageIDFile != "" {
+		id, err := image.ConfigName()
+		if err != nil {
+			return errors.Wrap(err, "error fetching image ID")
+		}
+		if err := writeDigestFile(opts.ImageIDFile, []byte(id.String())); err != nil {
+			return errors.Wrap(err, "writing image ID to file failed")
+		}
+	}
+
+	if opts.CompressionJobs > 0 {
+		var err error
+		if image, err = limitCompression(image, opts.CompressionJobs); err != nil {
+			return err
+		}
+	}
+
+	// When the image is written to several outputs, like a tarball and
+	// registries, compress its layers once and share them across outputs.
+	if imageOutputs(opts) > 1 {
+		dir, err := os.MkdirTemp(config.ScratchDir(), "layers-")
+		if err != nil {
+			return errors.Wrap(err, "creating layer spool directory")
+		}
+		defer os.RemoveAll(dir)
+		if image, err = spoolLayers(image, dir); err != nil {
+			return err
+		}
+	}
+
 	if opts.OCILayoutPath != "" {
 		path, err := layout.Write(opts.OCILayoutPath, empty.Index)
 		if err != nil {
@@ -205,6 +256,12 @@ func DoPush(image v1.Image, opts *config.KanikoOptions) error {
 		}
 	}
 
+	if opts.ComposefsPath != "" {
+		if err := writeComposefs(image, opts.ComposefsPath); err != nil {
+			return errors.Wrap(err, "writing composefs metadata")
+		}
+	}
+
 	if opts.NoPush && len(opts.Destinations) == 0 {
 		if opts.TarPath != "" {
 			setDummyDestinations(opts)
@@ -260,8 +317,32 @@ func DoPush(image v1.Image, opts *config.KanikoOptions) error {
 		return nil
 	}
 
+	var report v1.Image
+	if opts.PushBuildReport {
+		r, err := newBuildReport(image, opts)
+		if err != nil {
+			return errors.Wrap(err, "creating build report")
+		}
+		if report, err = buildReportArtifact(r, image); err != nil {
+			return errors.Wrap(err, "creating build report artifact")
+		}
+	}
+
+	layerIndex, err := openLayerIndex(opts)
+	if err != nil {
+		return errors.Wrap(err, "opening layer index")
+	}
+
 	// continue pushing unless an error occurs
 	for _, destRef := range destRefs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// The image name digest files keep the destinations, which serve the
+		// images pushed to the repositories they are mapped to
+		if destRef, err = pushTarget(opts, destRef); err != nil {
+			return err
+		}
 		registryName := destRef.Repository.Registry.Name()
 		if opts.Insecure || opts.InsecureRegistries.Contains(registryName) {
 			newReg, err := name.NewRegistry(registryName, name.WeakValidation, name.Insecure)
@@ -271,7 +352,7 @@ func DoPush(image v1.Image, opts *config.KanikoOptions) error {
 			destRef.Repository.Registry = newReg
 		}
 
-		pushAuth, err := creds.GetKeychain().Resolve(destRef.Context().Registry)
+		pushAuth, err := creds.Keychain(&opts.RegistryOptions).Resolve(destRef.Context())
 		if err != nil {
 			return errors.Wrap(err, "resolving pushAuth")
 		}
@@ -284,6 +365,7 @@ func DoPush(image v1.Image, opts *config.KanikoOptions) error {
 		rt := &withUserAgent{t: tr}
 
 		logrus.Infof("Pushing image to %s", destRef.String())
+		progress.SetPhase(progress.PhasePushing, destRef.String())
 
 		retryFunc := func() error {
 			dig, err := image.Digest()
@@ -291,7 +373,7 @@ func DoPush(image v1.Image, opts *config.KanikoOptions) error {
 				return err
 			}
 			digest := destRef.Context().Digest(dig.String())
-			if err := remote.Write(destRef, image, remote.WithAuth(pushAuth), remote.WithTransport(rt)); err != nil {
+			if err := writeImage(destRef, image, remote.WithContext(ctx), remote.WithAuth(pushAuth), remote.WithTransport(rt), remote.WithJobs(max(opts.UploadJobs, 1))); err != nil {
 				if !opts.PushIgnoreImmutableTagErrors {
 					return err
 				}
@@ -313,11 +395,59 @@ func DoPush(image v1.Image, opts *config.KanikoOptions) error {
 		if err := util.Retry(retryFunc, opts.PushRetry, 1000); err != nil {
 			return errors.Wrap(err, fmt.Sprintf("failed to push to destination %s", destRef))
 		}
+		dig, err := image.Digest()
+		if err != nil {
+			return err
+		}
+		recordPushed(destRef.Context().Digest(dig.String()).String())
+		if layerIndex != nil {
+			if err := recordPushedLayers(layerIndex, image, destRef.Context().String()); err != nil {
+				return errors.Wrap(err, "recording pushed layers")
+			}
+		}
+
+		if report != nil {
+			pushReport := func() error {
+				dig, err := report.Digest()
+				if err != nil {
+					return err
+				}
+				reportRef := destRef.Context().Digest(dig.String())
+				if err := writeImage(reportRef, report, remote.WithContext(ctx), remote.WithAuth(pushAuth), remote.WithTransport(rt)); err != nil {
+					return err
+				}
+				logrus.Infof("Pushed build report %s", reportRef)
+				return nil
+			}
+			if err := util.Retry(pushReport, opts.PushRetry, 1000); err != nil {
+				return errors.Wrapf(err, "failed to push build report to destination %s", destRef)
+			}
+		}
+	}
+	if layerIndex != nil {
+		if err := layerIndex.Save(); err != nil {
+			return errors.Wrap(err, "saving layer index")
+		}
 	}
 	timing.DefaultRun.Stop(t)
 	return writeImageOutputs(image, destRefs)
 }
 
+// imageOutputs returns the number of outputs the image is written to
+func imageOutputs(opts *config.KanikoOptions) int {
+	outputs := 0
+	if opts.OCILayoutPath != "" {
+		outputs++
+	}
+	if opts.TarPath != "" {
+		outputs++
+	}
+	if !opts.NoPush {
+		outputs += len(opts.Destinations)
+	}
+	return outputs
+}
+
 func writeImageOutputs(image v1.Image, destRefs []name.Tag) error {
 	dir := os.Getenv("BUILDER_OUTPUT")
 	if dir == "" {
@@ -352,6 +482,43 @@ func writeImageOutputs(image v1.Image, destRefs []name.Tag) error {
 // pushLayerToCache pushes layer (tagged with cacheKey) to opts.CacheRepo
 // if opts.CacheRepo doesn't exist, infer the cache from the given destination
 func pushLayerToCache(opts *config.KanikoOptions, cacheKey string, tarPath string, createdBy string) error {
+	empty, err := cachedLayerImage(opts, tarPath, createdBy)
+	if err != nil {
+		return err
+	}
+	backend, err := cache.GetBackend(opts, opts.CacheRepo)
+	if err != nil {
+		return err
+	}
+	cache, err := cache.Destination(opts, cacheKey)
+	if err != nil {
+		return errors.Wrap(err, "getting cache destination")
+	}
+	logrus.Infof("Pushing layer %s to cache now", cache)
+	if backend != nil {
+		if opts.NoPushCache {
+			return nil
+		}
+		return backend.Put(cacheKey, empty)
+	}
+	cacheOpts := *opts
+	cacheOpts.TarPath = ""              // tarPath doesn't make sense for Docker layers
+	cacheOpts.NoPush = opts.NoPushCache // we do not want to push cache if --no-push-cache is set.
+	cacheOpts.Destinations = []string{cache}
+	cacheOpts.ImageIDFile = ""
+	cacheOpts.InsecureRegistries = opts.InsecureRegistries
+	cacheOpts.SkipTLSVerifyRegistries = opts.SkipTLSVerifyRegistries
+	if isOCILayout(cache) {
+		cacheOpts.OCILayoutPath = strings.TrimPrefix(cache, "oci:")
+		cacheOpts.NoPush = true
+	}
+	return DoPush(empty, &cacheOpts)
+}
+
+// cachedLayerImage returns the image caching the layer at tarPath, made of
+// just that layer
+func cachedLayerImage(opts *config.KanikoOptions, tarPath string, createdBy string) (v1.Image, error) {
+	base := empty.Image
 	var layerOpts []tarball.LayerOption
 	if opts.CompressedCaching == true {
 		layerOpts = append(layerOpts, tarball.WithCompressedCaching)
@@ -364,6 +531,9 @@ func pushLayerToCache(opts *config.KanikoOptions, cacheKey string, tarPath strin
 	switch opts.Compression {
 	case config.ZStd:
 		layerOpts = append(layerOpts, tarball.WithCompression("zstd"), tarball.WithMediaType(types.OCILayerZStd))
+		// Only OCI images may have zstd compressed layers
+		base = mutate.MediaType(base, types.OCIManifestSchema1)
+		base = mutate.ConfigMediaType(base, types.OCIConfigJSON)
 
 	case config.GZip:
 		// layer already gzipped by default
@@ -371,18 +541,12 @@ func pushLayerToCache(opts *config.KanikoOptions, cacheKey string, tarPath strin
 
 	layer, err := tarball.LayerFromFile(tarPath, layerOpts...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	cache, err := cache.Destination(opts, cacheKey)
-	if err != nil {
-		return errors.Wrap(err, "getting cache destination")
-	}
-	logrus.Infof("Pushing layer %s to cache now", cache)
-	empty := empty.Image
-	empty, err = mutate.CreatedAt(empty, v1.Time{Time: time.Now()})
+	empty, err := mutate.CreatedAt(base, v1.Time{Time: time.Now()})
 	if err != nil {
-		return errors.Wrap(err, "setting empty image created time")
+		return nil, errors.Wrap(err, "setting empty image created time")
 	}
 
 	empty, err = mutate.Append(empty,
@@ -395,19 +559,45 @@ func pushLayerToCache(opts *config.KanikoOptions, cacheKey string, tarPath strin
 		},
 	)
 	if err != nil {
-		return errors.Wrap(err, "appending layer onto empty image")
+		return nil, errors.Wrap(err, "appending layer onto empty image")
 	}
-	cacheOpts := *opts
-	cacheOpts.TarPath = ""              // tarPath doesn't make sense for Docker layers
-	cacheOpts.NoPush = opts.NoPushCache // we do not want to push cache if --no-push-cache is set.
-	cacheOpts.Destinations = []string{cache}
-	cacheOpts.InsecureRegistries = opts.InsecureRegistries
-	cacheOpts.SkipTLSVerifyRegistries = opts.SkipTLSVerifyRegistries
-	if isOCILayout(cache) {
-		cacheOpts.OCILayoutPath = strings.TrimPrefix(cache, "oci:")
-		cacheOpts.NoPush = true
+	return empty, nil
+}
+
+// pushStageToCache pushes the image of a completed stage to the cache repo,
+// tagged with the stage name, for other builds to use it with COPY --from or
+// as a base image.
+func pushStageToCache(opts *config.KanikoOptions, stageName string, image v1.Image) error {
+	dest, err := cache.Destination(opts, stageName)
+	if err != nil {
+		return errors.Wrap(err, "getting stage destination")
 	}
-	return DoPush(empty, &cacheOpts)
+	logrus.Infof("Pushing stage %s to %s", stageName, dest)
+	backend, err := cache.GetBackend(opts, opts.CacheRepo)
+	if err != nil {
+		return err
+	}
+	if backend != nil {
+		if opts.NoPushCache {
+			return nil
+		}
+		return backend.Put(stageName, image)
+	}
+	stageOpts := *opts
+	stageOpts.TarPath = ""
+	stageOpts.NoPush = opts.NoPushCache
+	stageOpts.Destinations = []string{dest}
+	stageOpts.DigestFile = ""
+	stageOpts.ImageNameDigestFile = ""
+	stageOpts.ImageNameTagDigestFile = ""
+	stageOpts.ImageIDFile = ""
+	stageOpts.OCILayoutPath = ""
+	stageOpts.ComposefsPath = ""
+	if isOCILayout(dest) {
+		stageOpts.OCILayoutPath = strings.TrimPrefix(dest, "oci:")
+		stageOpts.NoPush = true
+	}
+	return DoPush(image, &stageOpts)
 }
 
 // setDummyDestinations sets the dummy destinations required to generate new
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"strings"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// pushTarget returns the tag destRef is pushed to: the same tag in the
+// repository set with --registry-push-map for the longest repository prefix
+// of destRef, like the writable upstream of an Artifact Registry virtual
+// repository which only serves pulls, or destRef itself if none is set.
+func pushTarget(opts *config.KanikoOptions, destRef name.Tag) (name.Tag, error) {
+	mapped, err := mapPushTarget(opts, destRef)
+	if err != nil {
+		return name.Tag{}, err
+	}
+	if mapped != destRef {
+		logrus.Infof("Pushing %s to %s, mapped with --registry-push-map", destRef, mapped)
+	}
+	return mapped, nil
+}
+
+// mapPushTarget returns the tag destRef is pushed to, without logging it
+func mapPushTarget(opts *config.KanikoOptions, destRef name.Tag) (name.Tag, error) {
+	repo := destRef.Context().Name()
+	var source, target string
+	for from, to := range opts.RegistryPushMaps {
+		fromRepo, err := name.NewRepository(strings.TrimSuffix(from, "/"), name.WeakValidation)
+		if err != nil {
+			return name.Tag{}, errors.Wrapf(err, "parsing registry push map %s", from)
+		}
+		prefix := fromRepo.Name()
+		if repo != prefix && !strings.HasPrefix(repo, prefix+"/") {
+			continue
+		}
+		if len(prefix) > len(source) {
+			source, target = prefix, strings.TrimSuffix(to, "/")
+		}
+	}
+	if source == "" {
+		return destRef, nil
+	}
+	mapped, err := name.NewTag(target+strings.TrimPrefix(repo, source)+":"+destRef.TagStr(), name.WeakValidation)
+	if err != nil {
+		return name.Tag{}, errors.Wrapf(err, "mapping %s to %s", destRef, target)
+	}
+	return mapped, nil
+}
+
+// repositoryKeychain resolves the credentials of a repository for the callers
+// resolving them by registry, for the credentials scoped to the repository or
+// to one of its parents to be used, like the tokens of a single Artifact
+// Registry repository.
+type repositoryKeychain struct {
+	repo     name.Repository
+	keychain authn.Keychain
+}
+
+func (k repositoryKeychain) Resolve(authn.Resource) (authn.Authenticator, error) {
+	return k.keychain.Resolve(k.repo)
+}
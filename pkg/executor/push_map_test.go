@@ -0,0 +1,53 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestPushTarget(t *testing.T) {
+	opts := &config.KanikoOptions{}
+	opts.RegistryPushMaps = map[string]string{
+		"us-docker.pkg.dev/prj/virtual":       "us-docker.pkg.dev/prj/standard",
+		"us-docker.pkg.dev/prj/virtual/cache": "us-docker.pkg.dev/prj/cache/",
+		"busybox":                             "registry.example.com/mirror/busybox",
+	}
+	tests := []struct {
+		destination string
+		want        string
+	}{
+		{"us-docker.pkg.dev/prj/virtual/app:v1", "us-docker.pkg.dev/prj/standard/app:v1"},
+		{"us-docker.pkg.dev/prj/virtual/team/app", "us-docker.pkg.dev/prj/standard/team/app:latest"},
+		{"us-docker.pkg.dev/prj/virtual/cache:key", "us-docker.pkg.dev/prj/cache:key"},
+		{"us-docker.pkg.dev/prj/virtual/cache/app:key", "us-docker.pkg.dev/prj/cache/app:key"},
+		{"us-docker.pkg.dev/prj/virtual-other/app:v1", "us-docker.pkg.dev/prj/virtual-other/app:v1"},
+		{"busybox:1.36", "registry.example.com/mirror/busybox:1.36"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.destination, func(t *testing.T) {
+			destRef, err := name.NewTag(tt.destination, name.WeakValidation)
+			testutil.CheckNoError(t, err)
+			got, err := pushTarget(opts, destRef)
+			testutil.CheckErrorAndDeepEqual(t, false, err, tt.want, got.String())
+		})
+	}
+}
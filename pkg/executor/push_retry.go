@@ -0,0 +1,124 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// manifestPutRetries is the number of times the manifest PUT of an image is
+// retried after a transient error
+const manifestPutRetries = 3
+
+// for testing
+var manifestPutBackoff = time.Second
+
+// writeImage pushes image to ref. The registry may store the manifest and
+// still fail its PUT, e.g. with a 5xx or a timeout of a proxy in front of it.
+// Since putting the same manifest again is idempotent, the manifest PUT alone
+// is retried after its transient errors, once the layers are pushed, and the
+// push succeeds as soon as ref points at the digest of the image. The whole
+// push is retried after the transient errors of the other requests, the layers
+// already pushed being skipped.
+func writeImage(ref name.Reference, image v1.Image, options ...remote.Option) error {
+	err := remote.Write(ref, image, options...)
+	if err == nil {
+		return nil
+	}
+	dig, derr := image.Digest()
+	if derr != nil {
+		return err
+	}
+	backoff := manifestPutBackoff
+	for i := 0; i < manifestPutRetries && isTransientError(err); i++ {
+		if pointsAt(ref, dig, options...) {
+			logrus.Warnf("Pushing %s failed with %v, but it points at %s already", ref, err, dig)
+			return nil
+		}
+		manifestOnly := manifestPutFailed(err)
+		if manifestOnly {
+			logrus.Warnf("Retrying the manifest PUT of %s in %s after %v", ref, backoff, err)
+		} else {
+			logrus.Warnf("Retrying the push of %s in %s after %v", ref, backoff, err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if manifestOnly {
+			err = remote.Put(ref, image, options...)
+		} else {
+			err = remote.Write(ref, image, options...)
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	if pointsAt(ref, dig, options...) {
+		logrus.Warnf("Pushing %s failed with %v, but it points at %s already", ref, err, dig)
+		return nil
+	}
+	return err
+}
+
+// pointsAt returns true if ref points at the manifest with the digest dig
+func pointsAt(ref name.Reference, dig v1.Hash, options ...remote.Option) bool {
+	desc, err := remote.Head(ref, options...)
+	if err != nil {
+		logrus.Debugf("Unable to check the digest %s points at: %v", ref, err)
+		return false
+	}
+	return desc.Digest == dig
+}
+
+// manifestPutFailed returns true if err is the error of the PUT of a manifest
+func manifestPutFailed(err error) bool {
+	var terr *transport.Error
+	if errors.As(err, &terr) && terr.Request != nil {
+		return terr.Request.Method == http.MethodPut && strings.Contains(terr.Request.URL.Path, "/manifests/")
+	}
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		// The operation of the errors of the client is the capitalized method
+		return uerr.Op == "Put" && strings.Contains(uerr.URL, "/manifests/")
+	}
+	return false
+}
+
+// isTransientError returns true if err is a server error or a timeout, after
+// which a request may succeed
+func isTransientError(err error) bool {
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		return terr.StatusCode >= http.StatusInternalServerError || terr.StatusCode == http.StatusRequestTimeout || terr.StatusCode == http.StatusTooManyRequests
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// flakyRegistry is a registry having all the blobs, failing the manifest PUTs
+// with the given statuses, storing the manifest or not, before accepting them.
+// With blobs set, it has none of the blobs and fails their upload with the
+// statuses of blobFailures, rejecting the manifest until it has blobs of them.
+type flakyRegistry struct {
+	mu           sync.Mutex
+	failures     []int
+	store        bool
+	manifest     []byte
+	puts         int
+	blobs        int
+	blobFailures []int
+	uploaded     map[string]bool
+	blobPuts     int
+}
+
+func (r *flakyRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case req.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case strings.Contains(req.URL.Path, "/blobs/uploads/"):
+		switch req.Method {
+		case http.MethodPut:
+			r.blobPuts++
+			if len(r.blobFailures) > 0 {
+				status := r.blobFailures[0]
+				r.blobFailures = r.blobFailures[1:]
+				w.WriteHeader(status)
+				return
+			}
+			if r.uploaded == nil {
+				r.uploaded = map[string]bool{}
+			}
+			r.uploaded[req.URL.Query().Get("digest")] = true
+			w.WriteHeader(http.StatusCreated)
+		default:
+			io.Copy(io.Discard, req.Body)
+			w.Header().Set("Location", "/v2/app/blobs/uploads/upload")
+			w.WriteHeader(http.StatusAccepted)
+		}
+	case strings.Contains(req.URL.Path, "/blobs/"):
+		if r.blobs > 0 && !r.uploaded[req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", "1")
+		w.WriteHeader(http.StatusOK)
+	case strings.Contains(req.URL.Path, "/manifests/") && req.Method == http.MethodPut:
+		b, _ := io.ReadAll(req.Body)
+		r.puts++
+		if len(r.uploaded) < r.blobs {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(r.failures) > 0 {
+			status := r.failures[0]
+			r.failures = r.failures[1:]
+			if r.store {
+				r.manifest = b
+			}
+			w.WriteHeader(status)
+			return
+		}
+		r.manifest = b
+		w.WriteHeader(http.StatusCreated)
+	case strings.Contains(req.URL.Path, "/manifests/") && req.Method == http.MethodHead:
+		if r.manifest == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		h, _, _ := v1.SHA256(bytes.NewReader(r.manifest))
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(r.manifest)))
+		w.Header().Set("Docker-Content-Digest", h.String())
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func Test_writeImage(t *testing.T) {
+	original := manifestPutBackoff
+	manifestPutBackoff = time.Millisecond
+	defer func() { manifestPutBackoff = original }()
+
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		registry     *flakyRegistry
+		wantErr      bool
+		wantPuts     int
+		wantBlobPuts int
+	}{
+		{
+			name:     "manifest stored despite the error",
+			registry: &flakyRegistry{failures: []int{http.StatusBadGateway}, store: true},
+			wantPuts: 1,
+		},
+		{
+			name:     "manifest PUT retried",
+			registry: &flakyRegistry{failures: []int{http.StatusServiceUnavailable, http.StatusGatewayTimeout}},
+			wantPuts: 3,
+		},
+		{
+			name:     "too many failures",
+			registry: &flakyRegistry{failures: []int{500, 500, 500, 500, 500}},
+			wantErr:  true,
+			wantPuts: 4,
+		},
+		{
+			name:     "permanent failure",
+			registry: &flakyRegistry{failures: []int{http.StatusBadRequest}},
+			wantErr:  true,
+			wantPuts: 1,
+		},
+		{
+			// The layer and the config are uploaded again before the manifest
+			name:         "layer upload retried",
+			registry:     &flakyRegistry{blobs: 2, blobFailures: []int{http.StatusBadGateway}},
+			wantPuts:     1,
+			wantBlobPuts: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(test.registry)
+			defer server.Close()
+			u, err := url.Parse(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ref, err := name.NewTag(u.Host+"/app:latest", name.Insecure)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Without the retries of the transport, to count the PUTs
+			err = writeImage(ref, image, remote.WithRetryBackoff(remote.Backoff{Steps: 1}))
+			testutil.CheckError(t, test.wantErr, err)
+			testutil.CheckDeepEqual(t, test.wantPuts, test.registry.puts)
+			testutil.CheckDeepEqual(t, test.wantBlobPuts, test.registry.blobPuts)
+		})
+	}
+}
@@ -223,6 +223,29 @@ func TestImageNameDigestFile(t *testing.T) {
 
 }
 
+func TestImageIDFile(t *testing.T) {
+	image, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("could not create image: %s", err)
+	}
+	id, err := image.ConfigName()
+	if err != nil {
+		t.Fatalf("could not get image ID: %s", err)
+	}
+
+	iidFile := filepath.Join(t.TempDir(), "iid")
+	opts := config.KanikoOptions{
+		NoPush:      true,
+		ImageIDFile: iidFile,
+	}
+	if err := DoPush(image, &opts); err != nil {
+		t.Fatalf("could not push image: %s", err)
+	}
+
+	got, err := os.ReadFile(iidFile)
+	testutil.CheckErrorAndDeepEqual(t, false, err, id.String(), string(got))
+}
+
 func TestDoPushWithOpts(t *testing.T) {
 	tarPath := "image.tar"
 
@@ -505,3 +528,38 @@ func TestWriteDigestFile(t *testing.T) {
 		}
 	})
 }
+
+func TestPushStageToCache(t *testing.T) {
+	// The cache repo must be a valid repository name
+	dir, err := os.MkdirTemp("", "stages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("could not create image: %s", err)
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatalf("could not get image digest: %s", err)
+	}
+	digestFile := filepath.Join(dir, "digest")
+	opts := config.KanikoOptions{
+		CacheRepo:  "oci:" + filepath.Join(dir, "cache"),
+		DigestFile: digestFile,
+	}
+
+	testutil.CheckNoError(t, pushStageToCache(&opts, "builder", image))
+
+	layoutIndex, err := layout.ImageIndexFromPath(filepath.Join(dir, "cache") + ":builder")
+	if err != nil {
+		t.Fatalf("could not get index from layout: %s", err)
+	}
+	_, err = layoutIndex.Image(digest)
+	testutil.CheckNoError(t, err)
+	// The outputs of the final image are not written for stages
+	if _, err := os.Stat(digestFile); !os.IsNotExist(err) {
+		t.Errorf("expected no digest file to be written, got %v", err)
+	}
+}
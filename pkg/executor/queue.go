@@ -0,0 +1,222 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrQueueFull is returned by Build and Push when QueueLimits.MaxQueued
+	// builds and pushes are already waiting
+	ErrQueueFull = errors.New("the build queue is full")
+	// ErrReservationTooLarge is returned by Build and Push when their
+	// reservation exceeds the resources of QueueLimits
+	ErrReservationTooLarge = errors.New("the reservation exceeds the resources available to the builds")
+)
+
+// QueueLimits bounds the builds and pushes run through the API, which run one
+// at a time: besides the builds owning the filesystem, they share the state of
+// the process, like the pre-push mutations, the build statistics, the progress,
+// the timings, the secrets and the cache mounts of RUN, and the hermetic mode.
+// The zero values are unlimited.
+type QueueLimits struct {
+	// MaxQueued is the number of builds and pushes which may wait for the
+	// running one, the others being rejected with ErrQueueFull
+	MaxQueued int
+	// Disk and Memory are the bytes available to a build, the builds and
+	// pushes reserving more being rejected with ErrReservationTooLarge
+	Disk   int64
+	Memory int64
+}
+
+// Reservation is the estimate of the resources a build needs
+type Reservation struct {
+	Disk   int64
+	Memory int64
+}
+
+// WithReservation reserves r for the build or the push
+func WithReservation(r Reservation) Option {
+	return func(s *settings) {
+		s.reservation = r
+	}
+}
+
+// QueueStats are the metrics of the queue of the builds and pushes
+type QueueStats struct {
+	// Queued is the number of builds and pushes waiting
+	Queued int
+	// Running is the number of builds and pushes running
+	Running int
+	// Disk and Memory are the bytes reserved by the running build or push
+	Disk   int64
+	Memory int64
+	// Completed is the number of builds and pushes which ran
+	Completed uint64
+	// Rejected is the number of builds and pushes rejected by the limits
+	Rejected uint64
+	// Canceled is the number of builds and pushes canceled while waiting
+	Canceled uint64
+	// Wait is the total time the builds and pushes which ran waited
+	Wait time.Duration
+}
+
+// queue schedules the builds and pushes run through the API
+type queue struct {
+	mu     sync.Mutex
+	limits QueueLimits
+	stats  QueueStats
+	// waiters are the builds and pushes waiting, in their order of arrival
+	waiters []*waiter
+}
+
+// waiter is a build or a push waiting in the queue
+type waiter struct {
+	r     Reservation
+	start time.Time
+	// ready is closed once the build or the push may run
+	ready chan struct{}
+}
+
+var apiQueue = newQueue()
+
+func newQueue() *queue {
+	return &queue{}
+}
+
+// SetQueueLimits sets the limits of the builds and pushes run through the API
+// from now on.
+func SetQueueLimits(l QueueLimits) {
+	apiQueue.mu.Lock()
+	defer apiQueue.mu.Unlock()
+	apiQueue.limits = l
+	apiQueue.grant()
+}
+
+// GetQueueStats returns the metrics of the builds and pushes run through the
+// API, for the programs embedding kaniko to expose them.
+func GetQueueStats() QueueStats {
+	apiQueue.mu.Lock()
+	defer apiQueue.mu.Unlock()
+	return apiQueue.stats
+}
+
+// acquire waits until the build or the push reserving r may run, once the
+// running one and the ones queued before have completed, unless the limits
+// reject it or ctx is done first. It returns the function to call once the
+// build or the push completes.
+func (q *queue) acquire(ctx context.Context, r Reservation) (release func(), err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	w := &waiter{r: r, start: time.Now(), ready: make(chan struct{})}
+	release = func() { q.release(w) }
+
+	q.mu.Lock()
+	if (q.limits.Disk > 0 && r.Disk > q.limits.Disk) || (q.limits.Memory > 0 && r.Memory > q.limits.Memory) {
+		q.stats.Rejected++
+		q.mu.Unlock()
+		return nil, fmt.Errorf("%w: reserving %d bytes of disk and %d bytes of memory, out of %d and %d", ErrReservationTooLarge, r.Disk, r.Memory, q.limits.Disk, q.limits.Memory)
+	}
+	if len(q.waiters) == 0 && q.idle() {
+		q.run(w)
+		q.mu.Unlock()
+		return release, nil
+	}
+	if q.limits.MaxQueued > 0 && len(q.waiters) >= q.limits.MaxQueued {
+		q.stats.Rejected++
+		q.mu.Unlock()
+		return nil, fmt.Errorf("%w: %d builds waiting", ErrQueueFull, len(q.waiters))
+	}
+	q.waiters = append(q.waiters, w)
+	q.stats.Queued++
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-ctx.Done():
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stats.Canceled++
+	select {
+	case <-w.ready:
+		// Started along with the cancelation
+		q.stats.Running--
+		q.free(w)
+	default:
+		for i := range q.waiters {
+			if q.waiters[i] == w {
+				q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+				break
+			}
+		}
+		q.stats.Queued--
+	}
+	// The ones queued after may now start
+	q.grant()
+	return nil, ctx.Err()
+}
+
+// idle returns whether no build or push is running. It is called with q.mu
+// held.
+func (q *queue) idle() bool {
+	return q.stats.Running == 0
+}
+
+// run reserves the resources of w. It is called with q.mu held.
+func (q *queue) run(w *waiter) {
+	q.stats.Running++
+	q.stats.Disk += w.r.Disk
+	q.stats.Memory += w.r.Memory
+}
+
+// free releases the resources of w. It is called with q.mu held.
+func (q *queue) free(w *waiter) {
+	q.stats.Disk -= w.r.Disk
+	q.stats.Memory -= w.r.Memory
+}
+
+// grant starts the first waiter once no build or push is running. It is
+// called with q.mu held.
+func (q *queue) grant() {
+	if len(q.waiters) > 0 && q.idle() {
+		w := q.waiters[0]
+		q.waiters = q.waiters[1:]
+		q.stats.Queued--
+		q.stats.Wait += time.Since(w.start)
+		q.run(w)
+		close(w.ready)
+	}
+}
+
+// release frees the resources of the build or the push w once it completed
+func (q *queue) release(w *waiter) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stats.Running--
+	q.stats.Completed++
+	q.free(w)
+	q.grant()
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func Test_queue(t *testing.T) {
+	q := newQueue()
+	q.limits = QueueLimits{MaxQueued: 1, Disk: 1 << 30}
+	ctx := context.Background()
+
+	release, err := q.acquire(ctx, Reservation{Disk: 1 << 20})
+	testutil.CheckNoError(t, err)
+
+	_, err = q.acquire(ctx, Reservation{Disk: 2 << 30})
+	testutil.CheckDeepEqual(t, true, errors.Is(err, ErrReservationTooLarge))
+
+	acquired := make(chan func())
+	go func() {
+		r, err := q.acquire(ctx, Reservation{})
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- r
+	}()
+	waitQueued(q, 1)
+
+	_, err = q.acquire(ctx, Reservation{})
+	testutil.CheckDeepEqual(t, true, errors.Is(err, ErrQueueFull))
+
+	release()
+	(<-acquired)()
+
+	// A canceled build leaves the queue
+	release, err = q.acquire(ctx, Reservation{})
+	testutil.CheckNoError(t, err)
+	canceled, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = q.acquire(canceled, Reservation{})
+	testutil.CheckDeepEqual(t, context.DeadlineExceeded, err)
+	release()
+
+	stats := q.stats
+	testutil.CheckDeepEqual(t, 0, stats.Queued)
+	testutil.CheckDeepEqual(t, 0, stats.Running)
+	testutil.CheckDeepEqual(t, uint64(3), stats.Completed)
+	testutil.CheckDeepEqual(t, uint64(2), stats.Rejected)
+	testutil.CheckDeepEqual(t, uint64(1), stats.Canceled)
+}
+
+func Test_queue_oneAtATime(t *testing.T) {
+	q := newQueue()
+	q.limits = QueueLimits{Disk: 3 << 30, Memory: 4 << 30}
+	ctx := context.Background()
+
+	build, err := q.acquire(ctx, Reservation{Disk: 2 << 30, Memory: 1 << 30})
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, int64(2<<30), q.stats.Disk)
+
+	// The builds and pushes share the state of the process, so a push waits
+	// for the running build, and the ones queued after it start in turn
+	order := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func(i int) {
+			release, err := q.acquire(ctx, Reservation{Memory: 1 << 30})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- i
+			release()
+		}(i)
+		waitQueued(q, i+1)
+	}
+	testutil.CheckDeepEqual(t, 1, q.stats.Running)
+	build()
+	testutil.CheckDeepEqual(t, 0, <-order)
+	testutil.CheckDeepEqual(t, 1, <-order)
+
+	waitCompleted(q, 3)
+	stats := q.stats
+	testutil.CheckDeepEqual(t, 0, stats.Queued)
+	testutil.CheckDeepEqual(t, 0, stats.Running)
+	testutil.CheckDeepEqual(t, int64(0), stats.Disk)
+	testutil.CheckDeepEqual(t, int64(0), stats.Memory)
+}
+
+// waitQueued waits until n builds or pushes wait in q
+func waitQueued(q *queue, n int) {
+	for {
+		q.mu.Lock()
+		queued := q.stats.Queued
+		q.mu.Unlock()
+		if queued >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitCompleted waits until n builds or pushes completed in q
+func waitCompleted(q *queue, n uint64) {
+	for {
+		q.mu.Lock()
+		completed := q.stats.Completed
+		q.mu.Unlock()
+		if completed >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
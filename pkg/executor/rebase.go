@@ -0,0 +1,223 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/image/remote"
+	"github.com/chainguard-dev/kaniko/pkg/timing"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// baseNameAnnotation and baseDigestAnnotation are the OCI annotations of
+	// the manifests recording their base image
+	baseNameAnnotation   = "org.opencontainers.image.base.name"
+	baseDigestAnnotation = "org.opencontainers.image.base.digest"
+)
+
+// DoRebase retrieves the image set with --rebase and returns it with the
+// layers of its base image, set with --rebase-old-base or recorded in its
+// annotations, replaced by the ones of --rebase-new-base, to patch its base
+// without rebuilding it.
+func DoRebase(opts *config.KanikoOptions) (v1.Image, error) {
+	t := timing.Start("Total Rebase Time")
+	defer timing.DefaultRun.Stop(t)
+
+	app, err := remote.RetrieveRemoteImage(opts.Rebase, opts.RegistryOptions, opts.CustomPlatform)
+	if err != nil {
+		return nil, errors.Wrapf(err, "retrieving image %s", opts.Rebase)
+	}
+	oldBaseRef := opts.RebaseOldBase
+	if oldBaseRef == "" {
+		if oldBaseRef, err = recordedBase(app); err != nil {
+			return nil, errors.Wrapf(err, "finding the base image of %s, set it with --rebase-old-base", opts.Rebase)
+		}
+	}
+	oldBase, err := remote.RetrieveRemoteImage(oldBaseRef, opts.RegistryOptions, opts.CustomPlatform)
+	if err != nil {
+		return nil, errors.Wrapf(err, "retrieving old base image %s", oldBaseRef)
+	}
+	newBase, err := remote.RetrieveRemoteImage(opts.RebaseNewBase, opts.RegistryOptions, opts.CustomPlatform)
+	if err != nil {
+		return nil, errors.Wrapf(err, "retrieving new base image %s", opts.RebaseNewBase)
+	}
+	logrus.Infof("Rebasing %s from %s onto %s", opts.Rebase, oldBaseRef, opts.RebaseNewBase)
+
+	startInterval, err := healthcheckStartInterval(app)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading config of image %s", opts.Rebase)
+	}
+	image, err := rebase(app, oldBase, newBase)
+	if err != nil {
+		return nil, errors.Wrapf(err, "rebasing image %s", opts.Rebase)
+	}
+	if image, err = convertImageMediaTypes(image, opts.MediaTypes); err != nil {
+		return nil, errors.Wrapf(err, "converting media types of image %s", opts.Rebase)
+	}
+	if image, err = recordBase(app, image, newBase, opts.RebaseNewBase); err != nil {
+		return nil, err
+	}
+	if image, err = annotate(image, opts.Annotations); err != nil {
+		return nil, err
+	}
+	return withHealthcheckStartInterval(image, startInterval)
+}
+
+// rebase returns app with the layers of oldBase replaced by the ones of
+// newBase, once checked that app is built on oldBase and that newBase can
+// replace it
+func rebase(app, oldBase, newBase v1.Image) (v1.Image, error) {
+	appLayers, err := app.Layers()
+	if err != nil {
+		return nil, err
+	}
+	oldLayers, err := oldBase.Layers()
+	if err != nil {
+		return nil, err
+	}
+	if len(oldLayers) > len(appLayers) {
+		return nil, fmt.Errorf("the image is not built on the old base image, which has more layers (%d) than the image (%d)", len(oldLayers), len(appLayers))
+	}
+	for i, l := range oldLayers {
+		oldDiffID, err := l.DiffID()
+		if err != nil {
+			return nil, err
+		}
+		appDiffID, err := appLayers[i].DiffID()
+		if err != nil {
+			return nil, err
+		}
+		if oldDiffID != appDiffID {
+			return nil, fmt.Errorf("the image is not built on the old base image, its layer %d is %s instead of %s", i, appDiffID, oldDiffID)
+		}
+	}
+
+	oldCf, err := oldBase.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	newCf, err := newBase.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if oldCf.OS != newCf.OS || oldCf.Architecture != newCf.Architecture || oldCf.Variant != newCf.Variant {
+		return nil, fmt.Errorf("the new base image is for %s, not %s like the old one", platformOf(newCf), platformOf(oldCf))
+	}
+	appMt, err := app.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	newMt, err := newBase.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	if extractMediaTypeVendor(appMt) != extractMediaTypeVendor(newMt) {
+		return nil, fmt.Errorf("the new base image is a %s image and the image a %s one, their layers cannot be mixed", newMt, appMt)
+	}
+	// The config of the image is kept, so the changes of the base images to
+	// theirs are not carried over
+	for field, values := range map[string][2]interface{}{
+		"environment":       {oldCf.Config.Env, newCf.Config.Env},
+		"user":              {oldCf.Config.User, newCf.Config.User},
+		"working directory": {oldCf.Config.WorkingDir, newCf.Config.WorkingDir},
+		"entrypoint":        {oldCf.Config.Entrypoint, newCf.Config.Entrypoint},
+	} {
+		if !reflect.DeepEqual(values[0], values[1]) {
+			logrus.Warnf("The new base image changes the %s of the old one, the image keeps its own", field)
+		}
+	}
+
+	image, err := mutate.Rebase(app, oldBase, newBase)
+	if err != nil {
+		return nil, err
+	}
+	// mutate.Rebase starts from an empty Docker image, keeping only the
+	// runtime config of app
+	appManifest, err := app.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	image = mutate.MediaType(image, appMt)
+	image = mutate.ConfigMediaType(image, appManifest.Config.MediaType)
+	appCf, err := app.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cf, err := image.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	cf = cf.DeepCopy()
+	cf.Author = appCf.Author
+	cf.Created = appCf.Created
+	cf.Variant = newCf.Variant
+	cf.OSFeatures = newCf.OSFeatures
+	return mutate.ConfigFile(image, cf)
+}
+
+// recordedBase returns the base image recorded in the annotations of image
+func recordedBase(image v1.Image) (string, error) {
+	m, err := image.Manifest()
+	if err != nil {
+		return "", err
+	}
+	name, ok := m.Annotations[baseNameAnnotation]
+	if !ok {
+		return "", fmt.Errorf("no %s annotation", baseNameAnnotation)
+	}
+	if digest, ok := m.Annotations[baseDigestAnnotation]; ok {
+		return name + "@" + digest, nil
+	}
+	return name, nil
+}
+
+// recordBase updates the base image recorded in the annotations of app, if
+// any, to newBase on rebased
+func recordBase(app, rebased, newBase v1.Image, newBaseRef string) (v1.Image, error) {
+	m, err := app.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	anns := map[string]string{}
+	for k, v := range m.Annotations {
+		anns[k] = v
+	}
+	if _, ok := anns[baseNameAnnotation]; ok {
+		digest, err := newBase.Digest()
+		if err != nil {
+			return nil, err
+		}
+		anns[baseNameAnnotation] = newBaseRef
+		anns[baseDigestAnnotation] = digest.String()
+	}
+	if len(anns) == 0 {
+		return rebased, nil
+	}
+	return mutate.Annotations(rebased, anns).(v1.Image), nil
+}
+
+func platformOf(cf *v1.ConfigFile) string {
+	p := v1.Platform{OS: cf.OS, Architecture: cf.Architecture, Variant: cf.Variant}
+	return p.String()
+}
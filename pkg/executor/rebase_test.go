@@ -0,0 +1,103 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func Test_rebase(t *testing.T) {
+	image := func(base v1.Image, layers ...v1.Layer) v1.Image {
+		img, err := mutate.AppendLayers(base, layers...)
+		testutil.CheckNoError(t, err)
+		return img
+	}
+	oldBase := image(empty.Image, tarLayer(t, map[string]string{"lib/libc.so": "1.0"}))
+	newBase := image(empty.Image, tarLayer(t, map[string]string{"lib/libc.so": "1.1"}))
+	appLayer := tarLayer(t, map[string]string{"app": "app"})
+	app := image(oldBase, appLayer)
+	app, err := mutate.Config(app, v1.Config{Entrypoint: []string{"/app"}})
+	testutil.CheckNoError(t, err)
+
+	rebased, err := rebase(app, oldBase, newBase)
+	testutil.CheckNoError(t, err)
+	_, err = rebased.Digest()
+	testutil.CheckNoError(t, err)
+	layers, err := rebased.Layers()
+	testutil.CheckNoError(t, err)
+	expected := []v1.Layer{mustLayers(t, newBase)[0], appLayer}
+	testutil.CheckDeepEqual(t, len(expected), len(layers))
+	for i, l := range layers {
+		digest, err := l.Digest()
+		testutil.CheckNoError(t, err)
+		expectedDigest, err := expected[i].Digest()
+		testutil.CheckNoError(t, err)
+		testutil.CheckDeepEqual(t, expectedDigest, digest)
+	}
+	cf, err := rebased.ConfigFile()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, []string{"/app"}, cf.Config.Entrypoint)
+
+	// The image must be built on the old base
+	_, err = rebase(app, newBase, oldBase)
+	testutil.CheckError(t, true, err)
+
+	// The new base must be for the same platform
+	armBase, err := mutate.ConfigFile(newBase, &v1.ConfigFile{OS: "linux", Architecture: "arm64"})
+	testutil.CheckNoError(t, err)
+	_, err = rebase(app, oldBase, armBase)
+	testutil.CheckError(t, true, err)
+
+	// The new base must use the same family of media types
+	ociBase := mutate.MediaType(newBase, types.OCIManifestSchema1)
+	_, err = rebase(app, oldBase, ociBase)
+	testutil.CheckError(t, true, err)
+}
+
+func Test_recordBase(t *testing.T) {
+	app := mutate.Annotations(empty.Image, map[string]string{
+		baseNameAnnotation:   "cgr.dev/chainguard/static:latest",
+		baseDigestAnnotation: "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+	}).(v1.Image)
+	ref, err := recordedBase(app)
+	testutil.CheckErrorAndDeepEqual(t, false, err, "cgr.dev/chainguard/static:latest@sha256:0000000000000000000000000000000000000000000000000000000000000000", ref)
+
+	newBase := mutate.MediaType(empty.Image, types.DockerManifestSchema2)
+	rebased, err := recordBase(app, empty.Image, newBase, "cgr.dev/chainguard/static:1.1")
+	testutil.CheckNoError(t, err)
+	m, err := rebased.Manifest()
+	testutil.CheckNoError(t, err)
+	digest, err := newBase.Digest()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, "cgr.dev/chainguard/static:1.1", m.Annotations[baseNameAnnotation])
+	testutil.CheckDeepEqual(t, digest.String(), m.Annotations[baseDigestAnnotation])
+
+	_, err = recordedBase(empty.Image)
+	testutil.CheckError(t, true, err)
+}
+
+func mustLayers(t *testing.T, image v1.Image) []v1.Layer {
+	layers, err := image.Layers()
+	testutil.CheckNoError(t, err)
+	return layers
+}
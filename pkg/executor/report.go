@@ -0,0 +1,143 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"encoding/json"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/timing"
+	"github.com/chainguard-dev/kaniko/pkg/version"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	// BuildReportArtifactType is the artifact type of the build reports pushed
+	// as referrers of the images
+	BuildReportArtifactType = "application/vnd.dev.kaniko.build.report.v1"
+	// BuildReportMediaType is the media type of the build report itself
+	BuildReportMediaType = "application/vnd.dev.kaniko.build.report.v1+json"
+)
+
+// BuildReport is the record of the build of an image
+type BuildReport struct {
+	KanikoVersion       string            `json:"kanikoVersion"`
+	Image               string            `json:"image"`
+	Destinations        []string          `json:"destinations,omitempty"`
+	Context             string            `json:"context,omitempty"`
+	Dockerfile          string            `json:"dockerfile,omitempty"`
+	DockerfileFragments []string          `json:"dockerfileFragments,omitempty"`
+	Target              string            `json:"target,omitempty"`
+	Platform            string            `json:"platform,omitempty"`
+	Cache               CacheStats        `json:"cache"`
+	Timing              map[string]string `json:"timing,omitempty"`
+	Mutations           []Mutation        `json:"mutations,omitempty"`
+	Logs                string            `json:"logs,omitempty"`
+}
+
+// CacheStats are the lookups of the cached layers of a build
+type CacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+// buildStats are the statistics of the build recorded in its report
+var buildStats struct {
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64
+}
+
+// newBuildReport returns the report of the build of image
+func newBuildReport(image v1.Image, opts *config.KanikoOptions) (*BuildReport, error) {
+	d, err := image.Digest()
+	if err != nil {
+		return nil, err
+	}
+	r := &BuildReport{
+		KanikoVersion:       version.Version(),
+		Image:               d.String(),
+		Destinations:        opts.Destinations,
+		Context:             redactURL(opts.SrcContext),
+		Dockerfile:          opts.DockerfilePath,
+		DockerfileFragments: opts.ResolvedDockerfileFragments,
+		Target:              opts.Target,
+		Platform:            opts.CustomPlatform,
+		Cache: CacheStats{
+			Hits:   buildStats.cacheHits.Load(),
+			Misses: buildStats.cacheMisses.Load(),
+		},
+		Logs:      opts.BuildLogsURL,
+		Mutations: prePushMutations,
+	}
+	s, err := timing.JSON()
+	if err != nil {
+		return nil, err
+	}
+	var categories map[string]time.Duration
+	if err := json.Unmarshal([]byte(s), &categories); err != nil {
+		return nil, err
+	}
+	r.Timing = map[string]string{}
+	for c, d := range categories {
+		r.Timing[c] = d.String()
+	}
+	return r, nil
+}
+
+// redactURL removes the credentials of the build context URLs
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	u.User = nil
+	return u.String()
+}
+
+// buildReportArtifact returns the OCI artifact holding the report, referring
+// to the image it is the report of.
+func buildReportArtifact(report *BuildReport, image v1.Image) (v1.Image, error) {
+	b, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	subject, err := partial.Descriptor(image)
+	if err != nil {
+		return nil, err
+	}
+	artifact, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer: static.NewLayer(b, BuildReportMediaType),
+	})
+	if err != nil {
+		return nil, err
+	}
+	artifact = mutate.MediaType(artifact, types.OCIManifestSchema1)
+	artifact = mutate.ConfigMediaType(artifact, BuildReportArtifactType)
+	return mutate.Subject(artifact, v1.Descriptor{
+		MediaType: subject.MediaType,
+		Digest:    subject.Digest,
+		Size:      subject.Size,
+	}).(v1.Image), nil
+}
@@ -0,0 +1,273 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// maxRunMismatches is the number of differences reported for a replayed RUN
+const maxRunMismatches = 10
+
+// runRecord is the record of the effects of a RUN instruction: the network
+// destinations its commands connected to, and the files of its layer
+type runRecord struct {
+	Stage   int      `json:"stage"`
+	Index   int      `json:"index"`
+	Command string   `json:"command"`
+	Network []string `json:"network,omitempty"`
+	// Files maps the files of the layer to their type, permissions, owner
+	// and content digest, leaving out their times
+	Files map[string]string `json:"files,omitempty"`
+}
+
+// runRecorder records the effects of the RUN instructions of a build with
+// --record-runs, and verifies they match the effects recorded by a previous
+// build with --replay-runs.
+type runRecorder struct {
+	// path is the file the records are written to, if any
+	path     string
+	records  []runRecord
+	recorded map[string]runRecord
+	// replayed are the keys of the recorded instructions replayed so far
+	replayed map[string]bool
+}
+
+// ValidateRunRecording returns an error when the RUN instructions are recorded
+// or replayed along with options running them without snapshotting each of
+// them: the instructions restored from the cache, and the ones snapshotted
+// together with --single-snapshot, would be left out silently.
+func ValidateRunRecording(opts *config.KanikoOptions) error {
+	if opts.RecordRuns == "" && opts.ReplayRuns == "" {
+		return nil
+	}
+	if opts.Cache {
+		return errors.New("--record-runs and --replay-runs cannot be used with --cache, the cached RUN instructions do not run")
+	}
+	if opts.SingleSnapshot {
+		return errors.New("--record-runs and --replay-runs cannot be used with --single-snapshot, the RUN instructions have no layer of their own")
+	}
+	return nil
+}
+
+// newRunRecorder returns the recorder of the RUN instructions, or nil if
+// they are neither recorded nor replayed
+func newRunRecorder(opts *config.KanikoOptions) (*runRecorder, error) {
+	if opts.RecordRuns == "" && opts.ReplayRuns == "" {
+		return nil, nil
+	}
+	if err := ValidateRunRecording(opts); err != nil {
+		return nil, err
+	}
+	r := &runRecorder{path: opts.RecordRuns}
+	if opts.ReplayRuns == "" {
+		return r, nil
+	}
+	b, err := os.ReadFile(opts.ReplayRuns)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading recorded RUN instructions")
+	}
+	var records []runRecord
+	if err := json.Unmarshal(b, &records); err != nil {
+		return nil, errors.Wrapf(err, "parsing recorded RUN instructions %s", opts.ReplayRuns)
+	}
+	r.recorded = map[string]runRecord{}
+	r.replayed = map[string]bool{}
+	for _, rec := range records {
+		r.recorded[runRecordKey(rec.Stage, rec.Index)] = rec
+	}
+	return r, nil
+}
+
+func runRecordKey(stage, index int) string {
+	return fmt.Sprintf("%d/%d", stage, index)
+}
+
+// record records the effects of the RUN instruction command at index in
+// stage, whose layer is at tarPath, and returns an error if they differ from
+// the recorded ones.
+func (r *runRecorder) record(stage, index int, command string, network []string, tarPath string) error {
+	files, err := layerFiles(tarPath)
+	if err != nil {
+		return errors.Wrapf(err, "recording files of %s", command)
+	}
+	rec := runRecord{Stage: stage, Index: index, Command: command, Network: network, Files: files}
+	r.records = append(r.records, rec)
+	if r.recorded == nil {
+		return nil
+	}
+	expected, ok := r.recorded[runRecordKey(stage, index)]
+	if !ok {
+		return fmt.Errorf("%s was not recorded at instruction %d of stage %d", command, index, stage)
+	}
+	r.replayed[runRecordKey(stage, index)] = true
+	if mismatches := compareRuns(expected, rec); len(mismatches) > 0 {
+		return fmt.Errorf("replayed %s does not match the recorded one: %s", command, strings.Join(mismatches, "; "))
+	}
+	logrus.Infof("Replayed %s matches the recorded one", command)
+	return nil
+}
+
+// save writes the records to the file set with --record-runs, if any, once
+// the build is done. It returns an error if recorded instructions were not
+// replayed.
+func (r *runRecorder) save() error {
+	if r == nil {
+		return nil
+	}
+	if err := r.checkReplayed(); err != nil {
+		return err
+	}
+	if r.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(r.records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0o755); err != nil {
+		return err
+	}
+	logrus.Infof("Writing the records of %d RUN instructions to %s", len(r.records), r.path)
+	return os.WriteFile(r.path, b, 0o644)
+}
+
+// checkReplayed returns an error if recorded instructions were not replayed
+func (r *runRecorder) checkReplayed() error {
+	var missing []string
+	for key, rec := range r.recorded {
+		if !r.replayed[key] {
+			missing = append(missing, fmt.Sprintf("%s at instruction %d of stage %d", rec.Command, rec.Index, rec.Stage))
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	if len(missing) > maxRunMismatches {
+		n := len(missing) - maxRunMismatches
+		missing = append(missing[:maxRunMismatches], fmt.Sprintf("and %d more", n))
+	}
+	return fmt.Errorf("recorded RUN instructions were not replayed: %s", strings.Join(missing, "; "))
+}
+
+// compareRuns returns the differences between the recorded effects of a RUN
+// instruction and the replayed ones
+func compareRuns(expected, got runRecord) []string {
+	var mismatches []string
+	if expected.Command != got.Command {
+		mismatches = append(mismatches, fmt.Sprintf("command was %s", expected.Command))
+	}
+	if !slices.Equal(expected.Network, got.Network) {
+		mismatches = append(mismatches, fmt.Sprintf("network destinations are [%s] instead of [%s]",
+			strings.Join(got.Network, ", "), strings.Join(expected.Network, ", ")))
+	}
+	var paths []string
+	for p := range expected.Files {
+		paths = append(paths, p)
+	}
+	for p := range got.Files {
+		if _, ok := expected.Files[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		e, inExpected := expected.Files[p]
+		g, inGot := got.Files[p]
+		switch {
+		case !inGot:
+			mismatches = append(mismatches, fmt.Sprintf("%s is missing", p))
+		case !inExpected:
+			mismatches = append(mismatches, fmt.Sprintf("%s was not recorded", p))
+		case e != g:
+			mismatches = append(mismatches, fmt.Sprintf("%s is %s instead of %s", p, g, e))
+		}
+	}
+	if len(mismatches) > maxRunMismatches {
+		n := len(mismatches) - maxRunMismatches
+		mismatches = append(mismatches[:maxRunMismatches], fmt.Sprintf("and %d more", n))
+	}
+	return mismatches
+}
+
+// layerFiles returns the files of the layer at tarPath, described by their
+// type, permissions, owner and content digest, which do not depend on when
+// they were written. The files deleted by the layer are described as such.
+func layerFiles(tarPath string) (map[string]string, error) {
+	files := map[string]string{}
+	if tarPath == "" {
+		return files, nil
+	}
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Clean("/" + hdr.Name)
+		dir, base := filepath.Split(name)
+		if base == archive.WhiteoutOpaqueDir {
+			files[filepath.Clean(dir)] = "opaque"
+			continue
+		}
+		if deleted, ok := strings.CutPrefix(base, archive.WhiteoutPrefix); ok {
+			files[filepath.Join(dir, deleted)] = "deleted"
+			continue
+		}
+		owner := fmt.Sprintf("%o %d:%d", hdr.Mode, hdr.Uid, hdr.Gid)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			h := sha256.New()
+			if _, err := io.Copy(h, tr); err != nil {
+				return nil, err
+			}
+			files[name] = fmt.Sprintf("file %s sha256:%s", owner, hex.EncodeToString(h.Sum(nil)))
+		case tar.TypeDir:
+			files[name] = "dir " + owner
+		case tar.TypeSymlink:
+			files[name] = fmt.Sprintf("symlink %s -> %s", owner, hdr.Linkname)
+		case tar.TypeLink:
+			files[name] = fmt.Sprintf("link %s -> %s", owner, filepath.Clean("/"+hdr.Linkname))
+		default:
+			files[name] = fmt.Sprintf("%c %s %d:%d", hdr.Typeflag, owner, hdr.Devmajor, hdr.Devminor)
+		}
+	}
+}
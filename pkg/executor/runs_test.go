@@ -0,0 +1,93 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func writeRunLayer(t *testing.T, content string) string {
+	t.Helper()
+	tarPath := filepath.Join(t.TempDir(), "layer.tar")
+	f, err := os.Create(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, hdr := range []*tar.Header{
+		{Name: "app/", Typeflag: tar.TypeDir, Mode: 0o755},
+		{Name: "app/main", Typeflag: tar.TypeReg, Mode: 0o755, Size: int64(len(content))},
+		{Name: "app/.wh.old", Typeflag: tar.TypeReg, Mode: 0o644},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			tw.Write([]byte(content))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return tarPath
+}
+
+func TestRunRecorder(t *testing.T) {
+	recordPath := filepath.Join(t.TempDir(), "runs.json")
+	network := []string{"93.184.216.34:443/tcp"}
+
+	r, err := newRunRecorder(&config.KanikoOptions{RecordRuns: recordPath})
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, r.record(0, 1, "RUN make", network, writeRunLayer(t, "binary")))
+	testutil.CheckNoError(t, r.save())
+	testutil.CheckDeepEqual(t, map[string]string{
+		"/app":      "dir 755 0:0",
+		"/app/main": "file 755 0:0 sha256:9a3a45d01531a20e89ac6ae10b0b0beb0492acd7216a368aa062d1a5fecaf9cd",
+		"/app/old":  "deleted",
+	}, r.records[0].Files)
+
+	replay := func() *runRecorder {
+		r, err := newRunRecorder(&config.KanikoOptions{ReplayRuns: recordPath})
+		testutil.CheckNoError(t, err)
+		return r
+	}
+	replayed := replay()
+	testutil.CheckNoError(t, replayed.record(0, 1, "RUN make", network, writeRunLayer(t, "binary")))
+	testutil.CheckNoError(t, replayed.save())
+	// The recorded instructions must all be replayed
+	testutil.CheckError(t, true, replay().save())
+	testutil.CheckError(t, true, replay().record(0, 1, "RUN make", network, writeRunLayer(t, "other")))
+	testutil.CheckError(t, true, replay().record(0, 1, "RUN make", nil, writeRunLayer(t, "binary")))
+	testutil.CheckError(t, true, replay().record(0, 2, "RUN make", network, writeRunLayer(t, "binary")))
+
+	if r, err := newRunRecorder(&config.KanikoOptions{}); r != nil || err != nil {
+		t.Fatalf("expected no recorder, got %v, %v", r, err)
+	}
+	// The cached instructions and the ones without a layer of their own
+	// cannot be recorded
+	_, err = newRunRecorder(&config.KanikoOptions{RecordRuns: recordPath, Cache: true})
+	testutil.CheckError(t, true, err)
+	_, err = newRunRecorder(&config.KanikoOptions{ReplayRuns: recordPath, SingleSnapshot: true})
+	testutil.CheckError(t, true, err)
+}
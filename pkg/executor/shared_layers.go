@@ -0,0 +1,94 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// sharedLayers are the layers built by the stages, keyed by the contents of
+// their snapshot, for the stages snapshotting the same files, like when they
+// COPY the same sources, to share a layer instead of compressing it again.
+type sharedLayers map[string]v1.Layer
+
+// get returns the layer built from a snapshot with the same contents as the
+// one at tarPath, or builds it with newLayer.
+func (l sharedLayers) get(tarPath string, mt types.MediaType, newLayer func() (v1.Layer, error)) (v1.Layer, error) {
+	key, err := snapshotContentKey(tarPath)
+	if err != nil {
+		return nil, err
+	}
+	key = string(mt) + "@" + key
+	if layer, ok := l[key]; ok {
+		logrus.Info("Reusing the layer of an earlier stage with the same contents")
+		return layer, nil
+	}
+	layer, err := newLayer()
+	if err != nil {
+		return nil, err
+	}
+	l[key] = layer
+	return layer, nil
+}
+
+// snapshotContentKey returns the digest of the snapshot tarball at tarPath,
+// ignoring the times of its files. The files written by the same COPY in
+// different stages only differ by their modification times.
+func snapshotContentKey(tarPath string) (string, error) {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	tw := tar.NewWriter(h)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		hdr.ModTime, hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}, time.Time{}
+		for _, k := range []string{"mtime", "atime", "ctime"} {
+			delete(hdr.PAXRecords, k)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return "", err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
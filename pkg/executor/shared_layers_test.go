@@ -0,0 +1,74 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func Test_sharedLayers(t *testing.T) {
+	dir := t.TempDir()
+	writeSnapshot := func(name, content string, modTime time.Time) string {
+		path := filepath.Join(dir, name)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		tw := tar.NewWriter(f)
+		if err := tw.WriteHeader(&tar.Header{Name: "app/main.go", Mode: 0o644, Size: int64(len(content)), ModTime: modTime}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	first := writeSnapshot("first", "package main", time.Unix(1000, 0))
+	sameContent := writeSnapshot("same", "package main", time.Unix(2000, 0))
+	otherContent := writeSnapshot("other", "package other", time.Unix(1000, 0))
+
+	layers := sharedLayers{}
+	built := 0
+	get := func(path string, mt types.MediaType) v1.Layer {
+		layer, err := layers.get(path, mt, func() (v1.Layer, error) {
+			built++
+			return tarball.LayerFromFile(path)
+		})
+		testutil.CheckNoError(t, err)
+		return layer
+	}
+	layer := get(first, types.DockerManifestSchema2)
+	testutil.CheckDeepEqual(t, true, layer == get(sameContent, types.DockerManifestSchema2))
+	testutil.CheckDeepEqual(t, 1, built)
+
+	get(otherContent, types.DockerManifestSchema2)
+	get(sameContent, types.OCIManifestSchema1)
+	testutil.CheckDeepEqual(t, 3, built)
+}
@@ -0,0 +1,378 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SummaryFormatMarkdown is the summary rendered by GitHub Actions, to be
+	// appended to $GITHUB_STEP_SUMMARY
+	SummaryFormatMarkdown = "markdown"
+	// SummaryFormatJUnit is the summary rendered by GitLab CI, to be
+	// collected with artifacts:reports:junit
+	SummaryFormatJUnit = "junit"
+
+	// maxSummaryWarnings is how many warnings the summary lists
+	maxSummaryWarnings = 50
+	// maxSummaryCommand is how long the commands listed in the summary may be
+	maxSummaryCommand = 120
+)
+
+// buildStep is a command of the build listed in its summary
+type buildStep struct {
+	Stage    string
+	Command  string
+	Cached   bool
+	Failed   bool
+	Duration time.Duration
+}
+
+// buildSummary records the steps, warnings and pushed references of the build
+var buildSummary struct {
+	sync.Mutex
+	start    time.Time
+	steps    []buildStep
+	warnings []string
+	dropped  int
+	pushed   []string
+}
+
+// StartSummary starts recording the steps and warnings of the build summarized
+// by WriteSummary
+func StartSummary() {
+	buildSummary.Lock()
+	buildSummary.start = time.Now()
+	buildSummary.Unlock()
+	logrus.AddHook(warningHook{})
+}
+
+// warningHook collects the warnings logged during the build
+type warningHook struct{}
+
+func (warningHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.WarnLevel}
+}
+
+func (warningHook) Fire(entry *logrus.Entry) error {
+	buildSummary.Lock()
+	defer buildSummary.Unlock()
+	if len(buildSummary.warnings) < maxSummaryWarnings {
+		buildSummary.warnings = append(buildSummary.warnings, entry.Message)
+	} else {
+		buildSummary.dropped++
+	}
+	return nil
+}
+
+// recordStep records the command of the stage, run in d, in the summary
+func recordStep(stage *config.KanikoStage, command string, cached bool, d time.Duration) {
+	appendStep(stage, buildStep{Command: command, Cached: cached, Duration: d})
+}
+
+// recordFailedStep records the command of the stage the build failed on,
+// after d, in the summary
+func recordFailedStep(stage *config.KanikoStage, command string, cached bool, d time.Duration) {
+	appendStep(stage, buildStep{Command: command, Cached: cached, Failed: true, Duration: d})
+}
+
+func appendStep(stage *config.KanikoStage, step buildStep) {
+	step.Stage = fmt.Sprintf("%d", stage.Index)
+	if stage.Name != "" {
+		step.Stage = stage.Name
+	}
+	buildSummary.Lock()
+	buildSummary.steps = append(buildSummary.steps, step)
+	buildSummary.Unlock()
+}
+
+// recordPushed records the reference the image was pushed to in the summary
+func recordPushed(ref string) {
+	buildSummary.Lock()
+	buildSummary.pushed = append(buildSummary.pushed, ref)
+	buildSummary.Unlock()
+}
+
+// summary is the outcome of a build written by WriteSummary
+type summary struct {
+	Image        string
+	Destinations []string
+	Cache        CacheStats
+	Duration     time.Duration
+	Steps        []buildStep
+	Warnings     []string
+	Dropped      int
+	Err          error
+}
+
+// summaryFormat returns the format of the summary, inferred from the
+// extension of the file when not set
+func summaryFormat(opts *config.KanikoOptions) (string, error) {
+	switch opts.SummaryFormat {
+	case SummaryFormatMarkdown, SummaryFormatJUnit:
+		return opts.SummaryFormat, nil
+	case "":
+		if strings.EqualFold(filepath.Ext(opts.SummaryFile), ".xml") {
+			return SummaryFormatJUnit, nil
+		}
+		return SummaryFormatMarkdown, nil
+	default:
+		return "", fmt.Errorf("unknown summary format %q, must be %s or %s", opts.SummaryFormat, SummaryFormatMarkdown, SummaryFormatJUnit)
+	}
+}
+
+// ValidateSummaryFormat returns an error when the format of the summary is
+// unknown
+func ValidateSummaryFormat(opts *config.KanikoOptions) error {
+	_, err := summaryFormat(opts)
+	return err
+}
+
+// WriteSummary writes the summary of the build of image, failed with buildErr
+// when not nil, to the summary file. Markdown summaries are appended to the
+// file, as GitHub Actions expects, and JUnit reports replace it.
+func WriteSummary(image v1.Image, opts *config.KanikoOptions, buildErr error) error {
+	if opts.SummaryFile == "" {
+		return nil
+	}
+	format, err := summaryFormat(opts)
+	if err != nil {
+		return err
+	}
+	s, err := newSummary(image, buildErr)
+	if err != nil {
+		return err
+	}
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if format == SummaryFormatMarkdown {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(opts.SummaryFile, flags, 0644)
+	if err != nil {
+		return errors.Wrap(err, "opening summary file")
+	}
+	if format == SummaryFormatJUnit {
+		err = s.writeJUnit(f)
+	} else {
+		err = s.writeMarkdown(f)
+	}
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "writing summary")
+	}
+	return f.Close()
+}
+
+// newSummary returns the summary of the build of image, nil when the build
+// failed
+func newSummary(image v1.Image, buildErr error) (*summary, error) {
+	buildSummary.Lock()
+	defer buildSummary.Unlock()
+	s := &summary{
+		Cache: CacheStats{
+			Hits:   buildStats.cacheHits.Load(),
+			Misses: buildStats.cacheMisses.Load(),
+		},
+		Steps:        append([]buildStep(nil), buildSummary.steps...),
+		Warnings:     append([]string(nil), buildSummary.warnings...),
+		Dropped:      buildSummary.dropped,
+		Destinations: append([]string(nil), buildSummary.pushed...),
+		Err:          buildErr,
+	}
+	if !buildSummary.start.IsZero() {
+		s.Duration = time.Since(buildSummary.start)
+	}
+	if image == nil {
+		return s, nil
+	}
+	d, err := image.Digest()
+	if err != nil {
+		return nil, err
+	}
+	s.Image = d.String()
+	return s, nil
+}
+
+// summaryCommand returns the command shortened to a line
+func summaryCommand(command string) string {
+	command = strings.Join(strings.Fields(command), " ")
+	if len(command) > maxSummaryCommand {
+		command = command[:maxSummaryCommand-3] + "..."
+	}
+	return command
+}
+
+// markdownCell escapes the text of a cell of a Markdown table
+func markdownCell(text string) string {
+	return strings.ReplaceAll(text, "|", `\|`)
+}
+
+func (s *summary) writeMarkdown(w io.Writer) error {
+	var b strings.Builder
+	if s.Err != nil {
+		fmt.Fprintf(&b, "### :x: kaniko build failed after %s\n\n", s.Duration.Round(time.Millisecond))
+		fmt.Fprintf(&b, "```\n%s\n```\n\n", s.Err)
+	} else {
+		fmt.Fprintf(&b, "### :white_check_mark: kaniko build succeeded in %s\n\n", s.Duration.Round(time.Millisecond))
+	}
+	b.WriteString("| | |\n| --- | --- |\n")
+	if s.Image != "" {
+		fmt.Fprintf(&b, "| Image | `%s` |\n", s.Image)
+	}
+	for _, dest := range s.Destinations {
+		fmt.Fprintf(&b, "| Pushed | `%s` |\n", dest)
+	}
+	fmt.Fprintf(&b, "| Cache | %d hits, %d misses |\n\n", s.Cache.Hits, s.Cache.Misses)
+	if len(s.Steps) > 0 {
+		b.WriteString("| Stage | Command | Cached | Duration |\n| --- | --- | :---: | ---: |\n")
+		for _, step := range s.Steps {
+			cached := ""
+			if step.Cached {
+				cached = ":white_check_mark:"
+			}
+			failed := ""
+			if step.Failed {
+				failed = " :x:"
+			}
+			fmt.Fprintf(&b, "| %s | `%s`%s | %s | %s |\n", markdownCell(step.Stage),
+				markdownCell(summaryCommand(step.Command)), failed, cached, step.Duration.Round(time.Millisecond))
+		}
+		b.WriteString("\n")
+	}
+	if len(s.Warnings) > 0 {
+		fmt.Fprintf(&b, "<details><summary>%d warnings</summary>\n\n", len(s.Warnings)+s.Dropped)
+		for _, warning := range s.Warnings {
+			fmt.Fprintf(&b, "- %s\n", strings.Join(strings.Fields(warning), " "))
+		}
+		if s.Dropped > 0 {
+			fmt.Fprintf(&b, "- and %d more\n", s.Dropped)
+		}
+		b.WriteString("\n</details>\n\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Time       string          `xml:"time,attr"`
+	Properties []junitProperty `xml:"properties>property,omitempty"`
+	Cases      []junitTestCase `xml:"testcase"`
+	SystemErr  string          `xml:"system-err,omitempty"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitTime formats d in seconds, as JUnit reports do
+func junitTime(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+func (s *summary) writeJUnit(w io.Writer) error {
+	suite := junitTestSuite{
+		Name: "kaniko build",
+		Time: junitTime(s.Duration),
+		Properties: []junitProperty{
+			{Name: "cache.hits", Value: fmt.Sprintf("%d", s.Cache.Hits)},
+			{Name: "cache.misses", Value: fmt.Sprintf("%d", s.Cache.Misses)},
+		},
+	}
+	if s.Image != "" {
+		suite.Properties = append(suite.Properties, junitProperty{Name: "image", Value: s.Image})
+	}
+	for _, dest := range s.Destinations {
+		suite.Properties = append(suite.Properties, junitProperty{Name: "pushed", Value: dest})
+	}
+	for _, step := range s.Steps {
+		c := junitTestCase{
+			ClassName: "stage " + step.Stage,
+			Name:      summaryCommand(step.Command),
+			Time:      junitTime(step.Duration),
+		}
+		if step.Cached {
+			c.SystemOut = "cached"
+		}
+		if step.Failed {
+			c.Failure = &junitFailure{Message: "command failed"}
+			if s.Err != nil {
+				c.Failure.Text = s.Err.Error()
+			}
+			suite.Failures++
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	result := junitTestCase{ClassName: "kaniko", Name: "build", Time: junitTime(s.Duration)}
+	if s.Err != nil {
+		result.Failure = &junitFailure{Message: "build failed", Text: s.Err.Error()}
+		suite.Failures++
+	}
+	suite.Cases = append(suite.Cases, result)
+	suite.Tests = len(suite.Cases)
+	if len(s.Warnings) > 0 {
+		warnings := append([]string(nil), s.Warnings...)
+		if s.Dropped > 0 {
+			warnings = append(warnings, fmt.Sprintf("and %d more", s.Dropped))
+		}
+		suite.SystemErr = strings.Join(warnings, "\n")
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
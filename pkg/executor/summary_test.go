@@ -0,0 +1,128 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/pkg/errors"
+)
+
+func TestSummaryFormat(t *testing.T) {
+	tests := []struct {
+		file   string
+		format string
+		want   string
+	}{
+		{"/github/step_summary", "", SummaryFormatMarkdown},
+		{"report.XML", "", SummaryFormatJUnit},
+		{"report.xml", SummaryFormatMarkdown, SummaryFormatMarkdown},
+		{"summary", SummaryFormatJUnit, SummaryFormatJUnit},
+	}
+	for _, test := range tests {
+		got, err := summaryFormat(&config.KanikoOptions{SummaryFile: test.file, SummaryFormat: test.format})
+		testutil.CheckErrorAndDeepEqual(t, false, err, test.want, got)
+	}
+	testutil.CheckError(t, true, ValidateSummaryFormat(&config.KanikoOptions{SummaryFormat: "html"}))
+}
+
+func TestWriteSummary(t *testing.T) {
+	image, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := image.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buildSummary.Lock()
+	buildSummary.steps = []buildStep{
+		{Stage: "builder", Command: "RUN make | tee log", Cached: true, Duration: time.Second},
+		{Stage: "1", Command: "COPY --from=builder /out /", Duration: 1500 * time.Millisecond},
+	}
+	buildSummary.warnings = []string{"base image is deprecated"}
+	buildSummary.Unlock()
+	defer func() {
+		buildSummary.Lock()
+		buildSummary.steps, buildSummary.warnings, buildSummary.pushed = nil, nil, nil
+		buildSummary.Unlock()
+	}()
+	// The references actually pushed are listed, mapped with
+	// --registry-push-map, not the destinations
+	recordPushed("registry.example.com/mirror/app@" + d.String())
+
+	dir := t.TempDir()
+	opts := &config.KanikoOptions{
+		SummaryFile:  filepath.Join(dir, "summary.md"),
+		Destinations: []string{"registry.example.com/app:v1"},
+	}
+	for i := 0; i < 2; i++ {
+		if err := WriteSummary(image, opts, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := os.ReadFile(opts.SummaryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := string(b)
+	testutil.CheckDeepEqual(t, 2, strings.Count(md, "kaniko build succeeded"))
+	for _, want := range []string{
+		"| Pushed | `registry.example.com/mirror/app@" + d.String() + "` |",
+		"| builder | `RUN make \\| tee log` | :white_check_mark: | 1s |",
+		"| 1 | `COPY --from=builder /out /` |  | 1.5s |",
+		"- base image is deprecated",
+	} {
+		if !strings.Contains(md, want) {
+			t.Errorf("markdown summary misses %q:\n%s", want, md)
+		}
+	}
+
+	// The command the build failed on is listed too
+	recordFailedStep(&config.KanikoStage{Index: 1}, "RUN make test", false, 2*time.Second)
+	opts.SummaryFile = filepath.Join(dir, "report.xml")
+	if err := WriteSummary(nil, opts, errors.New("failed to execute command")); err != nil {
+		t.Fatal(err)
+	}
+	b, err = os.ReadFile(opts.SummaryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report junitTestSuites
+	if err := xml.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckDeepEqual(t, 1, len(report.Suites))
+	suite := report.Suites[0]
+	testutil.CheckDeepEqual(t, 4, suite.Tests)
+	testutil.CheckDeepEqual(t, 2, suite.Failures)
+	testutil.CheckDeepEqual(t, "stage builder", suite.Cases[0].ClassName)
+	testutil.CheckDeepEqual(t, "cached", suite.Cases[0].SystemOut)
+	testutil.CheckDeepEqual(t, "1.500", suite.Cases[1].Time)
+	testutil.CheckDeepEqual(t, "RUN make test", suite.Cases[2].Name)
+	testutil.CheckDeepEqual(t, "command failed", suite.Cases[2].Failure.Message)
+	testutil.CheckDeepEqual(t, "failed to execute command", suite.Cases[3].Failure.Text)
+	testutil.CheckDeepEqual(t, "base image is deprecated", suite.SystemErr)
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/image/remote"
+	"github.com/chainguard-dev/kaniko/pkg/timing"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// DoTranscode retrieves the image set with --transcode and returns it with its
+// layers compressed again according to the compression options, to be pushed
+// without rebuilding it.
+func DoTranscode(opts *config.KanikoOptions) (v1.Image, error) {
+	t := timing.Start("Total Transcode Time")
+	defer timing.DefaultRun.Stop(t)
+
+	src, err := remote.RetrieveRemoteImage(opts.Transcode, opts.RegistryOptions, opts.CustomPlatform)
+	if err != nil {
+		return nil, errors.Wrapf(err, "retrieving image %s", opts.Transcode)
+	}
+	startInterval, err := healthcheckStartInterval(src)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading config of image %s", opts.Transcode)
+	}
+	image, err := transcode(src, opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "transcoding image %s", opts.Transcode)
+	}
+	if image, err = convertImageMediaTypes(image, opts.MediaTypes); err != nil {
+		return nil, errors.Wrapf(err, "converting media types of image %s", opts.Transcode)
+	}
+	if image, err = annotate(image, opts.Annotations); err != nil {
+		return nil, err
+	}
+	return withHealthcheckStartInterval(image, startInterval)
+}
+
+// transcode returns src with its layers compressed again. The layers are
+// recompressed from their uncompressed tar streams, so their contents,
+// whiteouts included, and the image config are left untouched. Images are
+// converted to OCI images when compressed with zstd, which Docker images do
+// not support.
+func transcode(src v1.Image, opts *config.KanikoOptions) (v1.Image, error) {
+	mt, err := src.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	cf, err := src.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	layers, err := src.Layers()
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := src.Manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	oci := extractMediaTypeVendor(mt) == types.OCIVendorPrefix || opts.Compression == config.ZStd
+	image := empty.Image
+	layerType := types.DockerLayer
+	if oci {
+		image = mutate.MediaType(image, types.OCIManifestSchema1)
+		image = mutate.ConfigMediaType(image, types.OCIConfigJSON)
+		layerType = types.OCILayer
+	}
+	var layerOpts []tarball.LayerOption
+	if opts.Compression == config.ZStd {
+		layerType = types.OCILayerZStd
+		layerOpts = append(layerOpts, tarball.WithCompression("zstd"))
+	}
+	if opts.CompressionLevel > 0 {
+		layerOpts = append(layerOpts, tarball.WithCompressionLevel(opts.CompressionLevel))
+	}
+	layerOpts = append(layerOpts, tarball.WithMediaType(layerType))
+
+	addenda := make([]mutate.Addendum, 0, len(layers))
+	for i, layer := range layers {
+		lmt, err := layer.MediaType()
+		if err != nil {
+			return nil, err
+		}
+		// Foreign layers are not distributed with the image
+		if !lmt.IsDistributable() {
+			addenda = append(addenda, mutate.Addendum{
+				Layer:     layer,
+				MediaType: convertForeignMediaType(lmt, oci),
+				URLs:      manifest.Layers[i].URLs,
+			})
+			continue
+		}
+		transcoded, err := tarball.LayerFromOpener(layer.Uncompressed, layerOpts...)
+		if err != nil {
+			return nil, err
+		}
+		addenda = append(addenda, mutate.Addendum{Layer: transcoded})
+	}
+	logrus.Infof("Compressing %d layers again as %s", len(addenda), layerType)
+	if image, err = mutate.Append(image, addenda...); err != nil {
+		return nil, err
+	}
+	// The layers have the same uncompressed contents, so the config of the
+	// source image, with its history and diff IDs, still applies
+	return mutate.ConfigFile(image, cf)
+}
+
+// convertForeignMediaType returns the media type of a foreign layer in an
+// OCI or Docker image
+func convertForeignMediaType(mt types.MediaType, oci bool) types.MediaType {
+	if oci == (extractMediaTypeVendor(mt) == types.OCIVendorPrefix) {
+		return mt
+	}
+	return convertMediaType(mt)
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func tarLayer(t *testing.T, files map[string]string) v1.Layer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layer
+}
+
+func Test_transcode(t *testing.T) {
+	src, err := mutate.AppendLayers(empty.Image,
+		tarLayer(t, map[string]string{"etc/app.conf": "a", "etc/old.conf": "b"}),
+		tarLayer(t, map[string]string{"etc/.wh.old.conf": ""}),
+	)
+	testutil.CheckNoError(t, err)
+	cf, err := src.ConfigFile()
+	testutil.CheckNoError(t, err)
+	cf.Config.Entrypoint = []string{"/app"}
+	src, err = mutate.ConfigFile(src, cf)
+	testutil.CheckNoError(t, err)
+
+	tests := []struct {
+		name          string
+		opts          *config.KanikoOptions
+		wantManifest  types.MediaType
+		wantLayerType types.MediaType
+	}{
+		{
+			name:          "gzip",
+			opts:          &config.KanikoOptions{Compression: config.GZip, CompressionLevel: 9},
+			wantManifest:  types.DockerManifestSchema2,
+			wantLayerType: types.DockerLayer,
+		},
+		{
+			name:          "zstd converts to OCI",
+			opts:          &config.KanikoOptions{Compression: config.ZStd},
+			wantManifest:  types.OCIManifestSchema1,
+			wantLayerType: types.OCILayerZStd,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image, err := transcode(src, tt.opts)
+			testutil.CheckNoError(t, err)
+
+			mt, err := image.MediaType()
+			testutil.CheckErrorAndDeepEqual(t, false, err, tt.wantManifest, mt)
+			got, err := image.ConfigFile()
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, cf.Config.Entrypoint, got.Config.Entrypoint)
+			testutil.CheckDeepEqual(t, cf.RootFS.DiffIDs, got.RootFS.DiffIDs)
+
+			layers, err := image.Layers()
+			testutil.CheckNoError(t, err)
+			for _, layer := range layers {
+				lmt, err := layer.MediaType()
+				testutil.CheckErrorAndDeepEqual(t, false, err, tt.wantLayerType, lmt)
+			}
+			// The whiteout is carried over
+			rc, err := layers[1].Uncompressed()
+			testutil.CheckNoError(t, err)
+			defer rc.Close()
+			hdr, err := tar.NewReader(rc).Next()
+			testutil.CheckErrorAndDeepEqual(t, false, err, "etc/.wh.old.conf", hdr.Name)
+		})
+	}
+}
@@ -34,7 +34,7 @@ import (
 // * If path is a symlink, resolve it's target. If the target is not ignored add it to the
 // output set.
 // * Add all ancestors of each path to the output set.
-func ResolvePaths(paths []string, wl []util.IgnoreListEntry) (pathsToAdd []string, err error) {
+func ResolvePaths(paths []string, wl []util.IgnoreListEntry, root string) (pathsToAdd []string, err error) {
 	logrus.Tracef("Resolving paths %s", paths)
 
 	fileSet := make(map[string]bool)
@@ -92,20 +92,20 @@ func ResolvePaths(paths []string, wl []util.IgnoreListEntry) (pathsToAdd []strin
 	}
 
 	// Also add parent directories to keep the permission of them correctly.
-	pathsToAdd = filesWithParentDirs(pathsToAdd)
+	pathsToAdd = filesWithParentDirs(pathsToAdd, root)
 	return
 }
 
-// filesWithParentDirs returns every ancestor path for each provided file path.
+// filesWithParentDirs returns every ancestor path up to root for each provided file path.
 // I.E. /foo/bar/baz/boom.txt => [/, /foo, /foo/bar, /foo/bar/baz, /foo/bar/baz/boom.txt]
-func filesWithParentDirs(files []string) []string {
+func filesWithParentDirs(files []string, root string) []string {
 	filesSet := map[string]bool{}
 
 	for _, file := range files {
 		file = filepath.Clean(file)
 		filesSet[file] = true
 
-		for _, dir := range util.ParentDirectories(file) {
+		for _, dir := range util.ParentDirectories(file, root) {
 			dir = filepath.Clean(dir)
 			filesSet[dir] = true
 		}
@@ -94,9 +94,9 @@ func Test_ResolvePaths(t *testing.T) {
 					expectedFiles = append(expectedFiles, target)
 				}
 
-				expectedFiles = filesWithParentDirs(expectedFiles)
+				expectedFiles = filesWithParentDirs(expectedFiles, "/")
 
-				files, err := ResolvePaths(inputFiles, wl)
+				files, err := ResolvePaths(inputFiles, wl, "/")
 
 				validateResults(t, files, expectedFiles, err)
 			})
@@ -158,9 +158,9 @@ func Test_ResolvePaths(t *testing.T) {
 				targetFile := filepath.Join(target, "meow.txt")
 				expectedFiles = append(expectedFiles, targetFile)
 
-				expectedFiles = filesWithParentDirs(expectedFiles)
+				expectedFiles = filesWithParentDirs(expectedFiles, "/")
 
-				files, err := ResolvePaths(inputFiles, wl)
+				files, err := ResolvePaths(inputFiles, wl, "/")
 
 				validateResults(t, files, expectedFiles, err)
 			})
@@ -173,7 +173,7 @@ func Test_ResolvePaths(t *testing.T) {
 
 		wl := []util.IgnoreListEntry{}
 
-		files, err := ResolvePaths(inputFiles, wl)
+		files, err := ResolvePaths(inputFiles, wl, "/")
 
 		validateResults(t, files, expectedFiles, err)
 	})
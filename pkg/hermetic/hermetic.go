@@ -0,0 +1,392 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package hermetic records the network destinations the commands of RUN
+// instructions connect to, and reports the ones outside of an
+// allowlist. The sockets of the commands are sampled from /proc while they
+// run, so connections shorter than the sampling interval may be missed: the
+// destinations are only ever reported, never enforced.
+package hermetic
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// None does not record the network destinations of the commands
+	None = "none"
+	// Report logs the destinations outside of the allowlist
+	Report = "report"
+
+	// enforce is rejected, as the sampling of the sockets cannot guarantee
+	// that no destination is missed
+	enforce = "enforce"
+
+	// tcpListen is the state of the listening TCP sockets in /proc/net/tcp
+	tcpListen = "0A"
+)
+
+// for testing
+var (
+	procDir          = "/proc"
+	samplingInterval = 50 * time.Millisecond
+)
+
+var (
+	mode      = None
+	allowlist []allowed
+	// recording is set to record the destinations even if they are not
+	// checked
+	recording bool
+)
+
+// allowed is an entry of the allowlist, a network with an optional port
+type allowed struct {
+	network *net.IPNet
+	port    int
+}
+
+// Destination is a network destination a command connected to
+type Destination struct {
+	Protocol string
+	IP       net.IP
+	Port     int
+}
+
+func (d Destination) String() string {
+	return fmt.Sprintf("%s/%s", net.JoinHostPort(d.IP.String(), strconv.Itoa(d.Port)), d.Protocol)
+}
+
+// SetMode sets whether the network destinations of the commands are recorded,
+// and the destinations they may connect to: IP addresses, CIDR networks or
+// host names, resolved once, each optionally followed by :port.
+func SetMode(m string, allow []string) error {
+	switch m {
+	case None, Report:
+	case enforce:
+		return fmt.Errorf("hermetic check %s is not supported: the sockets of the commands are sampled and short connections may be missed, use %s and run the commands without network to prevent them from connecting", enforce, Report)
+	default:
+		return fmt.Errorf("invalid hermetic check %q, must be %s or %s", m, None, Report)
+	}
+	entries, err := parseAllowlist(allow)
+	if err != nil {
+		return err
+	}
+	mode = m
+	allowlist = entries
+	return nil
+}
+
+func parseAllowlist(allow []string) ([]allowed, error) {
+	var entries []allowed
+	for _, a := range allow {
+		host, port := a, 0
+		if h, p, err := net.SplitHostPort(a); err == nil {
+			if port, err = strconv.Atoi(p); err != nil {
+				return nil, errors.Wrapf(err, "parsing the port of %s", a)
+			}
+			host = h
+		}
+		if _, n, err := net.ParseCIDR(host); err == nil {
+			entries = append(entries, allowed{network: n, port: port})
+			continue
+		}
+		ips := []net.IP{net.ParseIP(host)}
+		if ips[0] == nil {
+			var err error
+			if ips, err = net.LookupIP(host); err != nil {
+				return nil, errors.Wrapf(err, "resolving %s", host)
+			}
+		}
+		for _, ip := range ips {
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			entries = append(entries, allowed{network: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, port: port})
+		}
+	}
+	return entries, nil
+}
+
+// Record records the network destinations of the commands whether or not they
+// are checked, for them to be returned by Destinations.
+func Record() {
+	recording = true
+}
+
+// isAllowed returns true if d is in the allowlist, or on the loopback interface
+func isAllowed(d Destination) bool {
+	if d.IP.IsLoopback() {
+		return true
+	}
+	for _, a := range allowlist {
+		if a.network.Contains(d.IP) && (a.port == 0 || a.port == d.Port) {
+			return true
+		}
+	}
+	return false
+}
+
+// Monitor records the destinations of the processes of a process group and of
+// their descendants
+type Monitor struct {
+	pgid int
+	stop chan struct{}
+	done chan struct{}
+
+	mu           sync.Mutex
+	destinations map[string]Destination
+}
+
+// Watch starts recording the destinations of the process group pgid and of
+// the descendants of its leader, or returns nil if they are not recorded.
+func Watch(pgid int) *Monitor {
+	if mode == None && !recording {
+		return nil
+	}
+	m := &Monitor{
+		pgid:         pgid,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+		destinations: map[string]Destination{},
+	}
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(samplingInterval)
+		defer ticker.Stop()
+		for {
+			m.sample()
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return m
+}
+
+// Check stops recording the destinations and logs the ones of the command
+// outside of the allowlist. The error is kept for the callers, and always nil
+// since the destinations sampled cannot be enforced.
+func (m *Monitor) Check(command string) error {
+	if m == nil {
+		return nil
+	}
+	close(m.stop)
+	<-m.done
+	if mode == None {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var denied []string
+	for k, d := range m.destinations {
+		if isAllowed(d) {
+			logrus.Debugf("%s connected to %s", command, d)
+			continue
+		}
+		denied = append(denied, k)
+	}
+	if len(denied) == 0 {
+		return nil
+	}
+	sort.Strings(denied)
+	logrus.Warnf("%s connected to destinations outside of the hermetic allowlist: %s", command, strings.Join(denied, ", "))
+	return nil
+}
+
+// Destinations returns the destinations recorded, sorted, once stopped by
+// Check.
+func (m *Monitor) Destinations() []string {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	destinations := make([]string, 0, len(m.destinations))
+	for k := range m.destinations {
+		destinations = append(destinations, k)
+	}
+	sort.Strings(destinations)
+	return destinations
+}
+
+// sample records the destinations of the sockets the processes of the group
+// and their descendants hold open.
+func (m *Monitor) sample() {
+	pids, err := groupProcesses(m.pgid)
+	if err != nil {
+		logrus.Debugf("Unable to list the processes of group %d: %v", m.pgid, err)
+		return
+	}
+	for _, pid := range pids {
+		inodes := socketInodes(pid)
+		if len(inodes) == 0 {
+			continue
+		}
+		for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+			f, err := os.Open(filepath.Join(procDir, strconv.Itoa(pid), "net", proto))
+			if err != nil {
+				continue
+			}
+			destinations, err := parseProcNet(f, strings.TrimSuffix(proto, "6"), inodes)
+			f.Close()
+			if err != nil {
+				logrus.Debugf("Unable to parse the %s sockets of %d: %v", proto, pid, err)
+				continue
+			}
+			m.mu.Lock()
+			for _, d := range destinations {
+				m.destinations[d.String()] = d
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// groupProcesses returns the processes of the process group pgid, and the
+// descendants of its leader which left it, e.g. with setsid
+func groupProcesses(pgid int) ([]int, error) {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return nil, err
+	}
+	type process struct {
+		ppid, pgrp int
+	}
+	processes := map[int]process{}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(procDir, e.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// The command name is enclosed in parentheses and may contain spaces,
+		// the parent and the process group are the second and the third
+		// fields after it
+		i := strings.LastIndexByte(string(b), ')')
+		fields := strings.Fields(string(b[i+1:]))
+		if len(fields) < 3 {
+			continue
+		}
+		ppid, _ := strconv.Atoi(fields[1])
+		pgrp, _ := strconv.Atoi(fields[2])
+		processes[pid] = process{ppid: ppid, pgrp: pgrp}
+	}
+	var pids []int
+	for pid := range processes {
+		// The leader of the group is the process whose pid is pgid
+		for ancestor, depth := pid, 0; ancestor > 1 && depth < len(processes); depth++ {
+			if ancestor == pgid || processes[ancestor].pgrp == pgid {
+				pids = append(pids, pid)
+				break
+			}
+			ancestor = processes[ancestor].ppid
+		}
+	}
+	sort.Ints(pids)
+	return pids, nil
+}
+
+// socketInodes returns the inodes of the sockets the process pid holds open
+func socketInodes(pid int) map[string]bool {
+	fdDir := filepath.Join(procDir, strconv.Itoa(pid), "fd")
+	entries, err := os.ReadDir(fdDir)
+	if err != nil {
+		return nil
+	}
+	inodes := map[string]bool{}
+	for _, e := range entries {
+		target, err := os.Readlink(filepath.Join(fdDir, e.Name()))
+		if err != nil {
+			continue
+		}
+		if inode, ok := strings.CutPrefix(target, "socket:["); ok {
+			inodes[strings.TrimSuffix(inode, "]")] = true
+		}
+	}
+	return inodes
+}
+
+// parseProcNet returns the remote addresses of the connected sockets listed
+// in a /proc/net/{tcp,udp}[6] table whose inodes are in inodes.
+func parseProcNet(r io.Reader, protocol string, inodes map[string]bool) ([]Destination, error) {
+	var destinations []Destination
+	s := bufio.NewScanner(r)
+	// Skip the header
+	s.Scan()
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 || !inodes[fields[9]] || (protocol == "tcp" && fields[3] == tcpListen) {
+			continue
+		}
+		ip, port, err := parseHexAddress(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		if ip.IsUnspecified() {
+			continue
+		}
+		destinations = append(destinations, Destination{Protocol: protocol, IP: ip, Port: port})
+	}
+	return destinations, s.Err()
+}
+
+// parseHexAddress parses an address of the /proc/net tables, an IP address
+// made of 32 bit words in host byte order, and a port, in hexadecimal.
+func parseHexAddress(s string) (net.IP, int, error) {
+	host, port, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("invalid address %s", s)
+	}
+	b, err := hex.DecodeString(host)
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid address %s", s)
+	}
+	for i := 0; i < len(b); i += 4 {
+		binary.BigEndian.PutUint32(b[i:], binary.NativeEndian.Uint32(b[i:]))
+	}
+	p, err := strconv.ParseUint(port, 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid address %s", s)
+	}
+	ip := net.IP(b)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return ip, int(p), nil
+}
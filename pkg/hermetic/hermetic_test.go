@@ -0,0 +1,143 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package hermetic
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+const procNetTCP = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1001 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:9C40 22D8B85D:01BB 01 00000000:00000000 00:00000000 00000000     0        0 1002 1 0000000000000000 20 4 30 10 -1
+   2: 0100007F:9C41 0100007F:1F90 01 00000000:00000000 00:00000000 00000000     0        0 1003 1 0000000000000000 20 4 30 10 -1
+`
+
+func TestParseProcNet(t *testing.T) {
+	got, err := parseProcNet(strings.NewReader(procNetTCP), "tcp", map[string]bool{"1001": true, "1002": true})
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, 1, len(got))
+	testutil.CheckDeepEqual(t, "93.184.216.34:443/tcp", got[0].String())
+
+	ip, port, err := parseHexAddress("0000000000000000FFFF00000100007F:0050")
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, "127.0.0.1", ip.String())
+	testutil.CheckDeepEqual(t, 80, port)
+}
+
+func TestSetMode(t *testing.T) {
+	defer SetMode(None, nil)
+	testutil.CheckError(t, true, SetMode("strict", nil))
+	testutil.CheckError(t, true, SetMode(Report, []string{"10.0.0.1:http"}))
+	// The sampled destinations cannot be enforced
+	testutil.CheckError(t, true, SetMode("enforce", nil))
+	testutil.CheckNoError(t, SetMode(Report, []string{"10.0.0.0/8", "192.0.2.1:443", "2001:db8::1"}))
+	testutil.CheckDeepEqual(t, Report, mode)
+
+	for _, tt := range []struct {
+		destination Destination
+		want        bool
+	}{
+		{Destination{IP: net.ParseIP("10.1.2.3"), Port: 22}, true},
+		{Destination{IP: net.ParseIP("192.0.2.1").To4(), Port: 443}, true},
+		{Destination{IP: net.ParseIP("192.0.2.1").To4(), Port: 80}, false},
+		{Destination{IP: net.ParseIP("2001:db8::1"), Port: 80}, true},
+		{Destination{IP: net.ParseIP("127.0.0.1"), Port: 80}, true},
+		{Destination{IP: net.ParseIP("93.184.216.34"), Port: 443}, false},
+	} {
+		testutil.CheckDeepEqual(t, tt.want, isAllowed(tt.destination))
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	defer SetMode(None, nil)
+	if Watch(syscall.Getpgrp()) != nil {
+		t.Fatal("expected no monitor without hermetic check")
+	}
+	original := samplingInterval
+	samplingInterval = time.Millisecond
+	defer func() { samplingInterval = original }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	testutil.CheckNoError(t, SetMode(Report, nil))
+	m := Watch(syscall.Getpgrp())
+	time.Sleep(20 * time.Millisecond)
+	// Connections on the loopback interface are allowed
+	testutil.CheckNoError(t, m.Check("RUN curl"))
+	if _, ok := m.destinations[l.Addr().String()+"/tcp"]; !ok {
+		t.Skipf("sockets not listed in /proc, got %v", m.destinations)
+	}
+
+	m = &Monitor{
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+		destinations: map[string]Destination{"93.184.216.34:443/tcp": {Protocol: "tcp", IP: net.ParseIP("93.184.216.34"), Port: 443}},
+	}
+	close(m.done)
+	testutil.CheckNoError(t, m.Check("RUN curl"))
+	testutil.CheckDeepEqual(t, []string{"93.184.216.34:443/tcp"}, m.Destinations())
+}
+
+func TestGroupProcesses(t *testing.T) {
+	original := procDir
+	procDir = t.TempDir()
+	defer func() { procDir = original }()
+
+	// pid: ppid, pgrp
+	for pid, stat := range map[int][2]int{
+		1:  {0, 1},
+		10: {1, 10},
+		11: {10, 10},
+		// Left the group with setsid
+		12: {11, 12},
+		13: {12, 12},
+		20: {1, 20},
+		// Reparented to init, but still in the group
+		21: {1, 10},
+	} {
+		dir := filepath.Join(procDir, strconv.Itoa(pid))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		content := fmt.Sprintf("%d (sh -c) S %d %d %d 0 -1", pid, stat[0], stat[1], stat[1])
+		if err := os.WriteFile(filepath.Join(dir, "stat"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pids, err := groupProcesses(10)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, []int{10, 11, 12, 13, 21}, pids)
+}
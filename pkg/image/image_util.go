@@ -58,6 +58,15 @@ func RetrieveSourceImage(stage config.KanikoStage, opts *config.KanikoOptions) (
 	if err != nil {
 		return nil, err
 	}
+	// FROM --platform overrides the platform of the base image of the stage,
+	// e.g. to run a builder stage natively with --platform=$BUILDPLATFORM
+	platform := opts.CustomPlatform
+	if stage.Platform != "" {
+		if platform, err = util.ResolveEnvironmentReplacement(stage.Platform, buildArgs, false); err != nil {
+			return nil, err
+		}
+		logrus.Infof("Retrieving base image %s for platform %s", currentBaseName, platform)
+	}
 	// First, check if the base image is a scratch image
 	if currentBaseName == constants.NoBaseImage {
 		logrus.Info("No base image, nothing to extract")
@@ -72,7 +81,7 @@ func RetrieveSourceImage(stage config.KanikoStage, opts *config.KanikoOptions) (
 	// Finally, check if local caching is enabled
 	// If so, look in the local cache before trying the remote registry
 	if opts.Cache && opts.CacheDir != "" {
-		cachedImage, err := cachedImage(opts, currentBaseName)
+		cachedImage, err := cachedImage(opts, currentBaseName, platform)
 		if err != nil {
 			switch {
 			case cache.IsNotFound(err):
@@ -87,8 +96,22 @@ func RetrieveSourceImage(stage config.KanikoStage, opts *config.KanikoOptions) (
 		}
 	}
 
+	// Populate the local cache with the image, for the next builds to find it
+	if opts.Cache && opts.CacheDir != "" && opts.CacheDirWrite {
+		img, err := cache.WarmImage(&config.WarmerOptions{
+			CacheOptions:    opts.CacheOptions,
+			RegistryOptions: opts.RegistryOptions,
+			CustomPlatform:  platform,
+			Force:           true,
+		}, currentBaseName)
+		if err == nil {
+			return img, nil
+		}
+		logrus.Warnf("Unable to write %s to the local cache: %v", currentBaseName, err)
+	}
+
 	// Otherwise, initialize image as usual
-	return RetrieveRemoteImage(currentBaseName, opts.RegistryOptions, opts.CustomPlatform)
+	return RetrieveRemoteImage(currentBaseName, opts.RegistryOptions, platform)
 }
 
 func tarballImage(index int) (v1.Image, error) {
@@ -97,7 +120,7 @@ func tarballImage(index int) (v1.Image, error) {
 	return tarball.ImageFromPath(tarPath, nil)
 }
 
-func cachedImage(opts *config.KanikoOptions, image string) (v1.Image, error) {
+func cachedImage(opts *config.KanikoOptions, image, platform string) (v1.Image, error) {
 	ref, err := name.ParseReference(image, name.WeakValidation)
 	if err != nil {
 		return nil, err
@@ -107,7 +130,7 @@ func cachedImage(opts *config.KanikoOptions, image string) (v1.Image, error) {
 	if d, ok := ref.(name.Digest); ok {
 		cacheKey = d.DigestStr()
 	} else {
-		image, err := remote.RetrieveRemoteImage(image, opts.RegistryOptions, opts.CustomPlatform)
+		image, err := remote.RetrieveRemoteImage(image, opts.RegistryOptions, platform)
 		if err != nil {
 			return nil, err
 		}
@@ -63,6 +63,35 @@ func Test_StandardImage(t *testing.T) {
 	testutil.CheckErrorAndDeepEqual(t, false, err, nil, actual)
 }
 
+func Test_StagePlatform(t *testing.T) {
+	stages, err := parse(`
+	FROM --platform=$BUILDPLATFORM golang AS builder
+	FROM gcr.io/distroless/base`)
+	if err != nil {
+		t.Error(err)
+	}
+	original := RetrieveRemoteImage
+	defer func() {
+		RetrieveRemoteImage = original
+	}()
+	var platforms []string
+	RetrieveRemoteImage = func(image string, opts config.RegistryOptions, platform string) (v1.Image, error) {
+		platforms = append(platforms, platform)
+		return nil, nil
+	}
+	opts := &config.KanikoOptions{CustomPlatform: "linux/arm64"}
+	metaArgs := []instructions.ArgCommand{{Args: []instructions.KeyValuePairOptional{{Key: "BUILDPLATFORM", Value: ptr("linux/amd64")}}}}
+	for _, stage := range stages {
+		_, err := RetrieveSourceImage(config.KanikoStage{Stage: stage, MetaArgs: metaArgs}, opts)
+		testutil.CheckNoError(t, err)
+	}
+	testutil.CheckDeepEqual(t, []string{"linux/amd64", "linux/arm64"}, platforms)
+}
+
+func ptr(s string) *string {
+	return &s
+}
+
 func Test_ScratchImage(t *testing.T) {
 	stages, err := parse(dockerfile)
 	if err != nil {
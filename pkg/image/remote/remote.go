@@ -19,6 +19,7 @@ package remote
 import (
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/chainguard-dev/kaniko/pkg/config"
 	"github.com/chainguard-dev/kaniko/pkg/creds"
@@ -32,15 +33,41 @@ import (
 )
 
 var (
-	manifestCache   = make(map[string]v1.Image)
+	// manifestCache holds the images retrieved with the default keychain.
+	// The images retrieved with the keychain of a build are not cached, for
+	// another build not to use them without its credentials.
+	manifestCache = struct {
+		sync.Mutex
+		images map[string]v1.Image
+	}{images: make(map[string]v1.Image)}
 	remoteImageFunc = remote.Image
 )
 
+// cachedImage returns the image cached for the reference image, if any
+func cachedImage(image string, opts config.RegistryOptions) v1.Image {
+	if opts.Keychain != nil {
+		return nil
+	}
+	manifestCache.Lock()
+	defer manifestCache.Unlock()
+	return manifestCache.images[image]
+}
+
+// cacheImage caches the image retrieved for the reference image
+func cacheImage(image string, opts config.RegistryOptions, img v1.Image) {
+	if opts.Keychain != nil {
+		return
+	}
+	manifestCache.Lock()
+	defer manifestCache.Unlock()
+	manifestCache.images[image] = img
+}
+
 // RetrieveRemoteImage retrieves the manifest for the specified image from the specified registry
 func RetrieveRemoteImage(image string, opts config.RegistryOptions, customPlatform string) (v1.Image, error) {
 	logrus.Infof("Retrieving image manifest %s", image)
 
-	cachedRemoteImage := manifestCache[image]
+	cachedRemoteImage := cachedImage(image, opts)
 	if cachedRemoteImage != nil {
 		logrus.Infof("Returning cached image manifest")
 		return cachedRemoteImage, nil
@@ -76,7 +103,7 @@ func RetrieveRemoteImage(image string, opts config.RegistryOptions, customPlatfo
 				continue
 			}
 
-			manifestCache[image] = remoteImage
+			cacheImage(image, opts, remoteImage)
 
 			return remoteImage, nil
 		}
@@ -103,7 +130,7 @@ func RetrieveRemoteImage(image string, opts config.RegistryOptions, customPlatfo
 
 	var remoteImage v1.Image
 	if remoteImage, err = util.RetryWithResult(retryFunc, opts.ImageDownloadRetry, 1000); remoteImage != nil {
-		manifestCache[image] = remoteImage
+		cacheImage(image, opts, remoteImage)
 	}
 
 	return remoteImage, err
@@ -159,7 +186,7 @@ func remoteOptions(registryName string, opts config.RegistryOptions, customPlatf
 		logrus.Fatalf("Invalid platform %q: %v", customPlatform, err)
 	}
 
-	return []remote.Option{remote.WithTransport(tr), remote.WithAuthFromKeychain(creds.GetKeychain()), remote.WithPlatform(*platform)}
+	return []remote.Option{remote.WithTransport(tr), remote.WithAuthFromKeychain(creds.Keychain(&opts)), remote.WithPlatform(*platform)}
 }
 
 // Parse the registry mapping
@@ -21,6 +21,7 @@ import (
 	"testing"
 
 	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
@@ -180,11 +181,16 @@ func Test_RetrieveRemoteImage_manifestCache(t *testing.T) {
 		t.Fatal("Expected call to fail because there is no manifest for this image.")
 	}
 
-	manifestCache[nonExistingImageName] = &mockImage{}
+	manifestCache.images[nonExistingImageName] = &mockImage{}
 
 	if image, err := RetrieveRemoteImage(nonExistingImageName, config.RegistryOptions{}, ""); image == nil || err != nil {
 		t.Fatal("Expected call to succeed because there is a manifest for this image in the cache.")
 	}
+
+	// The builds with a keychain of their own do not share the cached images
+	if _, err := RetrieveRemoteImage(nonExistingImageName, config.RegistryOptions{Keychain: authn.NewMultiKeychain()}, ""); err == nil {
+		t.Fatal("Expected call to fail because the cache is not used with the keychain of a build.")
+	}
 }
 
 func Test_RetrieveRemoteImage_skipFallback(t *testing.T) {
@@ -209,7 +215,7 @@ func Test_RetrieveRemoteImage_skipFallback(t *testing.T) {
 
 	opts.SkipDefaultRegistryFallback = true
 	//clean cached image
-	manifestCache = make(map[string]v1.Image)
+	manifestCache.images = make(map[string]v1.Image)
 
 	if _, err := RetrieveRemoteImage(image, opts, ""); err == nil {
 		t.Fatal("Expected call to fail because fallback to default registry is skipped")
@@ -230,7 +236,7 @@ func Test_RetryRetrieveRemoteImageSucceeds(t *testing.T) {
 	}
 
 	// Clean cached image
-	manifestCache = make(map[string]v1.Image)
+	manifestCache.images = make(map[string]v1.Image)
 
 	if _, err := RetrieveRemoteImage(image, opts, ""); err != nil {
 		t.Fatal("Expected call to succeed because of retry")
@@ -251,7 +257,7 @@ func Test_NoRetryRetrieveRemoteImageFails(t *testing.T) {
 	}
 
 	// Clean cached image
-	manifestCache = make(map[string]v1.Image)
+	manifestCache.images = make(map[string]v1.Image)
 
 	if _, err := RetrieveRemoteImage(image, opts, ""); err == nil {
 		t.Fatal("Expected call to fail because there is no retry")
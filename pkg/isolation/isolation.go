@@ -0,0 +1,319 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package isolation runs the commands of RUN instructions in a mount namespace
+// of their own, pivoted into a view of the root filesystem in which the
+// directories managed by kaniko are hidden, and in a network namespace of their
+// own when they are not given network access.
+package isolation
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// None runs the commands directly in the root filesystem
+	None = "none"
+	// PivotRoot runs the commands in a mount namespace pivoted into a view of
+	// the root filesystem without the kaniko directory
+	PivotRoot = "pivot-root"
+
+	// NetworkDefault runs the commands with the network set by
+	// SetDefaultNetwork
+	NetworkDefault = "default"
+	// NetworkHost runs the commands with the network of kaniko
+	NetworkHost = "host"
+	// NetworkNone runs the commands in a network namespace of their own, in
+	// which only the loopback interface is up
+	NetworkNone = "none"
+
+	// childArg0 is the name the executor is re-executed with to set up the
+	// mount namespace of a command
+	childArg0 = "kaniko-isolated-run"
+	// setupFailedCode is the exit code of the child when it fails to set up
+	// the mount namespace
+	setupFailedCode = 125
+)
+
+// mode is the isolation of the commands, set by SetMode
+var mode = None
+
+// initialized is set by Init, the program then being known to set up the
+// namespaces of the commands when re-executed by Command
+var initialized bool
+
+// ErrNotInitialized is returned when a command must be isolated, which
+// re-executes the running program, and the program did not call Init
+var ErrNotInitialized = errors.New("isolating RUN commands re-executes the program, which must call isolation.Init at the start of its main function")
+
+// defaultNetwork is the network of the commands not given one, set by
+// SetDefaultNetwork
+var defaultNetwork = NetworkHost
+
+// childConfig is the command run by the child, and the mount namespace to set
+// up for it
+type childConfig struct {
+	Path       string
+	Args       []string
+	Dir        string
+	Credential *syscall.Credential
+	Root       string
+	Hidden     []string
+	NoNetwork  bool
+	Probe      bool
+}
+
+// Init sets up the namespaces of a command and executes it, never returning,
+// when the program was re-executed for it by Command. Commands are isolated by
+// re-executing the running program, so the programs embedding kaniko must call
+// Init first thing in their main function to run RUN commands with the
+// pivot-root isolation or without network.
+func Init() {
+	if IsChild() {
+		RunChild()
+	}
+	initialized = true
+}
+
+// CheckInit returns ErrNotInitialized if the commands run with the isolation
+// mode m, or with the network n by default, are re-executed and the program
+// did not call Init.
+func CheckInit(m, n string) error {
+	if (m == PivotRoot || n == NetworkNone) && !initialized {
+		return ErrNotInitialized
+	}
+	return nil
+}
+
+// SetMode sets the isolation of the commands run by RUN. The pivot-root mode
+// requires the permission to create mount namespaces, and kaniko falls back to
+// running the commands without isolation otherwise.
+func SetMode(m string) error {
+	switch m {
+	case None:
+		mode = None
+		return nil
+	case PivotRoot:
+	default:
+		return fmt.Errorf("invalid run isolation %q, must be %s or %s", m, None, PivotRoot)
+	}
+	if !initialized {
+		return ErrNotInitialized
+	}
+	if err := os.MkdirAll(rootDir(), 0o755); err != nil {
+		return errors.Wrap(err, "creating isolated root directory")
+	}
+	probe := wrap(&exec.Cmd{}, childConfig{Root: rootDir(), Hidden: hidden(), Probe: true})
+	probe.Stderr = os.Stderr
+	if err := probe.Run(); err != nil {
+		logrus.Warnf("Unable to isolate RUN commands with %s, running them without isolation: %v", PivotRoot, err)
+		mode = None
+		return nil
+	}
+	mode = PivotRoot
+	return nil
+}
+
+// SetDefaultNetwork sets the network of the commands run by RUN instructions
+// without a --network flag, or with --network=default.
+func SetDefaultNetwork(n string) error {
+	switch n {
+	case NetworkHost, NetworkNone:
+		defaultNetwork = n
+		return nil
+	}
+	return fmt.Errorf("invalid default run network %q, must be %s or %s", n, NetworkHost, NetworkNone)
+}
+
+// rootDir is the mount point of the view of the root filesystem that the
+// commands are pivoted into. It is inside the kaniko directory, so it is
+// hidden from the commands as well.
+func rootDir() string {
+	return filepath.Join(config.KanikoDir, "isolated-root")
+}
+
+// hidden are the directories hidden from the commands
+func hidden() []string {
+	return append([]string{config.KanikoDir}, config.WorkDirs()...)
+}
+
+// Command returns the command running cmd according to the isolation mode,
+// with the network of the RUN instruction. Running it without network
+// requires the permission to create network namespaces, and that the program
+// called Init.
+func Command(cmd *exec.Cmd, network string) (*exec.Cmd, error) {
+	if network == NetworkDefault || network == "" {
+		network = defaultNetwork
+	}
+	if mode != PivotRoot && network != NetworkNone {
+		return cmd, nil
+	}
+	if !initialized {
+		return nil, ErrNotInitialized
+	}
+	c := childConfig{Path: cmd.Path, Args: cmd.Args, Dir: cmd.Dir, NoNetwork: network == NetworkNone}
+	if mode == PivotRoot {
+		c.Root, c.Hidden = rootDir(), hidden()
+	}
+	if cmd.SysProcAttr != nil {
+		c.Credential = cmd.SysProcAttr.Credential
+	}
+	return wrap(cmd, c), nil
+}
+
+// wrap returns a command re-executing kaniko as the child setting up the
+// namespaces of cmd before executing it.
+func wrap(cmd *exec.Cmd, c childConfig) *exec.Cmd {
+	b, _ := json.Marshal(c)
+
+	child := exec.Command("/proc/self/exe", string(b))
+	child.Args[0] = childArg0
+	child.Env = cmd.Env
+	child.Stdin, child.Stdout, child.Stderr = cmd.Stdin, cmd.Stdout, cmd.Stderr
+	attr := syscall.SysProcAttr{}
+	if cmd.SysProcAttr != nil {
+		attr = *cmd.SysProcAttr
+	}
+	// The child switches to the credentials of the command only once the
+	// mount namespace is set up, which requires privileges
+	attr.Credential = nil
+	attr.Cloneflags |= syscall.CLONE_NEWNS
+	if c.NoNetwork {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	child.SysProcAttr = &attr
+	return child
+}
+
+// IsChild returns true if the executor was re-executed to set up the
+// namespaces of a command.
+func IsChild() bool {
+	return len(os.Args) == 2 && os.Args[0] == childArg0
+}
+
+// RunChild sets up the namespaces of the command passed by the parent and
+// executes it. It never returns.
+func RunChild() {
+	var c childConfig
+	if err := json.Unmarshal([]byte(os.Args[1]), &c); err != nil {
+		fmt.Fprintf(os.Stderr, "kaniko: invalid isolated command: %v\n", err)
+		os.Exit(setupFailedCode)
+	}
+	if c.Root != "" {
+		if err := pivot(c); err != nil {
+			fmt.Fprintf(os.Stderr, "kaniko: isolating command: %v\n", err)
+			os.Exit(setupFailedCode)
+		}
+	}
+	if c.NoNetwork {
+		if err := setLoopbackUp(); err != nil {
+			fmt.Fprintf(os.Stderr, "kaniko: setting up loopback interface: %v\n", err)
+			os.Exit(setupFailedCode)
+		}
+	}
+	if c.Probe {
+		os.Exit(0)
+	}
+	if err := setCredential(c.Credential); err != nil {
+		fmt.Fprintf(os.Stderr, "kaniko: setting credentials: %v\n", err)
+		os.Exit(setupFailedCode)
+	}
+	if c.Dir != "" {
+		if err := os.Chdir(c.Dir); err != nil {
+			fmt.Fprintf(os.Stderr, "kaniko: changing directory to %s: %v\n", c.Dir, err)
+			os.Exit(setupFailedCode)
+		}
+	}
+	err := syscall.Exec(c.Path, c.Args, os.Environ())
+	fmt.Fprintf(os.Stderr, "kaniko: executing %s: %v\n", c.Path, err)
+	os.Exit(setupFailedCode)
+}
+
+// pivot makes the root filesystem of the mount namespace a view of the
+// current one in which the hidden directories are empty and read-only.
+func pivot(c childConfig) error {
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return errors.Wrap(err, "making mounts private")
+	}
+	if err := unix.Mount("/", c.Root, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return errors.Wrapf(err, "binding / to %s", c.Root)
+	}
+	for _, h := range c.Hidden {
+		if err := unix.Mount("tmpfs", filepath.Join(c.Root, h), "tmpfs", unix.MS_RDONLY|unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, "mode=755"); err != nil {
+			return errors.Wrapf(err, "hiding %s", h)
+		}
+	}
+	if err := os.Chdir(c.Root); err != nil {
+		return err
+	}
+	// Stack the old root on top of the new one, then detach it
+	if err := unix.PivotRoot(".", "."); err != nil {
+		return errors.Wrap(err, "pivoting root")
+	}
+	if err := unix.Unmount(".", unix.MNT_DETACH); err != nil {
+		return errors.Wrap(err, "detaching old root")
+	}
+	return os.Chdir("/")
+}
+
+// setLoopbackUp brings up the loopback interface of the network namespace,
+// which is down when the namespace is created, for the commands to reach the
+// services they start on localhost.
+func setLoopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	ifr, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return err
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr)
+}
+
+func setCredential(cred *syscall.Credential) error {
+	if cred == nil {
+		return nil
+	}
+	if !cred.NoSetGroups {
+		groups := make([]int, len(cred.Groups))
+		for i, g := range cred.Groups {
+			groups[i] = int(g)
+		}
+		if err := syscall.Setgroups(groups); err != nil {
+			return err
+		}
+	}
+	if err := syscall.Setgid(int(cred.Gid)); err != nil {
+		return err
+	}
+	return syscall.Setuid(int(cred.Uid))
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package isolation
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestMain(m *testing.M) {
+	Init()
+	os.Exit(m.Run())
+}
+
+func TestSetMode(t *testing.T) {
+	defer func() { mode = None }()
+	testutil.CheckError(t, true, SetMode("chroot"))
+	testutil.CheckNoError(t, SetMode(None))
+	cmd := exec.Command("true")
+	if c, err := Command(cmd, NetworkDefault); err != nil || c != cmd {
+		t.Error("expected the command to run without isolation")
+	}
+}
+
+func TestNotInitialized(t *testing.T) {
+	defer func() { initialized = true }()
+	initialized = false
+	testutil.CheckDeepEqual(t, true, SetMode(PivotRoot) == ErrNotInitialized)
+	_, err := Command(exec.Command("true"), NetworkNone)
+	testutil.CheckDeepEqual(t, true, err == ErrNotInitialized)
+	// The commands which are not isolated run as they are
+	cmd := exec.Command("true")
+	c, err := Command(cmd, NetworkHost)
+	testutil.CheckErrorAndDeepEqual(t, false, err, true, c == cmd)
+}
+
+func TestPivotRoot(t *testing.T) {
+	original := config.KanikoDir
+	defer func() {
+		config.KanikoDir = original
+		mode = None
+	}()
+	config.KanikoDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(config.KanikoDir, "secret"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckNoError(t, SetMode(PivotRoot))
+	if mode != PivotRoot {
+		t.Skip("creating mount namespaces is not permitted")
+	}
+
+	// The kaniko directory is hidden from the commands
+	cmd, err := Command(exec.Command("ls", "-A", config.KanikoDir), NetworkDefault)
+	testutil.CheckNoError(t, err)
+	out, err := cmd.Output()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, "", string(out))
+	// The rest of the root filesystem is visible
+	wd, err := os.Getwd()
+	testutil.CheckNoError(t, err)
+	cmd = exec.Command("pwd")
+	cmd.Dir = wd
+	cmd, err = Command(cmd, NetworkHost)
+	testutil.CheckNoError(t, err)
+	out, err = cmd.Output()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, wd+"\n", string(out))
+}
+
+func TestNetworkNone(t *testing.T) {
+	defer func() { defaultNetwork = NetworkHost }()
+	testutil.CheckError(t, true, SetDefaultNetwork("bridge"))
+	testutil.CheckNoError(t, SetDefaultNetwork(NetworkNone))
+
+	// Only the loopback interface is left to the commands
+	cmd, err := Command(exec.Command("cat", "/proc/net/dev"), NetworkDefault)
+	testutil.CheckNoError(t, err)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Skipf("creating network namespaces is not permitted: %v", err)
+	}
+	var interfaces []string
+	for _, line := range strings.Split(string(out), "\n")[2:] {
+		if name, _, ok := strings.Cut(line, ":"); ok {
+			interfaces = append(interfaces, strings.TrimSpace(name))
+		}
+	}
+	testutil.CheckDeepEqual(t, []string{"lo"}, interfaces)
+
+	cmd = exec.Command("true")
+	if c, err := Command(cmd, NetworkHost); err != nil || c != cmd {
+		t.Error("expected the command to run with the network of kaniko")
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package profiling records Go runtime profiles of kaniko, to investigate
+// slow builds.
+package profiling
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	rpprof "runtime/pprof"
+	"runtime/trace"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	cpuProfile  = "cpu.pprof"
+	heapProfile = "heap.pprof"
+	traceFile   = "trace.out"
+)
+
+// Profiler records the CPU profile and the execution trace of a process into
+// a directory, along with its heap profile when stopped.
+type Profiler struct {
+	dir   string
+	cpu   *os.File
+	trace *os.File
+}
+
+// Start starts recording the CPU profile and the execution trace into dir.
+func Start(dir string) (*Profiler, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, errors.Wrapf(err, "creating profile directory %s", dir)
+	}
+	p := &Profiler{dir: dir}
+	var err error
+	if p.cpu, err = os.Create(filepath.Join(dir, cpuProfile)); err != nil {
+		return nil, err
+	}
+	if err := rpprof.StartCPUProfile(p.cpu); err != nil {
+		p.cpu.Close()
+		return nil, errors.Wrap(err, "starting CPU profile")
+	}
+	if p.trace, err = os.Create(filepath.Join(dir, traceFile)); err != nil {
+		p.Stop()
+		return nil, err
+	}
+	if err := trace.Start(p.trace); err != nil {
+		p.trace.Close()
+		p.trace = nil
+		p.Stop()
+		return nil, errors.Wrap(err, "starting execution trace")
+	}
+	logrus.Infof("Recording profiles into %s", dir)
+	return p, nil
+}
+
+// Stop stops the CPU profile and the execution trace, and writes the heap
+// profile. Stopping a nil or already stopped profiler does nothing.
+func (p *Profiler) Stop() error {
+	if p == nil || p.cpu == nil {
+		return nil
+	}
+	rpprof.StopCPUProfile()
+	err := p.cpu.Close()
+	p.cpu = nil
+	if p.trace != nil {
+		trace.Stop()
+		if cerr := p.trace.Close(); err == nil {
+			err = cerr
+		}
+		p.trace = nil
+	}
+	if herr := writeHeapProfile(filepath.Join(p.dir, heapProfile)); err == nil {
+		err = herr
+	}
+	return err
+}
+
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := rpprof.Lookup("heap").WriteTo(f, 0); err != nil {
+		return errors.Wrap(err, "writing heap profile")
+	}
+	return f.Close()
+}
+
+// Serve exposes the pprof endpoints under /debug/pprof/ on addr, until the
+// process exits. It returns the address listened on.
+func Serve(addr string) (string, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", errors.Wrapf(err, "listening on %s", addr)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			logrus.Warnf("pprof server stopped: %v", err)
+		}
+	}()
+	logrus.Infof("Serving pprof on http://%s/debug/pprof/", l.Addr())
+	return l.Addr().String(), nil
+}
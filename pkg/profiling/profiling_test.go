@@ -0,0 +1,55 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package profiling
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestProfiler(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "profiles")
+	p, err := Start(dir)
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, p.Stop())
+	// Stopping twice, like on exit after a failed build, is a no-op
+	testutil.CheckNoError(t, p.Stop())
+
+	for _, f := range []string{cpuProfile, heapProfile, traceFile} {
+		fi, err := os.Stat(filepath.Join(dir, f))
+		if err != nil {
+			t.Errorf("expected %s to be written: %v", f, err)
+			continue
+		}
+		if fi.Size() == 0 {
+			t.Errorf("expected %s not to be empty", f)
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	addr, err := Serve("127.0.0.1:0")
+	testutil.CheckNoError(t, err)
+	resp, err := http.Get("http://" + addr + "/debug/pprof/")
+	testutil.CheckNoError(t, err)
+	defer resp.Body.Close()
+	testutil.CheckDeepEqual(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package progress logs heartbeats of the phase of the build in progress, for
+// the long phases logging nothing not to look stalled.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/sirupsen/logrus"
+)
+
+// Phases of the build reported in the heartbeats
+const (
+	PhaseUnpacking    = "unpacking filesystem"
+	PhaseExecuting    = "executing"
+	PhaseSnapshotting = "taking snapshot"
+	PhasePushing      = "pushing"
+)
+
+// For testing
+var currentTimeFunc = time.Now
+
+var (
+	mu          sync.Mutex
+	start       time.Time
+	phase       string
+	instruction string
+	phaseStart  time.Time
+	processed   int64
+)
+
+// Start logs a heartbeat of the current phase every interval, until the
+// returned function is called. A zero interval logs none.
+func Start(interval time.Duration) (stop func()) {
+	mu.Lock()
+	start = currentTimeFunc()
+	mu.Unlock()
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				logrus.Info(Heartbeat())
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// SetPhase sets the phase of the build in progress, and the instruction it is
+// for, if any, resetting the bytes processed.
+func SetPhase(p, instr string) {
+	mu.Lock()
+	defer mu.Unlock()
+	phase = p
+	instruction = instr
+	phaseStart = currentTimeFunc()
+	processed = 0
+}
+
+// Add adds n bytes to the bytes processed in the current phase.
+func Add(n int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	processed += n
+}
+
+// Heartbeat returns the heartbeat of the current phase.
+func Heartbeat() string {
+	mu.Lock()
+	defer mu.Unlock()
+	now := currentTimeFunc()
+	if phase == "" {
+		return fmt.Sprintf("Still building, %s elapsed", now.Sub(start).Round(time.Second))
+	}
+	s := "Still " + phase
+	if instruction != "" {
+		s += " for " + instruction
+	}
+	s += fmt.Sprintf(", %s in this phase, %s elapsed", now.Sub(phaseStart).Round(time.Second), now.Sub(start).Round(time.Second))
+	if processed > 0 {
+		s += fmt.Sprintf(", %s processed", units.HumanSize(float64(processed)))
+	}
+	return s
+}
+
+// Reader returns a reader adding the bytes read from r to the bytes processed.
+func Reader(r io.Reader) io.Reader {
+	return &reader{r}
+}
+
+type reader struct {
+	io.Reader
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	Add(int64(n))
+	return n, err
+}
+
+// Writer returns a writer adding the bytes written to w to the bytes processed.
+func Writer(w io.Writer) io.Writer {
+	return &writer{w}
+}
+
+type writer struct {
+	io.Writer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package progress
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestHeartbeat(t *testing.T) {
+	now := time.Unix(1000, 0)
+	currentTimeFunc = func() time.Time { return now }
+	defer func() { currentTimeFunc = time.Now }()
+
+	stop := Start(0)
+	defer stop()
+	now = now.Add(90 * time.Second)
+	testutil.CheckDeepEqual(t, "Still building, 1m30s elapsed", Heartbeat())
+
+	SetPhase(PhaseSnapshotting, "RUN make")
+	now = now.Add(5 * time.Minute)
+	if _, err := io.Copy(Writer(io.Discard), Reader(strings.NewReader(strings.Repeat("a", 1500)))); err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckDeepEqual(t, "Still taking snapshot for RUN make, 5m0s in this phase, 6m30s elapsed, 3kB processed", Heartbeat())
+
+	SetPhase(PhasePushing, "")
+	testutil.CheckDeepEqual(t, "Still pushing, 0s in this phase, 6m30s elapsed", Heartbeat())
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chainguard-dev/kaniko/pkg/timing"
+	"github.com/chainguard-dev/kaniko/pkg/util"
+	"golang.org/x/sys/unix"
+)
+
+// dirStates records the metadata of the files of the filesystem, by
+// directory. Any change to a file changes its ctime, so the files whose
+// metadata did not change since the previous snapshot did not change either
+// and are not hashed again. The directories in which nothing changed, as
+// reported by a dirWatch, are not even listed again, nor their files statted.
+type dirStates struct {
+	// rootMeta is the metadata of the root of the walk
+	rootMeta string
+	// entries maps the directories to the metadata of their entries, by path
+	entries map[string]map[string]string
+}
+
+// fileMeta returns the metadata of the file at p, and whether it is a
+// directory
+func fileMeta(p string) (string, bool, error) {
+	var st unix.Stat_t
+	if err := unix.Lstat(p, &st); err != nil {
+		return "", false, err
+	}
+	meta := fmt.Sprintf("%o %d %d %d:%d %d.%d %d.%d",
+		st.Mode, st.Ino, st.Size, st.Uid, st.Gid,
+		st.Mtim.Sec, st.Mtim.Nsec, st.Ctim.Sec, st.Ctim.Nsec)
+	return meta, st.Mode&unix.S_IFMT == unix.S_IFDIR, nil
+}
+
+// sameInode returns true if the metadata returned by fileMeta are the ones of
+// the same inode
+func sameInode(a, b string) bool {
+	fa, fb := strings.Fields(a), strings.Fields(b)
+	return len(fa) > 1 && len(fb) > 1 && fa[1] == fb[1]
+}
+
+// dirWalk is a walk of the filesystem comparing it to the previous one
+type dirWalk struct {
+	previous *dirStates
+	// dirty are the directories in which something changed since the
+	// previous walk, all of them when nil
+	dirty map[string]bool
+	// open are the dirty directories and their parents
+	open map[string]bool
+
+	states  *dirStates
+	paths   []string
+	changed []string
+	// listed are the directories listed by the walk
+	listed []string
+}
+
+// walkDirs walks the filesystem under root, skipping the ignored paths, and
+// returns the states of its directories along with all its paths and the ones
+// whose metadata changed since previous, if any. Only the directories in dirty,
+// or new since previous, are listed again and their files statted, unless
+// dirty is nil; the others are walked from previous. The listed directories
+// are returned too.
+func walkDirs(root string, previous *dirStates, dirty map[string]bool) (*dirStates, []string, []string, []string, error) {
+	t := timing.Start("Walking directories")
+	defer timing.DefaultRun.Stop(t)
+
+	if previous == nil {
+		previous = &dirStates{}
+	}
+	w := &dirWalk{
+		previous: previous,
+		dirty:    dirty,
+		states:   &dirStates{entries: map[string]map[string]string{}},
+	}
+	if dirty != nil {
+		w.open = map[string]bool{}
+		for d := range dirty {
+			for p := d; !w.open[p]; p = filepath.Dir(p) {
+				w.open[p] = true
+				if p == root || p == filepath.Dir(p) {
+					break
+				}
+			}
+		}
+	}
+
+	meta, _, err := fileMeta(root)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	w.states.rootMeta = meta
+	w.paths = append(w.paths, root)
+	if meta != previous.rootMeta {
+		w.changed = append(w.changed, root)
+	}
+	if err := w.visit(root, !sameInode(previous.rootMeta, meta)); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return w.states, w.paths, w.changed, w.listed, nil
+}
+
+// visit walks dir, listing it again if it is fresh, i.e. new or replaced, or
+// if something changed in it
+func (w *dirWalk) visit(dir string, fresh bool) error {
+	entries, known := w.previous.entries[dir]
+	switch {
+	case fresh || !known || w.dirty == nil || w.dirty[dir]:
+		return w.list(dir, fresh)
+	case w.open[dir]:
+		// The entries of the directory did not change, but something changed
+		// in one of its subdirectories
+		w.states.entries[dir] = make(map[string]string, len(entries))
+		for p, meta := range entries {
+			if util.CheckCleanedPathAgainstIgnoreList(p) {
+				continue
+			}
+			w.states.entries[dir][p] = meta
+			w.paths = append(w.paths, p)
+			if _, isDir := w.previous.entries[p]; isDir {
+				if err := w.visit(p, false); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		w.keep(dir)
+	}
+	return nil
+}
+
+// keep walks dir, in which nothing changed, from the previous walk
+func (w *dirWalk) keep(dir string) {
+	entries := w.previous.entries[dir]
+	w.states.entries[dir] = make(map[string]string, len(entries))
+	for p, meta := range entries {
+		if util.CheckCleanedPathAgainstIgnoreList(p) {
+			continue
+		}
+		w.states.entries[dir][p] = meta
+		w.paths = append(w.paths, p)
+		if _, isDir := w.previous.entries[p]; isDir {
+			w.keep(p)
+		}
+	}
+}
+
+// list lists dir and stats its entries. The subdirectories are fresh too when
+// dir is, or when they were replaced by another directory.
+func (w *dirWalk) list(dir string, fresh bool) error {
+	w.listed = append(w.listed, dir)
+	des, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	previous := w.previous.entries[dir]
+	w.states.entries[dir] = make(map[string]string, len(des))
+	for _, de := range des {
+		p := filepath.Join(dir, de.Name())
+		if util.CheckCleanedPathAgainstIgnoreList(p) {
+			continue
+		}
+		meta, isDir, err := fileMeta(p)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("statting %s: %w", p, err)
+		}
+		w.states.entries[dir][p] = meta
+		w.paths = append(w.paths, p)
+		changed := previous[p] != meta
+		if changed {
+			w.changed = append(w.changed, p)
+		}
+		if isDir {
+			if err := w.visit(p, fresh || !sameInode(previous[p], meta)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
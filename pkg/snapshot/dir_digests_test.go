@@ -0,0 +1,135 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/util"
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestWalkDirs(t *testing.T) {
+	testDir, err := setUpTestDir(t)
+	testutil.CheckNoError(t, err)
+	all := []string{"", "foo", "bar", "bar/bat", "baz", "baz/file", "kaniko", "kaniko/file"}
+
+	// Everything is new
+	first, paths, changed, _, err := walkDirs(testDir, nil, nil)
+	testutil.CheckNoError(t, err)
+	sortAndCompareFilepaths(t, testDir, all, paths)
+	sortAndCompareFilepaths(t, testDir, all, changed)
+
+	// Nothing changed
+	second, _, changed, _, err := walkDirs(testDir, first, nil)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, first.entries, second.entries)
+	testutil.CheckDeepEqual(t, 0, len(changed))
+
+	// A file changed, and one was added in a new directory
+	testutil.CheckNoError(t, os.Chmod(filepath.Join(testDir, "bar/bat"), 0o600))
+	testutil.CheckNoError(t, testutil.SetupFiles(testDir, map[string]string{"new/file": "new"}))
+	third, _, changed, _, err := walkDirs(testDir, second, nil)
+	testutil.CheckNoError(t, err)
+	sortAndCompareFilepaths(t, testDir, []string{"", "bar/bat", "new", "new/file"}, changed)
+
+	// Only the dirty directories are listed, the others are walked from the
+	// previous walk
+	testutil.CheckNoError(t, os.WriteFile(filepath.Join(testDir, "baz/file"), []byte("changed"), 0o644))
+	_, paths, changed, listed, err := walkDirs(testDir, third, map[string]bool{filepath.Join(testDir, "bar"): true})
+	testutil.CheckNoError(t, err)
+	sortAndCompareFilepaths(t, testDir, append(all, "new", "new/file"), paths)
+	testutil.CheckDeepEqual(t, 0, len(changed))
+	testutil.CheckDeepEqual(t, []string{filepath.Join(testDir, "bar")}, listed)
+}
+
+func TestDirWatch(t *testing.T) {
+	testDir, err := setUpTestDir(t)
+	testutil.CheckNoError(t, err)
+	w, err := newDirWatch()
+	if err != nil {
+		t.Skipf("inotify unavailable: %v", err)
+	}
+	defer w.Close()
+	for _, dir := range []string{"", "bar", "baz", "kaniko"} {
+		w.add(filepath.Join(testDir, dir))
+	}
+	dirty, err := w.changed()
+	testutil.CheckErrorAndDeepEqual(t, false, err, map[string]bool{}, dirty)
+
+	// A file rewritten in place, without changing its directory
+	testutil.CheckNoError(t, os.WriteFile(filepath.Join(testDir, "baz/file"), []byte("changed"), 0o644))
+	// A directory replaced by another one
+	testutil.CheckNoError(t, os.Rename(filepath.Join(testDir, "kaniko"), filepath.Join(testDir, "old")))
+	testutil.CheckNoError(t, os.Mkdir(filepath.Join(testDir, "kaniko"), 0o755))
+	dirty, err = w.changed()
+	testutil.CheckNoError(t, err)
+	for _, dir := range []string{"", "baz"} {
+		if !dirty[filepath.Join(testDir, dir)] {
+			t.Errorf("expected %s to be dirty, got %v", dir, dirty)
+		}
+	}
+	if dirty[filepath.Join(testDir, "bar")] {
+		t.Errorf("expected bar not to be dirty, got %v", dirty)
+	}
+}
+
+func TestSnapshotFSWithDirDigests(t *testing.T) {
+	testDir, err := setUpTestDir(t)
+	testutil.CheckNoError(t, err)
+	snapshotPathPrefix = t.TempDir()
+	snapshotter := NewSnapshotter(NewLayeredMap(util.Hasher()), testDir)
+	snapshotter.SetDirDigests(true)
+	testutil.CheckNoError(t, snapshotter.Init())
+
+	testutil.CheckNoError(t, testutil.SetupFiles(testDir, map[string]string{"bar/bat": "changed"}))
+	tarPath, err := snapshotter.TakeSnapshotFS()
+	testutil.CheckNoError(t, err)
+	files, err := listFilesInTar(tarPath)
+	testutil.CheckNoError(t, err)
+	testDirWithoutLeadingSlash := testDir[1:]
+	batPath := filepath.Join(testDirWithoutLeadingSlash, "bar/bat")
+	var expected []string
+	for _, p := range util.ParentDirectoriesWithoutLeadingSlash(batPath) {
+		if p == "/" {
+			expected = append(expected, p)
+			continue
+		}
+		expected = append(expected, p+"/")
+	}
+	expected = append(expected, batPath)
+	testutil.CheckDeepEqual(t, expected, files)
+
+	// The following snapshots only list the directories reported as changed
+	// by the watch, catching the files appended to in place
+	if snapshotter.watch == nil {
+		t.Skip("inotify unavailable")
+	}
+	f, err := os.OpenFile(filepath.Join(testDir, "baz/file"), os.O_WRONLY|os.O_APPEND, 0)
+	testutil.CheckNoError(t, err)
+	_, err = f.WriteString("appended")
+	testutil.CheckNoError(t, err)
+	testutil.CheckNoError(t, f.Close())
+	tarPath, err = snapshotter.TakeSnapshotFS()
+	testutil.CheckNoError(t, err)
+	files, err = listFilesInTar(tarPath)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, filepath.Join(testDirWithoutLeadingSlash, "baz/file"), files[len(files)-1])
+	testutil.CheckNoError(t, snapshotter.Close())
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// dirWatchMask are the inotify events changing a directory or its entries
+const dirWatchMask = unix.IN_MODIFY | unix.IN_ATTRIB | unix.IN_CLOSE_WRITE |
+	unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+// dirWatch watches the directories of the filesystem with inotify between
+// two snapshots, for the snapshots to only list again the directories in
+// which something changed. The directories which cannot be watched, e.g.
+// past the limit of inotify watches, are always listed.
+type dirWatch struct {
+	fd int
+	// dirs maps the watch descriptors to their directories
+	dirs map[int]string
+	// wds maps the directories to their watch descriptors
+	wds map[string]int
+	// unwatched are the directories which cannot be watched
+	unwatched map[string]bool
+}
+
+// newDirWatch returns a watch of no directory
+func newDirWatch() (*dirWatch, error) {
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &dirWatch{fd: fd, dirs: map[int]string{}, wds: map[string]int{}, unwatched: map[string]bool{}}, nil
+}
+
+// add watches dir, replacing its watch if it was replaced by another
+// directory
+func (w *dirWatch) add(dir string) {
+	wd, err := unix.InotifyAddWatch(w.fd, dir, dirWatchMask|unix.IN_ONLYDIR|unix.IN_DONT_FOLLOW)
+	if err != nil {
+		if !w.unwatched[dir] {
+			logrus.Debugf("Unable to watch %s, listing it at every snapshot: %v", dir, err)
+		}
+		w.unwatched[dir] = true
+		return
+	}
+	delete(w.unwatched, dir)
+	if old, ok := w.dirs[wd]; ok && old != dir {
+		delete(w.wds, old)
+	}
+	w.dirs[wd] = dir
+	w.wds[dir] = wd
+}
+
+// changed returns the directories in which something changed since the
+// previous call, along with the unwatched ones, or nil when the changes are
+// unknown because events were lost.
+func (w *dirWatch) changed() (map[string]bool, error) {
+	dirty := map[string]bool{}
+	for d := range w.unwatched {
+		dirty[d] = true
+	}
+	overflow := false
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := unix.Read(w.fd, buf)
+		if errors.Is(err, unix.EAGAIN) {
+			break
+		} else if errors.Is(err, unix.EINTR) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := string(bytes.TrimRight(buf[off+unix.SizeofInotifyEvent:off+unix.SizeofInotifyEvent+int(ev.Len)], "\x00"))
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+			if ev.Mask&unix.IN_Q_OVERFLOW != 0 {
+				overflow = true
+				continue
+			}
+			dir, ok := w.dirs[int(ev.Wd)]
+			if !ok {
+				continue
+			}
+			dirty[dir] = true
+			if name == "" {
+				// The directory itself changed, which its parent lists
+				dirty[filepath.Dir(dir)] = true
+			}
+			if ev.Mask&unix.IN_IGNORED != 0 {
+				delete(w.dirs, int(ev.Wd))
+				if w.wds[dir] == int(ev.Wd) {
+					delete(w.wds, dir)
+				}
+			}
+		}
+	}
+	if overflow {
+		logrus.Debug("Lost inotify events, listing all the directories")
+		return nil, nil
+	}
+	return dirty, nil
+}
+
+// Close stops watching the directories
+func (w *dirWatch) Close() error {
+	return unix.Close(w.fd)
+}
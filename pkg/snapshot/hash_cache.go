@@ -0,0 +1,134 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// HashCache remembers the hashes of files along with the metadata they had
+// when hashed, for files whose metadata did not change to not be hashed again.
+// It can be saved and loaded, to be shared by the builds from a base image.
+type HashCache struct {
+	mu      sync.Mutex
+	entries map[string]hashCacheEntry
+}
+
+type hashCacheEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Mode    uint32 `json:"mode"`
+	UID     uint32 `json:"uid"`
+	GID     uint32 `json:"gid"`
+	Hash    string `json:"hash"`
+}
+
+// LoadHashCache loads the hash cache saved at path. An empty cache is
+// returned if there is none, or if it cannot be read.
+func LoadHashCache(path string) *HashCache {
+	c := &HashCache{entries: map[string]hashCacheEntry{}}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c
+	} else if err != nil {
+		logrus.Warnf("Unable to read file hash cache %s: %v", path, err)
+		return c
+	}
+	if err := json.Unmarshal(b, &c.entries); err != nil {
+		logrus.Warnf("Ignoring invalid file hash cache %s: %v", path, err)
+		c.entries = map[string]hashCacheEntry{}
+		return c
+	}
+	logrus.Debugf("Loaded %d file hashes from %s", len(c.entries), path)
+	return c
+}
+
+// Save writes the hash cache to path
+func (c *HashCache) Save(path string) error {
+	c.mu.Lock()
+	b, err := json.Marshal(c.entries)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// Write to a temporary file first for concurrent builds to never read a
+	// partially written cache
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".hashes-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "writing %s", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Hasher returns a hash function returning the cached hash of the files whose
+// size, modification time, mode and ownership did not change since they were
+// hashed, and hashing the other files with h.
+func (c *HashCache) Hasher(h func(string) (string, error)) func(string) (string, error) {
+	return func(p string) (string, error) {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return "", err
+		}
+		entry := hashCacheEntry{
+			Size:    fi.Size(),
+			ModTime: fi.ModTime().UnixNano(),
+			Mode:    uint32(fi.Mode()),
+		}
+		if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+			entry.UID, entry.GID = stat.Uid, stat.Gid
+		}
+
+		c.mu.Lock()
+		cached, ok := c.entries[p]
+		c.mu.Unlock()
+		if ok {
+			hash := cached.Hash
+			cached.Hash = ""
+			if cached == entry {
+				return hash, nil
+			}
+		}
+
+		hash, err := h(p)
+		if err != nil {
+			return "", err
+		}
+		entry.Hash = hash
+		c.mu.Lock()
+		c.entries[p] = entry
+		c.mu.Unlock()
+		return hash, nil
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestHashCache(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	hashes := 0
+	hasher := func(p string) (string, error) {
+		hashes++
+		b, err := os.ReadFile(p)
+		return string(b), err
+	}
+
+	cachePath := filepath.Join(dir, "cache", "hashes.json")
+	c := LoadHashCache(cachePath)
+	h, err := c.Hasher(hasher)(file)
+	testutil.CheckErrorAndDeepEqual(t, false, err, "content", h)
+	testutil.CheckNoError(t, c.Save(cachePath))
+
+	// A later build reuses the hash of the unchanged file
+	c = LoadHashCache(cachePath)
+	h, err = c.Hasher(hasher)(file)
+	testutil.CheckErrorAndDeepEqual(t, false, err, "content", h)
+	testutil.CheckDeepEqual(t, 1, hashes)
+
+	// and hashes it again once changed
+	if err := os.WriteFile(file, []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, time.Now(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	h, err = c.Hasher(hasher)(file)
+	testutil.CheckErrorAndDeepEqual(t, false, err, "changed", h)
+	testutil.CheckDeepEqual(t, 2, hashes)
+}
@@ -20,9 +20,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"os"
 
 	"github.com/chainguard-dev/kaniko/pkg/timing"
 	"github.com/chainguard-dev/kaniko/pkg/util"
+	"golang.org/x/sync/errgroup"
 )
 
 type LayeredMap struct {
@@ -196,3 +198,41 @@ func (l *LayeredMap) CheckFileChange(s string) (bool, error) {
 	// or it did change => Changed.
 	return true, nil
 }
+
+// CheckFileChanges returns the files of paths which changed from the current
+// layered map, hashing up to jobs files concurrently. Files removed since
+// they were listed are skipped.
+func (l *LayeredMap) CheckFileChanges(paths []string, jobs int) ([]string, error) {
+	t := timing.Start("Hashing files")
+	defer timing.DefaultRun.Stop(t)
+
+	hashes := make([]string, len(paths))
+	g := errgroup.Group{}
+	g.SetLimit(max(jobs, 1))
+	for i, p := range paths {
+		g.Go(func() error {
+			h, err := l.hasher(p)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("hashing %s: %w", p, err)
+			}
+			hashes[i] = h
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	changed := []string{}
+	for i, p := range paths {
+		if hashes[i] == "" {
+			continue
+		}
+		// Save hash to not recompute it when adding the file.
+		l.layerHashCache[p] = hashes[i]
+		if oldV, ok := l.get(p); !ok || oldV != hashes[i] {
+			changed = append(changed, p)
+		}
+	}
+	return changed, nil
+}
@@ -17,7 +17,10 @@ limitations under the License.
 package snapshot
 
 import (
+	"os"
 	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
 )
 
 func Test_CacheKey(t *testing.T) {
@@ -142,3 +145,24 @@ func Test_FlattenPaths(t *testing.T) {
 	assertPath("b", false)
 	assertPath("c", false)
 }
+
+func Test_CheckFileChanges(t *testing.T) {
+	hashes := map[string]string{
+		"/unchanged": "a",
+		"/changed":   "c",
+		"/added":     "d",
+	}
+	hasher := func(p string) (string, error) {
+		if h, ok := hashes[p]; ok {
+			return h, nil
+		}
+		return "", os.ErrNotExist
+	}
+	for _, jobs := range []int{1, 4} {
+		lm := NewLayeredMap(hasher)
+		lm.currentImage = map[string]string{"/unchanged": "a", "/changed": "b"}
+		changed, err := lm.CheckFileChanges([]string{"/unchanged", "/changed", "/removed", "/added"}, jobs)
+		testutil.CheckErrorAndDeepEqual(t, false, err, []string{"/changed", "/added"}, changed)
+		testutil.CheckDeepEqual(t, "d", lm.layerHashCache["/added"])
+	}
+}
@@ -27,6 +27,7 @@ import (
 
 	"github.com/chainguard-dev/kaniko/pkg/config"
 	"github.com/chainguard-dev/kaniko/pkg/filesystem"
+	"github.com/chainguard-dev/kaniko/pkg/progress"
 	"github.com/chainguard-dev/kaniko/pkg/timing"
 	"github.com/chainguard-dev/kaniko/pkg/util"
 
@@ -39,19 +40,118 @@ var snapshotPathPrefix = ""
 
 // Snapshotter holds the root directory from which to take snapshots, and a list of snapshots taken
 type Snapshotter struct {
-	l          *LayeredMap
-	directory  string
+	l         *LayeredMap
+	directory string
+	// root is the root directory of the build the paths in the layers are
+	// relative to
+	root       string
 	ignorelist []util.IgnoreListEntry
+	// tracked maps ignored files whose changes are still snapshotted to their
+	// last snapshotted hash
+	tracked map[string]string
+	// hashJobs is the number of files hashed concurrently
+	hashJobs int
+	// useDirDigests skips hashing the files which did not change since the
+	// previous full snapshot, whose metadata are dirStates, and walking the
+	// directories in which nothing changed, as reported by watch
+	useDirDigests bool
+	dirStates     *dirStates
+	watch         *dirWatch
+	// initHasher hashes the files of the initial snapshot, if set
+	initHasher func(string) (string, error)
 }
 
 // NewSnapshotter creates a new snapshotter rooted at d
 func NewSnapshotter(l *LayeredMap, d string) *Snapshotter {
-	return &Snapshotter{l: l, directory: d, ignorelist: util.IgnoreList()}
+	return &Snapshotter{l: l, directory: d, root: config.RootDir, ignorelist: util.IgnoreList()}
+}
+
+// SetRoot sets the root directory of the build the paths in the layers are
+// relative to, which defaults to config.RootDir
+func (s *Snapshotter) SetRoot(root string) {
+	s.root = root
+}
+
+// SetHashJobs sets the number of files hashed concurrently when scanning the
+// filesystem for changes
+func (s *Snapshotter) SetHashJobs(jobs int) {
+	s.hashJobs = jobs
+}
+
+// SetDirDigests sets whether the metadata of the files are kept between the
+// snapshots of the full filesystem, for the files which did not change to not
+// be hashed again, and the directories in which nothing changed to not be
+// walked again
+func (s *Snapshotter) SetDirDigests(enabled bool) {
+	s.useDirDigests = enabled
+}
+
+// Close releases the resources of the snapshotter
+func (s *Snapshotter) Close() error {
+	if s.watch == nil {
+		return nil
+	}
+	err := s.watch.Close()
+	s.watch = nil
+	return err
+}
+
+// Track adds the changes made to path to the following snapshots, even if the
+// path is ignored. Tracked paths are never whited out.
+func (s *Snapshotter) Track(path string) error {
+	h, err := hashTracked(path)
+	if err != nil {
+		return err
+	}
+	if s.tracked == nil {
+		s.tracked = map[string]string{}
+	}
+	s.tracked[path] = h
+	return nil
+}
+
+// changedTrackedFiles returns the tracked files which changed since the last
+// snapshot
+func (s *Snapshotter) changedTrackedFiles() ([]string, error) {
+	var changed []string
+	for path, previous := range s.tracked {
+		h, err := hashTracked(path)
+		if err != nil {
+			return nil, err
+		}
+		if h != previous && h != "" {
+			logrus.Debugf("Adding changes to tracked file %s", path)
+			changed = append(changed, path)
+		}
+		s.tracked[path] = h
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+func hashTracked(path string) (string, error) {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return "", nil
+	}
+	return util.CacheHasher()(path)
+}
+
+// SetInitHasher sets the hash function used for the initial snapshot only,
+// e.g. one reusing the hashes of the unchanged files of the base image. The
+// snapshots of the commands still hash the contents of the files, as a file
+// rewritten in place may keep its size and modification time.
+func (s *Snapshotter) SetInitHasher(h func(string) (string, error)) {
+	s.initHasher = h
 }
 
 // Init initializes a new snapshotter
 func (s *Snapshotter) Init() error {
 	logrus.Info("Initializing snapshotter ...")
+	if s.initHasher != nil {
+		hasher := s.l.hasher
+		s.l.hasher = s.initHasher
+		defer func() { s.l.hasher = hasher }()
+	}
 	_, _, err := s.scanFullFilesystem()
 	return err
 }
@@ -64,19 +164,23 @@ func (s *Snapshotter) Key() (string, error) {
 // TakeSnapshot takes a snapshot of the specified files, avoiding directories in the ignorelist, and creates
 // a tarball of the changed files. Return contents of the tarball, and whether or not any files were changed
 func (s *Snapshotter) TakeSnapshot(files []string, shdCheckDelete bool, forceBuildMetadata bool) (string, error) {
-	f, err := os.CreateTemp(config.KanikoDir, "")
+	f, err := os.CreateTemp(config.ScratchDir(), "")
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
 
 	s.l.Snapshot()
-	if len(files) == 0 && !forceBuildMetadata {
+	tracked, err := s.changedTrackedFiles()
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 && len(tracked) == 0 && !forceBuildMetadata {
 		logrus.Info("No files changed in this command, skipping snapshotting.")
 		return "", nil
 	}
 
-	filesToAdd, err := filesystem.ResolvePaths(files, s.ignorelist)
+	filesToAdd, err := filesystem.ResolvePaths(files, s.ignorelist, s.root)
 	if err != nil {
 		return "", err
 	}
@@ -112,14 +216,31 @@ func (s *Snapshotter) TakeSnapshot(files []string, shdCheckDelete bool, forceBui
 		sort.Strings(filesToWhiteout)
 	}
 
-	t := util.NewTar(f)
+	t := util.NewTar(progress.Writer(f))
+	t.SetRoot(s.root)
 	defer t.Close()
-	if err := writeToTar(t, filesToAdd, filesToWhiteout); err != nil {
+	if err := writeToTar(t, s.root, append(filesToAdd, tracked...), filesToWhiteout); err != nil {
 		return "", err
 	}
 	return f.Name(), nil
 }
 
+// RecordFiles adds the files to a new layer without writing them to a tarball,
+// for the layers made by the commands themselves.
+func (s *Snapshotter) RecordFiles(files []string) error {
+	s.l.Snapshot()
+	filesToAdd, err := filesystem.ResolvePaths(files, s.ignorelist, s.root)
+	if err != nil {
+		return err
+	}
+	for _, file := range filesToAdd {
+		if err := s.l.Add(file); err != nil {
+			return fmt.Errorf("Unable to add file %s to layered map: %w", file, err)
+		}
+	}
+	return nil
+}
+
 // TakeSnapshotFS takes a snapshot of the filesystem, avoiding directories in the ignorelist, and creates
 // a tarball of the changed files.
 func (s *Snapshotter) TakeSnapshotFS() (string, error) {
@@ -128,15 +249,21 @@ func (s *Snapshotter) TakeSnapshotFS() (string, error) {
 		return "", err
 	}
 	defer f.Close()
-	t := util.NewTar(f)
+	t := util.NewTar(progress.Writer(f))
+	t.SetRoot(s.root)
 	defer t.Close()
 
 	filesToAdd, filesToWhiteOut, err := s.scanFullFilesystem()
 	if err != nil {
 		return "", err
 	}
+	tracked, err := s.changedTrackedFiles()
+	if err != nil {
+		return "", err
+	}
+	filesToAdd = append(filesToAdd, tracked...)
 
-	if err := writeToTar(t, filesToAdd, filesToWhiteOut); err != nil {
+	if err := writeToTar(t, s.root, filesToAdd, filesToWhiteOut); err != nil {
 		return "", err
 	}
 	return f.Name(), nil
@@ -144,11 +271,33 @@ func (s *Snapshotter) TakeSnapshotFS() (string, error) {
 
 func (s *Snapshotter) getSnashotPathPrefix() string {
 	if snapshotPathPrefix == "" {
-		return config.KanikoDir
+		return config.ScratchDir()
 	}
 	return snapshotPathPrefix
 }
 
+// walkDirs walks the filesystem, only listing the directories in which
+// something changed since the previous full snapshot, and returns the states
+// of its directories, all its paths, the ones which may have changed and the
+// directories listed
+func (s *Snapshotter) walkDirs() (*dirStates, []string, []string, []string, error) {
+	var dirty map[string]bool
+	if s.watch != nil && s.dirStates != nil {
+		var err error
+		if dirty, err = s.watch.changed(); err != nil {
+			return nil, nil, nil, nil, err
+		}
+	} else if s.watch == nil {
+		w, err := newDirWatch()
+		if err != nil {
+			logrus.Debugf("Unable to watch the directories, listing them at every snapshot: %v", err)
+		} else {
+			s.watch = w
+		}
+	}
+	return walkDirs(s.directory, s.dirStates, dirty)
+}
+
 func (s *Snapshotter) scanFullFilesystem() ([]string, []string, error) {
 	logrus.Info("Taking snapshot of full filesystem...")
 
@@ -175,11 +324,42 @@ func (s *Snapshotter) scanFullFilesystem() ([]string, []string, error) {
 
 	logrus.Debugf("Current image filesystem: %v", s.l.currentImage)
 
-	changedPaths, deletedPaths := util.WalkFS(s.directory, s.l.GetCurrentPaths(), s.l.CheckFileChange)
+	var existingPaths, pathsToCheck, listed []string
+	var deletedPaths map[string]struct{}
+	var states *dirStates
+	if s.useDirDigests {
+		var err error
+		if states, existingPaths, pathsToCheck, listed, err = s.walkDirs(); err != nil {
+			return nil, nil, err
+		}
+		deletedPaths = s.l.GetCurrentPaths()
+		for _, p := range existingPaths {
+			delete(deletedPaths, p)
+		}
+		logrus.Debugf("Skipping %d unchanged files, listed %d directories", len(existingPaths)-len(pathsToCheck), len(listed))
+	} else {
+		_, deletedPaths = util.WalkFS(s.directory, s.l.GetCurrentPaths(), func(path string) (bool, error) {
+			existingPaths = append(existingPaths, path)
+			return false, nil
+		})
+		pathsToCheck = existingPaths
+	}
+	changedPaths, err := s.l.CheckFileChanges(pathsToCheck, s.hashJobs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s.useDirDigests {
+		s.dirStates = states
+		if s.watch != nil {
+			for _, dir := range listed {
+				s.watch.add(dir)
+			}
+		}
+	}
 	timer := timing.Start("Resolving Paths")
 
 	filesToAdd := []string{}
-	resolvedFiles, err := filesystem.ResolvePaths(changedPaths, s.ignorelist)
+	resolvedFiles, err := filesystem.ResolvePaths(changedPaths, s.ignorelist, s.root)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -230,7 +410,7 @@ func removeObsoleteWhiteouts(deletedFiles map[string]struct{}) (filesToWhiteout
 	return filesToWhiteout
 }
 
-func writeToTar(t util.Tar, files, whiteouts []string) error {
+func writeToTar(t util.Tar, root string, files, whiteouts []string) error {
 	timer := timing.Start("Writing tar file")
 	defer timing.DefaultRun.Stop(timer)
 
@@ -238,7 +418,7 @@ func writeToTar(t util.Tar, files, whiteouts []string) error {
 	addedPaths := make(map[string]bool)
 
 	for _, path := range whiteouts {
-		skipWhiteout, err := parentPathIncludesNonDirectory(path)
+		skipWhiteout, err := parentPathIncludesNonDirectory(path, root)
 		if err != nil {
 			return err
 		}
@@ -246,7 +426,7 @@ func writeToTar(t util.Tar, files, whiteouts []string) error {
 			continue
 		}
 
-		if err := addParentDirectories(t, addedPaths, path); err != nil {
+		if err := addParentDirectories(t, root, addedPaths, path); err != nil {
 			return err
 		}
 		if err := t.Whiteout(path); err != nil {
@@ -255,7 +435,7 @@ func writeToTar(t util.Tar, files, whiteouts []string) error {
 	}
 
 	for _, path := range files {
-		if err := addParentDirectories(t, addedPaths, path); err != nil {
+		if err := addParentDirectories(t, root, addedPaths, path); err != nil {
 			return err
 		}
 		if _, pathAdded := addedPaths[path]; pathAdded {
@@ -270,8 +450,8 @@ func writeToTar(t util.Tar, files, whiteouts []string) error {
 }
 
 // Returns true if a parent of the given path has been replaced with anything other than a directory
-func parentPathIncludesNonDirectory(path string) (bool, error) {
-	for _, parentPath := range util.ParentDirectories(path) {
+func parentPathIncludesNonDirectory(path string, root string) (bool, error) {
+	for _, parentPath := range util.ParentDirectories(path, root) {
 		lstat, err := os.Lstat(parentPath)
 		if err != nil {
 			return false, err
@@ -284,8 +464,8 @@ func parentPathIncludesNonDirectory(path string) (bool, error) {
 	return false, nil
 }
 
-func addParentDirectories(t util.Tar, addedPaths map[string]bool, path string) error {
-	for _, parentPath := range util.ParentDirectories(path) {
+func addParentDirectories(t util.Tar, root string, addedPaths map[string]bool, path string) error {
+	for _, parentPath := range util.ParentDirectories(path, root) {
 		if _, pathAdded := addedPaths[parentPath]; pathAdded {
 			continue
 		}
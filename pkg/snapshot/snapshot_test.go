@@ -97,6 +97,48 @@ func TestSnapshotFSFileChange(t *testing.T) {
 	}
 }
 
+func TestSnapshotFSInitHasher(t *testing.T) {
+	testDir, err := setUpTestDir(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotPathPrefix = t.TempDir()
+	original := config.KanikoDir
+	config.KanikoDir = testDir
+	defer func() { config.KanikoDir = original }()
+
+	l := NewLayeredMap(util.Hasher())
+	snapshotter := NewSnapshotter(l, testDir)
+	hashCache := LoadHashCache(filepath.Join(t.TempDir(), "hashes.json"))
+	snapshotter.SetInitHasher(hashCache.Hasher(util.Hasher()))
+	if err := snapshotter.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file rewritten in place with the same size and modification time is
+	// still snapshotted
+	foo := filepath.Join(testDir, "foo")
+	fi, err := os.Stat(foo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(foo, []byte("baz2"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(foo, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	tarPath, err := snapshotter.TakeSnapshotFS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := listFilesInTar(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckDeepEqual(t, filepath.Join(strings.TrimLeft(testDir, "/"), "foo"), files[len(files)-1])
+}
+
 func TestSnapshotFSIsReproducible(t *testing.T) {
 	testDir, snapshotter, cleanup, err := setUpTest(t)
 	defer cleanup()
@@ -274,6 +316,37 @@ func TestSnapshotFiles(t *testing.T) {
 	testutil.CheckErrorAndDeepEqual(t, false, nil, expectedFiles, actualFiles)
 }
 
+func TestSnapshotTrackedFiles(t *testing.T) {
+	testDir, snapshotter, cleanup, err := setUpTest(t)
+	defer cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracked := filepath.Join(testDir, "baz/file")
+	if err := snapshotter.Track(tracked); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changed tracked files are added without being listed
+	if err := os.WriteFile(tracked, []byte("changed"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tarPath, err := snapshotter.TakeSnapshot([]string{}, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tarPath)
+	actualFiles, err := listFilesInTar(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.CheckDeepEqual(t, strings.TrimLeft(tracked, "/"), actualFiles[len(actualFiles)-1])
+
+	// Unchanged tracked files are not added again
+	tarPath, err = snapshotter.TakeSnapshot([]string{}, false, false)
+	testutil.CheckErrorAndDeepEqual(t, false, err, "", tarPath)
+}
+
 func TestEmptySnapshotFS(t *testing.T) {
 	_, snapshotter, cleanup, err := setUpTest(t)
 	if err != nil {
@@ -0,0 +1,58 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bucket
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/chainguard-dev/kaniko/pkg/constants"
+)
+
+// NewS3Client returns a new S3 client, configured from the environment. The
+// S3_ENDPOINT and S3_FORCE_PATH_STYLE environment variables set the endpoint
+// of S3 compatible storages.
+func NewS3Client(ctx context.Context) (*s3.Client, error) {
+	endpoint := os.Getenv(constants.S3EndpointEnv)
+	forcePath := false
+	if strings.ToLower(os.Getenv(constants.S3ForcePathStyle)) == "true" {
+		forcePath = true
+	}
+
+	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+		if endpoint != "" {
+			return aws.Endpoint{
+				URL: endpoint,
+			}, nil
+		}
+		return aws.Endpoint{}, &aws.EndpointNotFoundError{}
+	})
+
+	cfg, err := config.LoadDefaultConfig(ctx, config.WithEndpointResolverWithOptions(customResolver))
+	if err != nil {
+		return nil, err
+	}
+	return s3.NewFromConfig(cfg, func(options *s3.Options) {
+		if endpoint != "" {
+			options.UsePathStyle = forcePath
+		}
+	}), nil
+}
@@ -72,7 +72,7 @@ func ResolveEnvironmentReplacement(value string, envs []string, isFilepath bool)
 	shlex := shell.NewLex(parser.DefaultEscapeToken)
 	fp, _, err := shlex.ProcessWord(value, shell.EnvsFromSlice(envs))
 	// Check after replacement if value is a remote URL
-	if !isFilepath || IsSrcRemoteFileURL(fp) {
+	if !isFilepath || isRemoteSource(fp) {
 		return fp, err
 	}
 	if err != nil {
@@ -144,7 +144,7 @@ func ResolveSources(srcs []string, root string) ([]string, error) {
 func matchSources(srcs, files []string) ([]string, error) {
 	var matchedSources []string
 	for _, src := range srcs {
-		if IsSrcRemoteFileURL(src) {
+		if isRemoteSource(src) {
 			matchedSources = append(matchedSources, src)
 			continue
 		}
@@ -153,7 +153,7 @@ func matchSources(srcs, files []string) ([]string, error) {
 			if filepath.IsAbs(src) {
 				file = filepath.Join(config.RootDir, file)
 			}
-			matched, err := filepath.Match(src, file)
+			matched, err := matchPath(src, file)
 			if err != nil {
 				return nil, err
 			}
@@ -165,6 +165,37 @@ func matchSources(srcs, files []string) ([]string, error) {
 	return matchedSources, nil
 }
 
+// matchPath reports whether name matches pattern like filepath.Match, with
+// ** matching any number of directories as with BuildKit
+func matchPath(pattern, name string) (bool, error) {
+	if !strings.Contains(pattern, "**") {
+		return filepath.Match(pattern, name)
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matched, err := matchSegments(pattern[1:], name[i:]); matched || err != nil {
+					return matched, err
+				}
+			}
+			return false, nil
+		}
+		if len(name) == 0 {
+			return false, nil
+		}
+		matched, err := filepath.Match(pattern[0], name[0])
+		if !matched || err != nil {
+			return false, err
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0, nil
+}
+
 func IsDestDir(path string) bool {
 	// try to stat the path
 	fileInfo, err := os.Stat(path)
@@ -255,7 +286,7 @@ func IsSrcsValid(srcsAndDest instructions.SourcesAndDest, resolvedSources []stri
 
 	// If there is only one source and it's a directory, docker assumes the dest is a directory
 	if len(resolvedSources) == 1 {
-		if IsSrcRemoteFileURL(resolvedSources[0]) {
+		if isRemoteSource(resolvedSources[0]) {
 			return nil
 		}
 		path := filepath.Join(fileContext.Root, resolvedSources[0])
@@ -270,7 +301,7 @@ func IsSrcsValid(srcsAndDest instructions.SourcesAndDest, resolvedSources []stri
 
 	totalFiles := 0
 	for _, src := range resolvedSources {
-		if IsSrcRemoteFileURL(src) {
+		if isRemoteSource(src) {
 			totalFiles++
 			continue
 		}
@@ -304,6 +335,29 @@ func IsSrcRemoteFileURL(rawurl string) bool {
 	return err == nil && u.Scheme != "" && u.Host != ""
 }
 
+// IsSrcGitURL returns true if src references a git repository, like
+// https://github.com/org/repo.git#ref or git@github.com:org/repo.git
+func IsSrcGitURL(src string) bool {
+	if strings.HasPrefix(src, "git@") || strings.HasPrefix(src, "git://") {
+		return true
+	}
+	u, err := url.Parse(src)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	switch u.Scheme {
+	case "ssh":
+		return true
+	case "http", "https":
+		return strings.HasSuffix(u.Path, ".git")
+	}
+	return false
+}
+
+func isRemoteSource(src string) bool {
+	return IsSrcRemoteFileURL(src) || IsSrcGitURL(src)
+}
+
 func UpdateConfigEnv(envVars []instructions.KeyValuePair, config *v1.Config, replacementEnvs []string) error {
 	newEnvs := make([]instructions.KeyValuePair, len(envVars))
 	for index, pair := range envVars {
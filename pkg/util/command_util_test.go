@@ -281,6 +281,28 @@ var matchSourcesTests = []struct {
 			testURL,
 		},
 	},
+	{
+		srcs: []string{
+			"**/go.mod",
+			"cmd/**/*.go",
+		},
+		files: []string{
+			"go.mod",
+			"go.sum",
+			"pkg/go.mod",
+			"pkg/a/go.mod",
+			"cmd/main.go",
+			"cmd/app/app.go",
+			"pkg/a/a.go",
+		},
+		expectedFiles: []string{
+			"cmd/app/app.go",
+			"cmd/main.go",
+			"go.mod",
+			"pkg/a/go.mod",
+			"pkg/go.mod",
+		},
+	},
 }
 
 func Test_MatchSources(t *testing.T) {
@@ -898,3 +920,23 @@ func TestIsSrcRemoteFileURL(t *testing.T) {
 		)
 	}
 }
+
+func TestIsSrcGitURL(t *testing.T) {
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{src: "https://github.com/moby/buildkit.git", want: true},
+		{src: "https://github.com/moby/buildkit.git#v0.10.1:docs", want: true},
+		{src: "git@github.com:moby/buildkit.git", want: true},
+		{src: "git://github.com/moby/buildkit", want: true},
+		{src: "ssh://git@github.com/moby/buildkit", want: true},
+		{src: "https://github.com/moby/buildkit/archive/v0.10.1.tar.gz", want: false},
+		{src: "/is/a/filepath.git", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			testutil.CheckDeepEqual(t, tt.want, IsSrcGitURL(tt.src))
+		})
+	}
+}
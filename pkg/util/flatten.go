@@ -0,0 +1,209 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/progress"
+	"github.com/docker/docker/pkg/archive"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// ExtractLayersFlattened extracts layers to root like GetFSFromLayers, with
+// the same result, in a single pass writing each file once: the layers are
+// fetched concurrently, up to jobs at a time, then their headers are read from
+// the last layer to the first to find the entries not overwritten or deleted
+// by a later layer, which alone are extracted. The layers are verified against
+// their digests once, while fetched.
+func ExtractLayersFlattened(root string, layers []v1.Layer, jobs int, extract ExtractFunction) error {
+	volumes = []string{}
+	if err := InitIgnoreList(); err != nil {
+		return errors.Wrap(err, "initializing filesystem ignore list")
+	}
+
+	dir, err := os.MkdirTemp(config.ScratchDir(), "layers-")
+	if err != nil {
+		return errors.Wrap(err, "creating layers directory")
+	}
+	defer os.RemoveAll(dir)
+	paths := make([]string, len(layers))
+	g := errgroup.Group{}
+	g.SetLimit(max(jobs, 1))
+	for i, l := range layers {
+		paths[i] = filepath.Join(dir, strconv.Itoa(i)+".tar")
+		g.Go(func() error {
+			return fetchLayer(l, paths[i])
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	entries, err := flattenedEntries(paths)
+	if err != nil {
+		return err
+	}
+	for i, path := range paths {
+		if err := extractEntries(root, path, entries[i], extract); err != nil {
+			return errors.Wrapf(err, "extracting layer %d", i)
+		}
+	}
+	return nil
+}
+
+// fetchLayer writes the uncompressed content of l to path
+func fetchLayer(l v1.Layer, path string) error {
+	r, err := l.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, progress.Reader(r)); err != nil {
+		return errors.Wrap(err, "fetching layer")
+	}
+	return f.Close()
+}
+
+// flattenedEntries returns the names of the entries of each layer tarball of
+// paths left in the filesystem once they are all extracted in order: the
+// whiteouts, and the files neither overwritten by a later layer nor in a
+// directory it deletes, along with the targets of their hard links.
+func flattenedEntries(paths []string) ([]map[string]bool, error) {
+	entries := make([]map[string]bool, len(paths))
+	written := map[string]bool{}
+	deleted := map[string]bool{}
+	isDeleted := func(name string) bool {
+		for p := name; ; p = filepath.Dir(p) {
+			if deleted[p] {
+				return true
+			}
+			if p == "." || p == "/" {
+				return false
+			}
+		}
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		layer := map[string]bool{}
+		var whiteouts []string
+		err := readTarHeaders(paths[i], func(hdr *tar.Header) {
+			name := filepath.Clean(hdr.Name)
+			base := filepath.Base(name)
+			if strings.HasPrefix(base, archive.WhiteoutPrefix) {
+				// The deletions only apply to the earlier layers, once
+				// applied themselves before the later ones
+				layer[name] = true
+				whiteouts = append(whiteouts, filepath.Join(filepath.Dir(name), strings.TrimPrefix(base, archive.WhiteoutPrefix)))
+				return
+			}
+			if !written[name] && !isDeleted(name) {
+				layer[name] = true
+				// A hard link to an overwritten file keeps its content
+				if hdr.Typeflag == tar.TypeLink {
+					layer[filepath.Clean(hdr.Linkname)] = true
+				}
+			}
+			written[name] = true
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading layer %d", i)
+		}
+		for _, w := range whiteouts {
+			deleted[w] = true
+		}
+		entries[i] = layer
+	}
+	return entries, nil
+}
+
+// readTarHeaders calls fn with the headers of the tarball at path, skipping
+// the contents of its files.
+func readTarHeaders(path string, fn func(*tar.Header)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(hdr)
+	}
+}
+
+// extractEntries extracts the entries of the layer tarball at path in names
+// to root, applying its whiteouts like GetFSFromLayers.
+func extractEntries(root, path string, names map[string]bool, extract ExtractFunction) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		cleanedName := filepath.Clean(hdr.Name)
+		if !names[cleanedName] {
+			continue
+		}
+		base := filepath.Base(cleanedName)
+		if strings.HasPrefix(base, archive.WhiteoutPrefix) {
+			path := filepath.Join(root, filepath.Dir(cleanedName), strings.TrimPrefix(base, archive.WhiteoutPrefix))
+			if CheckCleanedPathAgainstIgnoreList(path) && !checkIgnoreListRoot(root) {
+				logrus.Tracef("Not deleting %s, as it's ignored", path)
+				continue
+			}
+			if childDirInIgnoreList(path) && !checkIgnoreListRoot(root) {
+				logrus.Tracef("Not deleting %s, as it contains a ignored path", path)
+				continue
+			}
+			if err := os.RemoveAll(path); err != nil {
+				return errors.Wrapf(err, "removing whiteout %s", hdr.Name)
+			}
+			continue
+		}
+		if err := extract(root, hdr, cleanedName, tr); err != nil {
+			return err
+		}
+	}
+}
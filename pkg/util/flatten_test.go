@@ -0,0 +1,184 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// tarEntry is an entry of a test layer, a file unless typeflag is set
+type tarEntry struct {
+	name     string
+	content  string
+	typeflag byte
+	linkname string
+}
+
+func testLayer(t *testing.T, entries ...tarEntry) v1.Layer {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0o644, Typeflag: e.typeflag, Linkname: e.linkname}
+		switch e.typeflag {
+		case 0:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(e.content))
+		case tar.TypeDir:
+			hdr.Mode = 0o755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layer
+}
+
+// writeExtract extracts the entries of the test layers without changing their
+// owners, which requires root
+func writeExtract(root string, hdr *tar.Header, name string, r io.Reader) error {
+	path := filepath.Join(root, name)
+	if hdr.Typeflag == tar.TypeDir {
+		return os.MkdirAll(path, 0o755)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	switch hdr.Typeflag {
+	case tar.TypeLink:
+		return os.Link(filepath.Join(root, hdr.Linkname), path)
+	case tar.TypeSymlink:
+		return os.Symlink(hdr.Linkname, path)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
+
+func readTree(t *testing.T, root string) map[string]string {
+	tree := map[string]string{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		switch {
+		case d.IsDir():
+			tree[rel] = "dir"
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			tree[rel] = "-> " + link
+			return err
+		default:
+			b, err := os.ReadFile(path)
+			tree[rel] = string(b)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree
+}
+
+func TestExtractLayersFlattened(t *testing.T) {
+	resetMountInfoFile := provideEmptyMountinfoFile()
+	defer resetMountInfoFile()
+	original := config.KanikoDir
+	defer func() { config.KanikoDir = original }()
+	config.KanikoDir = t.TempDir()
+
+	layers := []v1.Layer{
+		testLayer(t,
+			tarEntry{name: "etc", typeflag: tar.TypeDir},
+			tarEntry{name: "etc/config", content: "v1"},
+			tarEntry{name: "etc/config-link", typeflag: tar.TypeLink, linkname: "etc/config"},
+			tarEntry{name: "cache/a", content: "a"},
+			tarEntry{name: "bin/sh", typeflag: tar.TypeSymlink, linkname: "busybox"},
+		),
+		testLayer(t,
+			tarEntry{name: "etc/config", content: "v2"},
+			tarEntry{name: "cache/.wh.a"},
+			tarEntry{name: "tmp/.wh.build"},
+		),
+		testLayer(t,
+			tarEntry{name: ".wh.cache"},
+			tarEntry{name: "cache/b", content: "b"},
+			tarEntry{name: "bin/sh", content: "shell"},
+		),
+	}
+	// The files of the base filesystem are deleted by the whiteouts
+	sequential, flattened := t.TempDir(), t.TempDir()
+	for _, root := range []string{sequential, flattened} {
+		if err := os.MkdirAll(filepath.Join(root, "tmp", "build"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, "tmp", "build", "out"), []byte("out"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := GetFSFromLayers(sequential, layers, ExtractFunc(writeExtract))
+	testutil.CheckNoError(t, err)
+	var extracted []string
+	testutil.CheckNoError(t, ExtractLayersFlattened(flattened, layers, 2, func(root string, hdr *tar.Header, name string, r io.Reader) error {
+		extracted = append(extracted, name)
+		return writeExtract(root, hdr, name, r)
+	}))
+	// The files overwritten or deleted later are never extracted, but the one
+	// a hard link keeps is
+	testutil.CheckDeepEqual(t, []string{"etc", "etc/config", "etc/config-link", "etc/config", "cache/b", "bin/sh"}, extracted)
+	testutil.CheckDeepEqual(t, readTree(t, sequential), readTree(t, flattened))
+	testutil.CheckDeepEqual(t, map[string]string{
+		"bin":             "dir",
+		"bin/sh":          "shell",
+		"cache":           "dir",
+		"cache/b":         "b",
+		"etc":             "dir",
+		"etc/config":      "v2",
+		"etc/config-link": "v1",
+		"tmp":             "dir",
+	}, readTree(t, flattened))
+}
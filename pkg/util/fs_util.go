@@ -27,18 +27,20 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/pkg/progress"
 	"github.com/chainguard-dev/kaniko/pkg/timing"
 	"github.com/docker/docker/pkg/archive"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/karrick/godirwalk"
 	"github.com/moby/buildkit/frontend/dockerfile/dockerignore"
 	"github.com/moby/patternmatcher"
-	otiai10Cpy "github.com/otiai10/copy"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -56,6 +58,116 @@ const (
 type IgnoreListEntry struct {
 	Path            string
 	PrefixMatchOnly bool
+	// Regexp, when set, is matched against paths instead of Path. Like for
+	// Path, the children of a matching directory are ignored too.
+	Regexp *regexp.Regexp
+}
+
+// ignorePathRegexPrefix marks --ignore-path patterns that are regular expressions
+const ignorePathRegexPrefix = "regex:"
+
+// NewIgnoreListEntry returns the ignore list entry for an --ignore-path pattern.
+// The pattern is either an absolute path, which may contain glob patterns, or a
+// regular expression prefixed by "regex:", anchored to match the whole path.
+// An error is returned for invalid patterns. The relative paths, which match
+// no path, are kept as they were for compatibility, with a deprecation warning.
+func NewIgnoreListEntry(pattern string) (IgnoreListEntry, error) {
+	if expr, ok := strings.CutPrefix(pattern, ignorePathRegexPrefix); ok {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return IgnoreListEntry{}, errors.Wrapf(err, "invalid ignore path regex %q", expr)
+		}
+		if prefix, _ := re.LiteralPrefix(); prefix != "" && !strings.HasPrefix(prefix, "/") {
+			return IgnoreListEntry{}, fmt.Errorf("ignore path regex %q matches no absolute path, it must start with /", expr)
+		}
+		return IgnoreListEntry{Path: pattern, Regexp: re}, nil
+	}
+	if _, err := filepath.Match(pattern, "/"); err != nil {
+		return IgnoreListEntry{}, errors.Wrapf(err, "invalid ignore path %q", pattern)
+	}
+	if !filepath.IsAbs(pattern) {
+		logrus.Warnf("Ignore path %q is relative and matches no path, relative ignore paths are deprecated and will be rejected: use %q to ignore the path from the root", pattern, "/"+pattern)
+		return IgnoreListEntry{Path: pattern}, nil
+	}
+	return IgnoreListEntry{Path: filepath.Clean(pattern)}, nil
+}
+
+// virtualFilesystems are the directories of the kernel filesystems, never
+// walked when looking for the paths matching an ignore list entry
+var virtualFilesystems = []string{"/proc", "/sys", "/dev"}
+
+// MatchesUnder returns true if the entry matches a path of the filesystem
+// rooted at root, to reject the patterns which may be mistyped. The kernel
+// filesystems and the paths already ignored are not walked.
+func (e IgnoreListEntry) MatchesUnder(root string) bool {
+	if e.Regexp == nil {
+		if !filepath.IsAbs(e.Path) {
+			return false
+		}
+		matches, _ := filepath.Glob(filepath.Join(root, e.Path))
+		return len(matches) > 0
+	}
+	// Only the directory the regex is rooted at is walked
+	start := root
+	if prefix, _ := e.Regexp.LiteralPrefix(); prefix != "" {
+		start = filepath.Join(root, prefix[:strings.LastIndex(prefix, "/")+1])
+	}
+	found := false
+	filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		p := filepath.Join("/", rel)
+		if d.IsDir() && path != start && (slices.Contains(virtualFilesystems, p) || CheckCleanedPathAgainstIgnoreList(p)) {
+			return filepath.SkipDir
+		}
+		if e.Regexp.MatchString(p) {
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found
+}
+
+// matches returns true if path, or one of its parent directories, is ignored
+// by the entry
+func (e IgnoreListEntry) matches(path string) bool {
+	if e.Regexp == nil {
+		return hasCleanedFilepathPrefix(path, e.Path, e.PrefixMatchOnly)
+	}
+	for p := path; ; p = filepath.Dir(p) {
+		if (p != path || !e.PrefixMatchOnly) && e.Regexp.MatchString(p) {
+			return true
+		}
+		if p == "/" || p == "." {
+			return false
+		}
+	}
+}
+
+// hasChildIn returns true if the entry may ignore children of the directory path
+func (e IgnoreListEntry) hasChildIn(path string) bool {
+	if e.Regexp == nil {
+		return HasFilepathPrefix(e.Path, path, e.PrefixMatchOnly)
+	}
+	// Only the directory the regex is rooted at is known to hold ignored paths
+	prefix, _ := e.Regexp.LiteralPrefix()
+	if prefix == "" {
+		return false
+	}
+	return HasFilepathPrefix(filepath.Dir(prefix), path, false)
+}
+
+func cleanIgnoreListEntry(entry IgnoreListEntry) IgnoreListEntry {
+	if entry.Regexp == nil {
+		entry.Path = filepath.Clean(entry.Path)
+	}
+	return entry
 }
 
 var defaultIgnoreList = []IgnoreListEntry{
@@ -79,18 +191,44 @@ var defaultIgnoreList = []IgnoreListEntry{
 
 var ignorelist = append([]IgnoreListEntry{}, defaultIgnoreList...)
 
+// cleanupPreserveList are the paths kept by CleanupFilesystem
+var cleanupPreserveList = []IgnoreListEntry{}
+
 var volumes = []string{}
 
-// skipKanikoDir opts to skip the '/kaniko' dir for otiai10.copy which should be ignored in root
-var skipKanikoDir = otiai10Cpy.Options{
-	Skip: func(info os.FileInfo, src, dest string) (bool, error) {
-		return strings.HasSuffix(src, "/kaniko"), nil
-	},
+// skipKanikoDir skips the '/kaniko' dir, which should be ignored in root, when
+// copying a tree
+func skipKanikoDir(path string) bool {
+	return strings.HasSuffix(path, "/kaniko")
+}
+
+// skipWorkDirs returns the function skipping the kaniko directory and the
+// staging directory when copying the tree src to dest. The files of the stages
+// are copied into the staging directory, which may be outside of the kaniko
+// one, so that copying the whole filesystem would otherwise copy its own copy.
+func skipWorkDirs(src, dest string) func(string) bool {
+	return func(target string) bool {
+		if skipKanikoDir(target) {
+			return true
+		}
+		rel, err := filepath.Rel(dest, target)
+		if err != nil {
+			return false
+		}
+		return filepath.Join(src, rel) == filepath.Clean(config.StagingDir())
+	}
 }
 
 type FileContext struct {
 	Root          string
 	ExcludedFiles []string
+	// Digests are the digests of the context files recorded when fetching the
+	// build context, keyed by path
+	Digests map[string]string
+	// CopyExcludes are the patterns of COPY --exclude, matched against the
+	// paths relative to CopyExcludesRoot
+	CopyExcludes     []string
+	CopyExcludesRoot string
 }
 
 type ExtractFunction func(string, *tar.Header, string, io.Reader) error
@@ -107,17 +245,11 @@ func IgnoreList() []IgnoreListEntry {
 }
 
 func AddToIgnoreList(entry IgnoreListEntry) {
-	ignorelist = append(ignorelist, IgnoreListEntry{
-		Path:            filepath.Clean(entry.Path),
-		PrefixMatchOnly: entry.PrefixMatchOnly,
-	})
+	ignorelist = append(ignorelist, cleanIgnoreListEntry(entry))
 }
 
 func AddToDefaultIgnoreList(entry IgnoreListEntry) {
-	defaultIgnoreList = append(defaultIgnoreList, IgnoreListEntry{
-		Path:            filepath.Clean(entry.Path),
-		PrefixMatchOnly: entry.PrefixMatchOnly,
-	})
+	defaultIgnoreList = append(defaultIgnoreList, cleanIgnoreListEntry(entry))
 }
 
 func IncludeWhiteout() FSOpt {
@@ -177,7 +309,7 @@ func GetFSFromLayers(root string, layers []v1.Layer, opts ...FSOpt) ([]string, e
 		}
 		defer r.Close()
 
-		tr := tar.NewReader(r)
+		tr := tar.NewReader(progress.Reader(r))
 		for {
 			hdr, err := tr.Next()
 			if errors.Is(err, io.EOF) {
@@ -199,11 +331,11 @@ func GetFSFromLayers(root string, layers []v1.Layer, opts ...FSOpt) ([]string, e
 				name := strings.TrimPrefix(base, archive.WhiteoutPrefix)
 				path := filepath.Join(dir, name)
 
-				if CheckCleanedPathAgainstIgnoreList(path) {
+				if CheckCleanedPathAgainstIgnoreList(path) && !checkIgnoreListRoot(root) {
 					logrus.Tracef("Not deleting %s, as it's ignored", path)
 					continue
 				}
-				if childDirInIgnoreList(path) {
+				if childDirInIgnoreList(path) && !checkIgnoreListRoot(root) {
 					logrus.Tracef("Not deleting %s, as it contains a ignored path", path)
 					continue
 				}
@@ -229,15 +361,44 @@ func GetFSFromLayers(root string, layers []v1.Layer, opts ...FSOpt) ([]string, e
 	return extractedFiles, nil
 }
 
-// DeleteFilesystem deletes the extracted image file system
-func DeleteFilesystem() error {
+// AddToCleanupPreserveList adds an entry to the paths kept by CleanupFilesystem
+func AddToCleanupPreserveList(entry IgnoreListEntry) {
+	cleanupPreserveList = append(cleanupPreserveList, cleanIgnoreListEntry(entry))
+}
+
+// DeleteFilesystem deletes the image file system extracted into root
+func DeleteFilesystem(root string) error {
+	return deleteFilesystem(root, nil)
+}
+
+// CleanupFilesystem deletes the image file system extracted into root at the
+// end of the build, keeping the paths of the cleanup preserve list for the
+// next builds run in the same container.
+func CleanupFilesystem(root string) error {
+	return deleteFilesystem(root, cleanupPreserveList)
+}
+
+func deleteFilesystem(root string, preserve []IgnoreListEntry) error {
 	logrus.Info("Deleting filesystem...")
-	return filepath.Walk(config.RootDir, func(path string, info os.FileInfo, err error) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			// ignore errors when deleting.
 			return nil //nolint:nilerr
 		}
 
+		for _, e := range preserve {
+			if e.matches(path) {
+				logrus.Debugf("Not deleting %s, as it's preserved", path)
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if e.hasChildIn(path) {
+				logrus.Debugf("Not deleting %s, as it contains a preserved path", path)
+				return nil
+			}
+		}
 		if CheckCleanedPathAgainstIgnoreList(path) {
 			if !isExist(path) {
 				logrus.Debugf("Path %s ignored, but not exists", path)
@@ -253,7 +414,7 @@ func DeleteFilesystem() error {
 			logrus.Debugf("Not deleting %s, as it contains a ignored path", path)
 			return nil
 		}
-		if path == config.RootDir {
+		if path == root {
 			return nil
 		}
 		return os.RemoveAll(path)
@@ -271,7 +432,7 @@ func isExist(path string) bool {
 // childDirInIgnoreList returns true if there is a child file or directory of the path in the ignorelist
 func childDirInIgnoreList(path string) bool {
 	for _, d := range ignorelist {
-		if HasFilepathPrefix(d.Path, path, d.PrefixMatchOnly) {
+		if d.hasChildIn(path) {
 			return true
 		}
 	}
@@ -416,7 +577,10 @@ func ExtractFile(dest string, hdr *tar.Header, cleanedName string, tr io.Reader)
 func IsInProvidedIgnoreList(path string, wl []IgnoreListEntry) bool {
 	path = filepath.Clean(path)
 	for _, entry := range wl {
-		if !entry.PrefixMatchOnly && path == entry.Path {
+		if entry.PrefixMatchOnly {
+			continue
+		}
+		if entry.Regexp != nil && entry.Regexp.MatchString(path) || path == entry.Path {
 			return true
 		}
 	}
@@ -430,7 +594,7 @@ func IsInIgnoreList(path string) bool {
 
 func CheckCleanedPathAgainstProvidedIgnoreList(path string, wl []IgnoreListEntry) bool {
 	for _, wl := range ignorelist {
-		if hasCleanedFilepathPrefix(path, wl.Path, wl.PrefixMatchOnly) {
+		if wl.matches(path) {
 			return true
 		}
 	}
@@ -519,13 +683,14 @@ func RelativeFiles(fp string, root string) ([]string, error) {
 	return files, err
 }
 
-// ParentDirectories returns a list of paths to all parent directories
+// ParentDirectories returns a list of paths to all parent directories of path
+// up to root
 // Ex. /some/temp/dir -> [/, /some, /some/temp, /some/temp/dir]
-func ParentDirectories(path string) []string {
+func ParentDirectories(path string, root string) []string {
 	dir := filepath.Clean(path)
 	var paths []string
 	for {
-		if dir == filepath.Clean(config.RootDir) || dir == "" || dir == "." {
+		if dir == filepath.Clean(root) || dir == "" || dir == "." {
 			break
 		}
 		dir, _ = filepath.Split(dir)
@@ -533,7 +698,7 @@ func ParentDirectories(path string) []string {
 		paths = append([]string{dir}, paths...)
 	}
 	if len(paths) == 0 {
-		paths = []string{config.RootDir}
+		paths = []string{root}
 	}
 	return paths
 }
@@ -574,7 +739,7 @@ func resetFileOwnershipIfNotMatching(path string, newUID, newGID uint32) error {
 		return fmt.Errorf("can't convert fs.FileInfo of %v to linux syscall.Stat_t", path)
 	}
 	if stat.Uid != newUID && stat.Gid != newGID {
-		err = os.Chown(path, int(newUID), int(newGID))
+		err = chown(path, int(newUID), int(newGID), false)
 		if err != nil {
 			return errors.Wrap(err, "reseting file ownership to root")
 		}
@@ -603,7 +768,7 @@ func CreateFile(path string, reader io.Reader, perm os.FileMode, uid uint32, gid
 		return errors.Wrap(err, "creating file")
 	}
 	defer dest.Close()
-	if _, err := io.Copy(dest, reader); err != nil {
+	if err := cloneOrCopy(dest, reader); err != nil {
 		return errors.Wrap(err, "copying file")
 	}
 	return setFilePermissions(path, perm, int(uid), int(gid))
@@ -625,7 +790,7 @@ func AddVolumePathToIgnoreList(path string) {
 //     - destination will have permissions of 0600 by default if not specified with chmod
 //     - If remote file has HTTP Last-Modified header, we set the mtime of the file to that timestamp
 func DownloadFileToDest(rawurl, dest string, uid, gid int64, chmod fs.FileMode) error {
-	resp, err := http.Get(rawurl) //nolint:noctx
+	resp, err := HTTPClient().Get(rawurl) //nolint:noctx
 	if err != nil {
 		return err
 	}
@@ -794,6 +959,7 @@ func getExcludedFiles(dockerfilePath, buildcontext string) ([]string, error) {
 // ExcludesFile returns true if the file context specified this file should be ignored.
 // Usually this is specified via .dockerignore
 func (c FileContext) ExcludesFile(path string) bool {
+	fullPath := path
 	if HasFilepathPrefix(path, c.Root, false) {
 		var err error
 		path, err = filepath.Rel(c.Root, path)
@@ -807,6 +973,18 @@ func (c FileContext) ExcludesFile(path string) bool {
 		logrus.Errorf("Error matching, including %s in build: %v", path, err)
 		return false
 	}
+	if match || len(c.CopyExcludes) == 0 {
+		return match
+	}
+	path, err = filepath.Rel(c.CopyExcludesRoot, fullPath)
+	if err != nil || path == "." || strings.HasPrefix(path, "..") {
+		return false
+	}
+	match, err = patternmatcher.Matches(path, c.CopyExcludes)
+	if err != nil {
+		logrus.Errorf("Error matching, including %s in build: %v", path, err)
+		return false
+	}
 	return match
 }
 
@@ -866,7 +1044,7 @@ func MkdirAllWithPermissions(path string, mode os.FileMode, uid, gid int64) erro
 			),
 		)
 	}
-	if err := os.Chown(path, int(uid), int(gid)); err != nil {
+	if err := chown(path, int(uid), int(gid), false); err != nil {
 		return err
 	}
 	// In some cases, MkdirAll doesn't change the permissions, so run Chmod
@@ -875,7 +1053,7 @@ func MkdirAllWithPermissions(path string, mode os.FileMode, uid, gid int64) erro
 }
 
 func setFilePermissions(path string, mode os.FileMode, uid, gid int) error {
-	if err := os.Chown(path, uid, gid); err != nil {
+	if err := chown(path, uid, gid, false); err != nil {
 		return err
 	}
 	// manually set permissions on file, since the default umask (022) will interfere
@@ -976,7 +1154,11 @@ func CopyFileOrSymlink(src string, destDir string, root string) error {
 		}
 		return os.Symlink(link, destFile)
 	}
-	if err := otiai10Cpy.Copy(src, destFile, skipKanikoDir); err != nil {
+	// The files are cloned when the filesystem supports reflinks
+	if err := createParentDirectory(destFile, DoNotChangeUID, DoNotChangeGID); err != nil {
+		return err
+	}
+	if err := CopyTree(src, destFile, skipWorkDirs(src, destFile)); err != nil {
 		return errors.Wrap(err, "copying file")
 	}
 	if err := CopyOwnership(src, destDir, root); err != nil {
@@ -1030,8 +1212,8 @@ func CopyOwnership(src string, destDir string, root string) error {
 		if err != nil {
 			return errors.Wrap(err, "reading ownership")
 		}
-		stat := info.Sys().(*syscall.Stat_t)
-		return os.Chown(destPath, int(stat.Uid), int(stat.Gid))
+		uid, gid := ownerOf(path, info.Sys().(*syscall.Stat_t))
+		return chown(destPath, uid, gid, false)
 	})
 }
 
@@ -1057,7 +1239,7 @@ func createParentDirectory(path string, uid int, gid int) error {
 				os.Mkdir(dir, 0o755)
 				if uid != DoNotChangeUID {
 					if gid != DoNotChangeGID {
-						os.Chown(dir, uid, gid)
+						chown(dir, uid, gid, false)
 					} else {
 						return errors.New(fmt.Sprintf("UID=%d but GID=-1, i.e. it is not set for %s", uid, dir))
 					}
@@ -1143,7 +1325,7 @@ func gowalkDir(dir string, existingPaths map[string]struct{}, changeFunc func(st
 	callback := func(path string, ent *godirwalk.Dirent) error {
 		logrus.Tracef("Analyzing path '%s'", path)
 
-		if IsInIgnoreList(path) {
+		if CheckCleanedPathAgainstIgnoreList(path) {
 			if IsDestDir(path) {
 				logrus.Tracef("Skipping paths under '%s', as it is an ignored directory", path)
 				return filepath.SkipDir
@@ -25,6 +25,7 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"sort"
 	"strings"
 	"testing"
@@ -58,13 +59,13 @@ func Test_DetectFilesystemSkiplist(t *testing.T) {
 
 	err := DetectFilesystemIgnoreList(path)
 	expectedSkiplist := []IgnoreListEntry{
-		{"/kaniko", false},
-		{"/proc", false},
-		{"/dev", false},
-		{"/dev/pts", false},
-		{"/sys", false},
-		{"/etc/mtab", false},
-		{"/tmp/apt-key-gpghome", true},
+		{Path: "/kaniko", PrefixMatchOnly: false},
+		{Path: "/proc", PrefixMatchOnly: false},
+		{Path: "/dev", PrefixMatchOnly: false},
+		{Path: "/dev/pts", PrefixMatchOnly: false},
+		{Path: "/sys", PrefixMatchOnly: false},
+		{Path: "/etc/mtab", PrefixMatchOnly: false},
+		{Path: "/tmp/apt-key-gpghome", PrefixMatchOnly: true},
 	}
 	actualSkiplist := ignorelist
 	sort.Slice(actualSkiplist, func(i, j int) bool {
@@ -218,10 +219,7 @@ func Test_ParentDirectories(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			original := config.RootDir
-			defer func() { config.RootDir = original }()
-			config.RootDir = tt.rootDir
-			actual := ParentDirectories(tt.path)
+			actual := ParentDirectories(tt.path, tt.rootDir)
 
 			testutil.CheckErrorAndDeepEqual(t, false, nil, tt.expected, actual)
 		})
@@ -274,7 +272,7 @@ func Test_CheckIgnoreList(t *testing.T) {
 			name: "file ignored",
 			args: args{
 				path:       "/foo",
-				ignorelist: []IgnoreListEntry{{"/foo", false}},
+				ignorelist: []IgnoreListEntry{{Path: "/foo", PrefixMatchOnly: false}},
 			},
 			want: true,
 		},
@@ -282,7 +280,7 @@ func Test_CheckIgnoreList(t *testing.T) {
 			name: "directory ignored",
 			args: args{
 				path:       "/foo/bar",
-				ignorelist: []IgnoreListEntry{{"/foo", false}},
+				ignorelist: []IgnoreListEntry{{Path: "/foo", PrefixMatchOnly: false}},
 			},
 			want: true,
 		},
@@ -290,7 +288,7 @@ func Test_CheckIgnoreList(t *testing.T) {
 			name: "grandparent ignored",
 			args: args{
 				path:       "/foo/bar/baz",
-				ignorelist: []IgnoreListEntry{{"/foo", false}},
+				ignorelist: []IgnoreListEntry{{Path: "/foo", PrefixMatchOnly: false}},
 			},
 			want: true,
 		},
@@ -298,7 +296,7 @@ func Test_CheckIgnoreList(t *testing.T) {
 			name: "sibling ignored",
 			args: args{
 				path:       "/foo/bar/baz",
-				ignorelist: []IgnoreListEntry{{"/foo/bat", false}},
+				ignorelist: []IgnoreListEntry{{Path: "/foo/bat", PrefixMatchOnly: false}},
 			},
 			want: false,
 		},
@@ -306,10 +304,26 @@ func Test_CheckIgnoreList(t *testing.T) {
 			name: "prefix match only ",
 			args: args{
 				path:       "/tmp/apt-key-gpghome.xft/gpg.key",
-				ignorelist: []IgnoreListEntry{{"/tmp/apt-key-gpghome.*", true}},
+				ignorelist: []IgnoreListEntry{{Path: "/tmp/apt-key-gpghome.*", PrefixMatchOnly: true}},
 			},
 			want: true,
 		},
+		{
+			name: "regex ignored",
+			args: args{
+				path:       "/home/user/.cache/pip/wheel",
+				ignorelist: []IgnoreListEntry{{Regexp: regexp.MustCompile(`^(?:/home/[^/]+/\.cache)$`)}},
+			},
+			want: true,
+		},
+		{
+			name: "regex anchored",
+			args: args{
+				path:       "/srv/home/user/.cache",
+				ignorelist: []IgnoreListEntry{{Regexp: regexp.MustCompile(`^(?:/home/[^/]+/\.cache)$`)}},
+			},
+			want: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -326,6 +340,76 @@ func Test_CheckIgnoreList(t *testing.T) {
 	}
 }
 
+func TestNewIgnoreListEntry(t *testing.T) {
+	tests := []struct {
+		pattern   string
+		path      string
+		want      bool
+		shouldErr bool
+	}{
+		{pattern: "/var/cache/", path: "/var/cache/apt", want: true},
+		{pattern: "/var/cache/*", path: "/var/cache/apt/archives", want: true},
+		{pattern: "regex:/var/log/.*\\.log", path: "/var/log/dpkg.log", want: true},
+		{pattern: "regex:/var/log/.*\\.log", path: "/var/log/dpkg.log.1", want: false},
+		// Deprecated, kept matching nothing
+		{pattern: "var/cache", path: "/var/cache/apt", want: false},
+		{pattern: "/var/[cache", shouldErr: true},
+		{pattern: "regex:/var/(cache", shouldErr: true},
+		{pattern: "regex:var/cache", shouldErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			entry, err := NewIgnoreListEntry(tt.pattern)
+			testutil.CheckError(t, tt.shouldErr, err)
+			if tt.shouldErr {
+				return
+			}
+			testutil.CheckDeepEqual(t, tt.want, entry.matches(tt.path))
+		})
+	}
+}
+
+func TestIgnoreListEntry_MatchesUnder(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "var/log/apt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "var/log/apt/history.log"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The kernel filesystems and the ignored paths are not walked
+	for _, dir := range []string{"proc/1", "workspace/cache"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, dir, "status.txt"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	original := ignorelist
+	defer func() { ignorelist = original }()
+	AddToIgnoreList(IgnoreListEntry{Path: "/workspace/cache"})
+	for _, tt := range []struct {
+		pattern string
+		want    bool
+	}{
+		{pattern: "/var/log", want: true},
+		{pattern: "/var/*/apt", want: true},
+		{pattern: "/var/cache", want: false},
+		{pattern: "regex:/var/log/.*\\.log", want: true},
+		{pattern: "regex:/var/log/.*\\.gz", want: false},
+		{pattern: "var/log", want: false},
+		{pattern: "regex:/.*/status\\.txt", want: false},
+		{pattern: "regex:/workspace/cache/.*", want: true},
+	} {
+		t.Run(tt.pattern, func(t *testing.T) {
+			entry, err := NewIgnoreListEntry(tt.pattern)
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, tt.want, entry.MatchesUnder(root))
+		})
+	}
+}
+
 func TestHasFilepathPrefix(t *testing.T) {
 	type args struct {
 		path            string
@@ -1562,3 +1646,66 @@ func Test_setFileTimes(t *testing.T) {
 		})
 	}
 }
+
+func TestCleanupFilesystem(t *testing.T) {
+	root := t.TempDir()
+	original, originalPreserve := config.RootDir, cleanupPreserveList
+	defer func() { config.RootDir, cleanupPreserveList = original, originalPreserve }()
+	config.RootDir = root
+
+	files := map[string]string{
+		"usr/bin/tool":         "tool",
+		"usr/lib/libfoo.so":    "lib",
+		"opt/cache/a/entry":    "a",
+		"opt/cache/b/entry":    "b",
+		"etc/config":           "config",
+		"var/tool/keep.txt":    "keep",
+		"var/tool/discard.log": "discard",
+	}
+	if err := testutil.SetupFiles(root, files); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{filepath.Join(root, "opt/cache"), filepath.Join(root, "var/tool/*.txt")} {
+		entry, err := NewIgnoreListEntry(p)
+		testutil.CheckNoError(t, err)
+		AddToCleanupPreserveList(entry)
+	}
+
+	testutil.CheckNoError(t, CleanupFilesystem(root))
+
+	var got []string
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(root, path)
+			got = append(got, rel)
+		}
+		return err
+	})
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, []string{"opt/cache/a/entry", "opt/cache/b/entry", "var/tool/keep.txt"}, got)
+}
+
+func TestCopyFileOrSymlink_stagingDir(t *testing.T) {
+	root := t.TempDir()
+	staging := filepath.Join(root, "stages")
+	config.SetWorkDirs(staging, "", "")
+	defer config.SetWorkDirs("", "", "")
+	original := ignorelist
+	defer func() { ignorelist = original }()
+	AddToIgnoreList(IgnoreListEntry{Path: staging})
+
+	if err := os.MkdirAll(filepath.Join(root, "app"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "app", "main"), []byte("binary"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// COPY --from=stage / copies the whole filesystem of the stage, but not
+	// the staging directory it is copied into
+	dest := filepath.Join(staging, "0")
+	testutil.CheckNoError(t, CopyFileOrSymlink(".", dest, root))
+	b, err := os.ReadFile(filepath.Join(dest, "app", "main"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, "binary", string(b))
+	_, err = os.Stat(filepath.Join(dest, "stages"))
+	testutil.CheckDeepEqual(t, true, os.IsNotExist(err))
+}
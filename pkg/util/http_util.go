@@ -0,0 +1,107 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// httpTransports are the transports of the hosts the remote files are fetched
+// from with certificates of their own, keyed by host
+var httpTransports struct {
+	mu    sync.RWMutex
+	hosts map[string]http.RoundTripper
+}
+
+// httpClient fetches the remote files of the builds
+var httpClient = &http.Client{Transport: hostTransport{}}
+
+// HTTPClient returns the client fetching the remote files of the builds, like
+// the URLs of ADD instructions, remote Dockerfiles and build contexts, with the
+// certificates set with SetHTTPCertificates.
+func HTTPClient() *http.Client {
+	return httpClient
+}
+
+// SetHTTPCertificates sets the certificates of the hosts the remote files are
+// fetched from: the CA certificates verifying the hosts, in addition to the
+// system ones, and the client certificates presented to the hosts requiring
+// mutual TLS, given as /path/to/cert,/path/to/key. Both are keyed by host,
+// optionally followed by its port.
+func SetHTTPCertificates(certificates, clientCertificates map[string]string) error {
+	configs := map[string]*tls.Config{}
+	config := func(host string) *tls.Config {
+		if _, ok := configs[host]; !ok {
+			configs[host] = &tls.Config{}
+		}
+		return configs[host]
+	}
+	for host, path := range certificates {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate %s for %s: %w", path, host, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("failed to load certificate %s for %s: no certificate found", path, host)
+		}
+		config(host).RootCAs = pool
+	}
+	for host, path := range clientCertificates {
+		cert, err := loadClientCertificate(host, path)
+		if err != nil {
+			return err
+		}
+		config(host).Certificates = []tls.Certificate{cert}
+	}
+
+	hosts := map[string]http.RoundTripper{}
+	for host, c := range configs {
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.TLSClientConfig = c
+		hosts[host] = tr
+	}
+	httpTransports.mu.Lock()
+	defer httpTransports.mu.Unlock()
+	httpTransports.hosts = hosts
+	return nil
+}
+
+// hostTransport sends the requests with the transport of their host, for the
+// redirections to other hosts to use theirs.
+type hostTransport struct{}
+
+func (hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	httpTransports.mu.RLock()
+	tr, ok := httpTransports.hosts[req.URL.Host]
+	if !ok {
+		tr, ok = httpTransports.hosts[req.URL.Hostname()]
+	}
+	httpTransports.mu.RUnlock()
+	if !ok {
+		tr = http.DefaultTransport
+	}
+	return tr.RoundTrip(req)
+}
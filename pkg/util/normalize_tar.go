@@ -0,0 +1,153 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// normalizedEntry is an entry of a tarball being normalized, along with the
+// offset of its content in the tarball
+type normalizedEntry struct {
+	hdr    *tar.Header
+	offset int64
+}
+
+// NormalizeTar rewrites the uncompressed tarball at path for its content to
+// only depend on the files it holds: the entries are sorted by name, with the
+// hard links after their targets, their modification times are set to epoch,
+// or to the Unix epoch if it is zero, and the access and change times, the
+// owner names and the device numbers of the entries which aren't devices are
+// cleared. The owner ids are kept, as they are part of the files.
+func NormalizeTar(path string, epoch time.Time) error {
+	if epoch.IsZero() {
+		epoch = time.Unix(0, 0)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var entries []normalizedEntry
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "reading %s", path)
+		}
+		// The reader is at the start of the content of the entry
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, normalizedEntry{hdr: hdr, offset: offset})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].hdr.Name < entries[j].hdr.Name
+	})
+
+	out, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	tw := tar.NewWriter(out)
+	written := map[string]bool{}
+	// The hard links waiting for their targets, keyed by target
+	pending := map[string][]normalizedEntry{}
+	var write func(e normalizedEntry) error
+	write = func(e normalizedEntry) error {
+		hdr := normalizeHeader(e.hdr, epoch)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+			if _, err := io.Copy(tw, io.NewSectionReader(f, e.offset, hdr.Size)); err != nil {
+				return err
+			}
+		}
+		written[hdr.Name] = true
+		links := pending[hdr.Name]
+		delete(pending, hdr.Name)
+		for _, l := range links {
+			if err := write(l); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	targets := map[string]bool{}
+	for _, e := range entries {
+		targets[e.hdr.Name] = true
+	}
+	for _, e := range entries {
+		if e.hdr.Typeflag == tar.TypeLink && targets[e.hdr.Linkname] && !written[e.hdr.Linkname] {
+			pending[e.hdr.Linkname] = append(pending[e.hdr.Linkname], e)
+			continue
+		}
+		if err := write(e); err != nil {
+			return errors.Wrapf(err, "writing %s", e.hdr.Name)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), path)
+}
+
+// normalizeHeader returns a copy of hdr with its metadata normalized
+func normalizeHeader(hdr *tar.Header, epoch time.Time) *tar.Header {
+	n := *hdr
+	n.ModTime = epoch
+	n.AccessTime = time.Time{}
+	n.ChangeTime = time.Time{}
+	n.Uname = ""
+	n.Gname = ""
+	// The writer picks the format the header needs
+	n.Format = tar.FormatUnknown
+	if n.Typeflag != tar.TypeChar && n.Typeflag != tar.TypeBlock {
+		n.Devmajor = 0
+		n.Devminor = 0
+	}
+	if n.PAXRecords != nil {
+		records := map[string]string{}
+		for k, v := range n.PAXRecords {
+			switch k {
+			case "atime", "ctime", "mtime", "uname", "gname":
+			default:
+				records[k] = v
+			}
+		}
+		n.PAXRecords = records
+	}
+	return &n
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func writeTestTar(t *testing.T, path string, hdrs []*tar.Header, contents map[string]string) {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, hdr := range hdrs {
+		hdr.Size = int64(len(contents[hdr.Name]))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents[hdr.Name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNormalizeTar(t *testing.T) {
+	dir := t.TempDir()
+	contents := map[string]string{"bin/app": "app", "etc/config": "config"}
+	builder := func(mtime time.Time, uname string, reversed bool) string {
+		hdrs := []*tar.Header{
+			{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0o755, ModTime: mtime, Format: tar.FormatPAX},
+			{Name: "bin/app", Typeflag: tar.TypeReg, Mode: 0o755, ModTime: mtime, AccessTime: mtime, Uname: uname, Uid: 1000, Format: tar.FormatPAX},
+			{Name: "bin/app-link", Typeflag: tar.TypeLink, Linkname: "bin/app", ModTime: mtime},
+			{Name: "etc/config", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: mtime, Devmajor: 8},
+			{Name: "etc/.wh.old", Typeflag: tar.TypeReg, ModTime: mtime},
+		}
+		if reversed {
+			for i, j := 0, len(hdrs)-1; i < j; i, j = i+1, j-1 {
+				hdrs[i], hdrs[j] = hdrs[j], hdrs[i]
+			}
+			// The first file of the hard link is the one with the content
+			hdrs[2], hdrs[3] = &tar.Header{Name: "bin/app-link", Typeflag: tar.TypeReg, Mode: 0o755, ModTime: mtime, Uid: 1000},
+				&tar.Header{Name: "bin/app", Typeflag: tar.TypeLink, Linkname: "bin/app-link", ModTime: mtime, Uid: 1000}
+			contents = map[string]string{"bin/app-link": "app", "etc/config": "config"}
+		}
+		path := filepath.Join(dir, uname+".tar")
+		writeTestTar(t, path, hdrs, contents)
+		return path
+	}
+
+	epoch := time.Unix(1700000000, 0)
+	first := builder(time.Unix(1800000000, 500), "alice", false)
+	testutil.CheckNoError(t, NormalizeTar(first, epoch))
+
+	f, err := os.Open(first)
+	testutil.CheckNoError(t, err)
+	defer f.Close()
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		testutil.CheckNoError(t, err)
+		names = append(names, hdr.Name)
+		testutil.CheckDeepEqual(t, epoch.Unix(), hdr.ModTime.Unix())
+		testutil.CheckDeepEqual(t, "", hdr.Uname)
+		testutil.CheckDeepEqual(t, int64(0), hdr.Devmajor)
+		if hdr.Name == "bin/app" {
+			testutil.CheckDeepEqual(t, 1000, hdr.Uid)
+			b, err := io.ReadAll(tr)
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, "app", string(b))
+		}
+	}
+	testutil.CheckDeepEqual(t, []string{"bin/", "bin/app", "bin/app-link", "etc/.wh.old", "etc/config"}, names)
+
+	// A hard link sorted before its target is written after it
+	second := builder(time.Unix(1600000000, 0), "bob", true)
+	testutil.CheckNoError(t, NormalizeTar(second, epoch))
+	f2, err := os.Open(second)
+	testutil.CheckNoError(t, err)
+	defer f2.Close()
+	names = nil
+	tr = tar.NewReader(f2)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		testutil.CheckNoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	testutil.CheckDeepEqual(t, []string{"bin/", "bin/app-link", "bin/app", "etc/.wh.old", "etc/config"}, names)
+}
+
+func TestNormalizeTar_reproducible(t *testing.T) {
+	dir := t.TempDir()
+	contents := map[string]string{"a": "a", "b/c": "c"}
+	paths := []string{filepath.Join(dir, "1.tar"), filepath.Join(dir, "2.tar")}
+	writeTestTar(t, paths[0], []*tar.Header{
+		{Name: "a", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: time.Unix(100, 0), Uname: "root"},
+		{Name: "b/c", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: time.Unix(200, 0)},
+	}, contents)
+	writeTestTar(t, paths[1], []*tar.Header{
+		{Name: "b/c", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: time.Unix(300, 0), Gname: "wheel", Format: tar.FormatPAX},
+		{Name: "a", Typeflag: tar.TypeReg, Mode: 0o644, ModTime: time.Unix(400, 0)},
+	}, contents)
+
+	var normalized [][]byte
+	for _, p := range paths {
+		testutil.CheckNoError(t, NormalizeTar(p, time.Time{}))
+		b, err := os.ReadFile(p)
+		testutil.CheckNoError(t, err)
+		normalized = append(normalized, b)
+	}
+	if !bytes.Equal(normalized[0], normalized[1]) {
+		t.Error("expected the normalized tarballs to be identical")
+	}
+}
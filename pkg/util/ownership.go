@@ -0,0 +1,108 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+type fileOwner struct {
+	uid, gid int
+}
+
+// ownerStore records the ownership of the files which could not be applied on
+// disk, to be written into the layers anyway
+var ownerStore = struct {
+	sync.Mutex
+	enabled bool
+	owners  map[string]fileOwner
+}{owners: map[string]fileOwner{}}
+
+// EnableOwnershipFallback makes kaniko record the ownership it is not
+// permitted to apply to files, when running without the CAP_CHOWN capability,
+// instead of failing. The recorded ownership is used in the layers.
+func EnableOwnershipFallback() {
+	ownerStore.Lock()
+	defer ownerStore.Unlock()
+	ownerStore.enabled = true
+}
+
+// chown changes the ownership of path, without following symlinks if lchown
+// is set. When not permitted and the ownership fallback is enabled, the
+// ownership is recorded instead. A uid or gid of -1 is left unchanged.
+func chown(path string, uid, gid int, lchown bool) error {
+	change := os.Chown
+	if lchown {
+		change = os.Lchown
+	}
+	path = filepath.Clean(path)
+	err := change(path, uid, gid)
+
+	ownerStore.Lock()
+	defer ownerStore.Unlock()
+	if err == nil || !ownerStore.enabled || !errors.Is(err, syscall.EPERM) {
+		if err == nil {
+			delete(ownerStore.owners, path)
+		}
+		return err
+	}
+	owner, ok := ownerStore.owners[path]
+	if !ok {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+			owner = fileOwner{uid: int(stat.Uid), gid: int(stat.Gid)}
+		}
+	}
+	if uid >= 0 {
+		owner.uid = uid
+	}
+	if gid >= 0 {
+		owner.gid = gid
+	}
+	logrus.Tracef("Recording ownership %d:%d of %s", owner.uid, owner.gid, path)
+	ownerStore.owners[path] = owner
+	return nil
+}
+
+// recordedOwner returns the ownership recorded for path, if its ownership
+// could not be applied on disk.
+func recordedOwner(path string) (uid, gid int, ok bool) {
+	ownerStore.Lock()
+	defer ownerStore.Unlock()
+	owner, ok := ownerStore.owners[filepath.Clean(path)]
+	return owner.uid, owner.gid, ok
+}
+
+// ownerOf returns the ownership of path, recorded or read from stat.
+func ownerOf(path string, stat *syscall.Stat_t) (uid, gid int) {
+	if uid, gid, ok := recordedOwner(path); ok {
+		return uid, gid
+	}
+	if stat == nil {
+		return -1, -1
+	}
+	return int(stat.Uid), int(stat.Gid)
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestRecordedOwnership(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ownerStore.Lock()
+	ownerStore.owners[path] = fileOwner{uid: 1000, gid: 2000}
+	ownerStore.Unlock()
+	defer func() {
+		ownerStore.Lock()
+		delete(ownerStore.owners, path)
+		ownerStore.Unlock()
+	}()
+
+	// The recorded ownership is written into the layers
+	buf := new(bytes.Buffer)
+	tarw := NewTar(buf)
+	if err := tarw.AddFileToTar(path); err != nil {
+		t.Fatal(err)
+	}
+	tarw.Close()
+	hdr, err := tar.NewReader(buf).Next()
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, []int{1000, 2000}, []int{hdr.Uid, hdr.Gid})
+
+	// Applying the ownership on disk forgets the recorded one
+	testutil.CheckNoError(t, chown(path, os.Getuid(), os.Getgid(), false))
+	_, _, ok := recordedOwner(path)
+	testutil.CheckDeepEqual(t, false, ok)
+}
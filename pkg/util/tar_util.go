@@ -39,6 +39,8 @@ import (
 type Tar struct {
 	hardlinks map[uint64]string
 	w         *tar.Writer
+	// root is the root directory the files added are named relative to
+	root string
 }
 
 // NewTar will create an instance of Tar that can write files to the writer at f.
@@ -47,9 +49,16 @@ func NewTar(f io.Writer) Tar {
 	return Tar{
 		w:         w,
 		hardlinks: map[uint64]string{},
+		root:      config.RootDir,
 	}
 }
 
+// SetRoot names the files added with AddFileToTar relative to root, the root
+// directory of the filesystem of the build, instead of config.RootDir.
+func (t *Tar) SetRoot(root string) {
+	t.root = root
+}
+
 func CreateTarballOfDirectory(pathToDir string, f io.Writer) error {
 	if !filepath.IsAbs(pathToDir) {
 		return errors.New("pathToDir is not absolute")
@@ -77,6 +86,34 @@ func (t *Tar) Close() {
 
 // AddFileToTar adds the file at path p to the tar
 func (t *Tar) AddFileToTar(p string) error {
+	// allow entry for / to preserve permission changes etc. (currently ignored anyway by Docker runtime)
+	name := "/"
+	if p != t.root {
+		// Docker uses no leading / in the tarball
+		name = strings.TrimLeft(strings.TrimPrefix(p, t.root), "/")
+	}
+	return t.addFileToTar(p, name)
+}
+
+// CreateLayerOfDirectory writes the files under dir to f as the layer adding
+// them to the root of an image, named after their paths relative to dir.
+func CreateLayerOfDirectory(dir string, f io.Writer) error {
+	t := NewTar(f)
+	defer t.Close()
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		return t.addFileToTar(path, filepath.ToSlash(rel))
+	})
+}
+
+// addFileToTar adds the file at p to the tarball as name
+func (t *Tar) addFileToTar(p, name string) error {
 	i, err := os.Lstat(p)
 	if err != nil {
 		return fmt.Errorf("Failed to get file info for %s: %w", p, err)
@@ -97,19 +134,15 @@ func (t *Tar) AddFileToTar(p string) error {
 	if err != nil {
 		return err
 	}
+	if uid, gid, ok := recordedOwner(p); ok {
+		hdr.Uid, hdr.Gid = uid, gid
+	}
 	err = readSecurityXattrToTarHeader(p, hdr)
 	if err != nil {
 		return err
 	}
 
-	if p == config.RootDir {
-		// allow entry for / to preserve permission changes etc. (currently ignored anyway by Docker runtime)
-		hdr.Name = "/"
-	} else {
-		// Docker uses no leading / in the tarball
-		hdr.Name = strings.TrimPrefix(p, config.RootDir)
-		hdr.Name = strings.TrimLeft(hdr.Name, "/")
-	}
+	hdr.Name = name
 	if hdr.Typeflag == tar.TypeDir && !strings.HasSuffix(hdr.Name, "/") {
 		hdr.Name = hdr.Name + "/"
 	}
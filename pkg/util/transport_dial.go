@@ -0,0 +1,101 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The IP families the registries are dialed with
+const (
+	// DualStack dials both families, preferring the first address resolved
+	DualStack = "dual-stack"
+	// IPv4 only dials IPv4
+	IPv4 = "ipv4"
+	// IPv6 only dials IPv6
+	IPv6 = "ipv6"
+	// PreferIPv4 dials IPv4, then IPv6 if it fails
+	PreferIPv4 = "prefer-ipv4"
+	// PreferIPv6 dials IPv6, then IPv4 if it fails
+	PreferIPv6 = "prefer-ipv6"
+)
+
+// ValidateRegistryIPFamilies returns an error if one of the IP families set
+// with --registry-ip-family is invalid.
+func ValidateRegistryIPFamilies(families []string) error {
+	_, err := registryIPFamily(families, "")
+	return err
+}
+
+// registryIPFamily returns the IP family registryName is dialed with, its own
+// or the global one of families, by default dual stack.
+func registryIPFamily(families []string, registryName string) (string, error) {
+	family := DualStack
+	found := false
+	for _, f := range families {
+		registry, value := splitRegistryLimit(f)
+		switch value {
+		case DualStack, IPv4, IPv6, PreferIPv4, PreferIPv6:
+		default:
+			return "", fmt.Errorf("invalid registry IP family %q, must be %s, %s, %s, %s or %s", f, DualStack, IPv4, IPv6, PreferIPv4, PreferIPv6)
+		}
+		if registry == registryName {
+			family, found = value, true
+		} else if registry == "" && !found {
+			family = value
+		}
+	}
+	return family, nil
+}
+
+// dialContext returns the function dialing the connections of the transports
+// with the IP family family.
+func dialContext(family string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	switch family {
+	case IPv4:
+		return func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp4", addr)
+		}
+	case IPv6:
+		return func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp6", addr)
+		}
+	case PreferIPv4, PreferIPv6:
+		preferred, fallback := "tcp4", "tcp6"
+		if family == PreferIPv6 {
+			preferred, fallback = fallback, preferred
+		}
+		return func(ctx context.Context, _, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, preferred, addr)
+			if err == nil || ctx.Err() != nil {
+				return conn, err
+			}
+			logrus.Debugf("Dialing %s over %s failed, falling back to %s: %v", addr, preferred, fallback, err)
+			return dialer.DialContext(ctx, fallback, addr)
+		}
+	}
+	return dialer.DialContext
+}
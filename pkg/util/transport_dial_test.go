@@ -0,0 +1,80 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func Test_registryIPFamily(t *testing.T) {
+	tests := []struct {
+		name     string
+		families []string
+		registry string
+		expected string
+		wantErr  bool
+	}{
+		{name: "default", registry: "gcr.io", expected: DualStack},
+		{name: "global", families: []string{"ipv4"}, registry: "gcr.io", expected: IPv4},
+		{name: "own family", families: []string{"gcr.io=prefer-ipv6", "ipv4"}, registry: "gcr.io", expected: PreferIPv6},
+		{name: "other registry", families: []string{"quay.io=ipv6"}, registry: "gcr.io", expected: DualStack},
+		{name: "invalid", families: []string{"gcr.io=ipv5"}, registry: "quay.io", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			family, err := registryIPFamily(test.families, test.registry)
+			testutil.CheckErrorAndDeepEqual(t, test.wantErr, err, test.expected, family)
+		})
+	}
+}
+
+func Test_dialContext(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	for _, tt := range []struct {
+		family  string
+		wantErr bool
+	}{
+		{family: DualStack},
+		{family: IPv4},
+		{family: IPv6, wantErr: true},
+		{family: PreferIPv6},
+	} {
+		conn, err := dialContext(tt.family)(context.Background(), "tcp", l.Addr().String())
+		testutil.CheckError(t, tt.wantErr, err)
+		if err == nil {
+			conn.Close()
+		}
+	}
+}
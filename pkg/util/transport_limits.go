@@ -0,0 +1,192 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	units "github.com/docker/go-units"
+	"golang.org/x/time/rate"
+)
+
+// maxLimiterBurst is the largest amount of bytes read at once under a
+// bandwidth limit
+const maxLimiterBurst = 64 * 1024
+
+// registryLimits are the limits of the traffic to the registries, keyed by
+// registry, the limits keyed by "" being shared by the registries without
+// limits of their own.
+var registryLimits struct {
+	mu          sync.RWMutex
+	upload      map[string]*rate.Limiter
+	download    map[string]*rate.Limiter
+	connections map[string]chan struct{}
+}
+
+// SetRegistryLimits sets the bandwidth and connection limits of the traffic
+// to the registries. Each limit is either global, shared by the registries
+// without a limit of their own, or set for a registry as registry=limit.
+func SetRegistryLimits(opts config.RegistryOptions) error {
+	upload, err := parseBandwidthLimits(opts.RegistryUploadLimits)
+	if err != nil {
+		return err
+	}
+	download, err := parseBandwidthLimits(opts.RegistryDownloadLimits)
+	if err != nil {
+		return err
+	}
+	connections := map[string]chan struct{}{}
+	for _, l := range opts.RegistryMaxConnections {
+		registry, value := splitRegistryLimit(l)
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid registry connection limit %q, must be a positive number", l)
+		}
+		connections[registry] = make(chan struct{}, n)
+	}
+	registryLimits.mu.Lock()
+	defer registryLimits.mu.Unlock()
+	registryLimits.upload = upload
+	registryLimits.download = download
+	registryLimits.connections = connections
+	return nil
+}
+
+func parseBandwidthLimits(limits []string) (map[string]*rate.Limiter, error) {
+	limiters := map[string]*rate.Limiter{}
+	for _, l := range limits {
+		registry, value := splitRegistryLimit(l)
+		bytes, err := units.RAMInBytes(value)
+		if err != nil || bytes <= 0 {
+			return nil, fmt.Errorf("invalid registry bandwidth limit %q, must be a positive size per second like 10MB", l)
+		}
+		limiters[registry] = rate.NewLimiter(rate.Limit(bytes), int(min(bytes, maxLimiterBurst)))
+	}
+	return limiters, nil
+}
+
+// splitRegistryLimit splits a limit into the registry it is set for, or "",
+// and its value
+func splitRegistryLimit(l string) (string, string) {
+	if registry, value, ok := strings.Cut(l, "="); ok {
+		return registry, value
+	}
+	return "", l
+}
+
+func registryLimit[T any](limits map[string]T, registryName string) T {
+	if l, ok := limits[registryName]; ok {
+		return l
+	}
+	return limits[""]
+}
+
+// limitTransport returns tr limiting the traffic to registryName, or tr
+// itself if it is not limited.
+func limitTransport(tr http.RoundTripper, registryName string) http.RoundTripper {
+	registryLimits.mu.RLock()
+	defer registryLimits.mu.RUnlock()
+	lt := &limitedTransport{
+		inner:       tr,
+		upload:      registryLimit(registryLimits.upload, registryName),
+		download:    registryLimit(registryLimits.download, registryName),
+		connections: registryLimit(registryLimits.connections, registryName),
+	}
+	if lt.upload == nil && lt.download == nil && lt.connections == nil {
+		return tr
+	}
+	return lt
+}
+
+// limitedTransport caps the bandwidth of the request and response bodies, and
+// the number of requests in flight, until their responses are read.
+type limitedTransport struct {
+	inner       http.RoundTripper
+	upload      *rate.Limiter
+	download    *rate.Limiter
+	connections chan struct{}
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	release := func() {}
+	if t.connections != nil {
+		select {
+		case t.connections <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		release = sync.OnceFunc(func() { <-t.connections })
+	}
+	if t.upload != nil && req.Body != nil && req.Body != http.NoBody {
+		req = req.Clone(ctx)
+		req.Body = &limitedReader{rc: req.Body, limiter: t.upload, ctx: ctx}
+		if getBody := req.GetBody; getBody != nil {
+			req.GetBody = func() (io.ReadCloser, error) {
+				rc, err := getBody()
+				if err != nil {
+					return nil, err
+				}
+				return &limitedReader{rc: rc, limiter: t.upload, ctx: ctx}, nil
+			}
+		}
+	}
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &limitedReader{rc: resp.Body, limiter: t.download, ctx: ctx, release: release}
+	return resp, nil
+}
+
+// limitedReader reads at the rate of limiter, if any, and calls release once
+// closed.
+type limitedReader struct {
+	rc      io.ReadCloser
+	limiter *rate.Limiter
+	ctx     context.Context
+	release func()
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.limiter != nil && len(p) > r.limiter.Burst() {
+		p = p[:r.limiter.Burst()]
+	}
+	n, err := r.rc.Read(p)
+	if r.limiter != nil && n > 0 {
+		if werr := r.limiter.WaitN(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (r *limitedReader) Close() error {
+	err := r.rc.Close()
+	if r.release != nil {
+		r.release()
+	}
+	return err
+}
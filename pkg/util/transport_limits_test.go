@@ -0,0 +1,95 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chainguard-dev/kaniko/pkg/config"
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestSetRegistryLimits(t *testing.T) {
+	defer SetRegistryLimits(config.RegistryOptions{})
+	testutil.CheckError(t, true, SetRegistryLimits(config.RegistryOptions{RegistryUploadLimits: []string{"fast"}}))
+	testutil.CheckError(t, true, SetRegistryLimits(config.RegistryOptions{RegistryMaxConnections: []string{"gcr.io=0"}}))
+
+	testutil.CheckNoError(t, SetRegistryLimits(config.RegistryOptions{
+		RegistryDownloadLimits: []string{"10MB", "gcr.io=1MB"},
+		RegistryMaxConnections: []string{"gcr.io=2"},
+	}))
+	// The registries without limits of their own share the global ones
+	if limitTransport(http.DefaultTransport, "quay.io").(*limitedTransport).download != registryLimits.download[""] {
+		t.Error("expected quay.io to share the global download limit")
+	}
+	lt := limitTransport(http.DefaultTransport, "gcr.io").(*limitedTransport)
+	testutil.CheckDeepEqual(t, 2, cap(lt.connections))
+	testutil.CheckDeepEqual(t, 1024.0*1024, float64(lt.download.Limit()))
+
+	testutil.CheckNoError(t, SetRegistryLimits(config.RegistryOptions{}))
+	if limitTransport(http.DefaultTransport, "gcr.io") != http.DefaultTransport {
+		t.Error("expected no limits")
+	}
+}
+
+func TestLimitedTransport(t *testing.T) {
+	defer SetRegistryLimits(config.RegistryOptions{})
+	body := bytes.Repeat([]byte("a"), 48*1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+	testutil.CheckNoError(t, SetRegistryLimits(config.RegistryOptions{
+		RegistryDownloadLimits: []string{"32KiB"},
+		RegistryMaxConnections: []string{"1"},
+	}))
+	client := &http.Client{Transport: limitTransport(http.DefaultTransport.(*http.Transport).Clone(), "registry")}
+
+	// The bytes past the burst of the limiter are read at 32KiB per second
+	start := time.Now()
+	resp, err := client.Get(server.URL)
+	testutil.CheckNoError(t, err)
+	b, err := io.ReadAll(resp.Body)
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, len(body), len(b))
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected the download to be limited, took %s", elapsed)
+	}
+
+	// The second request waits for the body of the first to be closed
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected the second request to wait for the first")
+	case <-time.After(50 * time.Millisecond):
+	}
+	resp.Body.Close()
+	<-done
+}
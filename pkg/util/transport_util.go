@@ -22,9 +22,11 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 
 	"net/http"
 
+	"github.com/chainguard-dev/kaniko/pkg/audit"
 	"github.com/chainguard-dev/kaniko/pkg/config"
 	"github.com/sirupsen/logrus"
 )
@@ -53,6 +55,10 @@ func (p *X509CertPool) append(path string) error {
 
 var systemCertLoader CertPool
 
+// certPoolMu guards the system cert pool, to which the registry certificates
+// are appended when making the transports of concurrent requests
+var certPoolMu sync.Mutex
+
 type KeyPairLoader interface {
 	load(string, string) (tls.Certificate, error)
 }
@@ -82,30 +88,49 @@ func init() {
 func MakeTransport(opts config.RegistryOptions, registryName string) (http.RoundTripper, error) {
 	// Create a transport to set our user-agent.
 	var tr http.RoundTripper = http.DefaultTransport.(*http.Transport).Clone()
+	family, err := registryIPFamily(opts.RegistryIPFamilies, registryName)
+	if err != nil {
+		return nil, err
+	}
+	tr.(*http.Transport).DialContext = dialContext(family)
 	if opts.SkipTLSVerify || opts.SkipTLSVerifyRegistries.Contains(registryName) {
 		tr.(*http.Transport).TLSClientConfig = &tls.Config{
 			InsecureSkipVerify: true,
 		}
 	} else if certificatePath := opts.RegistriesCertificates[registryName]; certificatePath != "" {
-		if err := systemCertLoader.append(certificatePath); err != nil {
+		certPoolMu.Lock()
+		err := systemCertLoader.append(certificatePath)
+		pool := systemCertLoader.value()
+		certPoolMu.Unlock()
+		if err != nil {
 			return nil, fmt.Errorf("failed to load certificate %s for %s: %w", certificatePath, registryName, err)
 		}
 		tr.(*http.Transport).TLSClientConfig = &tls.Config{
-			RootCAs: systemCertLoader.value(),
+			RootCAs: pool,
 		}
 	}
 
 	if clientCertificatePath := opts.RegistriesClientCertificates[registryName]; clientCertificatePath != "" {
-		certFiles := strings.Split(clientCertificatePath, ",")
-		if len(certFiles) != 2 {
-			return nil, fmt.Errorf("failed to load client certificate/key '%s=%s', expected format: %s=/path/to/cert,/path/to/key", registryName, clientCertificatePath, registryName)
-		}
-		cert, err := systemKeyPairLoader.load(certFiles[0], certFiles[1])
+		cert, err := loadClientCertificate(registryName, clientCertificatePath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to load client certificate/key '%s' for %s: %w", clientCertificatePath, registryName, err)
+			return nil, err
 		}
 		tr.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{cert}
 	}
 
-	return tr, nil
+	return audit.Transport(limitTransport(tr, registryName)), nil
+}
+
+// loadClientCertificate loads the client certificate of host given as
+// /path/to/cert,/path/to/key
+func loadClientCertificate(host, clientCertificatePath string) (tls.Certificate, error) {
+	certFiles := strings.Split(clientCertificatePath, ",")
+	if len(certFiles) != 2 {
+		return tls.Certificate{}, fmt.Errorf("failed to load client certificate/key '%s=%s', expected format: %s=/path/to/cert,/path/to/key", host, clientCertificatePath, host)
+	}
+	cert, err := systemKeyPairLoader.load(certFiles[0], certFiles[1])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load client certificate/key '%s' for %s: %w", clientCertificatePath, host, err)
+	}
+	return cert, nil
 }
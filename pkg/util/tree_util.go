@@ -0,0 +1,168 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// CloneFile copies the regular file src to dest with the given mode. The copy
+// shares its data blocks with src when the filesystem supports reflinks, and
+// falls back to copying the content otherwise.
+func CloneFile(src, dest string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if err := cloneOrCopy(out, in); err != nil {
+		return errors.Wrapf(err, "copying %s to %s", src, dest)
+	}
+	return out.Close()
+}
+
+// cloneOrCopy copies the content of r to dest. When r is a file read from its
+// start, dest shares its data blocks if the filesystem supports reflinks, like
+// XFS and btrfs, instead of the content being copied.
+func cloneOrCopy(dest *os.File, r io.Reader) error {
+	if src, ok := r.(*os.File); ok {
+		if offset, err := src.Seek(0, io.SeekCurrent); err == nil && offset == 0 {
+			if err := unix.IoctlFileClone(int(dest.Fd()), int(src.Fd())); err == nil {
+				return nil
+			}
+		}
+	}
+	_, err := io.Copy(dest, r)
+	return err
+}
+
+// CopyTree copies the directory tree at src into dest, preserving file modes,
+// ownership, modification times, hardlinks, symlinks and file capabilities.
+// Regular files are copied with CloneFile. Destination paths for which skip
+// returns true are left untouched, along with their children.
+func CopyTree(src, dest string, skip func(path string) bool) error {
+	hardlinks := map[uint64]string{}
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if rel != "." && skip != nil && skip(target) {
+			logrus.Tracef("Not copying %s, as it's ignored", target)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		stat := getSyscallStatT(fi)
+		uid, gid := ownerOf(path, stat)
+
+		switch {
+		case fi.IsDir():
+			if err := MkdirAllWithPermissions(target, fi.Mode(), int64(uid), int64(gid)); err != nil {
+				return err
+			}
+			return nil
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := removeExisting(target); err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			return chown(target, uid, gid, true)
+		case fi.Mode().IsRegular():
+			if err := removeExisting(target); err != nil {
+				return err
+			}
+			if stat != nil && stat.Nlink > 1 {
+				if original, ok := hardlinks[stat.Ino]; ok {
+					return os.Link(original, target)
+				}
+				hardlinks[stat.Ino] = target
+			}
+			if err := CloneFile(path, target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+			if err := setFilePermissions(target, fi.Mode(), uid, gid); err != nil {
+				return err
+			}
+			if err := copySecurityXattr(path, target); err != nil {
+				return err
+			}
+			return setFileTimes(target, fi.ModTime(), fi.ModTime())
+		default:
+			// Image layers are extracted without device files, fifos or sockets
+			logrus.Debugf("Not copying %s, unsupported file type %s", path, fi.Mode().Type())
+			return nil
+		}
+	})
+}
+
+func removeExisting(path string) error {
+	if !FilepathExists(path) {
+		return nil
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return errors.Wrapf(err, "error removing %s to make way for new file", path)
+	}
+	return nil
+}
+
+func copySecurityXattr(src, dest string) error {
+	capability, err := Lgetxattr(src, securityCapabilityXattr)
+	if err != nil {
+		if errors.Is(err, unix.EOPNOTSUPP) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to read %q attribute from %q", securityCapabilityXattr, src)
+	}
+	if capability == nil {
+		return nil
+	}
+	if err := unix.Lsetxattr(dest, securityCapabilityXattr, capability, 0); err != nil && !errors.Is(err, unix.EOPNOTSUPP) {
+		return errors.Wrapf(err, "failed to write %q attribute to %q", securityCapabilityXattr, dest)
+	}
+	return nil
+}
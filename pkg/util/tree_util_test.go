@@ -0,0 +1,107 @@
+/*
+Copyright 2018 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/chainguard-dev/kaniko/testutil"
+)
+
+func TestCopyTree(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(src, "bin"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(src, "skipped"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"bin/sh":       "shell",
+		"skipped/file": "ignored",
+	} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(src, "bin/sh"), filepath.Join(src, "bin/bash")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("bin", filepath.Join(src, "sbin")); err != nil {
+		t.Fatal(err)
+	}
+
+	skip := func(path string) bool {
+		return path == filepath.Join(dest, "skipped")
+	}
+	if err := CopyTree(src, dest, skip); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dest, "bin/sh"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, "shell", string(content))
+
+	fi, err := os.Stat(filepath.Join(dest, "bin"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, os.FileMode(0o750), fi.Mode().Perm())
+
+	link, err := os.Readlink(filepath.Join(dest, "sbin"))
+	testutil.CheckErrorAndDeepEqual(t, false, err, "bin", link)
+
+	sh, err := os.Stat(filepath.Join(dest, "bin/sh"))
+	testutil.CheckNoError(t, err)
+	bash, err := os.Stat(filepath.Join(dest, "bin/bash"))
+	testutil.CheckNoError(t, err)
+	testutil.CheckDeepEqual(t, sh.Sys().(*syscall.Stat_t).Ino, bash.Sys().(*syscall.Stat_t).Ino)
+
+	testutil.CheckDeepEqual(t, false, FilepathExists(filepath.Join(dest, "skipped")))
+}
+
+func Test_cloneOrCopy(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("header,content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	copyFrom := func(offset int64) string {
+		in, err := os.Open(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer in.Close()
+		if _, err := in.Seek(offset, 0); err != nil {
+			t.Fatal(err)
+		}
+		out, err := os.Create(filepath.Join(dir, "dest"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+		testutil.CheckNoError(t, cloneOrCopy(out, in))
+		content, err := os.ReadFile(out.Name())
+		testutil.CheckNoError(t, err)
+		return string(content)
+	}
+	testutil.CheckDeepEqual(t, "header,content", copyFrom(0))
+	// Files read from elsewhere than their start are not cloned whole
+	testutil.CheckDeepEqual(t, "content", copyFrom(7))
+}
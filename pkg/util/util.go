@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"math/rand"
 	"os"
 	"strconv"
 	"sync"
@@ -163,6 +164,69 @@ func RedoHasher() func(string) (string, error) {
 	return hasher
 }
 
+// SampledHasher returns a hash function which looks at mtime, size, inode,
+// filemode, owner uid and gid like RedoHasher, and which also hashes the
+// contents of a random sample of the files, given by rate between 0 and 1.
+// The sampled files are hashed again every time they are checked, and a
+// warning is logged if their contents changed while their metadata did not,
+// in which case they are reported as changed.
+func SampledHasher(rate float64) func(string) (string, error) {
+	type sample struct {
+		key, hash string
+	}
+	full := Hasher()
+	var mu sync.Mutex
+	samples := map[string]*sample{}
+	diverged := map[string]bool{}
+	hasher := func(p string) (string, error) {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return "", err
+		}
+		h := md5.New()
+		h.Write([]byte(fi.Mode().String()))
+		h.Write([]byte(fi.ModTime().String()))
+		h.Write([]byte(strconv.FormatInt(fi.Size(), 16)))
+		if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+			h.Write([]byte(strconv.FormatUint(stat.Ino, 36)))
+			h.Write([]byte(","))
+			h.Write([]byte(strconv.FormatUint(uint64(stat.Uid), 36)))
+			h.Write([]byte(","))
+			h.Write([]byte(strconv.FormatUint(uint64(stat.Gid), 36)))
+		}
+		key := hex.EncodeToString(h.Sum(nil))
+
+		mu.Lock()
+		s, sampled := samples[p]
+		if !sampled && rand.Float64() < rate {
+			s = &sample{}
+			samples[p] = s
+			sampled = true
+		}
+		mu.Unlock()
+		if !sampled {
+			return key, nil
+		}
+
+		hash, err := full(p)
+		if err != nil {
+			return "", err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if s.key == key && s.hash != hash {
+			logrus.Warnf("Contents of %s changed without its metadata changing, consider using --snapshot-mode=full", p)
+			diverged[p] = true
+		}
+		s.key, s.hash = key, hash
+		if diverged[p] {
+			return key + hash, nil
+		}
+		return key, nil
+	}
+	return hasher
+}
+
 // SHA256 returns the shasum of the contents of r
 func SHA256(r io.Reader) (string, error) {
 	hasher := sha256.New()
@@ -20,7 +20,10 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/chainguard-dev/kaniko/testutil"
 )
@@ -102,3 +105,40 @@ func TestRetryWithResult(t *testing.T) {
 		t.Fatalf("Got result %d and error: %v", result, err)
 	}
 }
+
+func TestSampledHasher(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		rate        float64
+		wantChanged bool
+	}{
+		{name: "not sampled", rate: 0, wantChanged: false},
+		{name: "sampled", rate: 1, wantChanged: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file")
+			mtime := time.Unix(1700000000, 0)
+			write := func(content string) {
+				if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chtimes(path, mtime, mtime); err != nil {
+					t.Fatal(err)
+				}
+			}
+			hasher := SampledHasher(tt.rate)
+
+			write("foo")
+			before, err := hasher(path)
+			testutil.CheckNoError(t, err)
+			// Same size and modification time, different contents
+			write("bar")
+			after, err := hasher(path)
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, tt.wantChanged, before != after)
+			again, err := hasher(path)
+			testutil.CheckNoError(t, err)
+			testutil.CheckDeepEqual(t, after, again)
+		})
+	}
+}